@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/mailimport"
+	"github.com/spf13/cobra"
+)
+
+// importCmd loads an mbox file or Maildir tree into a user's mail
+var importCmd = &cobra.Command{
+	Use:   "import <path>",
+	Short: "Import an mbox file or Maildir into a user's mail",
+	Long: `Import every message in an mbox file or Maildir tree for a user.
+
+Messages whose Message-ID the user already has are skipped. Progress is saved
+after every batch, so running the same command again after an interruption
+resumes where it stopped; use --restart to scan the archive from the start.`,
+	Args:         cobra.ExactArgs(1),
+	RunE:         runImport,
+	SilenceUsage: true,
+}
+
+func init() {
+	importCmd.Flags().StringP("user", "u", "", "ID or email address of the user to import into (required)")
+	importCmd.Flags().StringP("format", "f", mailimport.FormatAuto, "archive format: auto, mbox or maildir")
+	importCmd.Flags().Bool("dry-run", false, "parse and deduplicate without storing anything")
+	importCmd.Flags().Int("batch-size", mailimport.DefaultBatchSize, "messages written per transaction")
+	importCmd.Flags().Bool("restart", false, "ignore saved progress and start from the beginning")
+	importCmd.MarkFlagRequired("user")
+
+	rootCmd.AddCommand(importCmd)
+}
+
+func runImport(cmd *cobra.Command, args []string) error {
+	userFlag, _ := cmd.Flags().GetString("user")
+	format, _ := cmd.Flags().GetString("format")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	batchSize, _ := cmd.Flags().GetInt("batch-size")
+	restart, _ := cmd.Flags().GetBool("restart")
+
+	logger.Initialize(logger.LevelInfo)
+
+	// Stop between messages on Ctrl+C; the batch read so far is committed
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	source, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	dbService, err := initDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbService.Close()
+
+	userID, err := resolveUser(ctx, dbService, userFlag)
+	if err != nil {
+		return err
+	}
+
+	// Imported mail is old; rules and scripts don't send mail for it, and
+	// its bounces don't suppress recipients
+	store, _, err := initStore(ctx, dbService, nil, false)
+	if err != nil {
+		return err
+	}
+
+	out := cmd.ErrOrStderr()
+	im := &mailimport.Importer{
+		Store:     store,
+		UserID:    userID,
+		BatchSize: batchSize,
+		DryRun:    dryRun,
+		OnFailure: func(f mailimport.Failure) {
+			fmt.Fprintf(out, "skipped message at %s: %v\n", f.Location, f.Err)
+		},
+	}
+
+	var checkpoint *schema.ImportCheckpoint
+	if !restart {
+		checkpoint, err = im.Checkpoint(ctx, source)
+		if err != nil {
+			return err
+		}
+	} else if !dryRun {
+		if err := im.Reset(ctx, source); err != nil {
+			return err
+		}
+	}
+
+	cursor := ""
+	if checkpoint != nil {
+		if checkpoint.Completed {
+			fmt.Fprintf(out, "%s was already imported (%d imported, %d duplicates, %d failed); use --restart to scan it again\n",
+				source, checkpoint.Imported, checkpoint.Duplicates, checkpoint.Failed)
+			return nil
+		}
+		cursor = checkpoint.Cursor
+		fmt.Fprintf(out, "resuming %s after %d imported messages\n", source, checkpoint.Imported)
+	}
+
+	src, err := mailimport.Open(source, format, cursor)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	start := time.Now()
+	var lastReport time.Time
+	im.OnProgress = func(s mailimport.Stats) {
+		if time.Since(lastReport) < time.Second {
+			return
+		}
+		lastReport = time.Now()
+		fmt.Fprintf(out, "%s imported %d, duplicates %d, failed %d\n", progressPercent(s), s.Imported, s.Duplicates, s.Failed)
+	}
+
+	stats, err := im.Run(ctx, src, source, checkpoint)
+	prefix := "imported"
+	if dryRun {
+		prefix = "dry run: would import"
+	}
+	fmt.Fprintf(out, "%s %d messages, %d duplicates, %d failed in %s\n",
+		prefix, stats.Imported, stats.Duplicates, stats.Failed, time.Since(start).Round(time.Millisecond))
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(out, "interrupted; run the same command again to resume")
+		return nil
+	}
+	return err
+}
+
+// resolveUser accepts a user ID or an email address.
+func resolveUser(ctx context.Context, db database.Service, idOrEmail string) (string, error) {
+	user, err := db.Queries().GetUserByID(ctx, idOrEmail)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = db.Queries().GetUserByEmail(ctx, idOrEmail)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("no user with ID or email %q", idOrEmail)
+		}
+		return "", fmt.Errorf("failed to get user: %w", err)
+	}
+	return user.ID, nil
+}
+
+func progressPercent(s mailimport.Stats) string {
+	if s.Total <= 0 {
+		return "[100%]"
+	}
+	return fmt.Sprintf("[%3d%%]", s.Done*100/s.Total)
+}
@@ -6,18 +6,38 @@ package cmd
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/emersion/go-smtp"
 	"github.com/parsel-email/lib-go/logger"
 	"github.com/parsel-email/lib-go/tracing"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/bounce"
+	"github.com/parsel-email/mailroom/internal/changelog"
+	"github.com/parsel-email/mailroom/internal/credentials"
 	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/drafts"
+	"github.com/parsel-email/mailroom/internal/imapd"
+	"github.com/parsel-email/mailroom/internal/imapsync"
+	"github.com/parsel-email/mailroom/internal/inbound"
+	"github.com/parsel-email/mailroom/internal/jobs"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/outbound"
+	"github.com/parsel-email/mailroom/internal/rules"
 	"github.com/parsel-email/mailroom/internal/server"
+	"github.com/parsel-email/mailroom/internal/sieve"
+	"github.com/parsel-email/mailroom/internal/webhook"
 	"github.com/spf13/cobra"
 )
 
@@ -49,39 +69,105 @@ var rootCmd = &cobra.Command{
 			logger.Info(ctx, "OpenTelemetry tracing initialized")
 		}
 
-		// Initialize the database service
-		dbService, err := database.Initialize()
+		// Initialize the database service and run migrations
+		dbService, err := initDatabase(ctx)
 		if err != nil {
 			logger.Error(ctx, "Failed to initialize database", "error", err)
 			os.Exit(1)
 		}
-		logger.Info(ctx, "Database initialized successfully")
 
-		// Get the *sql.DB instance from the service for migrations
-		sqlDBProvider, ok := dbService.(interface{ DB() *sql.DB })
-		if !ok {
-			logger.Error(ctx, "Database service does not provide access to *sql.DB instance for migrations")
+		// The auth package does not require explicit initialization with dbService here.
+		// Server handlers will use the dbService passed to server.NewServer().
+
+		// Background work runs on a queue kept in the database
+		queue, err := initQueue(ctx, dbService)
+		if err != nil {
+			logger.Error(ctx, "Failed to initialize job queue", "error", err)
 			os.Exit(1)
 		}
 
-		// Run database migrations
-		migrationsPath := filepath.Join("db", "migrations")
-		if err := database.MigrateUp(sqlDBProvider.DB(), migrationsPath); err != nil {
-			logger.Error(ctx, "Failed to run database migrations", "error", err)
+		// All ingestion paths deliver through the same message store
+		store, mailer, err := initStore(ctx, dbService, queue, true)
+		if err != nil {
+			logger.Error(ctx, "Failed to initialize message store", "error", err)
 			os.Exit(1)
 		}
-		logger.Info(ctx, "Database migrations completed successfully")
+		queue.Start()
 
-		// The auth package does not require explicit initialization with dbService here.
-		// Server handlers will use the dbService passed to server.NewServer().
+		// Delete message content no message refers to anymore
+		blobs := store.Blobs()
+		blobs.Start()
+
+		// Delete old entries from the change log
+		compactor, err := changelog.NewCompactorFromEnv(dbService)
+		if err != nil {
+			logger.Error(ctx, "Failed to configure change log compaction", "error", err)
+			os.Exit(1)
+		}
+		compactor.Start()
+
+		// Post recorded events to users' webhook endpoints
+		dispatcher := webhook.NewDispatcher(dbService)
+		dispatcher.Start()
+
+		// Send drafts users schedule, if mail can be sent
+		var scheduler *drafts.Scheduler
+		if mailer != nil {
+			scheduler = drafts.NewScheduler(dbService, mailer)
+			scheduler.Start()
+		}
+
+		// Pull mail from users' remote IMAP accounts if sync is configured
+		syncWorker, err := imapsync.NewWorkerFromEnv(store)
+		switch {
+		case errors.Is(err, imapsync.ErrMissingEncryptionKey):
+			logger.Info(ctx, "IMAP sync disabled; SYNC_ENCRYPTION_KEY is not set")
+		case err != nil:
+			logger.Error(ctx, "Failed to configure IMAP sync", "error", err)
+			os.Exit(1)
+		default:
+			syncWorker.Start()
+		}
 
-		server := server.NewServer(dbService) // Pass dbService to NewServer
+		server := server.NewServer(dbService, store, syncWorker, mailer) // Pass dbService to NewServer
+
+		// Start the LMTP/SMTP listener if one is configured
+		var inboundServer *inbound.Server
+		if cfg, ok := inbound.ConfigFromEnv(); ok {
+			inboundServer = inbound.NewServer(cfg, store)
+			verifier := mailauth.NewVerifier(net.DefaultResolver, cfg.Domain)
+			verifier.SetTrustedSealers(strings.Split(os.Getenv("ARC_TRUSTED_SEALERS"), ","))
+			inboundServer.SetVerifier(verifier)
+			go func() {
+				logger.Info(ctx, "Starting inbound listener", "protocol", inboundServer.Protocol(), "addr", cfg.Addr)
+				if err := inboundServer.ListenAndServe(); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+					logger.Error(ctx, "Inbound listener error", "error", err)
+				}
+			}()
+		}
+
+		// Serve mail to IMAP clients if a listener is configured
+		var imapServer *imapd.Server
+		imapCfg, ok, err := imapd.ConfigFromEnv()
+		if err != nil {
+			logger.Error(ctx, "Failed to configure IMAP listener", "error", err)
+			os.Exit(1)
+		}
+		if ok {
+			imapServer = imapd.NewServer(imapCfg, store, credentials.New(dbService))
+			go func() {
+				logger.Info(ctx, "Starting IMAP listener", "tls", imapCfg.TLS, "addr", imapCfg.Addr)
+				if err := imapServer.ListenAndServe(); err != nil {
+					logger.Error(ctx, "IMAP listener error", "error", err)
+				}
+			}()
+		}
 
 		// Create a done channel to signal when the shutdown is complete
 		done := make(chan bool, 1)
 
 		// Run graceful shutdown in a separate goroutine
-		go gracefulShutdown(server, tracerShutdown, dbService, done) // Pass dbService to gracefulShutdown
+		go gracefulShutdown(server, inboundServer, imapServer, syncWorker, queue, dispatcher, scheduler, blobs, compactor, tracerShutdown, dbService, done) // Pass dbService to gracefulShutdown
 
 		logger.Info(ctx, "Starting server", "port", os.Getenv("PORT"))
 		err = server.ListenAndServe()
@@ -95,7 +181,129 @@ var rootCmd = &cobra.Command{
 	},
 }
 
-func gracefulShutdown(apiServer *http.Server, tracerShutdown func(context.Context) error, dbService database.Service, done chan bool) {
+// initDatabase opens the database service and applies pending migrations.
+func initDatabase(ctx context.Context) (database.Service, error) {
+	dbService, err := database.Initialize()
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(ctx, "Database initialized successfully")
+
+	// Get the *sql.DB instance from the service for migrations
+	sqlDBProvider, ok := dbService.(interface{ DB() *sql.DB })
+	if !ok {
+		dbService.Close()
+		return nil, errors.New("database service does not provide access to *sql.DB instance for migrations")
+	}
+
+	// Run database migrations
+	migrationsPath := filepath.Join("db", "migrations")
+	if err := database.MigrateUp(sqlDBProvider.DB(), migrationsPath); err != nil {
+		dbService.Close()
+		return nil, fmt.Errorf("failed to run database migrations: %w", err)
+	}
+	logger.Info(ctx, "Database migrations completed successfully")
+
+	return dbService, nil
+}
+
+// initQueue creates the job queue and, if there are messages stored before
+// search and threading existed or whose process job was lost, queues
+// bringing them up to date.
+func initQueue(ctx context.Context, dbService database.Service) (*jobs.Queue, error) {
+	queue, err := jobs.NewFromEnv(dbService)
+	if err != nil {
+		return nil, err
+	}
+
+	q := dbService.Queries()
+	backfills := []struct {
+		kind    string
+		run     func(context.Context) (int, error)
+		pending func(context.Context) (bool, error)
+		done    string
+	}{
+		{"messages.index", dbService.IndexMessages, func(ctx context.Context) (bool, error) {
+			rows, err := q.ListUnindexedMessageIDs(ctx, 1)
+			return len(rows) > 0, err
+		}, "Indexed messages for search"},
+		{"messages.thread", dbService.ThreadMessages, func(ctx context.Context) (bool, error) {
+			rows, err := q.ListUnthreadedMessages(ctx, 1)
+			return len(rows) > 0, err
+		}, "Threaded messages"},
+	}
+	for _, b := range backfills {
+		queue.Handle(b.kind, func(ctx context.Context, _ json.RawMessage) error {
+			n, err := b.run(ctx)
+			if n > 0 {
+				logger.Info(ctx, b.done, "count", n)
+			}
+			return err
+		}, jobs.Options{Timeout: time.Hour})
+		pending, err := b.pending(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for %s work: %w", b.kind, err)
+		}
+		if !pending {
+			continue
+		}
+		if _, err := queue.Enqueue(ctx, b.kind, nil, jobs.PriorityLow); err != nil {
+			return nil, err
+		}
+	}
+	return queue, nil
+}
+
+// initStore creates the message store and its blob store, moving message
+// content still kept in the database into the blob store. Stored messages
+// are published to webhooks, then run through their owner's rules and then
+// their active Sieve script; in jobs on queue, or inline if queue is nil.
+// If send is set, bounces among them are recorded, and if a relay is
+// configured it also returns the mailer that rules and scripts forward and
+// respond through; otherwise they don't send mail and the mailer is nil.
+func initStore(ctx context.Context, dbService database.Service, queue *jobs.Queue, send bool) (*mailstore.Store, *outbound.Mailer, error) {
+	blobs, err := blobstore.NewFromEnv(dbService)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to configure blob store: %w", err)
+	}
+	store := mailstore.New(dbService, blobs)
+	if queue != nil {
+		store.SetQueue(queue)
+	}
+
+	var mailer *outbound.Mailer
+	if send {
+		mailer, err = outbound.NewMailerFromEnv(store)
+		switch {
+		case errors.Is(err, outbound.ErrRelayNotConfigured):
+			logger.Info(ctx, "Outbound mail disabled; SMTP_RELAY_ADDR is not set")
+		case err != nil:
+			return nil, nil, fmt.Errorf("failed to configure outbound mail: %w", err)
+		}
+	}
+	engine := rules.New(dbService)
+	filter := sieve.New(dbService)
+	if mailer != nil {
+		engine.SetForwarder(mailer)
+		filter.SetSender(mailer)
+	}
+	store.Use(webhook.New(dbService))
+	if send {
+		// Imported bounces are old; the addresses they name may work again
+		store.Use(bounce.New(dbService))
+	}
+	store.Use(engine)
+	store.Use(filter)
+
+	if n, err := store.MoveInlineContent(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to move message content to the blob store: %w", err)
+	} else if n > 0 {
+		logger.Info(ctx, "Moved message content to the blob store", "count", n)
+	}
+	return store, mailer, nil
+}
+
+func gracefulShutdown(apiServer *http.Server, inboundServer *inbound.Server, imapServer *imapd.Server, syncWorker *imapsync.Worker, queue *jobs.Queue, dispatcher *webhook.Dispatcher, scheduler *drafts.Scheduler, blobs *blobstore.Store, compactor *changelog.Compactor, tracerShutdown func(context.Context) error, dbService database.Service, done chan bool) {
 	// Create context that listens for the interrupt signal from the OS.
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
@@ -105,19 +313,81 @@ func gracefulShutdown(apiServer *http.Server, tracerShutdown func(context.Contex
 
 	logger.Info(context.Background(), "shutting down gracefully, press Ctrl+C again to force")
 
-	// The context is used to inform the server it has 5 seconds to finish
-	// the request it is currently handling
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// Each component gets 5 seconds of its own to finish what it is doing,
+	// so that one that is slow to stop doesn't cut the others short
+	within := func(shutdown func(context.Context) error) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return shutdown(ctx)
+	}
 
-	// Shutdown the HTTP server
-	if err := apiServer.Shutdown(shutdownCtx); err != nil {
+	// Shutdown the HTTP server; event streams and push connections are
+	// ended as it starts, and clients reconnect on their own
+	if err := within(apiServer.Shutdown); err != nil {
 		logger.Error(context.Background(), "Server forced to shutdown with error", "error", err)
 	}
 
+	// Stop the inbound listener, letting in-flight transactions finish
+	if inboundServer != nil {
+		if err := within(inboundServer.Shutdown); err != nil {
+			logger.Error(context.Background(), "Inbound listener forced to shutdown with error", "error", err)
+		}
+	}
+
+	// Close IMAP connections; clients reconnect on their own
+	if imapServer != nil {
+		if err := within(imapServer.Shutdown); err != nil {
+			logger.Error(context.Background(), "IMAP listener forced to shutdown with error", "error", err)
+		}
+	}
+
+	// Stop IMAP sync; progress is saved per message
+	if syncWorker != nil {
+		if err := within(syncWorker.Shutdown); err != nil {
+			logger.Error(context.Background(), "IMAP sync forced to shutdown with error", "error", err)
+		}
+	}
+
+	// Let running jobs finish; queued ones run after a restart
+	if queue != nil {
+		if err := within(queue.Shutdown); err != nil {
+			logger.Error(context.Background(), "Job queue forced to shutdown with error", "error", err)
+		}
+	}
+
+	// Stop webhook delivery; interrupted deliveries are retried after a
+	// restart
+	if dispatcher != nil {
+		if err := within(dispatcher.Shutdown); err != nil {
+			logger.Error(context.Background(), "Webhook dispatcher forced to shutdown with error", "error", err)
+		}
+	}
+
+	// Stop sending scheduled drafts; interrupted sends are retried after a
+	// restart
+	if scheduler != nil {
+		if err := within(scheduler.Shutdown); err != nil {
+			logger.Error(context.Background(), "Draft scheduler forced to shutdown with error", "error", err)
+		}
+	}
+
+	// Stop blob garbage collection
+	if blobs != nil {
+		if err := within(blobs.Shutdown); err != nil {
+			logger.Error(context.Background(), "Blob garbage collection forced to shutdown with error", "error", err)
+		}
+	}
+
+	// Stop change log compaction
+	if compactor != nil {
+		if err := within(compactor.Shutdown); err != nil {
+			logger.Error(context.Background(), "Change log compaction forced to shutdown with error", "error", err)
+		}
+	}
+
 	// Shutdown the tracer provider
 	if tracerShutdown != nil {
-		if err := tracerShutdown(shutdownCtx); err != nil {
+		if err := within(tracerShutdown); err != nil {
 			logger.Error(context.Background(), "Failed to shutdown tracer provider", "error", err)
 		}
 	}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/parsel-email/mailroom/internal/sieve"
+	"github.com/spf13/cobra"
+)
+
+// sieveCmd groups the commands that work with Sieve scripts
+var sieveCmd = &cobra.Command{
+	Use:   "sieve",
+	Short: "Work with Sieve filtering scripts",
+}
+
+// sieveCheckCmd validates a script and optionally dry-runs it
+var sieveCheckCmd = &cobra.Command{
+	Use:   "check <script> [message.eml]",
+	Short: "Validate a Sieve script and dry-run it against a message",
+	Long: `Validate a Sieve script the way uploads are validated, reporting the line of
+the first error. Given a message file, also run the script against it and print
+the actions it would take without storing or sending anything.
+
+Use --envelope-from and --envelope-to to test envelope and vacation rules, and
+--address for the recipient's own addresses.`,
+	Args:         cobra.RangeArgs(1, 2),
+	RunE:         runSieveCheck,
+	SilenceUsage: true,
+}
+
+func init() {
+	sieveCheckCmd.Flags().String("envelope-from", "", "SMTP MAIL FROM address of the message")
+	sieveCheckCmd.Flags().String("envelope-to", "", "SMTP RCPT TO address of the message")
+	sieveCheckCmd.Flags().StringSlice("address", nil, "the recipient's own addresses, for vacation")
+
+	sieveCmd.AddCommand(sieveCheckCmd)
+	rootCmd.AddCommand(sieveCmd)
+}
+
+func runSieveCheck(cmd *cobra.Command, args []string) error {
+	envFrom, _ := cmd.Flags().GetString("envelope-from")
+	envTo, _ := cmd.Flags().GetString("envelope-to")
+	addresses, _ := cmd.Flags().GetStringSlice("address")
+	out := cmd.OutOrStdout()
+
+	src, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	script, err := sieve.Compile(string(src))
+	if err != nil {
+		var serr *sieve.Error
+		if errors.As(err, &serr) {
+			return fmt.Errorf("%s:%d: %s", args[0], serr.Line, serr.Msg)
+		}
+		return err
+	}
+	fmt.Fprintf(out, "%s: ok\n", args[0])
+	if len(args) < 2 {
+		return nil
+	}
+
+	raw, err := os.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	m, err := sieve.NewMessage(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[1], err)
+	}
+	m.EnvelopeFrom, m.EnvelopeTo = envFrom, envTo
+	m.Addresses = addresses
+	if envTo != "" {
+		m.Addresses = append(m.Addresses, envTo)
+	}
+
+	res, err := script.Run(m)
+	if err != nil {
+		fmt.Fprintf(out, "runtime error: %v\n", err)
+	}
+	printSieveResult(out, res)
+	return nil
+}
+
+// printSieveResult lists the actions of a dry run, one per line.
+func printSieveResult(out io.Writer, res *sieve.Result) {
+	flags := func(f []string) string {
+		if len(f) == 0 {
+			return ""
+		}
+		return " flags " + strings.Join(f, " ")
+	}
+
+	if res.Keep {
+		fmt.Fprintf(out, "keep%s\n", flags(res.KeepFlags))
+	}
+	for _, f := range res.FileInto {
+		fmt.Fprintf(out, "fileinto %q%s\n", f.Mailbox, flags(f.Flags))
+	}
+	for _, r := range res.Redirects {
+		fmt.Fprintf(out, "redirect %s\n", r.Address)
+	}
+	if res.Reject != nil {
+		fmt.Fprintf(out, "reject %q\n", res.Reject.Reason)
+	}
+	if v := res.Vacation; v != nil {
+		fmt.Fprintf(out, "vacation to %s every %d days (handle %s): %q\n", v.Sender, v.Days, v.Handle, v.Reason)
+	}
+	if !res.Keep && len(res.FileInto) == 0 {
+		fmt.Fprintln(out, "discard")
+	}
+}
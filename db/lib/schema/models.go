@@ -5,9 +5,310 @@
 package schema
 
 import (
+	"database/sql"
 	"time"
 )
 
+type Attachment struct {
+	MessageID   string `json:"message_id"`
+	Part        string `json:"part"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id"`
+	Size        int64  `json:"size"`
+	BlobHash    string `json:"blob_hash"`
+}
+
+type Blob struct {
+	Hash       string       `json:"hash"`
+	Size       int64        `json:"size"`
+	RefCount   int64        `json:"ref_count"`
+	CreatedAt  time.Time    `json:"created_at"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+	Lease      string       `json:"lease"`
+	LeaseUntil sql.NullTime `json:"lease_until"`
+}
+
+type Bounce struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"user_id"`
+	MessageID     string    `json:"message_id"`
+	SentMessageID string    `json:"sent_message_id"`
+	Recipient     string    `json:"recipient"`
+	Action        string    `json:"action"`
+	Status        string    `json:"status"`
+	Diagnostic    string    `json:"diagnostic"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type ChangeLog struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Type      string    `json:"type"`
+	MessageID string    `json:"message_id"`
+	Name      string    `json:"name"`
+	Added     bool      `json:"added"`
+	CreatedAt time.Time `json:"created_at"`
+	Modseq    int64     `json:"modseq"`
+	LabelID   string    `json:"label_id"`
+}
+
+type Credential struct {
+	ID         string       `json:"id"`
+	UserID     string       `json:"user_id"`
+	Kind       string       `json:"kind"`
+	Name       string       `json:"name"`
+	SecretHash string       `json:"secret_hash"`
+	CreatedAt  time.Time    `json:"created_at"`
+	LastUsedAt sql.NullTime `json:"last_used_at"`
+}
+
+type Draft struct {
+	ID         string       `json:"id"`
+	UserID     string       `json:"user_id"`
+	Content    string       `json:"content"`
+	Status     string       `json:"status"`
+	SendAt     sql.NullTime `json:"send_at"`
+	Attempts   int64        `json:"attempts"`
+	Lease      string       `json:"lease"`
+	LeaseUntil sql.NullTime `json:"lease_until"`
+	LastError  string       `json:"last_error"`
+	CreatedAt  time.Time    `json:"created_at"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+}
+
+type ImapAccount struct {
+	ID           string       `json:"id"`
+	UserID       string       `json:"user_id"`
+	Host         string       `json:"host"`
+	Port         int64        `json:"port"`
+	Security     string       `json:"security"`
+	Username     string       `json:"username"`
+	Password     []byte       `json:"password"`
+	Enabled      bool         `json:"enabled"`
+	LastError    string       `json:"last_error"`
+	LastSyncedAt sql.NullTime `json:"last_synced_at"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+type ImapFolderState struct {
+	AccountID     string    `json:"account_id"`
+	Folder        string    `json:"folder"`
+	UidValidity   int64     `json:"uid_validity"`
+	UidNext       int64     `json:"uid_next"`
+	HighestModseq int64     `json:"highest_modseq"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type ImapMessage struct {
+	AccountID   string `json:"account_id"`
+	Folder      string `json:"folder"`
+	UidValidity int64  `json:"uid_validity"`
+	Uid         int64  `json:"uid"`
+	MessageID   string `json:"message_id"`
+}
+
+type ImportCheckpoint struct {
+	UserID     string    `json:"user_id"`
+	Source     string    `json:"source"`
+	Cursor     string    `json:"cursor"`
+	Imported   int64     `json:"imported"`
+	Duplicates int64     `json:"duplicates"`
+	Failed     int64     `json:"failed"`
+	Completed  bool      `json:"completed"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type JmapState struct {
+	UserID string `json:"user_id"`
+	Type   string `json:"type"`
+	State  int64  `json:"state"`
+}
+
+type Job struct {
+	ID          string       `json:"id"`
+	Kind        string       `json:"kind"`
+	Payload     string       `json:"payload"`
+	Priority    int64        `json:"priority"`
+	Status      string       `json:"status"`
+	Attempts    int64        `json:"attempts"`
+	MaxAttempts int64        `json:"max_attempts"`
+	RunAt       time.Time    `json:"run_at"`
+	Lease       string       `json:"lease"`
+	LeaseUntil  sql.NullTime `json:"lease_until"`
+	LastError   string       `json:"last_error"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+type Label struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Path      string    `json:"path"`
+	Color     string    `json:"color"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type MailboxState struct {
+	UserID      string `json:"user_id"`
+	Name        string `json:"name"`
+	UidValidity int64  `json:"uid_validity"`
+	UidNext     int64  `json:"uid_next"`
+}
+
+type MailboxUid struct {
+	UserID    string `json:"user_id"`
+	Mailbox   string `json:"mailbox"`
+	Uid       int64  `json:"uid"`
+	MessageID string `json:"message_id"`
+}
+
+type Message struct {
+	ID                string    `json:"id"`
+	UserID            string    `json:"user_id"`
+	InternetMessageID string    `json:"internet_message_id"`
+	InReplyTo         string    `json:"in_reply_to"`
+	MessageReferences string    `json:"message_references"`
+	Subject           string    `json:"subject"`
+	FromName          string    `json:"from_name"`
+	FromAddress       string    `json:"from_address"`
+	SentAt            time.Time `json:"sent_at"`
+	ReceivedAt        time.Time `json:"received_at"`
+	Size              int64     `json:"size"`
+	HasAttachments    bool      `json:"has_attachments"`
+	CreatedAt         time.Time `json:"created_at"`
+	ThreadID          string    `json:"thread_id"`
+	IsRead            bool      `json:"is_read"`
+	Archived          bool      `json:"archived"`
+}
+
+type MessageAddress struct {
+	MessageID string `json:"message_id"`
+	Kind      string `json:"kind"`
+	Position  int64  `json:"position"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+}
+
+type MessageAuth struct {
+	MessageID     string `json:"message_id"`
+	Dkim          string `json:"dkim"`
+	Spf           string `json:"spf"`
+	Dmarc         string `json:"dmarc"`
+	DmarcPolicy   string `json:"dmarc_policy"`
+	HeaderFrom    string `json:"header_from"`
+	Results       string `json:"results"`
+	Arc           string `json:"arc"`
+	DmarcOverride string `json:"dmarc_override"`
+}
+
+type MessageBody struct {
+	MessageID string `json:"message_id"`
+	TextBody  string `json:"text_body"`
+	HtmlBody  string `json:"html_body"`
+	Raw       []byte `json:"raw"`
+	RawHash   string `json:"raw_hash"`
+}
+
+type MessageHeader struct {
+	MessageID string `json:"message_id"`
+	Position  int64  `json:"position"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+}
+
+type MessageKeyword struct {
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Keyword   string `json:"keyword"`
+}
+
+type MessageLabel struct {
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Label     string `json:"label"`
+}
+
+type MessageSearch struct {
+	Subject     string `json:"subject"`
+	FromText    string `json:"from_text"`
+	ToText      string `json:"to_text"`
+	Body        string `json:"body"`
+	Attachments string `json:"attachments"`
+}
+
+type MessageSearchContent struct {
+	DocID       int64  `json:"doc_id"`
+	MessageID   string `json:"message_id"`
+	UserID      string `json:"user_id"`
+	Subject     string `json:"subject"`
+	FromText    string `json:"from_text"`
+	ToText      string `json:"to_text"`
+	Body        string `json:"body"`
+	Attachments string `json:"attachments"`
+}
+
+type MessageThreadRef struct {
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Ref       string `json:"ref"`
+}
+
+type Rule struct {
+	ID             string    `json:"id"`
+	UserID         string    `json:"user_id"`
+	Name           string    `json:"name"`
+	Position       int64     `json:"position"`
+	Enabled        bool      `json:"enabled"`
+	Match          string    `json:"match"`
+	Conditions     string    `json:"conditions"`
+	Actions        string    `json:"actions"`
+	StopProcessing bool      `json:"stop_processing"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type SieveScript struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Content   string    `json:"content"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SieveVacation struct {
+	UserID string    `json:"user_id"`
+	Handle string    `json:"handle"`
+	Sender string    `json:"sender"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+type Suppression struct {
+	UserID          string    `json:"user_id"`
+	Address         string    `json:"address"`
+	Status          string    `json:"status"`
+	Diagnostic      string    `json:"diagnostic"`
+	BounceMessageID string    `json:"bounce_message_id"`
+	SentMessageID   string    `json:"sent_message_id"`
+	Bounces         int64     `json:"bounces"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type Thread struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"user_id"`
+	Subject       string    `json:"subject"`
+	BaseSubject   string    `json:"base_subject"`
+	MessageCount  int64     `json:"message_count"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
 type User struct {
 	ID         string    `json:"id"`
 	Email      string    `json:"email"`
@@ -15,3 +316,39 @@ type User struct {
 	ProviderID string    `json:"provider_id"`
 	CreatedAt  time.Time `json:"created_at"`
 }
+
+type UserModseq struct {
+	UserID      string `json:"user_id"`
+	Modseq      int64  `json:"modseq"`
+	Compacted   int64  `json:"compacted"`
+	CompactedID int64  `json:"compacted_id"`
+}
+
+type WebhookDelivery struct {
+	ID             string       `json:"id"`
+	EndpointID     string       `json:"endpoint_id"`
+	UserID         string       `json:"user_id"`
+	EventID        string       `json:"event_id"`
+	Event          string       `json:"event"`
+	Payload        string       `json:"payload"`
+	Status         string       `json:"status"`
+	Attempts       int64        `json:"attempts"`
+	NextAttemptAt  time.Time    `json:"next_attempt_at"`
+	LastAttemptAt  sql.NullTime `json:"last_attempt_at"`
+	LastStatusCode int64        `json:"last_status_code"`
+	LastError      string       `json:"last_error"`
+	CreatedAt      time.Time    `json:"created_at"`
+	DeliveredAt    sql.NullTime `json:"delivered_at"`
+}
+
+type WebhookEndpoint struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Url         string    `json:"url"`
+	Secret      string    `json:"secret"`
+	Events      string    `json:"events"`
+	Description string    `json:"description"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
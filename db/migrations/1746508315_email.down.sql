@@ -1 +1,6 @@
 -- Migration Down
+DROP TABLE IF EXISTS attachment;
+DROP TABLE IF EXISTS message_body;
+DROP TABLE IF EXISTS message_header;
+DROP TABLE IF EXISTS message_address;
+DROP TABLE IF EXISTS message;
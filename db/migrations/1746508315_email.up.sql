@@ -0,0 +1,59 @@
+-- Migration Up
+CREATE TABLE IF NOT EXISTS message (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    internet_message_id TEXT NOT NULL DEFAULT '',
+    in_reply_to TEXT NOT NULL DEFAULT '',
+    message_references TEXT NOT NULL DEFAULT '',
+    subject TEXT NOT NULL DEFAULT '',
+    from_name TEXT NOT NULL DEFAULT '',
+    from_address TEXT NOT NULL DEFAULT '',
+    sent_at DATETIME NOT NULL,
+    received_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    size INTEGER NOT NULL DEFAULT 0,
+    has_attachments BOOLEAN NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS message_user_received_idx ON message (user_id, received_at DESC, id);
+CREATE INDEX IF NOT EXISTS message_user_internet_message_id_idx ON message (user_id, internet_message_id);
+
+-- To, Cc, Bcc and Reply-To addresses, in header order
+CREATE TABLE IF NOT EXISTS message_address (
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    kind VARCHAR(16) NOT NULL,
+    position INTEGER NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    address TEXT NOT NULL,
+    PRIMARY KEY (message_id, kind, position)
+);
+
+CREATE INDEX IF NOT EXISTS message_address_address_idx ON message_address (address);
+
+-- Every header field of the top-level entity, in the order it appeared
+CREATE TABLE IF NOT EXISTS message_header (
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (message_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS message_body (
+    message_id VARCHAR(255) PRIMARY KEY REFERENCES message(id) ON DELETE CASCADE,
+    text_body TEXT NOT NULL DEFAULT '',
+    html_body TEXT NOT NULL DEFAULT '',
+    raw BLOB NOT NULL
+);
+
+-- Attachment metadata; part is the dotted MIME part path, e.g. "2.1"
+CREATE TABLE IF NOT EXISTS attachment (
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    part VARCHAR(64) NOT NULL,
+    filename TEXT NOT NULL DEFAULT '',
+    content_type TEXT NOT NULL DEFAULT 'application/octet-stream',
+    disposition VARCHAR(16) NOT NULL DEFAULT 'attachment',
+    content_id TEXT NOT NULL DEFAULT '',
+    size INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (message_id, part)
+);
@@ -0,0 +1,4 @@
+-- Migration Down
+DROP TABLE IF EXISTS imap_message;
+DROP TABLE IF EXISTS imap_folder_state;
+DROP TABLE IF EXISTS imap_account;
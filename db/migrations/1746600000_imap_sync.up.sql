@@ -0,0 +1,38 @@
+-- Migration Up
+-- Remote IMAP mailboxes pulled into a user's mail; password is sealed with SYNC_ENCRYPTION_KEY
+CREATE TABLE IF NOT EXISTS imap_account (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    host TEXT NOT NULL,
+    port INTEGER NOT NULL DEFAULT 993,
+    security VARCHAR(16) NOT NULL DEFAULT 'tls',
+    username TEXT NOT NULL,
+    password BLOB NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT 1,
+    last_error TEXT NOT NULL DEFAULT '',
+    last_synced_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS imap_account_user_idx ON imap_account (user_id);
+
+-- Incremental sync position per remote folder
+CREATE TABLE IF NOT EXISTS imap_folder_state (
+    account_id VARCHAR(255) NOT NULL REFERENCES imap_account(id) ON DELETE CASCADE,
+    folder TEXT NOT NULL,
+    uid_validity INTEGER NOT NULL,
+    uid_next INTEGER NOT NULL,
+    highest_modseq INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (account_id, folder)
+);
+
+-- Remote messages already imported, keyed by their UID within a UIDVALIDITY epoch
+CREATE TABLE IF NOT EXISTS imap_message (
+    account_id VARCHAR(255) NOT NULL REFERENCES imap_account(id) ON DELETE CASCADE,
+    folder TEXT NOT NULL,
+    uid_validity INTEGER NOT NULL,
+    uid INTEGER NOT NULL,
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    PRIMARY KEY (account_id, folder, uid_validity, uid)
+);
@@ -0,0 +1,14 @@
+-- Migration Up
+-- Resume position of a bulk import (mailroom import) per user and source path.
+-- cursor is source specific: a byte offset for mbox, the last file for Maildir
+CREATE TABLE IF NOT EXISTS import_checkpoint (
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    source TEXT NOT NULL,
+    cursor TEXT NOT NULL DEFAULT '',
+    imported INTEGER NOT NULL DEFAULT 0,
+    duplicates INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    completed BOOLEAN NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, source)
+);
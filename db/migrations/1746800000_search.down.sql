@@ -0,0 +1,6 @@
+-- Migration Down
+DROP TRIGGER IF EXISTS message_search_content_au;
+DROP TRIGGER IF EXISTS message_search_content_ad;
+DROP TRIGGER IF EXISTS message_search_content_ai;
+DROP TABLE IF EXISTS message_search;
+DROP TABLE IF EXISTS message_search_content;
@@ -0,0 +1,38 @@
+-- Migration Up
+-- Text indexed for full-text search, one row per message. The FTS5 table
+-- below uses it as external content, so search results and snippets come
+-- from here; the triggers keep the index in step with it.
+CREATE TABLE IF NOT EXISTS message_search_content (
+    doc_id INTEGER PRIMARY KEY,
+    message_id VARCHAR(255) NOT NULL UNIQUE REFERENCES message(id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    from_text TEXT NOT NULL DEFAULT '',
+    to_text TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL DEFAULT '',
+    attachments TEXT NOT NULL DEFAULT ''
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS message_search USING fts5(
+    subject, from_text, to_text, body, attachments,
+    content = 'message_search_content',
+    content_rowid = 'doc_id',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+
+CREATE TRIGGER IF NOT EXISTS message_search_content_ai AFTER INSERT ON message_search_content BEGIN
+    INSERT INTO message_search (rowid, subject, from_text, to_text, body, attachments)
+    VALUES (new.doc_id, new.subject, new.from_text, new.to_text, new.body, new.attachments);
+END;
+
+CREATE TRIGGER IF NOT EXISTS message_search_content_ad AFTER DELETE ON message_search_content BEGIN
+    INSERT INTO message_search (message_search, rowid, subject, from_text, to_text, body, attachments)
+    VALUES ('delete', old.doc_id, old.subject, old.from_text, old.to_text, old.body, old.attachments);
+END;
+
+CREATE TRIGGER IF NOT EXISTS message_search_content_au AFTER UPDATE ON message_search_content BEGIN
+    INSERT INTO message_search (message_search, rowid, subject, from_text, to_text, body, attachments)
+    VALUES ('delete', old.doc_id, old.subject, old.from_text, old.to_text, old.body, old.attachments);
+    INSERT INTO message_search (rowid, subject, from_text, to_text, body, attachments)
+    VALUES (new.doc_id, new.subject, new.from_text, new.to_text, new.body, new.attachments);
+END;
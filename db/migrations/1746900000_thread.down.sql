@@ -0,0 +1,5 @@
+-- Migration Down
+DROP INDEX IF EXISTS message_user_thread_idx;
+ALTER TABLE message DROP COLUMN thread_id;
+DROP TABLE IF EXISTS message_thread_ref;
+DROP TABLE IF EXISTS thread;
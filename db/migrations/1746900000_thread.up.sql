@@ -0,0 +1,32 @@
+-- Migration Up
+-- Conversations. subject is the subject of the earliest message; base_subject
+-- is the normalized subject used to attach replies that lost their references
+CREATE TABLE IF NOT EXISTS thread (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    subject TEXT NOT NULL DEFAULT '',
+    base_subject TEXT NOT NULL DEFAULT '',
+    message_count INTEGER NOT NULL DEFAULT 0,
+    last_message_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS thread_user_last_message_idx ON thread (user_id, last_message_at DESC, id);
+CREATE INDEX IF NOT EXISTS thread_user_base_subject_idx ON thread (user_id, base_subject);
+
+-- Message-IDs a message refers to through References and In-Reply-To. A
+-- message joins the thread of any message it refers to or that refers to it,
+-- so a parent that arrives after its replies links them up.
+CREATE TABLE IF NOT EXISTS message_thread_ref (
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    ref TEXT NOT NULL,
+    PRIMARY KEY (message_id, ref)
+);
+
+CREATE INDEX IF NOT EXISTS message_thread_ref_user_ref_idx ON message_thread_ref (user_id, ref);
+
+-- Empty until the message has been threaded
+ALTER TABLE message ADD COLUMN thread_id VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS message_user_thread_idx ON message (user_id, thread_id);
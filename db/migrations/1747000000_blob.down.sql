@@ -0,0 +1,4 @@
+-- Migration Down
+ALTER TABLE attachment DROP COLUMN blob_hash;
+ALTER TABLE message_body DROP COLUMN raw_hash;
+DROP TABLE IF EXISTS blob;
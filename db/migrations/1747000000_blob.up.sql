@@ -0,0 +1,24 @@
+-- Migration Up
+-- Content-addressed blobs (raw messages and attachment bodies) kept in the
+-- blob store backend, keyed by the hex SHA-256 of their content.
+-- ref_count counts the message_body and attachment rows using a blob; blobs
+-- at zero for longer than the GC grace period are deleted. updated_at is
+-- refreshed whenever a blob is written or referenced. A blob being deleted
+-- is leased until lease_until by the instance deleting it, and can't be
+-- written or referenced until then; lease identifies the deletion
+CREATE TABLE IF NOT EXISTS blob (
+    hash VARCHAR(64) PRIMARY KEY,
+    size INTEGER NOT NULL,
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL,
+    lease VARCHAR(255) NOT NULL DEFAULT '',
+    lease_until DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS blob_garbage_idx ON blob (ref_count, updated_at);
+
+-- raw is only used by messages stored before the blob store; their content
+-- is moved out on startup
+ALTER TABLE message_body ADD COLUMN raw_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE attachment ADD COLUMN blob_hash VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- Migration Down
+ALTER TABLE message DROP COLUMN archived;
+ALTER TABLE message DROP COLUMN is_read;
+DROP TABLE IF EXISTS message_label;
+DROP TABLE IF EXISTS rule;
@@ -0,0 +1,32 @@
+-- Migration Up
+-- Per-user rules run against every stored message in position order.
+-- conditions and actions are JSON arrays validated by the rules package;
+-- match is 'all' or 'any'
+CREATE TABLE IF NOT EXISTS rule (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0,
+    enabled BOOLEAN NOT NULL DEFAULT 1,
+    match VARCHAR(8) NOT NULL DEFAULT 'all',
+    conditions TEXT NOT NULL DEFAULT '[]',
+    actions TEXT NOT NULL DEFAULT '[]',
+    stop_processing BOOLEAN NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS rule_user_position_idx ON rule (user_id, position, created_at);
+
+-- Labels applied to messages, by name
+CREATE TABLE IF NOT EXISTS message_label (
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    label TEXT NOT NULL,
+    PRIMARY KEY (message_id, label)
+);
+
+CREATE INDEX IF NOT EXISTS message_label_user_label_idx ON message_label (user_id, label);
+
+ALTER TABLE message ADD COLUMN is_read BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE message ADD COLUMN archived BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Migration Down
+DROP TABLE IF EXISTS message_keyword;
+DROP TABLE IF EXISTS sieve_vacation;
+DROP TABLE IF EXISTS sieve_script;
@@ -0,0 +1,33 @@
+-- Migration Up
+-- Sieve scripts uploaded by users. At most one script per user is active and
+-- runs against every stored message
+CREATE TABLE IF NOT EXISTS sieve_script (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    content TEXT NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, name)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS sieve_script_active_idx ON sieve_script (user_id) WHERE active = 1;
+
+-- When a vacation response was last sent to a sender, so that each sender
+-- gets at most one response per :days period
+CREATE TABLE IF NOT EXISTS sieve_vacation (
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    handle TEXT NOT NULL,
+    sender TEXT NOT NULL,
+    sent_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, handle, sender)
+);
+
+-- IMAP keywords and system flags other than \Seen set on messages
+CREATE TABLE IF NOT EXISTS message_keyword (
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    keyword TEXT NOT NULL,
+    PRIMARY KEY (message_id, keyword)
+);
@@ -0,0 +1,3 @@
+-- Migration Down
+DROP TABLE IF EXISTS webhook_delivery;
+DROP TABLE IF EXISTS webhook_endpoint;
@@ -0,0 +1,40 @@
+-- Migration Up
+-- HTTP endpoints users register to receive events about their mail. events is
+-- a JSON array of event types; an empty array subscribes to all of them
+CREATE TABLE IF NOT EXISTS webhook_endpoint (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL DEFAULT '[]',
+    description TEXT NOT NULL DEFAULT '',
+    enabled BOOLEAN NOT NULL DEFAULT 1,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_endpoint_user_idx ON webhook_endpoint (user_id);
+
+-- One event to be delivered to one endpoint. status is 'pending' until the
+-- endpoint accepts it ('delivered') or it runs out of attempts ('dead'). A
+-- pending delivery being attempted is leased by pushing next_attempt_at past
+-- the attempt's timeout
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+    id VARCHAR(255) PRIMARY KEY,
+    endpoint_id VARCHAR(255) NOT NULL REFERENCES webhook_endpoint(id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL,
+    last_attempt_at DATETIME,
+    last_status_code INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_due_idx ON webhook_delivery (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS webhook_delivery_endpoint_idx ON webhook_delivery (endpoint_id, created_at);
@@ -0,0 +1,24 @@
+-- Migration Up
+-- Background work. A queued job is due at run_at; a running one is leased
+-- until lease_until, after which another worker may claim it again. lease
+-- identifies the current claim so that a worker whose lease ran out can't
+-- complete a job someone else now holds. Finished jobs are deleted; jobs
+-- that run out of attempts stay behind as 'dead'
+CREATE TABLE IF NOT EXISTS job (
+    id VARCHAR(255) PRIMARY KEY,
+    kind VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL DEFAULT '{}',
+    priority INTEGER NOT NULL DEFAULT 0,
+    status VARCHAR(16) NOT NULL DEFAULT 'queued',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL,
+    run_at DATETIME NOT NULL,
+    lease VARCHAR(255) NOT NULL DEFAULT '',
+    lease_until DATETIME,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS job_queued_idx ON job (status, priority, run_at);
+CREATE INDEX IF NOT EXISTS job_lease_idx ON job (status, lease_until);
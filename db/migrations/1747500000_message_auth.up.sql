@@ -0,0 +1,14 @@
+-- Migration Up
+-- The outcome of authenticating a message delivered over SMTP or LMTP. dkim,
+-- spf and dmarc hold the result of each check (pass, fail, none, ...);
+-- dmarc_policy is the policy the From domain asks for when DMARC fails and
+-- results is the full Authentication-Results header value (RFC 8601)
+CREATE TABLE IF NOT EXISTS message_auth (
+    message_id VARCHAR(255) PRIMARY KEY REFERENCES message(id) ON DELETE CASCADE,
+    dkim VARCHAR(16) NOT NULL,
+    spf VARCHAR(16) NOT NULL,
+    dmarc VARCHAR(16) NOT NULL,
+    dmarc_policy VARCHAR(16) NOT NULL DEFAULT '',
+    header_from TEXT NOT NULL DEFAULT '',
+    results TEXT NOT NULL
+);
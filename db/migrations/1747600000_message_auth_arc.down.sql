@@ -0,0 +1,3 @@
+-- Migration Down
+ALTER TABLE message_auth DROP COLUMN dmarc_override;
+ALTER TABLE message_auth DROP COLUMN arc;
@@ -0,0 +1,5 @@
+-- Migration Up
+-- The outcome of validating the message's ARC chain, and the trusted ARC
+-- sealer, if any, that vouched for a message failing DMARC
+ALTER TABLE message_auth ADD COLUMN arc VARCHAR(16) NOT NULL DEFAULT 'none';
+ALTER TABLE message_auth ADD COLUMN dmarc_override VARCHAR(255) NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- Migration Down
+DROP TABLE IF EXISTS draft;
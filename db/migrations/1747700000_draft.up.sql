@@ -0,0 +1,22 @@
+-- Migration Up
+-- Messages users are composing. content is the JSON of the message as the
+-- send API takes it. A 'scheduled' draft is sent once send_at passes; while
+-- it is being sent it is 'sending' and leased until lease_until, after which
+-- it may be claimed again. lease identifies the current claim. Sent drafts
+-- are deleted; drafts that can't be sent are left 'failed' with last_error
+CREATE TABLE IF NOT EXISTS draft (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    content TEXT NOT NULL DEFAULT '{}',
+    status VARCHAR(16) NOT NULL DEFAULT 'draft',
+    send_at DATETIME,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    lease VARCHAR(255) NOT NULL DEFAULT '',
+    lease_until DATETIME,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS draft_user_idx ON draft (user_id, updated_at);
+CREATE INDEX IF NOT EXISTS draft_due_idx ON draft (status, send_at);
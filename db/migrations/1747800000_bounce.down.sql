@@ -0,0 +1,3 @@
+-- Migration Down
+DROP TABLE IF EXISTS suppression;
+DROP TABLE IF EXISTS bounce;
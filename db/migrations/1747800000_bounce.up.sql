@@ -0,0 +1,32 @@
+-- Migration Up
+-- Delivery failures reported by bounces users received. message_id is the
+-- bounce; sent_message_id is the user's message that bounced, or '' when it
+-- isn't stored. status is the RFC 3463 status code, e.g. 5.1.1
+CREATE TABLE IF NOT EXISTS bounce (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    sent_message_id VARCHAR(255) NOT NULL DEFAULT '',
+    recipient VARCHAR(255) NOT NULL,
+    action VARCHAR(16) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT '',
+    diagnostic TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS bounce_sent_message_idx ON bounce (user_id, sent_message_id);
+
+-- Recipients a user's mail is not sent to because mail to them failed
+-- permanently. The latest bounce is kept; bounces counts them all
+CREATE TABLE IF NOT EXISTS suppression (
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    address VARCHAR(255) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT '',
+    diagnostic TEXT NOT NULL DEFAULT '',
+    bounce_message_id VARCHAR(255) NOT NULL DEFAULT '',
+    sent_message_id VARCHAR(255) NOT NULL DEFAULT '',
+    bounces INTEGER NOT NULL DEFAULT 1,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, address)
+);
@@ -0,0 +1,19 @@
+-- Migration Up
+-- Labels users create. message_label refers to them by path, whose segments
+-- are separated by '/'; the system labels (Inbox, Sent, Archive, Trash,
+-- Spam) have no row here
+CREATE TABLE IF NOT EXISTS label (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    color VARCHAR(7) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, path)
+);
+
+-- Labels rules and sieve scripts have already applied
+INSERT OR IGNORE INTO label (id, user_id, path)
+SELECT lower(hex(randomblob(16))), user_id, label FROM message_label
+WHERE label NOT IN ('Inbox', 'Sent', 'Archive', 'Trash', 'Spam')
+GROUP BY user_id, label;
@@ -0,0 +1,15 @@
+-- Migration Down
+DROP TRIGGER IF EXISTS jmap_state_thread_au;
+DROP TRIGGER IF EXISTS jmap_state_label_au;
+DROP TRIGGER IF EXISTS jmap_state_label_ad;
+DROP TRIGGER IF EXISTS jmap_state_label_ai;
+DROP TRIGGER IF EXISTS jmap_state_message_label_au;
+DROP TRIGGER IF EXISTS jmap_state_message_label_ad;
+DROP TRIGGER IF EXISTS jmap_state_message_label_ai;
+DROP TRIGGER IF EXISTS jmap_state_message_keyword_ad;
+DROP TRIGGER IF EXISTS jmap_state_message_keyword_ai;
+DROP TRIGGER IF EXISTS jmap_state_message_thread_au;
+DROP TRIGGER IF EXISTS jmap_state_message_au;
+DROP TRIGGER IF EXISTS jmap_state_message_ad;
+DROP TRIGGER IF EXISTS jmap_state_message_ai;
+DROP TABLE IF EXISTS jmap_state;
@@ -0,0 +1,86 @@
+-- Migration Up
+-- How often each user's mailboxes, emails and threads have changed, as the
+-- state strings JMAP clients sync against. type is 'Mailbox', 'Email' or
+-- 'Thread'. The triggers below count every change, whichever code path
+-- makes it
+CREATE TABLE IF NOT EXISTS jmap_state (
+    user_id VARCHAR(255) NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    state INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, type)
+);
+
+-- Messages are Emails, are counted by their Mailboxes and make up Threads
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_ai AFTER INSERT ON message BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES
+        (new.user_id, 'Email', 1), (new.user_id, 'Mailbox', 1), (new.user_id, 'Thread', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_ad AFTER DELETE ON message BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES
+        (old.user_id, 'Email', 1), (old.user_id, 'Mailbox', 1), (old.user_id, 'Thread', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_au AFTER UPDATE OF is_read, archived ON message BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES
+        (new.user_id, 'Email', 1), (new.user_id, 'Mailbox', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_thread_au AFTER UPDATE OF thread_id ON message BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES
+        (new.user_id, 'Email', 1), (new.user_id, 'Thread', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+-- Keywords are a property of Emails
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_keyword_ai AFTER INSERT ON message_keyword BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES (new.user_id, 'Email', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_keyword_ad AFTER DELETE ON message_keyword BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES (old.user_id, 'Email', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+-- Labels on messages change both the Emails and the Mailboxes' counts
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_label_ai AFTER INSERT ON message_label BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES
+        (new.user_id, 'Email', 1), (new.user_id, 'Mailbox', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_label_ad AFTER DELETE ON message_label BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES
+        (old.user_id, 'Email', 1), (old.user_id, 'Mailbox', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_message_label_au AFTER UPDATE ON message_label BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES
+        (new.user_id, 'Email', 1), (new.user_id, 'Mailbox', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_label_ai AFTER INSERT ON label BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES (new.user_id, 'Mailbox', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_label_ad AFTER DELETE ON label BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES (old.user_id, 'Mailbox', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_label_au AFTER UPDATE ON label BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES (new.user_id, 'Mailbox', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
+
+CREATE TRIGGER IF NOT EXISTS jmap_state_thread_au AFTER UPDATE ON thread BEGIN
+    INSERT INTO jmap_state (user_id, type, state) VALUES (new.user_id, 'Thread', 1)
+    ON CONFLICT (user_id, type) DO UPDATE SET state = state + 1;
+END;
@@ -0,0 +1,6 @@
+-- Migration Down
+DROP INDEX IF EXISTS idx_mailbox_uid_message;
+DROP TABLE IF EXISTS mailbox_uid;
+DROP TABLE IF EXISTS mailbox_state;
+DROP INDEX IF EXISTS idx_credential_user;
+DROP TABLE IF EXISTS credential;
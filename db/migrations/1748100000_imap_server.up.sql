@@ -0,0 +1,40 @@
+-- Migration Up
+-- Secrets users give programs and mail clients instead of signing in:
+-- API keys ('api_key') and app passwords ('app_password'). Only a SHA-256
+-- hash of each secret is kept
+CREATE TABLE IF NOT EXISTS credential (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    kind VARCHAR(32) NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    secret_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_credential_user ON credential (user_id, created_at);
+
+-- The IMAP mailboxes labels have been opened as, by label path. Rows are
+-- kept when labels go, so a mailbox made again under the same name goes on
+-- from the UIDs it had
+CREATE TABLE IF NOT EXISTS mailbox_state (
+    user_id VARCHAR(255) NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    uid_validity INTEGER NOT NULL,
+    uid_next INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (user_id, name)
+);
+
+-- The UIDs of the messages in each IMAP mailbox, given in the order
+-- messages were found in it
+CREATE TABLE IF NOT EXISTS mailbox_uid (
+    user_id VARCHAR(255) NOT NULL,
+    mailbox TEXT NOT NULL,
+    uid INTEGER NOT NULL,
+    message_id VARCHAR(255) NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, mailbox, uid),
+    UNIQUE (user_id, mailbox, message_id),
+    FOREIGN KEY (user_id, mailbox) REFERENCES mailbox_state(user_id, name) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_mailbox_uid_message ON mailbox_uid (message_id);
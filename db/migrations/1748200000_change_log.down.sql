@@ -0,0 +1,13 @@
+-- Migration Down
+DROP TRIGGER IF EXISTS change_log_message_label_au;
+DROP TRIGGER IF EXISTS change_log_message_label_ad;
+DROP TRIGGER IF EXISTS change_log_message_label_ai;
+DROP TRIGGER IF EXISTS change_log_message_keyword_ad;
+DROP TRIGGER IF EXISTS change_log_message_keyword_ai;
+DROP TRIGGER IF EXISTS change_log_message_archived_au;
+DROP TRIGGER IF EXISTS change_log_message_read_au;
+DROP TRIGGER IF EXISTS change_log_message_ad;
+DROP TRIGGER IF EXISTS change_log_message_ai;
+DROP INDEX IF EXISTS idx_change_log_message;
+DROP INDEX IF EXISTS idx_change_log_user;
+DROP TABLE IF EXISTS change_log;
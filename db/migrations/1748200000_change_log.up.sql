@@ -0,0 +1,73 @@
+-- Migration Up
+-- Every change to users' messages, in order, for clients that follow them
+-- as they happen and resume where they left off. type is
+-- 'message.created', 'message.deleted', 'message.flags_changed' or
+-- 'message.labels_changed'. name is the flag or label that changed, with
+-- added telling whether it was set or removed: 'read' is the message's
+-- is_read, other names are keywords as stored and 'Inbox' is the absence
+-- of archived. The triggers below record every change, whichever code path
+-- makes it
+CREATE TABLE IF NOT EXISTS change_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id VARCHAR(255) NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    message_id VARCHAR(255) NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    added BOOLEAN NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_change_log_user ON change_log (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_change_log_message ON change_log (message_id);
+
+CREATE TRIGGER IF NOT EXISTS change_log_message_ai AFTER INSERT ON message BEGIN
+    INSERT INTO change_log (user_id, type, message_id) VALUES (new.user_id, 'message.created', new.id);
+END;
+
+-- A deleted message's flags and labels no longer matter, including those
+-- removed as it was deleted
+CREATE TRIGGER IF NOT EXISTS change_log_message_ad AFTER DELETE ON message BEGIN
+    DELETE FROM change_log WHERE message_id = old.id AND type IN ('message.flags_changed', 'message.labels_changed');
+    INSERT INTO change_log (user_id, type, message_id) VALUES (old.user_id, 'message.deleted', old.id);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_message_read_au AFTER UPDATE OF is_read ON message
+WHEN old.is_read IS NOT new.is_read BEGIN
+    INSERT INTO change_log (user_id, type, message_id, name, added)
+    VALUES (new.user_id, 'message.flags_changed', new.id, 'read', new.is_read);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_message_archived_au AFTER UPDATE OF archived ON message
+WHEN old.archived IS NOT new.archived BEGIN
+    INSERT INTO change_log (user_id, type, message_id, name, added)
+    VALUES (new.user_id, 'message.labels_changed', new.id, 'Inbox', NOT new.archived);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_message_keyword_ai AFTER INSERT ON message_keyword BEGIN
+    INSERT INTO change_log (user_id, type, message_id, name, added)
+    VALUES (new.user_id, 'message.flags_changed', new.message_id, new.keyword, 1);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_message_keyword_ad AFTER DELETE ON message_keyword BEGIN
+    INSERT INTO change_log (user_id, type, message_id, name, added)
+    VALUES (old.user_id, 'message.flags_changed', old.message_id, old.keyword, 0);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_message_label_ai AFTER INSERT ON message_label BEGIN
+    INSERT INTO change_log (user_id, type, message_id, name, added)
+    VALUES (new.user_id, 'message.labels_changed', new.message_id, new.label, 1);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_message_label_ad AFTER DELETE ON message_label BEGIN
+    INSERT INTO change_log (user_id, type, message_id, name, added)
+    VALUES (old.user_id, 'message.labels_changed', old.message_id, old.label, 0);
+END;
+
+-- Renaming a label takes the old name off its messages and puts the new one
+-- on
+CREATE TRIGGER IF NOT EXISTS change_log_message_label_au AFTER UPDATE OF label ON message_label
+WHEN old.label IS NOT new.label BEGIN
+    INSERT INTO change_log (user_id, type, message_id, name, added) VALUES
+        (old.user_id, 'message.labels_changed', old.message_id, old.label, 0),
+        (new.user_id, 'message.labels_changed', new.message_id, new.label, 1);
+END;
@@ -0,0 +1,16 @@
+-- Migration Down
+DROP TRIGGER IF EXISTS change_log_message_ad;
+CREATE TRIGGER IF NOT EXISTS change_log_message_ad AFTER DELETE ON message BEGIN
+    DELETE FROM change_log WHERE message_id = old.id AND type IN ('message.flags_changed', 'message.labels_changed');
+    INSERT INTO change_log (user_id, type, message_id) VALUES (old.user_id, 'message.deleted', old.id);
+END;
+DROP TRIGGER IF EXISTS change_log_label_ad;
+DROP TRIGGER IF EXISTS change_log_label_au;
+DROP TRIGGER IF EXISTS change_log_label_ai;
+DROP TRIGGER IF EXISTS change_log_modseq_ai;
+DELETE FROM change_log WHERE type LIKE 'label.%';
+DROP INDEX IF EXISTS idx_change_log_created;
+DROP INDEX IF EXISTS idx_change_log_modseq;
+ALTER TABLE change_log DROP COLUMN label_id;
+ALTER TABLE change_log DROP COLUMN modseq;
+DROP TABLE IF EXISTS user_modseq;
@@ -0,0 +1,61 @@
+-- Migration Up
+-- Each user's modification sequence: modseq counts the user's changes, and
+-- every change_log entry is stamped with the count it brought it to, so
+-- that clients sync against a single number. compacted is the highest
+-- modseq whose entries have been compacted away; clients that last synced
+-- before it have to start over. compacted_id is the ID of the newest of
+-- those entries, for event streams resumed by ID
+CREATE TABLE IF NOT EXISTS user_modseq (
+    user_id VARCHAR(255) PRIMARY KEY,
+    modseq INTEGER NOT NULL DEFAULT 0,
+    compacted INTEGER NOT NULL DEFAULT 0,
+    compacted_id INTEGER NOT NULL DEFAULT 0
+);
+
+-- label_id is the label a 'label.created', 'label.updated' or
+-- 'label.deleted' entry is about, with name its path. Entries a deleted
+-- message leaves on its labels have only the name
+ALTER TABLE change_log ADD COLUMN modseq INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE change_log ADD COLUMN label_id VARCHAR(255) NOT NULL DEFAULT '';
+
+UPDATE change_log SET modseq = (
+    SELECT COUNT(*) FROM change_log c WHERE c.user_id = change_log.user_id AND c.id <= change_log.id
+);
+INSERT INTO user_modseq (user_id, modseq)
+SELECT user_id, MAX(modseq) FROM change_log GROUP BY user_id;
+
+CREATE INDEX IF NOT EXISTS idx_change_log_modseq ON change_log (user_id, modseq);
+CREATE INDEX IF NOT EXISTS idx_change_log_created ON change_log (created_at);
+
+CREATE TRIGGER IF NOT EXISTS change_log_modseq_ai AFTER INSERT ON change_log BEGIN
+    INSERT INTO user_modseq (user_id, modseq) VALUES (new.user_id, 1)
+    ON CONFLICT (user_id) DO UPDATE SET modseq = modseq + 1;
+    UPDATE change_log SET modseq = (SELECT modseq FROM user_modseq WHERE user_id = new.user_id)
+    WHERE id = new.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_label_ai AFTER INSERT ON label BEGIN
+    INSERT INTO change_log (user_id, type, message_id, label_id, name)
+    VALUES (new.user_id, 'label.created', '', new.id, new.path);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_label_au AFTER UPDATE ON label
+WHEN old.path IS NOT new.path OR old.color IS NOT new.color BEGIN
+    INSERT INTO change_log (user_id, type, message_id, label_id, name)
+    VALUES (new.user_id, 'label.updated', '', new.id, new.path);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_label_ad AFTER DELETE ON label BEGIN
+    INSERT INTO change_log (user_id, type, message_id, label_id, name)
+    VALUES (old.user_id, 'label.deleted', '', old.id, old.path);
+END;
+
+-- A deleted message's labels changed the labels' counts, so they are kept
+-- as changes to the labels
+DROP TRIGGER IF EXISTS change_log_message_ad;
+CREATE TRIGGER IF NOT EXISTS change_log_message_ad AFTER DELETE ON message BEGIN
+    DELETE FROM change_log WHERE message_id = old.id AND type = 'message.flags_changed';
+    UPDATE change_log SET type = 'label.updated', message_id = ''
+    WHERE message_id = old.id AND type = 'message.labels_changed';
+    INSERT INTO change_log (user_id, type, message_id) VALUES (old.user_id, 'message.deleted', old.id);
+END;
@@ -0,0 +1,49 @@
+-- name: RegisterBlob :one
+INSERT INTO blob (hash, size, updated_at)
+VALUES (?, ?, ?)
+ON CONFLICT (hash) DO UPDATE SET updated_at = excluded.updated_at, lease = '', lease_until = NULL
+WHERE blob.lease_until IS NULL OR blob.lease_until <= excluded.updated_at
+RETURNING ref_count;
+
+-- name: AcquireBlob :execrows
+UPDATE blob SET ref_count = ref_count + 1, updated_at = ? WHERE hash = ? AND lease_until IS NULL;
+
+-- name: ReleaseBlob :exec
+UPDATE blob SET ref_count = ref_count - 1, updated_at = ? WHERE hash = ? AND ref_count > 0;
+
+-- name: GetBlob :one
+SELECT * FROM blob WHERE hash = ?;
+
+-- name: ListGarbageBlobs :many
+SELECT * FROM blob
+WHERE ref_count = 0 AND updated_at < ?
+ORDER BY updated_at
+LIMIT ?;
+
+-- name: LeaseGarbageBlob :execrows
+UPDATE blob SET lease = sqlc.arg(lease), lease_until = sqlc.arg(lease_until)
+WHERE hash = sqlc.arg(hash) AND ref_count = 0 AND updated_at < sqlc.arg(updated_at)
+  AND (lease_until IS NULL OR lease_until <= sqlc.arg(now));
+
+-- name: DeleteLeasedBlob :execrows
+DELETE FROM blob WHERE hash = ? AND lease = ?;
+
+-- name: ListMessageBlobHashes :many
+SELECT raw_hash AS hash FROM message_body WHERE message_body.message_id = sqlc.arg(message_id) AND raw_hash != ''
+UNION ALL
+SELECT blob_hash AS hash FROM attachment WHERE attachment.message_id = sqlc.arg(message_id) AND blob_hash != '';
+
+-- name: ListInlineMessageBodies :many
+SELECT message_id, raw FROM message_body
+WHERE raw_hash = '' AND length(raw) > 0
+ORDER BY message_id
+LIMIT ?;
+
+-- name: SetMessageBodyBlob :exec
+UPDATE message_body SET raw_hash = ?, raw = X'' WHERE message_id = ?;
+
+-- name: SetAttachmentBlob :exec
+UPDATE attachment SET blob_hash = ? WHERE message_id = ? AND part = ?;
+
+-- name: GetAttachment :one
+SELECT * FROM attachment WHERE message_id = ? AND part = ?;
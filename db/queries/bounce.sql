@@ -0,0 +1,28 @@
+-- name: InsertBounce :exec
+INSERT INTO bounce (id, user_id, message_id, sent_message_id, recipient, action, status, diagnostic)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: ListBouncesBySentMessage :many
+SELECT * FROM bounce
+WHERE user_id = ? AND sent_message_id = ?
+ORDER BY created_at, id;
+
+-- name: UpsertSuppression :exec
+INSERT INTO suppression (user_id, address, status, diagnostic, bounce_message_id, sent_message_id)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (user_id, address) DO UPDATE SET
+    status = excluded.status,
+    diagnostic = excluded.diagnostic,
+    bounce_message_id = excluded.bounce_message_id,
+    sent_message_id = excluded.sent_message_id,
+    bounces = suppression.bounces + 1,
+    updated_at = CURRENT_TIMESTAMP;
+
+-- name: GetSuppression :one
+SELECT * FROM suppression WHERE user_id = ? AND address = ?;
+
+-- name: ListSuppressionsByUser :many
+SELECT * FROM suppression WHERE user_id = ? ORDER BY updated_at DESC, address;
+
+-- name: DeleteSuppression :execrows
+DELETE FROM suppression WHERE user_id = ? AND address = ?;
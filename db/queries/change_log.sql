@@ -0,0 +1,30 @@
+-- name: ListChanges :many
+SELECT id, user_id, type, message_id, name, added, created_at, modseq, label_id FROM change_log
+WHERE user_id = ? AND id > ?
+ORDER BY id
+LIMIT ?;
+
+-- name: GetLastChangeID :one
+SELECT CAST(COALESCE(MAX(id), 0) AS INTEGER) AS id FROM change_log WHERE user_id = ?;
+
+-- name: GetModseq :one
+SELECT user_id, modseq, compacted, compacted_id FROM user_modseq WHERE user_id = ?;
+
+-- name: ListChangesSince :many
+SELECT id, user_id, type, message_id, name, added, created_at, modseq, label_id FROM change_log
+WHERE user_id = sqlc.arg(user_id) AND modseq > sqlc.arg(since) AND modseq <= sqlc.arg(until)
+ORDER BY modseq
+LIMIT sqlc.arg(limit);
+
+-- name: ListCompactableChanges :many
+SELECT user_id, CAST(MAX(modseq) AS INTEGER) AS modseq, CAST(MAX(id) AS INTEGER) AS id FROM change_log
+WHERE created_at < ?
+GROUP BY user_id
+LIMIT ?;
+
+-- name: DeleteChangesThrough :execrows
+DELETE FROM change_log WHERE user_id = ? AND modseq <= ?;
+
+-- name: SetCompactedModseq :exec
+UPDATE user_modseq SET compacted = MAX(compacted, sqlc.arg(compacted)), compacted_id = MAX(compacted_id, sqlc.arg(compacted_id))
+WHERE user_id = sqlc.arg(user_id);
@@ -0,0 +1,22 @@
+-- name: InsertCredential :exec
+INSERT INTO credential (id, user_id, kind, name, secret_hash)
+VALUES (?, ?, ?, ?, ?);
+
+-- name: GetCredential :one
+SELECT * FROM credential WHERE id = ? AND user_id = ?;
+
+-- name: ListCredentials :many
+SELECT * FROM credential WHERE user_id = ?
+ORDER BY created_at, id;
+
+-- name: DeleteCredential :execrows
+DELETE FROM credential WHERE id = ? AND user_id = ?;
+
+-- name: GetCredentialBySecret :one
+SELECT c.id, c.user_id, c.kind, u.email
+FROM credential c
+JOIN user u ON u.id = c.user_id
+WHERE c.secret_hash = ?;
+
+-- name: TouchCredential :exec
+UPDATE credential SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?;
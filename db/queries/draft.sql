@@ -0,0 +1,66 @@
+-- name: InsertDraft :exec
+INSERT INTO draft (id, user_id, content) VALUES (?, ?, ?);
+
+-- name: GetDraft :one
+SELECT * FROM draft WHERE id = ? AND user_id = ?;
+
+-- name: ListDraftsByUser :many
+SELECT * FROM draft WHERE user_id = ? ORDER BY updated_at DESC, id;
+
+-- name: UpdateDraftContent :execrows
+UPDATE draft SET content = ?, updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND user_id = ? AND status != 'sending';
+
+-- name: DeleteDraft :execrows
+DELETE FROM draft WHERE id = ? AND user_id = ? AND status != 'sending';
+
+-- name: ScheduleDraft :execrows
+UPDATE draft SET
+    status = 'scheduled',
+    send_at = ?,
+    attempts = 0,
+    last_error = '',
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND user_id = ? AND status != 'sending';
+
+-- name: UnscheduleDraft :execrows
+UPDATE draft SET
+    status = 'draft',
+    send_at = NULL,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND user_id = ? AND status != 'sending';
+
+-- name: ClaimDueDrafts :many
+UPDATE draft SET
+    status = 'sending',
+    attempts = attempts + 1,
+    lease = sqlc.arg(lease),
+    lease_until = sqlc.arg(lease_until)
+WHERE id IN (
+    SELECT id FROM draft
+    WHERE (status = 'scheduled' AND send_at <= sqlc.arg(now))
+       OR (status = 'sending' AND lease_until <= sqlc.arg(now))
+    ORDER BY send_at
+    LIMIT sqlc.arg(limit)
+)
+RETURNING *;
+
+-- name: DeleteSentDraft :execrows
+DELETE FROM draft WHERE id = ? AND lease = ?;
+
+-- name: RetryDraft :execrows
+UPDATE draft SET
+    status = 'scheduled',
+    send_at = ?,
+    lease = '',
+    lease_until = NULL,
+    last_error = ?
+WHERE id = ? AND lease = ?;
+
+-- name: FailDraft :execrows
+UPDATE draft SET
+    status = 'failed',
+    lease = '',
+    lease_until = NULL,
+    last_error = ?
+WHERE id = ? AND lease = ?;
@@ -1,2 +1,5 @@
 -- name: GetUserByID :one
-SELECT * FROM user WHERE id = ?;
\ No newline at end of file
+SELECT * FROM user WHERE id = ?;
+
+-- name: GetUserByEmail :one
+SELECT * FROM user WHERE email = ? COLLATE NOCASE;
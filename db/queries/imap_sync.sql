@@ -0,0 +1,59 @@
+-- name: InsertIMAPAccount :exec
+INSERT INTO imap_account (id, user_id, host, port, security, username, password)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetIMAPAccount :one
+SELECT * FROM imap_account WHERE id = ? AND user_id = ?;
+
+-- name: ListIMAPAccountsByUser :many
+SELECT * FROM imap_account WHERE user_id = ? ORDER BY created_at;
+
+-- name: ListEnabledIMAPAccounts :many
+SELECT * FROM imap_account WHERE enabled = 1 ORDER BY last_synced_at;
+
+-- name: UpdateIMAPAccountSyncResult :exec
+UPDATE imap_account SET last_error = ?, last_synced_at = ? WHERE id = ?;
+
+-- name: DeleteIMAPAccount :execrows
+DELETE FROM imap_account WHERE id = ? AND user_id = ?;
+
+-- name: GetIMAPFolderState :one
+SELECT * FROM imap_folder_state WHERE account_id = ? AND folder = ?;
+
+-- name: UpsertIMAPFolderState :exec
+INSERT INTO imap_folder_state (account_id, folder, uid_validity, uid_next, highest_modseq, updated_at)
+VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+ON CONFLICT (account_id, folder) DO UPDATE SET
+    uid_validity = excluded.uid_validity,
+    uid_next = excluded.uid_next,
+    highest_modseq = excluded.highest_modseq,
+    updated_at = excluded.updated_at;
+
+-- name: DeleteIMAPFolderStates :exec
+DELETE FROM imap_folder_state WHERE account_id = ?;
+
+-- name: InsertIMAPMessage :exec
+INSERT OR IGNORE INTO imap_message (account_id, folder, uid_validity, uid, message_id)
+VALUES (?, ?, ?, ?, ?);
+
+-- name: HasIMAPMessage :one
+SELECT COUNT(*) FROM imap_message
+WHERE account_id = ? AND folder = ? AND uid_validity = ? AND uid = ?;
+
+-- name: ListIMAPMessages :many
+SELECT uid, message_id FROM imap_message
+WHERE account_id = ? AND folder = ? AND uid_validity = ?
+ORDER BY uid;
+
+-- name: DeleteIMAPMessage :exec
+DELETE FROM imap_message
+WHERE account_id = ? AND folder = ? AND uid_validity = ? AND uid = ?;
+
+-- name: CountIMAPMessagesByMessageID :one
+SELECT COUNT(*) FROM imap_message WHERE message_id = ?;
+
+-- name: DeleteIMAPMessagesForFolder :exec
+DELETE FROM imap_message WHERE account_id = ? AND folder = ?;
+
+-- name: DeleteIMAPMessages :exec
+DELETE FROM imap_message WHERE account_id = ?;
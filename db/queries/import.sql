@@ -0,0 +1,16 @@
+-- name: GetImportCheckpoint :one
+SELECT * FROM import_checkpoint WHERE user_id = ? AND source = ?;
+
+-- name: UpsertImportCheckpoint :exec
+INSERT INTO import_checkpoint (user_id, source, cursor, imported, duplicates, failed, completed, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+ON CONFLICT (user_id, source) DO UPDATE SET
+    cursor = excluded.cursor,
+    imported = excluded.imported,
+    duplicates = excluded.duplicates,
+    failed = excluded.failed,
+    completed = excluded.completed,
+    updated_at = excluded.updated_at;
+
+-- name: DeleteImportCheckpoint :exec
+DELETE FROM import_checkpoint WHERE user_id = ? AND source = ?;
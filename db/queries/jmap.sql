@@ -0,0 +1,16 @@
+-- name: ListJMAPStates :many
+SELECT type, state FROM jmap_state WHERE user_id = ?;
+
+-- name: CountThreadsByLabel :one
+SELECT COUNT(DISTINCT m.thread_id) AS total,
+    COUNT(DISTINCT CASE WHEN m.is_read = 0 THEN m.thread_id END) AS unread
+FROM message_label ml
+JOIN message m ON m.id = ml.message_id
+WHERE ml.user_id = ? AND ml.label = ?;
+
+-- name: CountThreadsByArchived :one
+SELECT COUNT(DISTINCT m.thread_id) AS total,
+    COUNT(DISTINCT CASE WHEN m.is_read = 0 THEN m.thread_id END) AS unread
+FROM message m
+WHERE m.user_id = ? AND m.archived = ?
+    AND NOT EXISTS (SELECT 1 FROM message_label ml WHERE ml.message_id = m.id AND ml.label IN ('Sent', 'Trash', 'Spam'));
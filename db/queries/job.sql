@@ -0,0 +1,47 @@
+-- name: InsertJob :exec
+INSERT INTO job (id, kind, payload, priority, max_attempts, run_at)
+VALUES (?, ?, ?, ?, ?, ?);
+
+-- name: ClaimJob :one
+UPDATE job SET
+    status = 'running',
+    attempts = attempts + 1,
+    lease = sqlc.arg(lease),
+    lease_until = sqlc.arg(lease_until),
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = (
+    SELECT id FROM job
+    WHERE (status = 'queued' AND run_at <= sqlc.arg(now))
+       OR (status = 'running' AND lease_until <= sqlc.arg(now))
+    ORDER BY priority DESC, run_at
+    LIMIT 1
+)
+RETURNING *;
+
+-- name: CompleteJob :execrows
+DELETE FROM job WHERE id = ? AND lease = ?;
+
+-- name: RetryJob :execrows
+UPDATE job SET
+    status = 'queued',
+    run_at = ?,
+    lease = '',
+    lease_until = NULL,
+    last_error = ?,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND lease = ?;
+
+-- name: KillJob :execrows
+UPDATE job SET
+    status = 'dead',
+    lease = '',
+    lease_until = NULL,
+    last_error = ?,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND lease = ?;
+
+-- name: GetJob :one
+SELECT * FROM job WHERE id = ?;
+
+-- name: CountJobs :many
+SELECT kind, status, COUNT(*) AS count FROM job GROUP BY kind, status;
@@ -0,0 +1,52 @@
+-- name: InsertLabel :execrows
+INSERT INTO label (id, user_id, path, color)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (user_id, path) DO NOTHING;
+
+-- name: GetLabel :one
+SELECT l.id, l.user_id, l.path, l.color, l.created_at, l.updated_at,
+    COUNT(m.id) AS total, CAST(COALESCE(SUM(m.is_read = 0), 0) AS INTEGER) AS unread
+FROM label l
+LEFT JOIN message_label ml ON ml.user_id = l.user_id AND ml.label = l.path
+LEFT JOIN message m ON m.id = ml.message_id
+WHERE l.id = ? AND l.user_id = ?
+GROUP BY l.id;
+
+-- name: ListLabelsByUser :many
+SELECT l.id, l.user_id, l.path, l.color, l.created_at, l.updated_at,
+    COUNT(m.id) AS total, CAST(COALESCE(SUM(m.is_read = 0), 0) AS INTEGER) AS unread
+FROM label l
+LEFT JOIN message_label ml ON ml.user_id = l.user_id AND ml.label = l.path
+LEFT JOIN message m ON m.id = ml.message_id
+WHERE l.user_id = ?
+GROUP BY l.id
+ORDER BY l.path;
+
+-- name: UpdateLabel :execrows
+UPDATE label SET path = ?, color = ?, updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND user_id = ?;
+
+-- name: DeleteLabel :execrows
+DELETE FROM label WHERE id = ? AND user_id = ?;
+
+-- name: RenameMessageLabels :exec
+UPDATE message_label SET label = sqlc.arg(new_label)
+WHERE user_id = sqlc.arg(user_id) AND label = sqlc.arg(old_label);
+
+-- name: DeleteMessageLabelsByLabel :exec
+DELETE FROM message_label WHERE user_id = ? AND label = ?;
+
+-- name: RemoveMessageLabel :execrows
+DELETE FROM message_label WHERE message_id = ? AND label = ?;
+
+-- name: CountMessagesByLabel :one
+SELECT COUNT(m.id) AS total, CAST(COALESCE(SUM(m.is_read = 0), 0) AS INTEGER) AS unread
+FROM message_label ml
+JOIN message m ON m.id = ml.message_id
+WHERE ml.user_id = ? AND ml.label = ?;
+
+-- name: CountMessagesByArchived :one
+SELECT COUNT(m.id) AS total, CAST(COALESCE(SUM(m.is_read = 0), 0) AS INTEGER) AS unread
+FROM message m
+WHERE m.user_id = ? AND m.archived = ?
+    AND NOT EXISTS (SELECT 1 FROM message_label ml WHERE ml.message_id = m.id AND ml.label IN ('Sent', 'Trash', 'Spam'));
@@ -0,0 +1,54 @@
+-- name: InsertMailboxState :exec
+INSERT INTO mailbox_state (user_id, name, uid_validity)
+VALUES (?, ?, ?)
+ON CONFLICT (user_id, name) DO NOTHING;
+
+-- name: GetMailboxState :one
+SELECT * FROM mailbox_state WHERE user_id = ? AND name = ?;
+
+-- name: SetMailboxUIDNext :exec
+UPDATE mailbox_state SET uid_next = ? WHERE user_id = ? AND name = ?;
+
+-- name: ListMailboxUIDs :many
+SELECT uid, message_id FROM mailbox_uid
+WHERE user_id = ? AND mailbox = ?
+ORDER BY uid;
+
+-- name: InsertMailboxUID :exec
+INSERT INTO mailbox_uid (user_id, mailbox, uid, message_id)
+VALUES (?, ?, ?, ?);
+
+-- name: DeleteMailboxUID :exec
+DELETE FROM mailbox_uid WHERE user_id = ? AND mailbox = ? AND uid = ?;
+
+-- name: DeleteMailboxUIDs :exec
+DELETE FROM mailbox_uid WHERE user_id = ? AND mailbox = ?;
+
+-- name: DeleteMessageMailboxUIDs :exec
+DELETE FROM mailbox_uid WHERE message_id = ?;
+
+-- name: ListMessageIDsByArchived :many
+SELECT m.id FROM message m
+WHERE m.user_id = ? AND m.archived = ?
+    AND NOT EXISTS (SELECT 1 FROM message_label ml WHERE ml.message_id = m.id AND ml.label IN ('Sent', 'Trash', 'Spam'))
+ORDER BY m.received_at, m.id;
+
+-- name: ListMessageIDsByLabel :many
+SELECT m.id FROM message_label ml
+JOIN message m ON m.id = ml.message_id
+WHERE ml.user_id = ? AND ml.label = ?
+ORDER BY m.received_at, m.id;
+
+-- name: ListMailboxMessages :many
+SELECT mu.uid, m.id, m.is_read, m.received_at, m.size
+FROM mailbox_uid mu
+JOIN message m ON m.id = mu.message_id
+WHERE mu.user_id = ? AND mu.mailbox = ?
+ORDER BY mu.uid;
+
+-- name: ListMailboxKeywords :many
+SELECT mk.message_id, mk.keyword
+FROM mailbox_uid mu
+JOIN message_keyword mk ON mk.message_id = mu.message_id
+WHERE mu.user_id = ? AND mu.mailbox = ?
+ORDER BY mk.message_id, mk.keyword;
@@ -0,0 +1,99 @@
+-- name: InsertMessage :exec
+INSERT INTO message (
+    id, user_id, internet_message_id, in_reply_to, message_references, subject,
+    from_name, from_address, sent_at, received_at, size, has_attachments
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: InsertMessageAddress :exec
+INSERT INTO message_address (message_id, kind, position, name, address)
+VALUES (?, ?, ?, ?, ?);
+
+-- name: InsertMessageHeader :exec
+INSERT INTO message_header (message_id, position, name, value)
+VALUES (?, ?, ?, ?);
+
+-- name: InsertMessageBody :exec
+INSERT INTO message_body (message_id, text_body, html_body, raw, raw_hash)
+VALUES (?, ?, ?, ?, ?);
+
+-- name: InsertAttachment :exec
+INSERT INTO attachment (message_id, part, filename, content_type, disposition, content_id, size, blob_hash)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetMessage :one
+SELECT * FROM message WHERE id = ? AND user_id = ?;
+
+-- name: GetMessageByInternetMessageID :one
+SELECT * FROM message
+WHERE user_id = ? AND internet_message_id = ?
+ORDER BY received_at
+LIMIT 1;
+
+-- name: ListMessagesByUser :many
+SELECT * FROM message
+WHERE user_id = sqlc.arg(user_id)
+  AND (received_at < sqlc.arg(before_received_at)
+    OR (received_at = sqlc.arg(before_received_at) AND id < sqlc.arg(before_id)))
+ORDER BY received_at DESC, id DESC
+LIMIT sqlc.arg(limit);
+
+-- name: CountMessagesByUser :one
+SELECT COUNT(*) FROM message WHERE user_id = ?;
+
+-- name: ListMessageAddresses :many
+SELECT * FROM message_address WHERE message_id = ? ORDER BY kind, position;
+
+-- name: ListMessageHeaders :many
+SELECT * FROM message_header WHERE message_id = ? ORDER BY position;
+
+-- name: GetMessageBody :one
+SELECT * FROM message_body WHERE message_id = ?;
+
+-- name: ListAttachments :many
+SELECT * FROM attachment WHERE message_id = ? ORDER BY part;
+
+-- name: DeleteMessage :execrows
+DELETE FROM message WHERE id = ? AND user_id = ?;
+
+-- name: DeleteMessageAddresses :exec
+DELETE FROM message_address WHERE message_id = ?;
+
+-- name: DeleteMessageHeaders :exec
+DELETE FROM message_header WHERE message_id = ?;
+
+-- name: DeleteMessageBody :exec
+DELETE FROM message_body WHERE message_id = ?;
+
+-- name: DeleteAttachments :exec
+DELETE FROM attachment WHERE message_id = ?;
+
+-- name: AddMessageLabel :exec
+INSERT INTO message_label (message_id, user_id, label)
+VALUES (?, ?, ?)
+ON CONFLICT (message_id, label) DO NOTHING;
+
+-- name: ListMessageLabels :many
+SELECT label FROM message_label WHERE message_id = ? ORDER BY label;
+
+-- name: DeleteMessageLabels :exec
+DELETE FROM message_label WHERE message_id = ?;
+
+-- name: SetMessageRead :exec
+UPDATE message SET is_read = ? WHERE id = ? AND user_id = ?;
+
+-- name: SetMessageArchived :exec
+UPDATE message SET archived = ? WHERE id = ? AND user_id = ?;
+
+-- name: AddMessageKeyword :exec
+INSERT INTO message_keyword (message_id, user_id, keyword)
+VALUES (?, ?, ?)
+ON CONFLICT (message_id, keyword) DO NOTHING;
+
+-- name: RemoveMessageKeyword :exec
+DELETE FROM message_keyword WHERE message_id = ? AND keyword = ? COLLATE NOCASE;
+
+-- name: ListMessageKeywords :many
+SELECT keyword FROM message_keyword WHERE message_id = ? ORDER BY keyword;
+
+-- name: DeleteMessageKeywords :exec
+DELETE FROM message_keyword WHERE message_id = ?;
@@ -0,0 +1,14 @@
+-- name: InsertMessageAuth :exec
+INSERT INTO message_auth (message_id, dkim, spf, dmarc, dmarc_policy, header_from, results, arc, dmarc_override)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetMessageAuth :one
+SELECT * FROM message_auth WHERE message_id = ?;
+
+-- name: ListThreadMessageAuth :many
+SELECT a.* FROM message_auth a
+JOIN message m ON m.id = a.message_id
+WHERE m.user_id = ? AND m.thread_id = ?;
+
+-- name: DeleteMessageAuth :exec
+DELETE FROM message_auth WHERE message_id = ?;
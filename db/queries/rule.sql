@@ -0,0 +1,30 @@
+-- name: InsertRule :exec
+INSERT INTO rule (id, user_id, name, position, enabled, match, conditions, actions, stop_processing)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetRule :one
+SELECT * FROM rule WHERE id = ? AND user_id = ?;
+
+-- name: ListRulesByUser :many
+SELECT * FROM rule WHERE user_id = ? ORDER BY position, created_at, id;
+
+-- name: ListEnabledRulesByUser :many
+SELECT * FROM rule WHERE user_id = ? AND enabled = 1 ORDER BY position, created_at, id;
+
+-- name: NextRulePosition :one
+SELECT CAST(COALESCE(MAX(position) + 1, 0) AS INTEGER) AS position FROM rule WHERE user_id = ?;
+
+-- name: UpdateRule :execrows
+UPDATE rule SET
+    name = ?,
+    position = ?,
+    enabled = ?,
+    match = ?,
+    conditions = ?,
+    actions = ?,
+    stop_processing = ?,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND user_id = ?;
+
+-- name: DeleteRule :execrows
+DELETE FROM rule WHERE id = ? AND user_id = ?;
@@ -0,0 +1,13 @@
+-- name: InsertMessageSearchContent :exec
+INSERT INTO message_search_content (message_id, user_id, subject, from_text, to_text, body, attachments)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+
+-- name: DeleteMessageSearchContent :exec
+DELETE FROM message_search_content WHERE message_id = ?;
+
+-- name: ListUnindexedMessageIDs :many
+SELECT m.id, m.user_id FROM message m
+LEFT JOIN message_search_content s ON s.message_id = m.id
+WHERE s.message_id IS NULL
+ORDER BY m.id
+LIMIT ?;
@@ -0,0 +1,33 @@
+-- name: InsertSieveScript :exec
+INSERT INTO sieve_script (id, user_id, name, content)
+VALUES (?, ?, ?, ?);
+
+-- name: GetSieveScript :one
+SELECT * FROM sieve_script WHERE user_id = ? AND name = ?;
+
+-- name: GetActiveSieveScript :one
+SELECT * FROM sieve_script WHERE user_id = ? AND active = 1;
+
+-- name: ListSieveScriptsByUser :many
+SELECT * FROM sieve_script WHERE user_id = ? ORDER BY name;
+
+-- name: UpdateSieveScript :execrows
+UPDATE sieve_script SET content = ?, updated_at = CURRENT_TIMESTAMP
+WHERE user_id = ? AND name = ?;
+
+-- name: DeleteSieveScript :execrows
+DELETE FROM sieve_script WHERE user_id = ? AND name = ?;
+
+-- name: DeactivateSieveScripts :exec
+UPDATE sieve_script SET active = 0 WHERE user_id = ? AND active = 1;
+
+-- name: ActivateSieveScript :execrows
+UPDATE sieve_script SET active = 1 WHERE user_id = ? AND name = ?;
+
+-- name: GetSieveVacation :one
+SELECT sent_at FROM sieve_vacation WHERE user_id = ? AND handle = ? AND sender = ?;
+
+-- name: PutSieveVacation :exec
+INSERT INTO sieve_vacation (user_id, handle, sender, sent_at)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (user_id, handle, sender) DO UPDATE SET sent_at = excluded.sent_at;
@@ -0,0 +1,63 @@
+-- name: InsertThread :exec
+INSERT INTO thread (id, user_id, subject, base_subject, last_message_at)
+VALUES (?, ?, ?, ?, ?);
+
+-- name: GetThread :one
+SELECT * FROM thread WHERE id = ? AND user_id = ?;
+
+-- name: ListThreadsByUser :many
+SELECT * FROM thread
+WHERE user_id = sqlc.arg(user_id)
+  AND (last_message_at < sqlc.arg(before_last_message_at)
+    OR (last_message_at = sqlc.arg(before_last_message_at) AND id < sqlc.arg(before_id)))
+ORDER BY last_message_at DESC, id DESC
+LIMIT sqlc.arg(limit);
+
+-- name: FindThreadByBaseSubject :one
+SELECT * FROM thread
+WHERE user_id = ? AND base_subject = ? AND last_message_at >= ?
+ORDER BY last_message_at DESC
+LIMIT 1;
+
+-- name: ListThreadIDsByReference :many
+SELECT thread_id FROM message
+WHERE message.user_id = sqlc.arg(user_id) AND internet_message_id = sqlc.arg(ref) AND thread_id != ''
+UNION
+SELECT m.thread_id FROM message_thread_ref r
+JOIN message m ON m.id = r.message_id
+WHERE r.user_id = sqlc.arg(user_id) AND r.ref = sqlc.arg(ref) AND m.thread_id != '';
+
+-- name: InsertMessageThreadRef :exec
+INSERT INTO message_thread_ref (message_id, user_id, ref)
+VALUES (?, ?, ?)
+ON CONFLICT (message_id, ref) DO NOTHING;
+
+-- name: DeleteMessageThreadRefs :exec
+DELETE FROM message_thread_ref WHERE message_id = ?;
+
+-- name: SetMessageThread :exec
+UPDATE message SET thread_id = ? WHERE id = ?;
+
+-- name: MoveThreadMessages :exec
+UPDATE message SET thread_id = sqlc.arg(new_thread_id)
+WHERE user_id = sqlc.arg(user_id) AND thread_id = sqlc.arg(old_thread_id);
+
+-- name: RefreshThread :exec
+UPDATE thread SET
+    subject = COALESCE((SELECT m.subject FROM message m
+        WHERE m.user_id = thread.user_id AND m.thread_id = thread.id
+        ORDER BY m.sent_at, m.id LIMIT 1), subject),
+    message_count = (SELECT COUNT(*) FROM message m
+        WHERE m.user_id = thread.user_id AND m.thread_id = thread.id),
+    last_message_at = COALESCE((SELECT MAX(m.received_at) FROM message m
+        WHERE m.user_id = thread.user_id AND m.thread_id = thread.id), last_message_at)
+WHERE id = ?;
+
+-- name: DeleteEmptyThread :exec
+DELETE FROM thread WHERE id = ? AND message_count = 0;
+
+-- name: ListThreadMessages :many
+SELECT * FROM message WHERE user_id = ? AND thread_id = ? ORDER BY sent_at, id;
+
+-- name: ListUnthreadedMessages :many
+SELECT * FROM message WHERE thread_id = '' ORDER BY sent_at, id LIMIT ?;
@@ -0,0 +1,83 @@
+-- name: InsertWebhookEndpoint :exec
+INSERT INTO webhook_endpoint (id, user_id, url, secret, events, description, enabled)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetWebhookEndpoint :one
+SELECT * FROM webhook_endpoint WHERE id = ? AND user_id = ?;
+
+-- name: GetWebhookEndpointByID :one
+SELECT * FROM webhook_endpoint WHERE id = ?;
+
+-- name: ListWebhookEndpointsByUser :many
+SELECT * FROM webhook_endpoint WHERE user_id = ? ORDER BY created_at, id;
+
+-- name: ListEnabledWebhookEndpointsByUser :many
+SELECT * FROM webhook_endpoint WHERE user_id = ? AND enabled = 1 ORDER BY created_at, id;
+
+-- name: UpdateWebhookEndpoint :execrows
+UPDATE webhook_endpoint SET
+    url = ?,
+    events = ?,
+    description = ?,
+    enabled = ?,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND user_id = ?;
+
+-- name: DeleteWebhookEndpoint :execrows
+DELETE FROM webhook_endpoint WHERE id = ? AND user_id = ?;
+
+-- name: InsertWebhookDelivery :exec
+INSERT INTO webhook_delivery (id, endpoint_id, user_id, event_id, event, payload, next_attempt_at)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+
+-- name: ClaimWebhookDeliveries :many
+UPDATE webhook_delivery SET next_attempt_at = sqlc.arg(lease_until)
+WHERE id IN (
+    SELECT id FROM webhook_delivery
+    WHERE status = 'pending' AND next_attempt_at <= sqlc.arg(now)
+    ORDER BY next_attempt_at
+    LIMIT sqlc.arg(limit)
+)
+RETURNING *;
+
+-- name: MarkWebhookDelivered :exec
+UPDATE webhook_delivery SET
+    status = 'delivered',
+    attempts = attempts + 1,
+    last_attempt_at = sqlc.arg(attempted_at),
+    last_status_code = sqlc.arg(status_code),
+    last_error = '',
+    delivered_at = sqlc.arg(attempted_at)
+WHERE id = sqlc.arg(id);
+
+-- name: MarkWebhookFailed :exec
+UPDATE webhook_delivery SET
+    status = ?,
+    attempts = attempts + 1,
+    next_attempt_at = ?,
+    last_attempt_at = ?,
+    last_status_code = ?,
+    last_error = ?
+WHERE id = ?;
+
+-- name: GetWebhookDelivery :one
+SELECT * FROM webhook_delivery WHERE id = ? AND endpoint_id = ? AND user_id = ?;
+
+-- name: ListWebhookDeliveries :many
+SELECT * FROM webhook_delivery
+WHERE endpoint_id = ? AND user_id = ?
+ORDER BY created_at DESC, id
+LIMIT ?;
+
+-- name: ListWebhookDeliveriesByStatus :many
+SELECT * FROM webhook_delivery
+WHERE endpoint_id = ? AND user_id = ? AND status = ?
+ORDER BY created_at DESC, id
+LIMIT ?;
+
+-- name: RetryWebhookDelivery :execrows
+UPDATE webhook_delivery SET status = 'pending', next_attempt_at = ?
+WHERE id = ? AND endpoint_id = ? AND user_id = ? AND status = 'dead';
+
+-- name: DeleteDeliveredWebhookDeliveries :execrows
+DELETE FROM webhook_delivery WHERE status = 'delivered' AND delivered_at < ?;
@@ -0,0 +1,25 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when a blob isn't in the backend.
+var ErrNotFound = errors.New("blob not found")
+
+// Backend stores blob content by key. Keys are hex SHA-256 digests, so a
+// backend never sees two different contents under one key and writing a key
+// again is harmless.
+type Backend interface {
+	// Put stores data under key.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the content of key starting at offset. It returns
+	// ErrNotFound if the key doesn't exist.
+	Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	// Exists reports whether key is stored.
+	Exists(ctx context.Context, key string) (bool, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
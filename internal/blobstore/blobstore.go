@@ -0,0 +1,375 @@
+// Package blobstore keeps message content (raw messages and attachments)
+// outside the database in a content-addressed store. Blobs are keyed by the
+// hex SHA-256 of their content, so identical attachments are stored once no
+// matter how many messages or users share them. The blob table counts the
+// references from message rows, and blobs nobody references are
+// garbage-collected.
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+const (
+	// DefaultGCInterval is used when BLOB_GC_INTERVAL is not set.
+	DefaultGCInterval = time.Hour
+	// DefaultGCGrace is used when BLOB_GC_GRACE is not set.
+	DefaultGCGrace = time.Hour
+
+	gcBatchSize = 100
+	// gcLease is how long a blob being collected is kept from being
+	// written or referenced. Deleting its content has to finish well
+	// within it.
+	gcLease = 10 * time.Minute
+	// gcLeaseRetry is how often a Put waiting for a blob's collection
+	// tries again.
+	gcLeaseRetry = 100 * time.Millisecond
+)
+
+// Key returns the key of data: its hex SHA-256 digest.
+func Key(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validKey reports whether key looks like a value returned by Key.
+func validKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Store writes blobs to a backend and tracks them in the blob table.
+//
+// A blob's life: Put registers it with no references and uploads the
+// content; the transaction that stores the referencing message acquires it
+// (database.InsertMessageTx) and deleting the message releases it. Blobs
+// without references are deleted by CollectGarbage once they have been
+// untouched for the grace period, which leaves a Put enough time to be
+// followed by its message insert. Collection leases the blob's row while it
+// deletes the content, so that a Put of the same content by any instance
+// waits for the deletion rather than finding the content about to go.
+type Store struct {
+	queries *schema.Queries
+	backend Backend
+
+	grace    time.Duration
+	interval time.Duration
+
+	// locks serialises Put and garbage collection of the same key within
+	// the process, saving the lease round trips
+	locksMu sync.Mutex
+	locks   map[string]*keyLock
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// New creates a Store that keeps content in backend.
+func New(db database.Service, backend Backend) *Store {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Store{
+		queries:  db.Queries(),
+		backend:  backend,
+		grace:    DefaultGCGrace,
+		interval: DefaultGCInterval,
+		locks:    make(map[string]*keyLock),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// NewFromEnv creates a Store configured by the environment:
+//
+//	BLOB_BACKEND      fs (default) or s3
+//	BLOB_DIR          directory of the fs backend, default ./blobs
+//	BLOB_S3_*         S3 settings, see S3ConfigFromEnv
+//	BLOB_GC_INTERVAL  how often unreferenced blobs are collected
+//	BLOB_GC_GRACE     how long an unreferenced blob is kept
+func NewFromEnv(db database.Service) (*Store, error) {
+	var backend Backend
+	switch kind := os.Getenv("BLOB_BACKEND"); kind {
+	case "", "fs":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "blobs"
+		}
+		b, err := NewFS(dir)
+		if err != nil {
+			return nil, err
+		}
+		backend = b
+	case "s3":
+		cfg, err := S3ConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		backend = NewS3(cfg, nil)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_BACKEND %q", kind)
+	}
+
+	s := New(db, backend)
+	for name, d := range map[string]*time.Duration{
+		"BLOB_GC_INTERVAL": &s.interval,
+		"BLOB_GC_GRACE":    &s.grace,
+	} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*d = parsed
+		}
+	}
+	return s, nil
+}
+
+// SetGrace changes how long unreferenced blobs are kept before
+// CollectGarbage deletes them.
+func (s *Store) SetGrace(d time.Duration) {
+	s.grace = d
+}
+
+// Put stores data and returns its key. The blob is registered without
+// references; it must be acquired by a message within the grace period or
+// it is collected again.
+func (s *Store) Put(ctx context.Context, data []byte) (string, error) {
+	key := Key(data)
+	unlock := s.lock(key)
+	defer unlock()
+
+	var refs int64
+	for {
+		var err error
+		refs, err = s.queries.RegisterBlob(ctx, schema.RegisterBlobParams{
+			Hash:      key,
+			Size:      int64(len(data)),
+			UpdatedAt: time.Now().UTC(),
+		})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("failed to register blob: %w", err)
+		}
+		// Another instance is collecting the blob; its content is stored
+		// again once that is done
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(gcLeaseRetry):
+		}
+	}
+
+	// Content that is already referenced is known to be stored. Otherwise
+	// it may still be there from an earlier Put whose message was never
+	// written
+	if refs == 0 {
+		exists, err := s.backend.Exists(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			if err := s.backend.Put(ctx, key, data); err != nil {
+				return "", err
+			}
+		}
+	}
+	return key, nil
+}
+
+// Get returns the whole content of a blob.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	rc, err := s.backend.Get(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+	return data, nil
+}
+
+// Open returns a seekable reader over a blob of the given size, for serving
+// byte ranges. The backend is only asked for the bytes after each seek
+// position as they are read.
+func (s *Store) Open(ctx context.Context, key string, size int64) (io.ReadSeekCloser, error) {
+	r := &reader{ctx: ctx, backend: s.backend, key: key, size: size}
+	// Open eagerly so a missing blob is reported here rather than by the
+	// first Read
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CollectGarbage deletes blobs that have had no references for the grace
+// period and returns how many were deleted.
+func (s *Store) CollectGarbage(ctx context.Context) (int, error) {
+	deleted := 0
+	for {
+		cutoff := time.Now().UTC().Add(-s.grace)
+		blobs, err := s.queries.ListGarbageBlobs(ctx, schema.ListGarbageBlobsParams{
+			UpdatedAt: cutoff,
+			Limit:     gcBatchSize,
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list unreferenced blobs: %w", err)
+		}
+
+		progress := false
+		for _, b := range blobs {
+			if ctx.Err() != nil {
+				return deleted, ctx.Err()
+			}
+			ok, err := s.collect(ctx, b.Hash, cutoff)
+			if err != nil {
+				metrics.Errors.WithLabelValues("blob_gc").Inc()
+				logger.Error(ctx, "Failed to delete blob", "hash", b.Hash, "error", err)
+				continue
+			}
+			if ok {
+				deleted++
+				progress = true
+			}
+		}
+		if len(blobs) < gcBatchSize || !progress {
+			return deleted, nil
+		}
+	}
+}
+
+// collect deletes one blob if it is still unreferenced. The row is leased
+// while the content is deleted and goes even if that fails: the orphaned
+// object is harmless, and a later Put of the same content reuses it.
+func (s *Store) collect(ctx context.Context, key string, cutoff time.Time) (bool, error) {
+	unlock := s.lock(key)
+	defer unlock()
+
+	lease := uuid.New().String()
+	now := time.Now().UTC()
+	n, err := s.queries.LeaseGarbageBlob(ctx, schema.LeaseGarbageBlobParams{
+		Lease:      lease,
+		LeaseUntil: sql.NullTime{Time: now.Add(gcLease), Valid: true},
+		Hash:       key,
+		UpdatedAt:  cutoff,
+		Now:        sql.NullTime{Time: now, Valid: true},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to lease blob: %w", err)
+	}
+	if n == 0 {
+		// Acquired, re-registered or being collected by another instance
+		// since it was listed
+		return false, nil
+	}
+
+	deleteCtx, cancel := context.WithTimeout(ctx, gcLease/2)
+	defer cancel()
+	deleteErr := s.backend.Delete(deleteCtx, key)
+	if _, err := s.queries.DeleteLeasedBlob(ctx, schema.DeleteLeasedBlobParams{Hash: key, Lease: lease}); err != nil {
+		return false, fmt.Errorf("failed to delete blob row: %w", err)
+	}
+	if deleteErr != nil {
+		return false, deleteErr
+	}
+	return true, nil
+}
+
+// Start collects garbage every interval in the background until Shutdown.
+func (s *Store) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			n, err := s.CollectGarbage(s.ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				metrics.Errors.WithLabelValues("blob_gc").Inc()
+				logger.Error(s.ctx, "Blob garbage collection failed", "error", err)
+			} else if n > 0 {
+				logger.Info(s.ctx, "Collected unreferenced blobs", "count", n)
+			}
+		}
+	}()
+}
+
+// Shutdown stops background garbage collection and waits until ctx is done
+// for it to finish.
+func (s *Store) Shutdown(ctx context.Context) error {
+	s.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lock locks key and returns the function that unlocks it.
+func (s *Store) lock(key string) func() {
+	s.locksMu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &keyLock{}
+		s.locks[key] = l
+	}
+	l.refs++
+	s.locksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.locksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, key)
+		}
+		s.locksMu.Unlock()
+	}
+}
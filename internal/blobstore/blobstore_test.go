@@ -0,0 +1,74 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+)
+
+// slowDelete is a backend whose deletions wait until release is closed.
+type slowDelete struct {
+	Backend
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *slowDelete) Delete(ctx context.Context, key string) error {
+	close(b.started)
+	<-b.release
+	return b.Backend.Delete(ctx, key)
+}
+
+func TestCollectLeasesBlobs(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+	fsb, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := &slowDelete{Backend: fsb, started: make(chan struct{}), release: make(chan struct{})}
+
+	// Two instances sharing the database and the backend
+	gc := New(db, slow)
+	other := New(db, fsb)
+	data := []byte("0123456789")
+	key, err := other.Put(ctx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gc.SetGrace(0)
+	time.Sleep(10 * time.Millisecond)
+	collected := make(chan error, 1)
+	go func() {
+		_, err := gc.CollectGarbage(ctx)
+		collected <- err
+	}()
+	<-slow.started
+
+	// A Put of the content being deleted waits for the deletion, then
+	// stores it again
+	put := make(chan error, 1)
+	go func() {
+		_, err := other.Put(ctx, data)
+		put <- err
+	}()
+	select {
+	case err := <-put:
+		t.Fatalf("Put returned %v while the content was being deleted", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(slow.release)
+	if err := <-collected; err != nil {
+		t.Fatalf("CollectGarbage = %v", err)
+	}
+	if err := <-put; err != nil {
+		t.Fatalf("Put = %v", err)
+	}
+	if got, err := other.Get(ctx, key); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get after the collection = %q, %v", got, err)
+	}
+}
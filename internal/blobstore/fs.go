@@ -0,0 +1,112 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FS stores blobs as files below a root directory, fanned out by the first
+// two bytes of the key: <root>/ab/cd/abcd....
+type FS struct {
+	root string
+}
+
+// NewFS creates a filesystem backend rooted at dir, creating it if needed.
+func NewFS(dir string) (*FS, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &FS{root: dir}, nil
+}
+
+func (b *FS) path(key string) string {
+	return filepath.Join(b.root, key[0:2], key[2:4], key)
+}
+
+// Put writes data to a temporary file and renames it into place, so a
+// partially written blob is never visible under its key.
+func (b *FS) Put(ctx context.Context, key string, data []byte) error {
+	if !validKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	path := b.path(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+	return nil
+}
+
+// Get opens the blob file positioned at offset.
+func (b *FS) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(b.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to seek blob: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// Exists reports whether the blob file exists.
+func (b *FS) Exists(ctx context.Context, key string) (bool, error) {
+	if !validKey(key) {
+		return false, nil
+	}
+	_, err := os.Stat(b.path(key))
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to stat blob: %w", err)
+	}
+}
+
+// Delete removes the blob file.
+func (b *FS) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return nil
+	}
+	if err := os.Remove(b.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
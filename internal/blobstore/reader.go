@@ -0,0 +1,74 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// reader is a seekable view of a blob. Seeking only records the position;
+// the next Read asks the backend for the content from there on.
+type reader struct {
+	ctx     context.Context
+	backend Backend
+	key     string
+	size    int64
+
+	pos int64
+	rc  io.ReadCloser // open at pos, or nil
+}
+
+func (r *reader) open() error {
+	rc, err := r.backend.Get(r.ctx, r.key, r.pos)
+	if err != nil {
+		return err
+	}
+	r.rc = rc
+	return nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.rc == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.rc.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("blobstore: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("blobstore: negative position")
+	}
+	if pos != r.pos && r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *reader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
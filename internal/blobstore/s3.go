@@ -0,0 +1,337 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config locates a bucket on an S3-compatible service.
+type S3Config struct {
+	// Endpoint is the service URL, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://localhost:9000 for a local MinIO.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to every object key, e.g. "mailroom/".
+	Prefix string
+	// PathStyle addresses objects as <endpoint>/<bucket>/<key> instead of
+	// <bucket>.<endpoint host>/<key>. Most self-hosted services need it.
+	PathStyle bool
+}
+
+// S3ConfigFromEnv reads the BLOB_S3_ENDPOINT, BLOB_S3_REGION,
+// BLOB_S3_BUCKET, BLOB_S3_ACCESS_KEY, BLOB_S3_SECRET_KEY, BLOB_S3_PREFIX and
+// BLOB_S3_PATH_STYLE environment variables.
+func S3ConfigFromEnv() (S3Config, error) {
+	cfg := S3Config{
+		Endpoint:  os.Getenv("BLOB_S3_ENDPOINT"),
+		Region:    os.Getenv("BLOB_S3_REGION"),
+		Bucket:    os.Getenv("BLOB_S3_BUCKET"),
+		AccessKey: os.Getenv("BLOB_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("BLOB_S3_SECRET_KEY"),
+		Prefix:    os.Getenv("BLOB_S3_PREFIX"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	if v := os.Getenv("BLOB_S3_PATH_STYLE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return S3Config{}, fmt.Errorf("invalid BLOB_S3_PATH_STYLE %q", v)
+		}
+		cfg.PathStyle = b
+	}
+	if cfg.Bucket == "" {
+		return S3Config{}, errors.New("BLOB_S3_BUCKET is required for the s3 blob backend")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return S3Config{}, errors.New("BLOB_S3_ACCESS_KEY and BLOB_S3_SECRET_KEY are required for the s3 blob backend")
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return S3Config{}, fmt.Errorf("invalid BLOB_S3_ENDPOINT: %w", err)
+	}
+	return cfg, nil
+}
+
+// S3 stores blobs as objects in an S3-compatible bucket. Requests are signed
+// with AWS Signature Version 4.
+type S3 struct {
+	cfg    S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewS3 creates an S3 backend. A nil client means http.DefaultClient.
+func NewS3(cfg S3Config, client *http.Client) *S3 {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{cfg: cfg, client: client, now: time.Now}
+}
+
+// objectURL returns the URL of the object holding key.
+func (b *S3) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(b.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	object := b.cfg.Prefix + key
+	if b.cfg.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.cfg.Bucket + "/" + object
+	} else {
+		u.Host = b.cfg.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + object
+	}
+	u.RawPath = awsEscapePath(u.Path)
+	return u, nil
+}
+
+// do signs and sends a request for key.
+func (b *S3) do(ctx context.Context, method, key string, body []byte, header http.Header) (*http.Response, error) {
+	u, err := b.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 request: %w", err)
+	}
+	if body == nil {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	signV4(req, b.cfg, payloadHash, b.now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 %s failed: %w", method, err)
+	}
+	return resp, nil
+}
+
+// Put uploads data as the object for key.
+func (b *S3) Put(ctx context.Context, key string, data []byte) error {
+	if !validKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := b.do(ctx, http.MethodPut, key, data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(http.MethodPut, resp)
+	}
+	return nil
+}
+
+// Get downloads the object for key from offset on, using a Range request.
+func (b *S3) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrNotFound
+	}
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := b.do(ctx, http.MethodGet, key, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Offset at or past the end: nothing left to read
+		resp.Body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, s3Error(http.MethodGet, resp)
+	}
+}
+
+// Exists checks for the object with a HEAD request.
+func (b *S3) Exists(ctx context.Context, key string) (bool, error) {
+	if !validKey(key) {
+		return false, nil
+	}
+	resp, err := b.do(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, s3Error(http.MethodHead, resp)
+	}
+}
+
+// Delete removes the object for key.
+func (b *S3) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return nil
+	}
+	resp, err := b.do(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s3Error(http.MethodDelete, resp)
+	}
+}
+
+// s3Error describes an unexpected response, including the start of the
+// error document the service returned.
+func s3Error(method string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if len(msg) == 0 {
+		return fmt.Errorf("S3 %s failed: %s", method, resp.Status)
+	}
+	return fmt.Errorf("S3 %s failed: %s: %s", method, resp.Status, bytes.TrimSpace(msg))
+}
+
+// signV4 adds the AWS Signature Version 4 headers to req. The host, the
+// x-amz-* headers and Range, Content-Type and Content-MD5 if present are
+// signed.
+func signV4(req *http.Request, cfg S3Config, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" ||
+			lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery sorts and escapes query parameters as SigV4 requires.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscapePath escapes each segment of a path with awsEscape.
+func awsEscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = awsEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsEscape percent-encodes everything except the RFC 3986 unreserved
+// characters, which is stricter than url.PathEscape.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
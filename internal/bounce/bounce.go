@@ -0,0 +1,219 @@
+// Package bounce recognizes the bounces among the mail users receive and
+// keeps each user's suppression list. A bounce's failed recipients are
+// recorded against the sent message it returns; recipients whose mail failed
+// permanently are suppressed, so that outbound mail to them is refused until
+// the user clears them.
+package bounce
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+var ErrSuppressionNotFound = errors.New("suppression not found")
+
+// Bounce is a failed recipient a bounce reported, as the API shows it.
+type Bounce struct {
+	ID            string `json:"id"`
+	MessageID     string `json:"message_id"` // the bounce
+	SentMessageID string `json:"sent_message_id,omitempty"`
+	Recipient
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newBounce(row schema.Bounce) Bounce {
+	return Bounce{
+		ID:            row.ID,
+		MessageID:     row.MessageID,
+		SentMessageID: row.SentMessageID,
+		Recipient: Recipient{
+			Address:    row.Recipient,
+			Action:     row.Action,
+			Status:     row.Status,
+			Diagnostic: row.Diagnostic,
+		},
+		CreatedAt: row.CreatedAt,
+	}
+}
+
+// Suppression is a recipient a user's mail isn't sent to, with the latest
+// bounce that failed permanently for it.
+type Suppression struct {
+	Address         string    `json:"address"`
+	Status          string    `json:"status"`
+	Diagnostic      string    `json:"diagnostic,omitempty"`
+	BounceMessageID string    `json:"bounce_message_id,omitempty"`
+	SentMessageID   string    `json:"sent_message_id,omitempty"`
+	Bounces         int64     `json:"bounces"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+func newSuppression(row schema.Suppression) Suppression {
+	return Suppression{
+		Address:         row.Address,
+		Status:          row.Status,
+		Diagnostic:      row.Diagnostic,
+		BounceMessageID: row.BounceMessageID,
+		SentMessageID:   row.SentMessageID,
+		Bounces:         row.Bounces,
+		CreatedAt:       row.CreatedAt,
+		UpdatedAt:       row.UpdatedAt,
+	}
+}
+
+// Service records bounces and keeps users' suppression lists.
+type Service struct {
+	db database.Service
+}
+
+// New creates a Service.
+func New(db database.Service) *Service {
+	return &Service{db: db}
+}
+
+// Process records the report of a stored message if it is a bounce.
+func (s *Service) Process(ctx context.Context, rec database.MessageRecord, _ mailstore.Envelope) error {
+	m, err := mime.Parse(rec.Blobs[rec.Body.RawHash])
+	if err != nil {
+		return nil
+	}
+	report, ok := Parse(m)
+	if !ok {
+		return nil
+	}
+
+	userID := rec.Message.UserID
+	q := s.db.Queries()
+	sentID := ""
+	if report.OriginalMessageID != "" {
+		sent, err := q.GetMessageByInternetMessageID(ctx, schema.GetMessageByInternetMessageIDParams{
+			UserID:            userID,
+			InternetMessageID: report.OriginalMessageID,
+		})
+		switch {
+		case err == nil:
+			sentID = sent.ID
+		case !errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("failed to find bounced message: %w", err)
+		}
+	}
+
+	err = s.db.WithTx(ctx, func(q *schema.Queries) error {
+		for _, r := range report.Recipients {
+			err := q.InsertBounce(ctx, schema.InsertBounceParams{
+				ID:            uuid.New().String(),
+				UserID:        userID,
+				MessageID:     rec.Message.ID,
+				SentMessageID: sentID,
+				Recipient:     r.Address,
+				Action:        r.Action,
+				Status:        r.Status,
+				Diagnostic:    r.Diagnostic,
+			})
+			if err != nil {
+				return err
+			}
+			if !r.Permanent() {
+				continue
+			}
+			err = q.UpsertSuppression(ctx, schema.UpsertSuppressionParams{
+				UserID:          userID,
+				Address:         r.Address,
+				Status:          r.Status,
+				Diagnostic:      r.Diagnostic,
+				BounceMessageID: rec.Message.ID,
+				SentMessageID:   sentID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record bounce: %w", err)
+	}
+	logger.Info(ctx, "Recorded bounce", "message_id", rec.Message.ID, "sent_message_id", sentID, "recipients", len(report.Recipients))
+	return nil
+}
+
+// Bounces returns the bounces recorded for one of userID's sent messages.
+func (s *Service) Bounces(ctx context.Context, userID, sentMessageID string) ([]Bounce, error) {
+	rows, err := s.db.Queries().ListBouncesBySentMessage(ctx, schema.ListBouncesBySentMessageParams{
+		UserID:        userID,
+		SentMessageID: sentMessageID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bounces: %w", err)
+	}
+	list := make([]Bounce, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, newBounce(row))
+	}
+	return list, nil
+}
+
+// List returns userID's suppression list, most recently bounced first.
+func (s *Service) List(ctx context.Context, userID string) ([]Suppression, error) {
+	rows, err := s.db.Queries().ListSuppressionsByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list suppressions: %w", err)
+	}
+	list := make([]Suppression, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, newSuppression(row))
+	}
+	return list, nil
+}
+
+// Get returns the suppression of address from userID's list.
+func (s *Service) Get(ctx context.Context, userID, address string) (Suppression, error) {
+	row, err := s.db.Queries().GetSuppression(ctx, schema.GetSuppressionParams{UserID: userID, Address: normalize(address)})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Suppression{}, ErrSuppressionNotFound
+		}
+		return Suppression{}, fmt.Errorf("failed to get suppression: %w", err)
+	}
+	return newSuppression(row), nil
+}
+
+// Delete clears address from userID's suppression list, so that mail to it
+// is sent again.
+func (s *Service) Delete(ctx context.Context, userID, address string) error {
+	n, err := s.db.Queries().DeleteSuppression(ctx, schema.DeleteSuppressionParams{UserID: userID, Address: normalize(address)})
+	if err != nil {
+		return fmt.Errorf("failed to delete suppression: %w", err)
+	}
+	if n == 0 {
+		return ErrSuppressionNotFound
+	}
+	return nil
+}
+
+// Suppressed returns the addresses among addrs on userID's suppression
+// list.
+func Suppressed(ctx context.Context, q *schema.Queries, userID string, addrs []string) ([]string, error) {
+	var suppressed []string
+	for _, addr := range addrs {
+		_, err := q.GetSuppression(ctx, schema.GetSuppressionParams{UserID: userID, Address: normalize(addr)})
+		switch {
+		case err == nil:
+			suppressed = append(suppressed, addr)
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("failed to check suppression list: %w", err)
+		}
+	}
+	return suppressed, nil
+}
@@ -0,0 +1,248 @@
+package bounce
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+var dsn = crlf(`From: Mail Delivery System <MAILER-DAEMON@mx.example.com>
+To: user@example.com
+Subject: Undelivered Mail Returned to Sender
+Message-ID: <bounce-1@mx.example.com>
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="b1"
+
+--b1
+Content-Type: text/plain
+
+I'm sorry to have to inform you that your message could not
+be delivered to one or more recipients.
+
+--b1
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+Arrival-Date: Mon, 12 May 2025 10:00:00 +0000
+
+Final-Recipient: rfc822; gone@example.net
+Original-Recipient: rfc822;Gone@example.net
+Action: failed
+Status: 5.1.1
+Diagnostic-Code: smtp; 550 5.1.1 <gone@example.net>: Recipient address
+ rejected: User unknown
+
+Final-Recipient: rfc822; slow@example.net
+Action: delayed
+Status: 4.4.1
+Diagnostic-Code: smtp; 451 4.4.1 Connection timed out
+
+Final-Recipient: rfc822; fine@example.net
+Action: delivered
+Status: 2.0.0
+
+--b1
+Content-Type: text/rfc822-headers
+
+From: user@example.com
+To: gone@example.net, slow@example.net, fine@example.net
+Subject: Status
+Message-ID: <status-1@example.com>
+
+--b1--
+`)
+
+var qmail = crlf(`From: MAILER-DAEMON@mail.example.org
+To: user@example.com
+Subject: failure notice
+
+Hi. This is the qmail-send program at mail.example.org.
+I'm afraid I wasn't able to deliver your message to the following addresses.
+This is a permanent error; I've given up. Sorry it didn't work out.
+
+<nobody@example.org>:
+Sorry, no mailbox here by that name. (#5.1.1)
+
+--- Below this line is a copy of the message.
+
+Return-Path: <user@example.com>
+From: user@example.com
+To: nobody@example.org
+Message-ID: <status-2@example.com>
+
+Hello
+`)
+
+var exim = crlf(`From: Mail Delivery System <Mailer-Daemon@exim.example.org>
+To: user@example.com
+Subject: Mail delivery failed: returning message to sender
+
+This message was created automatically by mail delivery software.
+
+A message that you sent could not be delivered to one or more of its
+recipients. This is a permanent error. The following address(es) failed:
+
+  old@example.org
+    host mx.example.org [192.0.2.1]
+    SMTP error from remote mail server after RCPT TO:<old@example.org>:
+    550 No such user here
+
+------ This is a copy of the message, including all the headers. ------
+
+Message-ID: <status-3@example.com>
+`)
+
+var postfix = crlf(`From: MAILER-DAEMON@relay.example.com (Mail Delivery System)
+To: user@example.com
+Subject: Undelivered Mail Returned to Sender
+
+This is the mail system at host relay.example.com.
+
+I'm sorry to have to inform you that your message could not
+be delivered to one or more recipients.
+
+<full@example.net>: host mx.example.net[192.0.2.2] said: 452 4.2.2 Mailbox
+    full (in reply to RCPT TO command)
+`)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		want       []Recipient
+		originalID string
+		standard   bool
+	}{
+		{"dsn", dsn, []Recipient{
+			{Address: "gone@example.net", Action: ActionFailed, Status: "5.1.1", Diagnostic: "550 5.1.1 <gone@example.net>: Recipient address rejected: User unknown"},
+			{Address: "slow@example.net", Action: ActionDelayed, Status: "4.4.1", Diagnostic: "451 4.4.1 Connection timed out"},
+		}, "status-1@example.com", true},
+		{"qmail", qmail, []Recipient{
+			{Address: "nobody@example.org", Action: ActionFailed, Status: "5.1.1", Diagnostic: "Sorry, no mailbox here by that name. (#5.1.1)"},
+		}, "status-2@example.com", false},
+		{"exim", exim, []Recipient{
+			{Address: "old@example.org", Action: ActionFailed, Status: "5.0.0", Diagnostic: "host mx.example.org [192.0.2.1] SMTP error from remote mail server after RCPT TO:<old@example.org>: 550 No such user here"},
+		}, "status-3@example.com", false},
+		{"postfix", postfix, []Recipient{
+			{Address: "full@example.net", Action: ActionDelayed, Status: "4.2.2", Diagnostic: "host mx.example.net[192.0.2.2] said: 452 4.2.2 Mailbox full (in reply to RCPT TO command)"},
+		}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := mime.Parse([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, ok := Parse(m)
+			if !ok {
+				t.Fatal("not recognized as a bounce")
+			}
+			if r.OriginalMessageID != tt.originalID || r.Standard != tt.standard {
+				t.Errorf("got original %q, standard %v", r.OriginalMessageID, r.Standard)
+			}
+			if len(r.Recipients) != len(tt.want) {
+				t.Fatalf("got recipients %+v", r.Recipients)
+			}
+			for i, want := range tt.want {
+				if r.Recipients[i] != want {
+					t.Errorf("got %+v\nwant %+v", r.Recipients[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseNotBounce(t *testing.T) {
+	for name, raw := range map[string]string{
+		"personal mail":             "From: bob@example.net\r\nTo: user@example.com\r\nSubject: Lunch\r\n\r\nAsk old@example.org:\r\n",
+		"success report":            strings.NewReplacer("Action: failed", "Action: delivered", "Action: delayed", "Action: relayed").Replace(dsn),
+		"daemon without recipients": "From: MAILER-DAEMON@mx.example.com\r\nTo: user@example.com\r\nSubject: Hi\r\n\r\nQueue report.\r\n",
+	} {
+		m, err := mime.Parse([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := Parse(m); ok {
+			t.Errorf("%s: recognized as a bounce: %+v", name, r)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	s := New(db)
+	store.Use(s)
+	ctx := context.Background()
+
+	sentID, err := store.Deliver(ctx, mailstore.Delivery{
+		UserID:   "u1",
+		Outgoing: true,
+		Raw: []byte("From: user@example.com\r\nTo: Gone@example.net\r\nSubject: Status\r\n" +
+			"Message-ID: <status-1@example.com>\r\n\r\nAll good.\r\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounceID, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(dsn)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bounces, err := s.Bounces(ctx, "u1", sentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounces) != 2 || bounces[0].MessageID != bounceID {
+		t.Fatalf("got bounces %+v", bounces)
+	}
+
+	// Only the permanent failure is suppressed
+	list, err := s.List(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Address != "gone@example.net" || list[0].SentMessageID != sentID || list[0].Status != "5.1.1" {
+		t.Fatalf("got suppressions %+v", list)
+	}
+	got, err := Suppressed(ctx, db.Queries(), "u1", []string{"fine@example.net", "GONE@example.net", "slow@example.net"})
+	if err != nil || len(got) != 1 || got[0] != "GONE@example.net" {
+		t.Errorf("got suppressed %v, %v", got, err)
+	}
+
+	// Another bounce counts against the same entry
+	if _, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(strings.Replace(dsn, "bounce-1@", "bounce-2@", 1))}); err != nil {
+		t.Fatal(err)
+	}
+	sup, err := s.Get(ctx, "u1", "Gone@Example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sup.Bounces != 2 {
+		t.Errorf("got %d bounces, want 2", sup.Bounces)
+	}
+
+	if err := s.Delete(ctx, "u1", "gone@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "u1", "gone@example.net"); !errors.Is(err, ErrSuppressionNotFound) {
+		t.Errorf("got %v, want %v", err, ErrSuppressionNotFound)
+	}
+	if err := s.Delete(ctx, "u1", "gone@example.net"); !errors.Is(err, ErrSuppressionNotFound) {
+		t.Errorf("got %v, want %v", err, ErrSuppressionNotFound)
+	}
+}
@@ -0,0 +1,323 @@
+package bounce
+
+import (
+	"bufio"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+// Actions of a failed recipient (RFC 3464 section 2.3.3). Reports of
+// recipients that were delivered, relayed or expanded aren't bounces.
+const (
+	ActionFailed  = "failed"
+	ActionDelayed = "delayed"
+)
+
+// maxDiagnostic bounds the diagnostic kept for a recipient, in bytes.
+const maxDiagnostic = 1000
+
+// Recipient is a recipient a bounce reports mail to as undelivered.
+type Recipient struct {
+	Address    string `json:"address"`
+	Action     string `json:"action"`
+	Status     string `json:"status"` // RFC 3463, e.g. "5.1.1"
+	Diagnostic string `json:"diagnostic,omitempty"`
+}
+
+// Permanent reports whether mail to r failed for good rather than for now.
+func (r Recipient) Permanent() bool {
+	return r.Action == ActionFailed && !strings.HasPrefix(r.Status, "4.")
+}
+
+// Report is what a bounce says about the message it returns.
+type Report struct {
+	Recipients []Recipient
+	// OriginalMessageID is the Message-ID of the bounced message, without
+	// angle brackets, or empty if the bounce doesn't quote it.
+	OriginalMessageID string
+	// Standard is set for RFC 3464 reports, and unset for bounces
+	// recognized by their wording.
+	Standard bool
+}
+
+// Parse recognizes m as a bounce and reads its report. It understands
+// RFC 3464 delivery status notifications and the plain-text bounces of
+// qmail, Exim and Postfix and servers that mimic them; it returns false for
+// anything else, including delivery reports that only announce success.
+func Parse(m *mime.Message) (*Report, bool) {
+	if r := parseDSN(m); r != nil {
+		return r, len(r.Recipients) > 0
+	}
+	if !looksLikeBounce(m) {
+		return nil, false
+	}
+	text := bodyText(m)
+	r := &Report{Recipients: parseText(m, text)}
+	if len(r.Recipients) == 0 {
+		return nil, false
+	}
+	r.OriginalMessageID = originalMessageID(m)
+	if r.OriginalMessageID == "" {
+		if match := quotedMessageID.FindStringSubmatch(text); match != nil {
+			r.OriginalMessageID = match[1]
+		}
+	}
+	return r, true
+}
+
+// parseDSN reads the delivery-status part of an RFC 3464 report, or returns
+// nil if m has none.
+func parseDSN(m *mime.Message) *Report {
+	var status *mime.Part
+	m.Root.Walk(func(p *mime.Part) {
+		if status == nil && (p.MediaType == "message/delivery-status" || p.MediaType == "message/global-delivery-status") {
+			status = p
+		}
+	})
+	if status == nil {
+		return nil
+	}
+
+	r := &Report{Standard: true, OriginalMessageID: originalMessageID(m)}
+	// The per-message fields come first, then a group per recipient
+	blocks := strings.Split(strings.ReplaceAll(string(status.Body), "\r\n", "\n"), "\n\n")
+	for _, block := range blocks[1:] {
+		if strings.TrimSpace(block) == "" {
+			continue
+		}
+		h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(strings.TrimLeft(block, "\n") + "\n\n"))).ReadMIMEHeader()
+		if err != nil && len(h) == 0 {
+			continue
+		}
+		addr := typedValue(h.Get("Original-Recipient"))
+		if addr == "" {
+			addr = typedValue(h.Get("Final-Recipient"))
+		}
+		action := strings.ToLower(strings.TrimSpace(h.Get("Action")))
+		if addr == "" || (action != ActionFailed && action != ActionDelayed) {
+			continue
+		}
+		st, _, _ := strings.Cut(strings.TrimSpace(h.Get("Status")), " ")
+		r.Recipients = append(r.Recipients, Recipient{
+			Address:    normalize(addr),
+			Action:     action,
+			Status:     st,
+			Diagnostic: truncate(typedValue(h.Get("Diagnostic-Code"))),
+		})
+	}
+	return r
+}
+
+// typedValue returns the value of a field like "rfc822; user@example.com".
+func typedValue(v string) string {
+	if _, after, ok := strings.Cut(v, ";"); ok {
+		v = after
+	}
+	return strings.Trim(strings.TrimSpace(v), "<>")
+}
+
+var (
+	daemons = map[string]bool{
+		"mailer-daemon": true, "postmaster": true, "mail-daemon": true, "mailerdaemon": true,
+	}
+	bounceSubjects = []string{
+		"undeliver", "delivery status notification", "returned mail", "failure notice",
+		"delivery failure", "mail delivery failed", "delivery has failed", "could not be delivered",
+		"delivery notification", "mail delivery system",
+	}
+	delayWords = []string{
+		"delayed", "will retry", "will continue to try", "still trying", "temporary failure",
+		"not yet been delivered",
+	}
+
+	// An address alone on a line, as qmail and Exim list them
+	addressLine = regexp.MustCompile(`^\s*<?([^\s<>@"]+@[^\s<>@:]+\.[^\s<>@:]+?)>?:?\s*$`)
+	// "<addr>: diagnostic", as Postfix lists them
+	postfixLine = regexp.MustCompile(`^\s*<([^\s<>@"]+@[^\s<>@]+)>(?: \(expanded from <[^>]*>\))?:\s*(.+)$`)
+	// The start of the returned message
+	originalStart = regexp.MustCompile(`(?i)^\s*-{2,}.*(original message|copy of the message|below this line|undelivered message|message headers|returned message)`)
+
+	enhancedCode    = regexp.MustCompile(`\b([245])\.(\d{1,3})\.(\d{1,3})\b`)
+	basicCode       = regexp.MustCompile(`\b([245])\d\d\b`)
+	quotedMessageID = regexp.MustCompile(`(?im)^\s*Message-ID:\s*<([^>\s]+)>`)
+)
+
+// looksLikeBounce reports whether m comes from a mail system rather than a
+// person and is worded like a bounce.
+func looksLikeBounce(m *mime.Message) bool {
+	for _, a := range m.From {
+		local, _, _ := strings.Cut(a.Address, "@")
+		if daemons[strings.ToLower(local)] {
+			return true
+		}
+	}
+	subject := strings.ToLower(m.Subject)
+	for _, s := range bounceSubjects {
+		if strings.Contains(subject, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyText returns the first text/plain part of m that isn't an attachment.
+func bodyText(m *mime.Message) string {
+	var text string
+	found := false
+	m.Root.Walk(func(p *mime.Part) {
+		if !found && p.MediaType == "text/plain" && p.Disposition != "attachment" {
+			text, found = p.Text, true
+		}
+	})
+	return text
+}
+
+// parseText reads the failed recipients from the text of a plain bounce:
+// each listed address followed by the reason it failed.
+func parseText(m *mime.Message, text string) []Recipient {
+	// The bounced user's own addresses and the daemon's appear too
+	skip := map[string]bool{}
+	for _, list := range [][]string{addresses(m.From), addresses(m.To)} {
+		for _, a := range list {
+			skip[a] = true
+		}
+	}
+	delayed := false
+	lower := strings.ToLower(m.Subject + "\n" + text)
+	for _, w := range delayWords {
+		if strings.Contains(lower, w) {
+			delayed = true
+			break
+		}
+	}
+
+	var recipients []Recipient
+	var cur *Recipient
+	var diag []string
+	flush := func() {
+		if cur != nil {
+			cur.Diagnostic = truncate(strings.Join(diag, " "))
+			recipients = append(recipients, *cur)
+		}
+		cur, diag = nil, nil
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if originalStart.MatchString(line) {
+			break
+		}
+		var addr, rest string
+		if match := postfixLine.FindStringSubmatch(line); match != nil {
+			addr, rest = match[1], match[2]
+		} else if match := addressLine.FindStringSubmatch(line); match != nil {
+			addr = match[1]
+		}
+		if addr != "" && !skip[normalize(addr)] {
+			flush()
+			cur = &Recipient{Address: normalize(addr)}
+			if rest != "" {
+				diag = append(diag, strings.TrimSpace(rest))
+			}
+			continue
+		}
+		switch {
+		case cur == nil:
+		case strings.TrimSpace(line) == "":
+			if len(diag) > 0 {
+				flush()
+			}
+		default:
+			diag = append(diag, strings.TrimSpace(line))
+		}
+	}
+	flush()
+
+	// Status codes in the text apply to recipients whose reason has none
+	fallback := ""
+	if match := enhancedCode.FindString(text); match != "" {
+		fallback = match
+	}
+	for i := range recipients {
+		r := &recipients[i]
+		r.Status = status(r.Diagnostic, fallback, delayed)
+		r.Action = ActionFailed
+		if strings.HasPrefix(r.Status, "4.") {
+			r.Action = ActionDelayed
+		}
+	}
+	return recipients
+}
+
+// status returns the status code in diagnostic, falling back to fallback
+// and then to a generic code for a failure or delay.
+func status(diagnostic, fallback string, delayed bool) string {
+	if match := enhancedCode.FindString(diagnostic); match != "" {
+		return match
+	}
+	if match := basicCode.FindStringSubmatch(diagnostic); match != nil {
+		return match[1] + ".0.0"
+	}
+	if fallback != "" {
+		return fallback
+	}
+	if delayed {
+		return "4.0.0"
+	}
+	return "5.0.0"
+}
+
+// originalMessageID returns the Message-ID of the message or headers a
+// bounce returns in a part of their own.
+func originalMessageID(m *mime.Message) string {
+	var id string
+	m.Root.Walk(func(p *mime.Part) {
+		if id != "" {
+			return
+		}
+		switch p.MediaType {
+		case "message/rfc822", "message/global":
+			if p.Embedded != nil {
+				id = messageID(p.Embedded.Header.Get("Message-Id"))
+			}
+		case "text/rfc822-headers", "message/global-headers":
+			if h, err := mime.Parse(append(p.Body, "\r\n"...)); err == nil {
+				id = h.MessageID
+			}
+		}
+	})
+	return id
+}
+
+func messageID(v string) string {
+	v = strings.TrimSpace(v)
+	if start := strings.IndexByte(v, '<'); start >= 0 {
+		if end := strings.IndexByte(v[start:], '>'); end > 0 {
+			return v[start+1 : start+end]
+		}
+	}
+	return v
+}
+
+func addresses(list []*mail.Address) []string {
+	out := make([]string, len(list))
+	for i, a := range list {
+		out[i] = normalize(a.Address)
+	}
+	return out
+}
+
+// normalize returns the form addresses are suppressed under.
+func normalize(addr string) string {
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+func truncate(s string) string {
+	if len(s) <= maxDiagnostic {
+		return s
+	}
+	// Drop a UTF-8 sequence split by the cut
+	return strings.ToValidUTF8(s[:maxDiagnostic], "")
+}
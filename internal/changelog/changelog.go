@@ -0,0 +1,146 @@
+// Package changelog reads the log of changes to users' messages and labels,
+// so that clients can follow them as they happen and pick up where they
+// left off after a disconnect, or sync what changed since they last did.
+// The log is kept by triggers in the database, which record every change
+// whichever code path makes it, and is compacted once old.
+package changelog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/flags"
+)
+
+// Event types.
+const (
+	EventMessageCreated       = "message.created"
+	EventMessageDeleted       = "message.deleted"
+	EventMessageFlagsChanged  = "message.flags_changed"
+	EventMessageLabelsChanged = "message.labels_changed"
+	EventLabelCreated         = "label.created"
+	EventLabelUpdated         = "label.updated"
+	EventLabelDeleted         = "label.deleted"
+)
+
+// DefaultPollInterval is how often followers of the log look for changes.
+// Changes can be made by other instances, so the log is polled.
+const DefaultPollInterval = time.Second
+
+// Event is a change to one of a user's messages or labels. IDs increase in
+// the order changes were made.
+//
+// A flags change has the flag (read, starred, important or answered) or
+// custom keyword that was set or removed. A labels change has the label
+// that was put on the message or taken off it; leaving the Inbox is how a
+// message is archived. A label event has the label's ID and path, except
+// that the labels a deleted message was put on or taken off become updates
+// with only the path.
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	MessageID string    `json:"message_id,omitempty"`
+	LabelID   string    `json:"label_id,omitempty"`
+	Flag      string    `json:"flag,omitempty"`
+	Keyword   string    `json:"keyword,omitempty"`
+	Label     string    `json:"label,omitempty"`
+	Added     *bool     `json:"added,omitempty"` // for flags and labels changes
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// flagNames are the names the API gives the flags kept as keywords.
+var flagNames = map[string]string{
+	flags.KeywordStarred:   "starred",
+	flags.KeywordImportant: "important",
+	flags.KeywordAnswered:  "answered",
+}
+
+func newEvent(row schema.ChangeLog) Event {
+	e := Event{
+		ID:        row.ID,
+		Type:      row.Type,
+		MessageID: row.MessageID,
+		CreatedAt: row.CreatedAt,
+	}
+	switch row.Type {
+	case EventMessageFlagsChanged:
+		added := row.Added
+		e.Added = &added
+		// read is the message's is_read column; the other names are
+		// keywords as stored
+		if name, ok := flagNames[row.Name]; ok {
+			e.Flag = name
+		} else if row.Name == "read" {
+			e.Flag = row.Name
+		} else {
+			e.Keyword = row.Name
+		}
+	case EventMessageLabelsChanged:
+		added := row.Added
+		e.Added = &added
+		e.Label = row.Name
+	case EventLabelCreated, EventLabelUpdated, EventLabelDeleted:
+		e.LabelID = row.LabelID
+		e.Label = row.Name
+	}
+	return e
+}
+
+// Service reads users' change logs.
+type Service struct {
+	db database.Service
+}
+
+// New creates a Service.
+func New(db database.Service) *Service {
+	return &Service{db: db}
+}
+
+// Last returns the ID of userID's latest event, or of the latest compacted
+// away if there are none left, or 0. Following the log from it gives the
+// changes made from now on.
+func (s *Service) Last(ctx context.Context, userID string) (int64, error) {
+	q := s.db.Queries()
+	id, err := q.GetLastChangeID(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last change: %w", err)
+	}
+	state, err := q.GetModseq(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to get modseq: %w", err)
+	}
+	return max(id, state.CompactedID), nil
+}
+
+// Resume returns ErrCannotCalculateChanges if some of userID's events after
+// the one with ID after have been compacted away, so that following the log
+// from it would miss them.
+func (s *Service) Resume(ctx context.Context, userID string, after int64) error {
+	state, err := s.db.Queries().GetModseq(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get modseq: %w", err)
+	}
+	if after < state.CompactedID {
+		return ErrCannotCalculateChanges
+	}
+	return nil
+}
+
+// List returns up to limit of userID's events after the one with ID after,
+// oldest first.
+func (s *Service) List(ctx context.Context, userID string, after int64, limit int) ([]Event, error) {
+	rows, err := s.db.Queries().ListChanges(ctx, schema.ListChangesParams{UserID: userID, ID: after, Limit: int64(limit)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changes: %w", err)
+	}
+	events := make([]Event, 0, len(rows))
+	for _, row := range rows {
+		events = append(events, newEvent(row))
+	}
+	return events, nil
+}
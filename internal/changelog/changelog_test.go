@@ -0,0 +1,279 @@
+package changelog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+const testRaw = "From: alice@example.org\r\nTo: user@example.com\r\nSubject: Hello\r\n\r\nHi.\r\n"
+
+// describe returns what e says happened, leaving out the message.
+func describe(e Event) string {
+	s := e.Type
+	if e.Added != nil {
+		name := e.Flag + e.Keyword + e.Label
+		if *e.Added {
+			s += " +" + name
+		} else {
+			s += " -" + name
+		}
+	}
+	return s
+}
+
+func TestLog(t *testing.T) {
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	s := New(db)
+	ctx := context.Background()
+
+	start, err := s.Last(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u2", Raw: []byte(testRaw)}); err != nil {
+		t.Fatal(err)
+	}
+	read, starred := true, true
+	err = db.WithTx(ctx, func(q *schema.Queries) error {
+		err := flags.ApplyTx(ctx, q, "u1", id, flags.Change{Read: &read, Starred: &starred, AddKeywords: []string{"$Work"}})
+		if err != nil {
+			return err
+		}
+		return labels.Add(ctx, q, "u1", id, labels.Trash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := s.List(ctx, "u1", start, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"message.created",
+		"message.flags_changed +read",
+		"message.flags_changed +starred",
+		"message.flags_changed +$Work",
+		"message.labels_changed +Trash",
+		"message.labels_changed -Inbox",
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events %+v, want %v", len(events), events, want)
+	}
+	for i, e := range events {
+		if got := describe(e); got != want[i] || e.MessageID != id {
+			t.Errorf("event %d is %s of %s, want %s of %s", i, got, e.MessageID, want[i], id)
+		}
+		if i > 0 && e.ID <= events[i-1].ID {
+			t.Errorf("event IDs %d and %d aren't increasing", events[i-1].ID, e.ID)
+		}
+	}
+	last, err := s.Last(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != events[len(events)-1].ID {
+		t.Errorf("got last %d, want %d", last, events[len(events)-1].ID)
+	}
+	if page, err := s.List(ctx, "u1", events[1].ID, 2); err != nil || len(page) != 2 || page[0].ID != events[2].ID {
+		t.Errorf("got page %+v, %v", page, err)
+	}
+
+	// Once the message is deleted, only its creation and deletion are left,
+	// and the labels it was put on or taken off as changes to the labels
+	err = db.WithTx(ctx, func(q *schema.Queries) error {
+		_, err := database.DeleteMessageTx(ctx, q, "u1", id)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err = s.List(ctx, "u1", start, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, describe(e)+" "+e.Label)
+	}
+	want = []string{"message.created ", "label.updated Trash", "label.updated Inbox", "label.updated Trash", "message.deleted "}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q after the deletion, want %q", got, want)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	lbls := labels.New(db)
+	s := New(db)
+	ctx := context.Background()
+
+	start, err := s.State(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, err := lbls.Create(ctx, "u1", "Work", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.Changes(ctx, "u1", start, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.OldState != start || c.NewState <= start || c.HasMore {
+		t.Errorf("got states %d to %d, has more %v", c.OldState, c.NewState, c.HasMore)
+	}
+	if fmt.Sprint(c.Messages) != fmt.Sprint(EntityChanges{Created: []string{first}}) {
+		t.Errorf("got messages %+v, want %s created", c.Messages, first)
+	}
+	if !slices.Equal(c.Labels.Created, []string{work.ID}) || !slices.Contains(c.Labels.Updated, "inbox") {
+		t.Errorf("got labels %+v, want Work created and Inbox updated", c.Labels)
+	}
+
+	// A message created and destroyed in between is left out
+	since := c.NewState
+	if err := lbls.Modify(ctx, "u1", []string{first}, []string{work.ID}, nil); err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := true
+	err = db.WithTx(ctx, func(q *schema.Queries) error {
+		if err := flags.ApplyTx(ctx, q, "u1", first, flags.Change{Read: &read}); err != nil {
+			return err
+		}
+		_, err := database.DeleteMessageTx(ctx, q, "u1", second)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lbls.Update(ctx, "u1", work.ID, "Clients", ""); err != nil {
+		t.Fatal(err)
+	}
+	c, err = s.Changes(ctx, "u1", since, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(c.Messages) != fmt.Sprint(EntityChanges{Updated: []string{first}}) {
+		t.Errorf("got messages %+v, want %s updated", c.Messages, first)
+	}
+	want := []string{"archive", "inbox", work.ID}
+	slices.Sort(want)
+	slices.Sort(c.Labels.Updated)
+	if len(c.Labels.Created)+len(c.Labels.Destroyed) != 0 || !slices.Equal(c.Labels.Updated, want) {
+		t.Errorf("got labels %+v, want %v updated", c.Labels, want)
+	}
+
+	// Changes can be read a page at a time
+	page, err := s.Changes(ctx, "u1", start, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !page.HasMore || page.NewState != start+2 {
+		t.Errorf("got first page to %d, has more %v", page.NewState, page.HasMore)
+	}
+	for page.HasMore {
+		if page, err = s.Changes(ctx, "u1", page.NewState, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if page.NewState != c.NewState {
+		t.Errorf("paging ended at %d, want %d", page.NewState, c.NewState)
+	}
+
+	if _, err := s.Changes(ctx, "u1", c.NewState+1, 100); !errors.Is(err, ErrCannotCalculateChanges) {
+		t.Errorf("state from the future got %v", err)
+	}
+	if c, err := s.Changes(ctx, "u2", 0, 100); err != nil || c.NewState != 0 || len(c.Messages.Created) != 0 {
+		t.Errorf("another user got %+v, %v", c, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	s := New(db)
+	ctx := context.Background()
+
+	if _, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)}); err != nil {
+		t.Fatal(err)
+	}
+	state, err := s.State(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := s.Last(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCompactor(db)
+	if n, err := c.Compact(ctx); err != nil || n != 0 {
+		t.Fatalf("compacting recent changes deleted %d, %v", n, err)
+	}
+	c.now = func() time.Time { return time.Now().Add(DefaultRetention + time.Hour) }
+	if n, err := c.Compact(ctx); err != nil || n == 0 {
+		t.Fatalf("compacting old changes deleted %d, %v", n, err)
+	}
+
+	if _, err := s.Changes(ctx, "u1", 0, 100); !errors.Is(err, ErrCannotCalculateChanges) {
+		t.Errorf("state from before compaction got %v", err)
+	}
+	if err := s.Resume(ctx, "u1", 0); !errors.Is(err, ErrCannotCalculateChanges) {
+		t.Errorf("resuming from before compaction got %v", err)
+	}
+	if err := s.Resume(ctx, "u1", last); err != nil {
+		t.Errorf("resuming from the last event got %v", err)
+	}
+	if got, err := s.Last(ctx, "u1"); err != nil || got != last {
+		t.Errorf("Last after compaction = %d, %v; want %d", got, err, last)
+	}
+	id, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := s.Changes(ctx, "u1", state, 100)
+	if err != nil || !slices.Equal(changes.Messages.Created, []string{id}) {
+		t.Errorf("got %+v, %v; want %s created", changes, err, id)
+	}
+}
@@ -0,0 +1,238 @@
+package changelog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/labels"
+)
+
+// ErrCannotCalculateChanges is returned by Changes for a state from before
+// the log was compacted, or that the user never had.
+var ErrCannotCalculateChanges = errors.New("cannot calculate changes")
+
+// Changes are what was created, updated and destroyed between two states
+// of a user's. A state is the user's modseq, which every change to their
+// messages and labels increases.
+//
+// A label is updated when it is renamed or recolored, and when its counts
+// change as messages are put on it, taken off it, created, read or marked
+// unread. Inbox and Archive are both updated when a message is destroyed,
+// as the labels it was in aren't known by then.
+type Changes struct {
+	OldState int64
+	NewState int64
+	// HasMore is set if there are changes after NewState, which was cut
+	// short by the limit.
+	HasMore  bool
+	Messages EntityChanges
+	Labels   EntityChanges
+}
+
+// EntityChanges lists the IDs of one kind of entity that changed. An entity
+// created and destroyed in between is left out.
+type EntityChanges struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Destroyed []string `json:"destroyed"`
+}
+
+// State returns userID's current state.
+func (s *Service) State(ctx context.Context, userID string) (int64, error) {
+	row, err := s.db.Queries().GetModseq(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to get modseq: %w", err)
+	}
+	return row.Modseq, nil
+}
+
+// Changes returns what changed for userID since the state since, reading up
+// to limit entries of the log.
+func (s *Service) Changes(ctx context.Context, userID string, since int64, limit int) (Changes, error) {
+	q := s.db.Queries()
+	state, err := q.GetModseq(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Changes{}, fmt.Errorf("failed to get modseq: %w", err)
+	}
+	if since < state.Compacted || since > state.Modseq {
+		return Changes{}, ErrCannotCalculateChanges
+	}
+
+	rows, err := q.ListChangesSince(ctx, schema.ListChangesSinceParams{
+		UserID: userID,
+		Since:  since,
+		Until:  state.Modseq,
+		Limit:  int64(limit),
+	})
+	if err != nil {
+		return Changes{}, fmt.Errorf("failed to list changes: %w", err)
+	}
+	c := Changes{OldState: since, NewState: state.Modseq}
+	if n := len(rows); n == limit && rows[n-1].Modseq < state.Modseq {
+		c.HasMore = true
+		c.NewState = rows[n-1].Modseq
+	}
+
+	r := resolver{ctx: ctx, q: q, userID: userID}
+	msgs, lbls := newChangeSet(), newChangeSet()
+	for _, row := range rows {
+		switch row.Type {
+		case EventMessageCreated:
+			msgs.add(row.MessageID, created)
+			r.recount(row.MessageID)
+		case EventMessageDeleted:
+			msgs.add(row.MessageID, destroyed)
+			lbls.add(labels.SystemID(labels.Inbox), updated)
+			lbls.add(labels.SystemID(labels.Archive), updated)
+		case EventMessageFlagsChanged:
+			msgs.add(row.MessageID, updated)
+			if row.Name == "read" {
+				r.recount(row.MessageID)
+			}
+		case EventMessageLabelsChanged:
+			msgs.add(row.MessageID, updated)
+			r.named(row.Name)
+		case EventLabelCreated:
+			lbls.add(row.LabelID, created)
+		case EventLabelDeleted:
+			lbls.add(row.LabelID, destroyed)
+		case EventLabelUpdated:
+			if row.LabelID != "" {
+				lbls.add(row.LabelID, updated)
+			} else {
+				r.named(row.Name)
+			}
+		}
+	}
+	ids, err := r.labelIDs()
+	if err != nil {
+		return Changes{}, err
+	}
+	for _, id := range ids {
+		lbls.add(id, updated)
+	}
+
+	c.Messages = msgs.result()
+	c.Labels = lbls.result()
+	return c, nil
+}
+
+// What happened to an entity in a changeSet.
+const (
+	created = 1 << iota
+	updated
+	destroyed
+)
+
+// changeSet collects what happened to entities, in the order they first
+// changed.
+type changeSet struct {
+	ids     []string
+	changes map[string]int
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{changes: map[string]int{}}
+}
+
+func (cs *changeSet) add(id string, change int) {
+	if _, ok := cs.changes[id]; !ok {
+		cs.ids = append(cs.ids, id)
+	}
+	cs.changes[id] |= change
+}
+
+func (cs *changeSet) result() EntityChanges {
+	ec := EntityChanges{Created: []string{}, Updated: []string{}, Destroyed: []string{}}
+	for _, id := range cs.ids {
+		switch change := cs.changes[id]; {
+		case change&created != 0 && change&destroyed != 0:
+		case change&created != 0:
+			ec.Created = append(ec.Created, id)
+		case change&destroyed != 0:
+			ec.Destroyed = append(ec.Destroyed, id)
+		default:
+			ec.Updated = append(ec.Updated, id)
+		}
+	}
+	return ec
+}
+
+// resolver finds the labels whose counts changed: those named in the log,
+// and those of messages created or read, as they are now.
+type resolver struct {
+	ctx    context.Context
+	q      *schema.Queries
+	userID string
+
+	names    []string
+	messages []string
+}
+
+func (r *resolver) named(name string) {
+	r.names = append(r.names, name)
+}
+
+func (r *resolver) recount(messageID string) {
+	r.messages = append(r.messages, messageID)
+}
+
+// labelIDs returns the IDs of the labels, in the order they were named.
+// Names of labels that have been renamed or deleted since are dropped, as
+// that is a change of the label's own.
+func (r *resolver) labelIDs() ([]string, error) {
+	names := r.names
+	seen := map[string]bool{}
+	for _, id := range r.messages {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		msg, err := r.q.GetMessage(r.ctx, schema.GetMessageParams{ID: id, UserID: r.userID})
+		if errors.Is(err, sql.ErrNoRows) {
+			// Destroyed since
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get message: %w", err)
+		}
+		stored, err := r.q.ListMessageLabels(r.ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list message labels: %w", err)
+		}
+		names = append(names, stored...)
+		if mailbox := labels.Mailbox(stored, msg.Archived); mailbox != "" {
+			names = append(names, mailbox)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	rows, err := r.q.ListLabelsByUser(r.ctx, r.userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list labels: %w", err)
+	}
+	paths := make(map[string]string, len(rows))
+	for _, row := range rows {
+		paths[row.Path] = row.ID
+	}
+	var ids []string
+	for _, name := range names {
+		switch name {
+		case labels.Inbox, labels.Sent, labels.Trash, labels.Spam:
+			// Each moves messages in or out of the Inbox or Archive
+			ids = append(ids, labels.SystemID(name), labels.SystemID(labels.Inbox), labels.SystemID(labels.Archive))
+		case labels.Archive:
+			ids = append(ids, labels.SystemID(name))
+		default:
+			if id, ok := paths[name]; ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,159 @@
+package changelog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+const (
+	// DefaultRetention is used when CHANGE_LOG_RETENTION is not set.
+	DefaultRetention = 30 * 24 * time.Hour
+	// DefaultCompactInterval is used when CHANGE_LOG_COMPACT_INTERVAL is
+	// not set.
+	DefaultCompactInterval = time.Hour
+
+	compactBatchSize = 100
+)
+
+// Compactor deletes old entries from the change log. Clients that last
+// synced before the entries it deleted get ErrCannotCalculateChanges and
+// start over, and event streams resumed from before them miss them.
+type Compactor struct {
+	db        database.Service
+	retention time.Duration
+	interval  time.Duration
+	now       func() time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewCompactor creates a Compactor for the change log in db.
+func NewCompactor(db database.Service) *Compactor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Compactor{
+		db:        db,
+		retention: DefaultRetention,
+		interval:  DefaultCompactInterval,
+		now:       time.Now,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// NewCompactorFromEnv creates a Compactor configured by the environment:
+//
+//	CHANGE_LOG_RETENTION         how long entries are kept
+//	CHANGE_LOG_COMPACT_INTERVAL  how often old entries are deleted
+func NewCompactorFromEnv(db database.Service) (*Compactor, error) {
+	c := NewCompactor(db)
+	for name, d := range map[string]*time.Duration{
+		"CHANGE_LOG_RETENTION":        &c.retention,
+		"CHANGE_LOG_COMPACT_INTERVAL": &c.interval,
+	} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*d = parsed
+		}
+	}
+	return c, nil
+}
+
+// Compact deletes the entries older than the retention period and returns
+// how many it deleted. Each user's entries go up to the newest old one,
+// which becomes the oldest state their changes can be calculated from.
+func (c *Compactor) Compact(ctx context.Context) (int64, error) {
+	var deleted int64
+	for {
+		users, err := c.db.Queries().ListCompactableChanges(ctx, schema.ListCompactableChangesParams{
+			CreatedAt: c.now().UTC().Add(-c.retention),
+			Limit:     compactBatchSize,
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list old changes: %w", err)
+		}
+		for _, u := range users {
+			var n int64
+			err := c.db.WithTx(ctx, func(q *schema.Queries) error {
+				var err error
+				n, err = q.DeleteChangesThrough(ctx, schema.DeleteChangesThroughParams{UserID: u.UserID, Modseq: u.Modseq})
+				if err != nil {
+					return fmt.Errorf("failed to delete changes: %w", err)
+				}
+				if err := q.SetCompactedModseq(ctx, schema.SetCompactedModseqParams{
+					Compacted:   u.Modseq,
+					CompactedID: u.ID,
+					UserID:      u.UserID,
+				}); err != nil {
+					return fmt.Errorf("failed to set compacted modseq: %w", err)
+				}
+				return nil
+			})
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+		}
+		if len(users) < compactBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// Start compacts the change log every interval in the background until
+// Shutdown.
+func (c *Compactor) Start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			n, err := c.Compact(c.ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				metrics.Errors.WithLabelValues("change_log_compact").Inc()
+				logger.Error(c.ctx, "Change log compaction failed", "error", err)
+			} else if n > 0 {
+				logger.Info(c.ctx, "Compacted change log", "count", n)
+			}
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops background compaction and waits until ctx is done for it
+// to finish.
+func (c *Compactor) Shutdown(ctx context.Context) error {
+	c.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,202 @@
+// Package credentials manages the secrets users give programs and mail
+// clients in place of signing in: API keys, and app passwords for clients
+// such as desktop IMAP clients, which sign in with an address and password.
+// Secrets are shown once, when they are created; only their hashes are
+// kept.
+package credentials
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+var (
+	ErrCredentialNotFound = errors.New("credential not found")
+	ErrInvalidCredential  = errors.New("invalid credential")
+	ErrAuthFailed         = errors.New("authentication failed")
+)
+
+// The kinds of credential.
+const (
+	KindAPIKey      = "api_key"
+	KindAppPassword = "app_password"
+)
+
+const (
+	apiKeyPrefix = "pk_"
+	maxName      = 100
+	// appPasswordLen is the number of letters in an app password, which is
+	// shown in groups of four.
+	appPasswordLen = 16
+)
+
+// Credential is a credential as the API shows it, without its secret.
+type Credential struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newCredential(row schema.Credential) Credential {
+	c := Credential{
+		ID:        row.ID,
+		Kind:      row.Kind,
+		Name:      row.Name,
+		CreatedAt: row.CreatedAt,
+	}
+	if row.LastUsedAt.Valid {
+		c.LastUsedAt = &row.LastUsedAt.Time
+	}
+	return c
+}
+
+// Service stores users' credentials and checks secrets against them.
+type Service struct {
+	db database.Service
+}
+
+// New creates a Service.
+func New(db database.Service) *Service {
+	return &Service{db: db}
+}
+
+// List returns userID's credentials, oldest first.
+func (s *Service) List(ctx context.Context, userID string) ([]Credential, error) {
+	rows, err := s.db.Queries().ListCredentials(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list credentials: %w", err)
+	}
+	list := make([]Credential, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, newCredential(row))
+	}
+	return list, nil
+}
+
+// Create makes a credential of kind for userID, returning it with its
+// secret. Errors wrap ErrInvalidCredential if kind or name isn't valid.
+func (s *Service) Create(ctx context.Context, userID, kind, name string) (Credential, string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) > maxName {
+		return Credential{}, "", fmt.Errorf("%w: name is longer than %d bytes", ErrInvalidCredential, maxName)
+	}
+	var secret string
+	var err error
+	switch kind {
+	case KindAPIKey:
+		secret, err = newAPIKey()
+	case KindAppPassword:
+		secret, err = newAppPassword()
+	default:
+		return Credential{}, "", fmt.Errorf("%w: kind must be %s or %s", ErrInvalidCredential, KindAPIKey, KindAppPassword)
+	}
+	if err != nil {
+		return Credential{}, "", err
+	}
+
+	id := uuid.New().String()
+	err = s.db.Queries().InsertCredential(ctx, schema.InsertCredentialParams{
+		ID:         id,
+		UserID:     userID,
+		Kind:       kind,
+		Name:       name,
+		SecretHash: hash(secret),
+	})
+	if err != nil {
+		return Credential{}, "", fmt.Errorf("failed to insert credential: %w", err)
+	}
+	row, err := s.db.Queries().GetCredential(ctx, schema.GetCredentialParams{ID: id, UserID: userID})
+	if err != nil {
+		return Credential{}, "", fmt.Errorf("failed to get credential: %w", err)
+	}
+	return newCredential(row), secret, nil
+}
+
+// Delete revokes one of userID's credentials.
+func (s *Service) Delete(ctx context.Context, userID, id string) error {
+	n, err := s.db.Queries().DeleteCredential(ctx, schema.DeleteCredentialParams{ID: id, UserID: userID})
+	if err != nil {
+		return fmt.Errorf("failed to delete credential: %w", err)
+	}
+	if n == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the ID of the user whose credential secret is, if
+// username is their address. It returns ErrAuthFailed otherwise.
+func (s *Service) Authenticate(ctx context.Context, username, secret string) (string, error) {
+	row, err := s.db.Queries().GetCredentialBySecret(ctx, hash(secret))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrAuthFailed
+		}
+		return "", fmt.Errorf("failed to get credential: %w", err)
+	}
+	if !strings.EqualFold(strings.TrimSpace(username), row.Email) {
+		return "", ErrAuthFailed
+	}
+	if err := s.db.Queries().TouchCredential(ctx, row.ID); err != nil {
+		return "", fmt.Errorf("failed to update credential: %w", err)
+	}
+	return row.UserID, nil
+}
+
+// hash returns the hash a secret is stored under. App passwords are
+// compared without the spaces they are shown with, and in lower case.
+func hash(secret string) string {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		secret = strings.ToLower(strings.ReplaceAll(secret, " ", ""))
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a random API key.
+func newAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return apiKeyPrefix + hex.EncodeToString(b), nil
+}
+
+// newAppPassword returns a random app password of lower case letters, in
+// groups of four so it can be typed in.
+func newAppPassword() (string, error) {
+	letters := make([]byte, 0, appPasswordLen)
+	b := make([]byte, appPasswordLen)
+	for len(letters) < appPasswordLen {
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("failed to generate app password: %w", err)
+		}
+		for _, c := range b {
+			// Bytes past the last multiple of 26 would favor early letters
+			if c < 26*9 && len(letters) < appPasswordLen {
+				letters = append(letters, 'a'+c%26)
+			}
+		}
+	}
+	var sb strings.Builder
+	for i, c := range letters {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), nil
+}
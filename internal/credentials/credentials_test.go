@@ -0,0 +1,78 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+)
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+	s := New(db)
+
+	key, keySecret, err := s.Create(ctx, "u1", KindAPIKey, " CI ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Name != "CI" || !strings.HasPrefix(keySecret, apiKeyPrefix) {
+		t.Errorf("api key = %+v, %q", key, keySecret)
+	}
+	_, password, err := s.Create(ctx, "u1", KindAppPassword, "Thunderbird")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(password) != appPasswordLen+appPasswordLen/4-1 || strings.Count(password, " ") != appPasswordLen/4-1 {
+		t.Errorf("app password = %q", password)
+	}
+
+	for _, secret := range []string{keySecret, password, strings.ToUpper(strings.ReplaceAll(password, " ", ""))} {
+		userID, err := s.Authenticate(ctx, "User@Example.com", secret)
+		if err != nil || userID != "u1" {
+			t.Errorf("Authenticate(%q) = %q, %v", secret, userID, err)
+		}
+	}
+	for name, c := range map[string][2]string{
+		"wrong user":   {"other@example.com", keySecret},
+		"wrong secret": {"user@example.com", "pk_nope"},
+		"empty":        {"user@example.com", ""},
+	} {
+		if _, err := s.Authenticate(ctx, c[0], c[1]); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%s: got %v, want ErrAuthFailed", name, err)
+		}
+	}
+
+	list, err := s.List(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].LastUsedAt == nil {
+		t.Errorf("list = %+v", list)
+	}
+
+	if err := s.Delete(ctx, "u2", key.ID); !errors.Is(err, ErrCredentialNotFound) {
+		t.Errorf("delete another user's credential: %v", err)
+	}
+	if err := s.Delete(ctx, "u1", key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, "user@example.com", keySecret); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("revoked key: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestCreateInvalid(t *testing.T) {
+	s := New(dbtest.New(t))
+	for _, c := range [][2]string{
+		{"password", "x"},
+		{KindAPIKey, strings.Repeat("x", maxName+1)},
+	} {
+		if _, _, err := s.Create(context.Background(), "u1", c[0], c[1]); !errors.Is(err, ErrInvalidCredential) {
+			t.Errorf("Create(%q, %q): got %v, want ErrInvalidCredential", c[0], c[1], err)
+		}
+	}
+}
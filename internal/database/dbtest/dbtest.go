@@ -0,0 +1,44 @@
+// Package dbtest opens migrated databases for tests.
+package dbtest
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+// New opens a database in a temporary directory, runs the migrations on it
+// and adds a user with the ID "u1" and the address user@example.com. The
+// database is closed when the test ends.
+func New(t testing.TB) database.Service {
+	t.Helper()
+	t.Setenv("DB_FILE", filepath.Join(t.TempDir(), "db.sqlite"))
+	db, err := database.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.MigrateUp(db.DB(), migrationsPath()); err != nil {
+		t.Fatal(err)
+	}
+	AddUser(t, db, "u1", "user@example.com")
+	return db
+}
+
+// AddUser adds a user with the ID and address.
+func AddUser(t testing.TB, db database.Service, id, email string) {
+	t.Helper()
+	_, err := db.DB().Exec(`INSERT INTO user (id, email, provider, provider_id) VALUES (?, ?, 'google', ?)`, id, email, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// migrationsPath finds db/migrations from this file, as tests run in the
+// directory of their package.
+func migrationsPath() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "..", "db", "migrations")
+}
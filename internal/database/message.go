@@ -0,0 +1,277 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+)
+
+// MessageRecord bundles a message row with its dependent rows so that it can
+// be written in a single transaction. The MessageID fields of the dependent
+// rows are filled in from Message.ID by InsertMessage.
+//
+// The raw message and attachment content live in the blob store and are
+// referenced by Body.RawHash and the attachments' BlobHash. Blobs holds that
+// content by hash; it must be stored (see blobstore.Store.Put) before the
+// record is inserted.
+//
+// Auth is the authentication verdict of a message delivered over SMTP or
+// LMTP, and nil for messages that weren't authenticated.
+//
+// Deferred leaves the message out of the search index and out of any
+// thread when it is inserted, for a background job to add it to them with
+// IndexMessageTx and ThreadMessageTx.
+type MessageRecord struct {
+	Message     schema.InsertMessageParams
+	Addresses   []schema.InsertMessageAddressParams
+	Headers     []schema.InsertMessageHeaderParams
+	Body        schema.InsertMessageBodyParams
+	Attachments []schema.InsertAttachmentParams
+	Auth        *schema.InsertMessageAuthParams
+	Blobs       map[string][]byte
+	Deferred    bool
+}
+
+// InsertMessage writes a message and all of its dependent rows atomically.
+func (s *service) InsertMessage(ctx context.Context, rec MessageRecord) error {
+	return s.WithTx(ctx, func(q *schema.Queries) error {
+		return InsertMessageTx(ctx, q, rec)
+	})
+}
+
+// InsertMessageTx writes a message and its dependent rows using q, which is
+// expected to be bound to a transaction owned by the caller.
+func InsertMessageTx(ctx context.Context, q *schema.Queries, rec MessageRecord) error {
+	id := rec.Message.ID
+
+	if err := q.InsertMessage(ctx, rec.Message); err != nil {
+		return fmt.Errorf("failed to insert message: %w", err)
+	}
+
+	for _, addr := range rec.Addresses {
+		addr.MessageID = id
+		if err := q.InsertMessageAddress(ctx, addr); err != nil {
+			return fmt.Errorf("failed to insert message address: %w", err)
+		}
+	}
+
+	for _, header := range rec.Headers {
+		header.MessageID = id
+		if err := q.InsertMessageHeader(ctx, header); err != nil {
+			return fmt.Errorf("failed to insert message header: %w", err)
+		}
+	}
+
+	body := rec.Body
+	body.MessageID = id
+	if body.Raw == nil {
+		body.Raw = []byte{}
+	}
+	if err := q.InsertMessageBody(ctx, body); err != nil {
+		return fmt.Errorf("failed to insert message body: %w", err)
+	}
+	if err := AcquireBlobTx(ctx, q, body.RawHash); err != nil {
+		return err
+	}
+
+	for _, att := range rec.Attachments {
+		att.MessageID = id
+		if err := q.InsertAttachment(ctx, att); err != nil {
+			return fmt.Errorf("failed to insert attachment: %w", err)
+		}
+		if err := AcquireBlobTx(ctx, q, att.BlobHash); err != nil {
+			return err
+		}
+	}
+
+	if rec.Auth != nil {
+		auth := *rec.Auth
+		auth.MessageID = id
+		if err := q.InsertMessageAuth(ctx, auth); err != nil {
+			return fmt.Errorf("failed to insert message authentication: %w", err)
+		}
+	}
+
+	if rec.Deferred {
+		return nil
+	}
+
+	if err := q.InsertMessageSearchContent(ctx, searchContent(rec)); err != nil {
+		return fmt.Errorf("failed to index message: %w", err)
+	}
+
+	if err := assignThread(ctx, q, rec.Message); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LoadMessageRecord reads a stored message back into the record it was
+// inserted from. Blobs is left empty: content lives in the blob store,
+// except for messages stored before it existed, whose raw message is in
+// Body.Raw. Errors wrap sql.ErrNoRows if the message doesn't exist.
+func LoadMessageRecord(ctx context.Context, q *schema.Queries, userID, id string) (MessageRecord, error) {
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: userID})
+	if err != nil {
+		return MessageRecord{}, fmt.Errorf("failed to get message %s: %w", id, err)
+	}
+	rec := MessageRecord{
+		Message: schema.InsertMessageParams{
+			ID:                msg.ID,
+			UserID:            msg.UserID,
+			InternetMessageID: msg.InternetMessageID,
+			InReplyTo:         msg.InReplyTo,
+			MessageReferences: msg.MessageReferences,
+			Subject:           msg.Subject,
+			FromName:          msg.FromName,
+			FromAddress:       msg.FromAddress,
+			SentAt:            msg.SentAt,
+			ReceivedAt:        msg.ReceivedAt,
+			Size:              msg.Size,
+			HasAttachments:    msg.HasAttachments,
+		},
+		Blobs: map[string][]byte{},
+	}
+
+	addrs, err := q.ListMessageAddresses(ctx, id)
+	if err != nil {
+		return MessageRecord{}, fmt.Errorf("failed to list addresses of message %s: %w", id, err)
+	}
+	for _, a := range addrs {
+		rec.Addresses = append(rec.Addresses, schema.InsertMessageAddressParams(a))
+	}
+
+	headers, err := q.ListMessageHeaders(ctx, id)
+	if err != nil {
+		return MessageRecord{}, fmt.Errorf("failed to list headers of message %s: %w", id, err)
+	}
+	for _, h := range headers {
+		rec.Headers = append(rec.Headers, schema.InsertMessageHeaderParams(h))
+	}
+
+	body, err := q.GetMessageBody(ctx, id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return MessageRecord{}, fmt.Errorf("failed to get body of message %s: %w", id, err)
+	}
+	rec.Body = schema.InsertMessageBodyParams(body)
+
+	atts, err := q.ListAttachments(ctx, id)
+	if err != nil {
+		return MessageRecord{}, fmt.Errorf("failed to list attachments of message %s: %w", id, err)
+	}
+	for _, a := range atts {
+		rec.Attachments = append(rec.Attachments, schema.InsertAttachmentParams(a))
+	}
+
+	auth, err := q.GetMessageAuth(ctx, id)
+	switch {
+	case err == nil:
+		params := schema.InsertMessageAuthParams(auth)
+		rec.Auth = &params
+	case !errors.Is(err, sql.ErrNoRows):
+		return MessageRecord{}, fmt.Errorf("failed to get authentication of message %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+// DeleteMessage removes a message owned by userID along with its dependent
+// rows. Dependent rows are deleted explicitly so that the result does not
+// depend on the connection having foreign key enforcement enabled.
+func (s *service) DeleteMessage(ctx context.Context, userID, id string) (bool, error) {
+	var deleted bool
+	err := s.WithTx(ctx, func(q *schema.Queries) error {
+		var err error
+		deleted, err = DeleteMessageTx(ctx, q, userID, id)
+		return err
+	})
+	return deleted, err
+}
+
+// DeleteMessageTx is DeleteMessage for a caller-owned transaction.
+func DeleteMessageTx(ctx context.Context, q *schema.Queries, userID, id string) (bool, error) {
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get message: %w", err)
+	}
+
+	hashes, err := q.ListMessageBlobHashes(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to list message blobs: %w", err)
+	}
+
+	if err := q.DeleteMessageThreadRefs(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete thread references: %w", err)
+	}
+	if err := q.DeleteMessageLabels(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete message labels: %w", err)
+	}
+	if err := q.DeleteMessageKeywords(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete message keywords: %w", err)
+	}
+	if err := q.DeleteMessageAuth(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete message authentication: %w", err)
+	}
+	if err := q.DeleteMessageSearchContent(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete search index entry: %w", err)
+	}
+	if err := q.DeleteAttachments(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete attachments: %w", err)
+	}
+	if err := q.DeleteMessageBody(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete message body: %w", err)
+	}
+	if err := q.DeleteMessageHeaders(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete message headers: %w", err)
+	}
+	if err := q.DeleteMessageAddresses(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete message addresses: %w", err)
+	}
+	if err := q.DeleteMessageMailboxUIDs(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to delete mailbox UIDs: %w", err)
+	}
+
+	n, err := q.DeleteMessage(ctx, schema.DeleteMessageParams{ID: id, UserID: userID})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete message: %w", err)
+	}
+
+	if msg.ThreadID != "" {
+		if err := releaseThread(ctx, q, msg.ThreadID); err != nil {
+			return false, err
+		}
+	}
+
+	// Unreferenced content is removed later by the blob store's garbage
+	// collection
+	now := time.Now().UTC()
+	for _, hash := range hashes {
+		if err := q.ReleaseBlob(ctx, schema.ReleaseBlobParams{UpdatedAt: now, Hash: hash}); err != nil {
+			return false, fmt.Errorf("failed to release blob: %w", err)
+		}
+	}
+	return n > 0, nil
+}
+
+// AcquireBlobTx adds a reference to a blob registered by the blob store. An
+// empty hash means there is no blob and is ignored.
+func AcquireBlobTx(ctx context.Context, q *schema.Queries, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	n, err := q.AcquireBlob(ctx, schema.AcquireBlobParams{UpdatedAt: time.Now().UTC(), Hash: hash})
+	if err != nil {
+		return fmt.Errorf("failed to reference blob: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("blob %s is not stored", hash)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+)
+
+// messageRecord returns a message for u1 with two recipients, a header and
+// a PDF attachment.
+func messageRecord(id string) database.MessageRecord {
+	sent := time.Date(2025, 3, 1, 9, 30, 0, 0, time.UTC)
+	return database.MessageRecord{
+		Message: schema.InsertMessageParams{
+			ID:                id,
+			UserID:            "u1",
+			InternetMessageID: id + "@example.org",
+			Subject:           "Quarterly report",
+			FromName:          "Alice",
+			FromAddress:       "alice@example.org",
+			SentAt:            sent,
+			ReceivedAt:        sent.Add(time.Minute),
+			Size:              2048,
+			HasAttachments:    true,
+		},
+		Addresses: []schema.InsertMessageAddressParams{
+			{Kind: "to", Position: 0, Name: "User", Address: "user@example.com"},
+			{Kind: "cc", Position: 0, Address: "bob@example.org"},
+		},
+		Headers: []schema.InsertMessageHeaderParams{
+			{Position: 0, Name: "Subject", Value: "Quarterly report"},
+		},
+		Body: schema.InsertMessageBodyParams{TextBody: "See attached.", Raw: []byte("raw message")},
+		Attachments: []schema.InsertAttachmentParams{
+			{Part: "2", Filename: "report.pdf", ContentType: "application/pdf", Disposition: "attachment", Size: 1024},
+		},
+	}
+}
+
+func TestInsertMessage(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+	if err := db.InsertMessage(ctx, messageRecord("m1")); err != nil {
+		t.Fatal(err)
+	}
+	q := db.Queries()
+
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: "m1", UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Quarterly report" || msg.FromAddress != "alice@example.org" || !msg.HasAttachments || msg.Size != 2048 {
+		t.Errorf("got message %+v", msg)
+	}
+	if _, err := q.GetMessage(ctx, schema.GetMessageParams{ID: "m1", UserID: "u2"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetMessage as another user: got %v, want sql.ErrNoRows", err)
+	}
+
+	addrs, err := q.ListMessageAddresses(ctx, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || addrs[0].Kind != "cc" || addrs[1].Address != "user@example.com" || addrs[1].Name != "User" {
+		t.Errorf("got addresses %+v", addrs)
+	}
+	headers, err := q.ListMessageHeaders(ctx, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 1 || headers[0].Name != "Subject" {
+		t.Errorf("got headers %+v", headers)
+	}
+	body, err := q.GetMessageBody(ctx, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.TextBody != "See attached." || string(body.Raw) != "raw message" {
+		t.Errorf("got body %+v", body)
+	}
+	atts, err := q.ListAttachments(ctx, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 1 || atts[0].Filename != "report.pdf" || atts[0].ContentType != "application/pdf" || atts[0].Size != 1024 {
+		t.Errorf("got attachments %+v", atts)
+	}
+}
+
+func TestInsertMessageIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+
+	// The second attachment has the part of the first, so the insert fails
+	// after the message row is written
+	rec := messageRecord("m1")
+	rec.Attachments = append(rec.Attachments, rec.Attachments[0])
+	if err := db.InsertMessage(ctx, rec); err == nil {
+		t.Fatal("inserted a message with two attachments for one part")
+	}
+	if _, err := db.Queries().GetMessage(ctx, schema.GetMessageParams{ID: "m1", UserID: "u1"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetMessage after a failed insert: got %v, want sql.ErrNoRows", err)
+	}
+	for _, table := range []string{"message_address", "message_header", "message_body", "attachment"} {
+		var n int
+		if err := db.DB().QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%s has %d rows after a failed insert", table, n)
+		}
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+	if err := db.InsertMessage(ctx, messageRecord("m1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := db.DeleteMessage(ctx, "u2", "m1"); err != nil || ok {
+		t.Errorf("DeleteMessage as another user = %v, %v", ok, err)
+	}
+	if ok, err := db.DeleteMessage(ctx, "u1", "m1"); err != nil || !ok {
+		t.Fatalf("DeleteMessage = %v, %v", ok, err)
+	}
+	if ok, err := db.DeleteMessage(ctx, "u1", "m1"); err != nil || ok {
+		t.Errorf("deleting again = %v, %v", ok, err)
+	}
+	atts, err := db.Queries().ListAttachments(ctx, "m1")
+	if err != nil || len(atts) != 0 {
+		t.Errorf("deleted message has attachments %v, %v", atts, err)
+	}
+	if _, err := db.Queries().GetMessageBody(ctx, "m1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetMessageBody after delete: got %v, want sql.ErrNoRows", err)
+	}
+}
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+// indexBatchSize is the number of messages IndexMessages indexes per
+// transaction.
+const indexBatchSize = 100
+
+// searchContent builds the full-text search row for a message. Bodies that
+// only have an HTML version are indexed by their text.
+func searchContent(rec MessageRecord) schema.InsertMessageSearchContentParams {
+	var to []string
+	for _, addr := range rec.Addresses {
+		if addr.Kind == "reply-to" {
+			continue
+		}
+		to = append(to, strings.TrimSpace(addr.Name+" "+addr.Address))
+	}
+
+	var filenames []string
+	for _, att := range rec.Attachments {
+		if att.Filename != "" {
+			filenames = append(filenames, att.Filename)
+		}
+	}
+
+	body := rec.Body.TextBody
+	if strings.TrimSpace(body) == "" && rec.Body.HtmlBody != "" {
+		body = mime.HTMLText(rec.Body.HtmlBody)
+	}
+
+	return schema.InsertMessageSearchContentParams{
+		MessageID:   rec.Message.ID,
+		UserID:      rec.Message.UserID,
+		Subject:     rec.Message.Subject,
+		FromText:    strings.TrimSpace(rec.Message.FromName + " " + rec.Message.FromAddress),
+		ToText:      strings.Join(to, "\n"),
+		Body:        body,
+		Attachments: strings.Join(filenames, "\n"),
+	}
+}
+
+// IndexMessages adds messages stored before full-text search existed to the
+// search index and returns how many were indexed.
+func (s *service) IndexMessages(ctx context.Context) (int, error) {
+	indexed := 0
+	for {
+		pending, err := s.queries.ListUnindexedMessageIDs(ctx, indexBatchSize)
+		if err != nil {
+			return indexed, fmt.Errorf("failed to list unindexed messages: %w", err)
+		}
+		if len(pending) == 0 {
+			return indexed, nil
+		}
+
+		err = s.WithTx(ctx, func(q *schema.Queries) error {
+			for _, m := range pending {
+				// Replaces the content of a message that a process job
+				// indexed meanwhile
+				if err := IndexMessageTx(ctx, q, m.UserID, m.ID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return indexed, err
+		}
+		indexed += len(pending)
+	}
+}
+
+// IndexMessageTx adds a stored message to the search index using q,
+// replacing what was indexed for it before.
+func IndexMessageTx(ctx context.Context, q *schema.Queries, userID, id string) error {
+	rec, err := loadSearchRecord(ctx, q, id, userID)
+	if err != nil {
+		return err
+	}
+	if err := q.DeleteMessageSearchContent(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete search content of message %s: %w", id, err)
+	}
+	if err := q.InsertMessageSearchContent(ctx, searchContent(rec)); err != nil {
+		return fmt.Errorf("failed to index message %s: %w", id, err)
+	}
+	return nil
+}
+
+// loadSearchRecord reads back the parts of a stored message that are indexed.
+func loadSearchRecord(ctx context.Context, q *schema.Queries, id, userID string) (MessageRecord, error) {
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: userID})
+	if err != nil {
+		return MessageRecord{}, fmt.Errorf("failed to get message %s: %w", id, err)
+	}
+	rec := MessageRecord{Message: schema.InsertMessageParams{
+		ID:          msg.ID,
+		UserID:      msg.UserID,
+		Subject:     msg.Subject,
+		FromName:    msg.FromName,
+		FromAddress: msg.FromAddress,
+	}}
+
+	addrs, err := q.ListMessageAddresses(ctx, id)
+	if err != nil {
+		return MessageRecord{}, fmt.Errorf("failed to list addresses of message %s: %w", id, err)
+	}
+	for _, a := range addrs {
+		rec.Addresses = append(rec.Addresses, schema.InsertMessageAddressParams{
+			Kind:    a.Kind,
+			Name:    a.Name,
+			Address: a.Address,
+		})
+	}
+
+	// A message without a body row is still indexed by its headers
+	if body, err := q.GetMessageBody(ctx, id); err == nil {
+		rec.Body.TextBody = body.TextBody
+		rec.Body.HtmlBody = body.HtmlBody
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return MessageRecord{}, fmt.Errorf("failed to get body of message %s: %w", id, err)
+	}
+
+	atts, err := q.ListAttachments(ctx, id)
+	if err != nil {
+		return MessageRecord{}, fmt.Errorf("failed to list attachments of message %s: %w", id, err)
+	}
+	for _, a := range atts {
+		rec.Attachments = append(rec.Attachments, schema.InsertAttachmentParams{Filename: a.Filename})
+	}
+	return rec, nil
+}
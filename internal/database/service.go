@@ -1,6 +1,12 @@
 package database
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+)
 
 // BaseService represents a service that interacts with a database.
 type BaseService interface {
@@ -15,10 +21,27 @@ type BaseService interface {
 type Service interface {
 	BaseService
 	DB() *sql.DB // Added method to get the underlying *sql.DB instance
+	// Queries returns the sqlc queries bound to the connection pool.
+	Queries() *schema.Queries
+	// WithTx runs fn inside a transaction, committing if it returns nil and
+	// rolling back otherwise.
+	WithTx(ctx context.Context, fn func(q *schema.Queries) error) error
+	// InsertMessage writes a message and all of its dependent rows atomically.
+	InsertMessage(ctx context.Context, rec MessageRecord) error
+	// DeleteMessage removes a message owned by userID. It reports whether a
+	// message was deleted.
+	DeleteMessage(ctx context.Context, userID, id string) (bool, error)
+	// IndexMessages adds messages missing from the full-text search index
+	// and returns how many were indexed.
+	IndexMessages(ctx context.Context) (int, error)
+	// ThreadMessages assigns threads to messages that don't have one and
+	// returns how many were threaded.
+	ThreadMessages(ctx context.Context) (int, error)
 }
 
 type service struct {
-	db *sql.DB
+	db      *sql.DB
+	queries *schema.Queries
 }
 
 func (s *service) Health() map[string]string {
@@ -35,3 +58,28 @@ func (s *service) Close() error {
 func (s *service) DB() *sql.DB { // Implemented method
 	return s.db
 }
+
+// Queries returns the sqlc queries bound to the connection pool.
+func (s *service) Queries() *schema.Queries {
+	return s.queries
+}
+
+// WithTx runs fn inside a transaction.
+func (s *service) WithTx(ctx context.Context, fn func(q *schema.Queries) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if err := fn(s.queries.WithTx(tx)); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/parsel-email/lib-go/database/sqlite3"
+	"github.com/parsel-email/mailroom/db/lib/schema"
 )
 
 // Config represents database configuration
@@ -37,7 +38,8 @@ func Initialize() (Service, error) {
 	}
 
 	service := &service{
-		db: db,
+		db:      db,
+		queries: schema.New(db),
 	}
 
 	fmt.Printf("Connected to libsql database at %s\n", dbFile)
@@ -0,0 +1,227 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/threading"
+)
+
+// subjectThreadWindow bounds how far back a reply without usable references
+// is matched to an existing thread by subject.
+const subjectThreadWindow = 30 * 24 * time.Hour
+
+// threadBatchSize is the number of messages ThreadMessages threads per
+// transaction.
+const threadBatchSize = 100
+
+// assignThread puts a newly inserted message into a thread. It joins the
+// threads of every stored message it refers to or that refers to it, merging
+// them if there are several, which re-links replies that arrived before
+// their parent. A reply with no such relatives falls back to a recent thread
+// with the same subject; otherwise a new thread is started.
+func assignThread(ctx context.Context, q *schema.Queries, m schema.InsertMessageParams) error {
+	refs := threadRefs(m)
+	for _, ref := range refs {
+		err := q.InsertMessageThreadRef(ctx, schema.InsertMessageThreadRefParams{
+			MessageID: m.ID,
+			UserID:    m.UserID,
+			Ref:       ref,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert thread reference: %w", err)
+		}
+	}
+
+	var found []string
+	seen := map[string]bool{}
+	lookup := refs
+	if m.InternetMessageID != "" {
+		lookup = append([]string{m.InternetMessageID}, refs...)
+	}
+	for _, ref := range lookup {
+		ids, err := q.ListThreadIDsByReference(ctx, schema.ListThreadIDsByReferenceParams{
+			UserID: m.UserID,
+			Ref:    ref,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to look up related threads: %w", err)
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				found = append(found, id)
+			}
+		}
+	}
+
+	baseSubject := threading.BaseSubject(m.Subject)
+	if len(found) == 0 && baseSubject != "" && threading.IsReply(m.Subject) {
+		t, err := q.FindThreadByBaseSubject(ctx, schema.FindThreadByBaseSubjectParams{
+			UserID:        m.UserID,
+			BaseSubject:   baseSubject,
+			LastMessageAt: m.SentAt.Add(-subjectThreadWindow),
+		})
+		if err == nil {
+			found = append(found, t.ID)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to look up thread by subject: %w", err)
+		}
+	}
+
+	var threadID string
+	if len(found) == 0 {
+		threadID = uuid.New().String()
+		err := q.InsertThread(ctx, schema.InsertThreadParams{
+			ID:            threadID,
+			UserID:        m.UserID,
+			Subject:       m.Subject,
+			BaseSubject:   baseSubject,
+			LastMessageAt: m.ReceivedAt,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert thread: %w", err)
+		}
+	} else {
+		var err error
+		if threadID, err = mergeThreads(ctx, q, m.UserID, found); err != nil {
+			return err
+		}
+	}
+
+	if err := q.SetMessageThread(ctx, schema.SetMessageThreadParams{ThreadID: threadID, ID: m.ID}); err != nil {
+		return fmt.Errorf("failed to set message thread: %w", err)
+	}
+	if err := q.RefreshThread(ctx, threadID); err != nil {
+		return fmt.Errorf("failed to update thread: %w", err)
+	}
+	return nil
+}
+
+// mergeThreads moves the messages of all threads in ids into the largest of
+// them and returns its ID.
+func mergeThreads(ctx context.Context, q *schema.Queries, userID string, ids []string) (string, error) {
+	if len(ids) == 1 {
+		return ids[0], nil
+	}
+
+	target, most := ids[0], int64(-1)
+	for _, id := range ids {
+		t, err := q.GetThread(ctx, schema.GetThreadParams{ID: id, UserID: userID})
+		if err != nil {
+			return "", fmt.Errorf("failed to get thread %s: %w", id, err)
+		}
+		if t.MessageCount > most {
+			target, most = t.ID, t.MessageCount
+		}
+	}
+
+	for _, id := range ids {
+		if id == target {
+			continue
+		}
+		err := q.MoveThreadMessages(ctx, schema.MoveThreadMessagesParams{
+			NewThreadID: target,
+			UserID:      userID,
+			OldThreadID: id,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to merge thread %s: %w", id, err)
+		}
+		if err := releaseThread(ctx, q, id); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+// releaseThread updates a thread after messages left it, deleting it once
+// it is empty.
+func releaseThread(ctx context.Context, q *schema.Queries, id string) error {
+	if err := q.RefreshThread(ctx, id); err != nil {
+		return fmt.Errorf("failed to update thread %s: %w", id, err)
+	}
+	if err := q.DeleteEmptyThread(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete thread %s: %w", id, err)
+	}
+	return nil
+}
+
+// threadRefs returns the Message-IDs m refers to: its References and
+// In-Reply-To, without duplicates or its own Message-ID.
+func threadRefs(m schema.InsertMessageParams) []string {
+	var refs []string
+	seen := map[string]bool{m.InternetMessageID: true, "": true}
+	for _, ref := range append(strings.Fields(m.MessageReferences), m.InReplyTo) {
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// ThreadMessages threads messages stored before threading existed, oldest
+// first, and returns how many were threaded.
+func (s *service) ThreadMessages(ctx context.Context) (int, error) {
+	threaded := 0
+	for {
+		pending, err := s.queries.ListUnthreadedMessages(ctx, threadBatchSize)
+		if err != nil {
+			return threaded, fmt.Errorf("failed to list unthreaded messages: %w", err)
+		}
+		if len(pending) == 0 {
+			return threaded, nil
+		}
+
+		err = s.WithTx(ctx, func(q *schema.Queries) error {
+			for _, m := range pending {
+				// Skips a message that a process job threaded meanwhile
+				if err := ThreadMessageTx(ctx, q, m.UserID, m.ID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return threaded, err
+		}
+		threaded += len(pending)
+	}
+}
+
+// ThreadMessageTx puts a stored message into a thread using q, unless it is
+// in one already.
+func ThreadMessageTx(ctx context.Context, q *schema.Queries, userID, id string) error {
+	m, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: userID})
+	if err != nil {
+		return fmt.Errorf("failed to get message %s: %w", id, err)
+	}
+	if m.ThreadID != "" {
+		return nil
+	}
+	if err := assignThread(ctx, q, threadParams(m)); err != nil {
+		return fmt.Errorf("failed to thread message %s: %w", id, err)
+	}
+	return nil
+}
+
+// threadParams returns the fields of a stored message that threading reads.
+func threadParams(m schema.Message) schema.InsertMessageParams {
+	return schema.InsertMessageParams{
+		ID:                m.ID,
+		UserID:            m.UserID,
+		InternetMessageID: m.InternetMessageID,
+		InReplyTo:         m.InReplyTo,
+		MessageReferences: m.MessageReferences,
+		Subject:           m.Subject,
+		SentAt:            m.SentAt,
+		ReceivedAt:        m.ReceivedAt,
+	}
+}
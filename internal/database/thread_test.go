@@ -0,0 +1,139 @@
+// The tests are in an external package because dbtest imports database.
+package database_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+)
+
+var threadBase = time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)
+
+// insert stores a message for userID sent and received day days after
+// threadBase. refs are its References, the last of which is its
+// In-Reply-To.
+func insert(t *testing.T, db database.Service, userID, id, subject string, day int, refs ...string) {
+	t.Helper()
+	m := schema.InsertMessageParams{
+		ID:                id,
+		UserID:            userID,
+		InternetMessageID: id + "@example.com",
+		Subject:           subject,
+		SentAt:            threadBase.AddDate(0, 0, day),
+		ReceivedAt:        threadBase.AddDate(0, 0, day),
+	}
+	for i, r := range refs {
+		if i > 0 {
+			m.MessageReferences += " "
+		}
+		m.MessageReferences += r + "@example.com"
+		m.InReplyTo = r + "@example.com"
+	}
+	if err := db.InsertMessage(context.Background(), database.MessageRecord{Message: m}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// threadOf returns the thread IDs of the messages.
+func threadOf(t *testing.T, db database.Service, ids ...string) map[string]string {
+	t.Helper()
+	threads := map[string]string{}
+	for _, id := range ids {
+		var thread string
+		if err := db.DB().QueryRow(`SELECT thread_id FROM message WHERE id = ?`, id).Scan(&thread); err != nil {
+			t.Fatal(err)
+		}
+		if thread == "" {
+			t.Errorf("message %s has no thread", id)
+		}
+		threads[id] = thread
+	}
+	return threads
+}
+
+// countThreads returns the number of userID's threads.
+func countThreads(t *testing.T, db database.Service, userID string) int {
+	t.Helper()
+	var n int
+	if err := db.DB().QueryRow(`SELECT COUNT(*) FROM thread WHERE user_id = ?`, userID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestThreadRelinksWhenParentArrivesLast(t *testing.T) {
+	db := dbtest.New(t)
+
+	// Replies whose clients kept only the last reference don't share one,
+	// and b2 changed the subject, so they start separate threads
+	insert(t, db, "u1", "c", "Re: Plans", 2, "b")
+	insert(t, db, "u1", "d", "Re: Plans", 3, "b", "c")
+	insert(t, db, "u1", "b2", "Re: Budget", 2, "a")
+	if n := countThreads(t, db, "u1"); n != 2 {
+		t.Fatalf("got %d threads before the parents arrived, want 2", n)
+	}
+
+	// b links c to b2's thread through a; a then arrives to its replies
+	insert(t, db, "u1", "b", "Re: Plans", 1, "a")
+	insert(t, db, "u1", "a", "Plans", 0)
+
+	threads := threadOf(t, db, "a", "b", "b2", "c", "d")
+	for id, thread := range threads {
+		if thread != threads["a"] {
+			t.Errorf("message %s is in thread %s, want %s", id, thread, threads["a"])
+		}
+	}
+	if n := countThreads(t, db, "u1"); n != 1 {
+		t.Errorf("got %d threads after the merge, want 1", n)
+	}
+
+	thread, err := db.Queries().GetThread(context.Background(), schema.GetThreadParams{ID: threads["a"], UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread.MessageCount != 5 || !thread.LastMessageAt.Equal(threadBase.AddDate(0, 0, 3)) {
+		t.Errorf("got %d messages, last at %s; want 5, last on day 3", thread.MessageCount, thread.LastMessageAt)
+	}
+
+}
+
+func TestThreadSubjectFallback(t *testing.T) {
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+
+	insert(t, db, "u1", "a", "Plans", 0)
+	// A reply that lost its references joins by subject within the window
+	insert(t, db, "u1", "b", "RE: [team] Plans", 10)
+	// A message with the same subject that isn't a reply starts a thread
+	insert(t, db, "u1", "c", "Plans", 11)
+	// So does a reply long after the thread was last active
+	insert(t, db, "u1", "d", "Re: Lunch", 0)
+	insert(t, db, "u1", "e", "Re: Lunch", 31)
+	// Other users' threads are never joined
+	insert(t, db, "u2", "f", "Re: Plans", 12)
+
+	threads := threadOf(t, db, "a", "b", "c", "d", "e", "f")
+	if threads["b"] != threads["a"] {
+		t.Error("a reply within the subject window started a thread")
+	}
+	// c's thread is the most recent for the subject, so later replies
+	// join it
+	insert(t, db, "u1", "g", "Re: Plans", 12)
+	threads = threadOf(t, db, "a", "c", "d", "e", "g")
+	if threads["c"] == threads["a"] {
+		t.Error("a message that isn't a reply joined a thread by subject")
+	}
+	if threads["g"] != threads["c"] {
+		t.Error("a reply didn't join the most recent thread with its subject")
+	}
+	if threads["e"] == threads["d"] {
+		t.Error("a reply outside the subject window joined a thread")
+	}
+	if n := countThreads(t, db, "u2"); n != 1 {
+		t.Errorf("u2 has %d threads, want 1", n)
+	}
+}
@@ -0,0 +1,62 @@
+// Package drafts keeps the messages users are composing and sends the ones
+// they schedule. The schedule is kept with the drafts in the database, so it
+// survives restarts: a Scheduler polls for drafts whose send time has passed
+// and submits them through the outbound mailer. A draft being sent is
+// leased, so one interrupted by a crash is sent again once its lease runs
+// out.
+package drafts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+var (
+	ErrDraftNotFound   = errors.New("draft not found")
+	ErrDraftSending    = errors.New("draft is being sent")
+	ErrInvalidSchedule = errors.New("invalid send time")
+)
+
+// Draft statuses.
+const (
+	StatusDraft     = "draft"
+	StatusScheduled = "scheduled"
+	StatusSending   = "sending"
+	StatusFailed    = "failed"
+)
+
+// Draft is a message being composed, as the API shows it. Its fields are
+// those of the message it sends. SendAt is set while it is scheduled, and
+// LastError says why the last attempt to send it failed.
+type Draft struct {
+	ID string `json:"id"`
+	outbound.Message
+	Status    string     `json:"status"`
+	SendAt    *time.Time `json:"send_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func newDraft(row schema.Draft) (Draft, error) {
+	d := Draft{
+		ID:        row.ID,
+		Status:    row.Status,
+		LastError: row.LastError,
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
+	}
+	if err := json.Unmarshal([]byte(row.Content), &d.Message); err != nil {
+		return Draft{}, fmt.Errorf("invalid content in draft %s: %w", row.ID, err)
+	}
+	if row.SendAt.Valid {
+		at := row.SendAt.Time
+		d.SendAt = &at
+	}
+	return d, nil
+}
@@ -0,0 +1,269 @@
+package drafts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+// fakeSender records submitted messages, failing while err is set.
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []outbound.Message
+	err  error
+}
+
+func (f *fakeSender) Submit(ctx context.Context, userID string, msg outbound.Message) (outbound.Sent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return outbound.Sent{}, f.err
+	}
+	f.sent = append(f.sent, msg)
+	return outbound.Sent{ID: fmt.Sprint(len(f.sent)), MessageID: "sent@example.com"}, nil
+}
+
+var status = outbound.Message{To: []string{"team@example.com"}, Subject: "Status", Text: "All good."}
+
+func TestCRUD(t *testing.T) {
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+	s := New(db)
+	ctx := context.Background()
+
+	// Drafts may be incomplete
+	d, err := s.Create(ctx, "u1", outbound.Message{Subject: "Status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != StatusDraft || d.SendAt != nil || d.Subject != "Status" {
+		t.Errorf("got %+v", d)
+	}
+	if _, err := s.Schedule(ctx, "u1", d.ID, time.Now().Add(time.Hour)); !errors.Is(err, outbound.ErrInvalidMessage) {
+		t.Errorf("scheduling an incomplete draft: got %v", err)
+	}
+
+	d, err = s.Update(ctx, "u1", d.ID, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Text != "All good." || d.To[0] != "team@example.com" {
+		t.Errorf("got %+v", d)
+	}
+	if _, err := s.Schedule(ctx, "u1", d.ID, time.Time{}); !errors.Is(err, ErrInvalidSchedule) {
+		t.Errorf("scheduling without a time: got %v", err)
+	}
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	d, err = s.Schedule(ctx, "u1", d.ID, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != StatusScheduled || d.SendAt == nil || !d.SendAt.Equal(at) {
+		t.Errorf("got %+v, want scheduled at %v", d, at)
+	}
+	d, err = s.Unschedule(ctx, "u1", d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != StatusDraft || d.SendAt != nil {
+		t.Errorf("got %+v", d)
+	}
+
+	// Other users' drafts are invisible
+	if _, err := s.Get(ctx, "u2", d.ID); !errors.Is(err, ErrDraftNotFound) {
+		t.Errorf("got %v, want %v", err, ErrDraftNotFound)
+	}
+	if _, err := s.Update(ctx, "u2", d.ID, status); !errors.Is(err, ErrDraftNotFound) {
+		t.Errorf("got %v, want %v", err, ErrDraftNotFound)
+	}
+	if list, err := s.List(ctx, "u2"); err != nil || len(list) != 0 {
+		t.Errorf("got %v, %v", list, err)
+	}
+
+	if list, err := s.List(ctx, "u1"); err != nil || len(list) != 1 {
+		t.Errorf("got %v, %v", list, err)
+	}
+	if err := s.Delete(ctx, "u1", d.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "u1", d.ID); !errors.Is(err, ErrDraftNotFound) {
+		t.Errorf("got %v, want %v", err, ErrDraftNotFound)
+	}
+}
+
+func TestSendDue(t *testing.T) {
+	db := dbtest.New(t)
+	s := New(db)
+	ctx := context.Background()
+
+	clock := time.Now()
+	sender := &fakeSender{}
+	sch := NewScheduler(db, sender)
+	sch.now = func() time.Time { return clock }
+
+	later, err := s.Create(ctx, "u1", status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Schedule(ctx, "u1", later.ID, clock.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	now, err := s.Create(ctx, "u1", outbound.Message{To: []string{"boss@example.com"}, Text: "Done."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Schedule(ctx, "u1", now.ID, clock.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := sch.SendDue(ctx); err != nil || n != 1 {
+		t.Fatalf("got %d, %v; want 1 draft sent", n, err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].Text != "Done." {
+		t.Errorf("sent %+v", sender.sent)
+	}
+	if _, err := s.Get(ctx, "u1", now.ID); !errors.Is(err, ErrDraftNotFound) {
+		t.Errorf("sent draft: got %v, want %v", err, ErrDraftNotFound)
+	}
+
+	// Rescheduling moves the send time
+	if _, err := s.Schedule(ctx, "u1", later.ID, clock.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(90 * time.Minute)
+	if n, err := sch.SendDue(ctx); err != nil || n != 0 {
+		t.Errorf("got %d, %v before the new time", n, err)
+	}
+	clock = clock.Add(time.Hour)
+	if n, err := sch.SendDue(ctx); err != nil || n != 1 || len(sender.sent) != 2 {
+		t.Errorf("got %d, %v after the new time", n, err)
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	db := dbtest.New(t)
+	s := New(db)
+	ctx := context.Background()
+
+	clock := time.Now()
+	sender := &fakeSender{err: fmt.Errorf("%w: 451 try again later", outbound.ErrRelayFailed)}
+	sch := NewScheduler(db, sender)
+	sch.now = func() time.Time { return clock }
+
+	d, err := s.Create(ctx, "u1", status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Schedule(ctx, "u1", d.ID, clock); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= MaxAttempts; i++ {
+		if n, err := sch.SendDue(ctx); err != nil || n != 1 {
+			t.Fatalf("attempt %d: got %d, %v", i, n, err)
+		}
+		got, err := s.Get(ctx, "u1", d.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := StatusScheduled
+		if i == MaxAttempts {
+			want = StatusFailed
+		}
+		if got.Status != want || got.LastError == "" {
+			t.Fatalf("attempt %d: got %+v, want %s", i, got, want)
+		}
+		if n, _ := sch.SendDue(ctx); n != 0 {
+			t.Fatalf("attempt %d: retried before the backoff", i)
+		}
+		clock = clock.Add(time.Hour)
+	}
+
+	// Rescheduling a failed draft tries again
+	sender.err = nil
+	if _, err := s.Schedule(ctx, "u1", d.ID, clock); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sch.SendDue(ctx); err != nil || n != 1 || len(sender.sent) != 1 {
+		t.Errorf("got %d, %v", n, err)
+	}
+}
+
+func TestSendPermanentFailure(t *testing.T) {
+	db := dbtest.New(t)
+	s := New(db)
+	ctx := context.Background()
+
+	sch := NewScheduler(db, &fakeSender{err: outbound.ErrReplyNotFound})
+	d, err := s.Create(ctx, "u1", status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Schedule(ctx, "u1", d.ID, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sch.SendDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(ctx, "u1", d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusFailed || got.LastError != outbound.ErrReplyNotFound.Error() {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestSendingLease(t *testing.T) {
+	db := dbtest.New(t)
+	s := New(db)
+	ctx := context.Background()
+
+	d, err := s.Create(ctx, "u1", status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Now()
+	if _, err := s.Schedule(ctx, "u1", d.ID, clock); err != nil {
+		t.Fatal(err)
+	}
+
+	// A scheduler that dies after claiming the draft leaves it leased
+	if _, err := db.Queries().ClaimDueDrafts(ctx, schema.ClaimDueDraftsParams{
+		Lease:      "dead",
+		LeaseUntil: sql.NullTime{Time: clock.UTC().Add(leaseTimeout), Valid: true},
+		Now:        sql.NullTime{Time: clock.UTC(), Valid: true},
+		Limit:      1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Update(ctx, "u1", d.ID, status); !errors.Is(err, ErrDraftSending) {
+		t.Errorf("update while sending: got %v, want %v", err, ErrDraftSending)
+	}
+	if _, err := s.Unschedule(ctx, "u1", d.ID); !errors.Is(err, ErrDraftSending) {
+		t.Errorf("unschedule while sending: got %v, want %v", err, ErrDraftSending)
+	}
+	if err := s.Delete(ctx, "u1", d.ID); !errors.Is(err, ErrDraftSending) {
+		t.Errorf("delete while sending: got %v, want %v", err, ErrDraftSending)
+	}
+
+	// After a restart it is sent once the lease runs out
+	sender := &fakeSender{}
+	sch := NewScheduler(db, sender)
+	sch.now = func() time.Time { return clock }
+	if n, _ := sch.SendDue(ctx); n != 0 {
+		t.Errorf("claimed a leased draft")
+	}
+	clock = clock.Add(leaseTimeout + time.Second)
+	if n, err := sch.SendDue(ctx); err != nil || n != 1 || len(sender.sent) != 1 {
+		t.Errorf("got %d, %v after the lease ran out", n, err)
+	}
+}
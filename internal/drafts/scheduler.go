@@ -0,0 +1,189 @@
+package drafts
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/jobs"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+const (
+	// DefaultInterval is how often the Scheduler looks for due drafts.
+	DefaultInterval = time.Second
+	// MaxAttempts is how many times sending a draft is tried before it is
+	// failed.
+	MaxAttempts = 5
+
+	// leaseTimeout outlasts the mailer's relay timeout
+	leaseTimeout = 5 * time.Minute
+	batchSize    = 10
+)
+
+// Submitter sends a message on a user's behalf. *outbound.Mailer implements
+// it.
+type Submitter interface {
+	Submit(ctx context.Context, userID string, msg outbound.Message) (outbound.Sent, error)
+}
+
+// Scheduler sends scheduled drafts once they are due, and deletes them once
+// sent; the message itself is kept in the Sent folder. Drafts the relay
+// refuses are retried with backoff. A draft whose sending is cut short by a
+// crash may be sent twice.
+type Scheduler struct {
+	queries  *schema.Queries
+	sender   Submitter
+	interval time.Duration
+	now      func() time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewScheduler creates a Scheduler sending the drafts in db through sender.
+func NewScheduler(db database.Service, sender Submitter) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		queries:  db.Queries(),
+		sender:   sender,
+		interval: DefaultInterval,
+		now:      time.Now,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start sends due drafts in the background until Shutdown.
+func (s *Scheduler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.Run(s.ctx)
+	}()
+}
+
+// Run sends due drafts every interval until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.SendDue(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			metrics.Errors.WithLabelValues("draft_claim").Inc()
+			logger.Error(ctx, "Failed to claim scheduled drafts", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops the Scheduler and waits until ctx is done for drafts being
+// sent to finish. Drafts cut short are sent after a restart.
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	s.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendDue sends the drafts that are due, concurrently, and returns how many
+// it attempted.
+func (s *Scheduler) SendDue(ctx context.Context) (int, error) {
+	now := s.now().UTC()
+	due, err := s.queries.ClaimDueDrafts(ctx, schema.ClaimDueDraftsParams{
+		Lease:      uuid.New().String(),
+		LeaseUntil: sql.NullTime{Time: now.Add(leaseTimeout), Valid: true},
+		Now:        sql.NullTime{Time: now, Valid: true},
+		Limit:      batchSize,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range due {
+		wg.Add(1)
+		go func(d schema.Draft) {
+			defer wg.Done()
+			if err := s.send(ctx, d); err != nil {
+				metrics.Errors.WithLabelValues("draft_record").Inc()
+				logger.Error(ctx, "Failed to record scheduled draft", "draft_id", d.ID, "error", err)
+			}
+		}(d)
+	}
+	wg.Wait()
+	return len(due), nil
+}
+
+// send submits a claimed draft and records the outcome. Only failures to
+// record it are returned.
+func (s *Scheduler) send(ctx context.Context, d schema.Draft) error {
+	var msg outbound.Message
+	if err := json.Unmarshal([]byte(d.Content), &msg); err != nil {
+		return s.fail(ctx, d, "invalid draft content: "+err.Error())
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, leaseTimeout)
+	sent, err := s.sender.Submit(sendCtx, d.UserID, msg)
+	cancel()
+	if err != nil && ctx.Err() != nil {
+		// Shutting down; the lease runs out and the draft is sent again
+		return nil
+	}
+	// Outcomes are recorded even if a shutdown starts meanwhile
+	ctx = context.WithoutCancel(ctx)
+	switch {
+	case err == nil:
+		logger.Info(ctx, "Sent scheduled draft", "draft_id", d.ID, "internet_message_id", sent.MessageID)
+		_, err := s.queries.DeleteSentDraft(ctx, schema.DeleteSentDraftParams{ID: d.ID, Lease: d.Lease})
+		return err
+	case errors.Is(err, outbound.ErrInvalidMessage),
+		errors.Is(err, outbound.ErrReplyNotFound),
+		errors.Is(err, outbound.ErrSuppressed),
+		errors.Is(err, mailstore.ErrUnknownUser):
+		// Sending it again won't help
+		return s.fail(ctx, d, err.Error())
+	case d.Attempts >= MaxAttempts:
+		metrics.Errors.WithLabelValues("draft_send").Inc()
+		return s.fail(ctx, d, err.Error())
+	default:
+		metrics.Errors.WithLabelValues("draft_send").Inc()
+		logger.Warn(ctx, "Failed to send scheduled draft; retrying", "draft_id", d.ID, "attempt", d.Attempts, "error", err)
+		_, err := s.queries.RetryDraft(ctx, schema.RetryDraftParams{
+			SendAt:    sql.NullTime{Time: s.now().UTC().Add(jobs.Backoff(int(d.Attempts))), Valid: true},
+			LastError: err.Error(),
+			ID:        d.ID,
+			Lease:     d.Lease,
+		})
+		return err
+	}
+}
+
+func (s *Scheduler) fail(ctx context.Context, d schema.Draft, reason string) error {
+	logger.Warn(ctx, "Scheduled draft failed", "draft_id", d.ID, "reason", reason)
+	_, err := s.queries.FailDraft(ctx, schema.FailDraftParams{LastError: reason, ID: d.ID, Lease: d.Lease})
+	return err
+}
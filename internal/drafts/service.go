@@ -0,0 +1,156 @@
+package drafts
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+// Service stores users' drafts and their schedules.
+type Service struct {
+	db database.Service
+}
+
+// New creates a Service.
+func New(db database.Service) *Service {
+	return &Service{db: db}
+}
+
+// List returns userID's drafts, most recently changed first.
+func (s *Service) List(ctx context.Context, userID string) ([]Draft, error) {
+	rows, err := s.db.Queries().ListDraftsByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list drafts: %w", err)
+	}
+	list := make([]Draft, 0, len(rows))
+	for _, row := range rows {
+		d, err := newDraft(row)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// Get returns one of userID's drafts.
+func (s *Service) Get(ctx context.Context, userID, id string) (Draft, error) {
+	row, err := s.db.Queries().GetDraft(ctx, schema.GetDraftParams{ID: id, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Draft{}, ErrDraftNotFound
+		}
+		return Draft{}, fmt.Errorf("failed to get draft: %w", err)
+	}
+	return newDraft(row)
+}
+
+// Create saves msg as a new draft of userID's. Drafts may be incomplete;
+// they are only validated when scheduled.
+func (s *Service) Create(ctx context.Context, userID string, msg outbound.Message) (Draft, error) {
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return Draft{}, fmt.Errorf("failed to encode draft: %w", err)
+	}
+	id := uuid.New().String()
+	err = s.db.Queries().InsertDraft(ctx, schema.InsertDraftParams{ID: id, UserID: userID, Content: string(content)})
+	if err != nil {
+		return Draft{}, fmt.Errorf("failed to insert draft: %w", err)
+	}
+	return s.Get(ctx, userID, id)
+}
+
+// Update replaces the message of one of userID's drafts. A scheduled draft
+// stays scheduled and sends the new message.
+func (s *Service) Update(ctx context.Context, userID, id string, msg outbound.Message) (Draft, error) {
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return Draft{}, fmt.Errorf("failed to encode draft: %w", err)
+	}
+	n, err := s.db.Queries().UpdateDraftContent(ctx, schema.UpdateDraftContentParams{
+		Content: string(content),
+		ID:      id,
+		UserID:  userID,
+	})
+	if err != nil {
+		return Draft{}, fmt.Errorf("failed to update draft: %w", err)
+	}
+	if n == 0 {
+		return Draft{}, s.unchanged(ctx, userID, id)
+	}
+	return s.Get(ctx, userID, id)
+}
+
+// Delete removes one of userID's drafts, cancelling its schedule.
+func (s *Service) Delete(ctx context.Context, userID, id string) error {
+	n, err := s.db.Queries().DeleteDraft(ctx, schema.DeleteDraftParams{ID: id, UserID: userID})
+	if err != nil {
+		return fmt.Errorf("failed to delete draft: %w", err)
+	}
+	if n == 0 {
+		return s.unchanged(ctx, userID, id)
+	}
+	return nil
+}
+
+// Schedule sets one of userID's drafts to be sent at at, rescheduling it if
+// it already was. A time that has passed sends it right away. Errors wrap
+// outbound.ErrInvalidMessage if the draft can't be sent as it is.
+func (s *Service) Schedule(ctx context.Context, userID, id string, at time.Time) (Draft, error) {
+	if at.IsZero() {
+		return Draft{}, fmt.Errorf("%w: send_at is required", ErrInvalidSchedule)
+	}
+	d, err := s.Get(ctx, userID, id)
+	if err != nil {
+		return Draft{}, err
+	}
+	if err := d.Message.Validate(); err != nil {
+		return Draft{}, err
+	}
+
+	n, err := s.db.Queries().ScheduleDraft(ctx, schema.ScheduleDraftParams{
+		SendAt: sql.NullTime{Time: at.UTC(), Valid: true},
+		ID:     id,
+		UserID: userID,
+	})
+	if err != nil {
+		return Draft{}, fmt.Errorf("failed to schedule draft: %w", err)
+	}
+	if n == 0 {
+		return Draft{}, s.unchanged(ctx, userID, id)
+	}
+	return s.Get(ctx, userID, id)
+}
+
+// Unschedule cancels sending one of userID's drafts, keeping it as a draft.
+func (s *Service) Unschedule(ctx context.Context, userID, id string) (Draft, error) {
+	n, err := s.db.Queries().UnscheduleDraft(ctx, schema.UnscheduleDraftParams{ID: id, UserID: userID})
+	if err != nil {
+		return Draft{}, fmt.Errorf("failed to unschedule draft: %w", err)
+	}
+	if n == 0 {
+		return Draft{}, s.unchanged(ctx, userID, id)
+	}
+	return s.Get(ctx, userID, id)
+}
+
+// unchanged explains why a change to a draft matched no row: either it
+// doesn't exist or it is being sent.
+func (s *Service) unchanged(ctx context.Context, userID, id string) error {
+	d, err := s.Get(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if d.Status == StatusSending {
+		return ErrDraftSending
+	}
+	return fmt.Errorf("draft %s was not changed", id)
+}
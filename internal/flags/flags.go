@@ -0,0 +1,251 @@
+// Package flags reads and changes the state users keep on their messages:
+// whether a message is read, starred, important or answered, and any custom
+// keywords. The state is stored as IMAP sees it. Read is the message's
+// is_read column; the other flags are the keywords \Flagged, $Important and
+// \Answered, kept alongside custom keywords.
+package flags
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+// MaxMessages bounds the messages one change applies to.
+const MaxMessages = 5000
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrInvalidChange   = errors.New("invalid flag change")
+)
+
+// The keywords flags are stored as.
+const (
+	KeywordStarred   = `\Flagged`
+	KeywordImportant = "$Important"
+	KeywordAnswered  = `\Answered`
+)
+
+const maxKeyword = 100
+
+// Flags is the state of a message, as the API shows it. Keywords are the
+// custom ones, in order.
+type Flags struct {
+	Read      bool     `json:"read"`
+	Starred   bool     `json:"starred"`
+	Important bool     `json:"important"`
+	Answered  bool     `json:"answered"`
+	Keywords  []string `json:"keywords"`
+}
+
+// Change is a change to the flags of messages. Flags left nil are kept.
+type Change struct {
+	Read           *bool    `json:"read,omitempty"`
+	Starred        *bool    `json:"starred,omitempty"`
+	Important      *bool    `json:"important,omitempty"`
+	Answered       *bool    `json:"answered,omitempty"`
+	AddKeywords    []string `json:"add_keywords,omitempty"`
+	RemoveKeywords []string `json:"remove_keywords,omitempty"`
+}
+
+// validate reports whether c changes anything and its keywords are valid
+// IMAP atoms that aren't system flags.
+func (c Change) validate() error {
+	if c.Read == nil && c.Starred == nil && c.Important == nil && c.Answered == nil &&
+		len(c.AddKeywords) == 0 && len(c.RemoveKeywords) == 0 {
+		return fmt.Errorf("%w: nothing to change", ErrInvalidChange)
+	}
+	for _, list := range [][]string{c.AddKeywords, c.RemoveKeywords} {
+		for _, k := range list {
+			if err := validateKeyword(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateKeyword(k string) error {
+	if k == "" || len(k) > maxKeyword {
+		return fmt.Errorf("%w: keywords must be 1 to %d characters", ErrInvalidChange, maxKeyword)
+	}
+	if k[0] == '\\' || reserved(k) {
+		return fmt.Errorf("%w: %q is a system flag", ErrInvalidChange, k)
+	}
+	for _, r := range k {
+		// The atom-specials of RFC 3501
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return fmt.Errorf("%w: keyword %q contains %q", ErrInvalidChange, k, r)
+		}
+	}
+	return nil
+}
+
+// reserved reports whether k is the keyword of one of the flags.
+func reserved(k string) bool {
+	for _, f := range []string{KeywordStarred, KeywordImportant, KeywordAnswered} {
+		if strings.EqualFold(k, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// Outcome statuses.
+const (
+	StatusUpdated  = "updated"
+	StatusNotFound = "not_found"
+)
+
+// Outcome is what a change did to one message. Flags is the message's state
+// after the change, and is unset if it wasn't found.
+type Outcome struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Flags  *Flags `json:"flags,omitempty"`
+}
+
+// Service reads and changes the flags of users' messages.
+type Service struct {
+	db database.Service
+}
+
+// New creates a Service.
+func New(db database.Service) *Service {
+	return &Service{db: db}
+}
+
+// Get returns the flags of one of userID's messages.
+func (s *Service) Get(ctx context.Context, userID, id string) (Flags, error) {
+	q := s.db.Queries()
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Flags{}, ErrMessageNotFound
+		}
+		return Flags{}, fmt.Errorf("failed to get message: %w", err)
+	}
+	return load(ctx, q, msg)
+}
+
+// Apply makes c to userID's messages with the given IDs, in one transaction,
+// and returns an outcome per distinct ID in the order given. IDs of messages
+// that don't exist are reported rather than failing the change.
+func (s *Service) Apply(ctx context.Context, userID string, ids []string, c Change) ([]Outcome, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if len(ids) > MaxMessages {
+		return nil, fmt.Errorf("%w: at most %d messages can be changed at once", ErrInvalidChange, MaxMessages)
+	}
+
+	var outcomes []Outcome
+	err := s.db.WithTx(ctx, func(q *schema.Queries) error {
+		outcomes = make([]Outcome, 0, len(ids))
+		seen := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: userID})
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					outcomes = append(outcomes, Outcome{ID: id, Status: StatusNotFound})
+					continue
+				}
+				return fmt.Errorf("failed to get message: %w", err)
+			}
+			if err := apply(ctx, q, userID, id, c); err != nil {
+				return err
+			}
+			if c.Read != nil {
+				msg.IsRead = *c.Read
+			}
+			f, err := load(ctx, q, msg)
+			if err != nil {
+				return err
+			}
+			outcomes = append(outcomes, Outcome{ID: id, Status: StatusUpdated, Flags: &f})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+// ApplyTx makes c to one of userID's messages, which must exist. q should
+// be bound to the transaction making the change.
+func ApplyTx(ctx context.Context, q *schema.Queries, userID, id string, c Change) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return apply(ctx, q, userID, id, c)
+}
+
+// apply makes c to one message.
+func apply(ctx context.Context, q *schema.Queries, userID, id string, c Change) error {
+	if c.Read != nil {
+		if err := q.SetMessageRead(ctx, schema.SetMessageReadParams{IsRead: *c.Read, ID: id, UserID: userID}); err != nil {
+			return fmt.Errorf("failed to mark message read: %w", err)
+		}
+	}
+	var add, remove []string
+	for _, f := range []struct {
+		set     *bool
+		keyword string
+	}{
+		{c.Starred, KeywordStarred},
+		{c.Important, KeywordImportant},
+		{c.Answered, KeywordAnswered},
+	} {
+		switch {
+		case f.set == nil:
+		case *f.set:
+			add = append(add, f.keyword)
+		default:
+			remove = append(remove, f.keyword)
+		}
+	}
+	for _, k := range append(remove, c.RemoveKeywords...) {
+		if err := q.RemoveMessageKeyword(ctx, schema.RemoveMessageKeywordParams{MessageID: id, Keyword: k}); err != nil {
+			return fmt.Errorf("failed to unflag message: %w", err)
+		}
+	}
+	for _, k := range append(add, c.AddKeywords...) {
+		err := q.AddMessageKeyword(ctx, schema.AddMessageKeywordParams{MessageID: id, UserID: userID, Keyword: k})
+		if err != nil {
+			return fmt.Errorf("failed to flag message: %w", err)
+		}
+	}
+	return nil
+}
+
+// load reads the flags of msg.
+func load(ctx context.Context, q *schema.Queries, msg schema.Message) (Flags, error) {
+	keywords, err := q.ListMessageKeywords(ctx, msg.ID)
+	if err != nil {
+		return Flags{}, fmt.Errorf("failed to list message keywords: %w", err)
+	}
+	f := Flags{Read: msg.IsRead, Keywords: []string{}}
+	for _, k := range keywords {
+		switch {
+		case strings.EqualFold(k, KeywordStarred):
+			f.Starred = true
+		case strings.EqualFold(k, KeywordImportant):
+			f.Important = true
+		case strings.EqualFold(k, KeywordAnswered):
+			f.Answered = true
+		case !strings.HasPrefix(k, `\`):
+			f.Keywords = append(f.Keywords, k)
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,99 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+func ptr(b bool) *bool { return &b }
+
+func TestApply(t *testing.T) {
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	s := New(db)
+	ctx := context.Background()
+
+	var ids []string
+	for _, subject := range []string{"One", "Two"} {
+		id, err := store.Deliver(ctx, mailstore.Delivery{
+			UserID: "u1",
+			Raw:    []byte("From: bob@example.net\r\nTo: user@example.com\r\nSubject: " + subject + "\r\n\r\nHi\r\n"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Flags sieve scripts set are read the same way
+	err = db.Queries().AddMessageKeyword(ctx, schema.AddMessageKeywordParams{MessageID: ids[1], UserID: "u1", Keyword: `\flagged`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes, err := s.Apply(ctx, "u1", []string{ids[0], "missing", ids[1], ids[0]}, Change{
+		Read:        ptr(true),
+		Important:   ptr(true),
+		AddKeywords: []string{"$Receipt", "project-x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcomes) != 3 || outcomes[1].Status != StatusNotFound || outcomes[1].Flags != nil {
+		t.Fatalf("got outcomes %+v", outcomes)
+	}
+	if f := outcomes[2].Flags; outcomes[2].Status != StatusUpdated || !f.Read || !f.Important || !f.Starred || f.Answered ||
+		strings.Join(f.Keywords, ",") != "$Receipt,project-x" {
+		t.Errorf("got %+v", outcomes[2])
+	}
+
+	if _, err := s.Apply(ctx, "u1", ids, Change{Starred: ptr(false), Answered: ptr(true), RemoveKeywords: []string{"PROJECT-X"}}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Get(ctx, "u1", ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Read || !f.Important || f.Starred || !f.Answered || strings.Join(f.Keywords, ",") != "$Receipt" {
+		t.Errorf("got %+v", f)
+	}
+
+	// Other users' messages aren't found
+	outcomes, err = s.Apply(ctx, "u2", ids[:1], Change{Read: ptr(false)})
+	if err != nil || outcomes[0].Status != StatusNotFound {
+		t.Errorf("got %+v, %v", outcomes, err)
+	}
+	if _, err := s.Get(ctx, "u2", ids[0]); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("got %v, want %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	s := New(dbtest.New(t))
+	for name, c := range map[string]Change{
+		"empty":        {},
+		"system flag":  {AddKeywords: []string{`\Deleted`}},
+		"flag keyword": {RemoveKeywords: []string{"$important"}},
+		"space":        {AddKeywords: []string{"two words"}},
+		"special":      {AddKeywords: []string{"a(b"}},
+		"long":         {AddKeywords: []string{strings.Repeat("k", maxKeyword+1)}},
+	} {
+		if _, err := s.Apply(context.Background(), "u1", []string{"m"}, c); !errors.Is(err, ErrInvalidChange) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrInvalidChange)
+		}
+	}
+	if _, err := s.Apply(context.Background(), "u1", make([]string, MaxMessages+1), Change{Read: ptr(true)}); !errors.Is(err, ErrInvalidChange) {
+		t.Errorf("too many messages: got %v, want %v", err, ErrInvalidChange)
+	}
+}
@@ -0,0 +1,230 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-message/textproto"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/flags"
+)
+
+func (s *session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *imap.FetchOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*entry
+	var seqNums []uint32
+	s.forEach(numSet, func(seqNum uint32, e *entry) {
+		// Messages that have left can't be read any more
+		if !e.gone {
+			list = append(list, e)
+			seqNums = append(seqNums, seqNum)
+		}
+	})
+
+	// Reading a body, rather than peeking at it, marks the message seen
+	markSeen := false
+	for _, bs := range options.BodySection {
+		markSeen = markSeen || !bs.Peek
+	}
+	seen := map[*entry]bool{}
+	if markSeen && !s.sel.readOnly {
+		read := true
+		err := s.srv.store.DB().WithTx(s.ctx, func(q *schema.Queries) error {
+			for _, e := range list {
+				if hasFlag(e.flags, imap.FlagSeen) {
+					continue
+				}
+				if err := flags.ApplyTx(s.ctx, q, s.userID, e.id, flags.Change{Read: &read}); err != nil {
+					return err
+				}
+				seen[e] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return s.internalError("Failed to mark messages seen", err)
+		}
+		for e := range seen {
+			e.flags = sortFlags(append(e.flags, imap.FlagSeen))
+		}
+	}
+
+	for i, e := range list {
+		if err := s.fetch(w.CreateMessage(seqNums[i]), e, options, seen[e]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetch writes the data options asks for about e. Its flags are written if
+// they changed as it was fetched.
+func (s *session) fetch(w *imapserver.FetchResponseWriter, e *entry, options *imap.FetchOptions, flagsChanged bool) error {
+	w.WriteUID(e.uid)
+	if options.Flags || flagsChanged {
+		w.WriteFlags(e.allFlags())
+	}
+	if options.InternalDate {
+		w.WriteInternalDate(e.receivedAt)
+	}
+	if options.RFC822Size {
+		w.WriteRFC822Size(e.size)
+	}
+
+	if options.Envelope || options.BodyStructure != nil || len(options.BodySection) > 0 ||
+		len(options.BinarySection) > 0 || len(options.BinarySectionSize) > 0 {
+		raw, err := s.raw(e.id)
+		if err != nil {
+			return s.internalError("Failed to read message", err)
+		}
+		if options.Envelope {
+			w.WriteEnvelope(envelope(raw))
+		}
+		if options.BodyStructure != nil {
+			w.WriteBodyStructure(imapserver.ExtractBodyStructure(bytes.NewReader(raw)))
+		}
+		for _, bs := range options.BodySection {
+			buf := imapserver.ExtractBodySection(bytes.NewReader(raw), bs)
+			if err := writeSection(w.WriteBodySection(bs, int64(len(buf))), buf); err != nil {
+				return err
+			}
+		}
+		for _, bs := range options.BinarySection {
+			buf := imapserver.ExtractBinarySection(bytes.NewReader(raw), bs)
+			if err := writeSection(w.WriteBinarySection(bs, int64(len(buf))), buf); err != nil {
+				return err
+			}
+		}
+		for _, bss := range options.BinarySectionSize {
+			w.WriteBinarySectionSize(bss, imapserver.ExtractBinarySectionSize(bytes.NewReader(raw), bss))
+		}
+	}
+	return w.Close()
+}
+
+func writeSection(wc interface {
+	Write([]byte) (int, error)
+	Close() error
+}, buf []byte) error {
+	_, err := wc.Write(buf)
+	if closeErr := wc.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// envelope returns the envelope of the message raw, or nil if its header
+// can't be read.
+func envelope(raw []byte) *imap.Envelope {
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil
+	}
+	return imapserver.ExtractEnvelope(header)
+}
+
+func (s *session) Store(w *imapserver.FetchWriter, numSet imap.NumSet, store *imap.StoreFlags, options *imap.StoreOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sel.readOnly {
+		return errReadOnly
+	}
+
+	type change struct {
+		seqNum  uint32
+		e       *entry
+		flags   []imap.Flag
+		deleted bool
+	}
+	var changes []change
+	s.forEach(numSet, func(seqNum uint32, e *entry) {
+		if e.gone {
+			return
+		}
+		c := change{seqNum: seqNum, e: e, deleted: e.deleted}
+		switch store.Op {
+		case imap.StoreFlagsSet:
+			c.deleted = false
+		case imap.StoreFlagsAdd, imap.StoreFlagsDel:
+			c.flags = append(c.flags, e.flags...)
+		}
+		for _, f := range store.Flags {
+			f = canonicalFlag(f)
+			add := store.Op != imap.StoreFlagsDel
+			switch {
+			case f == imap.FlagDeleted:
+				c.deleted = add
+			case !stored(f):
+			case add && !hasFlag(c.flags, f):
+				c.flags = append(c.flags, f)
+			case !add:
+				c.flags = removeFlag(c.flags, f)
+			}
+		}
+		c.flags = sortFlags(c.flags)
+		changes = append(changes, c)
+	})
+
+	err := s.srv.store.DB().WithTx(s.ctx, func(q *schema.Queries) error {
+		for _, c := range changes {
+			if fc := flagChange(c.e.flags, c.flags); !emptyChange(fc) {
+				if err := flags.ApplyTx(s.ctx, q, s.userID, c.e.id, fc); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, flags.ErrInvalidChange) {
+			return &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeCannot, Text: err.Error()}
+		}
+		return s.internalError("Failed to store flags", err)
+	}
+
+	for _, c := range changes {
+		c.e.flags = c.flags
+		c.e.deleted = c.deleted
+		if store.Silent {
+			continue
+		}
+		rw := w.CreateMessage(c.seqNum)
+		rw.WriteUID(c.e.uid)
+		rw.WriteFlags(c.e.allFlags())
+		if err := rw.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stored reports whether f is a flag that is kept: a keyword, or one of
+// the system flags the flags package keeps.
+func stored(f imap.Flag) bool {
+	return keyword(f) || hasFlag([]imap.Flag{imap.FlagSeen, imap.FlagFlagged, imap.FlagAnswered, flags.KeywordImportant}, f)
+}
+
+// canonicalFlag returns the system flag f names in any case, or else f.
+func canonicalFlag(f imap.Flag) imap.Flag {
+	for _, g := range []imap.Flag{imap.FlagSeen, imap.FlagFlagged, imap.FlagAnswered, imap.FlagDeleted, imap.FlagDraft, flags.KeywordImportant} {
+		if sameFlag(g, f) {
+			return g
+		}
+	}
+	return f
+}
+
+func removeFlag(list []imap.Flag, f imap.Flag) []imap.Flag {
+	kept := list[:0]
+	for _, g := range list {
+		if !sameFlag(g, f) {
+			kept = append(kept, g)
+		}
+	}
+	return kept
+}
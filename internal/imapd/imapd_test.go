@@ -0,0 +1,365 @@
+package imapd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/credentials"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// testServer is an IMAP server on a loopback port, with an app password for
+// u1 (user@example.com).
+type testServer struct {
+	*Server
+	db       database.Service
+	addr     string
+	password string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	db := dbtest.New(t)
+
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	creds := credentials.New(db)
+	_, password, err := creds.Create(context.Background(), "u1", credentials.KindAppPassword, "Mail client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(Config{TLS: TLSNone}, store, creds)
+	s.pollInterval = 10 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.imap.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return &testServer{Server: s, db: db, addr: ln.Addr().String(), password: password}
+}
+
+// dial connects and signs in as u1.
+func (ts *testServer) dial(t *testing.T, options *imapclient.Options) *imapclient.Client {
+	t.Helper()
+	c, err := imapclient.DialInsecure(ts.addr, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Login("user@example.com", ts.password).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// deliver stores a message for u1 with subject and returns its ID.
+func (ts *testServer) deliver(t *testing.T, subject string) string {
+	t.Helper()
+	raw := "From: alice@example.org\r\nTo: user@example.com\r\nSubject: " + subject +
+		"\r\nDate: Mon, 02 Jun 2025 10:00:00 +0000\r\n\r\nAbout " + subject + ".\r\n"
+	id, err := ts.store.Deliver(context.Background(), mailstore.Delivery{UserID: "u1", Raw: []byte(raw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func (ts *testServer) isRead(t *testing.T, id string) bool {
+	t.Helper()
+	var read bool
+	if err := ts.db.DB().QueryRow(`SELECT is_read FROM message WHERE id = ?`, id).Scan(&read); err != nil {
+		t.Fatal(err)
+	}
+	return read
+}
+
+func TestLogin(t *testing.T) {
+	ts := newTestServer(t)
+
+	c, err := imapclient.DialInsecure(ts.addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Login("user@example.com", "wrong password").Wait(); err == nil {
+		t.Error("login with a wrong password succeeded")
+	}
+	if err := c.Login("other@example.com", ts.password).Wait(); err == nil {
+		t.Error("login as another user succeeded")
+	}
+	// App passwords are typed in any case, with or without spaces
+	password := strings.ToUpper(strings.ReplaceAll(ts.password, " ", ""))
+	if err := c.Login("USER@example.com", password).Wait(); err != nil {
+		t.Errorf("login failed: %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.dial(t, nil)
+
+	if err := c.Create("Work/Reports", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	list, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := map[string][]imap.MailboxAttr{}
+	for _, data := range list {
+		attrs[data.Mailbox] = data.Attrs
+	}
+	has := func(name string, attr imap.MailboxAttr) bool {
+		for _, a := range attrs[name] {
+			if a == attr {
+				return true
+			}
+		}
+		return false
+	}
+	for name, attr := range map[string]imap.MailboxAttr{
+		"INBOX":        imap.MailboxAttrHasNoChildren,
+		labels.Sent:    imap.MailboxAttrSent,
+		labels.Trash:   imap.MailboxAttrTrash,
+		labels.Spam:    imap.MailboxAttrJunk,
+		labels.Archive: imap.MailboxAttrArchive,
+		"Work":         imap.MailboxAttrHasChildren,
+		"Work/Reports": imap.MailboxAttrHasNoChildren,
+	} {
+		if !has(name, attr) {
+			t.Errorf("%s has attributes %v, want %s", name, attrs[name], attr)
+		}
+	}
+
+	if err := c.Create("Work", nil).Wait(); err == nil {
+		t.Error("creating an existing mailbox succeeded")
+	}
+	if err := c.Delete("Trash").Wait(); err == nil {
+		t.Error("deleting Trash succeeded")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	ts := newTestServer(t)
+	id := ts.deliver(t, "Hello")
+	c := ts.dial(t, nil)
+
+	data, err := c.Select("INBOX", nil).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.NumMessages != 1 || data.UIDNext != 2 {
+		t.Fatalf("SELECT got %d messages and UIDNEXT %d, want 1 and 2", data.NumMessages, data.UIDNext)
+	}
+
+	peek := &imap.FetchItemBodySection{Peek: true}
+	msgs, err := c.Fetch(imap.SeqSetNum(1), &imap.FetchOptions{
+		UID:         true,
+		Flags:       true,
+		Envelope:    true,
+		RFC822Size:  true,
+		BodySection: []*imap.FetchItemBodySection{peek},
+	}).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.UID != 1 || msg.Envelope == nil || msg.Envelope.Subject != "Hello" || len(msg.Flags) != 0 {
+		t.Errorf("got UID %d, envelope %+v and flags %v", msg.UID, msg.Envelope, msg.Flags)
+	}
+	if body := msg.FindBodySection(peek); !strings.Contains(string(body), "About Hello.") || int64(len(body)) != msg.RFC822Size {
+		t.Errorf("got body %q of size %d", body, msg.RFC822Size)
+	}
+	if ts.isRead(t, id) {
+		t.Error("peeking marked the message read")
+	}
+
+	// Reading the body marks the message seen
+	msgs, err = c.Fetch(imap.UIDSetNum(1), &imap.FetchOptions{
+		BodySection: []*imap.FetchItemBodySection{{Specifier: imap.PartSpecifierText}},
+	}).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || len(msgs[0].Flags) != 1 || msgs[0].Flags[0] != imap.FlagSeen {
+		t.Errorf("UID FETCH got %+v, want the message with \\Seen", msgs)
+	}
+	if !ts.isRead(t, id) {
+		t.Error("reading didn't mark the message read")
+	}
+}
+
+func TestSearchAndStore(t *testing.T) {
+	ts := newTestServer(t)
+	ts.deliver(t, "Invoice")
+	ts.deliver(t, "Lunch")
+	ts.deliver(t, "Invoice reminder")
+	c := ts.dial(t, nil)
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(criteria *imap.SearchCriteria) []uint32 {
+		t.Helper()
+		data, err := c.Search(criteria, nil).Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data.AllSeqNums()
+	}
+	equal := func(got []uint32, want ...uint32) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	subject := &imap.SearchCriteria{Header: []imap.SearchCriteriaHeaderField{{Key: "Subject", Value: "invoice"}}}
+	if got := search(subject); !equal(got, 1, 3) {
+		t.Errorf("SEARCH SUBJECT invoice got %v, want [1 3]", got)
+	}
+	if got := search(&imap.SearchCriteria{Body: []string{"lunch"}}); !equal(got, 2) {
+		t.Errorf("SEARCH BODY lunch got %v, want [2]", got)
+	}
+
+	err := c.Store(imap.SeqSetNum(1, 3), &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagFlagged}}, nil).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := search(&imap.SearchCriteria{Flag: []imap.Flag{imap.FlagFlagged}}); !equal(got, 1, 3) {
+		t.Errorf("SEARCH FLAGGED got %v, want [1 3]", got)
+	}
+	if got := search(&imap.SearchCriteria{NotFlag: []imap.Flag{imap.FlagFlagged}}); !equal(got, 2) {
+		t.Errorf("SEARCH UNFLAGGED got %v, want [2]", got)
+	}
+
+	data, err := c.UIDSearch(&imap.SearchCriteria{UID: []imap.UIDSet{imap.UIDSetNum(2, 3)}, Flag: []imap.Flag{imap.FlagFlagged}}, nil).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uids := data.AllUIDs(); len(uids) != 1 || uids[0] != 3 {
+		t.Errorf("UID SEARCH got %v, want [3]", uids)
+	}
+
+	// Flags are kept, so a new session sees them
+	var n int
+	if err := ts.db.DB().QueryRow(`SELECT COUNT(*) FROM message_keyword WHERE keyword = ?`, `\Flagged`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d messages are flagged, want 2", n)
+	}
+}
+
+func TestMoveAndExpunge(t *testing.T) {
+	ts := newTestServer(t)
+	ts.deliver(t, "One")
+	ts.deliver(t, "Two")
+	c := ts.dial(t, nil)
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := c.Move(imap.SeqSetNum(1), labels.Trash).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.DestUIDs.String() != "1" || data.SourceUIDs.String() != "1" {
+		t.Errorf("MOVE got source UIDs %v and destination UIDs %v", data.SourceUIDs, data.DestUIDs)
+	}
+	status, err := c.Status("INBOX", &imap.StatusOptions{NumMessages: true}).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *status.NumMessages != 1 {
+		t.Errorf("INBOX has %d messages after the move, want 1", *status.NumMessages)
+	}
+
+	// Expunging from Trash deletes the message
+	if _, err := c.Select(labels.Trash, nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Store(imap.SeqSetNum(1), &imap.StoreFlags{Op: imap.StoreFlagsAdd, Silent: true, Flags: []imap.Flag{imap.FlagDeleted}}, nil).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqNums, err := c.Expunge().Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqNums) != 1 || seqNums[0] != 1 {
+		t.Errorf("EXPUNGE got %v, want [1]", seqNums)
+	}
+	var n int
+	if err := ts.db.DB().QueryRow(`SELECT COUNT(*) FROM message WHERE user_id = 'u1'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d messages are left, want 1", n)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	ts := newTestServer(t)
+	ts.deliver(t, "One")
+
+	exists := make(chan uint32, 10)
+	c := ts.dial(t, &imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages != nil {
+					exists <- *data.NumMessages
+				}
+			},
+		},
+	})
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	idle, err := c.Idle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.deliver(t, "Two")
+	select {
+	case n := <-exists:
+		if n != 2 {
+			t.Errorf("got EXISTS %d, want 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no EXISTS while idling")
+	}
+	if err := idle.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idle.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
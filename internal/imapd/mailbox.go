@@ -0,0 +1,283 @@
+package imapd
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+)
+
+// inbox is the name IMAP gives the Inbox, in any case.
+const inbox = "INBOX"
+
+// delim separates the segments of mailbox names, as it does label paths.
+const delim = '/'
+
+// mailboxName returns the IMAP name of the label at path.
+func mailboxName(path string) string {
+	if path == labels.Inbox {
+		return inbox
+	}
+	return path
+}
+
+// specialUse returns the special-use attribute of the label at path, if it
+// has one.
+func specialUse(path string) imap.MailboxAttr {
+	switch path {
+	case labels.Sent:
+		return imap.MailboxAttrSent
+	case labels.Archive:
+		return imap.MailboxAttrArchive
+	case labels.Trash:
+		return imap.MailboxAttrTrash
+	case labels.Spam:
+		return imap.MailboxAttrJunk
+	}
+	return ""
+}
+
+// errNoMailbox answers commands naming a mailbox that doesn't exist.
+var errNoMailbox = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeNonExistent,
+	Text: "No such mailbox",
+}
+
+// label returns the label of userID's the mailbox name is, or errNoMailbox.
+// System labels are named in any case.
+func (s *session) label(name string) (labels.Label, error) {
+	if strings.EqualFold(name, inbox) {
+		name = labels.Inbox
+	}
+	list, err := s.srv.labels.List(s.ctx, s.userID)
+	if err != nil {
+		return labels.Label{}, err
+	}
+	for _, l := range list {
+		if l.Path == name || (l.System && strings.EqualFold(l.Path, name)) {
+			return l, nil
+		}
+	}
+	return labels.Label{}, errNoMailbox
+}
+
+// entry is a message in a mailbox view. Its sequence number is its index
+// in the view plus one.
+type entry struct {
+	uid        imap.UID
+	id         string
+	flags      []imap.Flag // sorted
+	receivedAt time.Time
+	size       int64
+
+	// deleted is the \Deleted flag, which is kept by the session rather
+	// than stored, until the message is expunged
+	deleted bool
+	// gone marks a message that has left the mailbox but can't be
+	// expunged yet, as the client isn't expecting expunges
+	gone bool
+}
+
+// allFlags returns e's flags, with \Deleted if it is set.
+func (e *entry) allFlags() []imap.Flag {
+	if !e.deleted {
+		return e.flags
+	}
+	return sortFlags(append(append([]imap.Flag(nil), e.flags...), imap.FlagDeleted))
+}
+
+// snapshot is the state of a mailbox at one point.
+type snapshot struct {
+	uidValidity uint32
+	uidNext     imap.UID
+	msgs        []*entry
+}
+
+// snapshot gives UIDs to the messages that have come into the mailbox of
+// the label at path since it was last looked at, drops those of the
+// messages that have left, and returns the messages in UID order.
+func (s *session) snapshot(path string) (snapshot, error) {
+	var snap snapshot
+	err := s.srv.store.DB().WithTx(s.ctx, func(q *schema.Queries) error {
+		var err error
+		snap, err = syncMailbox(s.ctx, q, s.userID, path)
+		return err
+	})
+	return snap, err
+}
+
+func syncMailbox(ctx context.Context, q *schema.Queries, userID, path string) (snapshot, error) {
+	err := q.InsertMailboxState(ctx, schema.InsertMailboxStateParams{
+		UserID:      userID,
+		Name:        path,
+		UidValidity: int64(uint32(time.Now().Unix())),
+	})
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to insert mailbox state: %w", err)
+	}
+	state, err := q.GetMailboxState(ctx, schema.GetMailboxStateParams{UserID: userID, Name: path})
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to get mailbox state: %w", err)
+	}
+
+	var ids []string
+	switch path {
+	case labels.Inbox, labels.Archive:
+		ids, err = q.ListMessageIDsByArchived(ctx, schema.ListMessageIDsByArchivedParams{UserID: userID, Archived: path == labels.Archive})
+	default:
+		ids, err = q.ListMessageIDsByLabel(ctx, schema.ListMessageIDsByLabelParams{UserID: userID, Label: path})
+	}
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to list messages labeled %s: %w", path, err)
+	}
+	current := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		current[id] = true
+	}
+
+	uids, err := q.ListMailboxUIDs(ctx, schema.ListMailboxUIDsParams{UserID: userID, Mailbox: path})
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to list mailbox UIDs: %w", err)
+	}
+	known := make(map[string]bool, len(uids))
+	for _, u := range uids {
+		known[u.MessageID] = true
+		if current[u.MessageID] {
+			continue
+		}
+		err := q.DeleteMailboxUID(ctx, schema.DeleteMailboxUIDParams{UserID: userID, Mailbox: path, Uid: u.Uid})
+		if err != nil {
+			return snapshot{}, fmt.Errorf("failed to delete mailbox UID: %w", err)
+		}
+	}
+	next := state.UidNext
+	for _, id := range ids {
+		if known[id] {
+			continue
+		}
+		err := q.InsertMailboxUID(ctx, schema.InsertMailboxUIDParams{UserID: userID, Mailbox: path, Uid: next, MessageID: id})
+		if err != nil {
+			return snapshot{}, fmt.Errorf("failed to insert mailbox UID: %w", err)
+		}
+		next++
+	}
+	if next != state.UidNext {
+		err := q.SetMailboxUIDNext(ctx, schema.SetMailboxUIDNextParams{UidNext: next, UserID: userID, Name: path})
+		if err != nil {
+			return snapshot{}, fmt.Errorf("failed to update mailbox state: %w", err)
+		}
+	}
+
+	rows, err := q.ListMailboxMessages(ctx, schema.ListMailboxMessagesParams{UserID: userID, Mailbox: path})
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to list mailbox messages: %w", err)
+	}
+	keywords, err := q.ListMailboxKeywords(ctx, schema.ListMailboxKeywordsParams{UserID: userID, Mailbox: path})
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to list mailbox keywords: %w", err)
+	}
+	byMessage := make(map[string][]string)
+	for _, k := range keywords {
+		byMessage[k.MessageID] = append(byMessage[k.MessageID], k.Keyword)
+	}
+
+	snap := snapshot{
+		uidValidity: uint32(state.UidValidity),
+		uidNext:     imap.UID(next),
+		msgs:        make([]*entry, 0, len(rows)),
+	}
+	for _, row := range rows {
+		snap.msgs = append(snap.msgs, &entry{
+			uid:        imap.UID(row.Uid),
+			id:         row.ID,
+			flags:      storedFlags(row.IsRead, byMessage[row.ID]),
+			receivedAt: row.ReceivedAt,
+			size:       row.Size,
+		})
+	}
+	return snap, nil
+}
+
+// storedFlags returns the flags of a message that is read or not and has
+// keywords.
+func storedFlags(read bool, keywords []string) []imap.Flag {
+	list := make([]imap.Flag, 0, len(keywords)+1)
+	if read {
+		list = append(list, imap.FlagSeen)
+	}
+	for _, k := range keywords {
+		list = append(list, imap.Flag(k))
+	}
+	return sortFlags(list)
+}
+
+func sortFlags(list []imap.Flag) []imap.Flag {
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+// raw returns the raw content of one of the user's messages, which is in
+// the blob store or, for messages stored before it existed, in the
+// database.
+func (s *session) raw(id string) ([]byte, error) {
+	body, err := s.srv.store.DB().Queries().GetMessageBody(s.ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get message body: %w", err)
+	}
+	if len(body.Raw) > 0 || body.RawHash == "" {
+		return body.Raw, nil
+	}
+	return s.srv.store.Blobs().Get(s.ctx, body.RawHash)
+}
+
+// flagChange returns the change that takes a message's flags from old to
+// new. \Deleted, and system flags that aren't stored, are left out.
+func flagChange(old, new []imap.Flag) flags.Change {
+	var c flags.Change
+	set := func(f imap.Flag) *bool {
+		was, is := hasFlag(old, f), hasFlag(new, f)
+		if was == is {
+			return nil
+		}
+		return &is
+	}
+	c.Read = set(imap.FlagSeen)
+	c.Starred = set(imap.FlagFlagged)
+	c.Answered = set(imap.FlagAnswered)
+	c.Important = set(flags.KeywordImportant)
+	for _, f := range new {
+		if keyword(f) && !hasFlag(old, f) {
+			c.AddKeywords = append(c.AddKeywords, string(f))
+		}
+	}
+	for _, f := range old {
+		if keyword(f) && !hasFlag(new, f) {
+			c.RemoveKeywords = append(c.RemoveKeywords, string(f))
+		}
+	}
+	return c
+}
+
+// keyword reports whether f is a custom keyword, rather than a system flag
+// or one of those the flags package keeps.
+func keyword(f imap.Flag) bool {
+	return !strings.HasPrefix(string(f), `\`) && !strings.EqualFold(string(f), flags.KeywordImportant)
+}
+
+// emptyChange reports whether c changes nothing.
+func emptyChange(c flags.Change) bool {
+	return c.Read == nil && c.Starred == nil && c.Important == nil && c.Answered == nil &&
+		len(c.AddKeywords) == 0 && len(c.RemoveKeywords) == 0
+}
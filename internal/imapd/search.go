@@ -0,0 +1,271 @@
+package imapd
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+func (s *session) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.sel
+	s.staticCriteria(criteria)
+
+	data := imap.SearchData{UID: kind == imapserver.NumKindUID}
+	var seqSet imap.SeqSet
+	var uidSet imap.UIDSet
+	for i, e := range v.msgs {
+		if e.gone {
+			continue
+		}
+		seqNum := uint32(i) + 1
+		m := &match{s: s, e: e}
+		ok, err := m.search(seqNum, criteria)
+		if err != nil {
+			return nil, s.internalError("Failed to search messages", err)
+		}
+		if !ok {
+			continue
+		}
+
+		// The UIDs are kept for SEARCHRES whichever kind of number is
+		// asked for
+		uidSet.AddNum(e.uid)
+		num := seqNum
+		if kind == imapserver.NumKindUID {
+			num = uint32(e.uid)
+		} else {
+			seqSet.AddNum(seqNum)
+		}
+		if data.Min == 0 || num < data.Min {
+			data.Min = num
+		}
+		if num > data.Max {
+			data.Max = num
+		}
+		data.Count++
+	}
+	if kind == imapserver.NumKindUID {
+		data.All = uidSet
+	} else {
+		data.All = seqSet
+	}
+	if options.ReturnSave {
+		v.searchRes = uidSet
+	}
+	return &data, nil
+}
+
+// staticCriteria resolves the dynamic sequence sets in criteria. s.mu must
+// be held.
+func (s *session) staticCriteria(criteria *imap.SearchCriteria) {
+	seqNums := make([]imap.SeqSet, 0, len(criteria.SeqNum))
+	for _, seqSet := range criteria.SeqNum {
+		switch numSet := s.staticNumSet(seqSet).(type) {
+		case imap.SeqSet:
+			seqNums = append(seqNums, numSet)
+		case imap.UIDSet: // with SEARCHRES
+			criteria.UID = append(criteria.UID, numSet)
+		}
+	}
+	criteria.SeqNum = seqNums
+	for i, uidSet := range criteria.UID {
+		criteria.UID[i] = s.staticNumSet(uidSet).(imap.UIDSet)
+	}
+	for i := range criteria.Not {
+		s.staticCriteria(&criteria.Not[i])
+	}
+	for i := range criteria.Or {
+		for j := range criteria.Or[i] {
+			s.staticCriteria(&criteria.Or[i][j])
+		}
+	}
+}
+
+// match evaluates search criteria against a message, reading its content
+// only if they look at it.
+type match struct {
+	s   *session
+	e   *entry
+	raw []byte
+}
+
+func (m *match) content() ([]byte, error) {
+	if m.raw == nil {
+		raw, err := m.s.raw(m.e.id)
+		if err != nil {
+			return nil, err
+		}
+		m.raw = raw
+	}
+	return m.raw, nil
+}
+
+func (m *match) entity() (*gomessage.Entity, error) {
+	raw, err := m.content()
+	if err != nil {
+		return nil, err
+	}
+	e, _ := gomessage.Read(bytes.NewReader(raw))
+	if e == nil {
+		e, _ = gomessage.New(gomessage.Header{}, bytes.NewReader(nil))
+	}
+	return e, nil
+}
+
+func (m *match) search(seqNum uint32, criteria *imap.SearchCriteria) (bool, error) {
+	e := m.e
+	for _, seqSet := range criteria.SeqNum {
+		if !seqSet.Contains(seqNum) {
+			return false, nil
+		}
+	}
+	for _, uidSet := range criteria.UID {
+		if !uidSet.Contains(e.uid) {
+			return false, nil
+		}
+	}
+	if !matchDate(e.receivedAt, criteria.Since, criteria.Before) {
+		return false, nil
+	}
+	for _, f := range criteria.Flag {
+		if !hasFlag(e.allFlags(), f) {
+			return false, nil
+		}
+	}
+	for _, f := range criteria.NotFlag {
+		if hasFlag(e.allFlags(), f) {
+			return false, nil
+		}
+	}
+	if criteria.Larger != 0 && e.size <= criteria.Larger {
+		return false, nil
+	}
+	if criteria.Smaller != 0 && e.size >= criteria.Smaller {
+		return false, nil
+	}
+
+	if len(criteria.Header) > 0 || !criteria.SentSince.IsZero() || !criteria.SentBefore.IsZero() {
+		entity, err := m.entity()
+		if err != nil {
+			return false, err
+		}
+		header := mail.Header{Header: entity.Header}
+		for _, field := range criteria.Header {
+			if !matchHeaderFields(header.FieldsByKey(field.Key), field.Value) {
+				return false, nil
+			}
+		}
+		if !criteria.SentSince.IsZero() || !criteria.SentBefore.IsZero() {
+			t, err := header.Date()
+			if err != nil || !matchDate(t, criteria.SentSince, criteria.SentBefore) {
+				return false, nil
+			}
+		}
+	}
+	for _, text := range criteria.Text {
+		entity, err := m.entity()
+		if err != nil {
+			return false, err
+		}
+		if !matchEntity(entity, text, true) {
+			return false, nil
+		}
+	}
+	for _, body := range criteria.Body {
+		entity, err := m.entity()
+		if err != nil {
+			return false, err
+		}
+		if !matchEntity(entity, body, false) {
+			return false, nil
+		}
+	}
+
+	for i := range criteria.Not {
+		ok, err := m.search(seqNum, &criteria.Not[i])
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	for i := range criteria.Or {
+		ok, err := m.search(seqNum, &criteria.Or[i][0])
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			if ok, err = m.search(seqNum, &criteria.Or[i][1]); err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// matchDate reports whether t falls between since and before, by date
+// alone, as RFC 3501 compares dates without time zones.
+func matchDate(t, since, before time.Time) bool {
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+func matchHeaderFields(fields gomessage.HeaderFields, pattern string) bool {
+	if pattern == "" {
+		return fields.Len() > 0
+	}
+	pattern = strings.ToLower(pattern)
+	for fields.Next() {
+		v, _ := fields.Text()
+		if strings.Contains(strings.ToLower(v), pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchEntity reports whether the text parts of e, and its header if
+// includeHeader is set, contain pattern.
+func matchEntity(e *gomessage.Entity, pattern string, includeHeader bool) bool {
+	if pattern == "" {
+		return true
+	}
+	if includeHeader && matchHeaderFields(e.Header.Fields(), pattern) {
+		return true
+	}
+	if mr := e.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return false
+			}
+			if matchEntity(part, pattern, includeHeader) {
+				return true
+			}
+		}
+	}
+	t, _, err := e.Header.ContentType()
+	if err != nil {
+		t = "text/plain"
+	}
+	if !strings.HasPrefix(t, "text/") && !strings.HasPrefix(t, "message/") {
+		return false
+	}
+	buf, err := io.ReadAll(e.Body)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(bytes.ToLower(buf), bytes.ToLower([]byte(pattern)))
+}
@@ -0,0 +1,164 @@
+// Package imapd serves users' mail over IMAP4rev1 and IMAP4rev2, so that
+// desktop clients can read it. Labels are mailboxes: INBOX, the other
+// system labels and the user's own labels, nested by path. Users sign in
+// with their address and an API key or app password.
+//
+// UIDs are given to messages as they are found in a mailbox and are kept
+// in the database, so they stay the same across sessions. Changes made
+// elsewhere, such as mail delivered or labels changed through the API, are
+// found by polling.
+package imapd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/mailroom/internal/credentials"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// TLS modes of the listener.
+const (
+	TLSStartTLS = "starttls" // plain connections upgraded with STARTTLS, e.g. on port 143
+	TLSImplicit = "tls"      // TLS connections, e.g. on port 993
+	TLSNone     = "none"     // only behind a TLS proxy or on a trusted network
+)
+
+// DefaultPollInterval is how often changes are looked for while a client
+// idles.
+const DefaultPollInterval = 10 * time.Second
+
+// Config describes the IMAP listener.
+type Config struct {
+	Addr string
+	TLS  string // one of the TLS modes
+
+	// TLSConfig holds the server's certificate; it is unused with TLSNone.
+	TLSConfig *tls.Config
+}
+
+// ConfigFromEnv reads the listener configuration from the environment. It
+// returns false when IMAP_ADDR is unset and the listener is disabled.
+func ConfigFromEnv() (Config, bool, error) {
+	addr := os.Getenv("IMAP_ADDR")
+	if addr == "" {
+		return Config{}, false, nil
+	}
+
+	mode := strings.ToLower(os.Getenv("IMAP_TLS"))
+	switch mode {
+	case "":
+		mode = TLSStartTLS
+	case TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return Config{}, false, fmt.Errorf("invalid IMAP_TLS %q", mode)
+	}
+
+	cfg := Config{Addr: addr, TLS: mode}
+	if mode != TLSNone {
+		cert, err := tls.LoadX509KeyPair(os.Getenv("IMAP_TLS_CERT"), os.Getenv("IMAP_TLS_KEY"))
+		if err != nil {
+			return Config{}, false, fmt.Errorf("failed to load IMAP certificate: %w", err)
+		}
+		cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return cfg, true, nil
+}
+
+// Server is an IMAP listener over a mailstore.Store.
+type Server struct {
+	cfg    Config
+	store  *mailstore.Store
+	creds  *credentials.Service
+	labels *labels.Service
+	imap   *imapserver.Server
+
+	// pollInterval is how often idling sessions look for changes.
+	pollInterval time.Duration
+}
+
+// NewServer creates an IMAP listener for cfg. Users sign in with the
+// credentials creds checks.
+func NewServer(cfg Config, store *mailstore.Store, creds *credentials.Service) *Server {
+	s := &Server{
+		cfg:          cfg,
+		store:        store,
+		creds:        creds,
+		labels:       labels.New(store.DB()),
+		pollInterval: DefaultPollInterval,
+	}
+	opts := &imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return newSession(s), nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:    {},
+			imap.CapIMAP4rev2:    {},
+			imap.CapNamespace:    {},
+			imap.CapUIDPlus:      {},
+			imap.CapESearch:      {},
+			imap.CapSearchRes:    {},
+			imap.CapListExtended: {},
+			imap.CapListStatus:   {},
+			imap.CapMove:         {},
+			imap.CapSpecialUse:   {},
+			imap.CapStatusSize:   {},
+		},
+		Logger: errorLog{},
+	}
+	switch cfg.TLS {
+	case TLSNone:
+		// Secrets cross the network in the clear unless a proxy in front
+		// terminates TLS
+		opts.InsecureAuth = true
+	case TLSStartTLS:
+		opts.TLSConfig = cfg.TLSConfig
+	}
+	s.imap = imapserver.New(opts)
+	return s
+}
+
+// ListenAndServe listens on the configured address and serves until
+// Shutdown is called, after which it returns nil.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.Addr, err)
+	}
+	if s.cfg.TLS == TLSImplicit {
+		ln = tls.NewListener(ln, s.cfg.TLSConfig)
+	}
+	return s.imap.Serve(ln)
+}
+
+// Shutdown stops the listener and closes client connections. IMAP clients
+// reconnect on their own, and commands write nothing that isn't committed,
+// so connections aren't drained.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.imap.Close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// errorLog adapts go-imap's logger to the structured logger.
+type errorLog struct{}
+
+func (errorLog) Printf(format string, v ...interface{}) {
+	logger.Error(context.Background(), "IMAP server error", "error", fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,714 @@
+package imapd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/credentials"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+// session is one client connection.
+type session struct {
+	srv *Server
+	ctx context.Context
+
+	userID string // empty until the client signs in
+
+	// mu guards the selected mailbox, which IDLE polls from its own
+	// goroutine
+	mu  sync.Mutex
+	sel *view
+}
+
+var _ imapserver.SessionIMAP4rev2 = (*session)(nil)
+
+// view is the selected mailbox as the client knows it.
+type view struct {
+	path        string // the label's path
+	readOnly    bool
+	uidValidity uint32
+	uidNext     imap.UID
+	msgs        []*entry
+	searchRes   imap.UIDSet
+}
+
+func newSession(srv *Server) *session {
+	return &session{srv: srv, ctx: context.Background()}
+}
+
+// internalError logs err and returns the error the client is given for it.
+func (s *session) internalError(msg string, err error) error {
+	var imapErr *imap.Error
+	if errors.As(err, &imapErr) {
+		return err
+	}
+	metrics.Errors.WithLabelValues("imap_session").Inc()
+	logger.Error(s.ctx, msg, "user_id", s.userID, "error", err)
+	return &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeServerBug,
+		Text: msg,
+	}
+}
+
+func (s *session) Close() error {
+	return nil
+}
+
+func (s *session) Login(username, password string) error {
+	userID, err := s.srv.creds.Authenticate(s.ctx, username, password)
+	if err != nil {
+		if errors.Is(err, credentials.ErrAuthFailed) {
+			return imapserver.ErrAuthFailed
+		}
+		return s.internalError("Failed to sign in", err)
+	}
+	s.userID = userID
+	return nil
+}
+
+func (s *session) Namespace() (*imap.NamespaceData, error) {
+	return &imap.NamespaceData{
+		Personal: []imap.NamespaceDescriptor{{Delim: delim}},
+	}, nil
+}
+
+func (s *session) List(w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+	if len(patterns) == 0 {
+		return w.WriteList(&imap.ListData{
+			Attrs: []imap.MailboxAttr{imap.MailboxAttrNoSelect},
+			Delim: delim,
+		})
+	}
+	list, err := s.srv.labels.List(s.ctx, s.userID)
+	if err != nil {
+		return s.internalError("Failed to list mailboxes", err)
+	}
+	for _, l := range list {
+		name := mailboxName(l.Path)
+		match := false
+		for _, pattern := range patterns {
+			if imapserver.MatchList(name, delim, ref, pattern) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+
+		// Every mailbox is subscribed
+		data := imap.ListData{
+			Mailbox: name,
+			Delim:   delim,
+			Attrs:   []imap.MailboxAttr{imap.MailboxAttrSubscribed, imap.MailboxAttrHasNoChildren},
+		}
+		for _, child := range list {
+			if strings.HasPrefix(child.Path, l.Path+labels.Separator) {
+				data.Attrs[1] = imap.MailboxAttrHasChildren
+				break
+			}
+		}
+		if attr := specialUse(l.Path); attr != "" {
+			data.Attrs = append(data.Attrs, attr)
+		} else if options.SelectSpecialUse {
+			continue
+		}
+		if options.ReturnStatus != nil {
+			status, err := s.status(l.Path, options.ReturnStatus)
+			if err != nil {
+				return err
+			}
+			data.Status = status
+		}
+		if err := w.WriteList(&data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) Status(name string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	l, err := s.label(name)
+	if err != nil {
+		return nil, s.internalError("Failed to find mailbox", err)
+	}
+	return s.status(l.Path, options)
+}
+
+func (s *session) status(path string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	snap, err := s.snapshot(path)
+	if err != nil {
+		return nil, s.internalError("Failed to read mailbox", err)
+	}
+	data := imap.StatusData{Mailbox: mailboxName(path)}
+	if options.NumMessages {
+		n := uint32(len(snap.msgs))
+		data.NumMessages = &n
+	}
+	if options.UIDNext {
+		data.UIDNext = snap.uidNext
+	}
+	if options.UIDValidity {
+		data.UIDValidity = snap.uidValidity
+	}
+	if options.NumUnseen {
+		var n uint32
+		for _, e := range snap.msgs {
+			if !hasFlag(e.flags, imap.FlagSeen) {
+				n++
+			}
+		}
+		data.NumUnseen = &n
+	}
+	if options.NumDeleted {
+		// \Deleted isn't kept between sessions
+		var n uint32
+		data.NumDeleted = &n
+	}
+	if options.Size {
+		var size int64
+		for _, e := range snap.msgs {
+			size += e.size
+		}
+		data.Size = &size
+	}
+	return &data, nil
+}
+
+func (s *session) Select(name string, options *imap.SelectOptions) (*imap.SelectData, error) {
+	l, err := s.label(name)
+	if err != nil {
+		return nil, s.internalError("Failed to find mailbox", err)
+	}
+	snap, err := s.snapshot(l.Path)
+	if err != nil {
+		return nil, s.internalError("Failed to read mailbox", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sel = &view{
+		path:        l.Path,
+		readOnly:    options.ReadOnly,
+		uidValidity: snap.uidValidity,
+		uidNext:     snap.uidNext,
+		msgs:        snap.msgs,
+	}
+	permanent := []imap.Flag{imap.FlagSeen, imap.FlagFlagged, imap.FlagAnswered, imap.FlagDeleted, flags.KeywordImportant, imap.FlagWildcard}
+	if options.ReadOnly {
+		permanent = nil
+	}
+	return &imap.SelectData{
+		Flags:          []imap.Flag{imap.FlagSeen, imap.FlagFlagged, imap.FlagAnswered, imap.FlagDeleted, flags.KeywordImportant},
+		PermanentFlags: permanent,
+		NumMessages:    uint32(len(snap.msgs)),
+		UIDNext:        snap.uidNext,
+		UIDValidity:    snap.uidValidity,
+	}, nil
+}
+
+func (s *session) Unselect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sel = nil
+	return nil
+}
+
+func (s *session) Create(name string, options *imap.CreateOptions) error {
+	name = strings.TrimSuffix(name, string(delim))
+	if _, err := s.srv.labels.Create(s.ctx, s.userID, name, ""); err != nil {
+		return s.labelError("Failed to create mailbox", err)
+	}
+	return nil
+}
+
+func (s *session) Delete(name string) error {
+	l, err := s.label(name)
+	if err != nil {
+		return s.internalError("Failed to find mailbox", err)
+	}
+	paths, err := s.nested(l.Path)
+	if err != nil {
+		return err
+	}
+	if err := s.srv.labels.Delete(s.ctx, s.userID, l.ID); err != nil {
+		return s.labelError("Failed to delete mailbox", err)
+	}
+	return s.clearUIDs(paths)
+}
+
+func (s *session) Rename(oldName, newName string) error {
+	l, err := s.label(oldName)
+	if err != nil {
+		return s.internalError("Failed to find mailbox", err)
+	}
+	paths, err := s.nested(l.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := s.srv.labels.Update(s.ctx, s.userID, l.ID, newName, l.Color); err != nil {
+		return s.labelError("Failed to rename mailbox", err)
+	}
+	return s.clearUIDs(paths)
+}
+
+// nested returns path and the paths of the labels nested under it.
+func (s *session) nested(path string) ([]string, error) {
+	list, err := s.srv.labels.List(s.ctx, s.userID)
+	if err != nil {
+		return nil, s.internalError("Failed to list mailboxes", err)
+	}
+	paths := []string{path}
+	for _, l := range list {
+		if strings.HasPrefix(l.Path, path+labels.Separator) {
+			paths = append(paths, l.Path)
+		}
+	}
+	return paths, nil
+}
+
+// clearUIDs forgets the UIDs given in the mailboxes of the labels at paths,
+// which have gone. Their states are kept, so UIDs go on increasing should
+// mailboxes be made again under the same names.
+func (s *session) clearUIDs(paths []string) error {
+	q := s.srv.store.DB().Queries()
+	for _, p := range paths {
+		if err := q.DeleteMailboxUIDs(s.ctx, schema.DeleteMailboxUIDsParams{UserID: s.userID, Mailbox: p}); err != nil {
+			return s.internalError("Failed to clear mailbox", err)
+		}
+	}
+	return nil
+}
+
+// labelError maps label errors onto IMAP responses.
+func (s *session) labelError(msg string, err error) error {
+	switch {
+	case errors.Is(err, labels.ErrLabelExists):
+		return &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeAlreadyExists, Text: "Mailbox already exists"}
+	case errors.Is(err, labels.ErrSystemLabel):
+		return &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeNoPerm, Text: "System mailboxes can't be changed"}
+	case errors.Is(err, labels.ErrInvalidLabel):
+		return &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeCannot, Text: err.Error()}
+	case errors.Is(err, labels.ErrLabelNotFound):
+		return errNoMailbox
+	}
+	return s.internalError(msg, err)
+}
+
+// Subscribe and Unsubscribe do nothing, as every mailbox is subscribed.
+func (s *session) Subscribe(name string) error {
+	if _, err := s.label(name); err != nil {
+		return s.internalError("Failed to find mailbox", err)
+	}
+	return nil
+}
+
+func (s *session) Unsubscribe(name string) error {
+	return nil
+}
+
+func (s *session) Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	l, err := s.label(mailbox)
+	if err != nil {
+		if errors.Is(err, errNoMailbox) {
+			return nil, &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeTryCreate, Text: "No such mailbox"}
+		}
+		return nil, s.internalError("Failed to find mailbox", err)
+	}
+	if r.Size() > s.srv.store.MaxMessageSize() {
+		return nil, &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeTooBig, Text: "Message is too large"}
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	c := flagChange(nil, options.Flags)
+
+	d := mailstore.Delivery{
+		UserID:     s.userID,
+		Raw:        buf.Bytes(),
+		ReceivedAt: options.Time,
+		Outgoing:   true,
+		Tx: func(ctx context.Context, q *schema.Queries, id string) error {
+			if l.Path != labels.Inbox {
+				// New messages are in the Inbox until taken out of it
+				if err := labels.Remove(ctx, q, s.userID, id, labels.Inbox); err != nil {
+					return err
+				}
+				if err := labels.Add(ctx, q, s.userID, id, l.Path); err != nil {
+					return err
+				}
+			}
+			if !emptyChange(c) {
+				return flags.ApplyTx(ctx, q, s.userID, id, c)
+			}
+			return nil
+		},
+	}
+	id, err := s.srv.store.Deliver(s.ctx, d)
+	if err != nil {
+		switch {
+		case errors.Is(err, mailstore.ErrMessageTooLarge):
+			return nil, &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeTooBig, Text: "Message is too large"}
+		case errors.Is(err, mailstore.ErrMalformedMessage), errors.Is(err, mailstore.ErrEmptyMessage), errors.Is(err, flags.ErrInvalidChange):
+			return nil, &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeCannot, Text: err.Error()}
+		}
+		return nil, s.internalError("Failed to store message", err)
+	}
+
+	snap, err := s.snapshot(l.Path)
+	if err != nil {
+		return nil, s.internalError("Failed to read mailbox", err)
+	}
+	data := &imap.AppendData{UIDValidity: snap.uidValidity}
+	for _, e := range snap.msgs {
+		if e.id == id {
+			data.UID = e.uid
+		}
+	}
+	return data, nil
+}
+
+func (s *session) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sel == nil {
+		return nil
+	}
+	return s.refresh(w, allowExpunge)
+}
+
+func (s *session) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
+	ticker := time.NewTicker(s.srv.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := s.Poll(w, true); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// updateWriter is where refresh sends the changes it finds. ExpungeWriter
+// and MoveWriter send only expunges.
+type updateWriter interface {
+	WriteExpunge(seqNum uint32) error
+}
+
+// refresh brings the selected mailbox up to date, telling the client what
+// changed. Messages that have left are expunged only if allowExpunge is
+// set; until then they stay in the view, marked gone. s.mu must be held.
+func (s *session) refresh(w updateWriter, allowExpunge bool) error {
+	v := s.sel
+	snap, err := s.snapshot(v.path)
+	if err != nil {
+		return s.internalError("Failed to read mailbox", err)
+	}
+	byUID := make(map[imap.UID]*entry, len(snap.msgs))
+	for _, e := range snap.msgs {
+		byUID[e.uid] = e
+	}
+
+	// Expunges go from the end, so that the sequence numbers of the
+	// messages yet to go stay the same
+	for i := len(v.msgs) - 1; i >= 0; i-- {
+		e := v.msgs[i]
+		if _, ok := byUID[e.uid]; ok {
+			e.gone = false
+			continue
+		}
+		if !allowExpunge {
+			e.gone = true
+			continue
+		}
+		if err := w.WriteExpunge(uint32(i) + 1); err != nil {
+			return err
+		}
+		v.msgs = append(v.msgs[:i], v.msgs[i+1:]...)
+	}
+
+	uw, _ := w.(*imapserver.UpdateWriter)
+	var last imap.UID
+	for i, e := range v.msgs {
+		last = e.uid
+		current, ok := byUID[e.uid]
+		if !ok || equalFlags(current.flags, e.flags) {
+			continue
+		}
+		e.flags = current.flags
+		if uw != nil {
+			if err := uw.WriteMessageFlags(uint32(i)+1, e.uid, e.allFlags()); err != nil {
+				return err
+			}
+		}
+	}
+	n := len(v.msgs)
+	for _, e := range snap.msgs {
+		if e.uid > last {
+			v.msgs = append(v.msgs, e)
+		}
+	}
+	v.uidNext = snap.uidNext
+	if len(v.msgs) > n && uw != nil {
+		return uw.WriteNumMessages(uint32(len(v.msgs)))
+	}
+	return nil
+}
+
+func equalFlags(a, b []imap.Flag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasFlag(list []imap.Flag, f imap.Flag) bool {
+	for _, g := range list {
+		if sameFlag(g, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFlag reports whether a and b are the same flag; flags and keywords
+// are named in any case.
+func sameFlag(a, b imap.Flag) bool {
+	return strings.EqualFold(string(a), string(b))
+}
+
+// errReadOnly answers commands that would change a mailbox selected with
+// EXAMINE.
+var errReadOnly = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Text: "Mailbox is read-only",
+}
+
+func (s *session) Expunge(w *imapserver.ExpungeWriter, uids *imap.UIDSet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.sel
+	if v.readOnly {
+		return errReadOnly
+	}
+	var expunged []*entry
+	for _, e := range v.msgs {
+		if e.deleted && !e.gone && (uids == nil || uids.Contains(e.uid)) {
+			expunged = append(expunged, e)
+		}
+	}
+	if len(expunged) > 0 {
+		err := s.srv.store.DB().WithTx(s.ctx, func(q *schema.Queries) error {
+			for _, e := range expunged {
+				if err := s.expunge(q, v.path, e.id); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return s.internalError("Failed to expunge messages", err)
+		}
+	}
+	return s.refresh(w, true)
+}
+
+// expunge takes one of the user's messages out of the mailbox of the label
+// at path: messages in Trash and Spam are deleted; those in Sent and
+// Archive are moved to Trash; the others lose the label, so that messages
+// expunged from the Inbox are archived.
+func (s *session) expunge(q *schema.Queries, path, id string) error {
+	switch path {
+	case labels.Trash, labels.Spam:
+		deleted, err := database.DeleteMessageTx(s.ctx, q, s.userID, id)
+		if err != nil || !deleted {
+			return err
+		}
+		return webhook.PublishTx(s.ctx, q, s.userID, webhook.EventMessageDeleted, webhook.MessageDeleted{MessageID: id})
+	case labels.Sent:
+		if err := labels.Remove(s.ctx, q, s.userID, id, labels.Sent); err != nil {
+			return err
+		}
+		fallthrough
+	case labels.Archive:
+		if err := labels.Add(s.ctx, q, s.userID, id, labels.Trash); err != nil {
+			return err
+		}
+		return webhook.PublishTx(s.ctx, q, s.userID, webhook.EventMessageLabeled, webhook.MessageLabeled{MessageID: id, Labels: []string{labels.Trash}})
+	}
+	return labels.Remove(s.ctx, q, s.userID, id, path)
+}
+
+func (s *session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.copy(numSet, dest, false)
+}
+
+func (s *session) Move(w *imapserver.MoveWriter, numSet imap.NumSet, dest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sel.readOnly {
+		return errReadOnly
+	}
+	data, err := s.copy(numSet, dest, true)
+	if err != nil {
+		return err
+	}
+	if err := w.WriteCopyData(data); err != nil {
+		return err
+	}
+	return s.refresh(w, true)
+}
+
+// copy puts the label of the mailbox dest on messages in the selected
+// mailbox and, to move them, takes the label of the selected mailbox off
+// them. s.mu must be held.
+func (s *session) copy(numSet imap.NumSet, dest string, move bool) (*imap.CopyData, error) {
+	v := s.sel
+	l, err := s.label(dest)
+	if err != nil {
+		if errors.Is(err, errNoMailbox) {
+			return nil, &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeTryCreate, Text: "No such mailbox"}
+		}
+		return nil, s.internalError("Failed to find mailbox", err)
+	}
+	if l.Path == v.path {
+		return nil, &imap.Error{Type: imap.StatusResponseTypeNo, Text: "Source and destination mailboxes are identical"}
+	}
+
+	var copied []*entry
+	s.forEach(numSet, func(seqNum uint32, e *entry) {
+		if !e.gone {
+			copied = append(copied, e)
+		}
+	})
+	err = s.srv.store.DB().WithTx(s.ctx, func(q *schema.Queries) error {
+		for _, e := range copied {
+			// Messages leave Archive by going where it excludes, and the
+			// label is taken off first, so that moving a message out of
+			// Trash into the Inbox leaves it there
+			if move && v.path != labels.Archive {
+				if err := labels.Remove(s.ctx, q, s.userID, e.id, v.path); err != nil {
+					return err
+				}
+			}
+			if err := labels.Add(s.ctx, q, s.userID, e.id, l.Path); err != nil {
+				return err
+			}
+			err := webhook.PublishTx(s.ctx, q, s.userID, webhook.EventMessageLabeled, webhook.MessageLabeled{MessageID: e.id, Labels: []string{l.Path}})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.internalError("Failed to copy messages", err)
+	}
+
+	snap, err := s.snapshot(l.Path)
+	if err != nil {
+		return nil, s.internalError("Failed to read mailbox", err)
+	}
+	destUIDs := make(map[string]imap.UID, len(snap.msgs))
+	for _, e := range snap.msgs {
+		destUIDs[e.id] = e.uid
+	}
+	// UIDPLUS pairs source and destination UIDs in order
+	sort.Slice(copied, func(i, j int) bool { return copied[i].uid < copied[j].uid })
+	data := &imap.CopyData{UIDValidity: snap.uidValidity}
+	for _, e := range copied {
+		if uid, ok := destUIDs[e.id]; ok {
+			data.SourceUIDs.AddNum(e.uid)
+			data.DestUIDs.AddNum(uid)
+		}
+	}
+	return data, nil
+}
+
+// forEach calls f with the messages of the selected mailbox in numSet, in
+// order. s.mu must be held.
+func (s *session) forEach(numSet imap.NumSet, f func(seqNum uint32, e *entry)) {
+	v := s.sel
+	numSet = s.staticNumSet(numSet)
+	for i, e := range v.msgs {
+		seqNum := uint32(i) + 1
+		var contains bool
+		switch numSet := numSet.(type) {
+		case imap.SeqSet:
+			contains = numSet.Contains(seqNum)
+		case imap.UIDSet:
+			contains = numSet.Contains(e.uid)
+		}
+		if contains {
+			f(seqNum, e)
+		}
+	}
+}
+
+// staticNumSet resolves "*", the largest sequence number or UID, and the
+// SEARCHRES "$", the result of the last saved search, in numSet. s.mu must
+// be held.
+func (s *session) staticNumSet(numSet imap.NumSet) imap.NumSet {
+	v := s.sel
+	if imap.IsSearchRes(numSet) {
+		return v.searchRes
+	}
+	switch numSet := numSet.(type) {
+	case imap.SeqSet:
+		max := uint32(len(v.msgs))
+		for i := range numSet {
+			r := &numSet[i]
+			staticRange(&r.Start, &r.Stop, max)
+		}
+	case imap.UIDSet:
+		max := uint32(v.uidNext) - 1
+		for i := range numSet {
+			r := &numSet[i]
+			staticRange((*uint32)(&r.Start), (*uint32)(&r.Stop), max)
+		}
+	}
+	return numSet
+}
+
+func staticRange(start, stop *uint32, max uint32) {
+	dyn := false
+	if *start == 0 {
+		*start = max
+		dyn = true
+	}
+	if *stop == 0 {
+		*stop = max
+		dyn = true
+	}
+	if dyn && *start > *stop {
+		*start, *stop = *stop, *start
+	}
+}
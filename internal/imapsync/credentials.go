@@ -0,0 +1,64 @@
+package imapsync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Predefined errors for the imapsync package
+var (
+	ErrMissingEncryptionKey = errors.New("SYNC_ENCRYPTION_KEY is not set")
+	ErrInvalidEncryptionKey = errors.New("SYNC_ENCRYPTION_KEY must be 32 base64-encoded bytes")
+	ErrInvalidAccount       = errors.New("invalid IMAP account")
+	ErrAccountNotFound      = errors.New("IMAP account not found")
+)
+
+// sealer encrypts remote account passwords at rest with AES-256-GCM.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(encodedKey string) (*sealer, error) {
+	if encodedKey == "" {
+		return nil, ErrMissingEncryptionKey
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal returns nonce || ciphertext.
+func (s *sealer) seal(plaintext string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return s.aead.Seal(nonce, nonce, []byte(plaintext), nil), nil
+}
+
+func (s *sealer) open(sealed []byte) (string, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("sealed password is truncated")
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt password: %w", err)
+	}
+	return string(plaintext), nil
+}
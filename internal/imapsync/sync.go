@@ -0,0 +1,460 @@
+package imapsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+// fetchBatchSize is the number of message bodies requested per UID FETCH.
+const fetchBatchSize = 50
+
+// folderSync is the sync of a single selected remote folder.
+type folderSync struct {
+	worker *Worker
+	acct   schema.ImapAccount
+	folder string
+
+	uidValidity   int64
+	highestModSeq int64
+}
+
+// removal is a message imported from a remote folder it is no longer in.
+type removal struct {
+	schema.DeleteIMAPMessageParams
+	messageID string
+}
+
+func (w *Worker) syncAccount(ctx context.Context, acct schema.ImapAccount) error {
+	password, err := w.sealer.open(acct.Password)
+	if err != nil {
+		return err
+	}
+
+	c, err := w.dial(ctx, accountAddr(acct), acct.Security)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", acct.Host, err)
+	}
+	defer c.Close()
+
+	// imapclient has no context support; closing the connection unblocks any
+	// pending command when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	if err := c.Login(acct.Username, password).Wait(); err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+
+	mailboxes, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		return fmt.Errorf("failed to list folders: %w", err)
+	}
+
+	var removed []removal
+	for _, mbox := range mailboxes {
+		if slices.Contains(mbox.Attrs, imap.MailboxAttrNoSelect) || slices.Contains(mbox.Attrs, imap.MailboxAttrNonExistent) {
+			continue
+		}
+		r, err := w.syncFolder(ctx, c, acct, mbox.Mailbox)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("folder %q: %w", mbox.Mailbox, err)
+		}
+		removed = append(removed, r...)
+	}
+
+	// Removals wait until every folder was synced, as a message moved
+	// between folders is only known to be still there once the folder it
+	// moved to was
+	if err := w.remove(ctx, acct, removed); err != nil {
+		return err
+	}
+
+	// Errors on logout don't affect what was imported
+	_ = c.Logout().Wait()
+	return nil
+}
+
+// syncFolder imports every message in folder with a UID at or above the
+// stored UIDNEXT. A changed UIDVALIDITY invalidates all stored UIDs, so the
+// folder is rescanned; messages already imported are then matched by
+// Message-ID rather than stored twice. Otherwise the messages imported
+// before are reconciled with the folder first, unless CONDSTORE tells that
+// nothing changed. It returns the imported messages no longer in the folder.
+func (w *Worker) syncFolder(ctx context.Context, c *imapclient.Client, acct schema.ImapAccount, folder string) ([]removal, error) {
+	condStore := c.Caps().Has(imap.CapCondStore)
+	sel, err := c.Select(folder, &imap.SelectOptions{ReadOnly: true, CondStore: condStore}).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("failed to select: %w", err)
+	}
+
+	fs := &folderSync{
+		worker:        w,
+		acct:          acct,
+		folder:        folder,
+		uidValidity:   int64(sel.UIDValidity),
+		highestModSeq: int64(sel.HighestModSeq),
+	}
+
+	uidNext := int64(1)
+	var removed []removal
+	state, err := w.queries.GetIMAPFolderState(ctx, schema.GetIMAPFolderStateParams{
+		AccountID: acct.ID,
+		Folder:    folder,
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return nil, fmt.Errorf("failed to get folder state: %w", err)
+	case state.UidValidity != fs.uidValidity:
+		logger.Warn(ctx, "IMAP UIDVALIDITY changed, rescanning folder",
+			"account_id", acct.ID,
+			"folder", folder,
+			"old_uid_validity", state.UidValidity,
+			"new_uid_validity", fs.uidValidity,
+		)
+		err := w.queries.DeleteIMAPMessagesForFolder(ctx, schema.DeleteIMAPMessagesForFolderParams{
+			AccountID: acct.ID,
+			Folder:    folder,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to reset folder: %w", err)
+		}
+	default:
+		uidNext = state.UidNext
+		// Without CONDSTORE nothing tells whether messages were expunged,
+		// so the folder is always reconciled
+		modSeqChanged := condStore && fs.highestModSeq != state.HighestModseq
+		if !condStore || modSeqChanged {
+			removed, err = fs.reconcile(ctx, c, uidNext, state.HighestModseq, condStore)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if sel.UIDNext != 0 && int64(sel.UIDNext) == uidNext && !modSeqChanged {
+			return removed, nil
+		}
+	}
+
+	if sel.NumMessages > 0 {
+		last, err := fs.importFrom(ctx, c, uidNext)
+		if err != nil {
+			return nil, err
+		}
+		uidNext = max(uidNext, last+1)
+	}
+	if int64(sel.UIDNext) > uidNext {
+		uidNext = int64(sel.UIDNext)
+	}
+
+	if err := fs.advance(ctx, w.queries, uidNext); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// reconcile finds the messages imported from the folder below uidNext that
+// were expunged from it since and, with CONDSTORE, copies the flags of
+// those changed since modSeq.
+func (fs *folderSync) reconcile(ctx context.Context, c *imapclient.Client, uidNext, modSeq int64, condStore bool) ([]removal, error) {
+	w := fs.worker
+	imported, err := w.queries.ListIMAPMessages(ctx, schema.ListIMAPMessagesParams{
+		AccountID:   fs.acct.ID,
+		Folder:      fs.folder,
+		UidValidity: fs.uidValidity,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list imported messages: %w", err)
+	}
+	if len(imported) == 0 {
+		return nil, nil
+	}
+
+	data, err := c.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UIDs: %w", err)
+	}
+	present := map[int64]bool{}
+	for _, uid := range data.AllUIDs() {
+		present[int64(uid)] = true
+	}
+	var removed []removal
+	byUID := map[int64]string{}
+	for _, m := range imported {
+		if present[m.Uid] {
+			byUID[m.Uid] = m.MessageID
+			continue
+		}
+		removed = append(removed, removal{
+			DeleteIMAPMessageParams: schema.DeleteIMAPMessageParams{
+				AccountID:   fs.acct.ID,
+				Folder:      fs.folder,
+				UidValidity: fs.uidValidity,
+				Uid:         m.Uid,
+			},
+			messageID: m.MessageID,
+		})
+	}
+
+	if !condStore || len(byUID) == 0 {
+		return removed, nil
+	}
+	changed, err := c.Fetch(imap.UIDSet{{Start: 1, Stop: imap.UID(uidNext - 1)}}, &imap.FetchOptions{
+		UID:          true,
+		Flags:        true,
+		ChangedSince: uint64(modSeq),
+	}).Collect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch flags: %w", err)
+	}
+	err = w.store.DB().WithTx(ctx, func(q *schema.Queries) error {
+		for _, msg := range changed {
+			id, ok := byUID[int64(msg.UID)]
+			if !ok {
+				continue
+			}
+			if err := flags.ApplyTx(ctx, q, fs.acct.UserID, id, flagChange(msg.Flags)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync flags: %w", err)
+	}
+	return removed, nil
+}
+
+// flagChange sets the flags of a message to the remote flags of one.
+func flagChange(remote []imap.Flag) flags.Change {
+	read := slices.Contains(remote, imap.FlagSeen)
+	starred := slices.Contains(remote, imap.FlagFlagged)
+	answered := slices.Contains(remote, imap.FlagAnswered)
+	return flags.Change{Read: &read, Starred: &starred, Answered: &answered}
+}
+
+// remove forgets the imported messages of removed in the folders they are
+// no longer in, and moves those no longer in any folder to the Trash.
+func (w *Worker) remove(ctx context.Context, acct schema.ImapAccount, removed []removal) error {
+	if len(removed) == 0 {
+		return nil
+	}
+	err := w.store.DB().WithTx(ctx, func(q *schema.Queries) error {
+		for _, r := range removed {
+			if err := q.DeleteIMAPMessage(ctx, r.DeleteIMAPMessageParams); err != nil {
+				return err
+			}
+		}
+		for _, r := range removed {
+			n, err := q.CountIMAPMessagesByMessageID(ctx, r.messageID)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				continue
+			}
+			// The message may have been deleted here in the meantime
+			if _, err := q.GetMessage(ctx, schema.GetMessageParams{ID: r.messageID, UserID: acct.UserID}); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					continue
+				}
+				return err
+			}
+			if err := labels.Add(ctx, q, acct.UserID, r.messageID, labels.Trash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove expunged messages: %w", err)
+	}
+	return nil
+}
+
+// importFrom imports every message with a UID of at least uidNext and returns
+// the highest UID seen.
+func (fs *folderSync) importFrom(ctx context.Context, c *imapclient.Client, uidNext int64) (int64, error) {
+	// "n:*" always matches the highest UID in the folder, even when it is
+	// below n, so the results are filtered again
+	uidSet := imap.UIDSet{{Start: imap.UID(uidNext), Stop: 0}}
+	msgs, err := c.Fetch(uidSet, &imap.FetchOptions{UID: true, RFC822Size: true}).Collect()
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch UIDs: %w", err)
+	}
+
+	maxSize := fs.worker.store.MaxMessageSize()
+	var pending []imap.UID
+	last := uidNext - 1
+	for _, msg := range msgs {
+		if int64(msg.UID) < uidNext {
+			continue
+		}
+		if msg.RFC822Size > maxSize {
+			metrics.Errors.WithLabelValues("imap_sync_message_too_large").Inc()
+			logger.Warn(ctx, "Skipping oversized IMAP message",
+				"account_id", fs.acct.ID,
+				"folder", fs.folder,
+				"uid", msg.UID,
+				"size", msg.RFC822Size,
+			)
+			continue
+		}
+		pending = append(pending, msg.UID)
+	}
+	slices.Sort(pending)
+
+	for batch := range slices.Chunk(pending, fetchBatchSize) {
+		fetched, err := c.Fetch(imap.UIDSetNum(batch...), &imap.FetchOptions{
+			UID:          true,
+			Flags:        true,
+			InternalDate: true,
+			BodySection:  []*imap.FetchItemBodySection{{Peek: true}},
+		}).Collect()
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		slices.SortFunc(fetched, func(a, b *imapclient.FetchMessageBuffer) int {
+			return int(int64(a.UID) - int64(b.UID))
+		})
+
+		for _, msg := range fetched {
+			if len(msg.BodySection) == 0 {
+				continue
+			}
+			if err := fs.importMessage(ctx, int64(msg.UID), msg.BodySection[0].Bytes, msg.InternalDate, msg.Flags); err != nil {
+				return 0, err
+			}
+			last = max(last, int64(msg.UID))
+		}
+	}
+
+	for _, msg := range msgs {
+		last = max(last, int64(msg.UID))
+	}
+	return last, nil
+}
+
+// importMessage stores one remote message with its remote flags, unless it
+// was imported before (under this UID or, from another folder or sync,
+// under its Message-ID). The folder position advances in the same
+// transaction.
+func (fs *folderSync) importMessage(ctx context.Context, uid int64, raw []byte, internalDate time.Time, remote []imap.Flag) error {
+	w := fs.worker
+	n, err := w.queries.HasIMAPMessage(ctx, schema.HasIMAPMessageParams{
+		AccountID:   fs.acct.ID,
+		Folder:      fs.folder,
+		UidValidity: fs.uidValidity,
+		Uid:         uid,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check imported messages: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	record := func(ctx context.Context, q *schema.Queries, messageID string) error {
+		err := q.InsertIMAPMessage(ctx, schema.InsertIMAPMessageParams{
+			AccountID:   fs.acct.ID,
+			Folder:      fs.folder,
+			UidValidity: fs.uidValidity,
+			Uid:         uid,
+			MessageID:   messageID,
+		})
+		if err != nil {
+			return err
+		}
+		return fs.advance(ctx, q, uid+1)
+	}
+
+	if existing, ok, err := fs.findExisting(ctx, raw); err != nil {
+		return err
+	} else if ok {
+		return w.store.DB().WithTx(ctx, func(q *schema.Queries) error {
+			return record(ctx, q, existing)
+		})
+	}
+
+	_, err = w.store.Deliver(ctx, mailstore.Delivery{
+		UserID:     fs.acct.UserID,
+		Raw:        raw,
+		ReceivedAt: internalDate,
+		Tx: func(ctx context.Context, q *schema.Queries, messageID string) error {
+			if err := flags.ApplyTx(ctx, q, fs.acct.UserID, messageID, flagChange(remote)); err != nil {
+				return err
+			}
+			return record(ctx, q, messageID)
+		},
+	})
+	var parseErr *mailstore.ParseError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &parseErr), errors.Is(err, mailstore.ErrEmptyMessage), errors.Is(err, mailstore.ErrMessageTooLarge):
+		// Retrying won't help; skip past it so it doesn't block the folder
+		metrics.Errors.WithLabelValues("imap_sync_message_rejected").Inc()
+		logger.Warn(ctx, "Skipping IMAP message that could not be stored",
+			"account_id", fs.acct.ID,
+			"folder", fs.folder,
+			"uid", uid,
+			"error", err,
+		)
+		return fs.advance(ctx, w.queries, uid+1)
+	default:
+		return fmt.Errorf("failed to store message uid %d: %w", uid, err)
+	}
+}
+
+// findExisting looks up a message the user already has with the same
+// Message-ID as raw.
+func (fs *folderSync) findExisting(ctx context.Context, raw []byte) (string, bool, error) {
+	m, err := mime.Parse(raw)
+	if err != nil || m.MessageID == "" {
+		return "", false, nil
+	}
+	msgID := m.MessageID
+
+	existing, err := fs.worker.queries.GetMessageByInternetMessageID(ctx, schema.GetMessageByInternetMessageIDParams{
+		UserID:            fs.acct.UserID,
+		InternetMessageID: msgID,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to look up message: %w", err)
+	}
+	return existing.ID, true, nil
+}
+
+// advance persists the folder position so a restart resumes from uidNext.
+func (fs *folderSync) advance(ctx context.Context, q *schema.Queries, uidNext int64) error {
+	err := q.UpsertIMAPFolderState(ctx, schema.UpsertIMAPFolderStateParams{
+		AccountID:     fs.acct.ID,
+		Folder:        fs.folder,
+		UidValidity:   fs.uidValidity,
+		UidNext:       uidNext,
+		HighestModseq: fs.highestModSeq,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save folder state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package imapsync
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+const testKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// fakeServer is an in-process IMAP server holding one user's mailbox. It
+// records the traffic so that tests can tell what the client fetched.
+type fakeServer struct {
+	user *imapmemserver.User
+	addr string
+
+	mu      sync.Mutex
+	traffic bytes.Buffer
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	fs := &fakeServer{user: imapmemserver.NewUser("user", "secret")}
+	mem := imapmemserver.New()
+	mem.AddUser(fs.user)
+
+	srv := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return mem.NewSession(), nil, nil
+		},
+		Caps:         imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIMAP4rev2: {}},
+		InsecureAuth: true,
+		DebugWriter:  fs,
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	fs.addr = ln.Addr().String()
+	return fs
+}
+
+func (fs *fakeServer) Write(p []byte) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.traffic.Write(p)
+}
+
+// bodyFetches counts the messages whose content the client has requested.
+func (fs *fakeServer) bodyFetches() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return strings.Count(fs.traffic.String(), "BODY.PEEK[]")
+}
+
+func (fs *fakeServer) create(t *testing.T, folder string) {
+	t.Helper()
+	if err := fs.user.Create(folder, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (fs *fakeServer) append(t *testing.T, folder, raw string) {
+	t.Helper()
+	if _, err := fs.user.Append(folder, literal{strings.NewReader(raw)}, &imap.AppendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expunge removes the messages with uids from folder, copying them to
+// moveTo first unless it is empty.
+func (fs *fakeServer) expunge(t *testing.T, folder, moveTo string, uids ...imap.UID) {
+	t.Helper()
+	conn, err := net.Dial("tcp", fs.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := imapclient.New(conn, nil)
+	defer c.Close()
+	if err := c.Login("user", "secret").Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select(folder, nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	set := imap.UIDSetNum(uids...)
+	if moveTo != "" {
+		if _, err := c.Copy(set, moveTo).Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := &imap.StoreFlags{Op: imap.StoreFlagsAdd, Silent: true, Flags: []imap.Flag{imap.FlagDeleted}}
+	if err := c.Store(set, deleted, nil).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Expunge().Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type literal struct{ *strings.Reader }
+
+func (l literal) Size() int64 { return int64(l.Reader.Len()) }
+
+// newTestWorker creates a Worker syncing into db that connects to fs
+// whatever the account's address.
+func newTestWorker(t *testing.T, db database.Service, fs *fakeServer) *Worker {
+	t.Helper()
+	t.Setenv("SYNC_ENCRYPTION_KEY", testKey)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWorkerFromEnv(mailstore.New(db, blobstore.New(db, fsb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetDialer(func(ctx context.Context, addr, security string) (*imapclient.Client, error) {
+		conn, err := net.Dial("tcp", fs.addr)
+		if err != nil {
+			return nil, err
+		}
+		return imapclient.New(conn, nil), nil
+	})
+	t.Cleanup(func() { w.Shutdown(context.Background()) })
+	return w
+}
+
+func createAccount(t *testing.T, w *Worker) schema.ImapAccount {
+	t.Helper()
+	acct, err := w.CreateAccount(context.Background(), "u1", AccountParams{
+		Host:     "imap.example.com",
+		Security: SecurityNone,
+		Username: "user",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acct
+}
+
+func syncAccount(t *testing.T, w *Worker, acct schema.ImapAccount) {
+	t.Helper()
+	if err := w.SyncAccount(context.Background(), acct); err != nil {
+		t.Fatalf("SyncAccount: %v", err)
+	}
+}
+
+func count(t *testing.T, db database.Service, table string) int {
+	t.Helper()
+	var n int
+	if err := db.DB().QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func message(id, subject string) string {
+	return "Message-ID: <" + id + "@example.com>\r\nFrom: alice@example.com\r\nSubject: " + subject + "\r\n\r\nHello\r\n"
+}
+
+func TestSyncImportsEachMessageOnce(t *testing.T) {
+	db := dbtest.New(t)
+	fs := newFakeServer(t)
+	fs.create(t, "INBOX")
+	fs.create(t, "Archive")
+	fs.append(t, "INBOX", message("a", "one"))
+	fs.append(t, "INBOX", message("b", "two"))
+	// The same message filed in two folders is stored once
+	fs.append(t, "Archive", message("a", "one"))
+
+	w := newTestWorker(t, db, fs)
+	acct := createAccount(t, w)
+	syncAccount(t, w, acct)
+	if n := count(t, db, "message"); n != 2 {
+		t.Errorf("got %d messages after the first sync, want 2", n)
+	}
+	if n := count(t, db, "imap_message"); n != 3 {
+		t.Errorf("got %d imported UIDs, want 3", n)
+	}
+
+	fs.append(t, "INBOX", message("c", "three"))
+	fetches := fs.bodyFetches()
+	syncAccount(t, w, acct)
+	if n := count(t, db, "message"); n != 3 {
+		t.Errorf("got %d messages after the second sync, want 3", n)
+	}
+	if n := fs.bodyFetches() - fetches; n != 1 {
+		t.Errorf("second sync fetched %d batches of messages, want 1", n)
+	}
+
+	state, err := db.Queries().GetIMAPFolderState(context.Background(), schema.GetIMAPFolderStateParams{
+		AccountID: acct.ID,
+		Folder:    "INBOX",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.UidNext != 4 {
+		t.Errorf("got INBOX UIDNEXT %d, want 4", state.UidNext)
+	}
+}
+
+func TestSyncRemovesExpungedMessages(t *testing.T) {
+	db := dbtest.New(t)
+	fs := newFakeServer(t)
+	fs.create(t, "INBOX")
+	fs.create(t, "Archive")
+	fs.append(t, "INBOX", message("a", "one"))
+	fs.append(t, "INBOX", message("b", "two"))
+	if _, err := fs.user.Append("INBOX", literal{strings.NewReader(message("c", "three"))}, &imap.AppendOptions{
+		Flags: []imap.Flag{imap.FlagSeen, imap.FlagFlagged},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newTestWorker(t, db, fs)
+	acct := createAccount(t, w)
+	syncAccount(t, w, acct)
+
+	// Messages are imported with their flags
+	var read, starred int
+	err := db.DB().QueryRow(`SELECT COUNT(*) FROM message WHERE is_read`).Scan(&read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DB().QueryRow(`SELECT COUNT(*) FROM message_keyword WHERE keyword = ?`, flags.KeywordStarred).Scan(&starred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != 1 || starred != 1 {
+		t.Errorf("got %d read and %d starred messages, want 1 of each", read, starred)
+	}
+
+	// A message moved to another folder is kept, and one deleted is trashed
+	fs.expunge(t, "INBOX", "Archive", 2)
+	fs.expunge(t, "INBOX", "", 1)
+	syncAccount(t, w, acct)
+	if n := count(t, db, "imap_message"); n != 2 {
+		t.Errorf("got %d imported UIDs, want 2", n)
+	}
+	rows, err := db.DB().Query(`SELECT m.subject FROM message m JOIN message_label l ON l.message_id = m.id WHERE l.label = ?`, labels.Trash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var trashed []string
+	for rows.Next() {
+		var subject string
+		if err := rows.Scan(&subject); err != nil {
+			t.Fatal(err)
+		}
+		trashed = append(trashed, subject)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(trashed) != 1 || trashed[0] != "one" {
+		t.Errorf("got %q trashed, want one", trashed)
+	}
+}
+
+func TestSyncResumesAfterRestart(t *testing.T) {
+	db := dbtest.New(t)
+	fs := newFakeServer(t)
+	fs.create(t, "INBOX")
+	fs.append(t, "INBOX", message("a", "one"))
+	fs.append(t, "INBOX", message("b", "two"))
+
+	w := newTestWorker(t, db, fs)
+	acct := createAccount(t, w)
+	syncAccount(t, w, acct)
+
+	// A new worker finds the folder state of the last one
+	fetches := fs.bodyFetches()
+	syncAccount(t, newTestWorker(t, db, fs), acct)
+	if n := fs.bodyFetches() - fetches; n != 0 {
+		t.Errorf("sync after restart fetched %d batches of messages, want none", n)
+	}
+	if n := count(t, db, "message"); n != 2 {
+		t.Errorf("got %d messages, want 2", n)
+	}
+}
+
+func TestSyncRescansOnUIDValidityChange(t *testing.T) {
+	db := dbtest.New(t)
+	fs := newFakeServer(t)
+	fs.create(t, "INBOX")
+	fs.append(t, "INBOX", message("a", "one"))
+
+	w := newTestWorker(t, db, fs)
+	acct := createAccount(t, w)
+	syncAccount(t, w, acct)
+
+	// Recreating the folder gives it a new UIDVALIDITY
+	if err := fs.user.Delete("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	fs.create(t, "INBOX")
+	fs.append(t, "INBOX", message("a", "one"))
+	fs.append(t, "INBOX", message("b", "two"))
+	syncAccount(t, w, acct)
+
+	if n := count(t, db, "message"); n != 2 {
+		t.Errorf("got %d messages, want 2", n)
+	}
+	if n := count(t, db, "imap_message"); n != 2 {
+		t.Errorf("got %d imported UIDs, want 2", n)
+	}
+}
+
+func TestSyncSkipsMalformedMessages(t *testing.T) {
+	db := dbtest.New(t)
+	fs := newFakeServer(t)
+	fs.create(t, "INBOX")
+	fs.append(t, "INBOX", "not a message")
+	fs.append(t, "INBOX", message("a", "one"))
+
+	w := newTestWorker(t, db, fs)
+	acct := createAccount(t, w)
+	syncAccount(t, w, acct)
+	if n := count(t, db, "message"); n != 1 {
+		t.Errorf("got %d messages, want 1", n)
+	}
+
+	got, err := db.Queries().GetIMAPAccount(context.Background(), schema.GetIMAPAccountParams{ID: acct.ID, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastError != "" || !got.LastSyncedAt.Valid {
+		t.Errorf("got last error %q and synced %v, want a successful sync", got.LastError, got.LastSyncedAt.Valid)
+	}
+}
+
+func TestSyncRecordsLoginFailure(t *testing.T) {
+	db := dbtest.New(t)
+	fs := newFakeServer(t)
+	w := newTestWorker(t, db, fs)
+	acct, err := w.CreateAccount(context.Background(), "u1", AccountParams{
+		Host:     "imap.example.com",
+		Security: SecurityNone,
+		Username: "user",
+		Password: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SyncAccount(context.Background(), acct); err == nil {
+		t.Fatal("SyncAccount succeeded with a wrong password")
+	}
+	got, err := db.Queries().GetIMAPAccount(context.Background(), schema.GetIMAPAccountParams{ID: acct.ID, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastError == "" {
+		t.Error("login failure was not recorded on the account")
+	}
+}
@@ -0,0 +1,321 @@
+// Package imapsync pulls mail from users' existing IMAP mailboxes into the
+// mailstore. Sync is incremental: each remote folder's UIDVALIDITY, UIDNEXT
+// and (when the server supports CONDSTORE) HIGHESTMODSEQ are persisted, so a
+// restart resumes where the previous run stopped. Messages expunged from
+// every remote folder they were in are moved to the Trash, and with
+// CONDSTORE, changes to their read, flagged and answered flags are copied.
+package imapsync
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/google/uuid"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// Connection security modes for an account.
+const (
+	SecurityTLS      = "tls"
+	SecurityStartTLS = "starttls"
+	SecurityNone     = "none"
+)
+
+// DefaultInterval is used when SYNC_INTERVAL is not set.
+const DefaultInterval = 5 * time.Minute
+
+// Dialer opens an unauthenticated IMAP client connection.
+type Dialer func(ctx context.Context, addr, security string) (*imapclient.Client, error)
+
+// Worker periodically synchronizes every enabled IMAP account.
+type Worker struct {
+	store    *mailstore.Store
+	queries  *schema.Queries
+	sealer   *sealer
+	interval time.Duration
+	dial     Dialer
+
+	// ctx is cancelled by Shutdown; wg tracks the loop and triggered syncs
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// running serializes syncs of the same account between the periodic
+	// loop and on-demand triggers
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// NewWorkerFromEnv creates a Worker configured from SYNC_ENCRYPTION_KEY and
+// SYNC_INTERVAL. It returns ErrMissingEncryptionKey when sync is not
+// configured.
+func NewWorkerFromEnv(store *mailstore.Store) (*Worker, error) {
+	s, err := newSealer(os.Getenv("SYNC_ENCRYPTION_KEY"))
+	if err != nil {
+		return nil, err
+	}
+
+	interval := DefaultInterval
+	if v := os.Getenv("SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SYNC_INTERVAL %q", v)
+		}
+		interval = d
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Worker{
+		ctx:      ctx,
+		cancel:   cancel,
+		store:    store,
+		queries:  store.DB().Queries(),
+		sealer:   s,
+		interval: interval,
+		dial:     dialIMAP,
+		running:  make(map[string]bool),
+	}, nil
+}
+
+// SetDialer replaces the function used to connect to IMAP servers, e.g. to
+// reach an in-process server in tests.
+func (w *Worker) SetDialer(d Dialer) {
+	w.dial = d
+}
+
+// Start runs the periodic sync loop in the background until Shutdown.
+func (w *Worker) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.Run(w.ctx)
+	}()
+}
+
+// Run syncs all enabled accounts every interval until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.SyncAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown cancels running syncs and waits until ctx is done for them to
+// stop. Progress is saved per message, so an interrupted sync resumes where it
+// stopped.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	w.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SyncAll syncs every enabled account once, sequentially.
+func (w *Worker) SyncAll(ctx context.Context) {
+	accounts, err := w.queries.ListEnabledIMAPAccounts(ctx)
+	if err != nil {
+		metrics.Errors.WithLabelValues("imap_sync_list_accounts").Inc()
+		logger.Error(ctx, "Failed to list IMAP accounts", "error", err)
+		return
+	}
+
+	for _, acct := range accounts {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := w.SyncAccount(ctx, acct); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Error(ctx, "IMAP sync failed", "account_id", acct.ID, "user_id", acct.UserID, "error", err)
+		}
+	}
+}
+
+// SyncAccount runs one incremental sync of acct and records the outcome on
+// the account row.
+func (w *Worker) SyncAccount(ctx context.Context, acct schema.ImapAccount) error {
+	if !w.acquire(acct.ID) {
+		return nil
+	}
+	defer w.release(acct.ID)
+
+	syncErr := w.syncAccount(ctx, acct)
+	if syncErr != nil {
+		metrics.Errors.WithLabelValues("imap_sync").Inc()
+	}
+
+	lastError := ""
+	if syncErr != nil {
+		lastError = syncErr.Error()
+	}
+	err := w.queries.UpdateIMAPAccountSyncResult(context.WithoutCancel(ctx), schema.UpdateIMAPAccountSyncResultParams{
+		LastError:    lastError,
+		LastSyncedAt: sql.NullTime{Time: time.Now().UTC(), Valid: true},
+		ID:           acct.ID,
+	})
+	if err != nil {
+		logger.Error(ctx, "Failed to record IMAP sync result", "account_id", acct.ID, "error", err)
+	}
+	return syncErr
+}
+
+func (w *Worker) acquire(accountID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running[accountID] {
+		return false
+	}
+	w.running[accountID] = true
+	return true
+}
+
+func (w *Worker) release(accountID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.running, accountID)
+}
+
+// AccountParams describes a remote mailbox to add for a user.
+type AccountParams struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Security string `json:"security"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CreateAccount validates p and stores it with its password sealed.
+func (w *Worker) CreateAccount(ctx context.Context, userID string, p AccountParams) (schema.ImapAccount, error) {
+	p.Host = strings.TrimSpace(p.Host)
+	if p.Security == "" {
+		p.Security = SecurityTLS
+	}
+	if p.Port == 0 {
+		p.Port = 993
+		if p.Security != SecurityTLS {
+			p.Port = 143
+		}
+	}
+	switch {
+	case p.Host == "", p.Username == "", p.Password == "":
+		return schema.ImapAccount{}, fmt.Errorf("%w: host, username and password are required", ErrInvalidAccount)
+	case p.Port < 1 || p.Port > 65535:
+		return schema.ImapAccount{}, fmt.Errorf("%w: port out of range", ErrInvalidAccount)
+	case p.Security != SecurityTLS && p.Security != SecurityStartTLS && p.Security != SecurityNone:
+		return schema.ImapAccount{}, fmt.Errorf("%w: security must be tls, starttls or none", ErrInvalidAccount)
+	}
+
+	sealed, err := w.sealer.seal(p.Password)
+	if err != nil {
+		return schema.ImapAccount{}, err
+	}
+
+	id := uuid.New().String()
+	err = w.queries.InsertIMAPAccount(ctx, schema.InsertIMAPAccountParams{
+		ID:       id,
+		UserID:   userID,
+		Host:     p.Host,
+		Port:     int64(p.Port),
+		Security: p.Security,
+		Username: p.Username,
+		Password: sealed,
+	})
+	if err != nil {
+		return schema.ImapAccount{}, fmt.Errorf("failed to insert IMAP account: %w", err)
+	}
+	return w.queries.GetIMAPAccount(ctx, schema.GetIMAPAccountParams{ID: id, UserID: userID})
+}
+
+// DeleteAccount removes an account and its sync state. Messages already
+// imported are kept.
+func (w *Worker) DeleteAccount(ctx context.Context, userID, id string) error {
+	return w.store.DB().WithTx(ctx, func(q *schema.Queries) error {
+		if _, err := q.GetIMAPAccount(ctx, schema.GetIMAPAccountParams{ID: id, UserID: userID}); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrAccountNotFound
+			}
+			return err
+		}
+		if err := q.DeleteIMAPMessages(ctx, id); err != nil {
+			return err
+		}
+		if err := q.DeleteIMAPFolderStates(ctx, id); err != nil {
+			return err
+		}
+		_, err := q.DeleteIMAPAccount(ctx, schema.DeleteIMAPAccountParams{ID: id, UserID: userID})
+		return err
+	})
+}
+
+// TriggerSync starts an immediate background sync of one of userID's
+// accounts. It is a no-op if that account is already syncing.
+func (w *Worker) TriggerSync(ctx context.Context, userID, id string) error {
+	acct, err := w.queries.GetIMAPAccount(ctx, schema.GetIMAPAccountParams{ID: id, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAccountNotFound
+		}
+		return err
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		if err := w.SyncAccount(w.ctx, acct); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Error(w.ctx, "IMAP sync failed", "account_id", acct.ID, "user_id", acct.UserID, "error", err)
+		}
+	}()
+	return nil
+}
+
+// dialIMAP is the default Dialer.
+func dialIMAP(ctx context.Context, addr, security string) (*imapclient.Client, error) {
+	d := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch security {
+	case SecurityTLS:
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, NextProtos: []string{"imap"}})
+		return imapclient.New(tlsConn, nil), nil
+	case SecurityStartTLS:
+		return imapclient.NewStartTLS(conn, nil)
+	default:
+		return imapclient.New(conn, nil), nil
+	}
+}
+
+func accountAddr(acct schema.ImapAccount) string {
+	return net.JoinHostPort(acct.Host, strconv.FormatInt(acct.Port, 10))
+}
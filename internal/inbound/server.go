@@ -0,0 +1,219 @@
+// Package inbound receives mail directly from an MTA over LMTP or SMTP and
+// delivers it through the mailstore.
+package inbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// Config describes the inbound listener.
+type Config struct {
+	Network       string // "tcp" or "unix"
+	Addr          string
+	LMTP          bool
+	Domain        string
+	MaxRecipients int
+}
+
+// ConfigFromEnv reads the listener configuration from the environment. It
+// returns false when SMTP_ADDR is unset and the listener is disabled.
+func ConfigFromEnv() (Config, bool) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return Config{}, false
+	}
+
+	domain := os.Getenv("SMTP_DOMAIN")
+	if domain == "" {
+		domain, _ = os.Hostname()
+	}
+
+	network := os.Getenv("SMTP_NETWORK")
+	if network == "" {
+		network = "tcp"
+	}
+
+	return Config{
+		Network:       network,
+		Addr:          addr,
+		LMTP:          os.Getenv("SMTP_PROTOCOL") != "smtp",
+		Domain:        domain,
+		MaxRecipients: 100,
+	}, true
+}
+
+// Server is an LMTP or SMTP listener that delivers into a mailstore.Store.
+type Server struct {
+	cfg      Config
+	store    *mailstore.Store
+	smtp     *smtp.Server
+	verifier *mailauth.Verifier // nil stores mail unauthenticated
+
+	draining atomic.Bool
+	inFlight atomic.Int64
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewServer creates an inbound listener for cfg.
+func NewServer(cfg Config, store *mailstore.Store) *Server {
+	s := &Server{
+		cfg:   cfg,
+		store: store,
+		conns: make(map[net.Conn]struct{}),
+	}
+
+	srv := smtp.NewServer(&backend{server: s})
+	srv.Network = cfg.Network
+	srv.Addr = cfg.Addr
+	srv.LMTP = cfg.LMTP
+	srv.Domain = cfg.Domain
+	srv.MaxRecipients = cfg.MaxRecipients
+	srv.MaxMessageBytes = store.MaxMessageSize()
+	srv.ReadTimeout = 5 * time.Minute
+	srv.WriteTimeout = time.Minute
+	srv.ErrorLog = errorLog{}
+	s.smtp = srv
+
+	return s
+}
+
+// SetVerifier makes the server authenticate the messages it receives,
+// storing the verdict with them. It must be called before ListenAndServe.
+func (s *Server) SetVerifier(v *mailauth.Verifier) {
+	s.verifier = v
+}
+
+// Protocol returns "lmtp" or "smtp".
+func (s *Server) Protocol() string {
+	if s.cfg.LMTP {
+		return "lmtp"
+	}
+	return "smtp"
+}
+
+// ListenAndServe listens on the configured address and serves until
+// Shutdown is called, after which it returns smtp.ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if s.cfg.Network == "unix" {
+		// Remove a stale socket left behind by an unclean exit
+		_ = os.Remove(s.cfg.Addr)
+	}
+
+	ln, err := net.Listen(s.cfg.Network, s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.Addr, err)
+	}
+
+	return s.smtp.Serve(&trackingListener{Listener: ln, server: s})
+}
+
+// Shutdown stops accepting connections and new mail transactions. Clients
+// that try to start a transaction get a 421 tempfail; transactions already in
+// progress are given until ctx is done to finish. Remaining connections are
+// then closed, which the sending MTA treats as a temporary failure.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.smtp.Shutdown(ctx)
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for s.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			logger.Warn(ctx, "Closing inbound connections with transactions in flight",
+				"in_flight", s.inFlight.Load())
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	s.closeConns()
+
+	err := <-shutdownErr
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return ctx.Err()
+}
+
+// closeConns closes every open client connection, waking idle sessions.
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+// trackingListener records accepted connections so that Shutdown can close
+// idle ones; go-smtp's own Shutdown waits for clients to hang up.
+type trackingListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: c, server: l.server}
+	l.server.trackConn(tc, true)
+	return tc, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	server *Server
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.server.trackConn(c, false) })
+	return c.Conn.Close()
+}
+
+// errorLog adapts go-smtp's logger to the structured logger.
+type errorLog struct{}
+
+func (errorLog) Printf(format string, v ...interface{}) {
+	logger.Error(context.Background(), "Inbound server error", "error", fmt.Sprintf(format, v...))
+}
+
+func (errorLog) Println(v ...interface{}) {
+	logger.Error(context.Background(), "Inbound server error", "error", fmt.Sprint(v...))
+}
@@ -0,0 +1,308 @@
+package inbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+const testMessage = "From: alice@example.org\r\nTo: user@example.com\r\nSubject: Hello\r\n\r\nHi there.\r\n"
+
+// testServer is an inbound server on a loopback port, delivering for u1
+// (user@example.com).
+type testServer struct {
+	*Server
+	db   database.Service
+	addr string
+}
+
+func newTestServer(t *testing.T, lmtp bool) *testServer {
+	t.Helper()
+	db := dbtest.New(t)
+
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+
+	s := NewServer(Config{Network: "tcp", LMTP: lmtp, Domain: "mx.example.com", MaxRecipients: 10}, store)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.smtp.Serve(&trackingListener{Listener: ln, server: s})
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return &testServer{Server: s, db: db, addr: ln.Addr().String()}
+}
+
+func (ts *testServer) dial(t *testing.T) *smtp.Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c *smtp.Client
+	if ts.cfg.LMTP {
+		c = smtp.NewClientLMTP(conn)
+	} else {
+		c = smtp.NewClient(conn)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("mta.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// messages returns the number of messages stored for userID.
+func (ts *testServer) messages(t *testing.T, userID string) int {
+	t.Helper()
+	var n int
+	if err := ts.db.DB().QueryRow(`SELECT COUNT(*) FROM message WHERE user_id = ?`, userID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// replyCode returns the SMTP code of err, or 250 when it is nil.
+func replyCode(err error) int {
+	if err == nil {
+		return 250
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code
+	}
+	return 0
+}
+
+func TestLMTPRepliesPerRecipient(t *testing.T) {
+	ts := newTestServer(t, true)
+	c := ts.dial(t)
+
+	if err := c.Mail("alice@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"user@example.com", "user+lists@example.com"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("RCPT %s: %v", rcpt, err)
+		}
+	}
+	if code := replyCode(c.Rcpt("nobody@example.com", nil)); code != 550 {
+		t.Errorf("RCPT of an unknown address got %d, want 550", code)
+	}
+
+	got := map[string]int{}
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		if status == nil {
+			got[rcpt] = 250
+		} else {
+			got[rcpt] = status.Code
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"user@example.com": 250, "user+lists@example.com": 250}
+	for rcpt, code := range want {
+		if got[rcpt] != code {
+			t.Errorf("%s got %d, want %d", rcpt, got[rcpt], code)
+		}
+	}
+	if n := ts.messages(t, "u1"); n != 2 {
+		t.Errorf("u1 has %d messages, want 2", n)
+	}
+}
+
+func TestSMTPRejectsWhenNoRecipientHasTheMessage(t *testing.T) {
+	ts := newTestServer(t, false)
+
+	for _, c := range []struct {
+		name string
+		to   []string
+		data string
+		want int
+	}{
+		{"malformed", []string{"user@example.com"}, "not a message\r\n", 554},
+	} {
+		err := ts.dial(t).SendMail("alice@example.org", c.to, strings.NewReader(c.data))
+		if code := replyCode(err); code != c.want {
+			t.Errorf("%s: got %d (%v), want %d", c.name, code, err, c.want)
+		}
+	}
+	if n := ts.messages(t, "u1"); n != 0 {
+		t.Errorf("u1 has %d messages, want none", n)
+	}
+}
+
+func TestSMTPDeliversToAllRecipientsOrNone(t *testing.T) {
+	ts := newTestServer(t, false)
+	dbtest.AddUser(t, ts.db, "u2", "other@example.com")
+	to := []string{"user@example.com", "other@example.com"}
+
+	if err := ts.dial(t).SendMail("alice@example.org", to, strings.NewReader(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if n, m := ts.messages(t, "u1"), ts.messages(t, "u2"); n != 1 || m != 1 {
+		t.Fatalf("u1 has %d messages and u2 %d, want 1 each", n, m)
+	}
+
+	// A recipient gone by DATA fails the message for the one before it too
+	c := ts.dial(t)
+	if err := c.Mail("alice@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("RCPT %s: %v", rcpt, err)
+		}
+	}
+	if _, err := ts.db.DB().Exec(`DELETE FROM user WHERE id = 'u2'`); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if code := replyCode(w.Close()); code != 550 {
+		t.Errorf("DATA got %d, want 550", code)
+	}
+	if n := ts.messages(t, "u1"); n != 1 {
+		t.Errorf("u1 has %d messages, want 1", n)
+	}
+}
+
+func TestSMTPAuthenticatesMessages(t *testing.T) {
+	ts := newTestServer(t, false)
+	ts.SetVerifier(mailauth.NewVerifier(mailauth.Zone{TXT: map[string][]string{
+		"example.org":        {"v=spf1 ip4:127.0.0.1 -all"},
+		"_dmarc.example.org": {"v=DMARC1; p=reject"},
+		"_dmarc.bank.test":   {"v=DMARC1; p=quarantine"},
+	}}, "mx.example.com"))
+
+	spoofed := strings.Replace(testMessage, "alice@example.org", "ceo@bank.test", 1)
+	for _, data := range []string{testMessage, spoofed} {
+		if err := ts.dial(t).SendMail("alice@example.org", []string{"user@example.com"}, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := ts.db.DB().Query(`SELECT a.header_from, a.spf, a.dmarc, a.dmarc_policy, a.results
+		FROM message_auth a JOIN message m ON m.id = a.message_id WHERE m.user_id = 'u1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[string]string{}
+	for rows.Next() {
+		var from, spf, dmarc, policy, results string
+		if err := rows.Scan(&from, &spf, &dmarc, &policy, &results); err != nil {
+			t.Fatal(err)
+		}
+		got[from] = spf + " " + dmarc + " " + policy
+		if !strings.HasPrefix(results, "mx.example.com;") {
+			t.Errorf("results for %s: %q", from, results)
+		}
+	}
+	want := map[string]string{"example.org": "pass pass reject", "bank.test": "pass fail quarantine"}
+	for from, verdict := range want {
+		if got[from] != verdict {
+			t.Errorf("From %s: got %q, want %q", from, got[from], verdict)
+		}
+	}
+}
+
+func TestShutdownDrainsTransactions(t *testing.T) {
+	ts := newTestServer(t, false)
+
+	busy := ts.dial(t)
+	if err := busy.Mail("alice@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := busy.Rcpt("user@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	idle := ts.dial(t)
+
+	var wg sync.WaitGroup
+	var shutdownErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr = ts.Shutdown(ctx)
+	}()
+	for !ts.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New transactions are tempfailed while the one in flight finishes
+	if code := replyCode(idle.Mail("bob@example.org", nil)); code != 421 {
+		t.Errorf("MAIL while draining got %d, want 421", code)
+	}
+	w, err := busy.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("DATA while draining: %v", err)
+	}
+	busy.Quit()
+
+	wg.Wait()
+	if shutdownErr != nil {
+		t.Errorf("Shutdown = %v", shutdownErr)
+	}
+	if n := ts.messages(t, "u1"); n != 1 {
+		t.Errorf("u1 has %d messages, want 1", n)
+	}
+}
+
+func TestShutdownClosesTransactionsPastTheDeadline(t *testing.T) {
+	ts := newTestServer(t, false)
+
+	c := ts.dial(t)
+	if err := c.Mail("alice@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := ts.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want DeadlineExceeded", err)
+	}
+	// The connection was closed under the client, which the MTA retries
+	if err := c.Rcpt("user@example.com", nil); err == nil {
+		t.Error("RCPT after the deadline succeeded")
+	}
+}
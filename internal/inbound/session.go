@@ -0,0 +1,252 @@
+package inbound
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+var (
+	errShuttingDown = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Service shutting down, try again later",
+	}
+	errUnknownRecipient = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user here",
+	}
+	errNoRecipients = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "No valid recipients",
+	}
+	errTemporary = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Temporary local error, try again later",
+	}
+	errTooLarge = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Message exceeds maximum size",
+	}
+)
+
+type backend struct {
+	server *Server
+}
+
+func (b *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	if b.server.draining.Load() {
+		return nil, errShuttingDown
+	}
+	return &session{
+		server:     b.server,
+		conn:       c,
+		remoteAddr: c.Conn().RemoteAddr().String(),
+	}, nil
+}
+
+// recipient is an accepted RCPT TO address and the user it resolved to.
+type recipient struct {
+	address string
+	userID  string
+}
+
+// session is a single client connection. A mail transaction runs from an
+// accepted MAIL command until Reset, and counts towards the server's in-flight
+// transactions so that Shutdown can wait for it.
+type session struct {
+	server     *Server
+	conn       *smtp.Conn
+	remoteAddr string
+
+	inTx       bool
+	from       string
+	recipients []recipient
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.server.draining.Load() {
+		return errShuttingDown
+	}
+	s.reset()
+	s.from = from
+	s.inTx = true
+	s.server.inFlight.Add(1)
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	userID, err := s.server.lookupRecipient(context.Background(), to)
+	if err != nil {
+		return err
+	}
+	s.recipients = append(s.recipients, recipient{address: to, userID: userID})
+	return nil
+}
+
+// Data delivers the message to every recipient. Plain SMTP has a single
+// reply for the whole transaction, so the message is stored for all of them
+// in one database transaction or for none, and a client retrying after a
+// failure doesn't deliver it twice.
+func (s *session) Data(r io.Reader) error {
+	raw, err := s.readMessage(r)
+	if err != nil {
+		return err
+	}
+	return s.deliver(s.recipients, raw, s.authenticate(raw))
+}
+
+// LMTPData delivers the message and reports a status for each recipient.
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	raw, err := s.readMessage(r)
+	if err != nil {
+		return err
+	}
+	auth := s.authenticate(raw)
+
+	for _, rcpt := range s.recipients {
+		status.SetStatus(rcpt.address, s.deliver([]recipient{rcpt}, raw, auth))
+	}
+	return nil
+}
+
+func (s *session) Reset() {
+	s.reset()
+}
+
+func (s *session) Logout() error {
+	s.reset()
+	return nil
+}
+
+func (s *session) reset() {
+	if s.inTx {
+		s.server.inFlight.Add(-1)
+		s.inTx = false
+	}
+	s.from = ""
+	s.recipients = nil
+}
+
+func (s *session) readMessage(r io.Reader) ([]byte, error) {
+	if len(s.recipients) == 0 {
+		return nil, errNoRecipients
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		if errors.Is(err, smtp.ErrDataTooLarge) {
+			return nil, errTooLarge
+		}
+		return nil, err
+	}
+	return raw, nil
+}
+
+// authenticate checks the DKIM, SPF and DMARC of a message, or returns nil
+// if the server has no verifier. SPF is only checked for SMTP: an LMTP
+// client is the MTA that relayed the message, not its sender.
+func (s *session) authenticate(raw []byte) *mailauth.Results {
+	if s.server.verifier == nil {
+		return nil
+	}
+	in := mailauth.Input{Raw: raw, Helo: s.conn.Hostname(), MailFrom: s.from}
+	if addr, ok := s.conn.Conn().RemoteAddr().(*net.TCPAddr); ok && !s.server.cfg.LMTP {
+		in.RemoteIP = addr.IP
+	}
+	res := s.server.verifier.Verify(context.Background(), in)
+	return &res
+}
+
+// deliver stores raw for all of rcpts or none of them and maps the result
+// to an SMTP reply.
+func (s *session) deliver(rcpts []recipient, raw []byte, auth *mailauth.Results) error {
+	ctx := context.Background()
+	ds := make([]mailstore.Delivery, len(rcpts))
+	addresses := make([]string, len(rcpts))
+	for i, rcpt := range rcpts {
+		ds[i] = mailstore.Delivery{
+			UserID:   rcpt.userID,
+			Raw:      raw,
+			Envelope: mailstore.Envelope{From: s.from, To: rcpt.address},
+			Auth:     auth,
+		}
+		addresses[i] = rcpt.address
+	}
+	_, err := s.server.store.DeliverAll(ctx, ds)
+	if err == nil {
+		for _, rcpt := range rcpts {
+			logger.Info(ctx, "Delivered inbound message",
+				"protocol", s.server.Protocol(),
+				"remote_addr", s.remoteAddr,
+				"mail_from", s.from,
+				"recipient", rcpt.address,
+				"size", len(raw),
+			)
+		}
+		return nil
+	}
+
+	var parseErr *mailstore.ParseError
+	switch {
+	case errors.As(err, &parseErr):
+		metrics.Errors.WithLabelValues("message_malformed").Inc()
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Malformed message: " + parseErr.Reason,
+		}
+	case errors.Is(err, mailstore.ErrMessageTooLarge):
+		return errTooLarge
+	case errors.Is(err, mailstore.ErrEmptyMessage):
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Empty message",
+		}
+	case errors.Is(err, mailstore.ErrUnknownUser):
+		return errUnknownRecipient
+	default:
+		metrics.Errors.WithLabelValues("inbound_delivery").Inc()
+		logger.Error(ctx, "Failed to deliver inbound message",
+			"recipients", addresses,
+			"error", err,
+		)
+		return errTemporary
+	}
+}
+
+// lookupRecipient resolves a RCPT TO address to a user ID. A "+detail"
+// subaddress is accepted when the base address belongs to a user.
+func (s *Server) lookupRecipient(ctx context.Context, address string) (string, error) {
+	queries := s.store.DB().Queries()
+
+	user, err := queries.GetUserByEmail(ctx, address)
+	if errors.Is(err, sql.ErrNoRows) {
+		local, domain, ok := strings.Cut(address, "@")
+		if base, _, found := strings.Cut(local, "+"); ok && found {
+			user, err = queries.GetUserByEmail(ctx, base+"@"+domain)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errUnknownRecipient
+		}
+		metrics.Errors.WithLabelValues("database_get_user").Inc()
+		logger.Error(ctx, "Failed to look up recipient", "recipient", address, "error", err)
+		return "", errTemporary
+	}
+	return user.ID, nil
+}
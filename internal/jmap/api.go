@@ -0,0 +1,305 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+)
+
+// Request-level error types (RFC 8620 section 3.6.1).
+const (
+	problemUnknownCapability = "urn:ietf:params:jmap:error:unknownCapability"
+	problemNotJSON           = "urn:ietf:params:jmap:error:notJSON"
+	problemNotRequest        = "urn:ietf:params:jmap:error:notRequest"
+	problemLimit             = "urn:ietf:params:jmap:error:limit"
+)
+
+// problem is a request-level error, sent as RFC 7807 problem details.
+type problem struct {
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Limit  string `json:"limit,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, p problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		metrics.Errors.WithLabelValues("response_encode").Inc()
+		logger.Error(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		metrics.Errors.WithLabelValues("response_encode").Inc()
+		logger.Error(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// user returns the ID of the user the request is authenticated as, or
+// writes an error and returns false.
+func user(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusUnauthorized, Detail: "Failed to get user ID from token"})
+		return "", false
+	}
+	return userID, true
+}
+
+// request is the state of one API request shared by its method calls: the
+// IDs of objects created so far, by creation ID, and the responses for
+// result references.
+type request struct {
+	userID    string
+	created   map[string]string
+	responses []Invocation
+
+	// extra holds the implicit responses a method adds after its own, such
+	// as the Email/set of an EmailSubmission/set.
+	extra []Invocation
+}
+
+// resolveID returns the ID of the object created with creation ID id[1:]
+// if id starts with "#", and id otherwise.
+func (r *request) resolveID(id string) (string, bool) {
+	if !strings.HasPrefix(id, "#") {
+		return id, true
+	}
+	created, ok := r.created[id[1:]]
+	return created, ok
+}
+
+// respond adds an implicit response after that of the current method call.
+func (r *request) respond(name string, args interface{}) error {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	r.extra = append(r.extra, Invocation{Name: name, Args: b})
+	return nil
+}
+
+// HandleAPI runs the method calls of a JMAP request in order.
+func (s *Server) HandleAPI(w http.ResponseWriter, r *http.Request) {
+	userID, ok := user(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSizeRequest+1))
+	if err != nil {
+		writeProblem(w, r, problem{Type: problemNotRequest, Status: http.StatusBadRequest, Detail: "Failed to read request"})
+		return
+	}
+	if len(body) > maxSizeRequest {
+		writeProblem(w, r, problem{Type: problemLimit, Status: http.StatusRequestEntityTooLarge,
+			Detail: "The request is larger than maxSizeRequest", Limit: "maxSizeRequest"})
+		return
+	}
+	if !json.Valid(body) {
+		writeProblem(w, r, problem{Type: problemNotJSON, Status: http.StatusBadRequest, Detail: "The request is not JSON"})
+		return
+	}
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil || req.Using == nil || req.MethodCalls == nil {
+		detail := "The request must have using and methodCalls"
+		if err != nil {
+			detail = err.Error()
+		}
+		writeProblem(w, r, problem{Type: problemNotRequest, Status: http.StatusBadRequest, Detail: detail})
+		return
+	}
+
+	capabilities, _ := s.capabilities()
+	using := map[string]bool{}
+	for _, c := range req.Using {
+		if _, ok := capabilities[c]; !ok {
+			writeProblem(w, r, problem{Type: problemUnknownCapability, Status: http.StatusBadRequest,
+				Detail: "The server doesn't support " + c})
+			return
+		}
+		using[c] = true
+	}
+	if len(req.MethodCalls) > maxCallsInRequest {
+		writeProblem(w, r, problem{Type: problemLimit, Status: http.StatusBadRequest,
+			Detail: "Too many method calls", Limit: "maxCallsInRequest"})
+		return
+	}
+
+	rq := &request{userID: userID, created: map[string]string{}}
+	for k, v := range req.CreatedIDs {
+		rq.created[k] = v
+	}
+	for _, call := range req.MethodCalls {
+		rq.extra = nil
+		result, err := s.call(r.Context(), rq, using, call)
+		if err != nil {
+			var me *methodError
+			if !errors.As(err, &me) {
+				metrics.Errors.WithLabelValues("jmap_method").Inc()
+				logger.Error(r.Context(), "JMAP method failed", "method", call.Name, "error", err)
+				me = &methodError{Type: errServerFail}
+			}
+			result, rq.extra = me, nil
+			call.Name = "error"
+		}
+		args, err := json.Marshal(result)
+		if err != nil {
+			metrics.Errors.WithLabelValues("response_encode").Inc()
+			logger.Error(r.Context(), "Failed to encode JMAP response", "method", call.Name, "error", err)
+			args, call.Name = []byte(`{"type":"serverFail"}`), "error"
+		}
+		rq.responses = append(rq.responses, Invocation{Name: call.Name, Args: args, CallID: call.CallID})
+		for _, inv := range rq.extra {
+			inv.CallID = call.CallID
+			rq.responses = append(rq.responses, inv)
+		}
+	}
+
+	resp := Response{MethodResponses: rq.responses, SessionState: s.sessionState(r.Context(), userID)}
+	if req.CreatedIDs != nil {
+		resp.CreatedIDs = rq.created
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// call runs one method call after resolving its result references.
+func (s *Server) call(ctx context.Context, r *request, using map[string]bool, call Invocation) (interface{}, error) {
+	m, ok := s.methods[call.Name]
+	if !ok || !using[methodCapability(call.Name)] {
+		return nil, &methodError{Type: errUnknownMethod}
+	}
+	args, err := r.resolveReferences(call.Args)
+	if err != nil {
+		return nil, err
+	}
+	return m(ctx, r, args)
+}
+
+// resultReference is an argument whose value is taken from the response to
+// an earlier call in the request (RFC 8620 section 3.7).
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveReferences replaces the "#name" arguments of args with the values
+// they refer to.
+func (r *request) resolveReferences(args json.RawMessage) (json.RawMessage, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(args, &m); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	changed := false
+	for k, v := range m {
+		if !strings.HasPrefix(k, "#") {
+			continue
+		}
+		name := k[1:]
+		if _, ok := m[name]; ok {
+			return nil, invalidArguments("both %s and %s are given", name, k)
+		}
+		var ref resultReference
+		if err := json.Unmarshal(v, &ref); err != nil {
+			return nil, &methodError{Type: errInvalidResultReference, Description: err.Error()}
+		}
+		value, err := r.evaluate(ref)
+		if err != nil {
+			return nil, &methodError{Type: errInvalidResultReference, Description: err.Error()}
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		delete(m, k)
+		m[name] = b
+		changed = true
+	}
+	if !changed {
+		return args, nil
+	}
+	return json.Marshal(m)
+}
+
+// evaluate returns the value ref refers to.
+func (r *request) evaluate(ref resultReference) (interface{}, error) {
+	for _, inv := range r.responses {
+		if inv.CallID != ref.ResultOf {
+			continue
+		}
+		if inv.Name != ref.Name {
+			return nil, errors.New("the response to " + ref.ResultOf + " is " + inv.Name + ", not " + ref.Name)
+		}
+		var v interface{}
+		if err := json.Unmarshal(inv.Args, &v); err != nil {
+			return nil, err
+		}
+		return evaluatePointer(v, ref.Path)
+	}
+	return nil, errors.New("no response to " + ref.ResultOf)
+}
+
+// evaluatePointer evaluates a JSON pointer (RFC 6901) against v. A "*"
+// token applies the rest of the pointer to every element of an array,
+// flattening arrays in the results.
+func evaluatePointer(v interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return v, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("path must start with /")
+	}
+	return evaluateTokens(v, strings.Split(path[1:], "/"))
+}
+
+func evaluateTokens(v interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+	tok := strings.NewReplacer("~1", "/", "~0", "~").Replace(tokens[0])
+	switch x := v.(type) {
+	case map[string]interface{}:
+		next, ok := x[tok]
+		if !ok {
+			return nil, errors.New("no property " + tok)
+		}
+		return evaluateTokens(next, tokens[1:])
+	case []interface{}:
+		if tok == "*" {
+			list := []interface{}{}
+			for _, e := range x {
+				result, err := evaluateTokens(e, tokens[1:])
+				if err != nil {
+					return nil, err
+				}
+				if a, ok := result.([]interface{}); ok {
+					list = append(list, a...)
+				} else {
+					list = append(list, result)
+				}
+			}
+			return list, nil
+		}
+		i, err := strconv.Atoi(tok)
+		if err != nil || i < 0 || i >= len(x) {
+			return nil, errors.New("no element " + tok)
+		}
+		return evaluateTokens(x[i], tokens[1:])
+	}
+	return nil, errors.New("can't apply " + tok + " to a value that isn't an object or array")
+}
@@ -0,0 +1,232 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+)
+
+// Blob IDs start with a letter saying what they are:
+//
+//	M<message ID>             the raw message
+//	A<message ID>_<part>      an attachment, with the dots of its part path as _
+//	T<message ID>_<text|html> the text or HTML body
+//	U<key>                    uploaded content, by its blob store key
+const (
+	blobMessage    = 'M'
+	blobAttachment = 'A'
+	blobText       = 'T'
+	blobUpload     = 'U'
+)
+
+// errBlobNotFound is returned for a blob ID that doesn't name content the
+// user can read.
+var errBlobNotFound = errors.New("blob not found")
+
+func messageBlobID(messageID string) string {
+	return string(blobMessage) + messageID
+}
+
+func attachmentBlobID(messageID, part string) string {
+	return string(blobAttachment) + messageID + "_" + strings.ReplaceAll(part, ".", "_")
+}
+
+func textBlobID(messageID, part string) string {
+	return string(blobText) + messageID + "_" + part
+}
+
+// blob is content a blob ID names.
+type blob struct {
+	data        []byte
+	contentType string
+	name        string
+}
+
+// blob returns the content of one of userID's blobs.
+func (s *Server) blob(ctx context.Context, userID, id string) (blob, error) {
+	if id == "" {
+		return blob{}, errBlobNotFound
+	}
+	q := s.db.Queries()
+	if id[0] == blobUpload {
+		key := id[1:]
+		if b, err := hex.DecodeString(key); err != nil || len(b) != sha256.Size || key != strings.ToLower(key) {
+			return blob{}, errBlobNotFound
+		}
+		data, err := s.store.Blobs().Get(ctx, key)
+		if err != nil {
+			if errors.Is(err, blobstore.ErrNotFound) {
+				return blob{}, errBlobNotFound
+			}
+			return blob{}, err
+		}
+		return blob{data: data, contentType: "application/octet-stream"}, nil
+	}
+
+	messageID, part, _ := strings.Cut(id[1:], "_")
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: messageID, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return blob{}, errBlobNotFound
+		}
+		return blob{}, fmt.Errorf("failed to get message: %w", err)
+	}
+
+	switch id[0] {
+	case blobMessage:
+		if part != "" {
+			return blob{}, errBlobNotFound
+		}
+		data, err := s.raw(ctx, q, msg.ID)
+		if err != nil {
+			return blob{}, err
+		}
+		return blob{data: data, contentType: "message/rfc822", name: "message.eml"}, nil
+	case blobText:
+		body, err := q.GetMessageBody(ctx, msg.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return blob{}, fmt.Errorf("failed to get message body: %w", err)
+		}
+		switch part {
+		case partText:
+			return blob{data: []byte(body.TextBody), contentType: "text/plain; charset=utf-8"}, nil
+		case partHTML:
+			return blob{data: []byte(body.HtmlBody), contentType: "text/html; charset=utf-8"}, nil
+		}
+	case blobAttachment:
+		att, err := q.GetAttachment(ctx, schema.GetAttachmentParams{MessageID: msg.ID, Part: strings.ReplaceAll(part, "_", ".")})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return blob{}, errBlobNotFound
+			}
+			return blob{}, fmt.Errorf("failed to get attachment: %w", err)
+		}
+		if att.BlobHash == "" {
+			return blob{}, errBlobNotFound
+		}
+		data, err := s.store.Blobs().Get(ctx, att.BlobHash)
+		if err != nil {
+			return blob{}, err
+		}
+		return blob{data: data, contentType: att.ContentType, name: att.Filename}, nil
+	}
+	return blob{}, errBlobNotFound
+}
+
+// raw returns the raw content of a message, which is in the blob store or,
+// for messages stored before it existed, in the database.
+func (s *Server) raw(ctx context.Context, q *schema.Queries, messageID string) ([]byte, error) {
+	body, err := q.GetMessageBody(ctx, messageID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errBlobNotFound
+		}
+		return nil, fmt.Errorf("failed to get message body: %w", err)
+	}
+	if len(body.Raw) > 0 || body.RawHash == "" {
+		return body.Raw, nil
+	}
+	return s.store.Blobs().Get(ctx, body.RawHash)
+}
+
+// HandleDownload serves a blob at
+// /jmap/download/{account}/{blob}/{name}?accept={type}.
+func (s *Server) HandleDownload(w http.ResponseWriter, r *http.Request) {
+	userID, ok := user(w, r)
+	if !ok {
+		return
+	}
+	if r.PathValue("account") != userID {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	b, err := s.blob(r.Context(), userID, r.PathValue("blob"))
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) || errors.Is(err, blobstore.ErrNotFound) {
+			http.Error(w, "Blob not found", http.StatusNotFound)
+			return
+		}
+		metrics.Errors.WithLabelValues("jmap_download").Inc()
+		logger.Error(r.Context(), "Failed to read blob", "error", err)
+		http.Error(w, "Failed to read blob", http.StatusInternalServerError)
+		return
+	}
+
+	contentType := r.URL.Query().Get("accept")
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		contentType = b.contentType
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	name := r.PathValue("name")
+	if name == "" {
+		name = b.name
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b.data))
+}
+
+type uploadResponse struct {
+	AccountID string `json:"accountId"`
+	BlobID    string `json:"blobId"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+}
+
+// HandleUpload stores the request body as a blob, for Email/import. An
+// upload that isn't imported is collected with the blob store's garbage.
+func (s *Server) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	userID, ok := user(w, r)
+	if !ok {
+		return
+	}
+	if r.PathValue("account") != userID {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusNotFound, Detail: "Account not found"})
+		return
+	}
+	max := s.store.MaxMessageSize()
+	data, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusBadRequest, Detail: "Failed to read upload"})
+		return
+	}
+	if int64(len(data)) > max {
+		writeProblem(w, r, problem{Type: problemLimit, Status: http.StatusRequestEntityTooLarge,
+			Detail: "The upload is larger than maxSizeUpload", Limit: "maxSizeUpload"})
+		return
+	}
+	key, err := s.store.Blobs().Put(r.Context(), data)
+	if err != nil {
+		metrics.Errors.WithLabelValues("jmap_upload").Inc()
+		logger.Error(r.Context(), "Failed to store upload", "error", err)
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: "Failed to store upload"})
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	writeJSON(w, r, http.StatusCreated, uploadResponse{
+		AccountID: userID,
+		BlobID:    string(blobUpload) + key,
+		Type:      contentType,
+		Size:      int64(len(data)),
+	})
+}
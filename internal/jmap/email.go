@@ -0,0 +1,704 @@
+package jmap
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+// Email properties. The body is offered as a text and an HTML part, the
+// ones the message was indexed with, and its attachments; the MIME
+// structure itself isn't kept, so bodyStructure and header:{name} aren't.
+var emailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+	"replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues",
+	"textBody", "htmlBody", "attachments", "headers",
+}
+
+var defaultEmailProperties = emailProperties[:len(emailProperties)-1]
+
+var bodyPartProperties = []string{
+	"partId", "blobId", "size", "name", "type", "charset", "disposition", "cid",
+}
+
+// The part IDs of the text and HTML bodies.
+const (
+	partText = "text"
+	partHTML = "html"
+)
+
+// maxPreview bounds the length of previews, in characters.
+const maxPreview = 256
+
+// The keywords of the flags, as JMAP names them.
+const (
+	keywordSeen      = "$seen"
+	keywordFlagged   = "$flagged"
+	keywordImportant = "$important"
+	keywordAnswered  = "$answered"
+)
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+type bodyPart struct {
+	PartID      string  `json:"partId"`
+	BlobID      string  `json:"blobId"`
+	Size        int64   `json:"size"`
+	Name        *string `json:"name"`
+	Type        string  `json:"type"`
+	Charset     *string `json:"charset"`
+	Disposition *string `json:"disposition"`
+	CID         *string `json:"cid"`
+}
+
+type bodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+type emailHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// bodyOptions are the arguments of Email/get that say which body values to
+// fetch.
+type bodyOptions struct {
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+// jmapKeywords returns the keywords of a message, given whether it is read
+// and the keywords stored on it. Custom keywords are in lower case, as JMAP
+// compares them without case.
+func jmapKeywords(read bool, stored []string) map[string]bool {
+	keywords := map[string]bool{}
+	if read {
+		keywords[keywordSeen] = true
+	}
+	for _, k := range stored {
+		switch {
+		case strings.EqualFold(k, flags.KeywordStarred):
+			keywords[keywordFlagged] = true
+		case strings.EqualFold(k, flags.KeywordImportant):
+			keywords[keywordImportant] = true
+		case strings.EqualFold(k, flags.KeywordAnswered):
+			keywords[keywordAnswered] = true
+		case !strings.HasPrefix(k, `\`):
+			keywords[strings.ToLower(k)] = true
+		}
+	}
+	return keywords
+}
+
+// keywordChange returns the change that takes a message from the keywords
+// from to the keywords to.
+func keywordChange(from, to map[string]bool) flags.Change {
+	var c flags.Change
+	for k, f := range map[string]**bool{
+		keywordSeen:      &c.Read,
+		keywordFlagged:   &c.Starred,
+		keywordImportant: &c.Important,
+		keywordAnswered:  &c.Answered,
+	} {
+		if from[k] != to[k] {
+			v := to[k]
+			*f = &v
+		}
+	}
+	for k := range to {
+		if !from[k] && !flagKeyword(k) {
+			c.AddKeywords = append(c.AddKeywords, k)
+		}
+	}
+	for k := range from {
+		if !to[k] && !flagKeyword(k) {
+			c.RemoveKeywords = append(c.RemoveKeywords, k)
+		}
+	}
+	sort.Strings(c.AddKeywords)
+	sort.Strings(c.RemoveKeywords)
+	return c
+}
+
+func flagKeyword(k string) bool {
+	return k == keywordSeen || k == keywordFlagged || k == keywordImportant || k == keywordAnswered
+}
+
+// emptyChange reports whether c changes nothing.
+func emptyChange(c flags.Change) bool {
+	return c.Read == nil && c.Starred == nil && c.Important == nil && c.Answered == nil &&
+		len(c.AddKeywords) == 0 && len(c.RemoveKeywords) == 0
+}
+
+// messageIDs splits a space-separated list of message IDs, returning nil
+// for none.
+func messageIDs(s string) []string {
+	ids := strings.Fields(s)
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+func utcDate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func stringPtr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// preview returns the start of text with its whitespace collapsed.
+func preview(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= maxPreview {
+		return text
+	}
+	return string([]rune(text)[:maxPreview])
+}
+
+// truncate returns the first max bytes of s, or all of it if max is 0,
+// without splitting a character.
+func truncate(s string, max int) (string, bool) {
+	if max <= 0 || len(s) <= max {
+		return s, false
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max], true
+}
+
+// email reads a message as an Email with the given properties.
+func (s *Server) email(ctx context.Context, q *schema.Queries, m *mailboxes, msg schema.Message, props map[string]bool, opts bodyOptions) (map[string]interface{}, error) {
+	e := map[string]interface{}{"id": msg.ID}
+	set := func(prop string, v interface{}) {
+		if props[prop] {
+			e[prop] = v
+		}
+	}
+	set("blobId", messageBlobID(msg.ID))
+	set("threadId", msg.ThreadID)
+	set("size", msg.Size)
+	set("receivedAt", utcDate(msg.ReceivedAt))
+	set("sentAt", msg.SentAt.Format(time.RFC3339))
+	set("subject", msg.Subject)
+	set("hasAttachment", msg.HasAttachments)
+	set("messageId", messageIDs(msg.InternetMessageID))
+	set("inReplyTo", messageIDs(msg.InReplyTo))
+	set("references", messageIDs(msg.MessageReferences))
+
+	if props["mailboxIds"] {
+		names, err := q.ListMessageLabels(ctx, msg.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list message labels: %w", err)
+		}
+		e["mailboxIds"] = m.ids(msg.Archived, names)
+	}
+	if props["keywords"] {
+		stored, err := q.ListMessageKeywords(ctx, msg.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list message keywords: %w", err)
+		}
+		e["keywords"] = jmapKeywords(msg.IsRead, stored)
+	}
+
+	if props["from"] {
+		var from []emailAddress
+		if msg.FromAddress != "" {
+			from = []emailAddress{{Name: stringPtr(msg.FromName), Email: msg.FromAddress}}
+		}
+		e["from"] = from
+	}
+	if props["to"] || props["cc"] || props["bcc"] || props["replyTo"] {
+		addrs, err := q.ListMessageAddresses(ctx, msg.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list message addresses: %w", err)
+		}
+		byKind := map[string][]emailAddress{}
+		for _, a := range addrs {
+			byKind[a.Kind] = append(byKind[a.Kind], emailAddress{Name: stringPtr(a.Name), Email: a.Address})
+		}
+		set("to", byKind["to"])
+		set("cc", byKind["cc"])
+		set("bcc", byKind["bcc"])
+		set("replyTo", byKind["reply-to"])
+	}
+	if props["sender"] || props["headers"] {
+		headers, err := q.ListMessageHeaders(ctx, msg.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list message headers: %w", err)
+		}
+		var sender []emailAddress
+		list := make([]emailHeader, len(headers))
+		for i, h := range headers {
+			list[i] = emailHeader{Name: h.Name, Value: h.Value}
+			if sender == nil && strings.EqualFold(h.Name, "Sender") {
+				if a, err := mail.ParseAddress(h.Value); err == nil {
+					sender = []emailAddress{{Name: stringPtr(a.Name), Email: strings.ToLower(a.Address)}}
+				}
+			}
+		}
+		set("sender", sender)
+		set("headers", list)
+	}
+
+	if props["preview"] || props["bodyValues"] || props["textBody"] || props["htmlBody"] || props["attachments"] {
+		if err := s.emailBody(ctx, q, msg, props, opts, e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// emailBody adds the body properties of msg to e.
+func (s *Server) emailBody(ctx context.Context, q *schema.Queries, msg schema.Message, props map[string]bool, opts bodyOptions, e map[string]interface{}) error {
+	partProps, err := properties(opts.BodyProperties, bodyPartProperties, bodyPartProperties)
+	if err != nil {
+		return err
+	}
+	delete(partProps, "id")
+
+	body, err := q.GetMessageBody(ctx, msg.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get message body: %w", err)
+	}
+	text := bodyPart{PartID: partText, BlobID: textBlobID(msg.ID, partText), Size: int64(len(body.TextBody)),
+		Type: "text/plain", Charset: stringPtr("utf-8")}
+	html := bodyPart{PartID: partHTML, BlobID: textBlobID(msg.ID, partHTML), Size: int64(len(body.HtmlBody)),
+		Type: "text/html", Charset: stringPtr("utf-8")}
+
+	// Each list falls back to the other kind of body, as a client showing
+	// only one kind still has something to show
+	var textBody, htmlBody []bodyPart
+	switch {
+	case body.TextBody != "" && body.HtmlBody != "":
+		textBody, htmlBody = []bodyPart{text}, []bodyPart{html}
+	case body.TextBody != "":
+		textBody, htmlBody = []bodyPart{text}, []bodyPart{text}
+	case body.HtmlBody != "":
+		textBody, htmlBody = []bodyPart{html}, []bodyPart{html}
+	}
+
+	var attachments []bodyPart
+	if props["attachments"] {
+		atts, err := q.ListAttachments(ctx, msg.ID)
+		if err != nil {
+			return fmt.Errorf("failed to list attachments: %w", err)
+		}
+		for _, a := range atts {
+			attachments = append(attachments, bodyPart{
+				PartID:      a.Part,
+				BlobID:      attachmentBlobID(msg.ID, a.Part),
+				Size:        a.Size,
+				Name:        stringPtr(a.Filename),
+				Type:        a.ContentType,
+				Disposition: stringPtr(a.Disposition),
+				CID:         stringPtr(strings.Trim(a.ContentID, "<>")),
+			})
+		}
+	}
+
+	parts := func(list []bodyPart) ([]map[string]json.RawMessage, error) {
+		out := make([]map[string]json.RawMessage, 0, len(list))
+		for _, p := range list {
+			obj, err := project(p, partProps)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, obj)
+		}
+		return out, nil
+	}
+	for prop, list := range map[string][]bodyPart{"textBody": textBody, "htmlBody": htmlBody, "attachments": attachments} {
+		if !props[prop] {
+			continue
+		}
+		v, err := parts(list)
+		if err != nil {
+			return err
+		}
+		e[prop] = v
+	}
+
+	if props["preview"] {
+		p := body.TextBody
+		if p == "" {
+			p = htmlText(body.HtmlBody)
+		}
+		e["preview"] = preview(p)
+	}
+	if props["bodyValues"] {
+		values := map[string]bodyValue{}
+		content := map[string]string{partText: body.TextBody, partHTML: body.HtmlBody}
+		for _, fetch := range []struct {
+			on   bool
+			list []bodyPart
+		}{
+			{opts.FetchTextBodyValues || opts.FetchAllBodyValues, textBody},
+			{opts.FetchHTMLBodyValues || opts.FetchAllBodyValues, htmlBody},
+		} {
+			if !fetch.on {
+				continue
+			}
+			for _, p := range fetch.list {
+				v, truncated := truncate(content[p.PartID], opts.MaxBodyValueBytes)
+				values[p.PartID] = bodyValue{Value: v, IsTruncated: truncated}
+			}
+		}
+		e["bodyValues"] = values
+	}
+	return nil
+}
+
+// htmlText strips the tags from an HTML body for a preview.
+func htmlText(html string) string {
+	var b strings.Builder
+	in := false
+	for _, r := range html {
+		switch {
+		case r == '<':
+			in = true
+		case r == '>':
+			in = false
+			b.WriteByte(' ')
+		case !in:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (s *Server) getEmails(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		getArgs
+		bodyOptions
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.IDs == nil {
+		return nil, &methodError{Type: errRequestTooLarge, Description: "ids must be given"}
+	}
+	ids, err := args.ids(r)
+	if err != nil {
+		return nil, err
+	}
+	props, err := properties(args.Properties, emailProperties, defaultEmailProperties)
+	if err != nil {
+		return nil, err
+	}
+	if args.MaxBodyValueBytes < 0 {
+		return nil, invalidArguments("maxBodyValueBytes must not be negative")
+	}
+	state, err := s.state(ctx, r.userID, typeEmail)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.mailboxes(ctx, r.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	q := s.db.Queries()
+	resp := getResponse{AccountID: r.userID, State: state, List: []interface{}{}, NotFound: []string{}}
+	for i, id := range ids {
+		msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: r.userID})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				resp.NotFound = append(resp.NotFound, (*args.IDs)[i])
+				continue
+			}
+			return nil, fmt.Errorf("failed to get message: %w", err)
+		}
+		e, err := s.email(ctx, q, m, msg, props, args.bodyOptions)
+		if err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, e)
+	}
+	return resp, nil
+}
+
+// setEmails updates the keywords and Mailboxes of Emails and destroys them.
+// Emails are created with Email/import instead.
+func (s *Server) setEmails(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args setArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := args.check(r); err != nil {
+		return nil, err
+	}
+	state, err := s.checkState(ctx, r.userID, typeEmail, args.IfInState)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.applyEmailSet(ctx, r, args, state)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// applyEmailSet makes the changes of an Email/set, which also runs for the
+// onSuccess arguments of EmailSubmission/set.
+func (s *Server) applyEmailSet(ctx context.Context, r *request, args setArgs, state string) (*setResponse, error) {
+	resp := newSetResponse(r.userID, state)
+	for _, cid := range sortedKeys(args.Create) {
+		resp.NotCreated[cid] = &setError{Type: setForbidden, Description: "Emails are created with Email/import"}
+	}
+
+	m, err := s.mailboxes(ctx, r.userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range sortedKeys(args.Update) {
+		actual, err := s.updateEmail(ctx, r, m, id, args.Update[id])
+		if err != nil {
+			var se *setError
+			if !errors.As(err, &se) {
+				return nil, err
+			}
+			resp.NotUpdated[id] = se
+			continue
+		}
+		if actual != nil {
+			resp.Updated[id] = map[string]interface{}{"mailboxIds": actual}
+		} else {
+			resp.Updated[id] = nil
+		}
+	}
+
+	for _, id := range args.Destroy {
+		deleted, err := s.destroyEmail(ctx, r.userID, id)
+		if err != nil {
+			return nil, err
+		}
+		if !deleted {
+			resp.NotDestroyed[id] = &setError{Type: setNotFound}
+			continue
+		}
+		resp.Destroyed = append(resp.Destroyed, id)
+	}
+
+	if resp.NewState, err = s.state(ctx, r.userID, typeEmail); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// updateEmail applies a patch of keywords and mailboxIds to an Email. If
+// the Email doesn't end up in exactly the Mailboxes asked for, such as when
+// it is taken out of Inbox and so lands in Archive, it returns the ones it
+// is in.
+func (s *Server) updateEmail(ctx context.Context, r *request, m *mailboxes, id string, patch map[string]json.RawMessage) (map[string]bool, error) {
+	id, _ = r.resolveID(id)
+	var actual map[string]bool
+	err := s.db.WithTx(ctx, func(q *schema.Queries) error {
+		msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: r.userID})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return &setError{Type: setNotFound}
+			}
+			return fmt.Errorf("failed to get message: %w", err)
+		}
+		names, err := q.ListMessageLabels(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to list message labels: %w", err)
+		}
+		stored, err := q.ListMessageKeywords(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to list message keywords: %w", err)
+		}
+		oldMailboxes := m.ids(msg.Archived, names)
+		oldKeywords := jmapKeywords(msg.IsRead, stored)
+
+		newMailboxes, newKeywords, err := applyPatch(r, oldMailboxes, oldKeywords, patch)
+		if err != nil {
+			return err
+		}
+		if len(newMailboxes) == 0 {
+			return invalidProperties("An Email must be in a mailbox", "mailboxIds")
+		}
+		for mid := range newMailboxes {
+			if _, ok := m.byID[mid]; !ok {
+				return invalidProperties("No such mailbox "+mid, "mailboxIds")
+			}
+		}
+
+		if c := keywordChange(oldKeywords, newKeywords); !emptyChange(c) {
+			if err := flags.ApplyTx(ctx, q, r.userID, id, c); err != nil {
+				if errors.Is(err, flags.ErrInvalidChange) {
+					return invalidProperties(err.Error(), "keywords")
+				}
+				return err
+			}
+		}
+
+		// Mailboxes are taken away before others are added, so that moving
+		// a message out of Trash into Inbox leaves it there
+		var added []string
+		for mid := range oldMailboxes {
+			if !newMailboxes[mid] {
+				if err := labels.Remove(ctx, q, r.userID, id, m.byID[mid].Path); err != nil {
+					return err
+				}
+			}
+		}
+		for mid := range newMailboxes {
+			if !oldMailboxes[mid] {
+				if err := labels.Add(ctx, q, r.userID, id, m.byID[mid].Path); err != nil {
+					return err
+				}
+				added = append(added, m.byID[mid].Path)
+			}
+		}
+		if len(added) > 0 {
+			sort.Strings(added)
+			err := webhook.PublishTx(ctx, q, r.userID, webhook.EventMessageLabeled, webhook.MessageLabeled{MessageID: id, Labels: added})
+			if err != nil {
+				return err
+			}
+		}
+
+		if msg, err = q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: r.userID}); err != nil {
+			return fmt.Errorf("failed to get message: %w", err)
+		}
+		if names, err = q.ListMessageLabels(ctx, id); err != nil {
+			return fmt.Errorf("failed to list message labels: %w", err)
+		}
+		if ids := m.ids(msg.Archived, names); !sameSet(ids, newMailboxes) {
+			actual = ids
+		}
+		return nil
+	})
+	return actual, err
+}
+
+func sameSet(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyPatch returns the Mailboxes and keywords of an Email after patch.
+func applyPatch(r *request, mailboxIDs, keywords map[string]bool, patch map[string]json.RawMessage) (map[string]bool, map[string]bool, error) {
+	mailboxIDs, keywords = copySet(mailboxIDs), copySet(keywords)
+	for path, v := range patch {
+		prop, key, _ := strings.Cut(path, "/")
+		key = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+		switch {
+		case prop == "keywords" && key == "":
+			set, err := decodeSet(v)
+			if err != nil {
+				return nil, nil, invalidProperties(err.Error(), prop)
+			}
+			keywords = map[string]bool{}
+			for k := range set {
+				keywords[strings.ToLower(k)] = true
+			}
+		case prop == "mailboxIds" && key == "":
+			set, err := decodeSet(v)
+			if err != nil {
+				return nil, nil, invalidProperties(err.Error(), prop)
+			}
+			mailboxIDs = map[string]bool{}
+			for id := range set {
+				id, _ = r.resolveID(id)
+				mailboxIDs[id] = true
+			}
+		case prop == "keywords" || prop == "mailboxIds":
+			var on *bool
+			if err := json.Unmarshal(v, &on); err != nil || (on != nil && !*on) {
+				return nil, nil, &setError{Type: setInvalidPatch, Description: path + " must be true or null"}
+			}
+			target := keywords
+			if prop == "keywords" {
+				key = strings.ToLower(key)
+			} else {
+				target = mailboxIDs
+				key, _ = r.resolveID(key)
+			}
+			if on != nil {
+				target[key] = true
+			} else {
+				delete(target, key)
+			}
+		default:
+			return nil, nil, invalidProperties(prop+" can't be changed", prop)
+		}
+	}
+	return mailboxIDs, keywords, nil
+}
+
+// decodeSet decodes a set of strings, given as an object whose values are
+// all true.
+func decodeSet(v json.RawMessage) (map[string]bool, error) {
+	var set map[string]bool
+	if err := json.Unmarshal(v, &set); err != nil {
+		return nil, err
+	}
+	for k, on := range set {
+		if !on {
+			return nil, fmt.Errorf("the value of %s must be true", k)
+		}
+	}
+	return set, nil
+}
+
+func copySet(set map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(set))
+	for k, v := range set {
+		c[k] = v
+	}
+	return c
+}
+
+// destroyEmail deletes one of userID's messages, reporting whether it
+// existed.
+func (s *Server) destroyEmail(ctx context.Context, userID, id string) (bool, error) {
+	var deleted bool
+	err := s.db.WithTx(ctx, func(q *schema.Queries) error {
+		var err error
+		if deleted, err = database.DeleteMessageTx(ctx, q, userID, id); err != nil || !deleted {
+			return err
+		}
+		return webhook.PublishTx(ctx, q, userID, webhook.EventMessageDeleted, webhook.MessageDeleted{MessageID: id})
+	})
+	return deleted, err
+}
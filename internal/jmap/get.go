@@ -0,0 +1,128 @@
+package jmap
+
+import "encoding/json"
+
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+}
+
+type getResponse struct {
+	AccountID string        `json:"accountId"`
+	State     string        `json:"state"`
+	List      []interface{} `json:"list"`
+	NotFound  []string      `json:"notFound"`
+}
+
+// ids returns the IDs a /get call asks for, with creation IDs resolved, or
+// nil if it asks for all of them. IDs of objects not created in the request
+// come back as "".
+func (a getArgs) ids(r *request) ([]string, error) {
+	if a.IDs == nil {
+		return nil, nil
+	}
+	if len(*a.IDs) > maxObjectsInGet {
+		return nil, &methodError{Type: errRequestTooLarge}
+	}
+	ids := make([]string, len(*a.IDs))
+	for i, id := range *a.IDs {
+		ids[i], _ = r.resolveID(id)
+	}
+	return ids, nil
+}
+
+// properties returns the properties a /get call asks for, which must be
+// among all, or defaults if it doesn't say. The id is always included.
+func properties(asked *[]string, all, defaults []string) (map[string]bool, error) {
+	list := defaults
+	if asked != nil {
+		list = *asked
+	}
+	known := map[string]bool{}
+	for _, p := range all {
+		known[p] = true
+	}
+	props := map[string]bool{"id": true}
+	for _, p := range list {
+		if !known[p] {
+			return nil, invalidArguments("unknown property %s", p)
+		}
+		props[p] = true
+	}
+	return props, nil
+}
+
+// project returns the properties of v, an object that encodes to JSON, that
+// are in props.
+func project(v interface{}, props map[string]bool) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	out := make(map[string]json.RawMessage, len(props))
+	for p := range props {
+		if v, ok := all[p]; ok {
+			out[p] = v
+		}
+	}
+	return out, nil
+}
+
+type setArgs struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+// check returns an error if the call is for another account or changes too
+// many objects.
+func (a setArgs) check(r *request) error {
+	if err := r.checkAccount(a.AccountID); err != nil {
+		return err
+	}
+	if len(a.Create)+len(a.Update)+len(a.Destroy) > maxObjectsInSet {
+		return &methodError{Type: errRequestTooLarge}
+	}
+	return nil
+}
+
+type setResponse struct {
+	AccountID    string                 `json:"accountId"`
+	OldState     string                 `json:"oldState"`
+	NewState     string                 `json:"newState"`
+	Created      map[string]interface{} `json:"created"`
+	Updated      map[string]interface{} `json:"updated"`
+	Destroyed    []string               `json:"destroyed"`
+	NotCreated   map[string]*setError   `json:"notCreated"`
+	NotUpdated   map[string]*setError   `json:"notUpdated"`
+	NotDestroyed map[string]*setError   `json:"notDestroyed"`
+}
+
+func newSetResponse(accountID, state string) *setResponse {
+	return &setResponse{
+		AccountID:    accountID,
+		OldState:     state,
+		Created:      map[string]interface{}{},
+		Updated:      map[string]interface{}{},
+		Destroyed:    []string{},
+		NotCreated:   map[string]*setError{},
+		NotUpdated:   map[string]*setError{},
+		NotDestroyed: map[string]*setError{},
+	}
+}
+
+// decodeObject decodes the properties of an object being created, which
+// must all be known to v.
+func decodeObject(raw json.RawMessage, v interface{}) *setError {
+	if err := decodeArgs(raw, v); err != nil {
+		return invalidProperties(err.(*methodError).Description)
+	}
+	return nil
+}
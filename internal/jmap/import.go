@@ -0,0 +1,160 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+type emailImport struct {
+	BlobID     string          `json:"blobId"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt *time.Time      `json:"receivedAt"`
+}
+
+type importResponse struct {
+	AccountID  string                 `json:"accountId"`
+	OldState   string                 `json:"oldState"`
+	NewState   string                 `json:"newState"`
+	Created    map[string]interface{} `json:"created"`
+	NotCreated map[string]*setError   `json:"notCreated"`
+}
+
+// importEmails stores uploaded messages as the user's own, as a client does
+// to save a sent message or a draft: the rules, sieve scripts and webhooks
+// that act on received mail don't run on them.
+func (s *Server) importEmails(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID string                     `json:"accountId"`
+		IfInState *string                    `json:"ifInState"`
+		Emails    map[string]json.RawMessage `json:"emails"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if len(args.Emails) > maxObjectsInSet {
+		return nil, &methodError{Type: errRequestTooLarge}
+	}
+	state, err := s.checkState(ctx, r.userID, typeEmail, args.IfInState)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := importResponse{AccountID: r.userID, OldState: state, Created: map[string]interface{}{}, NotCreated: map[string]*setError{}}
+	for _, cid := range sortedKeys(args.Emails) {
+		created, err := s.importEmail(ctx, r, args.Emails[cid])
+		if err != nil {
+			var se *setError
+			if !errors.As(err, &se) {
+				return nil, err
+			}
+			resp.NotCreated[cid] = se
+			continue
+		}
+		r.created[cid] = created.ID
+		resp.Created[cid] = map[string]interface{}{
+			"id":       created.ID,
+			"blobId":   messageBlobID(created.ID),
+			"threadId": created.ThreadID,
+			"size":     created.Size,
+		}
+	}
+
+	if resp.NewState, err = s.state(ctx, r.userID, typeEmail); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *Server) importEmail(ctx context.Context, r *request, raw json.RawMessage) (schema.Message, error) {
+	var e emailImport
+	if err := decodeObject(raw, &e); err != nil {
+		return schema.Message{}, err
+	}
+	m, err := s.mailboxes(ctx, r.userID)
+	if err != nil {
+		return schema.Message{}, err
+	}
+	var names []string
+	inbox := false
+	for id, on := range e.MailboxIDs {
+		id, _ = r.resolveID(id)
+		l, ok := m.byID[id]
+		if !on || !ok {
+			return schema.Message{}, invalidProperties("No such mailbox "+id, "mailboxIds")
+		}
+		names = append(names, l.Path)
+		inbox = inbox || l.Path == labels.Inbox
+	}
+	if len(names) == 0 {
+		return schema.Message{}, invalidProperties("An Email must be in a mailbox", "mailboxIds")
+	}
+	keywords := map[string]bool{}
+	for k, on := range e.Keywords {
+		if !on {
+			return schema.Message{}, invalidProperties("Keyword values must be true", "keywords")
+		}
+		keywords[strings.ToLower(k)] = true
+	}
+
+	b, err := s.blob(ctx, r.userID, e.BlobID)
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return schema.Message{}, &setError{Type: setBlobNotFound}
+		}
+		return schema.Message{}, err
+	}
+
+	d := mailstore.Delivery{
+		UserID:   r.userID,
+		Raw:      b.data,
+		Outgoing: true,
+		Tx: func(ctx context.Context, q *schema.Queries, id string) error {
+			for _, name := range names {
+				if err := labels.Add(ctx, q, r.userID, id, name); err != nil {
+					return err
+				}
+			}
+			if !inbox {
+				// New messages are in the Inbox until taken out of it
+				if err := labels.Remove(ctx, q, r.userID, id, labels.Inbox); err != nil {
+					return err
+				}
+			}
+			if c := keywordChange(map[string]bool{}, keywords); !emptyChange(c) {
+				if err := flags.ApplyTx(ctx, q, r.userID, id, c); err != nil {
+					if errors.Is(err, flags.ErrInvalidChange) {
+						return invalidProperties(err.Error(), "keywords")
+					}
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	if e.ReceivedAt != nil {
+		d.ReceivedAt = *e.ReceivedAt
+	}
+	id, err := s.store.Deliver(ctx, d)
+	if err != nil {
+		switch {
+		case errors.Is(err, mailstore.ErrMessageTooLarge):
+			return schema.Message{}, &setError{Type: setTooLarge}
+		case errors.Is(err, mailstore.ErrMalformedMessage), errors.Is(err, mailstore.ErrEmptyMessage):
+			return schema.Message{}, &setError{Type: setInvalidEmail, Description: err.Error()}
+		}
+		return schema.Message{}, err
+	}
+	return s.db.Queries().GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: r.userID})
+}
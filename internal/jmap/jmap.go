@@ -0,0 +1,328 @@
+// Package jmap serves users' mail to JMAP clients (RFC 8620 and RFC 8621).
+// Labels are Mailboxes, stored messages are Emails and conversations are
+// Threads, and Emails are sent with EmailSubmission through the outbound
+// relay. Clients authenticate with the same Bearer JWTs as the REST API,
+// and the account ID is the user's ID.
+//
+// States are the per-user counters of the jmap_state table, which triggers
+// bump on every change to the user's messages and labels. What changed
+// between two states isn't recorded, so the /changes methods answer
+// cannotCalculateChanges once a client's state is out of date and the
+// client fetches again; the event source tells it when that is.
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+// The capabilities the server supports.
+const (
+	CapabilityCore       = "urn:ietf:params:jmap:core"
+	CapabilityMail       = "urn:ietf:params:jmap:mail"
+	CapabilitySubmission = "urn:ietf:params:jmap:submission"
+)
+
+// Limits advertised in the core capability.
+const (
+	maxSizeRequest        = 10 << 20
+	maxConcurrentUpload   = 4
+	maxConcurrentRequests = 4
+	maxCallsInRequest     = 16
+	maxObjectsInGet       = 500
+	maxObjectsInSet       = 500
+)
+
+// defaultPushInterval is how often the event source checks for changes.
+const defaultPushInterval = 2 * time.Second
+
+// Server answers JMAP requests for the users of a mail store.
+type Server struct {
+	db     database.Service
+	store  *mailstore.Store
+	labels *labels.Service
+	flags  *flags.Service
+	mailer *outbound.Mailer // nil when outbound mail is not configured
+
+	// publicURL is the URL clients reach the server at, from JMAP_BASE_URL;
+	// empty derives it from each request.
+	publicURL string
+
+	// pushInterval is how often event sources poll the states.
+	pushInterval time.Duration
+
+	methods map[string]method
+}
+
+// method runs one method call with its arguments and returns the response
+// arguments, or an error that is a *methodError for errors the client
+// should see.
+type method func(ctx context.Context, r *request, args json.RawMessage) (interface{}, error)
+
+// New creates a Server over store. EmailSubmission is only offered when
+// mailer is set. The URLs in the session resource are under JMAP_BASE_URL,
+// e.g. https://mail.example.com, or the host of the session request if it
+// isn't set.
+func New(store *mailstore.Store, mailer *outbound.Mailer) *Server {
+	s := &Server{
+		db:           store.DB(),
+		store:        store,
+		labels:       labels.New(store.DB()),
+		flags:        flags.New(store.DB()),
+		mailer:       mailer,
+		publicURL:    strings.TrimSuffix(os.Getenv("JMAP_BASE_URL"), "/"),
+		pushInterval: defaultPushInterval,
+	}
+	s.methods = map[string]method{
+		"Core/echo": s.echo,
+
+		"Mailbox/get":     s.getMailboxes,
+		"Mailbox/changes": s.changes(typeMailbox),
+		"Mailbox/query":   s.queryMailboxes,
+		"Mailbox/set":     s.setMailboxes,
+
+		"Email/get":          s.getEmails,
+		"Email/changes":      s.changes(typeEmail),
+		"Email/query":        s.queryEmails,
+		"Email/queryChanges": s.queryChanges(typeEmail),
+		"Email/set":          s.setEmails,
+		"Email/import":       s.importEmails,
+
+		"Thread/get":     s.getThreads,
+		"Thread/changes": s.changes(typeThread),
+	}
+	if mailer != nil {
+		s.methods["Identity/get"] = s.getIdentities
+		s.methods["Identity/changes"] = s.changes(typeIdentity)
+		s.methods["EmailSubmission/get"] = s.getSubmissions
+		s.methods["EmailSubmission/changes"] = s.changes(typeEmailSubmission)
+		s.methods["EmailSubmission/query"] = s.querySubmissions
+		s.methods["EmailSubmission/set"] = s.setSubmissions
+	}
+	return s
+}
+
+// SetPushInterval changes how often event sources check for changes.
+func (s *Server) SetPushInterval(d time.Duration) {
+	s.pushInterval = d
+}
+
+// capabilities returns the capabilities of the session, keyed by URI, and
+// those of the account.
+func (s *Server) capabilities() (session, account map[string]interface{}) {
+	session = map[string]interface{}{
+		CapabilityCore: coreCapability{
+			MaxSizeUpload:         s.store.MaxMessageSize(),
+			MaxConcurrentUpload:   maxConcurrentUpload,
+			MaxSizeRequest:        maxSizeRequest,
+			MaxConcurrentRequests: maxConcurrentRequests,
+			MaxCallsInRequest:     maxCallsInRequest,
+			MaxObjectsInGet:       maxObjectsInGet,
+			MaxObjectsInSet:       maxObjectsInSet,
+			CollationAlgorithms:   []string{"i;ascii-casemap"},
+		},
+		CapabilityMail: struct{}{},
+	}
+	account = map[string]interface{}{
+		CapabilityMail: mailCapability{
+			MaxSizeMailboxName:         maxMailboxName,
+			MaxSizeAttachmentsPerEmail: s.store.MaxMessageSize(),
+			EmailQuerySortOptions:      sortProperties(),
+			MayCreateTopLevelMailbox:   true,
+		},
+	}
+	if s.mailer != nil {
+		session[CapabilitySubmission] = struct{}{}
+		account[CapabilitySubmission] = submissionCapability{SubmissionExtensions: map[string][]string{}}
+	}
+	return session, account
+}
+
+type coreCapability struct {
+	MaxSizeUpload         int64    `json:"maxSizeUpload"`
+	MaxConcurrentUpload   int      `json:"maxConcurrentUpload"`
+	MaxSizeRequest        int      `json:"maxSizeRequest"`
+	MaxConcurrentRequests int      `json:"maxConcurrentRequests"`
+	MaxCallsInRequest     int      `json:"maxCallsInRequest"`
+	MaxObjectsInGet       int      `json:"maxObjectsInGet"`
+	MaxObjectsInSet       int      `json:"maxObjectsInSet"`
+	CollationAlgorithms   []string `json:"collationAlgorithms"`
+}
+
+type mailCapability struct {
+	MaxMailboxesPerEmail       *int     `json:"maxMailboxesPerEmail"`
+	MaxMailboxDepth            *int     `json:"maxMailboxDepth"`
+	MaxSizeMailboxName         int      `json:"maxSizeMailboxName"`
+	MaxSizeAttachmentsPerEmail int64    `json:"maxSizeAttachmentsPerEmail"`
+	EmailQuerySortOptions      []string `json:"emailQuerySortOptions"`
+	MayCreateTopLevelMailbox   bool     `json:"mayCreateTopLevelMailbox"`
+}
+
+type submissionCapability struct {
+	MaxDelayedSend       int                 `json:"maxDelayedSend"`
+	SubmissionExtensions map[string][]string `json:"submissionExtensions"`
+}
+
+// methodCapability returns the capability a method belongs to, which the
+// request must use.
+func methodCapability(name string) string {
+	typ, _, _ := strings.Cut(name, "/")
+	switch typ {
+	case "Core":
+		return CapabilityCore
+	case "Identity", "EmailSubmission":
+		return CapabilitySubmission
+	default:
+		return CapabilityMail
+	}
+}
+
+// Invocation is a method call or response: a name, its arguments and the
+// client's call ID, sent as a three-element JSON array.
+type Invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (inv Invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{inv.Name, inv.Args, inv.CallID})
+}
+
+func (inv *Invocation) UnmarshalJSON(b []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(b, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("an invocation has 3 elements, not %d", len(parts))
+	}
+	if err := json.Unmarshal(parts[0], &inv.Name); err != nil {
+		return fmt.Errorf("invalid method name: %w", err)
+	}
+	if err := json.Unmarshal(parts[2], &inv.CallID); err != nil {
+		return fmt.Errorf("invalid call ID: %w", err)
+	}
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(parts[1], &args); err != nil || args == nil {
+		return fmt.Errorf("method arguments must be an object")
+	}
+	inv.Args = parts[1]
+	return nil
+}
+
+// Request is the body of an API request.
+type Request struct {
+	Using       []string          `json:"using"`
+	MethodCalls []Invocation      `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds,omitempty"`
+}
+
+// Response is the body of an API response.
+type Response struct {
+	MethodResponses []Invocation      `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// Method-level error types (RFC 8620 section 3.6.2 and the errors of the
+// standard methods).
+const (
+	errUnknownMethod          = "unknownMethod"
+	errInvalidArguments       = "invalidArguments"
+	errInvalidResultReference = "invalidResultReference"
+	errAccountNotFound        = "accountNotFound"
+	errServerFail             = "serverFail"
+	errCannotCalculateChanges = "cannotCalculateChanges"
+	errAnchorNotFound         = "anchorNotFound"
+	errUnsupportedFilter      = "unsupportedFilter"
+	errUnsupportedSort        = "unsupportedSort"
+	errStateMismatch          = "stateMismatch"
+	errRequestTooLarge        = "requestTooLarge"
+)
+
+// methodError is an error response to a method call.
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string {
+	if e.Description == "" {
+		return e.Type
+	}
+	return e.Type + ": " + e.Description
+}
+
+func invalidArguments(format string, args ...interface{}) *methodError {
+	return &methodError{Type: errInvalidArguments, Description: fmt.Sprintf(format, args...)}
+}
+
+// SetError types used by the /set and /import methods.
+const (
+	setForbidden         = "forbidden"
+	setNotFound          = "notFound"
+	setInvalidProperties = "invalidProperties"
+	setInvalidPatch      = "invalidPatch"
+	setTooLarge          = "tooLarge"
+	setBlobNotFound      = "blobNotFound"
+	setInvalidEmail      = "invalidEmail"
+	setMailboxHasChild   = "mailboxHasChild"
+	setMailboxHasEmail   = "mailboxHasEmail"
+	setNoRecipients      = "noRecipients"
+	setInvalidRecipients = "invalidRecipients"
+	setForbiddenFrom     = "forbiddenFrom"
+	setForbiddenMailFrom = "forbiddenMailFrom"
+	setForbiddenToSend   = "forbiddenToSend"
+	setTooManyRecipients = "tooManyRecipients"
+)
+
+// setError is why one object of a /set or /import call wasn't created,
+// updated or destroyed.
+type setError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+func (e *setError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func invalidProperties(description string, properties ...string) *setError {
+	return &setError{Type: setInvalidProperties, Description: description, Properties: properties}
+}
+
+// decodeArgs decodes method arguments into v, rejecting arguments the
+// method doesn't know.
+func decodeArgs(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return invalidArguments("%v", err)
+	}
+	return nil
+}
+
+// checkAccount returns accountNotFound unless id is the account of r.
+func (r *request) checkAccount(id string) error {
+	if id != r.userID {
+		return &methodError{Type: errAccountNotFound}
+	}
+	return nil
+}
+
+func (s *Server) echo(ctx context.Context, r *request, args json.RawMessage) (interface{}, error) {
+	return args, nil
+}
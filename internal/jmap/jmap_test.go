@@ -0,0 +1,519 @@
+package jmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/golang-jwt/jwt"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+const testSecret = "test-secret"
+
+const testRaw = "From: Alice <alice@example.org>\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"Message-ID: <hello@example.org>\r\n" +
+	"Date: Mon, 02 Jun 2025 10:00:00 +0000\r\n" +
+	"\r\n" +
+	"Hi there.\r\n"
+
+// testRelay is a plain SMTP relay that accepts any mail.
+type testRelay struct {
+	mu   sync.Mutex
+	rcpt []string
+}
+
+func (r *testRelay) NewSession(*smtp.Conn) (smtp.Session, error) { return &relaySession{r}, nil }
+
+type relaySession struct{ relay *testRelay }
+
+func (s *relaySession) Mail(string, *smtp.MailOptions) error { return nil }
+func (s *relaySession) Rcpt(to string, _ *smtp.RcptOptions) error {
+	s.relay.mu.Lock()
+	defer s.relay.mu.Unlock()
+	s.relay.rcpt = append(s.relay.rcpt, to)
+	return nil
+}
+func (s *relaySession) Data(r io.Reader) error { _, err := io.Copy(io.Discard, r); return err }
+func (s *relaySession) Reset()                 {}
+func (s *relaySession) Logout() error          { return nil }
+
+// testServer is the JMAP API over a test database in which u1
+// (user@example.com) and u2 are users, sending mail through a testRelay.
+type testServer struct {
+	*httptest.Server
+	db    database.Service
+	store *mailstore.Store
+	relay *testRelay
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	t.Setenv("AUTH_SECRET", testSecret)
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+
+	relay := &testRelay{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpServer := smtp.NewServer(relay)
+	go smtpServer.Serve(ln)
+	t.Cleanup(func() { smtpServer.Close() })
+	mailer := outbound.NewMailer(outbound.Config{Addr: ln.Addr().String(), TLS: outbound.TLSNone, Hostname: "localhost"}, store)
+
+	s := New(store, mailer)
+	s.SetPushInterval(20 * time.Millisecond)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jmap", s.HandleSession)
+	mux.HandleFunc("POST /jmap/api", s.HandleAPI)
+	mux.HandleFunc("GET /jmap/download/{account}/{blob}/{name}", s.HandleDownload)
+	mux.HandleFunc("POST /jmap/upload/{account}/{$}", s.HandleUpload)
+	mux.HandleFunc("GET /jmap/eventsource", s.HandleEventSource)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return &testServer{Server: ts, db: db, store: store, relay: relay}
+}
+
+func token(t *testing.T, userID string) string {
+	t.Helper()
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"ID":  userID,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + tok
+}
+
+func (ts *testServer) do(t *testing.T, method, userID, path string, body io.Reader) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != "" {
+		req.Header.Set("Authorization", token(t, userID))
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// deliver stores raw as a message received by userID.
+func (ts *testServer) deliver(t *testing.T, userID, raw string) string {
+	t.Helper()
+	id, err := ts.store.Deliver(context.Background(), mailstore.Delivery{UserID: userID, Raw: []byte(raw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// call makes a JMAP request as u1 with the method calls, given as
+// [name, args, callId] JSON, and returns the method responses.
+func (ts *testServer) call(t *testing.T, calls ...string) []Invocation {
+	t.Helper()
+	body := `{"using": ["urn:ietf:params:jmap:core", "urn:ietf:params:jmap:mail", "urn:ietf:params:jmap:submission"],
+		"methodCalls": [` + strings.Join(calls, ",") + `]}`
+	resp, got := ts.do(t, http.MethodPost, "u1", "/jmap/api", strings.NewReader(body))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, got)
+	}
+	var r Response
+	if err := json.Unmarshal([]byte(got), &r); err != nil {
+		t.Fatal(err)
+	}
+	return r.MethodResponses
+}
+
+// result decodes the arguments of the response named name into v.
+func result(t *testing.T, responses []Invocation, name, callID string, v interface{}) {
+	t.Helper()
+	for _, inv := range responses {
+		if inv.CallID != callID {
+			continue
+		}
+		if inv.Name != name {
+			t.Fatalf("%s: got %s %s", callID, inv.Name, inv.Args)
+		}
+		if err := json.Unmarshal(inv.Args, v); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Fatalf("no %s response for %s", name, callID)
+}
+
+func TestSession(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodGet, "", "/.well-known/jmap", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a token: got status %d", resp.StatusCode)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/.well-known/jmap", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var s struct {
+		Username        string
+		APIURL          string `json:"apiUrl"`
+		PrimaryAccounts map[string]string
+		Capabilities    map[string]json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Username != "user@example.com" || s.PrimaryAccounts[CapabilityMail] != "u1" || s.APIURL != ts.URL+"/jmap/api" {
+		t.Errorf("got session %s", body)
+	}
+	if _, ok := s.Capabilities[CapabilitySubmission]; !ok {
+		t.Errorf("submission missing: %s", body)
+	}
+
+	for _, c := range []struct {
+		name, body string
+		wantStatus int
+	}{
+		{"not json", `{`, http.StatusBadRequest},
+		{"no calls", `{"using": []}`, http.StatusBadRequest},
+		{"unknown capability", `{"using": ["urn:example"], "methodCalls": []}`, http.StatusBadRequest},
+	} {
+		resp, got := ts.do(t, http.MethodPost, "u1", "/jmap/api", strings.NewReader(c.body))
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s: got status %d, want %d: %s", c.name, resp.StatusCode, c.wantStatus, got)
+		}
+	}
+
+	responses := ts.call(t,
+		`["Core/echo", {"hello": true}, "0"]`,
+		`["Mailbox/get", {"accountId": "u2"}, "1"]`,
+		`["Email/nope", {}, "2"]`)
+	var echo map[string]bool
+	result(t, responses, "Core/echo", "0", &echo)
+	var e methodError
+	result(t, responses, "error", "1", &e)
+	if !echo["hello"] || e.Type != errAccountNotFound {
+		t.Errorf("got %+v", responses)
+	}
+	result(t, responses, "error", "2", &e)
+	if e.Type != errUnknownMethod {
+		t.Errorf("unknown method: got %s", e.Type)
+	}
+}
+
+func TestMailboxes(t *testing.T) {
+	ts := newTestServer(t)
+	ts.deliver(t, "u1", testRaw)
+
+	responses := ts.call(t,
+		`["Mailbox/set", {"accountId": "u1", "create": {"w": {"name": "Work"}, "a": {"name": "Acme", "parentId": "#w"}}}, "0"]`,
+		`["Mailbox/get", {"accountId": "u1"}, "1"]`,
+		`["Mailbox/query", {"accountId": "u1", "filter": {"role": "inbox"}}, "2"]`)
+	var set setResponse
+	result(t, responses, "Mailbox/set", "0", &set)
+	if len(set.Created) != 2 || len(set.NotCreated) != 0 {
+		t.Fatalf("got %+v", set)
+	}
+	var get struct {
+		State string
+		List  []mailbox
+	}
+	result(t, responses, "Mailbox/get", "1", &get)
+	byName := map[string]mailbox{}
+	for _, m := range get.List {
+		byName[m.Name] = m
+	}
+	inbox := byName["Inbox"]
+	if inbox.Role == nil || *inbox.Role != "inbox" || inbox.TotalEmails != 1 || inbox.UnreadEmails != 1 || inbox.TotalThreads != 1 {
+		t.Errorf("got Inbox %+v", inbox)
+	}
+	if spam := byName["Spam"]; spam.Role == nil || *spam.Role != "junk" {
+		t.Errorf("got Spam %+v", spam)
+	}
+	if acme := byName["Acme"]; acme.ParentID == nil || *acme.ParentID != byName["Work"].ID {
+		t.Errorf("got Acme %+v", acme)
+	}
+	var query queryResponse
+	result(t, responses, "Mailbox/query", "2", &query)
+	if len(query.IDs) != 1 || query.IDs[0] != inbox.ID {
+		t.Errorf("got query %+v", query)
+	}
+
+	responses = ts.call(t,
+		`["Mailbox/set", {"accountId": "u1", "update": {"`+inbox.ID+`": {"name": "Box"}},
+			"destroy": ["`+byName["Work"].ID+`"]}, "0"]`,
+		`["Mailbox/changes", {"accountId": "u1", "sinceState": "`+set.OldState+`"}, "1"]`)
+	result(t, responses, "Mailbox/set", "0", &set)
+	if set.NotUpdated[inbox.ID] == nil || set.NotDestroyed[byName["Work"].ID].Type != setMailboxHasChild {
+		t.Errorf("got %+v", set)
+	}
+	var e methodError
+	result(t, responses, "error", "1", &e)
+	if e.Type != errCannotCalculateChanges {
+		t.Errorf("changes: got %s", e.Type)
+	}
+}
+
+func TestEmails(t *testing.T) {
+	ts := newTestServer(t)
+	id := ts.deliver(t, "u1", testRaw)
+	ts.deliver(t, "u2", testRaw)
+
+	responses := ts.call(t,
+		`["Email/query", {"accountId": "u1", "filter": {"text": "there"}}, "0"]`,
+		`["Email/get", {"accountId": "u1", "#ids": {"resultOf": "0", "name": "Email/query", "path": "/ids"},
+			"properties": ["subject", "from", "keywords", "mailboxIds", "threadId", "bodyValues", "textBody"],
+			"fetchTextBodyValues": true}, "1"]`,
+		`["Thread/get", {"accountId": "u1", "#ids": {"resultOf": "1", "name": "Email/get", "path": "/list/*/threadId"}}, "2"]`)
+	var query queryResponse
+	result(t, responses, "Email/query", "0", &query)
+	if len(query.IDs) != 1 || query.IDs[0] != id {
+		t.Fatalf("got query %+v", query)
+	}
+	var get struct {
+		State string
+		List  []struct {
+			Subject    string
+			From       []emailAddress
+			Keywords   map[string]bool
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+			ThreadID   string          `json:"threadId"`
+			TextBody   []bodyPart
+			BodyValues map[string]bodyValue
+		}
+	}
+	result(t, responses, "Email/get", "1", &get)
+	if len(get.List) != 1 {
+		t.Fatalf("got %+v", get)
+	}
+	e := get.List[0]
+	if e.Subject != "Hello" || len(e.From) != 1 || e.From[0].Email != "alice@example.org" || len(e.Keywords) != 0 || !e.MailboxIDs["inbox"] {
+		t.Errorf("got email %+v", e)
+	}
+	if len(e.TextBody) != 1 || !strings.Contains(e.BodyValues[e.TextBody[0].PartID].Value, "Hi there.") {
+		t.Errorf("got body %+v %+v", e.TextBody, e.BodyValues)
+	}
+	var threads struct{ List []thread }
+	result(t, responses, "Thread/get", "2", &threads)
+	if len(threads.List) != 1 || threads.List[0].ID != e.ThreadID || len(threads.List[0].EmailIDs) != 1 {
+		t.Errorf("got threads %+v", threads)
+	}
+
+	responses = ts.call(t,
+		`["Email/set", {"accountId": "u1", "ifInState": "`+get.State+`", "update": {"`+id+`": {
+			"keywords/$seen": true, "keywords/$flagged": true, "mailboxIds": {"archive": true}}}}, "0"]`,
+		`["Email/get", {"accountId": "u1", "ids": ["`+id+`", "nope"], "properties": ["keywords", "mailboxIds"]}, "1"]`,
+		`["Email/set", {"accountId": "u1", "ifInState": "`+get.State+`", "destroy": ["`+id+`"]}, "2"]`,
+		`["Email/changes", {"accountId": "u1", "sinceState": "`+get.State+`"}, "3"]`)
+	var set setResponse
+	result(t, responses, "Email/set", "0", &set)
+	if _, ok := set.Updated[id]; !ok || set.NewState == get.State {
+		t.Errorf("got %+v", set)
+	}
+	var after struct {
+		List []struct {
+			Keywords   map[string]bool
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+		}
+		NotFound []string
+	}
+	result(t, responses, "Email/get", "1", &after)
+	if len(after.List) != 1 || !after.List[0].Keywords[keywordSeen] || !after.List[0].Keywords[keywordFlagged] ||
+		!after.List[0].MailboxIDs["archive"] || after.List[0].MailboxIDs["inbox"] || len(after.NotFound) != 1 {
+		t.Errorf("got %+v", after)
+	}
+	var me methodError
+	result(t, responses, "error", "2", &me)
+	if me.Type != errStateMismatch {
+		t.Errorf("stale destroy: got %s", me.Type)
+	}
+	result(t, responses, "error", "3", &me)
+	if me.Type != errCannotCalculateChanges {
+		t.Errorf("changes: got %s", me.Type)
+	}
+
+	responses = ts.call(t, `["Email/set", {"accountId": "u1", "destroy": ["`+id+`"]}, "0"]`,
+		`["Email/query", {"accountId": "u1"}, "1"]`)
+	result(t, responses, "Email/set", "0", &set)
+	result(t, responses, "Email/query", "1", &query)
+	if len(set.Destroyed) != 1 || len(query.IDs) != 0 {
+		t.Errorf("got %+v, %+v", set, query)
+	}
+}
+
+func TestUploadImportAndSubmit(t *testing.T) {
+	ts := newTestServer(t)
+
+	raw := "From: user@example.com\r\nTo: bob@example.net\r\nBcc: carol@example.net\r\nSubject: Draft\r\n\r\nSend me.\r\n"
+	resp, body := ts.do(t, http.MethodPost, "u2", "/jmap/upload/u1/", strings.NewReader(raw))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("upload to another account: got status %d", resp.StatusCode)
+	}
+	resp, body = ts.do(t, http.MethodPost, "u1", "/jmap/upload/u1/", strings.NewReader(raw))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload got status %d: %s", resp.StatusCode, body)
+	}
+	var up uploadResponse
+	if err := json.Unmarshal([]byte(body), &up); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := ts.call(t,
+		`["Mailbox/query", {"accountId": "u1", "filter": {"role": "drafts"}}, "d"]`,
+		`["Email/import", {"accountId": "u1", "emails": {
+			"e": {"blobId": "`+up.BlobID+`", "mailboxIds": {"sent": true}, "keywords": {"$draft": true}},
+			"bad": {"blobId": "Unope", "mailboxIds": {"sent": true}}}}, "0"]`,
+		`["EmailSubmission/set", {"accountId": "u1", "create": {"s": {"identityId": "primary", "emailId": "#e"}},
+			"onSuccessUpdateEmail": {"#s": {"keywords/$draft": null}}}, "1"]`,
+		`["Email/get", {"accountId": "u1", "ids": ["#e"], "properties": ["keywords", "mailboxIds", "blobId"]}, "2"]`)
+	var imported importResponse
+	result(t, responses, "Email/import", "0", &imported)
+	if len(imported.Created) != 1 || imported.NotCreated["bad"] == nil || imported.NotCreated["bad"].Type != setBlobNotFound {
+		t.Fatalf("got %+v", imported)
+	}
+	var submission setResponse
+	result(t, responses, "EmailSubmission/set", "1", &submission)
+	if len(submission.Created) != 1 {
+		t.Fatalf("got %+v", submission)
+	}
+	var implicit setResponse
+	found := false
+	for _, inv := range responses {
+		if inv.Name == "Email/set" && inv.CallID == "1" {
+			found = json.Unmarshal(inv.Args, &implicit) == nil && len(implicit.Updated) == 1
+		}
+	}
+	if !found {
+		t.Errorf("no implicit Email/set in %+v", responses)
+	}
+	var get struct {
+		List []struct {
+			Keywords   map[string]bool
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+			BlobID     string          `json:"blobId"`
+		}
+	}
+	result(t, responses, "Email/get", "2", &get)
+	if len(get.List) != 1 || len(get.List[0].Keywords) != 0 || !get.List[0].MailboxIDs["sent"] || get.List[0].MailboxIDs["inbox"] {
+		t.Errorf("got %+v", get)
+	}
+	ts.relay.mu.Lock()
+	rcpt := strings.Join(ts.relay.rcpt, ",")
+	ts.relay.mu.Unlock()
+	if rcpt != "bob@example.net,carol@example.net" {
+		t.Errorf("relayed to %s", rcpt)
+	}
+
+	resp, body = ts.do(t, http.MethodGet, "u1", "/jmap/download/u1/"+get.List[0].BlobID+"/draft.eml?accept=message/rfc822", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Send me.") || resp.Header.Get("Content-Type") != "message/rfc822" {
+		t.Errorf("download got status %d: %s", resp.StatusCode, body)
+	}
+	resp, _ = ts.do(t, http.MethodGet, "u2", "/jmap/download/u2/"+get.List[0].BlobID+"/draft.eml", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download of another user's blob: got status %d", resp.StatusCode)
+	}
+
+	responses = ts.call(t,
+		`["EmailSubmission/set", {"accountId": "u1", "create": {"s": {"identityId": "primary", "emailId": "`+imported.Created["e"].(map[string]interface{})["id"].(string)+`",
+			"envelope": {"mailFrom": {"email": "someone@example.org"}, "rcptTo": [{"email": "bob@example.net"}]}}}}, "0"]`)
+	result(t, responses, "EmailSubmission/set", "0", &submission)
+	if submission.NotCreated["s"] == nil || submission.NotCreated["s"].Type != setForbiddenMailFrom {
+		t.Errorf("got %+v", submission)
+	}
+}
+
+func TestEventSource(t *testing.T) {
+	ts := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/jmap/eventsource?types=Email&closeafter=state&ping=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", token(t, "u1"))
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d, %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+				events <- data
+			}
+		}
+	}()
+	next := func() stateChange {
+		t.Helper()
+		select {
+		case data, ok := <-events:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			var c stateChange
+			if err := json.Unmarshal([]byte(data), &c); err != nil {
+				t.Fatal(err)
+			}
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return stateChange{}
+	}
+
+	first := next()
+	if first.Type != "StateChange" || first.Changed["u1"][typeEmail] == "" || len(first.Changed["u1"]) != 1 {
+		t.Fatalf("got %+v", first)
+	}
+	ts.deliver(t, "u2", testRaw)
+	ts.deliver(t, "u1", testRaw)
+	change := next()
+	if s := change.Changed["u1"][typeEmail]; s == "" || s == first.Changed["u1"][typeEmail] {
+		t.Errorf("got %+v after %+v", change, first)
+	}
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("stream not closed after the change")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("stream not closed after the change")
+	}
+}
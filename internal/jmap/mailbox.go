@@ -0,0 +1,690 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/labels"
+)
+
+// maxMailboxName bounds the names of Mailboxes, which are labels' paths.
+const maxMailboxName = 255
+
+// roles are the roles of the system labels' Mailboxes.
+var roles = map[string]string{
+	labels.Inbox:   "inbox",
+	labels.Sent:    "sent",
+	labels.Archive: "archive",
+	labels.Trash:   "trash",
+	labels.Spam:    "junk",
+}
+
+var mailboxProperties = []string{
+	"id", "name", "parentId", "role", "sortOrder", "totalEmails", "unreadEmails",
+	"totalThreads", "unreadThreads", "myRights", "isSubscribed",
+}
+
+// mailbox is a label as a Mailbox. Its name is the last segment of the
+// label's path, and its parent the label the path nests under.
+type mailbox struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	ParentID      *string `json:"parentId"`
+	Role          *string `json:"role"`
+	SortOrder     int     `json:"sortOrder"`
+	TotalEmails   int64   `json:"totalEmails"`
+	UnreadEmails  int64   `json:"unreadEmails"`
+	TotalThreads  int64   `json:"totalThreads"`
+	UnreadThreads int64   `json:"unreadThreads"`
+	MyRights      rights  `json:"myRights"`
+	IsSubscribed  bool    `json:"isSubscribed"`
+}
+
+type rights struct {
+	MayReadItems   bool `json:"mayReadItems"`
+	MayAddItems    bool `json:"mayAddItems"`
+	MayRemoveItems bool `json:"mayRemoveItems"`
+	MaySetSeen     bool `json:"maySetSeen"`
+	MaySetKeywords bool `json:"maySetKeywords"`
+	MayCreateChild bool `json:"mayCreateChild"`
+	MayRename      bool `json:"mayRename"`
+	MayDelete      bool `json:"mayDelete"`
+	MaySubmit      bool `json:"maySubmit"`
+}
+
+// mailboxes is a user's labels, indexed to map between Mailbox IDs and the
+// names messages are labeled with.
+type mailboxes struct {
+	list   []labels.Label
+	byID   map[string]labels.Label
+	byPath map[string]labels.Label
+}
+
+func (s *Server) mailboxes(ctx context.Context, userID string) (*mailboxes, error) {
+	list, err := s.labels.List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	m := &mailboxes{list: list, byID: map[string]labels.Label{}, byPath: map[string]labels.Label{}}
+	for _, l := range list {
+		m.byID[l.ID] = l
+		m.byPath[l.Path] = l
+	}
+	return m, nil
+}
+
+// ids returns the Mailboxes a message is in, given whether it is archived
+// and the labels on it.
+func (m *mailboxes) ids(archived bool, names []string) map[string]bool {
+	ids := map[string]bool{}
+	inbox := true
+	for _, name := range names {
+		l, ok := m.byPath[name]
+		if !ok {
+			continue
+		}
+		ids[l.ID] = true
+		if l.System {
+			// Sent, Trash and Spam take a message out of Inbox and Archive
+			inbox = false
+		}
+	}
+	if inbox {
+		if archived {
+			ids[m.byPath[labels.Archive].ID] = true
+		} else {
+			ids[m.byPath[labels.Inbox].ID] = true
+		}
+	}
+	return ids
+}
+
+// parent returns the ID of the Mailbox l nests under, or nil.
+func (m *mailboxes) parent(l labels.Label) *string {
+	i := strings.LastIndex(l.Path, labels.Separator)
+	if i < 0 {
+		return nil
+	}
+	p, ok := m.byPath[l.Path[:i]]
+	if !ok {
+		return nil
+	}
+	return &p.ID
+}
+
+// hasChild reports whether any label nests under l.
+func (m *mailboxes) hasChild(l labels.Label) bool {
+	for _, other := range m.list {
+		if strings.HasPrefix(other.Path, l.Path+labels.Separator) {
+			return true
+		}
+	}
+	return false
+}
+
+// mailbox returns l as a Mailbox. System labels come first, in the order
+// labels lists them.
+func (s *Server) mailbox(ctx context.Context, userID string, m *mailboxes, l labels.Label) (mailbox, error) {
+	threads, err := s.countThreads(ctx, userID, l)
+	if err != nil {
+		return mailbox{}, err
+	}
+	mb := mailbox{
+		ID:            l.ID,
+		Name:          l.Name,
+		ParentID:      m.parent(l),
+		SortOrder:     100,
+		TotalEmails:   l.Total,
+		UnreadEmails:  l.Unread,
+		TotalThreads:  threads.Total,
+		UnreadThreads: threads.Unread,
+		MyRights: rights{
+			MayReadItems:   true,
+			MayAddItems:    true,
+			MayRemoveItems: true,
+			MaySetSeen:     true,
+			MaySetKeywords: true,
+			MayCreateChild: true,
+			MayRename:      !l.System,
+			MayDelete:      !l.System,
+			MaySubmit:      true,
+		},
+		IsSubscribed: true,
+	}
+	if l.System {
+		role := roles[l.Name]
+		mb.Role = &role
+		for i, sl := range m.list {
+			if sl.ID == l.ID {
+				mb.SortOrder = i + 1
+			}
+		}
+	}
+	return mb, nil
+}
+
+// countThreads counts the threads with messages labeled l, and those of
+// them with unread messages.
+func (s *Server) countThreads(ctx context.Context, userID string, l labels.Label) (schema.CountThreadsByLabelRow, error) {
+	q := s.db.Queries()
+	var counts schema.CountThreadsByLabelRow
+	var err error
+	switch l.Path {
+	case labels.Inbox, labels.Archive:
+		var row schema.CountThreadsByArchivedRow
+		row, err = q.CountThreadsByArchived(ctx, schema.CountThreadsByArchivedParams{UserID: userID, Archived: l.Path == labels.Archive})
+		counts = schema.CountThreadsByLabelRow(row)
+	default:
+		counts, err = q.CountThreadsByLabel(ctx, schema.CountThreadsByLabelParams{UserID: userID, Label: l.Path})
+	}
+	if err != nil {
+		return counts, fmt.Errorf("failed to count threads labeled %s: %w", l.Path, err)
+	}
+	return counts, nil
+}
+
+func (s *Server) getMailboxes(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args getArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	ids, err := args.ids(r)
+	if err != nil {
+		return nil, err
+	}
+	props, err := properties(args.Properties, mailboxProperties, mailboxProperties)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.state(ctx, r.userID, typeMailbox)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.mailboxes(ctx, r.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := getResponse{AccountID: r.userID, State: state, List: []interface{}{}, NotFound: []string{}}
+	list := m.list
+	if args.IDs != nil {
+		list = nil
+		for i, id := range ids {
+			l, ok := m.byID[id]
+			if !ok {
+				resp.NotFound = append(resp.NotFound, (*args.IDs)[i])
+				continue
+			}
+			list = append(list, l)
+		}
+	}
+	for _, l := range list {
+		mb, err := s.mailbox(ctx, r.userID, m, l)
+		if err != nil {
+			return nil, err
+		}
+		obj, err := project(mb, props)
+		if err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, obj)
+	}
+	return resp, nil
+}
+
+type mailboxFilter struct {
+	ParentID     json.RawMessage `json:"parentId"`
+	Name         *string         `json:"name"`
+	Role         json.RawMessage `json:"role"`
+	HasAnyRole   *bool           `json:"hasAnyRole"`
+	IsSubscribed *bool           `json:"isSubscribed"`
+}
+
+type comparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+}
+
+// ascending reports the order of c, which is ascending unless it says
+// otherwise.
+func (c comparator) ascending() bool {
+	return c.IsAscending == nil || *c.IsAscending
+}
+
+type queryArgs struct {
+	AccountID      string          `json:"accountId"`
+	Filter         json.RawMessage `json:"filter"`
+	Sort           []comparator    `json:"sort"`
+	Position       int             `json:"position"`
+	Anchor         *string         `json:"anchor"`
+	AnchorOffset   int             `json:"anchorOffset"`
+	Limit          *int            `json:"limit"`
+	CalculateTotal bool            `json:"calculateTotal"`
+}
+
+type queryResponse struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+	Limit               *int     `json:"limit,omitempty"`
+}
+
+// maxQueryLimit bounds the IDs one query returns.
+const maxQueryLimit = 1000
+
+// window puts the page of ids a query asks for in resp, with its position,
+// and the total and limit if the client should know them.
+func (a queryArgs) window(ids []string, resp *queryResponse) error {
+	maxLimit := maxQueryLimit
+	if a.Limit != nil && *a.Limit < 0 {
+		return invalidArguments("limit must not be negative")
+	}
+	if a.CalculateTotal {
+		total := len(ids)
+		resp.Total = &total
+	}
+
+	start := a.Position
+	if a.Anchor != nil {
+		i := indexOf(ids, *a.Anchor)
+		if i < 0 {
+			return &methodError{Type: errAnchorNotFound}
+		}
+		start = max(i+a.AnchorOffset, 0)
+	} else if start < 0 {
+		start = max(len(ids)+start, 0)
+	}
+	start = min(start, len(ids))
+
+	limit := maxLimit
+	if a.Limit != nil && *a.Limit <= maxLimit {
+		limit = *a.Limit
+	} else if a.Limit != nil {
+		resp.Limit = &limit
+	}
+	end := min(start+limit, len(ids))
+
+	resp.Position = start
+	resp.IDs = append([]string{}, ids[start:end]...)
+	return nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Server) queryMailboxes(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		queryArgs
+		SortAsTree   bool `json:"sortAsTree"`
+		FilterAsTree bool `json:"filterAsTree"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	var filter mailboxFilter
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		if err := decodeArgs(args.Filter, &filter); err != nil {
+			return nil, &methodError{Type: errUnsupportedFilter, Description: err.(*methodError).Description}
+		}
+	}
+	state, err := s.state(ctx, r.userID, typeMailbox)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.mailboxes(ctx, r.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []mailbox
+	for _, l := range m.list {
+		mb, err := s.mailbox(ctx, r.userID, m, l)
+		if err != nil {
+			return nil, err
+		}
+		if filter.matches(mb) {
+			list = append(list, mb)
+		}
+	}
+	for i := len(args.Sort) - 1; i >= 0; i-- {
+		c := args.Sort[i]
+		var less func(a, b mailbox) bool
+		switch c.Property {
+		case "name":
+			less = func(a, b mailbox) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+		case "sortOrder":
+			less = func(a, b mailbox) bool { return a.SortOrder < b.SortOrder }
+		default:
+			return nil, &methodError{Type: errUnsupportedSort, Description: "can't sort by " + c.Property}
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			if c.ascending() {
+				return less(list[i], list[j])
+			}
+			return less(list[j], list[i])
+		})
+	}
+
+	ids := make([]string, len(list))
+	for i, mb := range list {
+		ids[i] = mb.ID
+	}
+	resp := queryResponse{AccountID: r.userID, QueryState: state}
+	if err := args.window(ids, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (f mailboxFilter) matches(mb mailbox) bool {
+	if f.ParentID != nil {
+		var parent *string
+		json.Unmarshal(f.ParentID, &parent)
+		if (parent == nil) != (mb.ParentID == nil) || (parent != nil && *parent != *mb.ParentID) {
+			return false
+		}
+	}
+	if f.Name != nil && !strings.Contains(strings.ToLower(mb.Name), strings.ToLower(*f.Name)) {
+		return false
+	}
+	if f.Role != nil {
+		var role *string
+		json.Unmarshal(f.Role, &role)
+		if (role == nil) != (mb.Role == nil) || (role != nil && *role != *mb.Role) {
+			return false
+		}
+	}
+	if f.HasAnyRole != nil && *f.HasAnyRole != (mb.Role != nil) {
+		return false
+	}
+	if f.IsSubscribed != nil && *f.IsSubscribed != mb.IsSubscribed {
+		return false
+	}
+	return true
+}
+
+type mailboxCreate struct {
+	Name         string  `json:"name"`
+	ParentID     *string `json:"parentId"`
+	Role         *string `json:"role"`
+	SortOrder    int     `json:"sortOrder"`
+	IsSubscribed *bool   `json:"isSubscribed"`
+}
+
+// setMailboxes creates, renames, moves and destroys labels. Destroying a
+// Mailbox that still has Emails needs onDestroyRemoveEmails, which takes the
+// label off them; the Emails themselves are kept.
+func (s *Server) setMailboxes(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		setArgs
+		OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := args.check(r); err != nil {
+		return nil, err
+	}
+	state, err := s.checkState(ctx, r.userID, typeMailbox, args.IfInState)
+	if err != nil {
+		return nil, err
+	}
+	resp := newSetResponse(r.userID, state)
+
+	for _, cid := range createOrder(args.Create) {
+		id, err := s.createMailbox(ctx, r, args.Create[cid])
+		if err != nil {
+			var se *setError
+			if !errors.As(err, &se) {
+				return nil, err
+			}
+			resp.NotCreated[cid] = se
+			continue
+		}
+		r.created[cid] = id
+		resp.Created[cid] = map[string]interface{}{
+			"id": id, "role": nil, "sortOrder": 100, "totalEmails": 0, "unreadEmails": 0,
+			"totalThreads": 0, "unreadThreads": 0, "isSubscribed": true,
+			"myRights": rights{true, true, true, true, true, true, true, true, true},
+		}
+	}
+
+	for _, id := range sortedKeys(args.Update) {
+		if err := s.updateMailbox(ctx, r, id, args.Update[id]); err != nil {
+			var se *setError
+			if !errors.As(err, &se) {
+				return nil, err
+			}
+			resp.NotUpdated[id] = se
+			continue
+		}
+		resp.Updated[id] = nil
+	}
+
+	for _, id := range args.Destroy {
+		if err := s.destroyMailbox(ctx, r.userID, id, args.OnDestroyRemoveEmails); err != nil {
+			var se *setError
+			if !errors.As(err, &se) {
+				return nil, err
+			}
+			resp.NotDestroyed[id] = se
+			continue
+		}
+		resp.Destroyed = append(resp.Destroyed, id)
+	}
+
+	if resp.NewState, err = s.state(ctx, r.userID, typeMailbox); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// createOrder returns the creation IDs of creates so that a Mailbox whose
+// parentId is another's creation ID comes after it, and otherwise in sorted
+// order.
+func createOrder(creates map[string]json.RawMessage) []string {
+	parents := make(map[string]string, len(creates))
+	for cid, raw := range creates {
+		var c struct {
+			ParentID *string `json:"parentId"`
+		}
+		if json.Unmarshal(raw, &c) == nil && c.ParentID != nil && strings.HasPrefix(*c.ParentID, "#") {
+			parents[cid] = strings.TrimPrefix(*c.ParentID, "#")
+		}
+	}
+
+	order := make([]string, 0, len(creates))
+	visited := make(map[string]bool, len(creates))
+	var visit func(cid string)
+	visit = func(cid string) {
+		if visited[cid] {
+			return
+		}
+		// Marked first so that a cycle ends here; its creates fail for
+		// want of a parent
+		visited[cid] = true
+		if parent, ok := parents[cid]; ok {
+			if _, ok := creates[parent]; ok {
+				visit(parent)
+			}
+		}
+		order = append(order, cid)
+	}
+	for _, cid := range sortedKeys(creates) {
+		visit(cid)
+	}
+	return order
+}
+
+// sortedKeys returns the keys of m in order, for set methods to handle
+// objects in the same order from one request to the next.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelError returns the SetError for a labels error about property, or
+// err if it isn't the client's.
+func labelError(err error, property string) error {
+	switch {
+	case errors.Is(err, labels.ErrLabelNotFound):
+		return &setError{Type: setNotFound}
+	case errors.Is(err, labels.ErrSystemLabel):
+		return &setError{Type: setForbidden, Description: "System mailboxes can't be changed"}
+	case errors.Is(err, labels.ErrInvalidLabel), errors.Is(err, labels.ErrLabelExists):
+		return invalidProperties(err.Error(), property)
+	}
+	return err
+}
+
+// mailboxPath returns the path of the label a Mailbox called name under
+// parentID would be.
+func mailboxPath(r *request, m *mailboxes, name string, parentID *string) (string, error) {
+	if name == "" || strings.Contains(name, labels.Separator) {
+		return "", invalidProperties("Names must not be empty or contain "+labels.Separator, "name")
+	}
+	if parentID == nil {
+		return name, nil
+	}
+	id, _ := r.resolveID(*parentID)
+	parent, ok := m.byID[id]
+	if !ok {
+		return "", invalidProperties("No such parent mailbox", "parentId")
+	}
+	return parent.Path + labels.Separator + name, nil
+}
+
+func (s *Server) createMailbox(ctx context.Context, r *request, raw json.RawMessage) (string, error) {
+	var c mailboxCreate
+	if err := decodeObject(raw, &c); err != nil {
+		return "", err
+	}
+	if c.Role != nil {
+		return "", invalidProperties("Mailboxes with roles can't be created", "role")
+	}
+	m, err := s.mailboxes(ctx, r.userID)
+	if err != nil {
+		return "", err
+	}
+	path, err := mailboxPath(r, m, c.Name, c.ParentID)
+	if err != nil {
+		return "", err
+	}
+	l, err := s.labels.Create(ctx, r.userID, path, "")
+	if err != nil {
+		return "", labelError(err, "name")
+	}
+	return l.ID, nil
+}
+
+func (s *Server) updateMailbox(ctx context.Context, r *request, id string, patch map[string]json.RawMessage) error {
+	m, err := s.mailboxes(ctx, r.userID)
+	if err != nil {
+		return err
+	}
+	l, ok := m.byID[id]
+	if !ok {
+		return &setError{Type: setNotFound}
+	}
+	mb, err := s.mailbox(ctx, r.userID, m, l)
+	if err != nil {
+		return err
+	}
+
+	name, parentID := mb.Name, mb.ParentID
+	for prop, v := range patch {
+		var err error
+		switch prop {
+		case "name":
+			err = json.Unmarshal(v, &name)
+		case "parentId":
+			parentID = nil
+			err = json.Unmarshal(v, &parentID)
+		case "isSubscribed", "sortOrder", "role":
+			// Only the current value can be set
+			var cur interface{}
+			switch prop {
+			case "isSubscribed":
+				cur = mb.IsSubscribed
+			case "sortOrder":
+				cur = mb.SortOrder
+			default:
+				cur = mb.Role
+			}
+			b, _ := json.Marshal(cur)
+			if string(b) != string(v) {
+				return invalidProperties(prop+" can't be changed", prop)
+			}
+		default:
+			return invalidProperties("Unknown property "+prop, prop)
+		}
+		if err != nil {
+			return invalidProperties(err.Error(), prop)
+		}
+	}
+	if name == mb.Name && equalPtr(parentID, mb.ParentID) {
+		return nil
+	}
+	if l.System {
+		return &setError{Type: setForbidden, Description: "System mailboxes can't be renamed"}
+	}
+	path, err := mailboxPath(r, m, name, parentID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.labels.Update(ctx, r.userID, id, path, l.Color); err != nil {
+		return labelError(err, "parentId")
+	}
+	return nil
+}
+
+func equalPtr(a, b *string) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func (s *Server) destroyMailbox(ctx context.Context, userID, id string, removeEmails bool) error {
+	m, err := s.mailboxes(ctx, userID)
+	if err != nil {
+		return err
+	}
+	l, ok := m.byID[id]
+	switch {
+	case !ok:
+		return &setError{Type: setNotFound}
+	case l.System:
+		return &setError{Type: setForbidden, Description: "System mailboxes can't be destroyed"}
+	case m.hasChild(l):
+		return &setError{Type: setMailboxHasChild}
+	case l.Total > 0 && !removeEmails:
+		return &setError{Type: setMailboxHasEmail}
+	}
+	if err := s.labels.Delete(ctx, userID, id); err != nil {
+		return labelError(err, "id")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+)
+
+// minPing is the shortest ping interval a client can ask for, so idle
+// connections can't be made to cost much.
+const minPing = 5
+
+type stateChange struct {
+	Type    string                       `json:"@type"`
+	Changed map[string]map[string]string `json:"changed"`
+}
+
+type ping struct {
+	Type     string `json:"@type"`
+	Interval int    `json:"interval"`
+}
+
+// HandleEventSource pushes state changes as server-sent events, at
+// /jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}. The
+// states are polled, as changes can be made by other instances. The stream
+// stays open, so it must be served without a write timeout.
+func (s *Server) HandleEventSource(w http.ResponseWriter, r *http.Request) {
+	userID, ok := user(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	var types map[string]bool
+	if t := query.Get("types"); t != "" && t != "*" {
+		types = map[string]bool{}
+		for _, typ := range strings.Split(t, ",") {
+			types[strings.TrimSpace(typ)] = true
+		}
+	}
+	closeAfter := query.Get("closeafter") == "state"
+	pingInterval := 0
+	if p := query.Get("ping"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid ping interval", http.StatusBadRequest)
+			return
+		}
+		if n > 0 && n < minPing {
+			n = minPing
+		}
+		pingInterval = n
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, data interface{}) bool {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	poll := time.NewTicker(s.pushInterval)
+	defer poll.Stop()
+	var pings <-chan time.Time
+	if pingInterval > 0 {
+		t := time.NewTicker(time.Duration(pingInterval) * time.Second)
+		defer t.Stop()
+		pings = t.C
+	}
+
+	var last map[string]string
+	for {
+		states, err := s.states(r.Context(), userID)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			metrics.Errors.WithLabelValues("jmap_push").Inc()
+			logger.Error(r.Context(), "Failed to read states", "error", err)
+			return
+		}
+		changed := map[string]string{}
+		for typ, state := range states {
+			if (types == nil || types[typ]) && (last == nil || last[typ] != state) {
+				changed[typ] = state
+			}
+		}
+		// The first event has every state, for the client to compare
+		// with its own
+		if last == nil || len(changed) > 0 {
+			if !send("state", stateChange{Type: "StateChange", Changed: map[string]map[string]string{userID: changed}}) {
+				return
+			}
+			if last != nil && closeAfter {
+				return
+			}
+		}
+		last = states
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-poll.C:
+		case <-pings:
+			if !send("ping", ping{Type: "Ping", Interval: pingInterval}) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/search"
+)
+
+// sortColumns maps the Email/query sort properties onto message columns.
+var sortColumns = map[string]string{
+	"receivedAt": "m.received_at",
+	"sentAt":     "m.sent_at",
+	"size":       "m.size",
+	"subject":    "m.subject COLLATE NOCASE",
+	"from":       "m.from_address",
+}
+
+func sortProperties() []string {
+	return []string{"receivedAt", "sentAt", "size", "subject", "from"}
+}
+
+// emailFilter is a FilterOperator or FilterCondition of Email/query. A
+// condition's properties are ANDed together.
+type emailFilter struct {
+	Operator   string        `json:"operator"`
+	Conditions []emailFilter `json:"conditions"`
+
+	InMailbox          *string    `json:"inMailbox"`
+	InMailboxOtherThan []string   `json:"inMailboxOtherThan"`
+	Before             *time.Time `json:"before"`
+	After              *time.Time `json:"after"`
+	MinSize            *int64     `json:"minSize"`
+	MaxSize            *int64     `json:"maxSize"`
+	HasKeyword         *string    `json:"hasKeyword"`
+	NotKeyword         *string    `json:"notKeyword"`
+	HasAttachment      *bool      `json:"hasAttachment"`
+	Text               *string    `json:"text"`
+	From               *string    `json:"from"`
+	To                 *string    `json:"to"`
+	Cc                 *string    `json:"cc"`
+	Bcc                *string    `json:"bcc"`
+	Subject            *string    `json:"subject"`
+	Body               *string    `json:"body"`
+}
+
+// sqlExpr is a SQL condition on the message table, aliased m, with its
+// arguments.
+type sqlExpr struct {
+	sql  string
+	args []interface{}
+}
+
+// join combines exprs with op, which is "AND" or "OR". No exprs is true.
+func join(op string, exprs []sqlExpr) sqlExpr {
+	if len(exprs) == 0 {
+		return sqlExpr{sql: "1"}
+	}
+	var parts []string
+	var args []interface{}
+	for _, e := range exprs {
+		parts = append(parts, "("+e.sql+")")
+		args = append(args, e.args...)
+	}
+	return sqlExpr{sql: strings.Join(parts, " "+op+" "), args: args}
+}
+
+// where returns the condition f puts on userID's messages.
+func (f emailFilter) where(userID string, m *mailboxes) (sqlExpr, error) {
+	if f.Operator != "" {
+		var exprs []sqlExpr
+		for _, c := range f.Conditions {
+			e, err := c.where(userID, m)
+			if err != nil {
+				return sqlExpr{}, err
+			}
+			exprs = append(exprs, e)
+		}
+		switch f.Operator {
+		case "AND":
+			return join("AND", exprs), nil
+		case "OR":
+			if len(exprs) == 0 {
+				return sqlExpr{sql: "0"}, nil
+			}
+			return join("OR", exprs), nil
+		case "NOT":
+			e := join("OR", exprs)
+			if len(exprs) == 0 {
+				e = sqlExpr{sql: "0"}
+			}
+			return sqlExpr{sql: "NOT (" + e.sql + ")", args: e.args}, nil
+		}
+		return sqlExpr{}, &methodError{Type: errUnsupportedFilter, Description: "unknown operator " + f.Operator}
+	}
+
+	var exprs []sqlExpr
+	if f.InMailbox != nil {
+		exprs = append(exprs, inMailbox(m, *f.InMailbox))
+	}
+	for _, id := range f.InMailboxOtherThan {
+		// In some Mailbox other than these: the others are ANDed
+		// together and an Email is in at least one Mailbox, so it must be
+		// outside one of them
+		e := inMailbox(m, id)
+		exprs = append(exprs, sqlExpr{sql: "NOT (" + e.sql + ")", args: e.args})
+	}
+	if f.Before != nil {
+		exprs = append(exprs, sqlExpr{"m.received_at < ?", []interface{}{f.Before.UTC()}})
+	}
+	if f.After != nil {
+		exprs = append(exprs, sqlExpr{"m.received_at >= ?", []interface{}{f.After.UTC()}})
+	}
+	if f.MinSize != nil {
+		exprs = append(exprs, sqlExpr{"m.size >= ?", []interface{}{*f.MinSize}})
+	}
+	if f.MaxSize != nil {
+		exprs = append(exprs, sqlExpr{"m.size < ?", []interface{}{*f.MaxSize}})
+	}
+	if f.HasKeyword != nil {
+		exprs = append(exprs, hasKeyword(*f.HasKeyword))
+	}
+	if f.NotKeyword != nil {
+		e := hasKeyword(*f.NotKeyword)
+		exprs = append(exprs, sqlExpr{sql: "NOT (" + e.sql + ")", args: e.args})
+	}
+	if f.HasAttachment != nil {
+		exprs = append(exprs, sqlExpr{"m.has_attachments = ?", []interface{}{*f.HasAttachment}})
+	}
+	for _, t := range []struct {
+		field string
+		value *string
+	}{
+		{"", f.Text},
+		{"from", f.From},
+		{"to", f.To},
+		{"to", f.Cc},
+		{"to", f.Bcc},
+		{"subject", f.Subject},
+		{"body", f.Body},
+	} {
+		if t.value == nil {
+			continue
+		}
+		e, err := textMatch(userID, t.field, *t.value)
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		exprs = append(exprs, e)
+	}
+	return join("AND", exprs), nil
+}
+
+// inMailbox returns the condition that a message is in the Mailbox id.
+// Inbox and Archive hold the messages that aren't sent, trash or spam,
+// split by whether they are archived.
+func inMailbox(m *mailboxes, id string) sqlExpr {
+	l, ok := m.byID[id]
+	if !ok {
+		return sqlExpr{sql: "0"}
+	}
+	switch l.Path {
+	case labels.Inbox, labels.Archive:
+		return sqlExpr{
+			sql: `m.archived = ? AND NOT EXISTS (SELECT 1 FROM message_label ml WHERE ml.message_id = m.id
+    AND ml.label IN ('Sent', 'Trash', 'Spam'))`,
+			args: []interface{}{l.Path == labels.Archive},
+		}
+	}
+	return sqlExpr{
+		sql:  "EXISTS (SELECT 1 FROM message_label ml WHERE ml.message_id = m.id AND ml.label = ?)",
+		args: []interface{}{l.Path},
+	}
+}
+
+// hasKeyword returns the condition that a message has keyword k.
+func hasKeyword(k string) sqlExpr {
+	switch strings.ToLower(k) {
+	case keywordSeen:
+		return sqlExpr{sql: "m.is_read = 1"}
+	case keywordFlagged:
+		k = `\Flagged`
+	case keywordImportant:
+		k = "$Important"
+	case keywordAnswered:
+		k = `\Answered`
+	}
+	return sqlExpr{
+		sql:  "EXISTS (SELECT 1 FROM message_keyword k WHERE k.message_id = m.id AND k.keyword = ? COLLATE NOCASE)",
+		args: []interface{}{k},
+	}
+}
+
+// textMatch returns the condition that a message matches a text filter,
+// using the search index. field qualifies the search, as in the search
+// syntax; "" searches all of the message.
+func textMatch(userID, field, value string) (sqlExpr, error) {
+	s := value
+	if field != "" {
+		s = field + `:"` + strings.ReplaceAll(value, `"`, "") + `"`
+	}
+	q, err := search.ParseQuery(s)
+	if err != nil {
+		if errors.Is(err, search.ErrEmptyQuery) {
+			return sqlExpr{sql: "1"}, nil
+		}
+		return sqlExpr{}, &methodError{Type: errUnsupportedFilter, Description: err.Error()}
+	}
+	var exprs []sqlExpr
+	if q.Match != "" {
+		exprs = append(exprs, sqlExpr{
+			sql: `m.id IN (SELECT c.message_id FROM message_search
+    JOIN message_search_content c ON c.doc_id = message_search.rowid
+    WHERE message_search MATCH ? AND c.user_id = ?)`,
+			args: []interface{}{q.Match, userID},
+		})
+	}
+	if q.HasAttachment {
+		exprs = append(exprs, sqlExpr{sql: "m.has_attachments = 1"})
+	}
+	if !q.Before.IsZero() {
+		exprs = append(exprs, sqlExpr{"m.sent_at < ?", []interface{}{q.Before}})
+	}
+	if !q.After.IsZero() {
+		exprs = append(exprs, sqlExpr{"m.sent_at >= ?", []interface{}{q.After}})
+	}
+	return join("AND", exprs), nil
+}
+
+// queryEmails runs Email/query. The whole result is read and then paged,
+// which keeps anchors and collapsed threads simple; queries return IDs
+// only, so even large mailboxes are cheap to read.
+func (s *Server) queryEmails(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		queryArgs
+		CollapseThreads bool `json:"collapseThreads"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	var filter emailFilter
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		if err := decodeArgs(args.Filter, &filter); err != nil {
+			return nil, &methodError{Type: errUnsupportedFilter, Description: err.(*methodError).Description}
+		}
+	}
+	state, err := s.state(ctx, r.userID, typeEmail)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.mailboxes(ctx, r.userID)
+	if err != nil {
+		return nil, err
+	}
+	cond, err := filter.where(r.userID, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var order []string
+	for _, c := range args.Sort {
+		col, ok := sortColumns[c.Property]
+		if !ok {
+			return nil, &methodError{Type: errUnsupportedSort, Description: "can't sort by " + c.Property}
+		}
+		if c.ascending() {
+			order = append(order, col)
+		} else {
+			order = append(order, col+" DESC")
+		}
+	}
+	if len(order) == 0 {
+		order = append(order, "m.received_at DESC")
+	}
+	order = append(order, "m.id")
+
+	query := "SELECT m.id, m.thread_id FROM message m WHERE m.user_id = ? AND (" + cond.sql + ") ORDER BY " + strings.Join(order, ", ")
+	rows, err := s.db.DB().QueryContext(ctx, query, append([]interface{}{r.userID}, cond.args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	seen := map[string]bool{}
+	for rows.Next() {
+		var id, thread string
+		if err := rows.Scan(&id, &thread); err != nil {
+			return nil, fmt.Errorf("failed to read message: %w", err)
+		}
+		if args.CollapseThreads {
+			if seen[thread] {
+				continue
+			}
+			seen[thread] = true
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	resp := queryResponse{AccountID: r.userID, QueryState: state}
+	if err := args.window(ids, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
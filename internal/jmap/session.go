@@ -0,0 +1,103 @@
+package jmap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+)
+
+// session is the session resource (RFC 8620 section 2).
+type session struct {
+	Capabilities    map[string]interface{} `json:"capabilities"`
+	Accounts        map[string]account     `json:"accounts"`
+	PrimaryAccounts map[string]string      `json:"primaryAccounts"`
+	Username        string                 `json:"username"`
+	APIURL          string                 `json:"apiUrl"`
+	DownloadURL     string                 `json:"downloadUrl"`
+	UploadURL       string                 `json:"uploadUrl"`
+	EventSourceURL  string                 `json:"eventSourceUrl"`
+	State           string                 `json:"state"`
+}
+
+type account struct {
+	Name                string                 `json:"name"`
+	IsPersonal          bool                   `json:"isPersonal"`
+	IsReadOnly          bool                   `json:"isReadOnly"`
+	AccountCapabilities map[string]interface{} `json:"accountCapabilities"`
+}
+
+// HandleSession serves the session resource at /.well-known/jmap.
+func (s *Server) HandleSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := user(w, r)
+	if !ok {
+		return
+	}
+	u, err := s.db.Queries().GetUserByID(r.Context(), userID)
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_get_user").Inc()
+		logger.Error(r.Context(), "Failed to get user", "error", err)
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: "Failed to get session"})
+		return
+	}
+
+	capabilities, accountCapabilities := s.capabilities()
+	primary := map[string]string{}
+	for c := range accountCapabilities {
+		primary[c] = userID
+	}
+	base := s.baseURL(r)
+	sess := session{
+		Capabilities: capabilities,
+		Accounts: map[string]account{
+			userID: {Name: u.Email, IsPersonal: true, AccountCapabilities: accountCapabilities},
+		},
+		PrimaryAccounts: primary,
+		Username:        u.Email,
+		APIURL:          base + "/jmap/api",
+		DownloadURL:     base + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		UploadURL:       base + "/jmap/upload/{accountId}/",
+		EventSourceURL:  base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		State:           sessionState(u.Email, capabilities, accountCapabilities),
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	writeJSON(w, r, http.StatusOK, sess)
+}
+
+// baseURL returns the URL the session's URLs are under: JMAP_BASE_URL if
+// set, and otherwise the scheme and host the request was made to.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.publicURL != "" {
+		return s.publicURL
+	}
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// sessionState identifies the content of a session, which only changes
+// with the server's configuration.
+func sessionState(username string, capabilities, accountCapabilities map[string]interface{}) string {
+	b, _ := json.Marshal([]interface{}{username, capabilities, accountCapabilities})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// sessionState returns the state of userID's session for API responses.
+func (s *Server) sessionState(ctx context.Context, userID string) string {
+	u, err := s.db.Queries().GetUserByID(ctx, userID)
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_get_user").Inc()
+		logger.Error(ctx, "Failed to get user", "error", err)
+		return ""
+	}
+	capabilities, accountCapabilities := s.capabilities()
+	return sessionState(u.Email, capabilities, accountCapabilities)
+}
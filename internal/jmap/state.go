@@ -0,0 +1,160 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// The data types, as states and push notifications name them.
+const (
+	typeMailbox         = "Mailbox"
+	typeEmail           = "Email"
+	typeThread          = "Thread"
+	typeIdentity        = "Identity"
+	typeEmailSubmission = "EmailSubmission"
+)
+
+// states returns userID's current state of every data type. Identities and
+// submissions never change, so their state is constant.
+func (s *Server) states(ctx context.Context, userID string) (map[string]string, error) {
+	rows, err := s.db.Queries().ListJMAPStates(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list states: %w", err)
+	}
+	states := map[string]string{typeMailbox: "0", typeEmail: "0", typeThread: "0"}
+	for _, row := range rows {
+		states[row.Type] = strconv.FormatInt(row.State, 10)
+	}
+	if s.mailer != nil {
+		states[typeIdentity] = "0"
+		states[typeEmailSubmission] = "0"
+	}
+	return states, nil
+}
+
+// state returns userID's current state of one data type.
+func (s *Server) state(ctx context.Context, userID, typ string) (string, error) {
+	states, err := s.states(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return states[typ], nil
+}
+
+type changesArgs struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+type changesResponse struct {
+	AccountID         string   `json:"accountId"`
+	OldState          string   `json:"oldState"`
+	NewState          string   `json:"newState"`
+	HasMoreChanges    bool     `json:"hasMoreChanges"`
+	Created           []string `json:"created"`
+	Updated           []string `json:"updated"`
+	Destroyed         []string `json:"destroyed"`
+	UpdatedProperties []string `json:"updatedProperties,omitempty"`
+}
+
+// changes returns the /changes method of typ. Only a client that is up to
+// date gets an answer; any other gets cannotCalculateChanges and fetches
+// the objects again.
+func (s *Server) changes(typ string) method {
+	return func(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+		var args changesArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if err := r.checkAccount(args.AccountID); err != nil {
+			return nil, err
+		}
+		if args.MaxChanges != nil && *args.MaxChanges <= 0 {
+			return nil, invalidArguments("maxChanges must be positive")
+		}
+		state, err := s.state(ctx, r.userID, typ)
+		if err != nil {
+			return nil, err
+		}
+		if args.SinceState != state {
+			return nil, &methodError{Type: errCannotCalculateChanges}
+		}
+		return changesResponse{
+			AccountID: r.userID,
+			OldState:  state,
+			NewState:  state,
+			Created:   []string{},
+			Updated:   []string{},
+			Destroyed: []string{},
+		}, nil
+	}
+}
+
+type queryChangesArgs struct {
+	AccountID       string          `json:"accountId"`
+	Filter          json.RawMessage `json:"filter"`
+	Sort            json.RawMessage `json:"sort"`
+	SinceQueryState string          `json:"sinceQueryState"`
+	MaxChanges      *int            `json:"maxChanges"`
+	UpToID          *string         `json:"upToId"`
+	CalculateTotal  bool            `json:"calculateTotal"`
+	CollapseThreads bool            `json:"collapseThreads"`
+}
+
+type queryChangesResponse struct {
+	AccountID     string      `json:"accountId"`
+	OldQueryState string      `json:"oldQueryState"`
+	NewQueryState string      `json:"newQueryState"`
+	Removed       []string    `json:"removed"`
+	Added         []addedItem `json:"added"`
+}
+
+type addedItem struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+}
+
+// queryChanges returns the /queryChanges method of typ. Query states are
+// the state of typ, so as with changes only an up to date client gets an
+// answer, and only if it doesn't ask for the total.
+func (s *Server) queryChanges(typ string) method {
+	return func(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+		var args queryChangesArgs
+		if err := decodeArgs(raw, &args); err != nil {
+			return nil, err
+		}
+		if err := r.checkAccount(args.AccountID); err != nil {
+			return nil, err
+		}
+		state, err := s.state(ctx, r.userID, typ)
+		if err != nil {
+			return nil, err
+		}
+		if args.SinceQueryState != state || args.CalculateTotal {
+			return nil, &methodError{Type: errCannotCalculateChanges}
+		}
+		return queryChangesResponse{
+			AccountID:     r.userID,
+			OldQueryState: state,
+			NewQueryState: state,
+			Removed:       []string{},
+			Added:         []addedItem{},
+		}, nil
+	}
+}
+
+// checkState returns stateMismatch if ifInState is set and isn't the
+// current state, which it returns otherwise.
+func (s *Server) checkState(ctx context.Context, userID, typ string, ifInState *string) (string, error) {
+	state, err := s.state(ctx, userID, typ)
+	if err != nil {
+		return "", err
+	}
+	if ifInState != nil && *ifInState != state {
+		return "", &methodError{Type: errStateMismatch}
+	}
+	return state, nil
+}
@@ -0,0 +1,295 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+// identityID is the ID of a user's only Identity, their own address.
+const identityID = "primary"
+
+// maxRecipients bounds the recipients of one EmailSubmission.
+const maxRecipients = 100
+
+type identity struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Email         string  `json:"email"`
+	ReplyTo       *string `json:"replyTo"`
+	Bcc           *string `json:"bcc"`
+	TextSignature string  `json:"textSignature"`
+	HTMLSignature string  `json:"htmlSignature"`
+	MayDelete     bool    `json:"mayDelete"`
+}
+
+func (s *Server) getIdentities(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args getArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	all := []string{"id", "name", "email", "replyTo", "bcc", "textSignature", "htmlSignature", "mayDelete"}
+	props, err := properties(args.Properties, all, all)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.db.Queries().GetUserByID(ctx, r.userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	obj, err := project(identity{ID: identityID, Email: u.Email}, props)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := getResponse{AccountID: r.userID, State: "0", List: []interface{}{}, NotFound: []string{}}
+	if args.IDs == nil {
+		resp.List = append(resp.List, obj)
+		return resp, nil
+	}
+	for _, id := range *args.IDs {
+		if id == identityID {
+			resp.List = append(resp.List, obj)
+		} else {
+			resp.NotFound = append(resp.NotFound, id)
+		}
+	}
+	return resp, nil
+}
+
+// getSubmissions answers EmailSubmission/get. Submissions are relayed as
+// they are made and not kept, so there are none to get.
+func (s *Server) getSubmissions(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args getArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	resp := getResponse{AccountID: r.userID, State: "0", List: []interface{}{}, NotFound: []string{}}
+	if args.IDs != nil {
+		resp.NotFound = append(resp.NotFound, *args.IDs...)
+	}
+	return resp, nil
+}
+
+func (s *Server) querySubmissions(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args queryArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	resp := queryResponse{AccountID: r.userID, QueryState: "0"}
+	if err := args.window(nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type submissionCreate struct {
+	IdentityID string    `json:"identityId"`
+	EmailID    string    `json:"emailId"`
+	Envelope   *envelope `json:"envelope"`
+}
+
+type envelope struct {
+	MailFrom address   `json:"mailFrom"`
+	RcptTo   []address `json:"rcptTo"`
+}
+
+type address struct {
+	Email      string                 `json:"email"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// setSubmissions sends Emails. The onSuccessUpdateEmail and
+// onSuccessDestroyEmail arguments change the Emails sent, typically moving
+// a draft to Sent, and are answered by an implicit Email/set.
+func (s *Server) setSubmissions(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		setArgs
+		OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := args.check(r); err != nil {
+		return nil, err
+	}
+	state, err := s.checkState(ctx, r.userID, typeEmailSubmission, args.IfInState)
+	if err != nil {
+		return nil, err
+	}
+	resp := newSetResponse(r.userID, state)
+	resp.NewState = state
+
+	// The Emails sent, by the creation ID of their submission
+	sent := map[string]string{}
+	for _, cid := range sortedKeys(args.Create) {
+		created, err := s.submit(ctx, r, args.Create[cid])
+		if err != nil {
+			var se *setError
+			if !errors.As(err, &se) {
+				return nil, err
+			}
+			resp.NotCreated[cid] = se
+			continue
+		}
+		id := uuid.New().String()
+		r.created[cid] = id
+		sent[cid] = created.emailID
+		resp.Created[cid] = map[string]interface{}{
+			"id":         id,
+			"threadId":   created.threadID,
+			"sendAt":     utcDate(created.sendAt),
+			"undoStatus": "final",
+		}
+	}
+	for id := range args.Update {
+		resp.NotUpdated[id] = &setError{Type: setNotFound}
+	}
+	for _, id := range args.Destroy {
+		resp.NotDestroyed[id] = &setError{Type: setNotFound}
+	}
+
+	// The onSuccess arguments refer to submissions by "#" and their
+	// creation ID; those that failed are left out
+	emailSet := setArgs{AccountID: r.userID, Update: map[string]map[string]json.RawMessage{}}
+	for ref, patch := range args.OnSuccessUpdateEmail {
+		if emailID, ok := sent[strings.TrimPrefix(ref, "#")]; ok {
+			emailSet.Update[emailID] = patch
+		}
+	}
+	for _, ref := range args.OnSuccessDestroyEmail {
+		if emailID, ok := sent[strings.TrimPrefix(ref, "#")]; ok {
+			emailSet.Destroy = append(emailSet.Destroy, emailID)
+		}
+	}
+	if len(emailSet.Update) > 0 || len(emailSet.Destroy) > 0 {
+		emailState, err := s.state(ctx, r.userID, typeEmail)
+		if err != nil {
+			return nil, err
+		}
+		setResp, err := s.applyEmailSet(ctx, r, emailSet, emailState)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.respond("Email/set", setResp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// submitted is an Email that was sent.
+type submitted struct {
+	emailID  string
+	threadID string
+	sendAt   time.Time
+}
+
+// submit sends the Email an EmailSubmission is for.
+func (s *Server) submit(ctx context.Context, r *request, raw json.RawMessage) (submitted, error) {
+	var c submissionCreate
+	if err := decodeObject(raw, &c); err != nil {
+		return submitted{}, err
+	}
+	if c.IdentityID != identityID {
+		return submitted{}, invalidProperties("No such identity", "identityId")
+	}
+	emailID, ok := r.resolveID(c.EmailID)
+	if !ok {
+		return submitted{}, invalidProperties("No such email", "emailId")
+	}
+	q := s.db.Queries()
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: emailID, UserID: r.userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return submitted{}, invalidProperties("No such email", "emailId")
+		}
+		return submitted{}, fmt.Errorf("failed to get message: %w", err)
+	}
+	u, err := q.GetUserByID(ctx, r.userID)
+	if err != nil {
+		return submitted{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	data, err := s.raw(ctx, q, msg.ID)
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return submitted{}, &setError{Type: setInvalidEmail, Description: "The email has no content"}
+		}
+		return submitted{}, err
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return submitted{}, &setError{Type: setInvalidEmail, Description: err.Error()}
+	}
+	from, err := parsed.Header.AddressList("From")
+	if err != nil || len(from) != 1 || !strings.EqualFold(from[0].Address, u.Email) {
+		return submitted{}, &setError{Type: setForbiddenFrom, Description: "Emails must be from " + u.Email}
+	}
+
+	var rcpt []string
+	if c.Envelope != nil {
+		if !strings.EqualFold(c.Envelope.MailFrom.Email, u.Email) {
+			return submitted{}, &setError{Type: setForbiddenMailFrom, Description: "Mail must be from " + u.Email}
+		}
+		for _, a := range c.Envelope.RcptTo {
+			rcpt = append(rcpt, a.Email)
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, field := range []string{"To", "Cc", "Bcc"} {
+			list, err := parsed.Header.AddressList(field)
+			if err != nil && !errors.Is(err, mail.ErrHeaderNotPresent) {
+				return submitted{}, &setError{Type: setInvalidRecipients, Description: err.Error()}
+			}
+			for _, a := range list {
+				if addr := strings.ToLower(a.Address); !seen[addr] {
+					seen[addr] = true
+					rcpt = append(rcpt, addr)
+				}
+			}
+		}
+	}
+	switch {
+	case len(rcpt) == 0:
+		return submitted{}, &setError{Type: setNoRecipients}
+	case len(rcpt) > maxRecipients:
+		return submitted{}, &setError{Type: setTooManyRecipients}
+	}
+	for _, a := range rcpt {
+		if _, err := mail.ParseAddress(a); err != nil {
+			return submitted{}, &setError{Type: setInvalidRecipients, Description: "Invalid address " + a}
+		}
+	}
+
+	sendAt := time.Now()
+	if err := s.mailer.Relay(ctx, r.userID, rcpt, data); err != nil {
+		switch {
+		case errors.Is(err, outbound.ErrSuppressed), errors.Is(err, outbound.ErrRelayFailed):
+			return submitted{}, &setError{Type: setForbiddenToSend, Description: err.Error()}
+		case errors.Is(err, outbound.ErrInvalidMessage):
+			return submitted{}, &setError{Type: setInvalidEmail, Description: err.Error()}
+		}
+		return submitted{}, err
+	}
+	return submitted{emailID: msg.ID, threadID: msg.ThreadID, sendAt: sendAt}, nil
+}
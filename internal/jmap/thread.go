@@ -0,0 +1,67 @@
+package jmap
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+)
+
+type thread struct {
+	ID       string   `json:"id"`
+	EmailIDs []string `json:"emailIds"`
+}
+
+func (s *Server) getThreads(ctx context.Context, r *request, raw json.RawMessage) (interface{}, error) {
+	var args getArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.IDs == nil {
+		return nil, &methodError{Type: errRequestTooLarge, Description: "ids must be given"}
+	}
+	ids, err := args.ids(r)
+	if err != nil {
+		return nil, err
+	}
+	props, err := properties(args.Properties, []string{"id", "emailIds"}, []string{"id", "emailIds"})
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.state(ctx, r.userID, typeThread)
+	if err != nil {
+		return nil, err
+	}
+
+	q := s.db.Queries()
+	resp := getResponse{AccountID: r.userID, State: state, List: []interface{}{}, NotFound: []string{}}
+	for i, id := range ids {
+		if _, err := q.GetThread(ctx, schema.GetThreadParams{ID: id, UserID: r.userID}); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				resp.NotFound = append(resp.NotFound, (*args.IDs)[i])
+				continue
+			}
+			return nil, fmt.Errorf("failed to get thread: %w", err)
+		}
+		msgs, err := q.ListThreadMessages(ctx, schema.ListThreadMessagesParams{UserID: r.userID, ThreadID: id})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list thread messages: %w", err)
+		}
+		t := thread{ID: id, EmailIDs: make([]string, len(msgs))}
+		for j, msg := range msgs {
+			t.EmailIDs[j] = msg.ID
+		}
+		obj, err := project(t, props)
+		if err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, obj)
+	}
+	return resp, nil
+}
@@ -0,0 +1,58 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mailroom_job_queue_depth",
+		Help: "Jobs in the queue by kind and status (queued, running or dead).",
+	}, []string{"kind", "status"})
+
+	jobLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mailroom_job_latency_seconds",
+		Help:    "Time from a job becoming due to a worker starting it.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"kind"})
+
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mailroom_job_duration_seconds",
+		Help:    "Time taken to run a job, by kind and outcome (ok or error).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"kind", "outcome"})
+)
+
+// reportDepth updates the queue depth gauge until ctx is cancelled.
+func (q *Queue) reportDepth(ctx context.Context) {
+	ticker := time.NewTicker(depthInterval)
+	defer ticker.Stop()
+	for {
+		if err := q.UpdateDepth(ctx); err != nil && ctx.Err() == nil {
+			logger.Error(ctx, "Failed to count jobs", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// UpdateDepth sets the queue depth gauge from the jobs in the database.
+func (q *Queue) UpdateDepth(ctx context.Context) error {
+	counts, err := q.queries.CountJobs(ctx)
+	if err != nil {
+		return err
+	}
+	queueDepth.Reset()
+	for _, c := range counts {
+		queueDepth.WithLabelValues(c.Kind, c.Status).Set(float64(c.Count))
+	}
+	return nil
+}
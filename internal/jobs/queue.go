@@ -0,0 +1,384 @@
+// Package jobs runs background work from a queue kept in the database, so
+// that slow or failure-prone processing happens outside request handlers and
+// survives restarts. Jobs are claimed under a lease: a job whose worker dies
+// is claimed again once its lease runs out, so handlers must tolerate running
+// more than once. Failed jobs are retried with exponential backoff and are
+// kept as dead after their last attempt.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+// Priorities; jobs with a higher priority are claimed first.
+const (
+	PriorityLow    = -10
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
+// Job statuses.
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDead    = "dead"
+)
+
+const (
+	// DefaultWorkers is used when JOB_WORKERS is not set.
+	DefaultWorkers = 4
+	// DefaultPollInterval is used when JOB_POLL_INTERVAL is not set.
+	DefaultPollInterval = time.Second
+	// DefaultTimeout is how long a job may run before its lease runs out
+	// and it is cancelled.
+	DefaultTimeout = 5 * time.Minute
+	// DefaultMaxAttempts is how many times a job is tried before it is dead.
+	DefaultMaxAttempts = 5
+
+	baseBackoff   = 5 * time.Second
+	maxBackoff    = 30 * time.Minute
+	depthInterval = 15 * time.Second
+)
+
+// ErrUnknownKind is returned when enqueueing a job no handler is registered
+// for.
+var ErrUnknownKind = errors.New("unknown job kind")
+
+// Handler runs a job. Returning an error retries the job later, until it has
+// had its maximum attempts.
+type Handler func(ctx context.Context, payload json.RawMessage) error
+
+// Options tune how the jobs of one kind are run. Zero fields take the
+// defaults.
+type Options struct {
+	Timeout     time.Duration
+	MaxAttempts int
+}
+
+type kind struct {
+	handler Handler
+	opts    Options
+}
+
+// Queue stores jobs and runs them on a bounded pool of workers.
+type Queue struct {
+	queries  *schema.Queries
+	workers  int
+	interval time.Duration
+	now      func() time.Time
+
+	mu    sync.RWMutex
+	kinds map[string]kind
+
+	// wake lets an enqueue start an idle worker before the next poll
+	wake chan struct{}
+
+	// ctx stops claiming new jobs; runCtx, cancelled only when Shutdown
+	// gives up waiting, stops the jobs already running
+	ctx       context.Context
+	cancel    context.CancelFunc
+	runCtx    context.Context
+	runCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// New creates a Queue with the default settings.
+func New(db database.Service) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	runCtx, runCancel := context.WithCancel(context.Background())
+	return &Queue{
+		queries:   db.Queries(),
+		workers:   DefaultWorkers,
+		interval:  DefaultPollInterval,
+		now:       time.Now,
+		kinds:     make(map[string]kind),
+		wake:      make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		runCtx:    runCtx,
+		runCancel: runCancel,
+	}
+}
+
+// NewFromEnv creates a Queue configured by the environment:
+//
+//	JOB_WORKERS        how many jobs run at once
+//	JOB_POLL_INTERVAL  how often idle workers look for due jobs
+func NewFromEnv(db database.Service) (*Queue, error) {
+	q := New(db)
+	if v := os.Getenv("JOB_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid JOB_WORKERS %q", v)
+		}
+		q.workers = n
+	}
+	if v := os.Getenv("JOB_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid JOB_POLL_INTERVAL %q", v)
+		}
+		q.interval = d
+	}
+	return q, nil
+}
+
+// Handle registers the handler for jobs of kind. It must be called before
+// jobs of that kind are enqueued.
+func (q *Queue) Handle(name string, h Handler, opts Options) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.kinds[name] = kind{handler: h, opts: opts}
+}
+
+func (q *Queue) kind(name string) (kind, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	k, ok := q.kinds[name]
+	return k, ok
+}
+
+// Enqueue adds a job whose payload is the JSON encoding of payload and
+// returns its ID.
+func (q *Queue) Enqueue(ctx context.Context, name string, payload interface{}, priority int) (string, error) {
+	return q.EnqueueTx(ctx, q.queries, name, payload, priority)
+}
+
+// EnqueueTx is Enqueue using tx, which should be bound to the transaction
+// that makes the change the job follows up on, so that the job is queued if
+// and only if the change is committed.
+func (q *Queue) EnqueueTx(ctx context.Context, tx *schema.Queries, name string, payload interface{}, priority int) (string, error) {
+	k, ok := q.kind(name)
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKind, name)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode job payload: %w", err)
+	}
+
+	id := uuid.New().String()
+	err = tx.InsertJob(ctx, schema.InsertJobParams{
+		ID:          id,
+		Kind:        name,
+		Payload:     string(b),
+		Priority:    int64(priority),
+		MaxAttempts: int64(k.opts.MaxAttempts),
+		RunAt:       q.now().UTC(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to insert job: %w", err)
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// Start runs the workers in the background until Shutdown.
+func (q *Queue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.work(q.ctx)
+		}()
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.reportDepth(q.ctx)
+	}()
+}
+
+// Shutdown stops claiming jobs and waits until ctx is done for the running
+// ones to finish. Jobs still running then are cancelled and run again after
+// a restart.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		// Jobs that don't stop in time are claimed again once their
+		// lease runs out
+		q.runCancel()
+		return ctx.Err()
+	}
+}
+
+// work runs jobs until ctx is cancelled, waiting for the poll interval or an
+// enqueue whenever none is due.
+func (q *Queue) work(ctx context.Context) {
+	timer := time.NewTimer(q.interval)
+	defer timer.Stop()
+	for {
+		ran, err := q.RunNext(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			metrics.Errors.WithLabelValues("job_queue").Inc()
+			logger.Error(ctx, "Failed to run job", "error", err)
+		}
+		if ran {
+			continue
+		}
+
+		timer.Reset(q.interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// RunNext claims the most urgent due job and runs it, reporting whether
+// there was one. Only failures to claim or record a job are returned; a
+// failing job is retried or killed.
+func (q *Queue) RunNext(ctx context.Context) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	now := q.now().UTC()
+	lease := uuid.New().String()
+	job, err := q.queries.ClaimJob(ctx, schema.ClaimJobParams{
+		Lease: lease,
+		// Every kind's jobs are leased for the longest timeout; the
+		// handler's own timeout is applied below
+		LeaseUntil: sql.NullTime{Time: now.Add(q.maxTimeout()), Valid: true},
+		Now:        now,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to claim job: %w", err)
+	}
+	jobLatency.WithLabelValues(job.Kind).Observe(now.Sub(job.RunAt).Seconds())
+
+	return true, q.run(job)
+}
+
+// maxTimeout returns the longest timeout of any kind.
+func (q *Queue) maxTimeout() time.Duration {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	longest := DefaultTimeout
+	for _, k := range q.kinds {
+		if k.opts.Timeout > longest {
+			longest = k.opts.Timeout
+		}
+	}
+	return longest
+}
+
+// run runs a claimed job and records the outcome.
+func (q *Queue) run(job schema.Job) error {
+	// Outcomes are recorded even while shutting down
+	ctx := context.WithoutCancel(q.runCtx)
+
+	k, ok := q.kind(job.Kind)
+	if !ok {
+		return q.kill(ctx, job, fmt.Sprintf("no handler for job kind %q", job.Kind))
+	}
+
+	start := time.Now()
+	err := q.call(job, k)
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	jobDuration.WithLabelValues(job.Kind, outcome).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err == nil:
+		if _, err := q.queries.CompleteJob(ctx, schema.CompleteJobParams{ID: job.ID, Lease: job.Lease}); err != nil {
+			return fmt.Errorf("failed to complete job %s: %w", job.ID, err)
+		}
+		return nil
+	case q.runCtx.Err() != nil:
+		// Cancelled by Shutdown; run it again after the restart
+		return q.retry(ctx, job, q.now().UTC(), err.Error())
+	case job.Attempts >= job.MaxAttempts:
+		metrics.Errors.WithLabelValues("job_dead").Inc()
+		return q.kill(ctx, job, err.Error())
+	default:
+		metrics.Errors.WithLabelValues("job_failed").Inc()
+		logger.Warn(ctx, "Job failed; retrying", "job_id", job.ID, "kind", job.Kind, "attempt", job.Attempts, "error", err)
+		return q.retry(ctx, job, q.now().UTC().Add(Backoff(int(job.Attempts))), err.Error())
+	}
+}
+
+// call runs the handler of job within its timeout, turning a panic into an
+// error so that one bad job can't take the worker down.
+func (q *Queue) call(job schema.Job, k kind) (err error) {
+	ctx, cancel := context.WithTimeout(q.runCtx, k.opts.Timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return k.handler(ctx, json.RawMessage(job.Payload))
+}
+
+func (q *Queue) retry(ctx context.Context, job schema.Job, at time.Time, reason string) error {
+	_, err := q.queries.RetryJob(ctx, schema.RetryJobParams{RunAt: at, LastError: reason, ID: job.ID, Lease: job.Lease})
+	if err != nil {
+		return fmt.Errorf("failed to requeue job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+func (q *Queue) kill(ctx context.Context, job schema.Job, reason string) error {
+	logger.Error(ctx, "Job is dead", "job_id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", reason)
+	_, err := q.queries.KillJob(ctx, schema.KillJobParams{LastError: reason, ID: job.ID, Lease: job.Lease})
+	if err != nil {
+		return fmt.Errorf("failed to kill job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+// Backoff returns how long to wait after the given number of failed
+// attempts: 5s doubling each time up to 30m, plus up to 10% jitter.
+func Backoff(attempts int) time.Duration {
+	wait := maxBackoff
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts < 20 {
+		if b := baseBackoff << (attempts - 1); b < maxBackoff {
+			wait = b
+		}
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait)/10+1))
+}
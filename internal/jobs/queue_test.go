@@ -0,0 +1,240 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestQueue returns a queue on a fresh database whose clock only moves
+// when the test advances it.
+func newTestQueue(t *testing.T) (database.Service, *Queue, *time.Time) {
+	t.Helper()
+	db := dbtest.New(t)
+	q := New(db)
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+	return db, q, &now
+}
+
+func TestPriority(t *testing.T) {
+	ctx := context.Background()
+	_, q, _ := newTestQueue(t)
+
+	var ran []string
+	q.Handle("record", func(ctx context.Context, payload json.RawMessage) error {
+		var name string
+		if err := json.Unmarshal(payload, &name); err != nil {
+			return err
+		}
+		ran = append(ran, name)
+		return nil
+	}, Options{})
+
+	for _, j := range []struct {
+		name     string
+		priority int
+	}{
+		{"normal", PriorityNormal},
+		{"low", PriorityLow},
+		{"high", PriorityHigh},
+		{"normal again", PriorityNormal},
+	} {
+		if _, err := q.Enqueue(ctx, "record", j.name, j.priority); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		ok, err := q.RunNext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+	}
+	if got := strings.Join(ran, ", "); got != "high, normal, normal again, low" {
+		t.Errorf("ran %s", got)
+	}
+
+	if _, err := q.Enqueue(ctx, "missing", nil, PriorityNormal); !errors.Is(err, ErrUnknownKind) {
+		t.Errorf("enqueueing an unknown kind = %v, want ErrUnknownKind", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	db, q, now := newTestQueue(t)
+
+	calls := 0
+	q.Handle("flaky", func(ctx context.Context, payload json.RawMessage) error {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		return errors.New("unavailable")
+	}, Options{MaxAttempts: 3})
+
+	id, err := q.Enqueue(ctx, "flaky", nil, PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if ok, err := q.RunNext(ctx); err != nil || !ok {
+			t.Fatalf("attempt %d: RunNext = %t, %v", attempt, ok, err)
+		}
+		job, err := db.Queries().GetJob(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Attempts != int64(attempt) {
+			t.Errorf("attempt %d: job has %d attempts", attempt, job.Attempts)
+		}
+		if attempt == 1 && !strings.Contains(job.LastError, "boom") {
+			t.Errorf("a panic was recorded as %q", job.LastError)
+		}
+		if attempt == 3 {
+			if job.Status != StatusDead {
+				t.Errorf("after the last attempt the job is %s, want dead", job.Status)
+			}
+			break
+		}
+		if job.Status != StatusQueued || !job.RunAt.After(*now) {
+			t.Errorf("attempt %d: job is %s to run at %v", attempt, job.Status, job.RunAt)
+		}
+
+		// Not due until its backoff has passed
+		if ok, _ := q.RunNext(ctx); ok {
+			t.Fatalf("attempt %d: retried before its backoff", attempt)
+		}
+		*now = job.RunAt
+	}
+
+	*now = now.Add(24 * time.Hour)
+	if ok, _ := q.RunNext(ctx); ok {
+		t.Error("a dead job was run")
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	db, q, now := newTestQueue(t)
+
+	done := 0
+	q.Handle("once", func(ctx context.Context, payload json.RawMessage) error {
+		done++
+		return nil
+	}, Options{Timeout: time.Minute})
+
+	id, err := q.Enqueue(ctx, "once", nil, PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A worker that claims the job and dies
+	_, err = db.Queries().ClaimJob(ctx, schema.ClaimJobParams{
+		Lease:      "lost",
+		LeaseUntil: sql.NullTime{Time: now.Add(DefaultTimeout), Valid: true},
+		Now:        *now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := q.RunNext(ctx); ok {
+		t.Fatal("a leased job was claimed again")
+	}
+
+	*now = now.Add(DefaultTimeout)
+	if ok, err := q.RunNext(ctx); err != nil || !ok {
+		t.Fatalf("RunNext after the lease ran out = %t, %v", ok, err)
+	}
+	if done != 1 {
+		t.Errorf("handler ran %d times", done)
+	}
+	if _, err := db.Queries().GetJob(ctx, id); err == nil {
+		t.Error("a completed job was kept")
+	}
+
+	// The lost worker can no longer record an outcome
+	n, err := db.Queries().CompleteJob(ctx, schema.CompleteJobParams{ID: id, Lease: "lost"})
+	if err != nil || n != 0 {
+		t.Errorf("completing with an old lease = %d, %v", n, err)
+	}
+}
+
+func TestUpdateDepth(t *testing.T) {
+	ctx := context.Background()
+	_, q, _ := newTestQueue(t)
+	q.Handle("depth", func(ctx context.Context, payload json.RawMessage) error { return nil }, Options{})
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.Enqueue(ctx, "depth", nil, PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.UpdateDepth(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(queueDepth.WithLabelValues("depth", StatusQueued)); got != 2 {
+		t.Errorf("queued depth = %v, want 2", got)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+	q := New(db)
+	q.interval = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	ran := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	q.Handle("slow", func(ctx context.Context, payload json.RawMessage) error {
+		mu.Lock()
+		ran++
+		mu.Unlock()
+		started <- struct{}{}
+		<-release
+		return nil
+	}, Options{})
+
+	if _, err := q.Enqueue(ctx, "slow", nil, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	q.Start()
+	<-started
+
+	// Shutdown waits for the running job to finish
+	shutdown := make(chan error)
+	go func() { shutdown <- q.Shutdown(ctx) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v while a job was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is claimed after Shutdown
+	if _, err := q.Enqueue(ctx, "slow", nil, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if ran != 1 {
+		t.Errorf("handler ran %d times", ran)
+	}
+}
@@ -0,0 +1,184 @@
+// Package labels organizes users' messages under labels. A message carries
+// any number of them. Users create their own labels, which nest by path
+// ("Work/Clients/Acme"), and every user has the system labels Inbox, Sent,
+// Archive, Trash and Spam. Messages refer to labels by path, so rules and
+// sieve scripts label mail by name; Add creates the labels they name.
+//
+// Inbox and Archive aren't stored on messages: a message is in the Inbox
+// until it is archived, and in Archive once it is, unless it is sent, trash
+// or spam. Moving a message to Trash or Spam takes it out of the Inbox.
+package labels
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+)
+
+var (
+	ErrLabelNotFound   = errors.New("label not found")
+	ErrLabelExists     = errors.New("label already exists")
+	ErrSystemLabel     = errors.New("system labels can't be changed")
+	ErrInvalidLabel    = errors.New("invalid label")
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+// The system labels.
+const (
+	Inbox   = "Inbox"
+	Sent    = "Sent"
+	Archive = "Archive"
+	Trash   = "Trash"
+	Spam    = "Spam"
+)
+
+// system lists the system labels in the order they are shown, with their
+// IDs.
+var system = []struct{ id, name string }{
+	{"inbox", Inbox},
+	{"sent", Sent},
+	{"archive", Archive},
+	{"trash", Trash},
+	{"spam", Spam},
+}
+
+// Separator separates the segments of a label's path.
+const Separator = "/"
+
+const maxPath = 255
+
+var color = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// Label is a label and the number of messages it is on, as the API shows
+// it. Name is the last segment of Path. System labels have no color or
+// timestamps.
+type Label struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	Color     string     `json:"color,omitempty"`
+	System    bool       `json:"system"`
+	Total     int64      `json:"total"`
+	Unread    int64      `json:"unread"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+func newLabel(row schema.GetLabelRow) Label {
+	return Label{
+		ID:        row.ID,
+		Name:      name(row.Path),
+		Path:      row.Path,
+		Color:     row.Color,
+		Total:     row.Total,
+		Unread:    row.Unread,
+		CreatedAt: &row.CreatedAt,
+		UpdatedAt: &row.UpdatedAt,
+	}
+}
+
+func name(path string) string {
+	return path[strings.LastIndex(path, Separator)+1:]
+}
+
+// systemName returns the canonical name of the system label s names, in any
+// case, or "" if s isn't one.
+func systemName(s string) string {
+	for _, l := range system {
+		if strings.EqualFold(s, l.name) {
+			return l.name
+		}
+	}
+	return ""
+}
+
+// SystemID returns the ID of the system label name, or "" if it isn't one.
+func SystemID(name string) string {
+	for _, l := range system {
+		if l.name == name {
+			return l.id
+		}
+	}
+	return ""
+}
+
+// Mailbox returns Inbox or Archive, whichever a message with the stored
+// labels is in, or "" if it is in neither.
+func Mailbox(stored []string, archived bool) string {
+	for _, l := range stored {
+		if l == Sent || l == Trash || l == Spam {
+			return ""
+		}
+	}
+	if archived {
+		return Archive
+	}
+	return Inbox
+}
+
+// Normalize returns path with its segments trimmed, or an error if it isn't
+// a valid path for a label users create.
+func Normalize(path string) (string, error) {
+	segments := strings.Split(path, Separator)
+	for i, s := range segments {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return "", fmt.Errorf("%w: path segments can't be empty", ErrInvalidLabel)
+		}
+		if strings.ContainsFunc(s, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+			return "", fmt.Errorf("%w: path contains control characters", ErrInvalidLabel)
+		}
+		segments[i] = s
+	}
+	path = strings.Join(segments, Separator)
+	if len(path) > maxPath {
+		return "", fmt.Errorf("%w: path is longer than %d bytes", ErrInvalidLabel, maxPath)
+	}
+	if systemName(path) != "" {
+		return "", fmt.Errorf("%w: %q is a system label", ErrInvalidLabel, path)
+	}
+	return path, nil
+}
+
+// Canonical returns the name label is stored under: the name of the system
+// label it names, in any case, or else its path normalized.
+func Canonical(label string) (string, error) {
+	if name := systemName(label); name != "" {
+		return name, nil
+	}
+	return Normalize(label)
+}
+
+// normalizeColor returns c in lower case, or an error if it isn't empty or
+// an "#rrggbb" color.
+func normalizeColor(c string) (string, error) {
+	c = strings.ToLower(strings.TrimSpace(c))
+	if c != "" && !color.MatchString(c) {
+		return "", fmt.Errorf("%w: color must look like #rrggbb", ErrInvalidLabel)
+	}
+	return c, nil
+}
+
+// parents returns the paths of the labels path nests under, outermost
+// first.
+func parents(path string) []string {
+	var list []string
+	for i := strings.Index(path, Separator); i >= 0; {
+		list = append(list, path[:i])
+		next := strings.Index(path[i+1:], Separator)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return list
+}
+
+// under reports whether path is parent or nests under it.
+func under(path, parent string) bool {
+	return path == parent || strings.HasPrefix(path, parent+Separator)
+}
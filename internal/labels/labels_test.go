@@ -0,0 +1,213 @@
+package labels
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+func TestNormalize(t *testing.T) {
+	for path, want := range map[string]string{
+		"Work":                         "Work",
+		" Work / Clients /x":           "Work/Clients/x",
+		"inbox/Receipts":               "inbox/Receipts",
+		"":                             "",
+		"Work//Clients":                "",
+		"Work/":                        "",
+		"Tab\tbed":                     "",
+		"SPAM":                         "",
+		strings.Repeat("x", maxPath+1): "",
+	} {
+		got, err := Normalize(path)
+		if got != want || (want == "") != errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("Normalize(%q) = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if got := parents("a/b/c"); strings.Join(got, ",") != "a,a/b" {
+		t.Errorf("got parents %v", got)
+	}
+}
+
+// userPaths returns the paths of the user labels in list.
+func userPaths(list []Label) string {
+	var out []string
+	for _, l := range list {
+		if !l.System {
+			out = append(out, l.Path)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+func TestCRUD(t *testing.T) {
+	db := dbtest.New(t)
+	dbtest.AddUser(t, db, "u2", "other@example.com")
+	s := New(db)
+	ctx := context.Background()
+
+	l, err := s.Create(ctx, "u1", "Work/Clients/Acme", "#FF0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Name != "Acme" || l.Color != "#ff0000" || l.System || l.CreatedAt == nil {
+		t.Errorf("got %+v", l)
+	}
+	if _, err := s.Create(ctx, "u1", "Work", ""); !errors.Is(err, ErrLabelExists) {
+		t.Errorf("got %v, want %v", err, ErrLabelExists)
+	}
+	if _, err := s.Create(ctx, "u1", "Work", "red"); !errors.Is(err, ErrInvalidLabel) {
+		t.Errorf("got %v, want %v", err, ErrInvalidLabel)
+	}
+	if _, err := s.Create(ctx, "u2", "Work", ""); err != nil {
+		t.Errorf("other user's label: %v", err)
+	}
+
+	list, err := s.List(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(system)+3 || list[0].ID != "inbox" || !list[0].System {
+		t.Fatalf("got %+v", list)
+	}
+	if got := userPaths(list); got != "Work,Work/Clients,Work/Clients/Acme" {
+		t.Errorf("got paths %s", got)
+	}
+	clients := list[len(system)+1]
+
+	// Renaming moves the nested labels too
+	if _, err := s.Update(ctx, "u1", clients.ID, "Customers", "#00ff00"); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = s.List(ctx, "u1")
+	if got := userPaths(list); got != "Customers,Customers/Acme,Work" {
+		t.Errorf("got paths %s", got)
+	}
+	if _, err := s.Update(ctx, "u1", clients.ID, "Work", ""); !errors.Is(err, ErrLabelExists) {
+		t.Errorf("got %v, want %v", err, ErrLabelExists)
+	}
+	if _, err := s.Update(ctx, "u1", clients.ID, "Customers/Old", ""); !errors.Is(err, ErrInvalidLabel) {
+		t.Errorf("got %v, want %v", err, ErrInvalidLabel)
+	}
+	if _, err := s.Update(ctx, "u2", clients.ID, "Mine", ""); !errors.Is(err, ErrLabelNotFound) {
+		t.Errorf("got %v, want %v", err, ErrLabelNotFound)
+	}
+	if _, err := s.Update(ctx, "u1", "trash", "Bin", ""); !errors.Is(err, ErrSystemLabel) {
+		t.Errorf("got %v, want %v", err, ErrSystemLabel)
+	}
+
+	if err := s.Delete(ctx, "u1", "inbox"); !errors.Is(err, ErrSystemLabel) {
+		t.Errorf("got %v, want %v", err, ErrSystemLabel)
+	}
+	if err := s.Delete(ctx, "u1", clients.ID); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = s.List(ctx, "u1")
+	if got := userPaths(list); got != "Work" {
+		t.Errorf("got paths %s", got)
+	}
+	if err := s.Delete(ctx, "u1", clients.ID); !errors.Is(err, ErrLabelNotFound) {
+		t.Errorf("got %v, want %v", err, ErrLabelNotFound)
+	}
+}
+
+func TestModify(t *testing.T) {
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	s := New(db)
+	ctx := context.Background()
+
+	var ids []string
+	for _, subject := range []string{"One", "Two"} {
+		id, err := store.Deliver(ctx, mailstore.Delivery{
+			UserID: "u1",
+			Raw:    []byte("From: bob@example.net\r\nTo: user@example.com\r\nSubject: " + subject + "\r\n\r\nHi\r\n"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	work, err := s.Create(ctx, "u1", "Work", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := func(id string) (int64, int64) {
+		t.Helper()
+		l, err := s.Get(ctx, "u1", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Total, l.Unread
+	}
+
+	if err := s.Modify(ctx, "u1", ids, []string{work.ID, "archive"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if total, unread := counts(work.ID); total != 2 || unread != 2 {
+		t.Errorf("got %d/%d in Work, want 2/2", total, unread)
+	}
+	if total, _ := counts("inbox"); total != 0 {
+		t.Errorf("got %d in Inbox, want 0", total)
+	}
+	if total, _ := counts("archive"); total != 2 {
+		t.Errorf("got %d in Archive, want 2", total)
+	}
+
+	// Trash leaves Archive; removing Archive brings mail back to the Inbox
+	if err := s.Modify(ctx, "u1", ids[:1], []string{"trash"}, []string{work.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Modify(ctx, "u1", ids[1:], nil, []string{"archive"}); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]int64{work.ID: 1, "trash": 1, "archive": 0, "inbox": 1} {
+		if total, _ := counts(id); total != want {
+			t.Errorf("got %d in %s, want %d", total, id, want)
+		}
+	}
+
+	// Nothing changes if a message or label is unknown
+	if err := s.Modify(ctx, "u1", []string{ids[1], "missing"}, []string{"spam"}, nil); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("got %v, want %v", err, ErrMessageNotFound)
+	}
+	if err := s.Modify(ctx, "u1", ids, []string{"missing"}, nil); !errors.Is(err, ErrLabelNotFound) {
+		t.Errorf("got %v, want %v", err, ErrLabelNotFound)
+	}
+	if total, _ := counts("spam"); total != 0 {
+		t.Errorf("got %d in Spam, want 0", total)
+	}
+
+	// Labels added by name are created, nested under their parents
+	err = db.WithTx(ctx, func(q *schema.Queries) error {
+		return Add(ctx, q, "u1", ids[1], "Projects/Launch")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := userPaths(list); got != "Projects,Projects/Launch,Work" {
+		t.Errorf("got paths %s", got)
+	}
+
+	// Renaming keeps the label on its messages
+	if _, err := s.Update(ctx, "u1", work.ID, "Job", ""); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Queries().ListMessageLabels(ctx, ids[1])
+	if err != nil || strings.Join(got, ",") != "Job,Projects/Launch" {
+		t.Errorf("got labels %v, %v", got, err)
+	}
+}
@@ -0,0 +1,338 @@
+package labels
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+// Service keeps users' labels and the labels on their messages.
+type Service struct {
+	db database.Service
+}
+
+// New creates a Service.
+func New(db database.Service) *Service {
+	return &Service{db: db}
+}
+
+// List returns userID's labels: the system labels first, then the user's own
+// in path order, so that each label follows the one it nests under.
+func (s *Service) List(ctx context.Context, userID string) ([]Label, error) {
+	q := s.db.Queries()
+	list := make([]Label, 0, len(system))
+	for _, l := range system {
+		sl, err := systemLabel(ctx, q, userID, l.id, l.name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sl)
+	}
+	rows, err := q.ListLabelsByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list labels: %w", err)
+	}
+	for _, row := range rows {
+		list = append(list, newLabel(schema.GetLabelRow(row)))
+	}
+	return list, nil
+}
+
+// Get returns one of userID's labels.
+func (s *Service) Get(ctx context.Context, userID, id string) (Label, error) {
+	return getLabel(ctx, s.db.Queries(), userID, id)
+}
+
+func getLabel(ctx context.Context, q *schema.Queries, userID, id string) (Label, error) {
+	for _, l := range system {
+		if l.id == id {
+			return systemLabel(ctx, q, userID, l.id, l.name)
+		}
+	}
+	row, err := q.GetLabel(ctx, schema.GetLabelParams{ID: id, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Label{}, ErrLabelNotFound
+		}
+		return Label{}, fmt.Errorf("failed to get label: %w", err)
+	}
+	return newLabel(row), nil
+}
+
+// systemLabel counts the messages of userID's the system label name is on.
+func systemLabel(ctx context.Context, q *schema.Queries, userID, id, name string) (Label, error) {
+	var counts schema.CountMessagesByLabelRow
+	var err error
+	switch name {
+	case Inbox, Archive:
+		var row schema.CountMessagesByArchivedRow
+		row, err = q.CountMessagesByArchived(ctx, schema.CountMessagesByArchivedParams{UserID: userID, Archived: name == Archive})
+		counts = schema.CountMessagesByLabelRow(row)
+	default:
+		counts, err = q.CountMessagesByLabel(ctx, schema.CountMessagesByLabelParams{UserID: userID, Label: name})
+	}
+	if err != nil {
+		return Label{}, fmt.Errorf("failed to count messages labeled %s: %w", name, err)
+	}
+	return Label{ID: id, Name: name, Path: name, System: true, Total: counts.Total, Unread: counts.Unread}, nil
+}
+
+// Create creates a label of userID's at path, and the labels it nests under
+// that don't exist yet.
+func (s *Service) Create(ctx context.Context, userID, path, color string) (Label, error) {
+	path, err := Normalize(path)
+	if err != nil {
+		return Label{}, err
+	}
+	if color, err = normalizeColor(color); err != nil {
+		return Label{}, err
+	}
+	id := uuid.New().String()
+	err = s.db.WithTx(ctx, func(q *schema.Queries) error {
+		if err := ensure(ctx, q, userID, parents(path)); err != nil {
+			return err
+		}
+		n, err := q.InsertLabel(ctx, schema.InsertLabelParams{ID: id, UserID: userID, Path: path, Color: color})
+		if err != nil {
+			return fmt.Errorf("failed to insert label: %w", err)
+		}
+		if n == 0 {
+			return fmt.Errorf("%w: %s", ErrLabelExists, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return Label{}, err
+	}
+	return s.Get(ctx, userID, id)
+}
+
+// Update renames and recolors one of userID's labels. The labels nested
+// under it move with it, and its messages keep it.
+func (s *Service) Update(ctx context.Context, userID, id, path, color string) (Label, error) {
+	path, err := Normalize(path)
+	if err != nil {
+		return Label{}, err
+	}
+	if color, err = normalizeColor(color); err != nil {
+		return Label{}, err
+	}
+	err = s.db.WithTx(ctx, func(q *schema.Queries) error {
+		l, err := getLabel(ctx, q, userID, id)
+		if err != nil {
+			return err
+		}
+		if l.System {
+			return ErrSystemLabel
+		}
+		if path != l.Path {
+			if strings.HasPrefix(path, l.Path+Separator) {
+				return fmt.Errorf("%w: a label can't nest under itself", ErrInvalidLabel)
+			}
+			if err := rename(ctx, q, userID, l.Path, path); err != nil {
+				return err
+			}
+		}
+		_, err = q.UpdateLabel(ctx, schema.UpdateLabelParams{Path: path, Color: color, ID: id, UserID: userID})
+		if err != nil {
+			return fmt.Errorf("failed to update label: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Label{}, err
+	}
+	return s.Get(ctx, userID, id)
+}
+
+// rename moves the labels nested under from to nest under to, and relabels
+// their messages. The label at from itself is only relabeled on messages.
+func rename(ctx context.Context, q *schema.Queries, userID, from, to string) error {
+	rows, err := q.ListLabelsByUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to list labels: %w", err)
+	}
+	for _, row := range rows {
+		if under(row.Path, to) && !under(row.Path, from) {
+			return fmt.Errorf("%w: %s", ErrLabelExists, to)
+		}
+	}
+	if err := ensure(ctx, q, userID, parents(to)); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if !under(row.Path, from) {
+			continue
+		}
+		newPath := to + strings.TrimPrefix(row.Path, from)
+		if row.Path != from {
+			_, err := q.UpdateLabel(ctx, schema.UpdateLabelParams{Path: newPath, Color: row.Color, ID: row.ID, UserID: userID})
+			if err != nil {
+				return fmt.Errorf("failed to move label: %w", err)
+			}
+		}
+		err := q.RenameMessageLabels(ctx, schema.RenameMessageLabelsParams{NewLabel: newPath, UserID: userID, OldLabel: row.Path})
+		if err != nil {
+			return fmt.Errorf("failed to relabel messages: %w", err)
+		}
+	}
+	return nil
+}
+
+// Delete deletes one of userID's labels and the labels nested under it, and
+// takes them off its messages. The messages themselves are kept.
+func (s *Service) Delete(ctx context.Context, userID, id string) error {
+	return s.db.WithTx(ctx, func(q *schema.Queries) error {
+		l, err := getLabel(ctx, q, userID, id)
+		if err != nil {
+			return err
+		}
+		if l.System {
+			return ErrSystemLabel
+		}
+		rows, err := q.ListLabelsByUser(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to list labels: %w", err)
+		}
+		for _, row := range rows {
+			if !under(row.Path, l.Path) {
+				continue
+			}
+			if _, err := q.DeleteLabel(ctx, schema.DeleteLabelParams{ID: row.ID, UserID: userID}); err != nil {
+				return fmt.Errorf("failed to delete label: %w", err)
+			}
+			err := q.DeleteMessageLabelsByLabel(ctx, schema.DeleteMessageLabelsByLabelParams{UserID: userID, Label: row.Path})
+			if err != nil {
+				return fmt.Errorf("failed to unlabel messages: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Modify adds and removes labels, given by ID, on messages of userID's. The
+// change is made to all of the messages or, if any of them or the labels
+// doesn't exist, to none.
+func (s *Service) Modify(ctx context.Context, userID string, messageIDs, add, remove []string) error {
+	return s.db.WithTx(ctx, func(q *schema.Queries) error {
+		addNames, err := paths(ctx, q, userID, add)
+		if err != nil {
+			return err
+		}
+		removeNames, err := paths(ctx, q, userID, remove)
+		if err != nil {
+			return err
+		}
+		for _, id := range messageIDs {
+			if _, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: userID}); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return fmt.Errorf("%w: %s", ErrMessageNotFound, id)
+				}
+				return fmt.Errorf("failed to get message: %w", err)
+			}
+			for _, name := range removeNames {
+				if err := Remove(ctx, q, userID, id, name); err != nil {
+					return err
+				}
+			}
+			for _, name := range addNames {
+				if err := Add(ctx, q, userID, id, name); err != nil {
+					return err
+				}
+			}
+			if len(addNames) > 0 {
+				err := webhook.PublishTx(ctx, q, userID, webhook.EventMessageLabeled, webhook.MessageLabeled{MessageID: id, Labels: addNames})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// paths returns the paths of the labels of userID's with the given IDs.
+func paths(ctx context.Context, q *schema.Queries, userID string, ids []string) ([]string, error) {
+	list := make([]string, 0, len(ids))
+	for _, id := range ids {
+		l, err := getLabel(ctx, q, userID, id)
+		if err != nil {
+			if errors.Is(err, ErrLabelNotFound) {
+				return nil, fmt.Errorf("%w: %s", ErrLabelNotFound, id)
+			}
+			return nil, err
+		}
+		list = append(list, l.Path)
+	}
+	return list, nil
+}
+
+// Add puts the label named label on one of userID's messages, creating the
+// label if it is the user's own and doesn't exist yet. System labels are
+// named in any case. q should be bound to the transaction making the change.
+func Add(ctx context.Context, q *schema.Queries, userID, messageID, label string) error {
+	name, err := Canonical(label)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case Inbox, Archive:
+		return setArchived(ctx, q, userID, messageID, name == Archive)
+	case Sent, Trash, Spam:
+	default:
+		if err := ensure(ctx, q, userID, append(parents(name), name)); err != nil {
+			return err
+		}
+	}
+	err = q.AddMessageLabel(ctx, schema.AddMessageLabelParams{MessageID: messageID, UserID: userID, Label: name})
+	if err != nil {
+		return fmt.Errorf("failed to label message: %w", err)
+	}
+	if name == Trash || name == Spam {
+		return setArchived(ctx, q, userID, messageID, true)
+	}
+	return nil
+}
+
+// Remove takes the label named label off one of userID's messages. Taking a
+// message out of the Inbox archives it, and taking it out of Archive moves it
+// back to the Inbox. q should be bound to the transaction making the change.
+func Remove(ctx context.Context, q *schema.Queries, userID, messageID, label string) error {
+	name := systemName(label)
+	switch name {
+	case Inbox, Archive:
+		return setArchived(ctx, q, userID, messageID, name == Inbox)
+	case "":
+		name = label
+	}
+	if _, err := q.RemoveMessageLabel(ctx, schema.RemoveMessageLabelParams{MessageID: messageID, Label: name}); err != nil {
+		return fmt.Errorf("failed to unlabel message: %w", err)
+	}
+	return nil
+}
+
+func setArchived(ctx context.Context, q *schema.Queries, userID, messageID string, archived bool) error {
+	err := q.SetMessageArchived(ctx, schema.SetMessageArchivedParams{Archived: archived, ID: messageID, UserID: userID})
+	if err != nil {
+		return fmt.Errorf("failed to archive message: %w", err)
+	}
+	return nil
+}
+
+// ensure creates the labels of userID's at paths that don't exist yet.
+func ensure(ctx context.Context, q *schema.Queries, userID string, paths []string) error {
+	for _, path := range paths {
+		_, err := q.InsertLabel(ctx, schema.InsertLabelParams{ID: uuid.New().String(), UserID: userID, Path: path})
+		if err != nil {
+			return fmt.Errorf("failed to insert label: %w", err)
+		}
+	}
+	return nil
+}
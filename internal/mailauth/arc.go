@@ -0,0 +1,375 @@
+package mailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxInstances is the largest ARC instance number allowed (RFC 8617
+// section 4.2.1).
+const maxInstances = 50
+
+// ARC header field names.
+const (
+	arcResultsField   = "ARC-Authentication-Results"
+	arcSignatureField = "ARC-Message-Signature"
+	arcSealField      = "ARC-Seal"
+)
+
+// Chain validation statuses, as carried in the cv= tag of an ARC-Seal.
+const (
+	chainNone = "none"
+	chainPass = "pass"
+	chainFail = "fail"
+)
+
+var (
+	// ErrChainFailed is returned when sealing a message whose ARC chain is
+	// already marked failed.
+	ErrChainFailed = errors.New("ARC chain has failed")
+	// ErrTooManyInstances is returned when sealing a message that already
+	// carries the most ARC sets allowed.
+	ErrTooManyInstances = errors.New("ARC chain is too long")
+)
+
+// ARCResult is the outcome of validating the message's ARC chain (RFC 8617):
+// the sets of authentication results, message signature and seal added by
+// each intermediary, such as a mailing list, that handled it.
+type ARCResult struct {
+	Result   string   `json:"result"`
+	Instance int      `json:"instance,omitempty"` // the number of sets in the chain
+	Sealers  []string `json:"sealers,omitempty"`  // the d= of each seal, oldest first
+	Reason   string   `json:"reason,omitempty"`
+
+	results []string // the ARC-Authentication-Results of each set, oldest first
+}
+
+// arcSet is the three header fields one intermediary added.
+type arcSet struct {
+	instance  int
+	results   field
+	signature field
+	seal      field
+	sealTags  map[string]string
+}
+
+// verifyARC validates the message's ARC chain. A chain only passes if every
+// seal verifies, and the message signature of the newest set does too.
+func verifyARC(ctx context.Context, r Resolver, fields []field, body []byte, now time.Time) ARCResult {
+	sets, err := arcSets(fields)
+	if err != nil {
+		return ARCResult{Result: ResultFail, Reason: err.Error()}
+	}
+	if len(sets) == 0 {
+		return ARCResult{Result: ResultNone}
+	}
+	res := ARCResult{Instance: len(sets)}
+	for _, set := range sets {
+		res.Sealers = append(res.Sealers, strings.ToLower(set.sealTags["d"]))
+		res.results = append(res.results, set.results.value())
+	}
+	fail := func(format string, args ...any) ARCResult {
+		res.Result, res.Reason = ResultFail, fmt.Sprintf(format, args...)
+		return res
+	}
+
+	newest := sets[len(sets)-1]
+	if cv := strings.ToLower(newest.sealTags["cv"]); cv == chainFail {
+		return fail("chain marked failed at i=%d", newest.instance)
+	}
+	for _, set := range sets {
+		want := chainPass
+		if set.instance == 1 {
+			want = chainNone
+		}
+		if cv := strings.ToLower(set.sealTags["cv"]); cv != want {
+			return fail("i=%d has cv=%s", set.instance, cv)
+		}
+	}
+
+	if ams := verifyMessageSignature(ctx, r, newest.signature, fields, body, now); ams.Result != ResultPass {
+		return fail("message signature i=%d: %s", newest.instance, ams.Reason)
+	}
+	for i := len(sets); i >= 1; i-- {
+		if err := verifySeal(ctx, r, sets[:i]); err != nil {
+			return fail("seal i=%d: %v", i, err)
+		}
+	}
+	res.Result = ResultPass
+	return res
+}
+
+// arcSets gathers the message's ARC sets, oldest first. It fails unless
+// each instance from 1 up has exactly one field of each kind.
+func arcSets(fields []field) ([]arcSet, error) {
+	byInstance := map[int]*arcSet{}
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, arcResultsField) && !strings.EqualFold(f.name, arcSignatureField) && !strings.EqualFold(f.name, arcSealField) {
+			continue
+		}
+		i, tags, err := arcInstance(f)
+		if err != nil {
+			return nil, err
+		}
+		set := byInstance[i]
+		if set == nil {
+			set = &arcSet{instance: i}
+			byInstance[i] = set
+		}
+		slot := &set.seal
+		switch {
+		case strings.EqualFold(f.name, arcResultsField):
+			slot = &set.results
+		case strings.EqualFold(f.name, arcSignatureField):
+			slot = &set.signature
+		default:
+			set.sealTags = tags
+		}
+		if slot.raw != "" {
+			return nil, fmt.Errorf("more than one %s with i=%d", f.name, i)
+		}
+		*slot = f
+	}
+
+	sets := make([]arcSet, 0, len(byInstance))
+	for _, set := range byInstance {
+		sets = append(sets, *set)
+	}
+	sort.Slice(sets, func(a, b int) bool { return sets[a].instance < sets[b].instance })
+	for n, set := range sets {
+		if set.instance != n+1 {
+			return nil, fmt.Errorf("missing ARC set i=%d", n+1)
+		}
+		if set.results.raw == "" || set.signature.raw == "" || set.seal.raw == "" {
+			return nil, fmt.Errorf("incomplete ARC set i=%d", set.instance)
+		}
+	}
+	return sets, nil
+}
+
+// arcInstance reads the i= tag of an ARC field. For ARC-Message-Signature
+// and ARC-Seal fields it also returns their parsed tags; the results of an
+// ARC-Authentication-Results field aren't a tag list, so only its leading
+// i= is read.
+func arcInstance(f field) (int, map[string]string, error) {
+	value := f.value()
+	var tags map[string]string
+	if strings.EqualFold(f.name, arcResultsField) {
+		first, _, _ := strings.Cut(value, ";")
+		name, n, _ := strings.Cut(first, "=")
+		if strings.TrimSpace(name) == "i" {
+			tags = map[string]string{"i": strings.TrimSpace(n)}
+		}
+	} else {
+		tags = parseTags(value)
+	}
+	if tags == nil {
+		return 0, nil, fmt.Errorf("malformed %s", f.name)
+	}
+	i, err := strconv.Atoi(tags["i"])
+	if err != nil || i < 1 || i > maxInstances {
+		return 0, nil, fmt.Errorf("%s has an invalid instance", f.name)
+	}
+	return i, tags, nil
+}
+
+// verifyMessageSignature verifies an ARC-Message-Signature the way a DKIM
+// signature is verified. It may not sign ARC-Seal fields.
+func verifyMessageSignature(ctx context.Context, r Resolver, f field, fields []field, body []byte, now time.Time) DKIMResult {
+	s, err := parseSignature(f, true)
+	if s == nil {
+		return DKIMResult{Result: ResultPermError, Reason: err.Error()}
+	}
+	if err == nil && containsFold(s.headers, arcSealField) {
+		err = fmt.Errorf("ARC-Seal is signed")
+	}
+	if err != nil {
+		return DKIMResult{Result: ResultPermError, Reason: err.Error()}
+	}
+	return verifyParsed(ctx, r, s, fields, body, now)
+}
+
+// verifySeal verifies the seal of the last of sets, which covers every set
+// up to and including its own.
+func verifySeal(ctx context.Context, r Resolver, sets []arcSet) error {
+	tags := sets[len(sets)-1].sealTags
+	for _, tag := range []string{"a", "b", "cv", "d", "s"} {
+		if tags[tag] == "" {
+			return fmt.Errorf("missing %s= tag", tag)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return fmt.Errorf("h= tag is not allowed")
+	}
+	s := &dkimSignature{
+		algorithm: tags["a"],
+		domain:    strings.ToLower(strings.TrimSuffix(tags["d"], ".")),
+		selector:  strings.ToLower(tags["s"]),
+	}
+	if s.algorithm != AlgorithmRSASHA256 && s.algorithm != AlgorithmEd25519SHA256 {
+		return fmt.Errorf("unsupported algorithm %q", s.algorithm)
+	}
+	sig, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("malformed b= tag")
+	}
+	key, _, err := lookupKey(ctx, r, s)
+	if err != nil {
+		return err
+	}
+	if !verifyHash(key, sealHash(sets), sig) {
+		return fmt.Errorf("signature did not verify")
+	}
+	return nil
+}
+
+// sealHash hashes the fields of sets in order, relaxed, each set's results,
+// signature and seal in turn. The seal of the last set is hashed with its
+// b= value removed.
+func sealHash(sets []arcSet) []byte {
+	h := sha256.New()
+	for n, set := range sets {
+		h.Write([]byte(canonicalHeader(set.results.raw, canonRelaxed)))
+		h.Write([]byte(canonicalHeader(set.signature.raw, canonRelaxed)))
+		if n < len(sets)-1 {
+			h.Write([]byte(canonicalHeader(set.seal.raw, canonRelaxed)))
+			continue
+		}
+		seal := canonicalHeader(removeSignature(set.seal.raw), canonRelaxed)
+		h.Write([]byte(strings.TrimSuffix(seal, "\r\n")))
+	}
+	return h.Sum(nil)
+}
+
+// dmarcPassed reports whether an ARC-Authentication-Results value records a
+// DMARC pass for fromDomain. Results naming no header.from count.
+func dmarcPassed(results, fromDomain string) bool {
+	resinfos := strings.Split(stripComments(results), ";")
+	// The first two are the instance and the authserv-id
+	if len(resinfos) < 3 {
+		return false
+	}
+	for _, resinfo := range resinfos[2:] {
+		parts := strings.Fields(resinfo)
+		if len(parts) == 0 || !strings.EqualFold(parts[0], "dmarc=pass") {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if name, value, ok := strings.Cut(p, "="); ok && strings.EqualFold(name, "header.from") {
+				value = strings.TrimSuffix(value, ".")
+				if at := strings.LastIndexByte(value, '@'); at >= 0 {
+					value = value[at+1:]
+				}
+				return strings.EqualFold(value, fromDomain)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// stripComments removes parenthesized comments, which may nest.
+func stripComments(s string) string {
+	var b strings.Builder
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && depth > 0:
+			i++
+		case s[i] == '(':
+			depth++
+		case s[i] == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// Sealer adds an ARC set to messages mailroom passes on, so that receivers
+// can see how the message was authenticated when it reached us.
+type Sealer struct {
+	resolver  Resolver
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+	now       func() time.Time
+}
+
+// NewSealer creates a Sealer signing with key, whose public half is
+// published at selector._domainkey.domain. It validates the chains it
+// extends with resolver. key must be an RSA or Ed25519 private key.
+func NewSealer(resolver Resolver, domain, selector string, key crypto.Signer) (*Sealer, error) {
+	algorithm, err := keyAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{
+		resolver:  resolver,
+		domain:    strings.ToLower(domain),
+		selector:  strings.ToLower(selector),
+		key:       key,
+		algorithm: algorithm,
+		now:       time.Now,
+	}, nil
+}
+
+// Seal returns raw with a new ARC set prepended. authResults is the
+// Authentication-Results value recorded when the message was delivered
+// (see Results.String). The chain the message already carries is validated
+// first; messages whose chain has failed are not sealed.
+func (s *Sealer) Seal(ctx context.Context, raw []byte, authResults string) ([]byte, error) {
+	raw = toCRLF(raw)
+	fields, body := splitMessage(raw)
+	sets, err := arcSets(fields)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrChainFailed, err)
+	}
+	cv := chainNone
+	if len(sets) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+		if res := verifyARC(ctx, s.resolver, fields, body, s.now()); res.Result != ResultPass {
+			return nil, fmt.Errorf("%w: %s", ErrChainFailed, res.Reason)
+		}
+		cv = chainPass
+	}
+	if len(sets) == maxInstances {
+		return nil, ErrTooManyInstances
+	}
+	instance := len(sets) + 1
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+
+	set := arcSet{instance: instance}
+	set.results = newField(arcResultsField, fmt.Sprintf("i=%d; %s", instance, authResults))
+
+	set.signature, err = signMessage(s.key, arcSignatureField, fields, body,
+		fmt.Sprintf("i=%d; a=%s; d=%s; s=%s; t=%s", instance, s.algorithm, s.domain, s.selector, timestamp))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	set.seal = newField(arcSealField, fmt.Sprintf("i=%d; a=%s; cv=%s; d=%s; s=%s; t=%s; b=",
+		instance, s.algorithm, cv, s.domain, s.selector, timestamp))
+	sig, err := signHash(s.key, sealHash(append(sets, set)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal message: %w", err)
+	}
+	set.seal = withSignature(set.seal, sig)
+
+	out := make([]byte, 0, len(raw)+len(set.results.raw)+len(set.signature.raw)+len(set.seal.raw))
+	out = append(out, set.seal.raw...)
+	out = append(out, set.signature.raw...)
+	out = append(out, set.results.raw...)
+	return append(out, raw...), nil
+}
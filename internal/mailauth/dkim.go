@@ -0,0 +1,360 @@
+package mailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSignatures bounds how many DKIM-Signature fields of one message
+	// are verified.
+	maxSignatures = 5
+	// minRSABits is the smallest RSA key accepted (RFC 8301).
+	minRSABits = 1024
+)
+
+// DKIM signing algorithms.
+const (
+	AlgorithmRSASHA256     = "rsa-sha256"
+	AlgorithmEd25519SHA256 = "ed25519-sha256"
+)
+
+// DKIMResult is the outcome of verifying one DKIM signature.
+type DKIMResult struct {
+	Result    string `json:"result"`
+	Domain    string `json:"domain,omitempty"`   // d=
+	Selector  string `json:"selector,omitempty"` // s=
+	Algorithm string `json:"algorithm,omitempty"`
+	Signature string `json:"-"` // the start of b=, identifying the signature
+	Reason    string `json:"reason,omitempty"`
+}
+
+// dkimSignature is a parsed DKIM-Signature field.
+type dkimSignature struct {
+	field      field
+	algorithm  string
+	sig        []byte
+	bodyHash   []byte
+	domain     string
+	selector   string
+	headers    []string
+	headCanon  string
+	bodyCanon  string
+	bodyLength int64 // -1 if the whole body is signed
+	expires    time.Time
+}
+
+// verifyDKIM verifies the message's DKIM signatures, topmost first. It
+// returns nil if the message isn't signed.
+func verifyDKIM(ctx context.Context, r Resolver, fields []field, body []byte, now time.Time) []DKIMResult {
+	var results []DKIMResult
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) == maxSignatures {
+			break
+		}
+		results = append(results, verifySignature(ctx, r, f, fields, body, now))
+	}
+	return results
+}
+
+func verifySignature(ctx context.Context, r Resolver, f field, fields []field, body []byte, now time.Time) DKIMResult {
+	s, err := parseSignature(f, false)
+	if s == nil {
+		return DKIMResult{Result: ResultPermError, Reason: err.Error()}
+	}
+	if err != nil {
+		res := newDKIMResult(s)
+		res.Result, res.Reason = ResultPermError, err.Error()
+		return res
+	}
+	return verifyParsed(ctx, r, s, fields, body, now)
+}
+
+func newDKIMResult(s *dkimSignature) DKIMResult {
+	return DKIMResult{
+		Domain:    s.domain,
+		Selector:  s.selector,
+		Algorithm: s.algorithm,
+		Signature: signatureID(s.sig),
+	}
+}
+
+// verifyParsed verifies a signature that parsed without error.
+func verifyParsed(ctx context.Context, r Resolver, s *dkimSignature, fields []field, body []byte, now time.Time) DKIMResult {
+	res := newDKIMResult(s)
+	fail := func(result, reason string) DKIMResult {
+		res.Result, res.Reason = result, reason
+		return res
+	}
+	if !s.expires.IsZero() && now.After(s.expires) {
+		return fail(ResultPermError, "signature expired")
+	}
+
+	key, result, err := lookupKey(ctx, r, s)
+	if err != nil {
+		return fail(result, err.Error())
+	}
+
+	canon := canonicalBody(body, s.bodyCanon)
+	if s.bodyLength >= 0 {
+		if s.bodyLength > int64(len(canon)) {
+			return fail(ResultPermError, "l= is longer than the body")
+		}
+		canon = canon[:s.bodyLength]
+	}
+	bh := sha256.Sum256(canon)
+	if subtle.ConstantTimeCompare(bh[:], s.bodyHash) != 1 {
+		return fail(ResultFail, "body hash did not verify")
+	}
+
+	if !verifyHash(key, headerHash(s, fields), s.sig) {
+		return fail(ResultFail, "signature did not verify")
+	}
+	res.Result = ResultPass
+	return res
+}
+
+// verifyHash reports whether sig is key's signature of a SHA-256 hash.
+func verifyHash(key crypto.PublicKey, hash, sig []byte) bool {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash, sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, hash, sig)
+	}
+	return false
+}
+
+// parseSignature parses a DKIM-Signature field, or an ARC-Message-Signature
+// field if arc is set: those have no v= tag and their i= tag numbers the ARC
+// set. It returns a nil signature if the field can't be read at all, and a
+// signature together with an error if it can be attributed to a domain but
+// is unusable.
+func parseSignature(f field, arc bool) (*dkimSignature, error) {
+	tags := parseTags(f.value())
+	if tags == nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	s := &dkimSignature{
+		field:      f,
+		algorithm:  tags["a"],
+		domain:     strings.ToLower(strings.TrimSuffix(tags["d"], ".")),
+		selector:   strings.ToLower(tags["s"]),
+		headCanon:  canonSimple,
+		bodyCanon:  canonSimple,
+		bodyLength: -1,
+	}
+	var err error
+	if s.sig, err = base64.StdEncoding.DecodeString(stripWSP(tags["b"])); err != nil {
+		return s, fmt.Errorf("malformed b= tag")
+	}
+	if s.bodyHash, err = base64.StdEncoding.DecodeString(stripWSP(tags["bh"])); err != nil {
+		return s, fmt.Errorf("malformed bh= tag")
+	}
+
+	required := []string{"a", "b", "bh", "d", "h", "s"}
+	if !arc {
+		required = append(required, "v")
+	}
+	for _, tag := range required {
+		if tags[tag] == "" {
+			return s, fmt.Errorf("missing %s= tag", tag)
+		}
+	}
+	if !arc && tags["v"] != "1" {
+		return s, fmt.Errorf("unsupported version %q", tags["v"])
+	}
+	if s.algorithm != AlgorithmRSASHA256 && s.algorithm != AlgorithmEd25519SHA256 {
+		return s, fmt.Errorf("unsupported algorithm %q", s.algorithm)
+	}
+
+	if c, ok := tags["c"]; ok {
+		head, body, _ := strings.Cut(strings.ToLower(c), "/")
+		if body == "" {
+			body = canonSimple
+		}
+		for _, v := range []string{head, body} {
+			if v != canonSimple && v != canonRelaxed {
+				return s, fmt.Errorf("unsupported canonicalization %q", c)
+			}
+		}
+		s.headCanon, s.bodyCanon = head, body
+	}
+
+	for _, h := range strings.Split(tags["h"], ":") {
+		if h = strings.TrimSpace(stripWSP(h)); h != "" {
+			s.headers = append(s.headers, h)
+		}
+	}
+	signsFrom := false
+	for _, h := range s.headers {
+		signsFrom = signsFrom || strings.EqualFold(h, "From")
+	}
+	if !signsFrom {
+		return s, fmt.Errorf("From field not signed")
+	}
+
+	if i, ok := tags["i"]; ok && !arc {
+		_, domain, found := strings.Cut(i, "@")
+		domain = strings.ToLower(domain)
+		if !found || (domain != s.domain && !strings.HasSuffix(domain, "."+s.domain)) {
+			return s, fmt.Errorf("i= is not within d=")
+		}
+	}
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n < 0 {
+			return s, fmt.Errorf("malformed l= tag")
+		}
+		s.bodyLength = n
+	}
+	if x, ok := tags["x"]; ok {
+		n, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("malformed x= tag")
+		}
+		s.expires = time.Unix(n, 0)
+	}
+	return s, nil
+}
+
+// lookupKey fetches the public key a signature names, returning the result
+// to report if it can't be used.
+func lookupKey(ctx context.Context, r Resolver, s *dkimSignature) (crypto.PublicKey, string, error) {
+	name := s.selector + "._domainkey." + s.domain
+	txts, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ResultPermError, fmt.Errorf("no key for signature")
+		}
+		return nil, ResultTempError, fmt.Errorf("key lookup failed")
+	}
+	if len(txts) != 1 {
+		return nil, ResultPermError, fmt.Errorf("expected one key record, found %d", len(txts))
+	}
+
+	tags := parseTags(txts[0])
+	if tags == nil {
+		return nil, ResultPermError, fmt.Errorf("malformed key record")
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, ResultPermError, fmt.Errorf("unsupported key version %q", v)
+	}
+	if h, ok := tags["h"]; ok && !containsFold(strings.Split(stripWSP(h), ":"), "sha256") {
+		return nil, ResultPermError, fmt.Errorf("key does not allow sha256")
+	}
+	if sv, ok := tags["s"]; ok {
+		services := strings.Split(stripWSP(sv), ":")
+		if !containsFold(services, "*") && !containsFold(services, "email") {
+			return nil, ResultPermError, fmt.Errorf("key is not for email")
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(stripWSP(tags["p"]))
+	if err != nil {
+		return nil, ResultPermError, fmt.Errorf("malformed key")
+	}
+	if len(data) == 0 {
+		return nil, ResultPermError, fmt.Errorf("key revoked")
+	}
+
+	keyType := strings.ToLower(tags["k"])
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	if want, _, _ := strings.Cut(s.algorithm, "-"); keyType != want {
+		return nil, ResultPermError, fmt.Errorf("key type %s does not match algorithm", keyType)
+	}
+	switch keyType {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			// Some publish the bare PKCS #1 key
+			if pub, err = x509.ParsePKCS1PublicKey(data); err != nil {
+				return nil, ResultPermError, fmt.Errorf("malformed key")
+			}
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, ResultPermError, fmt.Errorf("key is not an RSA key")
+		}
+		if rsaKey.N.BitLen() < minRSABits {
+			return nil, ResultPermError, fmt.Errorf("key is too short")
+		}
+		return rsaKey, "", nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, ResultPermError, fmt.Errorf("malformed key")
+		}
+		return ed25519.PublicKey(data), "", nil
+	}
+	return nil, ResultPermError, fmt.Errorf("unsupported key type %q", keyType)
+}
+
+// headerHash hashes the signed header fields followed by the signature
+// field with its b= value removed. Each listed name takes the last field of
+// that name not yet used; names with none left add nothing.
+func headerHash(s *dkimSignature, fields []field) []byte {
+	h := sha256.New()
+	used := map[string]int{}
+	for _, name := range s.headers {
+		key := strings.ToLower(name)
+		candidates := lastFields(fields, name)
+		if used[key] < len(candidates) {
+			h.Write([]byte(canonicalHeader(candidates[used[key]].raw, s.headCanon)))
+		}
+		used[key]++
+	}
+	sigField := canonicalHeader(removeSignature(s.field.raw), s.headCanon)
+	h.Write([]byte(strings.TrimSuffix(sigField, "\r\n")))
+	return h.Sum(nil)
+}
+
+// removeSignature empties the value of the b= tag of a raw DKIM-Signature
+// field, leaving everything else as it was.
+func removeSignature(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	specs := strings.Split(value, ";")
+	for i, spec := range specs {
+		tag, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(stripWSP(tag)) == "b" {
+			eq := strings.IndexByte(spec, '=')
+			specs[i] = spec[:eq+1]
+			if i == len(specs)-1 && strings.HasSuffix(spec, "\r\n") {
+				specs[i] += "\r\n"
+			}
+		}
+	}
+	return name + ":" + strings.Join(specs, ";")
+}
+
+// signatureID returns the start of a signature's b= value, as reported in
+// header.b of Authentication-Results (RFC 6008).
+func signatureID(sig []byte) string {
+	b := base64.StdEncoding.EncodeToString(sig)
+	if len(b) > 8 {
+		b = b[:8]
+	}
+	return b
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package mailauth
+
+import (
+	"context"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARC policies.
+const (
+	PolicyNone       = "none"
+	PolicyQuarantine = "quarantine"
+	PolicyReject     = "reject"
+)
+
+// DMARCResult is the outcome of checking that the From domain is
+// authenticated by an aligned DKIM signature or SPF check (RFC 7489).
+// Policy is what the domain asks receivers to do with mail that fails.
+// Override names the trusted ARC sealer that vouched for mail failing DMARC,
+// whose policy is then not applied.
+type DMARCResult struct {
+	Result   string `json:"result"`
+	Domain   string `json:"domain,omitempty"` // the From domain
+	Policy   string `json:"policy,omitempty"`
+	Override string `json:"override,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// dmarcRecord is a parsed DMARC policy record.
+type dmarcRecord struct {
+	policy          string
+	subdomainPolicy string
+	strictDKIM      bool
+	strictSPF       bool
+}
+
+// checkDMARC applies the DMARC policy of fromDomain to the DKIM and SPF
+// results.
+func checkDMARC(ctx context.Context, r Resolver, fromDomain string, dkim []DKIMResult, spf SPFResult) DMARCResult {
+	res := DMARCResult{Domain: fromDomain}
+	if fromDomain == "" {
+		res.Result, res.Reason = ResultPermError, "no single From domain"
+		return res
+	}
+
+	org := orgDomain(fromDomain)
+	rec, result := lookupDMARC(ctx, r, fromDomain)
+	policyOf := func(rec *dmarcRecord) string { return rec.policy }
+	if rec == nil && result == ResultNone && org != fromDomain {
+		// Subdomains fall back on the organizational domain's policy
+		rec, result = lookupDMARC(ctx, r, org)
+		policyOf = func(rec *dmarcRecord) string { return rec.subdomainPolicy }
+	}
+	if rec == nil {
+		res.Result = result
+		return res
+	}
+	res.Policy = policyOf(rec)
+
+	aligned := func(domain string, strict bool) bool {
+		domain = strings.ToLower(domain)
+		if strict {
+			return domain == fromDomain
+		}
+		return domain != "" && orgDomain(domain) == org
+	}
+	for _, d := range dkim {
+		if d.Result == ResultPass && aligned(d.Domain, rec.strictDKIM) {
+			res.Result = ResultPass
+			return res
+		}
+	}
+	if spf.Result == ResultPass && aligned(spf.Domain, rec.strictSPF) {
+		res.Result = ResultPass
+		return res
+	}
+	res.Result, res.Reason = ResultFail, "no aligned DKIM signature or SPF pass"
+	return res
+}
+
+// lookupDMARC fetches the DMARC record of domain. It returns a nil record
+// with the result to report if there is no usable one.
+func lookupDMARC(ctx context.Context, r Resolver, domain string) (*dmarcRecord, string) {
+	txts, err := r.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ResultNone
+		}
+		return nil, ResultTempError
+	}
+	var found []string
+	for _, txt := range txts {
+		if v, _, _ := strings.Cut(txt, ";"); strings.TrimSpace(v) == "v=DMARC1" {
+			found = append(found, txt)
+		}
+	}
+	// More than one record counts as none
+	if len(found) != 1 {
+		return nil, ResultNone
+	}
+
+	tags := parseTags(found[0])
+	if tags == nil {
+		return nil, ResultPermError
+	}
+	rec := &dmarcRecord{
+		policy:     strings.ToLower(tags["p"]),
+		strictDKIM: strings.EqualFold(tags["adkim"], "s"),
+		strictSPF:  strings.EqualFold(tags["aspf"], "s"),
+	}
+	if !validPolicy(rec.policy) {
+		return nil, ResultPermError
+	}
+	rec.subdomainPolicy = rec.policy
+	if sp, ok := tags["sp"]; ok && validPolicy(strings.ToLower(sp)) {
+		rec.subdomainPolicy = strings.ToLower(sp)
+	}
+	return rec, ""
+}
+
+func validPolicy(p string) bool {
+	return p == PolicyNone || p == PolicyQuarantine || p == PolicyReject
+}
+
+// orgDomain returns the organizational domain of domain: the registered
+// domain below its public suffix, e.g. example.co.uk for mail.example.co.uk.
+func orgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
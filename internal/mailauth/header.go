@@ -0,0 +1,180 @@
+package mailauth
+
+import (
+	"bytes"
+	"strings"
+)
+
+// field is a header field as it appears in the message, folding and the
+// terminating CRLF included.
+type field struct {
+	name string
+	raw  string
+}
+
+// value returns the unfolded text after the colon.
+func (f field) value() string {
+	_, v, _ := strings.Cut(f.raw, ":")
+	v = strings.NewReplacer("\r\n", "", "\n", "").Replace(v)
+	return strings.TrimSpace(v)
+}
+
+// splitMessage splits raw into its header fields, in order, and its body.
+// Bare LF line endings are read as CRLF, as they would have been on the wire.
+func splitMessage(raw []byte) ([]field, []byte) {
+	raw = toCRLF(raw)
+	var fields []field
+	rest := raw
+	for len(rest) > 0 {
+		end := bytes.Index(rest, []byte("\r\n"))
+		if end < 0 {
+			end = len(rest)
+		} else {
+			end += 2
+		}
+		line := rest[:end]
+		if string(line) == "\r\n" {
+			return fields, rest[end:]
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += string(line)
+		} else {
+			name, _, _ := strings.Cut(string(line), ":")
+			fields = append(fields, field{name: strings.TrimSpace(name), raw: string(line)})
+		}
+		rest = rest[end:]
+	}
+	return fields, nil
+}
+
+// toCRLF turns bare LFs into CRLFs.
+func toCRLF(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n")) || bytes.Count(b, []byte("\n")) == bytes.Count(b, []byte("\r\n")) {
+		return b
+	}
+	var out bytes.Buffer
+	out.Grow(len(b) + len(b)/40)
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(c)
+	}
+	return out.Bytes()
+}
+
+// lastFields returns the fields named name, last first.
+func lastFields(fields []field, name string) []field {
+	var out []field
+	for i := len(fields) - 1; i >= 0; i-- {
+		if strings.EqualFold(fields[i].name, name) {
+			out = append(out, fields[i])
+		}
+	}
+	return out
+}
+
+// Canonicalization algorithms (RFC 6376 section 3.4).
+const (
+	canonSimple  = "simple"
+	canonRelaxed = "relaxed"
+)
+
+// canonicalHeader canonicalizes a field for hashing.
+func canonicalHeader(f string, canon string) string {
+	if canon == canonSimple {
+		return f
+	}
+	name, value, _ := strings.Cut(f, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(compressWSP(value)) + "\r\n"
+}
+
+// canonicalBody canonicalizes the body for hashing.
+func canonicalBody(body []byte, canon string) []byte {
+	var out bytes.Buffer
+	lines := strings.SplitAfter(string(body), "\r\n")
+	if canon == canonRelaxed {
+		for _, line := range lines {
+			text := strings.TrimSuffix(line, "\r\n")
+			text = strings.TrimRight(compressWSP(text), " ")
+			out.WriteString(text)
+			if strings.HasSuffix(line, "\r\n") || text != "" {
+				out.WriteString("\r\n")
+			}
+		}
+	} else {
+		for _, line := range lines {
+			out.WriteString(line)
+		}
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\r\n")) {
+			out.WriteString("\r\n")
+		}
+	}
+
+	b := out.Bytes()
+	for bytes.HasSuffix(b, []byte("\r\n\r\n")) {
+		b = b[:len(b)-2]
+	}
+	if canon == canonRelaxed && string(b) == "\r\n" {
+		return nil
+	}
+	if canon == canonSimple && len(b) == 0 {
+		return []byte("\r\n")
+	}
+	return b
+}
+
+// compressWSP replaces each run of spaces and tabs with a single space.
+func compressWSP(s string) string {
+	var b strings.Builder
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseTags parses a tag=value list as used by DKIM and DMARC records,
+// returning nil if it is malformed. Whitespace around tags and values is
+// dropped.
+func parseTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil
+		}
+		if _, dup := tags[name]; dup {
+			return nil
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags
+}
+
+// stripWSP removes all folding whitespace from a tag value, e.g. base64.
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
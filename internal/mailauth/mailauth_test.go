@@ -0,0 +1,396 @@
+package mailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc8463Message is the ed25519-signed example of RFC 8463 appendix A.
+var rfc8463Message = crlf(`DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`)
+
+const rfc8463Key = "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func dkimResults(t *testing.T, z Zone, raw string) []DKIMResult {
+	t.Helper()
+	fields, body := splitMessage([]byte(raw))
+	return verifyDKIM(context.Background(), z, fields, body, time.Now())
+}
+
+func TestDKIMEd25519(t *testing.T) {
+	z := Zone{TXT: map[string][]string{"brisbane._domainkey.football.example.com": {rfc8463Key}}}
+
+	got := dkimResults(t, z, rfc8463Message)
+	if len(got) != 1 || got[0].Result != ResultPass || got[0].Domain != "football.example.com" {
+		t.Fatalf("got %+v", got)
+	}
+	// Relaxed canonicalization ignores whitespace changes and bare LFs
+	loose := strings.Replace(rfc8463Message, "We lost the game.  Are", "We lost the game. \tAre", 1)
+	if got := dkimResults(t, z, strings.ReplaceAll(loose, "\r\n", "\n")); got[0].Result != ResultPass {
+		t.Errorf("reformatted message: got %+v", got[0])
+	}
+
+	for name, c := range map[string]struct {
+		zone Zone
+		raw  string
+		want string
+	}{
+		"changed body":    {z, strings.Replace(rfc8463Message, "lost", "won", 1), ResultFail},
+		"changed subject": {z, strings.Replace(rfc8463Message, "dinner", "lunch", 1), ResultFail},
+		"no key":          {Zone{}, rfc8463Message, ResultPermError},
+		"revoked key":     {Zone{TXT: map[string][]string{"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p="}}}, rfc8463Message, ResultPermError},
+		"wrong key type":  {Zone{TXT: map[string][]string{"brisbane._domainkey.football.example.com": {"v=DKIM1; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}}}, rfc8463Message, ResultPermError},
+		"From unsigned":   {z, strings.Replace(rfc8463Message, "h=from : to :\r\n subject : date : message-id : from : subject : date", "h=to : subject", 1), ResultPermError},
+	} {
+		got := dkimResults(t, c.zone, c.raw)
+		if len(got) != 1 || got[0].Result != c.want {
+			t.Errorf("%s: got %+v, want %s", name, got, c.want)
+		}
+	}
+
+	if got := dkimResults(t, z, "From: a@example.org\r\n\r\nHi\r\n"); got != nil {
+		t.Errorf("unsigned message: got %+v", got)
+	}
+}
+
+// signRSA adds an rsa-sha256 DKIM signature with simple/simple
+// canonicalization to raw, which must use CRLF line endings.
+func signRSA(t *testing.T, key *rsa.PrivateKey, domain, selector, raw string) string {
+	t.Helper()
+	_, body := splitMessage([]byte(raw))
+	bh := sha256.Sum256(canonicalBody(body, canonSimple))
+	sigField := "DKIM-Signature: v=1; a=rsa-sha256; c=simple/simple; d=" + domain +
+		"; s=" + selector + "; h=From:Subject;\r\n bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b=\r\n"
+
+	fields, _ := splitMessage([]byte(sigField + raw))
+	s := &dkimSignature{field: fields[0], headers: []string{"From", "Subject"}, headCanon: canonSimple}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, headerHash(s, fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(sigField, "b=\r\n", "b="+base64.StdEncoding.EncodeToString(sig)+"\r\n", 1) + raw
+}
+
+func TestDKIMRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := Zone{TXT: map[string][]string{
+		"s1._domainkey.example.org": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}}
+
+	raw := signRSA(t, key, "example.org", "s1", "From: alice@example.org\r\nSubject: Hi\r\n\r\nHello\r\n\r\n\r\n")
+	if got := dkimResults(t, z, raw); len(got) != 1 || got[0].Result != ResultPass || got[0].Algorithm != AlgorithmRSASHA256 {
+		t.Fatalf("got %+v", got)
+	}
+	// Simple canonicalization only tolerates trailing empty lines
+	if got := dkimResults(t, z, raw+"\r\n"); got[0].Result != ResultPass {
+		t.Errorf("extra empty line: got %+v", got[0])
+	}
+	if got := dkimResults(t, z, strings.Replace(raw, "Hello", "Hello ", 1)); got[0].Result != ResultFail {
+		t.Errorf("changed whitespace: got %+v", got[0])
+	}
+	// A second From field added above the signed one isn't covered
+	if got := dkimResults(t, z, strings.Replace(raw, "From: alice", "From: mallory@example.net\r\nFrom: alice", 1)); got[0].Result != ResultPass {
+		t.Errorf("added From: got %+v", got[0])
+	}
+}
+
+func TestSPF(t *testing.T) {
+	z := Zone{
+		TXT: map[string][]string{
+			"example.org":         {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.net mx a:relay.example.org/30 -all"},
+			"_spf.example.net":    {"v=spf1 ip6:2001:db8::/32 ?all"},
+			"soft.example.org":    {"some other record", "v=spf1 ~all"},
+			"redirect.example":    {"v=spf1 redirect=example.org"},
+			"macro.example":       {"v=spf1 exists:%{ir}.%{l1r+}._spf.%{d} -all"},
+			"loop.example":        {"v=spf1 include:loop.example -all"},
+			"double.example":      {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example":      {"v=spf1 foo:bar -all"},
+			"mta.example.org":     {"v=spf1 a -all"},
+			"missing.example":     {"v=spf1 include:nowhere.example -all"},
+			"neutral.example.org": {"v=spf1 ip4:203.0.113.1"},
+		},
+		A: map[string][]net.IP{
+			"mail.example.org":                     {net.ParseIP("198.51.100.10")},
+			"relay.example.org":                    {net.ParseIP("203.0.113.9")},
+			"mta.example.org":                      {net.ParseIP("198.51.100.20")},
+			"1.113.0.203.alice._spf.macro.example": {net.ParseIP("127.0.0.2")},
+		},
+		MX: map[string][]*net.MX{
+			"example.org": {{Host: "mail.example.org.", Pref: 10}},
+		},
+	}
+
+	for _, c := range []struct {
+		ip, helo, from string
+		want           string
+	}{
+		{"192.0.2.55", "", "alice@example.org", ResultPass},
+		{"2001:db8::1", "", "alice@example.org", ResultPass},
+		{"2001:db9::1", "", "alice@example.org", ResultFail},
+		{"198.51.100.10", "", "alice@example.org", ResultPass},
+		{"203.0.113.10", "", "alice@example.org", ResultPass},
+		{"203.0.113.20", "", "alice@example.org", ResultFail},
+		{"192.0.2.1", "", "alice@soft.example.org", ResultSoftFail},
+		{"192.0.2.1", "", "alice@redirect.example", ResultPass},
+		{"203.0.113.1", "", "alice@macro.example", ResultPass},
+		{"203.0.113.1", "", "bob@macro.example", ResultFail},
+		{"192.0.2.1", "", "alice@loop.example", ResultPermError},
+		{"192.0.2.1", "", "alice@double.example", ResultPermError},
+		{"192.0.2.1", "", "alice@broken.example", ResultPermError},
+		{"192.0.2.1", "", "alice@missing.example", ResultPermError},
+		{"192.0.2.1", "", "alice@neutral.example.org", ResultNeutral},
+		{"192.0.2.1", "", "alice@unknown.example", ResultNone},
+		// Bounces are checked against the HELO name
+		{"198.51.100.20", "mta.example.org", "", ResultPass},
+		{"198.51.100.21", "mta.example.org", "", ResultFail},
+	} {
+		got := checkSPF(context.Background(), z, net.ParseIP(c.ip), c.helo, c.from)
+		if got.Result != c.want {
+			t.Errorf("%s from %q: got %+v, want %s", c.ip, c.from, got, c.want)
+		}
+	}
+}
+
+func TestDMARC(t *testing.T) {
+	z := Zone{TXT: map[string][]string{
+		"_dmarc.example.org":  {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.test":  {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+		"_dmarc.broken.test":  {"v=DMARC1; p=maybe"},
+		"_dmarc.several.test": {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+	}}
+	pass := func(domain string) []DKIMResult { return []DKIMResult{{Result: ResultPass, Domain: domain}} }
+
+	for _, c := range []struct {
+		name       string
+		from       string
+		dkim       []DKIMResult
+		spf        SPFResult
+		want       string
+		wantPolicy string
+	}{
+		{"aligned DKIM", "example.org", pass("example.org"), SPFResult{}, ResultPass, PolicyReject},
+		{"relaxed DKIM", "example.org", pass("mail.example.org"), SPFResult{}, ResultPass, PolicyReject},
+		{"aligned SPF", "example.org", nil, SPFResult{Result: ResultPass, Domain: "bounces.example.org"}, ResultPass, PolicyReject},
+		{"unaligned", "example.org", pass("example.net"), SPFResult{Result: ResultPass, Domain: "example.net"}, ResultFail, PolicyReject},
+		{"failed DKIM", "example.org", []DKIMResult{{Result: ResultFail, Domain: "example.org"}}, SPFResult{}, ResultFail, PolicyReject},
+		{"subdomain", "news.example.org", nil, SPFResult{}, ResultFail, PolicyQuarantine},
+		{"strict", "strict.test", pass("mail.strict.test"), SPFResult{Result: ResultPass, Domain: "mail.strict.test"}, ResultFail, PolicyQuarantine},
+		{"no record", "example.net", nil, SPFResult{}, ResultNone, ""},
+		{"bad policy", "broken.test", nil, SPFResult{}, ResultPermError, ""},
+		{"several records", "several.test", nil, SPFResult{}, ResultNone, ""},
+		{"no From domain", "", nil, SPFResult{}, ResultPermError, ""},
+	} {
+		got := checkDMARC(context.Background(), z, c.from, c.dkim, c.spf)
+		if got.Result != c.want || got.Policy != c.wantPolicy {
+			t.Errorf("%s: got %+v, want %s with policy %q", c.name, got, c.want, c.wantPolicy)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	z := Zone{TXT: map[string][]string{
+		"brisbane._domainkey.football.example.com": {rfc8463Key},
+		"football.example.com":                     {"v=spf1 ip4:192.0.2.1 -all"},
+		"_dmarc.football.example.com":              {"v=DMARC1; p=reject"},
+	}}
+	v := NewVerifier(z, "mx.example.com")
+	ctx := context.Background()
+
+	// Signed by the From domain, though sent from elsewhere
+	res := v.Verify(ctx, Input{
+		Raw:      []byte(rfc8463Message),
+		RemoteIP: net.ParseIP("198.51.100.1"),
+		MailFrom: "joe@football.example.com",
+	})
+	if res.DKIMVerdict() != ResultPass || res.SPF.Result != ResultFail || res.DMARC.Result != ResultPass {
+		t.Errorf("got %+v", res)
+	}
+	want := "mx.example.com;\r\n\tdkim=pass header.d=football.example.com header.s=brisbane header.a=ed25519-sha256 header.b=/gCrinpc;\r\n" +
+		"\tspf=fail smtp.mailfrom=football.example.com;\r\n" +
+		"\tdmarc=pass (p=reject) header.from=football.example.com;\r\n" +
+		"\tarc=none"
+	if got := res.String(); got != want {
+		t.Errorf("got Authentication-Results\n%s\nwant\n%s", got, want)
+	}
+
+	// Spoofed: the signature no longer matches and the IP isn't allowed
+	res = v.Verify(ctx, Input{
+		Raw:      []byte(strings.Replace(rfc8463Message, "lost", "won", 1)),
+		RemoteIP: net.ParseIP("198.51.100.1"),
+		MailFrom: "joe@football.example.com",
+	})
+	if res.DMARC.Result != ResultFail || res.DMARC.Policy != PolicyReject {
+		t.Errorf("spoofed message: got %+v", res.DMARC)
+	}
+
+	// Without a client IP only DKIM counts
+	res = v.Verify(ctx, Input{Raw: []byte(rfc8463Message), MailFrom: "joe@football.example.com"})
+	if res.SPF.Result != ResultNone || res.DMARC.Result != ResultPass {
+		t.Errorf("without an IP: got %+v", res)
+	}
+}
+
+func TestARC(t *testing.T) {
+	z := Zone{TXT: map[string][]string{
+		"brisbane._domainkey.football.example.com": {rfc8463Key},
+		"_dmarc.football.example.com":              {"v=DMARC1; p=reject"},
+	}}
+	newSealer := func(domain string) *Sealer {
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.TXT["arc._domainkey."+domain] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}
+		s, err := NewSealer(z, domain, "arc", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	list, relay := newSealer("lists.example.net"), newSealer("relay.example.com")
+	ctx := context.Background()
+	arc := func(raw []byte) ARCResult {
+		fields, body := splitMessage(raw)
+		return verifyARC(ctx, z, fields, body, time.Now())
+	}
+
+	// The list checks the message, then rewrites its subject and adds a
+	// footer, breaking the author's signature
+	received := "lists.example.net; dkim=pass header.d=football.example.com; dmarc=pass (p=reject) header.from=football.example.com"
+	modified := strings.Replace(rfc8463Message, "Subject: Is", "Subject: [dinner] Is", 1) + "--\r\nThe dinner list\r\n"
+	sealed, err := list.Seal(ctx, []byte(modified), received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := arc(sealed); got.Result != ResultPass || got.Instance != 1 || len(got.Sealers) != 1 || got.Sealers[0] != "lists.example.net" {
+		t.Fatalf("sealed once: got %+v", got)
+	}
+	twice, err := relay.Seal(ctx, sealed, "relay.example.com; arc=pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := arc(twice); got.Result != ResultPass || got.Instance != 2 {
+		t.Fatalf("sealed twice: got %+v", got)
+	}
+	if !strings.Contains(string(twice), "i=2; a=ed25519-sha256; cv=pass; d=relay.example.com") {
+		t.Errorf("second seal does not record the validated chain:\n%s", twice)
+	}
+
+	for name, raw := range map[string]string{
+		"changed body":    strings.Replace(string(twice), "hungry", "thirsty", 1),
+		"changed results": strings.Replace(string(twice), "dkim=pass header.d=football", "dkim=fail header.d=football", 1),
+		"missing set":     string(sealed[strings.Index(string(sealed), "ARC-Message-Signature"):]),
+	} {
+		if got := arc([]byte(raw)); got.Result != ResultFail {
+			t.Errorf("%s: got %+v, want fail", name, got)
+		}
+	}
+	if got := arc([]byte(rfc8463Message)); got.Result != ResultNone {
+		t.Errorf("unsealed message: got %+v", got)
+	}
+	if _, err := relay.Seal(ctx, []byte(strings.Replace(string(sealed), "hungry", "thirsty", 1)), "relay.example.com"); !errors.Is(err, ErrChainFailed) {
+		t.Errorf("sealing a broken chain: got %v, want %v", err, ErrChainFailed)
+	}
+
+	// DMARC fails for the rewritten message, unless the list is trusted
+	v := NewVerifier(z, "mx.example.com")
+	res := v.Verify(ctx, Input{Raw: sealed})
+	if res.DMARC.Result != ResultFail || res.DMARC.Override != "" || res.ARC.Result != ResultPass {
+		t.Errorf("untrusted sealer: got %+v %+v", res.DMARC, res.ARC)
+	}
+	v.SetTrustedSealers([]string{"Lists.Example.NET", ""})
+	res = v.Verify(ctx, Input{Raw: sealed})
+	if res.DMARC.Override != "lists.example.net" {
+		t.Errorf("trusted sealer: got %+v", res.DMARC)
+	}
+	if got := res.String(); !strings.Contains(got, "dmarc=fail (p=reject; overridden by ARC from lists.example.net)") || !strings.HasSuffix(got, "arc=pass (i=1)") {
+		t.Errorf("got Authentication-Results\n%s", got)
+	}
+	res = v.Verify(ctx, Input{Raw: []byte(strings.Replace(string(sealed), "dmarc=pass", "dmarc=fail", 1))})
+	if res.DMARC.Override != "" {
+		t.Errorf("tampered results: got %+v", res.DMARC)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil || !key.Equal(got) {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("parsed garbage")
+	}
+}
+
+func TestSign(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := Zone{TXT: map[string][]string{
+		"mail._domainkey.example.org": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}}
+	s, err := NewSigner("Example.org", "mail", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := s.Sign([]byte("From: a@example.org\nTo: b@example.net\nSubject: Hi\n\nHello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := dkimResults(t, z, string(signed))
+	if len(got) != 1 || got[0].Result != ResultPass || got[0].Domain != "example.org" || got[0].Algorithm != AlgorithmEd25519SHA256 {
+		t.Fatalf("got %+v\n%s", got, signed)
+	}
+	if got := dkimResults(t, z, strings.Replace(string(signed), "Hello", "Goodbye", 1)); got[0].Result != ResultFail {
+		t.Errorf("changed body: got %+v", got)
+	}
+}
@@ -0,0 +1,77 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Resolver looks up the DNS records authentication depends on.
+// *net.Resolver implements it; tests use a Zone.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Zone is a Resolver answering from fixed records, keyed by domain name
+// (without the trailing dot) or, for PTR, by IP address. Names missing from
+// the zone don't exist.
+type Zone struct {
+	TXT map[string][]string
+	A   map[string][]net.IP // both A and AAAA records
+	MX  map[string][]*net.MX
+	PTR map[string][]string
+}
+
+func (z Zone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if v, ok := z.TXT[zoneKey(name)]; ok {
+		return v, nil
+	}
+	return nil, notFound(name)
+}
+
+func (z Zone) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, ip := range z.A[zoneKey(host)] {
+		is4 := ip.To4() != nil
+		if network == "ip" || (network == "ip4" && is4) || (network == "ip6" && !is4) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, notFound(host)
+	}
+	return ips, nil
+}
+
+func (z Zone) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if v, ok := z.MX[zoneKey(name)]; ok {
+		return v, nil
+	}
+	return nil, notFound(name)
+}
+
+func (z Zone) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if v, ok := z.PTR[addr]; ok {
+		return v, nil
+	}
+	return nil, notFound(addr)
+}
+
+func zoneKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// isNotFound reports whether err means the name or record doesn't exist, as
+// opposed to the lookup failing.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,167 @@
+package mailauth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedKey is returned for signing keys that are neither RSA nor
+// Ed25519.
+var ErrUnsupportedKey = errors.New("unsupported signing key")
+
+// ParsePrivateKey reads a PEM-encoded RSA or Ed25519 private key, in PKCS #8
+// or, for RSA, PKCS #1 form.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	if _, err := keyAlgorithm(signer); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// keyAlgorithm returns the signing algorithm to name for key.
+func keyAlgorithm(key crypto.Signer) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSABits {
+			return "", fmt.Errorf("RSA key is too short")
+		}
+		return AlgorithmRSASHA256, nil
+	case ed25519.PrivateKey:
+		return AlgorithmEd25519SHA256, nil
+	}
+	return "", ErrUnsupportedKey
+}
+
+// signHash signs a SHA-256 hash. Ed25519 signs the hash itself, as RFC 8463
+// specifies, rather than the data hashed.
+func signHash(key crypto.Signer, hash []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, hash, crypto.Hash(0))
+	}
+	return key.Sign(rand.Reader, hash, crypto.SHA256)
+}
+
+// Signer adds DKIM signatures (RFC 6376) for one domain.
+type Signer struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+	now       func() time.Time
+}
+
+// NewSigner creates a Signer signing for domain with key, whose public half
+// is published at selector._domainkey.domain. key must be an RSA or Ed25519
+// private key.
+func NewSigner(domain, selector string, key crypto.Signer) (*Signer, error) {
+	algorithm, err := keyAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{
+		domain:    strings.ToLower(domain),
+		selector:  strings.ToLower(selector),
+		key:       key,
+		algorithm: algorithm,
+		now:       time.Now,
+	}, nil
+}
+
+// Domain returns the domain s signs for.
+func (s *Signer) Domain() string {
+	return s.domain
+}
+
+// Sign returns raw with a DKIM-Signature field prepended. The signature
+// covers the body and the usual header fields the message has, relaxed.
+func (s *Signer) Sign(raw []byte) ([]byte, error) {
+	raw = toCRLF(raw)
+	fields, body := splitMessage(raw)
+	sig, err := signMessage(s.key, "DKIM-Signature", fields, body,
+		fmt.Sprintf("v=1; a=%s; d=%s; s=%s; t=%d", s.algorithm, s.domain, s.selector, s.now().Unix()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign message: %w", err)
+	}
+	return append([]byte(sig.raw), raw...), nil
+}
+
+// signedHeaders are the fields the signatures we add cover when the message
+// has them.
+var signedHeaders = []string{
+	"From", "To", "Cc", "Reply-To", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Id", "DKIM-Signature",
+}
+
+// signMessage builds a DKIM-Signature or ARC-Message-Signature field named
+// name, starting with the tags in prefix, over the message's signedHeaders
+// and body with relaxed canonicalization.
+func signMessage(key crypto.Signer, name string, fields []field, body []byte, prefix string) (field, error) {
+	var headers []string
+	for _, h := range signedHeaders {
+		for range lastFields(fields, h) {
+			headers = append(headers, h)
+		}
+	}
+	bh := sha256.Sum256(canonicalBody(body, canonRelaxed))
+	s := &dkimSignature{
+		headers:   headers,
+		headCanon: canonRelaxed,
+		field: newField(name, prefix+"; c=relaxed/relaxed;\r\n\th="+strings.Join(headers, ":")+
+			";\r\n\tbh="+base64.StdEncoding.EncodeToString(bh[:])+"; b="),
+	}
+	sig, err := signHash(key, headerHash(s, fields))
+	if err != nil {
+		return field{}, err
+	}
+	return withSignature(s.field, sig), nil
+}
+
+// newField builds a header field from its name and value.
+func newField(name, value string) field {
+	return field{name: name, raw: name + ": " + value + "\r\n"}
+}
+
+// withSignature fills in the empty b= tag that ends f, folding the value.
+func withSignature(f field, sig []byte) field {
+	b := base64.StdEncoding.EncodeToString(sig)
+	var folded strings.Builder
+	for len(b) > 72 {
+		folded.WriteString(b[:72] + "\r\n\t ")
+		b = b[72:]
+	}
+	folded.WriteString(b)
+	f.raw = strings.TrimSuffix(f.raw, "\r\n") + folded.String() + "\r\n"
+	return f
+}
@@ -0,0 +1,512 @@
+package mailauth
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxSPFLookups bounds the terms that cause DNS lookups during one
+	// check (RFC 7208 section 4.6.4).
+	maxSPFLookups = 10
+	// maxVoidLookups bounds the lookups that find nothing.
+	maxVoidLookups = 2
+	// maxMXNames bounds the MX hosts an mx mechanism looks at.
+	maxMXNames = 10
+)
+
+// SPFResult is the outcome of checking the sending IP against the SPF
+// policy of the MAIL FROM domain, or of the HELO name for bounces.
+type SPFResult struct {
+	Result string `json:"result"`
+	Domain string `json:"domain,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// spfError ends a check with result, e.g. because a record is malformed or
+// a lookup failed.
+type spfError struct {
+	result string
+	reason string
+}
+
+func (e *spfError) Error() string { return e.reason }
+
+// spfCheck holds the state of one check_host evaluation and the ones it
+// recurses into.
+type spfCheck struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string // local@domain; the domain part is the HELO name for bounces
+	helo     string
+	lookups  int
+	voids    int
+}
+
+// checkSPF evaluates the SPF policy for a message from ip with the given
+// MAIL FROM, falling back on postmaster@helo for the null reverse path.
+func checkSPF(ctx context.Context, r Resolver, ip net.IP, helo, mailFrom string) SPFResult {
+	sender := mailFrom
+	if sender == "" {
+		sender = "postmaster@" + helo
+	} else if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	_, domain, _ := strings.Cut(sender, "@")
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if ip == nil || domain == "" {
+		return SPFResult{Result: ResultNone, Domain: domain}
+	}
+
+	c := &spfCheck{resolver: r, ip: ip, sender: sender, helo: helo}
+	result, err := c.checkHost(ctx, domain)
+	res := SPFResult{Result: result, Domain: domain}
+	if err != nil {
+		res.Result, res.Reason = err.result, err.reason
+	}
+	return res
+}
+
+// checkHost is check_host() of RFC 7208 section 4.
+func (c *spfCheck) checkHost(ctx context.Context, domain string) (string, *spfError) {
+	record, err := c.record(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	if record == "" {
+		return ResultNone, nil
+	}
+
+	var redirect string
+	sawAll := false
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := strings.Cut(term, "="); ok && isModifierName(name) {
+			if strings.EqualFold(name, "redirect") {
+				if redirect != "" {
+					return "", &spfError{ResultPermError, "more than one redirect"}
+				}
+				redirect = value
+			}
+			// exp and unknown modifiers are ignored
+			continue
+		}
+
+		qualifier := ResultPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = ResultFail, term[1:]
+		case '~':
+			qualifier, term = ResultSoftFail, term[1:]
+		case '?':
+			qualifier, term = ResultNeutral, term[1:]
+		}
+		if strings.EqualFold(term, "all") {
+			sawAll = true
+		}
+		matched, err := c.mechanism(ctx, domain, term)
+		if err != nil {
+			return "", err
+		}
+		if matched {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" && !sawAll {
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return "", err
+		}
+		if err := c.count(); err != nil {
+			return "", err
+		}
+		result, serr := c.checkHost(ctx, target)
+		if serr == nil && result == ResultNone {
+			return "", &spfError{ResultPermError, "redirect to " + target + " has no SPF record"}
+		}
+		return result, serr
+	}
+	return ResultNeutral, nil
+}
+
+// record returns the SPF record of domain, or "" if it has none.
+func (c *spfCheck) record(ctx context.Context, domain string) (string, *spfError) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", &spfError{ResultTempError, "lookup of " + domain + " failed"}
+	}
+	var found []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || (len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ")) {
+			found = append(found, txt)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	}
+	return "", &spfError{ResultPermError, domain + " has more than one SPF record"}
+}
+
+// mechanism reports whether a mechanism matches the client IP.
+func (c *spfCheck) mechanism(ctx context.Context, domain, term string) (bool, *spfError) {
+	name, arg, hasArg := strings.Cut(term, ":")
+	// a and mx take a CIDR length without a domain, e.g. a/24
+	if !hasArg {
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name, arg = name[:i], name[i:]
+		}
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return c.matchNetwork(name, arg)
+	case "include":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		result, err := c.checkHost(ctx, target)
+		if err != nil {
+			return false, err
+		}
+		switch result {
+		case ResultPass:
+			return true, nil
+		case ResultNone:
+			return false, &spfError{ResultPermError, "included " + target + " has no SPF record"}
+		}
+		return false, nil
+	case "a", "mx":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, cidr4, cidr6, err := c.domainCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, lerr := c.resolver.LookupMX(ctx, target)
+			if lerr != nil {
+				return false, c.lookupFailed(lerr, target)
+			}
+			if len(mxs) > maxMXNames {
+				return false, &spfError{ResultPermError, "too many MX hosts for " + target}
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			ips, lerr := c.resolver.LookupIP(ctx, c.network(), host)
+			if lerr != nil {
+				if err := c.lookupFailed(lerr, host); err != nil {
+					return false, err
+				}
+				continue
+			}
+			for _, ip := range ips {
+				if c.inCIDR(ip, cidr4, cidr6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "ptr":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target := domain
+		if hasArg {
+			var err *spfError
+			if target, err = c.expand(arg, domain); err != nil {
+				return false, err
+			}
+		}
+		return c.matchPTR(ctx, target), nil
+	case "exists":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, lerr := c.resolver.LookupIP(ctx, "ip4", target)
+		if lerr != nil {
+			return false, c.lookupFailed(lerr, target)
+		}
+		return len(ips) > 0, nil
+	}
+	return false, &spfError{ResultPermError, "unknown mechanism " + name}
+}
+
+// count charges a term that causes DNS lookups against the limit.
+func (c *spfCheck) count() *spfError {
+	c.lookups++
+	if c.lookups > maxSPFLookups {
+		return &spfError{ResultPermError, "too many DNS lookups"}
+	}
+	return nil
+}
+
+// lookupFailed turns a failed lookup into the error to end the check with,
+// if any: a name that doesn't exist is only a void lookup.
+func (c *spfCheck) lookupFailed(err error, name string) *spfError {
+	if !isNotFound(err) {
+		return &spfError{ResultTempError, "lookup of " + name + " failed"}
+	}
+	c.voids++
+	if c.voids > maxVoidLookups {
+		return &spfError{ResultPermError, "too many void DNS lookups"}
+	}
+	return nil
+}
+
+func (c *spfCheck) network() string {
+	if c.ip.To4() != nil {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+func (c *spfCheck) matchNetwork(name, arg string) (bool, *spfError) {
+	if !strings.Contains(arg, "/") {
+		if name == "ip4" {
+			arg += "/32"
+		} else {
+			arg += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(arg)
+	if err != nil || (name == "ip4") != (network.IP.To4() != nil) {
+		return false, &spfError{ResultPermError, "invalid " + name + " network " + arg}
+	}
+	return network.Contains(c.ip), nil
+}
+
+// domainCIDR splits the argument of an a or mx mechanism into its target
+// domain and CIDR prefix lengths, e.g. "example.org/24//64".
+func (c *spfCheck) domainCIDR(arg, domain string) (string, int, int, *spfError) {
+	spec, lengths := arg, ""
+	if i := strings.IndexByte(arg, '/'); i >= 0 {
+		spec, lengths = arg[:i], arg[i:]
+	}
+	cidr4, cidr6 := 32, 128
+	if lengths != "" {
+		v4, v6, dual := strings.Cut(lengths, "//")
+		var ok bool
+		if v4 != "" {
+			if cidr4, ok = cidrLength(v4, 32); !ok {
+				return "", 0, 0, &spfError{ResultPermError, "invalid CIDR length in " + arg}
+			}
+		}
+		if dual {
+			if cidr6, ok = cidrLength("/"+v6, 128); !ok {
+				return "", 0, 0, &spfError{ResultPermError, "invalid CIDR length in " + arg}
+			}
+		}
+	}
+	if spec == "" {
+		return domain, cidr4, cidr6, nil
+	}
+	target, err := c.expand(spec, domain)
+	return target, cidr4, cidr6, err
+}
+
+// cidrLength parses a "/n" prefix length of at most max bits.
+func cidrLength(s string, max int) (int, bool) {
+	v, ok := strings.CutPrefix(s, "/")
+	n, err := strconv.Atoi(v)
+	return n, ok && err == nil && n >= 0 && n <= max
+}
+
+func (c *spfCheck) inCIDR(ip net.IP, cidr4, cidr6 int) bool {
+	if v4 := c.ip.To4(); v4 != nil {
+		other := ip.To4()
+		mask := net.CIDRMask(cidr4, 32)
+		return other != nil && v4.Mask(mask).Equal(other.Mask(mask))
+	}
+	mask := net.CIDRMask(cidr6, 128)
+	return ip.To4() == nil && c.ip.To16().Mask(mask).Equal(ip.To16().Mask(mask))
+}
+
+// matchPTR reports whether a validated name of the client IP is target or
+// one of its subdomains.
+func (c *spfCheck) matchPTR(ctx context.Context, target string) bool {
+	names, err := c.resolver.LookupAddr(ctx, c.ip.String())
+	if err != nil {
+		return false
+	}
+	target = strings.ToLower(target)
+	for i, name := range names {
+		if i == maxMXNames {
+			break
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		ips, err := c.resolver.LookupIP(ctx, c.network(), name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(c.ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expand expands the macros of a domain-spec (RFC 7208 section 7).
+func (c *spfCheck) expand(spec, domain string) (string, *spfError) {
+	if !strings.Contains(spec, "%") {
+		return strings.TrimSuffix(spec, "."), nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 == len(spec) {
+			return "", &spfError{ResultPermError, "malformed macro in " + spec}
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", &spfError{ResultPermError, "malformed macro in " + spec}
+			}
+			v, ok := c.macro(spec[i+1:i+end], domain)
+			if !ok {
+				return "", &spfError{ResultPermError, "malformed macro in " + spec}
+			}
+			b.WriteString(v)
+			i += end
+		default:
+			return "", &spfError{ResultPermError, "malformed macro in " + spec}
+		}
+	}
+	return strings.TrimSuffix(b.String(), "."), nil
+}
+
+// macro expands the inside of one %{...} macro, e.g. "ir" or "d2".
+func (c *spfCheck) macro(m, domain string) (string, bool) {
+	if m == "" {
+		return "", false
+	}
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+	var v string
+	switch m[0] {
+	case 's', 'S':
+		v = c.sender
+	case 'l', 'L':
+		v = local
+	case 'o', 'O':
+		v = senderDomain
+	case 'd', 'D':
+		v = domain
+	case 'h', 'H':
+		v = c.helo
+	case 'v', 'V':
+		v = "in-addr"
+		if c.ip.To4() == nil {
+			v = "ip6"
+		}
+	case 'i', 'I':
+		if v4 := c.ip.To4(); v4 != nil {
+			v = v4.String()
+		} else {
+			nibbles := make([]string, 0, 32)
+			for _, b := range c.ip.To16() {
+				nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+			}
+			v = strings.Join(nibbles, ".")
+		}
+	case 'p', 'P':
+		// Validated names aren't looked up for macros
+		v = "unknown"
+	default:
+		return "", false
+	}
+
+	// Transformers: how many labels to keep, whether to reverse them and
+	// the delimiters to split on
+	rest := m[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", false
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", false
+		}
+		delims = rest
+	}
+
+	parts := strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), true
+}
+
+func isModifierName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		ok := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			i > 0 && (r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
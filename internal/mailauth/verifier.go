@@ -0,0 +1,210 @@
+// Package mailauth authenticates inbound mail: it verifies DKIM signatures
+// (RFC 6376, with rsa-sha256 and ed25519-sha256), checks the sending IP
+// against the SPF policy of the envelope sender (RFC 7208) and applies the
+// DMARC policy of the From domain (RFC 7489). It also validates the ARC
+// chain (RFC 8617) of forwarded mail, so that mail a trusted intermediary
+// such as a mailing list vouches for isn't held to a DMARC policy it can no
+// longer pass, and seals the mail mailroom passes on. The combined verdict
+// is reported the way an Authentication-Results field (RFC 8601) would.
+//
+// All DNS lookups go through a Resolver, so tests can answer them from a
+// Zone.
+package mailauth
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Results of a check, as named by RFC 8601.
+const (
+	ResultNone      = "none"
+	ResultPass      = "pass"
+	ResultFail      = "fail"
+	ResultSoftFail  = "softfail"
+	ResultNeutral   = "neutral"
+	ResultTempError = "temperror"
+	ResultPermError = "permerror"
+)
+
+// DefaultTimeout bounds the DNS lookups for one message.
+const DefaultTimeout = 20 * time.Second
+
+// Input is a message to authenticate and how it reached us. RemoteIP is nil
+// when the client's address says nothing about the sender, e.g. for LMTP
+// from a local MTA; SPF is then not checked.
+type Input struct {
+	Raw      []byte
+	RemoteIP net.IP
+	Helo     string
+	MailFrom string // empty for the null reverse path
+}
+
+// Results is the verdict on a message.
+type Results struct {
+	Hostname   string       `json:"-"` // the authserv-id of the Authentication-Results field
+	HeaderFrom string       `json:"header_from"`
+	DKIM       []DKIMResult `json:"dkim"`
+	SPF        SPFResult    `json:"spf"`
+	DMARC      DMARCResult  `json:"dmarc"`
+	ARC        ARCResult    `json:"arc"`
+}
+
+// DKIMVerdict sums up the DKIM results: pass if any signature passed,
+// otherwise the result of the topmost signature, or none if there is none.
+func (r Results) DKIMVerdict() string {
+	if len(r.DKIM) == 0 {
+		return ResultNone
+	}
+	for _, d := range r.DKIM {
+		if d.Result == ResultPass {
+			return ResultPass
+		}
+	}
+	return r.DKIM[0].Result
+}
+
+// String formats r as the value of an Authentication-Results field.
+func (r Results) String() string {
+	var b strings.Builder
+	b.WriteString(r.Hostname)
+
+	if len(r.DKIM) == 0 {
+		b.WriteString(";\r\n\tdkim=none")
+	}
+	for _, d := range r.DKIM {
+		b.WriteString(";\r\n\tdkim=" + d.Result)
+		writeReason(&b, d.Reason)
+		if d.Domain != "" {
+			b.WriteString(" header.d=" + d.Domain + " header.s=" + d.Selector)
+		}
+		if d.Algorithm != "" {
+			b.WriteString(" header.a=" + d.Algorithm)
+		}
+		if d.Signature != "" {
+			b.WriteString(" header.b=" + d.Signature)
+		}
+	}
+
+	b.WriteString(";\r\n\tspf=" + r.SPF.Result)
+	writeReason(&b, r.SPF.Reason)
+	if r.SPF.Domain != "" {
+		b.WriteString(" smtp.mailfrom=" + r.SPF.Domain)
+	}
+
+	b.WriteString(";\r\n\tdmarc=" + r.DMARC.Result)
+	switch {
+	case r.DMARC.Override != "":
+		b.WriteString(" (p=" + r.DMARC.Policy + "; overridden by ARC from " + r.DMARC.Override + ")")
+	case r.DMARC.Policy != "":
+		b.WriteString(" (p=" + r.DMARC.Policy + ")")
+	}
+	writeReason(&b, r.DMARC.Reason)
+	if r.HeaderFrom != "" {
+		b.WriteString(" header.from=" + r.HeaderFrom)
+	}
+
+	b.WriteString(";\r\n\tarc=" + r.ARC.Result)
+	if r.ARC.Result == ResultPass {
+		b.WriteString(" (i=" + strconv.Itoa(r.ARC.Instance) + ")")
+	}
+	writeReason(&b, r.ARC.Reason)
+	return b.String()
+}
+
+// writeReason adds a reason as a comment, without the characters that
+// would end it early.
+func writeReason(b *strings.Builder, reason string) {
+	if reason == "" {
+		return
+	}
+	reason = strings.NewReplacer("(", "", ")", "", "\\", "", "\r", "", "\n", " ").Replace(reason)
+	b.WriteString(" (" + reason + ")")
+}
+
+// Verifier authenticates messages.
+type Verifier struct {
+	resolver Resolver
+	hostname string
+	timeout  time.Duration
+	now      func() time.Time
+	trusted  map[string]bool // ARC sealers whose DMARC results we accept
+}
+
+// NewVerifier creates a Verifier looking records up with resolver and
+// naming itself hostname in its results.
+func NewVerifier(resolver Resolver, hostname string) *Verifier {
+	return &Verifier{
+		resolver: resolver,
+		hostname: hostname,
+		timeout:  DefaultTimeout,
+		now:      time.Now,
+	}
+}
+
+// SetTrustedSealers sets the domains whose ARC seals may override a DMARC
+// failure: when a message fails DMARC, its ARC chain passes and one of these
+// domains sealed results showing that it passed DMARC on arrival there, the
+// From domain's policy is not applied. Empty names are ignored.
+func (v *Verifier) SetTrustedSealers(domains []string) {
+	v.trusted = map[string]bool{}
+	for _, d := range domains {
+		if d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), ".")); d != "" {
+			v.trusted[d] = true
+		}
+	}
+}
+
+// Verify authenticates a message. Lookups that fail or time out show up as
+// temperror results rather than as an error.
+func (v *Verifier) Verify(ctx context.Context, in Input) Results {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	fields, body := splitMessage(in.Raw)
+	res := Results{
+		Hostname:   v.hostname,
+		HeaderFrom: fromDomain(fields),
+		DKIM:       verifyDKIM(ctx, v.resolver, fields, body, v.now()),
+		SPF:        SPFResult{Result: ResultNone},
+	}
+	if in.RemoteIP != nil {
+		res.SPF = checkSPF(ctx, v.resolver, in.RemoteIP, in.Helo, in.MailFrom)
+	}
+	res.DMARC = checkDMARC(ctx, v.resolver, res.HeaderFrom, res.DKIM, res.SPF)
+	res.ARC = verifyARC(ctx, v.resolver, fields, body, v.now())
+	if res.DMARC.Result == ResultFail && res.ARC.Result == ResultPass {
+		res.DMARC.Override = v.override(res.ARC, res.HeaderFrom)
+	}
+	return res
+}
+
+// override returns the newest trusted sealer of a validated chain that
+// recorded a DMARC pass for fromDomain, or "" if there is none.
+func (v *Verifier) override(arc ARCResult, fromDomain string) string {
+	for i := len(arc.Sealers) - 1; i >= 0; i-- {
+		if v.trusted[arc.Sealers[i]] && dmarcPassed(arc.results[i], fromDomain) {
+			return arc.Sealers[i]
+		}
+	}
+	return ""
+}
+
+// fromDomain returns the domain of the message's author, or "" unless there
+// is exactly one From field naming exactly one address.
+func fromDomain(fields []field) string {
+	from := lastFields(fields, "From")
+	if len(from) != 1 {
+		return ""
+	}
+	addrs, err := mail.ParseAddressList(from[0].value())
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	_, domain, _ := strings.Cut(addrs[0].Address, "@")
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
@@ -0,0 +1,226 @@
+package mailimport
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// DefaultBatchSize is the number of messages written per transaction.
+const DefaultBatchSize = 200
+
+// Stats counts the outcome of an import. When resuming, the counts include
+// the earlier runs.
+type Stats struct {
+	Imported   int64
+	Duplicates int64
+	Failed     int64
+
+	// Done and Total are the source's progress, see Source.Progress
+	Done  int64
+	Total int64
+}
+
+// Failure describes a message that could not be imported.
+type Failure struct {
+	Location string
+	Err      error
+}
+
+// Importer loads an archive into one user's mail.
+type Importer struct {
+	Store     *mailstore.Store
+	UserID    string
+	BatchSize int
+
+	// DryRun parses and deduplicates without writing anything, including
+	// the resume checkpoint.
+	DryRun bool
+
+	// OnProgress, if set, is called after every batch.
+	OnProgress func(Stats)
+
+	// OnFailure, if set, is called for every message that is skipped
+	// because it can't be stored.
+	OnFailure func(Failure)
+}
+
+// Checkpoint returns the saved position of an earlier import of source, or
+// nil if there is none.
+func (im *Importer) Checkpoint(ctx context.Context, source string) (*schema.ImportCheckpoint, error) {
+	cp, err := im.Store.DB().Queries().GetImportCheckpoint(ctx, schema.GetImportCheckpointParams{
+		UserID: im.UserID,
+		Source: source,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get import checkpoint: %w", err)
+	}
+	return &cp, nil
+}
+
+// Reset discards the saved position of source so the next import starts
+// from the beginning.
+func (im *Importer) Reset(ctx context.Context, source string) error {
+	return im.Store.DB().Queries().DeleteImportCheckpoint(ctx, schema.DeleteImportCheckpointParams{
+		UserID: im.UserID,
+		Source: source,
+	})
+}
+
+// Run imports every message from src. source identifies the archive for the
+// checkpoint and prev, if non-nil, is the checkpoint src was opened from.
+//
+// Messages whose Message-ID the user already has are skipped. Each batch is
+// committed together with the source cursor, so an interrupted import resumes
+// after the last committed batch. When ctx is cancelled the pending batch is
+// still committed before Run returns ctx.Err().
+func (im *Importer) Run(ctx context.Context, src Source, source string, prev *schema.ImportCheckpoint) (Stats, error) {
+	if err := im.Store.CheckUser(ctx, im.UserID); err != nil {
+		return Stats{}, err
+	}
+
+	// Database work isn't cancelled with ctx: an interrupted import stops
+	// between messages and still commits the batch it has read
+	dbCtx := context.WithoutCancel(ctx)
+
+	batchSize := im.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	var stats Stats
+	if prev != nil {
+		stats.Imported = prev.Imported
+		stats.Duplicates = prev.Duplicates
+		stats.Failed = prev.Failed
+	}
+
+	// seen holds the Message-IDs of this run, which a dry run can't look up
+	// in the database
+	seen := make(map[string]bool)
+	var batch []database.MessageRecord
+
+	flush := func(completed bool) error {
+		stats.Done, stats.Total = src.Progress()
+		if !im.DryRun {
+			for _, rec := range batch {
+				if err := im.Store.PutBlobs(dbCtx, rec); err != nil {
+					return err
+				}
+			}
+			err := im.Store.DB().WithTx(dbCtx, func(q *schema.Queries) error {
+				for _, rec := range batch {
+					if err := database.InsertMessageTx(dbCtx, q, rec); err != nil {
+						return err
+					}
+				}
+				return q.UpsertImportCheckpoint(dbCtx, schema.UpsertImportCheckpointParams{
+					UserID:     im.UserID,
+					Source:     source,
+					Cursor:     src.Cursor(),
+					Imported:   stats.Imported,
+					Duplicates: stats.Duplicates,
+					Failed:     stats.Failed,
+					Completed:  completed,
+				})
+			})
+			if err != nil {
+				return fmt.Errorf("failed to write batch: %w", err)
+			}
+			for _, rec := range batch {
+				im.Store.Process(dbCtx, rec, mailstore.Envelope{})
+			}
+		}
+		batch = batch[:0]
+		if im.OnProgress != nil {
+			im.OnProgress(stats)
+		}
+		return nil
+	}
+
+	for {
+		if ctx.Err() != nil {
+			if err := flush(false); err != nil {
+				return stats, err
+			}
+			return stats, ctx.Err()
+		}
+
+		item, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		rec, _, err := im.Store.Prepare(mailstore.Delivery{
+			UserID:     im.UserID,
+			Raw:        item.Raw,
+			ReceivedAt: item.ReceivedAt,
+		})
+		if err != nil {
+			stats.Failed++
+			if im.OnFailure != nil {
+				im.OnFailure(Failure{Location: item.Location, Err: err})
+			}
+			continue
+		}
+
+		dup, err := im.isDuplicate(dbCtx, rec.Message.InternetMessageID, seen)
+		if err != nil {
+			return stats, err
+		}
+		if dup {
+			stats.Duplicates++
+			continue
+		}
+
+		batch = append(batch, rec)
+		stats.Imported++
+		if len(batch) >= batchSize {
+			if err := flush(false); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	if err := flush(true); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// isDuplicate reports whether msgID was already imported in this run or is
+// stored for the user. Messages without a Message-ID are never duplicates.
+func (im *Importer) isDuplicate(ctx context.Context, msgID string, seen map[string]bool) (bool, error) {
+	if msgID == "" {
+		return false, nil
+	}
+	if seen[msgID] {
+		return true, nil
+	}
+	seen[msgID] = true
+
+	_, err := im.Store.DB().Queries().GetMessageByInternetMessageID(ctx, schema.GetMessageByInternetMessageIDParams{
+		UserID:            im.UserID,
+		InternetMessageID: msgID,
+	})
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to look up message: %w", err)
+	}
+}
@@ -0,0 +1,416 @@
+package mailimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+func newImporter(t *testing.T) *Importer {
+	t.Helper()
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Importer{
+		Store:  mailstore.New(db, blobstore.New(db, fsb)),
+		UserID: "u1",
+	}
+}
+
+// message returns a message with the given Message-ID and body.
+func message(msgID, body string) string {
+	return "From: alice@example.org\nTo: user@example.com\nSubject: " + msgID +
+		"\nMessage-ID: <" + msgID + ">\n\n" + body
+}
+
+// writeMbox writes messages to an mbox file, separated by "From " lines.
+func writeMbox(t *testing.T, messages ...string) string {
+	t.Helper()
+	var b strings.Builder
+	for _, m := range messages {
+		b.WriteString("From alice@example.org Sat Mar  1 09:30:00 2025\n")
+		b.WriteString(m)
+		b.WriteString("\n")
+	}
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeMaildir writes each file, named by its path relative to the root.
+func writeMaildir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// run opens path, resuming from its checkpoint, and imports it.
+func run(t *testing.T, ctx context.Context, im *Importer, path string, wrap func(Source) Source) (Stats, error) {
+	t.Helper()
+	cp, err := im.Checkpoint(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cursor string
+	if cp != nil {
+		cursor = cp.Cursor
+	}
+	src, err := Open(path, FormatAuto, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if wrap != nil {
+		src = wrap(src)
+	}
+	return im.Run(ctx, src, path, cp)
+}
+
+func countMessages(t *testing.T, im *Importer) int {
+	t.Helper()
+	var n int
+	if err := im.Store.DB().DB().QueryRow(`SELECT COUNT(*) FROM message WHERE user_id = 'u1'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func textBody(t *testing.T, im *Importer, msgID string) string {
+	t.Helper()
+	ctx := context.Background()
+	msg, err := im.Store.DB().Queries().GetMessageByInternetMessageID(ctx, schema.GetMessageByInternetMessageIDParams{
+		UserID:            "u1",
+		InternetMessageID: msgID,
+	})
+	if err != nil {
+		t.Fatalf("message %s: %v", msgID, err)
+	}
+	body, err := im.Store.DB().Queries().GetMessageBody(ctx, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body.TextBody
+}
+
+func TestMboxSource(t *testing.T) {
+	path := writeMbox(t,
+		message("a@example.org", "First line.\n>From the start.\n>>From quoted.\nFrom here is not a separator.\n"),
+		message("b@example.org", "Second.\n"),
+	)
+	src, err := Open(path, FormatAuto, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	first, err := src.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBody := "First line.\nFrom the start.\n>From quoted.\nFrom here is not a separator.\n"
+	if want := message("a@example.org", wantBody); string(first.Raw) != want {
+		t.Errorf("got %q, want %q", first.Raw, want)
+	}
+	if want := time.Date(2025, 3, 1, 9, 30, 0, 0, time.UTC); !first.ReceivedAt.Equal(want) {
+		t.Errorf("got received time %v, want %v", first.ReceivedAt, want)
+	}
+	if first.Location != "offset 0" {
+		t.Errorf("got location %q", first.Location)
+	}
+
+	// The cursor resumes at the second message
+	cursor := src.Cursor()
+	resumed, err := Open(path, FormatMbox, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	second, err := resumed.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := message("b@example.org", "Second.\n"); string(second.Raw) != want {
+		t.Errorf("resuming at %s: got %q, want %q", cursor, second.Raw, want)
+	}
+	if _, err := resumed.Next(); err == nil {
+		t.Error("read past the last message")
+	}
+
+	if _, err := Open(path, FormatMbox, "-1"); err == nil {
+		t.Error("opened with a negative cursor")
+	}
+}
+
+func TestMaildirSource(t *testing.T) {
+	root := writeMaildir(t, map[string]string{
+		"cur/1700000000.M1P1.host:2,S":      message("a@example.org", "A.\n"),
+		"new/1700000100.M2P1.host":          message("b@example.org", "B.\n"),
+		".Work/cur/1700000200.M3P1.host:2,": message("c@example.org", "C.\n"),
+		"tmp/1700000300.M4P1.host":          message("d@example.org", "Not delivered yet.\n"),
+	})
+	src, err := Open(root, FormatAuto, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var locations []string
+	for {
+		item, err := src.Next()
+		if err != nil {
+			break
+		}
+		locations = append(locations, item.Location)
+		if item.Location == "cur/1700000000.M1P1.host:2,S" && !item.ReceivedAt.Equal(time.Unix(1700000000, 0)) {
+			t.Errorf("got received time %v from the file name", item.ReceivedAt)
+		}
+	}
+	want := []string{".Work/cur/1700000200.M3P1.host:2,", "cur/1700000000.M1P1.host:2,S", "new/1700000100.M2P1.host"}
+	if fmt.Sprint(locations) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", locations, want)
+	}
+
+	// Resuming after the first file, including one that has since moved
+	for _, cursor := range []string{".Work/cur/1700000200.M3P1.host:2,", ".Work/cur/1700000200.M3P1.host:2,S"} {
+		src, err := Open(root, FormatMaildir, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, err := src.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Location != "cur/1700000000.M1P1.host:2,S" {
+			t.Errorf("resuming after %s: got %s", cursor, item.Location)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	im := newImporter(t)
+	im.BatchSize = 2
+	var batches []Stats
+	im.OnProgress = func(s Stats) { batches = append(batches, s) }
+	var failures []Failure
+	im.OnFailure = func(f Failure) { failures = append(failures, f) }
+
+	root := writeMaildir(t, map[string]string{
+		"cur/1.host:2,S": message("a@example.org", "A.\n"),
+		"cur/2.host:2,S": message("b@example.org", "B.\n"),
+		"cur/3.host:2,S": message("a@example.org", "A again.\n"),
+		"cur/4.host:2,S": "",
+		"cur/5.host:2,S": message("c@example.org", "C.\n"),
+	})
+	stats, err := run(t, ctx, im, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Imported != 3 || stats.Duplicates != 1 || stats.Failed != 1 || stats.Done != 5 || stats.Total != 5 {
+		t.Errorf("got %+v", stats)
+	}
+	if len(failures) != 1 || failures[0].Location != "cur/4.host:2,S" || !errors.Is(failures[0].Err, mailstore.ErrEmptyMessage) {
+		t.Errorf("got failures %v", failures)
+	}
+	// A full batch of two, then the rest
+	if len(batches) != 2 || batches[0].Imported != 2 || batches[1].Imported != 3 {
+		t.Errorf("got batches %+v", batches)
+	}
+	if n := countMessages(t, im); n != 3 {
+		t.Errorf("stored %d messages, want 3", n)
+	}
+	if got := textBody(t, im, "a@example.org"); got != "A.\n" {
+		t.Errorf("got %q, want the first copy of a duplicate", got)
+	}
+
+	cp, err := im.Checkpoint(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp == nil || !cp.Completed || cp.Cursor != "cur/5.host:2,S" || cp.Imported != 3 || cp.Duplicates != 1 || cp.Failed != 1 {
+		t.Errorf("got checkpoint %+v", cp)
+	}
+
+	// Importing again only finds duplicates of what is stored
+	if err := im.Reset(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = run(t, ctx, im, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Imported != 0 || stats.Duplicates != 4 || stats.Failed != 1 {
+		t.Errorf("importing again: got %+v", stats)
+	}
+	if n := countMessages(t, im); n != 3 {
+		t.Errorf("stored %d messages after importing again, want 3", n)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	ctx := context.Background()
+	im := newImporter(t)
+	im.DryRun = true
+
+	path := writeMbox(t,
+		message("a@example.org", "A.\n"),
+		message("a@example.org", "A again.\n"),
+		message("b@example.org", "B.\n"),
+	)
+	stats, err := run(t, ctx, im, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Imported != 2 || stats.Duplicates != 1 {
+		t.Errorf("got %+v", stats)
+	}
+	if n := countMessages(t, im); n != 0 {
+		t.Errorf("a dry run stored %d messages", n)
+	}
+	if cp, err := im.Checkpoint(ctx, path); err != nil || cp != nil {
+		t.Errorf("a dry run saved checkpoint %+v, %v", cp, err)
+	}
+}
+
+// failingSource fails after reading n messages, as a crash would.
+type failingSource struct {
+	Source
+	n int
+}
+
+var errCrash = errors.New("crash")
+
+func (s *failingSource) Next() (*Item, error) {
+	if s.n == 0 {
+		return nil, errCrash
+	}
+	s.n--
+	return s.Source.Next()
+}
+
+func TestImportResume(t *testing.T) {
+	ctx := context.Background()
+	var messages []string
+	for i := 0; i < 7; i++ {
+		messages = append(messages, message(fmt.Sprintf("m%d@example.org", i), "Body.\n"))
+	}
+	messages = append(messages, message("m0@example.org", "A duplicate.\n"))
+
+	tests := []struct {
+		name string
+		path func(t *testing.T) string
+	}{
+		{"mbox", func(t *testing.T) string { return writeMbox(t, messages...) }},
+		{"maildir", func(t *testing.T) string {
+			files := make(map[string]string)
+			for i, m := range messages {
+				files[fmt.Sprintf("cur/%d.host:2,", 1700000000+i)] = m
+			}
+			return writeMaildir(t, files)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := newImporter(t)
+			im.BatchSize = 3
+			path := tt.path(t)
+
+			// The first batch of three is committed; the next two messages
+			// are read but lost with the crash
+			_, err := run(t, ctx, im, path, func(src Source) Source { return &failingSource{Source: src, n: 5} })
+			if !errors.Is(err, errCrash) {
+				t.Fatalf("got %v, want the crash", err)
+			}
+			if n := countMessages(t, im); n != 3 {
+				t.Errorf("stored %d messages before the crash, want 3", n)
+			}
+			cp, err := im.Checkpoint(ctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cp == nil || cp.Completed || cp.Imported != 3 {
+				t.Fatalf("got checkpoint %+v after the crash", cp)
+			}
+
+			stats, err := run(t, ctx, im, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Imported != 7 || stats.Duplicates != 1 || stats.Failed != 0 {
+				t.Errorf("got %+v after resuming", stats)
+			}
+			if n := countMessages(t, im); n != 7 {
+				t.Errorf("stored %d messages after resuming, want 7", n)
+			}
+			if cp, err := im.Checkpoint(ctx, path); err != nil || cp == nil || !cp.Completed {
+				t.Errorf("got checkpoint %+v, %v after resuming", cp, err)
+			}
+		})
+	}
+}
+
+func TestImportCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	im := newImporter(t)
+	im.BatchSize = 10
+
+	path := writeMbox(t,
+		message("a@example.org", "A.\n"),
+		message("b@example.org", "B.\n"),
+		message("c@example.org", "C.\n"),
+	)
+	// Cancelled after two messages, the pending batch is still committed
+	_, err := run(t, ctx, im, path, func(src Source) Source { return &cancellingSource{Source: src, n: 2, cancel: cancel} })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if n := countMessages(t, im); n != 2 {
+		t.Errorf("stored %d messages, want 2", n)
+	}
+
+	stats, err := run(t, context.Background(), im, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Imported != 3 || stats.Duplicates != 0 {
+		t.Errorf("got %+v after resuming", stats)
+	}
+}
+
+// cancellingSource cancels the import after reading n messages.
+type cancellingSource struct {
+	Source
+	n      int
+	cancel context.CancelFunc
+}
+
+func (s *cancellingSource) Next() (*Item, error) {
+	s.n--
+	if s.n == 0 {
+		s.cancel()
+	}
+	return s.Source.Next()
+}
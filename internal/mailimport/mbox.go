@@ -0,0 +1,169 @@
+package mailimport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mboxSource reads an mbox file. Messages are separated by "From " lines
+// that follow a blank line; ">From " quoting (mboxo and mboxrd) is undone by
+// removing one ">".
+type mboxSource struct {
+	f      *os.File
+	r      *bufio.Reader
+	size   int64
+	offset int64 // start of the next unread line
+
+	// pending is a "From " line read while finishing the previous message
+	pending     []byte
+	pendingDate time.Time
+}
+
+func openMbox(path, cursor string) (*mboxSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var offset int64
+	if cursor != "" {
+		offset, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || offset < 0 || offset > info.Size() {
+			f.Close()
+			return nil, fmt.Errorf("invalid mbox cursor %q", cursor)
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return &mboxSource{
+		f:      f,
+		r:      bufio.NewReaderSize(f, 64<<10),
+		size:   info.Size(),
+		offset: offset,
+	}, nil
+}
+
+func (m *mboxSource) Next() (*Item, error) {
+	start := m.offset
+	date := m.pendingDate
+	if m.pending == nil {
+		// Skip to the first "From " line
+		for {
+			line, err := m.readLine()
+			if len(line) == 0 && err != nil {
+				return nil, err
+			}
+			if isFromLine(line) {
+				start = m.offset - int64(len(line))
+				date = fromLineDate(line)
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		start -= int64(len(m.pending))
+		m.pending = nil
+	}
+
+	var buf bytes.Buffer
+	prevBlank := true
+	for {
+		line, err := m.readLine()
+		if prevBlank && isFromLine(line) {
+			m.pending = line
+			m.pendingDate = fromLineDate(line)
+			break
+		}
+		buf.Write(unquoteFrom(line))
+		prevBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The blank line before the next "From " line belongs to the separator
+	raw := buf.Bytes()
+	if bytes.HasSuffix(raw, []byte("\r\n\r\n")) {
+		raw = raw[:len(raw)-2]
+	} else if bytes.HasSuffix(raw, []byte("\n\n")) {
+		raw = raw[:len(raw)-1]
+	}
+
+	return &Item{
+		Raw:        raw,
+		ReceivedAt: date,
+		Location:   "offset " + strconv.FormatInt(start, 10),
+	}, nil
+}
+
+func (m *mboxSource) readLine() ([]byte, error) {
+	line, err := m.r.ReadBytes('\n')
+	m.offset += int64(len(line))
+	return line, err
+}
+
+// Cursor is the byte offset of the next message's "From " line.
+func (m *mboxSource) Cursor() string {
+	return strconv.FormatInt(m.offset-int64(len(m.pending)), 10)
+}
+
+func (m *mboxSource) Progress() (int64, int64) {
+	return m.offset - int64(len(m.pending)), m.size
+}
+
+func (m *mboxSource) Close() error {
+	return m.f.Close()
+}
+
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// unquoteFrom turns ">From ", ">>From ", ... back into one less ">".
+func unquoteFrom(line []byte) []byte {
+	i := 0
+	for i < len(line) && line[i] == '>' {
+		i++
+	}
+	if i > 0 && bytes.HasPrefix(line[i:], []byte("From ")) {
+		return line[1:]
+	}
+	return line
+}
+
+// fromLineDate parses the asctime date that follows the envelope sender in a
+// "From sender Mon Jan  2 15:04:05 2006" line. It returns the zero time if
+// the date is missing or unparseable.
+func fromLineDate(line []byte) time.Time {
+	fields := strings.Fields(string(line))
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+	s := strings.Join(fields[2:], " ")
+	// Some writers add a time zone after the time or the year
+	for _, layout := range []string{time.ANSIC, "Mon Jan _2 15:04:05 2006 -0700", "Mon Jan _2 15:04:05 MST 2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
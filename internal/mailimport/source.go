@@ -0,0 +1,67 @@
+// Package mailimport bulk-loads existing mail archives (mbox files and
+// Maildir trees) into a user's mailstore.
+package mailimport
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Formats accepted by Open.
+const (
+	FormatAuto    = "auto"
+	FormatMbox    = "mbox"
+	FormatMaildir = "maildir"
+)
+
+// ErrUnknownFormat is returned by Open when the format can't be determined.
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+// Item is one message read from an archive.
+type Item struct {
+	Raw        []byte
+	ReceivedAt time.Time // zero if the archive doesn't record it
+	Location   string    // human-readable position, for error reports
+}
+
+// Source reads messages from an archive in a stable order. Next returns
+// io.EOF after the last message.
+type Source interface {
+	Next() (*Item, error)
+
+	// Cursor identifies the position after the last message returned by
+	// Next; passing it to Open resumes from there.
+	Cursor() string
+
+	// Progress reports how far through the archive the source is, in
+	// source-specific units (bytes for mbox, files for Maildir).
+	Progress() (done, total int64)
+
+	Close() error
+}
+
+// Open opens the archive at path, resuming after cursor if it is non-empty.
+// With FormatAuto a directory is read as Maildir and a file as mbox.
+func Open(path, format, cursor string) (Source, error) {
+	if format == "" || format == FormatAuto {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		format = FormatMbox
+		if info.IsDir() {
+			format = FormatMaildir
+		}
+	}
+
+	switch format {
+	case FormatMbox:
+		return openMbox(path, cursor)
+	case FormatMaildir:
+		return openMaildir(path, cursor)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+}
@@ -0,0 +1,96 @@
+package mailstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+// moveBatchSize is the number of messages MoveInlineContent moves per
+// transaction.
+const moveBatchSize = 50
+
+// MoveInlineContent moves the raw messages stored in the database before the
+// blob store existed into it, together with their attachments' content, and
+// returns how many messages were moved.
+func (s *Store) MoveInlineContent(ctx context.Context) (int, error) {
+	moved := 0
+	for {
+		bodies, err := s.db.Queries().ListInlineMessageBodies(ctx, moveBatchSize)
+		if err != nil {
+			return moved, fmt.Errorf("failed to list stored messages: %w", err)
+		}
+		if len(bodies) == 0 {
+			return moved, nil
+		}
+
+		type pending struct {
+			messageID   string
+			rawHash     string
+			attachments map[string]string // part -> hash
+		}
+		batch := make([]pending, 0, len(bodies))
+		for _, b := range bodies {
+			rawHash, err := s.blobs.Put(ctx, b.Raw)
+			if err != nil {
+				return moved, fmt.Errorf("failed to move message %s: %w", b.MessageID, err)
+			}
+			p := pending{messageID: b.MessageID, rawHash: rawHash, attachments: map[string]string{}}
+
+			// The message parsed when it was stored, so a failure here only
+			// leaves its attachments without downloadable content
+			if parsed, err := Parse(b.Raw); err == nil {
+				for _, a := range parsed.Attachments {
+					hash, err := s.blobs.Put(ctx, a.Body)
+					if err != nil {
+						return moved, fmt.Errorf("failed to move attachment of message %s: %w", b.MessageID, err)
+					}
+					p.attachments[a.Part] = hash
+				}
+			}
+			batch = append(batch, p)
+		}
+
+		err = s.db.WithTx(ctx, func(q *schema.Queries) error {
+			for _, p := range batch {
+				err := q.SetMessageBodyBlob(ctx, schema.SetMessageBodyBlobParams{RawHash: p.rawHash, MessageID: p.messageID})
+				if err != nil {
+					return fmt.Errorf("failed to update message %s: %w", p.messageID, err)
+				}
+				if err := database.AcquireBlobTx(ctx, q, p.rawHash); err != nil {
+					return err
+				}
+
+				for part, hash := range p.attachments {
+					att, err := q.GetAttachment(ctx, schema.GetAttachmentParams{MessageID: p.messageID, Part: part})
+					if errors.Is(err, sql.ErrNoRows) || (err == nil && att.BlobHash != "") {
+						continue
+					}
+					if err != nil {
+						return fmt.Errorf("failed to get attachment of message %s: %w", p.messageID, err)
+					}
+					err = q.SetAttachmentBlob(ctx, schema.SetAttachmentBlobParams{
+						BlobHash:  hash,
+						MessageID: p.messageID,
+						Part:      part,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to update attachment of message %s: %w", p.messageID, err)
+					}
+					if err := database.AcquireBlobTx(ctx, q, hash); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+		moved += len(batch)
+	}
+}
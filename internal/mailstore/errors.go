@@ -0,0 +1,32 @@
+package mailstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Predefined errors for the mailstore package
+var (
+	ErrMalformedMessage = errors.New("malformed message")
+	ErrMessageTooLarge  = errors.New("message exceeds maximum size")
+	ErrEmptyMessage     = errors.New("empty message")
+	ErrUnknownUser      = errors.New("unknown user")
+)
+
+// ParseError describes why a message could not be parsed.
+type ParseError struct {
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return "malformed message: " + e.Reason
+}
+
+// Unwrap lets callers match parse failures with errors.Is(err, ErrMalformedMessage).
+func (e *ParseError) Unwrap() error {
+	return ErrMalformedMessage
+}
+
+func malformed(format string, args ...interface{}) error {
+	return &ParseError{Reason: fmt.Sprintf(format, args...)}
+}
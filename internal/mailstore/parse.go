@@ -0,0 +1,113 @@
+package mailstore
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+// Header is a single header field in the order it appeared in the message.
+type Header = mime.Header
+
+// Attachment describes a non-body leaf part of a message.
+type Attachment struct {
+	Part        string // dotted part path, e.g. "2" or "1.2"
+	Filename    string
+	ContentType string
+	Disposition string
+	ContentID   string
+	Size        int64
+	Body        []byte // transfer-decoded content
+}
+
+// Parsed is the subset of an RFC 5322 message that mailroom persists.
+type Parsed struct {
+	MessageID   string
+	InReplyTo   string
+	References  []string
+	Subject     string
+	From        *mail.Address
+	To          []*mail.Address
+	Cc          []*mail.Address
+	Bcc         []*mail.Address
+	ReplyTo     []*mail.Address
+	Date        time.Time
+	Headers     []Header
+	TextBody    string
+	HTMLBody    string
+	Attachments []Attachment
+
+	// Warnings lists problems the parser worked around.
+	Warnings []string
+}
+
+// Parse parses a raw RFC 5322 message with the mime package. Only input that
+// isn't a message at all is rejected; errors wrap ErrMalformedMessage.
+func Parse(raw []byte) (*Parsed, error) {
+	m, err := mime.Parse(raw)
+	if err != nil {
+		if errors.Is(err, mime.ErrNoHeader) {
+			return nil, malformed("message has no header fields")
+		}
+		return nil, malformed("%v", err)
+	}
+
+	p := &Parsed{
+		MessageID:  m.MessageID,
+		InReplyTo:  m.InReplyTo,
+		References: m.References,
+		Subject:    m.Subject,
+		To:         m.To,
+		Cc:         m.Cc,
+		Bcc:        m.Bcc,
+		ReplyTo:    m.ReplyTo,
+		Date:       m.Date,
+		Headers:    m.Header(),
+	}
+	if len(m.From) > 0 {
+		p.From = m.From[0]
+	}
+	for _, w := range m.Warnings {
+		p.Warnings = append(p.Warnings, w.String())
+	}
+
+	m.Root.Walk(p.addPart)
+	return p, nil
+}
+
+// addPart takes the first inline text/plain and text/html leaves as the
+// message bodies and records every other leaf as an attachment.
+func (p *Parsed) addPart(part *mime.Part) {
+	if part.IsMultipart() {
+		return
+	}
+
+	isText := part.MediaType == "text/plain" || part.MediaType == "text/html"
+	if isText && part.Disposition != "attachment" && part.Filename == "" {
+		if part.MediaType == "text/plain" && p.TextBody == "" {
+			p.TextBody = part.Text
+			return
+		}
+		if part.MediaType == "text/html" && p.HTMLBody == "" {
+			p.HTMLBody = part.Text
+			return
+		}
+	}
+
+	disposition := part.Disposition
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	p.Attachments = append(p.Attachments, Attachment{
+		Part:        part.Path,
+		Filename:    strings.TrimSpace(part.Filename),
+		ContentType: part.MediaType,
+		Disposition: disposition,
+		ContentID:   part.ContentID,
+		Size:        int64(len(part.Body)),
+		Body:        part.Body,
+	})
+}
@@ -0,0 +1,427 @@
+// Package mailstore turns raw RFC 5322 messages into stored messages. Every
+// ingestion path (HTTP, SMTP/LMTP, sync, import) delivers through a Store.
+package mailstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/jobs"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+)
+
+// DefaultMaxMessageSize is used when MAX_MESSAGE_SIZE is not set.
+const DefaultMaxMessageSize = 25 << 20 // 25 MiB
+
+// ProcessJob is the kind of the jobs that run the processors on a stored
+// message once the store has a queue. Messages delivered to a store with a
+// queue are indexed for search and threaded in their ProcessJob too, before
+// the processors run.
+const ProcessJob = "message.process"
+
+// Store persists parsed messages through the database service, keeping the
+// raw message and attachment content in the blob store.
+type Store struct {
+	db             database.Service
+	blobs          *blobstore.Store
+	maxMessageSize int64
+	processors     []Processor
+	queue          *jobs.Queue // nil runs processors before Deliver returns
+}
+
+// Processor acts on messages after they have been stored, e.g. by running
+// the owner's rules.
+type Processor interface {
+	Process(ctx context.Context, rec database.MessageRecord, env Envelope) error
+}
+
+// Envelope is the SMTP envelope a message was delivered with. It is empty
+// for messages that didn't arrive over SMTP or LMTP.
+type Envelope struct {
+	From string `json:"from"` // MAIL FROM; empty for the null reverse path
+	To   string `json:"to"`   // the RCPT TO address the message was delivered for
+}
+
+// Delivery is a single message to be stored for a user.
+type Delivery struct {
+	UserID     string
+	Raw        []byte
+	ReceivedAt time.Time // zero means now
+	Envelope   Envelope
+
+	// Auth is the authentication verdict of a message delivered over SMTP
+	// or LMTP; nil if it wasn't authenticated.
+	Auth *mailauth.Results
+
+	// Outgoing marks a message the user wrote rather than received, such
+	// as the copy of one they sent or a draft they saved. The processors
+	// don't run on it.
+	Outgoing bool
+
+	// Tx, if set, runs inside the transaction that inserts the message so
+	// that callers can record bookkeeping (e.g. sync positions) atomically
+	// with it.
+	Tx func(ctx context.Context, q *schema.Queries, messageID string) error
+}
+
+// New creates a Store. The maximum message size is read from the
+// MAX_MESSAGE_SIZE environment variable (in bytes).
+func New(db database.Service, blobs *blobstore.Store) *Store {
+	maxSize := int64(DefaultMaxMessageSize)
+	if v := os.Getenv("MAX_MESSAGE_SIZE"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			maxSize = n
+		}
+	}
+	return &Store{
+		db:             db,
+		blobs:          blobs,
+		maxMessageSize: maxSize,
+	}
+}
+
+// MaxMessageSize returns the largest raw message, in bytes, that Deliver accepts.
+func (s *Store) MaxMessageSize() int64 {
+	return s.maxMessageSize
+}
+
+// DB returns the database service backing the store.
+func (s *Store) DB() database.Service {
+	return s.db
+}
+
+// Blobs returns the blob store holding message content.
+func (s *Store) Blobs() *blobstore.Store {
+	return s.blobs
+}
+
+// Use adds a processor to run on every stored message, after those added
+// before it. It must be called before the store delivers messages.
+func (s *Store) Use(p Processor) {
+	s.processors = append(s.processors, p)
+}
+
+// SetQueue makes the store run its processors, and index and thread the
+// messages it receives, in jobs on queue instead of before Deliver returns.
+func (s *Store) SetQueue(queue *jobs.Queue) {
+	s.queue = queue
+	queue.Handle(ProcessJob, s.processJob, jobs.Options{})
+}
+
+// processPayload identifies the message a ProcessJob runs on.
+type processPayload struct {
+	MessageID string   `json:"message_id"`
+	UserID    string   `json:"user_id"`
+	Envelope  Envelope `json:"envelope"`
+	// Deferred is set if the message is still to be indexed and threaded
+	Deferred bool `json:"deferred,omitempty"`
+}
+
+// Process runs the processors on a stored message, or queues a job to run
+// them if the store has a queue. Deliver calls it once the message is
+// committed; callers that insert records themselves must call it after
+// committing them. Failures are logged rather than returned, as the message
+// is already stored.
+func (s *Store) Process(ctx context.Context, rec database.MessageRecord, env Envelope) {
+	if s.queue != nil {
+		p := processPayload{MessageID: rec.Message.ID, UserID: rec.Message.UserID, Envelope: env}
+		if _, err := s.queue.Enqueue(ctx, ProcessJob, p, jobs.PriorityHigh); err != nil {
+			metrics.Errors.WithLabelValues("message_process").Inc()
+			logger.Error(ctx, "Failed to queue message processing", "message_id", rec.Message.ID, "error", err)
+		}
+		return
+	}
+	s.runProcessors(ctx, rec, env)
+}
+
+// processJob runs the processors on the message a ProcessJob names. A
+// processor that fails isn't retried, as the processors before it may have
+// already acted on the message; only failing to load the message is.
+func (s *Store) processJob(ctx context.Context, payload json.RawMessage) error {
+	var p processPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", ProcessJob, err)
+	}
+	if p.Deferred {
+		err := s.db.WithTx(ctx, func(q *schema.Queries) error {
+			if err := database.IndexMessageTx(ctx, q, p.UserID, p.MessageID); err != nil {
+				return err
+			}
+			return database.ThreadMessageTx(ctx, q, p.UserID, p.MessageID)
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			// Deleted before it could be processed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	rec, err := database.LoadMessageRecord(ctx, s.db.Queries(), p.UserID, p.MessageID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Deleted before it could be processed
+			return nil
+		}
+		return err
+	}
+	raw := rec.Body.Raw
+	if len(raw) == 0 {
+		if raw, err = s.blobs.Get(ctx, rec.Body.RawHash); err != nil {
+			return fmt.Errorf("failed to read message %s: %w", p.MessageID, err)
+		}
+	}
+	rec.Blobs[rec.Body.RawHash] = raw
+
+	s.runProcessors(ctx, rec, p.Envelope)
+	return nil
+}
+
+func (s *Store) runProcessors(ctx context.Context, rec database.MessageRecord, env Envelope) {
+	for _, p := range s.processors {
+		if err := p.Process(ctx, rec, env); err != nil {
+			metrics.Errors.WithLabelValues("message_process").Inc()
+			logger.Error(ctx, "Failed to process message", "message_id", rec.Message.ID, "error", err)
+		}
+	}
+}
+
+// Deliver parses and stores a message, returning the new message ID.
+func (s *Store) Deliver(ctx context.Context, d Delivery) (string, error) {
+	ids, err := s.DeliverAll(ctx, []Delivery{d})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// DeliverAll parses and stores messages in one transaction, so that either
+// all of them are stored or none is, returning their IDs in order.
+func (s *Store) DeliverAll(ctx context.Context, ds []Delivery) ([]string, error) {
+	recs := make([]database.MessageRecord, len(ds))
+	for i, d := range ds {
+		if err := s.CheckUser(ctx, d.UserID); err != nil {
+			return nil, err
+		}
+
+		rec, warnings, err := s.Prepare(d)
+		if err != nil {
+			return nil, err
+		}
+		if len(warnings) > 0 {
+			logger.Warn(ctx, "Message parsed with warnings",
+				"message_id", rec.Message.ID,
+				"internet_message_id", rec.Message.InternetMessageID,
+				"warnings", warnings,
+			)
+		}
+
+		if err := s.PutBlobs(ctx, rec); err != nil {
+			return nil, err
+		}
+
+		// Received messages are indexed and threaded in their ProcessJob, so
+		// that delivering them stays quick. Outgoing ones are done at once, as
+		// callers answer with their thread.
+		rec.Deferred = s.queue != nil && !d.Outgoing
+		recs[i] = rec
+	}
+
+	err := s.db.WithTx(ctx, func(q *schema.Queries) error {
+		for i, d := range ds {
+			rec := recs[i]
+			if err := database.InsertMessageTx(ctx, q, rec); err != nil {
+				return err
+			}
+			if d.Tx != nil {
+				if err := d.Tx(ctx, q, rec.Message.ID); err != nil {
+					return err
+				}
+			}
+			if s.queue != nil && !d.Outgoing {
+				// Queued with the message, so that it is processed even if
+				// the process stops right after the commit
+				p := processPayload{MessageID: rec.Message.ID, UserID: d.UserID, Envelope: d.Envelope, Deferred: true}
+				if _, err := s.queue.EnqueueTx(ctx, q, ProcessJob, p, jobs.PriorityHigh); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(ds))
+	for i, d := range ds {
+		if s.queue == nil && !d.Outgoing {
+			s.runProcessors(ctx, recs[i], d.Envelope)
+		}
+		ids[i] = recs[i].Message.ID
+	}
+	return ids, nil
+}
+
+// PutBlobs stores the content referenced by rec in the blob store. It must
+// be called before rec is inserted.
+func (s *Store) PutBlobs(ctx context.Context, rec database.MessageRecord) error {
+	for _, data := range rec.Blobs {
+		if _, err := s.blobs.Put(ctx, data); err != nil {
+			return fmt.Errorf("failed to store message content: %w", err)
+		}
+	}
+	return nil
+}
+
+// CheckUser returns ErrUnknownUser if userID does not exist.
+func (s *Store) CheckUser(ctx context.Context, userID string) error {
+	if _, err := s.db.Queries().GetUserByID(ctx, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUnknownUser
+		}
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	return nil
+}
+
+// Prepare validates and parses d without storing it, also returning the
+// problems the parser worked around. Callers that write many messages in one
+// transaction (such as bulk import) store the record's blobs with PutBlobs,
+// insert it themselves with database.InsertMessageTx and then call Process;
+// d.Tx is ignored.
+func (s *Store) Prepare(d Delivery) (database.MessageRecord, []string, error) {
+	if len(d.Raw) == 0 {
+		return database.MessageRecord{}, nil, ErrEmptyMessage
+	}
+	if int64(len(d.Raw)) > s.maxMessageSize {
+		return database.MessageRecord{}, nil, ErrMessageTooLarge
+	}
+
+	parsed, err := Parse(d.Raw)
+	if err != nil {
+		return database.MessageRecord{}, nil, err
+	}
+	return NewRecord(d, parsed), parsed.Warnings, nil
+}
+
+// NewRecord converts a parsed message into the rows written by
+// database.InsertMessage, assigning it a new ID. The raw message and the
+// attachment content are referenced by hash and carried in rec.Blobs.
+func NewRecord(d Delivery, p *Parsed) database.MessageRecord {
+	receivedAt := d.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	receivedAt = receivedAt.UTC()
+	sentAt := p.Date
+	if sentAt.IsZero() {
+		sentAt = receivedAt
+	}
+
+	rec := database.MessageRecord{
+		Message: schema.InsertMessageParams{
+			ID:                uuid.New().String(),
+			UserID:            d.UserID,
+			InternetMessageID: p.MessageID,
+			InReplyTo:         p.InReplyTo,
+			MessageReferences: strings.Join(p.References, " "),
+			Subject:           p.Subject,
+			SentAt:            sentAt,
+			ReceivedAt:        receivedAt,
+			Size:              int64(len(d.Raw)),
+			HasAttachments:    hasAttachments(p),
+		},
+		Body: schema.InsertMessageBodyParams{
+			TextBody: p.TextBody,
+			HtmlBody: p.HTMLBody,
+			RawHash:  blobstore.Key(d.Raw),
+		},
+		Blobs: map[string][]byte{},
+	}
+	rec.Blobs[rec.Body.RawHash] = d.Raw
+	if d.Auth != nil {
+		rec.Auth = &schema.InsertMessageAuthParams{
+			Dkim:          d.Auth.DKIMVerdict(),
+			Spf:           d.Auth.SPF.Result,
+			Dmarc:         d.Auth.DMARC.Result,
+			DmarcPolicy:   d.Auth.DMARC.Policy,
+			DmarcOverride: d.Auth.DMARC.Override,
+			Arc:           d.Auth.ARC.Result,
+			HeaderFrom:    d.Auth.HeaderFrom,
+			Results:       d.Auth.String(),
+		}
+	}
+	if p.From != nil {
+		rec.Message.FromName = p.From.Name
+		rec.Message.FromAddress = strings.ToLower(p.From.Address)
+	}
+
+	for _, group := range []struct {
+		kind  string
+		addrs []*mail.Address
+	}{
+		{"to", p.To},
+		{"cc", p.Cc},
+		{"bcc", p.Bcc},
+		{"reply-to", p.ReplyTo},
+	} {
+		for i, addr := range group.addrs {
+			rec.Addresses = append(rec.Addresses, schema.InsertMessageAddressParams{
+				Kind:     group.kind,
+				Position: int64(i),
+				Name:     addr.Name,
+				Address:  strings.ToLower(addr.Address),
+			})
+		}
+	}
+
+	for i, h := range p.Headers {
+		rec.Headers = append(rec.Headers, schema.InsertMessageHeaderParams{
+			Position: int64(i),
+			Name:     h.Name,
+			Value:    h.Value,
+		})
+	}
+
+	for _, a := range p.Attachments {
+		hash := blobstore.Key(a.Body)
+		rec.Blobs[hash] = a.Body
+		rec.Attachments = append(rec.Attachments, schema.InsertAttachmentParams{
+			Part:        a.Part,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Disposition: a.Disposition,
+			ContentID:   a.ContentID,
+			Size:        a.Size,
+			BlobHash:    hash,
+		})
+	}
+
+	return rec
+}
+
+// hasAttachments reports whether any part is a real attachment rather than an
+// inline resource such as an embedded image.
+func hasAttachments(p *Parsed) bool {
+	for _, a := range p.Attachments {
+		if a.Disposition == "attachment" {
+			return true
+		}
+	}
+	return false
+}
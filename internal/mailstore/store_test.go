@@ -0,0 +1,72 @@
+package mailstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/jobs"
+)
+
+const testRaw = "From: Alice <alice@example.org>\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Lunch\r\n" +
+	"Message-ID: <lunch@example.org>\r\n" +
+	"\r\n" +
+	"Noon?\r\n"
+
+func TestDeliverQueued(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := New(db, blobstore.New(db, fsb))
+	queue := jobs.New(db)
+	store.SetQueue(queue)
+
+	received, err := store.Deliver(ctx, Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, err := store.Deliver(ctx, Delivery{UserID: "u1", Raw: []byte(testRaw), Outgoing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Outgoing messages are indexed and threaded at once, received ones by
+	// their job
+	check := func(id string, want bool) {
+		t.Helper()
+		msg, err := db.Queries().GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: "u1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		unindexed, err := db.Queries().ListUnindexedMessageIDs(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexed := true
+		for _, m := range unindexed {
+			if m.ID == id {
+				indexed = false
+			}
+		}
+		if threaded := msg.ThreadID != ""; threaded != want || indexed != want {
+			t.Errorf("message %s: threaded %t, indexed %t, want %t", id, threaded, indexed, want)
+		}
+	}
+	check(received, false)
+	check(sent, true)
+
+	if ok, err := queue.RunNext(ctx); err != nil || !ok {
+		t.Fatalf("RunNext = %t, %v", ok, err)
+	}
+	check(received, true)
+	if ok, err := queue.RunNext(ctx); err != nil || ok {
+		t.Errorf("outgoing message was queued: RunNext = %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,99 @@
+package mime
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// charsetAliases maps labels seen in real mail that the WHATWG index used by
+// htmlindex doesn't know.
+var charsetAliases = map[string]encoding.Encoding{
+	"cp932":          japanese.ShiftJIS,
+	"ms932":          japanese.ShiftJIS,
+	"windows-31j":    japanese.ShiftJIS,
+	"cp936":          simplifiedchinese.GBK,
+	"ms936":          simplifiedchinese.GBK,
+	"x-gbk":          simplifiedchinese.GBK,
+	"cp850":          charmap.CodePage850,
+	"ibm850":         charmap.CodePage850,
+	"cp437":          charmap.CodePage437,
+	"ibm437":         charmap.CodePage437,
+	"cp1250":         charmap.Windows1250,
+	"cp1251":         charmap.Windows1251,
+	"cp1253":         charmap.Windows1253,
+	"cp1254":         charmap.Windows1254,
+	"cp1255":         charmap.Windows1255,
+	"cp1256":         charmap.Windows1256,
+	"cp1257":         charmap.Windows1257,
+	"cp1258":         charmap.Windows1258,
+	"iso-8859-8-i":   charmap.ISO8859_8,
+	"macintosh":      charmap.Macintosh,
+	"x-mac-roman":    charmap.Macintosh,
+	"unknown-8bit":   charmap.Windows1252,
+	"x-unknown":      charmap.Windows1252,
+	"default":        charmap.Windows1252,
+	"iso8859-1":      charmap.Windows1252,
+	"iso8859-15":     charmap.ISO8859_15,
+	"ansi_x3.4-1968": charmap.Windows1252,
+}
+
+// lookupCharset returns the decoder for a charset label, or nil for UTF-8,
+// US-ASCII and labels that aren't known. Like browsers, ISO-8859-1 is read as
+// its superset Windows-1252.
+func lookupCharset(label string) (enc encoding.Encoding, known bool) {
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	switch label {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return nil, true
+	}
+	if enc, ok := charsetAliases[label]; ok {
+		return enc, true
+	}
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, false
+	}
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return nil, true
+	}
+	return enc, true
+}
+
+// toUTF8 converts b from charset to UTF-8. Unknown charsets and bytes that
+// aren't valid in the declared charset produce a warning; the result is
+// always valid UTF-8.
+func (p *parser) toUTF8(b []byte, charset, where string) string {
+	enc, known := lookupCharset(charset)
+	if !known {
+		p.warn(where, "unknown charset %q", charset)
+	}
+
+	if enc == nil {
+		if utf8.Valid(b) {
+			return string(b)
+		}
+		// Undeclared or mislabeled 8-bit text is most often Windows-1252
+		if s, err := charmap.Windows1252.NewDecoder().Bytes(b); err == nil {
+			if known && charset != "" {
+				p.warn(where, "invalid %s text, decoded as windows-1252", charset)
+			} else if charset == "" {
+				p.warn(where, "8-bit text without a charset, decoded as windows-1252")
+			}
+			return string(s)
+		}
+		return strings.ToValidUTF8(string(b), "�")
+	}
+
+	s, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		p.warn(where, "invalid %s text: %v", charset, err)
+		return strings.ToValidUTF8(string(b), "�")
+	}
+	return strings.ToValidUTF8(string(s), "�")
+}
@@ -0,0 +1,127 @@
+package mime
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+// decodeTransfer reverses a Content-Transfer-Encoding. Damaged input is
+// decoded as far as possible rather than rejected.
+func (p *parser) decodeTransfer(encoding string, body []byte, where string) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "7bit", "8bit", "binary":
+		return body
+	case "base64":
+		return p.decodeBase64(body, where)
+	case "quoted-printable":
+		return p.decodeQuotedPrintable(body, where)
+	default:
+		p.warn(where, "unknown Content-Transfer-Encoding %q, leaving body undecoded", encoding)
+		return body
+	}
+}
+
+// decodeBase64 ignores characters outside the base64 alphabet, missing or
+// misplaced padding and a dangling final character.
+func (p *parser) decodeBase64(body []byte, where string) []byte {
+	clean := make([]byte, 0, len(body))
+	var stray bool
+	for _, c := range body {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '+', c == '/':
+			clean = append(clean, c)
+		case c == '=', c == '\r', c == '\n', c == ' ', c == '\t':
+		case c == '-' || c == '_':
+			// base64url from sloppy encoders
+			if c == '-' {
+				c = '+'
+			} else {
+				c = '/'
+			}
+			clean = append(clean, c)
+			stray = true
+		default:
+			stray = true
+		}
+	}
+	if stray {
+		p.warn(where, "base64 body contains characters outside the alphabet")
+	}
+	if len(clean)%4 == 1 {
+		p.warn(where, "base64 body is truncated")
+		clean = clean[:len(clean)-1]
+	}
+
+	out := make([]byte, base64.RawStdEncoding.DecodedLen(len(clean)))
+	n, err := base64.RawStdEncoding.Decode(out, clean)
+	if err != nil {
+		p.warn(where, "invalid base64 body: %v", err)
+	}
+	return out[:n]
+}
+
+// decodeQuotedPrintable decodes RFC 2045 quoted-printable. Invalid escapes
+// are kept literally, as most mail clients do.
+func (p *parser) decodeQuotedPrintable(body []byte, where string) []byte {
+	var out bytes.Buffer
+	out.Grow(len(body))
+	var invalid bool
+
+	for len(body) > 0 {
+		line, rest, hadNewline := bytes.Cut(body, []byte("\n"))
+		body = rest
+		eol := "\n"
+		if bytes.HasSuffix(line, []byte("\r")) {
+			eol = "\r\n"
+			line = line[:len(line)-1]
+		}
+		// Trailing whitespace was added in transport
+		line = bytes.TrimRight(line, " \t")
+
+		soft := false
+		if bytes.HasSuffix(line, []byte("=")) {
+			soft = true
+			line = line[:len(line)-1]
+		}
+
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			if c != '=' {
+				out.WriteByte(c)
+				continue
+			}
+			if i+2 < len(line) && isHex(line[i+1]) && isHex(line[i+2]) {
+				out.WriteByte(unhex(line[i+1])<<4 | unhex(line[i+2]))
+				i += 2
+				continue
+			}
+			invalid = true
+			out.WriteByte('=')
+		}
+
+		if !soft && hadNewline {
+			out.WriteString(eol)
+		}
+	}
+
+	if invalid {
+		p.warn(where, "quoted-printable body contains invalid escapes")
+	}
+	return out.Bytes()
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,377 @@
+package mime
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	stdmime "mime"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Header is a single unfolded header field in the order it appeared. Value
+// is the raw field body; use DecodeHeader for display text.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Headers is a header section in its original order.
+type Headers []Header
+
+// Get returns the value of the first field named name, case-insensitively.
+func (h Headers) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of every field named name.
+func (h Headers) Values(name string) []string {
+	var values []string
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// splitHeader separates the header section from the body and unfolds the
+// header fields. Lines that aren't valid fields are skipped with a warning;
+// a header section without a blank line is taken to end at the first line
+// that doesn't look like a field.
+func (p *parser) splitHeader(raw []byte, where string) (Headers, []byte) {
+	var headers Headers
+	rest := raw
+	for len(rest) > 0 {
+		line, after, _ := bytes.Cut(rest, []byte("\n"))
+		trimmed := strings.TrimRight(string(line), "\r")
+		if trimmed == "" {
+			return headers, after
+		}
+
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if len(headers) == 0 {
+				p.warn(where, "header section starts with a continuation line")
+			} else {
+				headers[len(headers)-1].Value += " " + strings.TrimSpace(trimmed)
+			}
+			rest = after
+			continue
+		}
+
+		name, value, ok := strings.Cut(trimmed, ":")
+		name = strings.TrimRight(name, " \t")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			if len(headers) == 0 && strings.HasPrefix(trimmed, "From ") {
+				// mbox envelope line left in front of the message
+				p.warn(where, "skipped mbox \"From \" line")
+				rest = after
+				continue
+			}
+			if len(headers) > 0 {
+				p.warn(where, "header section not terminated by a blank line")
+				return headers, rest
+			}
+			p.warn(where, "skipped invalid header line %q", truncate(trimmed, 80))
+			rest = after
+			continue
+		}
+
+		headers = append(headers, Header{Name: name, Value: strings.TrimSpace(value)})
+		rest = after
+	}
+	return headers, nil
+}
+
+// DecodeHeader decodes RFC 2047 encoded words in an unstructured header
+// value and converts the result to UTF-8. Words that can't be decoded are
+// kept as they are.
+func DecodeHeader(value string) string {
+	return (&parser{}).decodeHeader(value, "")
+}
+
+func (p *parser) decodeHeader(value, where string) string {
+	if !strings.Contains(value, "=?") {
+		if utf8.ValidString(value) {
+			return value
+		}
+		// Raw 8-bit header in an unknown charset
+		return p.toUTF8([]byte(value), "", where)
+	}
+
+	var out strings.Builder
+	// Adjacent words in the same charset are decoded together so that a
+	// multi-byte character split across words survives
+	var pending []byte
+	var pendingCharset string
+	flush := func() {
+		if pending != nil {
+			out.WriteString(p.toUTF8(pending, pendingCharset, where))
+			pending, pendingCharset = nil, ""
+		}
+	}
+
+	s := value
+	lastWasWord := false
+	for len(s) > 0 {
+		start := strings.Index(s, "=?")
+		if start < 0 {
+			flush()
+			out.WriteString(p.plain(s, where))
+			break
+		}
+
+		charset, data, end, ok := p.parseEncodedWord(s[start:], where)
+		if !ok {
+			flush()
+			out.WriteString(p.plain(s[:start+2], where))
+			s = s[start+2:]
+			lastWasWord = false
+			continue
+		}
+
+		between := s[:start]
+		// Whitespace between adjacent encoded words is not displayed
+		if !(lastWasWord && strings.TrimSpace(between) == "") {
+			flush()
+			out.WriteString(p.plain(between, where))
+		}
+		if pending != nil && !strings.EqualFold(pendingCharset, charset) {
+			flush()
+		}
+		if pending == nil {
+			pending = []byte{}
+			pendingCharset = charset
+		}
+		pending = append(pending, data...)
+
+		s = s[start+end:]
+		lastWasWord = true
+	}
+	flush()
+	return out.String()
+}
+
+// plain converts text outside encoded words, which should be ASCII but is
+// sometimes raw 8-bit.
+func (p *parser) plain(s, where string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return p.toUTF8([]byte(s), "", where)
+}
+
+// parseEncodedWord decodes "=?charset?enc?text?=" at the start of s,
+// returning the charset, the decoded bytes and the length of the word.
+func (p *parser) parseEncodedWord(s, where string) (charset string, data []byte, n int, ok bool) {
+	parts := strings.SplitN(s[2:], "?", 3)
+	if len(parts) < 3 {
+		return "", nil, 0, false
+	}
+	charset, enc := parts[0], parts[1]
+	text, _, found := strings.Cut(parts[2], "?=")
+	if !found || charset == "" || strings.ContainsAny(text, " \t") {
+		return "", nil, 0, false
+	}
+	// RFC 2231 language suffix: charset*lang
+	charset, _, _ = strings.Cut(charset, "*")
+	n = 2 + len(parts[0]) + 1 + len(enc) + 1 + len(text) + 2
+
+	switch strings.ToUpper(enc) {
+	case "B":
+		clean := strings.TrimRight(text, "=")
+		b, err := base64.RawStdEncoding.DecodeString(clean)
+		if err != nil {
+			p.warn(where, "invalid base64 encoded word")
+			return "", nil, 0, false
+		}
+		return charset, b, n, true
+	case "Q":
+		b := make([]byte, 0, len(text))
+		for i := 0; i < len(text); i++ {
+			switch c := text[i]; {
+			case c == '_':
+				b = append(b, ' ')
+			case c == '=' && i+2 < len(text) && isHex(text[i+1]) && isHex(text[i+2]):
+				b = append(b, unhex(text[i+1])<<4|unhex(text[i+2]))
+				i += 2
+			default:
+				b = append(b, c)
+			}
+		}
+		return charset, b, n, true
+	default:
+		return "", nil, 0, false
+	}
+}
+
+// ParseAddressList parses an address header value as Parse does, falling
+// back to a lenient scan when it isn't valid RFC 5322.
+func ParseAddressList(value string) []*mail.Address {
+	return (&parser{}).parseAddressList(value, "")
+}
+
+// parseAddressList parses an address header, falling back to a lenient scan
+// for addresses when the value isn't valid RFC 5322.
+func (p *parser) parseAddressList(value, where string) []*mail.Address {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	ap := mail.AddressParser{WordDecoder: p.wordDecoder(where)}
+	if list, err := ap.ParseList(value); err == nil {
+		return list
+	}
+
+	var list []*mail.Address
+	for _, chunk := range splitAddresses(value) {
+		if addr := p.lenientAddress(chunk, where); addr != nil {
+			list = append(list, addr)
+		}
+	}
+	if len(list) == 0 {
+		p.warn(where, "no addresses found in %q", truncate(value, 80))
+	} else {
+		p.warn(where, "invalid address list %q, parsed leniently", truncate(value, 80))
+	}
+	return list
+}
+
+// splitAddresses splits at commas outside quotes and angle brackets.
+func splitAddresses(s string) []string {
+	var parts []string
+	var inQuote, inAngle bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && inQuote:
+			i++
+		case c == '"':
+			inQuote = !inQuote
+		case c == '<' && !inQuote:
+			inAngle = true
+		case c == '>' && !inQuote:
+			inAngle = false
+		case (c == ',' || c == ';') && !inQuote && !inAngle:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func (p *parser) lenientAddress(s, where string) *mail.Address {
+	s = strings.TrimSpace(s)
+	// Group syntax "name: addr, addr;" leaves the group name on the first
+	// address
+	if i := strings.Index(s, ":"); i >= 0 && !strings.Contains(s[:i], "<") && !strings.Contains(s[:i], "@") {
+		s = strings.TrimSpace(s[i+1:])
+	}
+
+	if open := strings.LastIndex(s, "<"); open >= 0 {
+		end := strings.Index(s[open:], ">")
+		if end < 0 {
+			end = len(s) - open
+		}
+		addr := strings.TrimSpace(s[open+1 : open+end])
+		if !strings.Contains(addr, "@") {
+			return nil
+		}
+		name := strings.TrimSpace(s[:open])
+		name = strings.Trim(name, `"`)
+		name = strings.ReplaceAll(name, `\"`, `"`)
+		return &mail.Address{Name: p.decodeHeader(name, where), Address: addr}
+	}
+
+	for _, field := range strings.Fields(s) {
+		field = strings.Trim(field, `"'()[]`)
+		if strings.Contains(field, "@") {
+			return &mail.Address{Address: field}
+		}
+	}
+	return nil
+}
+
+// wordDecoder adapts the parser's charset handling to net/mail.
+func (p *parser) wordDecoder(where string) *stdmime.WordDecoder {
+	return &stdmime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		b, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(p.toUTF8(b, charset, where)), nil
+	}}
+}
+
+// parseMsgIDs extracts the <id> tokens from a Message-ID, References or
+// In-Reply-To value, ignoring anything between them. A value without angle
+// brackets is taken as a single bare ID.
+func parseMsgIDs(s string) []string {
+	var ids []string
+	rest := s
+	for {
+		start := strings.Index(rest, "<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], ">")
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(rest[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		rest = rest[start+end+1:]
+	}
+	if len(ids) == 0 {
+		if bare := strings.TrimSpace(s); bare != "" && !strings.ContainsAny(bare, " \t") {
+			ids = append(ids, bare)
+		}
+	}
+	return ids
+}
+
+// dateLayouts are tried after net/mail for dates real senders produce.
+var dateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700 (MST)",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 MST 2006",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	time.RFC3339,
+}
+
+func (p *parser) parseDate(value, where string) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}
+	}
+	if t, err := mail.ParseDate(value); err == nil {
+		return t.UTC()
+	}
+	normalized := strings.Join(strings.Fields(value), " ")
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, normalized); err == nil {
+			return t.UTC()
+		}
+	}
+	p.warn(where, "unparseable Date %q", truncate(value, 80))
+	return time.Time{}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,330 @@
+// Package mime parses raw RFC 5322 messages into a tree of MIME parts. It
+// handles multipart nesting, quoted-printable and base64 transfer encodings,
+// RFC 2047 encoded words, RFC 2231 parameters and legacy charsets, and is
+// deliberately forgiving: damage that real senders produce is recorded as a
+// Warning and parsing continues with a best-effort interpretation.
+package mime
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoHeader is returned by Parse when the input has no header fields at
+// all, which means it isn't a message.
+var ErrNoHeader = errors.New("message has no header fields")
+
+// maxDepth bounds multipart and message/rfc822 nesting.
+const maxDepth = 32
+
+// Warning records a problem that was worked around while parsing.
+type Warning struct {
+	Part    string // part path, "" for the top-level header
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Part == "" {
+		return w.Message
+	}
+	return "part " + w.Part + ": " + w.Message
+}
+
+// Part is one MIME entity. Leaf parts carry their transfer-decoded body;
+// multipart parts carry their children; message/rfc822 parts carry both
+// their body and the parsed embedded message.
+type Part struct {
+	// Path is the IMAP section number, e.g. "1.2". The top-level entity of
+	// a message has the path "", or "1" when it is not multipart.
+	Path   string
+	Header Headers
+
+	MediaType string            // lowercased, e.g. "text/plain"
+	Params    map[string]string // Content-Type parameters, decoded
+
+	Disposition       string // lowercased, "" if absent
+	DispositionParams map[string]string
+
+	Filename  string
+	ContentID string // without angle brackets
+	Charset   string
+
+	// Body is the transfer-decoded content of a leaf part.
+	Body []byte
+
+	// Text is Body converted to UTF-8 for text/* parts.
+	Text string
+
+	Parts    []*Part // children of a multipart part
+	Embedded *Part   // root entity of a message/rfc822 part
+}
+
+// IsMultipart reports whether p is a multipart container.
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.MediaType, "multipart/")
+}
+
+// Walk calls fn for p and its descendants in document order, not descending
+// into embedded messages.
+func (p *Part) Walk(fn func(*Part)) {
+	fn(p)
+	for _, c := range p.Parts {
+		c.Walk(fn)
+	}
+}
+
+// Message is a parsed message.
+type Message struct {
+	Root *Part
+
+	MessageID  string
+	InReplyTo  string
+	References []string
+	Subject    string
+	From       []*mail.Address
+	To         []*mail.Address
+	Cc         []*mail.Address
+	Bcc        []*mail.Address
+	ReplyTo    []*mail.Address
+	Date       time.Time // zero if absent or unparseable
+
+	Warnings []Warning
+}
+
+// Header returns the top-level header section.
+func (m *Message) Header() Headers {
+	return m.Root.Header
+}
+
+// parser accumulates warnings across one Parse call.
+type parser struct {
+	warnings []Warning
+}
+
+func (p *parser) warn(part, format string, args ...interface{}) {
+	if p == nil {
+		return
+	}
+	// The same problem is often repeated many times in one part
+	msg := fmt.Sprintf(format, args...)
+	for _, w := range p.warnings {
+		if w.Part == part && w.Message == msg {
+			return
+		}
+	}
+	p.warnings = append(p.warnings, Warning{Part: part, Message: msg})
+}
+
+// Parse parses a raw message. It only fails when raw has no header fields;
+// every other problem is recorded in Message.Warnings.
+func Parse(raw []byte) (*Message, error) {
+	p := &parser{}
+	headers, body := p.splitHeader(raw, "")
+	if len(headers) == 0 {
+		return nil, ErrNoHeader
+	}
+
+	root := p.parseEntity(headers, body, "", 0)
+	m := &Message{Root: root}
+	h := root.Header
+
+	if ids := parseMsgIDs(h.Get("Message-Id")); len(ids) > 0 {
+		m.MessageID = ids[0]
+	}
+	if ids := parseMsgIDs(h.Get("In-Reply-To")); len(ids) > 0 {
+		m.InReplyTo = ids[0]
+	}
+	m.References = parseMsgIDs(h.Get("References"))
+	m.Subject = p.decodeHeader(h.Get("Subject"), "")
+	m.From = p.parseAddressList(h.Get("From"), "")
+	m.To = p.parseAddressList(strings.Join(h.Values("To"), ", "), "")
+	m.Cc = p.parseAddressList(strings.Join(h.Values("Cc"), ", "), "")
+	m.Bcc = p.parseAddressList(strings.Join(h.Values("Bcc"), ", "), "")
+	m.ReplyTo = p.parseAddressList(h.Get("Reply-To"), "")
+	m.Date = p.parseDate(h.Get("Date"), "")
+
+	m.Warnings = p.warnings
+	return m, nil
+}
+
+// parseEntity builds the part for one entity. path is the entity's IMAP
+// section path; the top level of a message is "".
+func (p *parser) parseEntity(h Headers, body []byte, path string, depth int) *Part {
+	part := &Part{Path: path, Header: h}
+	where := path
+
+	ct := h.Get("Content-Type")
+	part.MediaType, part.Params = "text/plain", map[string]string{}
+	if ct != "" {
+		part.MediaType, part.Params = p.parseMediaType(ct, where)
+		if !validMediaType(part.MediaType) {
+			p.warn(where, "invalid Content-Type %q, treated as text/plain", truncate(ct, 80))
+			part.MediaType = "text/plain"
+		}
+	}
+	part.Charset = part.Params["charset"]
+
+	if cd := h.Get("Content-Disposition"); cd != "" {
+		part.Disposition, part.DispositionParams = p.parseMediaType(cd, where)
+	}
+	part.Filename = part.DispositionParams["filename"]
+	if part.Filename == "" {
+		part.Filename = part.Params["name"]
+	}
+	if ids := parseMsgIDs(h.Get("Content-Id")); len(ids) > 0 {
+		part.ContentID = ids[0]
+	}
+
+	if part.IsMultipart() {
+		if depth >= maxDepth {
+			p.warn(where, "multipart nesting too deep, not descending further")
+			return part
+		}
+		boundary := part.Params["boundary"]
+		if boundary == "" {
+			boundary = guessBoundary(body)
+			if boundary == "" {
+				p.warn(where, "multipart entity has no boundary, treated as text/plain")
+				part.MediaType = "text/plain"
+				p.decodeLeaf(part, body)
+				return part
+			}
+			p.warn(where, "multipart entity has no boundary parameter, using %q", boundary)
+		}
+
+		for i, data := range p.splitMultipart(body, boundary, where) {
+			childPath := strconv.Itoa(i + 1)
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			ch, cb := p.splitHeader(data, childPath)
+			child := p.parseEntity(ch, cb, childPath, depth+1)
+			// Parts without a Content-Type default to message/rfc822 in
+			// multipart/digest
+			if part.MediaType == "multipart/digest" && ch.Get("Content-Type") == "" {
+				child.MediaType = "message/rfc822"
+				child.Text = ""
+				p.parseEmbedded(child, depth+1)
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		if len(part.Parts) == 0 {
+			p.warn(where, "multipart entity has no parts")
+		}
+		return part
+	}
+
+	// A non-multipart top-level body is section 1 in IMAP terms
+	if part.Path == "" {
+		part.Path = "1"
+	}
+	p.decodeLeaf(part, body)
+
+	if part.MediaType == "message/rfc822" || part.MediaType == "message/global" {
+		p.parseEmbedded(part, depth)
+	}
+	return part
+}
+
+// decodeLeaf fills in Body, and Text for text parts.
+func (p *parser) decodeLeaf(part *Part, body []byte) {
+	part.Body = p.decodeTransfer(part.Header.Get("Content-Transfer-Encoding"), body, part.Path)
+	if strings.HasPrefix(part.MediaType, "text/") {
+		part.Text = p.toUTF8(part.Body, part.Charset, part.Path)
+	}
+}
+
+// parseEmbedded parses the body of a message/rfc822 part. The embedded
+// message's parts are numbered below the enclosing part, as in IMAP.
+func (p *parser) parseEmbedded(part *Part, depth int) {
+	if depth >= maxDepth {
+		p.warn(part.Path, "message nesting too deep, not descending further")
+		return
+	}
+	h, b := p.splitHeader(part.Body, part.Path)
+	if len(h) == 0 {
+		p.warn(part.Path, "embedded message has no header fields")
+		return
+	}
+	embedded := p.parseEntity(h, b, part.Path, depth+1)
+	if !embedded.IsMultipart() {
+		embedded.Path = part.Path + ".1"
+	}
+	part.Embedded = embedded
+}
+
+// splitMultipart returns the raw body parts between boundary delimiter lines.
+// A missing close delimiter ends the last part at the end of the body.
+func (p *parser) splitMultipart(body []byte, boundary, where string) [][]byte {
+	delim := []byte("--" + boundary)
+	var parts [][]byte
+
+	start := -1 // start of the current part, -1 in the preamble
+	closed := false
+	pos := 0
+	for pos <= len(body) {
+		lineEnd := bytes.IndexByte(body[pos:], '\n')
+		next := len(body) + 1
+		line := body[pos:]
+		if lineEnd >= 0 {
+			line = body[pos : pos+lineEnd]
+			next = pos + lineEnd + 1
+		}
+
+		if bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t\r")
+			isClose := bytes.Equal(rest, []byte("--"))
+			if len(rest) == 0 || isClose {
+				if start >= 0 {
+					parts = append(parts, trimDelimiterEOL(body[start:pos]))
+				}
+				if isClose {
+					closed = true
+					break
+				}
+				start = next
+			}
+		}
+		pos = next
+	}
+
+	if !closed {
+		if start >= 0 && start <= len(body) {
+			p.warn(where, "multipart entity is missing its closing boundary")
+			parts = append(parts, body[start:])
+		} else if start < 0 {
+			p.warn(where, "boundary %q not found in multipart body", truncate(boundary, 70))
+		}
+	}
+	return parts
+}
+
+// trimDelimiterEOL drops the line break that belongs to the following
+// delimiter line.
+func trimDelimiterEOL(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
+
+// guessBoundary returns the boundary of a multipart body whose Content-Type
+// lost its boundary parameter, from the first line that looks like a
+// delimiter.
+func guessBoundary(body []byte) string {
+	for _, line := range bytes.SplitN(body, []byte("\n"), 50) {
+		line = bytes.TrimRight(line, " \t\r")
+		if len(line) > 2 && bytes.HasPrefix(line, []byte("--")) && !bytes.HasSuffix(line, []byte("--")) {
+			return string(line[2:])
+		}
+	}
+	return ""
+}
+
+func validMediaType(t string) bool {
+	typ, sub, ok := strings.Cut(t, "/")
+	return ok && typ != "" && sub != "" && !strings.ContainsAny(t, " \t\"(),:<>@[\\]")
+}
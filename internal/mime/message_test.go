@@ -0,0 +1,349 @@
+package mime
+
+import (
+	"strings"
+	"testing"
+)
+
+// hasWarning reports whether warnings has one for part containing msg.
+func hasWarning(warnings []Warning, part, msg string) bool {
+	for _, w := range warnings {
+		if w.Part == part && strings.Contains(w.Message, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParse(t *testing.T, raw string) *Message {
+	t.Helper()
+	m, err := Parse([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestParseNestedMultipart(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: Alice <alice@example.com>",
+		"To: bob@example.org, Carol <carol@example.org>",
+		"Subject: Report",
+		"Message-ID: <report@example.com>",
+		"Content-Type: multipart/mixed; boundary=outer",
+		"",
+		"preamble",
+		"--outer",
+		"Content-Type: multipart/alternative; boundary=\"inner\"",
+		"",
+		"--inner",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"Plain body",
+		"--inner",
+		"Content-Type: text/html",
+		"",
+		"<p>HTML body</p>",
+		"--inner--",
+		"--outer",
+		"Content-Type: application/pdf; name=report.pdf",
+		"Content-Disposition: attachment",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"JVBERi0=",
+		"--outer",
+		"Content-Type: message/rfc822",
+		"",
+		"From: carol@example.org",
+		"Subject: Forwarded",
+		"Content-Type: multipart/mixed; boundary=fwd",
+		"",
+		"--fwd",
+		"",
+		"Inner text",
+		"--fwd",
+		"Content-Type: image/png",
+		"Content-Id: <logo@example.org>",
+		"",
+		"PNG",
+		"--fwd--",
+		"--outer--",
+		"epilogue",
+	}, "\r\n")
+	m := mustParse(t, raw)
+	if len(m.Warnings) != 0 {
+		t.Errorf("got warnings %v", m.Warnings)
+	}
+	if m.Subject != "Report" || m.MessageID != "report@example.com" || len(m.To) != 2 || m.To[1].Name != "Carol" {
+		t.Errorf("got header fields %q %q %v", m.Subject, m.MessageID, m.To)
+	}
+
+	var got []string
+	m.Root.Walk(func(p *Part) {
+		got = append(got, p.Path+" "+p.MediaType)
+	})
+	want := []string{
+		" multipart/mixed",
+		"1 multipart/alternative",
+		"1.1 text/plain",
+		"1.2 text/html",
+		"2 application/pdf",
+		"3 message/rfc822",
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got parts %q, want %q", got, want)
+	}
+
+	alt := m.Root.Parts[0]
+	if alt.Parts[0].Text != "Plain body" || alt.Parts[1].Text != "<p>HTML body</p>" {
+		t.Errorf("got bodies %q and %q", alt.Parts[0].Text, alt.Parts[1].Text)
+	}
+	pdf := m.Root.Parts[1]
+	if string(pdf.Body) != "%PDF-" || pdf.Filename != "report.pdf" || pdf.Disposition != "attachment" {
+		t.Errorf("got attachment %q %q %q", pdf.Body, pdf.Filename, pdf.Disposition)
+	}
+
+	// The embedded message's parts are numbered below the part holding it
+	fwd := m.Root.Parts[2].Embedded
+	if fwd == nil || !fwd.IsMultipart() || len(fwd.Parts) != 2 {
+		t.Fatalf("got embedded message %+v", fwd)
+	}
+	if p := fwd.Parts[0]; p.Path != "3.1" || p.MediaType != "text/plain" || p.Text != "Inner text" {
+		t.Errorf("got embedded part %q %q %q", p.Path, p.MediaType, p.Text)
+	}
+	if p := fwd.Parts[1]; p.Path != "3.2" || p.ContentID != "logo@example.org" {
+		t.Errorf("got embedded part %q with Content-ID %q", p.Path, p.ContentID)
+	}
+}
+
+func TestParseSinglePart(t *testing.T) {
+	m := mustParse(t, "Subject: hi\r\n\r\nHello\r\n")
+	if p := m.Root; p.Path != "1" || p.MediaType != "text/plain" || p.Text != "Hello\r\n" {
+		t.Errorf("got %q %q %q", p.Path, p.MediaType, p.Text)
+	}
+	if _, err := Parse([]byte("no header here")); err != ErrNoHeader {
+		t.Errorf("Parse without a header = %v, want ErrNoHeader", err)
+	}
+}
+
+func TestTransferEncodings(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		encoding string
+		body     string
+		want     string
+		warning  string
+	}{
+		{"7bit", "7bit", "plain", "plain", ""},
+		{"base64", "base64", "SGVsbG8s\r\nIHdvcmxk\r\n", "Hello, world", ""},
+		{"base64 without padding", "BASE64", "SGk", "Hi", ""},
+		{"base64 with stray characters", "base64", "SGVs*bG8=", "Hello", "outside the alphabet"},
+		{"base64 truncated", "base64", "SGVsbG8hZ", "Hello!", "truncated"},
+		{"quoted-printable", "quoted-printable", "caf=C3=A9 =3D ok", "café = ok", ""},
+		{"quoted-printable soft break", "quoted-printable", "long=\r\nline\r\nnext", "longline\r\nnext", ""},
+		{"quoted-printable trailing space", "quoted-printable", "end   \r\n", "end\r\n", ""},
+		{"quoted-printable invalid escape", "quoted-printable", "100=% sure=ZZ", "100=% sure=ZZ", "invalid escapes"},
+		{"unknown", "x-uuencode", "begin", "begin", "unknown Content-Transfer-Encoding"},
+	} {
+		raw := "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: " + c.encoding + "\r\n\r\n" + c.body
+		m := mustParse(t, raw)
+		if m.Root.Text != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, m.Root.Text, c.want)
+		}
+		if c.warning == "" && len(m.Warnings) != 0 {
+			t.Errorf("%s: got warnings %v", c.name, m.Warnings)
+		}
+		if c.warning != "" && !hasWarning(m.Warnings, "1", c.warning) {
+			t.Errorf("%s: got warnings %v, want one about %q", c.name, m.Warnings, c.warning)
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"=?UTF-8?B?SGVsbG8=?=", "Hello"},
+		{"=?utf-8?q?hello_world?=", "hello world"},
+		{"=?ISO-8859-1?Q?caf=E9?= au lait", "café au lait"},
+		{"Re: =?UTF-8?Q?na=C3=AFve?= question", "Re: naïve question"},
+		// Whitespace between adjacent words isn't displayed
+		{"=?UTF-8?Q?a?= =?UTF-8?Q?b?=", "ab"},
+		{"=?UTF-8?Q?a?=\r\n =?UTF-8?Q?b?=", "ab"},
+		// A character split across two words
+		{"=?UTF-8?B?4oI=?= =?UTF-8?B?rA==?=", "€"},
+		// Words in different charsets
+		{"=?ISO-8859-1?Q?=E9?= =?UTF-8?Q?=C3=A9?= =?windows-1251?Q?=E4?=", "ééд"},
+		{"=?UTF-8*en?Q?hi?=", "hi"},
+		// Malformed words are kept as they are
+		{"=?UTF-8?X?abc?=", "=?UTF-8?X?abc?="},
+		{"=?UTF-8?Q?unterminated", "=?UTF-8?Q?unterminated"},
+		{"=?UTF-8?Q?has space?=", "=?UTF-8?Q?has space?="},
+		{"=??Q?abc?=", "=??Q?abc?="},
+		{"=?UTF-8?B?***?= next", "=?UTF-8?B?***?= next"},
+		// Raw 8-bit text is read as Windows-1252
+		{"caf\xe9", "café"},
+	} {
+		if got := DecodeHeader(c.in); got != c.want {
+			t.Errorf("DecodeHeader(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+
+	p := &parser{}
+	p.decodeHeader("=?UTF-8?B?***?=", "")
+	if !hasWarning(p.warnings, "", "invalid base64 encoded word") {
+		t.Errorf("got warnings %v for an invalid base64 word", p.warnings)
+	}
+}
+
+func TestParseMediaType(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		in      string
+		typ     string
+		param   string
+		want    string
+		warning string
+	}{
+		{"quoted", `Text/Plain; Charset="ISO-8859-1"`, "text/plain", "charset", "ISO-8859-1", ""},
+		{"escaped quote", `attachment; filename="say \"hi\".txt"`, "attachment", "filename", `say "hi".txt`, ""},
+		{"unquoted with spaces", `attachment; filename=my file.txt`, "attachment", "filename", "my file.txt", ""},
+		{"semicolon in quotes", `attachment; filename="a;b.txt"; size=3`, "attachment", "filename", "a;b.txt", ""},
+		{"continuations", `attachment; filename*0="very long "; filename*1="name.txt"`, "attachment", "filename", "very long name.txt", ""},
+		{"continuations out of order", `attachment; filename*1="b.txt"; filename*0="a"`, "attachment", "filename", "ab.txt", ""},
+		{"extended", `attachment; filename*=UTF-8''%E2%82%AC.txt`, "attachment", "filename", "€.txt", ""},
+		{"extended charset", `attachment; filename*=iso-8859-1'fr'caf%E9.txt`, "attachment", "filename", "café.txt", ""},
+		{"extended continuations", `attachment; filename*0*=UTF-8''%E2%82; filename*1*=%AC; filename*2=.txt`, "attachment", "filename", "€.txt", ""},
+		{"extended over plain", `attachment; filename="fallback.txt"; filename*=UTF-8''real.txt`, "attachment", "filename", "real.txt", ""},
+		{"encoded word", `attachment; filename="=?UTF-8?B?w6kudHh0?="`, "attachment", "filename", "é.txt", ""},
+		{"invalid percent escape", `attachment; filename*=UTF-8''100%.txt`, "attachment", "filename", "100%.txt", ""},
+		{"missing section", `attachment; filename*0="a"; filename*2="c"`, "attachment", "filename", "ac", "missing sections"},
+		{"duplicate", `text/plain; charset=utf-8; charset=latin1`, "text/plain", "charset", "utf-8", "duplicate parameter"},
+		{"invalid parameter", `text/plain; garbage; charset=utf-8`, "text/plain", "charset", "utf-8", "ignored invalid parameter"},
+	} {
+		p := &parser{}
+		typ, params := p.parseMediaType(c.in, "")
+		if typ != c.typ || params[c.param] != c.want {
+			t.Errorf("%s: got %q with %s=%q, want %q with %q", c.name, typ, c.param, params[c.param], c.typ, c.want)
+		}
+		if c.warning == "" && len(p.warnings) != 0 {
+			t.Errorf("%s: got warnings %v", c.name, p.warnings)
+		}
+		if c.warning != "" && !hasWarning(p.warnings, "", c.warning) {
+			t.Errorf("%s: got warnings %v, want one about %q", c.name, p.warnings, c.warning)
+		}
+	}
+}
+
+func TestCharsets(t *testing.T) {
+	for _, c := range []struct {
+		charset string
+		body    string
+		want    string
+	}{
+		// ISO-8859-1 is read as its superset Windows-1252
+		{"ISO-8859-1", "caf\xe9 \x80", "café €"},
+		{"iso-8859-2", "\xb1\xbf", "ąż"},
+		{"ISO-8859-5", "\xbf\xe0\xd8\xd2\xd5\xe2", "Привет"},
+		{"ISO-8859-7", "\xe1\xe2\xe3", "αβγ"},
+		{"iso-8859-15", "\xa4", "€"},
+		{"windows-1250", "\x9a\xe8", "šč"},
+		{"windows-1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{"windows-1252", "\x93hi\x94", "“hi”"},
+		{"cp1251", "\xe4\xe0", "да"},
+		{"Shift_JIS", "\x93\xfa\x96\x7b", "日本"},
+		{"cp932", "\x93\xfa\x96\x7b", "日本"},
+		{"GB2312", "\xd6\xd0\xce\xc4", "中文"},
+		{"gbk", "\xd6\xd0\xce\xc4", "中文"},
+		{"utf-8", "na\xc3\xafve", "naïve"},
+		{"us-ascii", "plain", "plain"},
+	} {
+		m := mustParse(t, "Content-Type: text/plain; charset="+c.charset+"\r\n\r\n"+c.body)
+		if m.Root.Text != c.want {
+			t.Errorf("%s: got %q, want %q", c.charset, m.Root.Text, c.want)
+		}
+		if len(m.Warnings) != 0 {
+			t.Errorf("%s: got warnings %v", c.charset, m.Warnings)
+		}
+	}
+
+	for _, c := range []struct {
+		name    string
+		ct      string
+		body    string
+		want    string
+		warning string
+	}{
+		{"unknown charset", "text/plain; charset=x-klingon", "abc", "abc", `unknown charset "x-klingon"`},
+		{"mislabeled utf-8", "text/plain; charset=utf-8", "caf\xe9", "café", "invalid utf-8 text, decoded as windows-1252"},
+		{"8-bit without charset", "text/plain", "caf\xe9", "café", "8-bit text without a charset"},
+	} {
+		m := mustParse(t, "Content-Type: "+c.ct+"\r\n\r\n"+c.body)
+		if m.Root.Text != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, m.Root.Text, c.want)
+		}
+		if !hasWarning(m.Warnings, "1", c.warning) {
+			t.Errorf("%s: got warnings %v, want one about %q", c.name, m.Warnings, c.warning)
+		}
+	}
+}
+
+func TestBrokenMIMEWarnings(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		raw     string
+		parts   int
+		part    string
+		warning string
+	}{
+		{
+			name:    "boundary guessed",
+			raw:     "Content-Type: multipart/mixed\r\n\r\n--abc\r\n\r\none\r\n--abc\r\n\r\ntwo\r\n--abc--\r\n",
+			parts:   2,
+			warning: `no boundary parameter, using "abc"`,
+		},
+		{
+			name:    "no boundary",
+			raw:     "Content-Type: multipart/mixed\r\n\r\njust text\r\n",
+			warning: "no boundary, treated as text/plain",
+		},
+		{
+			name:    "boundary not found",
+			raw:     "Content-Type: multipart/mixed; boundary=abc\r\n\r\n--xyz\r\n\r\none\r\n",
+			warning: `boundary "abc" not found`,
+		},
+		{
+			name:    "missing closing boundary",
+			raw:     "Content-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\n\r\none\r\n--abc\r\n\r\ntwo\r\n",
+			parts:   2,
+			warning: "missing its closing boundary",
+		},
+		{
+			name:    "invalid Content-Type",
+			raw:     "Content-Type: text\r\n\r\nbody",
+			warning: "invalid Content-Type",
+		},
+		{
+			name:    "bad encoding in a part",
+			raw:     "Content-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\nContent-Transfer-Encoding: base64\r\n\r\nSGk!\r\n--abc--\r\n",
+			parts:   1,
+			part:    "1",
+			warning: "outside the alphabet",
+		},
+	} {
+		m := mustParse(t, c.raw)
+		if len(m.Root.Parts) != c.parts {
+			t.Errorf("%s: got %d parts, want %d", c.name, len(m.Root.Parts), c.parts)
+		}
+		if !hasWarning(m.Warnings, c.part, c.warning) {
+			t.Errorf("%s: got warnings %v, want one about %q", c.name, m.Warnings, c.warning)
+		}
+	}
+
+	// A part without a boundary is still readable as text
+	m := mustParse(t, "Content-Type: multipart/mixed\r\n\r\njust text\r\n")
+	if m.Root.MediaType != "text/plain" || m.Root.Text != "just text\r\n" {
+		t.Errorf("got %q %q", m.Root.MediaType, m.Root.Text)
+	}
+}
@@ -0,0 +1,155 @@
+package mime
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseMediaType parses a Content-Type or Content-Disposition value into a
+// lowercased type and its parameters. Unlike mime.ParseMediaType it accepts
+// unquoted values containing spaces, stray semicolons and duplicate
+// parameters, and decodes RFC 2231 values in any charset as well as RFC 2047
+// encoded words some clients put in filenames.
+func (p *parser) parseMediaType(value, where string) (string, map[string]string) {
+	typ, rest, _ := strings.Cut(value, ";")
+	typ = strings.ToLower(strings.TrimSpace(typ))
+
+	// RFC 2231 sections of one parameter, keyed by name then section number
+	type section struct {
+		n       int
+		value   string
+		encoded bool
+	}
+	sections := map[string][]section{}
+	params := map[string]string{}
+
+	for _, raw := range splitParams(rest) {
+		name, val, ok := strings.Cut(raw, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			if strings.TrimSpace(raw) != "" {
+				p.warn(where, "ignored invalid parameter %q", truncate(strings.TrimSpace(raw), 80))
+			}
+			continue
+		}
+		val = unquote(strings.TrimSpace(val))
+
+		base, sec, isSection := strings.Cut(name, "*")
+		if !isSection {
+			if _, dup := params[name]; dup {
+				p.warn(where, "duplicate parameter %q", name)
+				continue
+			}
+			params[name] = val
+			continue
+		}
+
+		// name*, name*0, name*0*, name*1 ...
+		encoded := strings.HasSuffix(sec, "*") || sec == ""
+		sec = strings.TrimSuffix(sec, "*")
+		n := 0
+		if sec != "" {
+			var err error
+			if n, err = strconv.Atoi(sec); err != nil {
+				p.warn(where, "ignored invalid parameter %q", name)
+				continue
+			}
+		}
+		sections[base] = append(sections[base], section{n: n, value: val, encoded: encoded})
+	}
+
+	for name, secs := range sections {
+		sort.SliceStable(secs, func(i, j int) bool { return secs[i].n < secs[j].n })
+
+		var charset string
+		var buf []byte
+		for i, s := range secs {
+			if s.n != i {
+				p.warn(where, "parameter %q has missing sections", name)
+			}
+			v := s.value
+			if s.encoded {
+				if i == 0 {
+					// charset'language'value
+					parts := strings.SplitN(v, "'", 3)
+					if len(parts) == 3 {
+						charset, v = parts[0], parts[2]
+					}
+				}
+				buf = append(buf, percentDecode(v)...)
+			} else {
+				buf = append(buf, v...)
+			}
+		}
+		// The extended form takes precedence over a plain fallback
+		params[name] = p.toUTF8(buf, charset, where)
+	}
+
+	for _, name := range []string{"name", "filename"} {
+		if v, ok := params[name]; ok && strings.Contains(v, "=?") {
+			params[name] = p.decodeHeader(v, where)
+		}
+	}
+
+	return typ, params
+}
+
+// splitParams splits at semicolons outside quoted strings.
+func splitParams(s string) []string {
+	var parts []string
+	var inQuote bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if inQuote {
+				i++
+			}
+		case '"':
+			inQuote = !inQuote
+		case ';':
+			if !inQuote {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote removes surrounding double quotes and backslash escapes. An
+// unterminated quoted string runs to the end of the value.
+func unquote(s string) string {
+	if !strings.HasPrefix(s, `"`) {
+		return s
+	}
+	s = s[1:]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			break
+		}
+		if c == '\\' && i+1 < len(s) {
+			i++
+			c = s[i]
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// percentDecode decodes %XX escapes, keeping invalid ones literally.
+func percentDecode(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			b = append(b, unhex(s[i+1])<<4|unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
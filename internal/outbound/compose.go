@@ -0,0 +1,313 @@
+package outbound
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxRecipients bounds the To, Cc and Bcc addresses of one message.
+const maxRecipients = 100
+
+// Message is mail to compose and send on a user's behalf. Addresses may
+// carry a display name, as in "Alice <alice@example.org>". InReplyTo is the
+// ID of the stored message being answered; the reply joins its thread.
+type Message struct {
+	To          []string     `json:"to"`
+	Cc          []string     `json:"cc,omitempty"`
+	Bcc         []string     `json:"bcc,omitempty"`
+	Subject     string       `json:"subject"`
+	Text        string       `json:"text,omitempty"`
+	HTML        string       `json:"html,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	InReplyTo   string       `json:"in_reply_to,omitempty"`
+}
+
+// Attachment is a file sent with a message. Content is base64 in JSON; the
+// content type is guessed from the filename when empty.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Content     []byte `json:"content"`
+}
+
+// parent is the message a reply answers.
+type parent struct {
+	messageID  string
+	references []string
+	subject    string
+}
+
+// envelope is a composed message with the addresses it is sent to.
+type envelope struct {
+	raw        []byte
+	messageID  string
+	recipients []string
+}
+
+// Validate reports whether msg can be sent: that its addresses parse and it
+// has recipients and content. Errors wrap ErrInvalidMessage.
+func (msg Message) Validate() error {
+	if _, _, _, err := msg.addresses(); err != nil {
+		return err
+	}
+	for _, a := range msg.Attachments {
+		if _, err := attachmentEntity(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addresses parses and checks the recipients of msg.
+func (msg Message) addresses() (to, cc, bcc []*mail.Address, err error) {
+	if to, err = parseAddresses("to", msg.To); err != nil {
+		return nil, nil, nil, err
+	}
+	if cc, err = parseAddresses("cc", msg.Cc); err != nil {
+		return nil, nil, nil, err
+	}
+	if bcc, err = parseAddresses("bcc", msg.Bcc); err != nil {
+		return nil, nil, nil, err
+	}
+	n := len(to) + len(cc) + len(bcc)
+	switch {
+	case n == 0:
+		return nil, nil, nil, fmt.Errorf("%w: no recipients", ErrInvalidMessage)
+	case n > maxRecipients:
+		return nil, nil, nil, fmt.Errorf("%w: more than %d recipients", ErrInvalidMessage, maxRecipients)
+	case msg.Text == "" && msg.HTML == "" && len(msg.Attachments) == 0:
+		return nil, nil, nil, fmt.Errorf("%w: no text, html or attachments", ErrInvalidMessage)
+	}
+	return to, cc, bcc, nil
+}
+
+// compose validates msg and builds the message from from. Bcc recipients
+// are only in the envelope.
+func compose(from string, msg Message, p *parent, hostname string, now time.Time) (*envelope, error) {
+	to, cc, bcc, err := msg.addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	subject := strings.NewReplacer("\r", "", "\n", " ").Replace(msg.Subject)
+	if subject == "" && p != nil {
+		subject = p.subject
+		if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+			subject = "Re: " + subject
+		}
+	}
+
+	content, err := body(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := hostname
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+	env := &envelope{messageID: uuid.New().String() + "@" + domain}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "From: %s\r\n", (&mail.Address{Address: from}).String())
+	writeAddresses(&b, "To", to)
+	writeAddresses(&b, "Cc", cc)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Message-ID: <%s>\r\n", env.messageID)
+	if p != nil && p.messageID != "" {
+		fmt.Fprintf(&b, "In-Reply-To: <%s>\r\n", p.messageID)
+		refs := append(p.references[:len(p.references):len(p.references)], p.messageID)
+		fmt.Fprintf(&b, "References: <%s>\r\n", strings.Join(refs, ">\r\n <"))
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	writeEntity(&b, content)
+	env.raw = b.Bytes()
+
+	for _, list := range [][]*mail.Address{to, cc, bcc} {
+		for _, a := range list {
+			env.recipients = append(env.recipients, a.Address)
+		}
+	}
+	return env, nil
+}
+
+// removeHeader returns raw without the top-level header fields called
+// name, along with their continuation lines.
+func removeHeader(raw []byte, name string) []byte {
+	var out bytes.Buffer
+	skipping := false
+	for rest := raw; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		switch {
+		case len(bytes.TrimRight(line, "\r\n")) == 0:
+			// The blank line ends the header
+			out.Write(line)
+			out.Write(rest)
+			return out.Bytes()
+		case line[0] == ' ' || line[0] == '\t':
+		default:
+			field, _, _ := bytes.Cut(line, []byte(":"))
+			skipping = strings.EqualFold(strings.TrimSpace(string(field)), name)
+		}
+		if !skipping {
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
+
+func parseAddresses(field string, list []string) ([]*mail.Address, error) {
+	var addrs []*mail.Address
+	for _, s := range list {
+		a, err := mail.ParseAddress(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid %s address %q", ErrInvalidMessage, field, s)
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+func writeAddresses(b *bytes.Buffer, name string, addrs []*mail.Address) {
+	if len(addrs) == 0 {
+		return
+	}
+	list := make([]string, len(addrs))
+	for i, a := range addrs {
+		list[i] = a.String()
+	}
+	fmt.Fprintf(b, "%s: %s\r\n", name, strings.Join(list, ",\r\n "))
+}
+
+// entity is a MIME entity: its content header fields and encoded body.
+type entity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// body builds the MIME structure of msg: its text and HTML as alternatives,
+// followed by any attachments.
+func body(msg Message) (entity, error) {
+	var parts []entity
+	if msg.Text != "" {
+		parts = append(parts, textEntity("text/plain", msg.Text))
+	}
+	if msg.HTML != "" {
+		parts = append(parts, textEntity("text/html", msg.HTML))
+	}
+	var content entity
+	switch len(parts) {
+	case 0:
+		content = textEntity("text/plain", "")
+	case 1:
+		content = parts[0]
+	default:
+		content = multipartEntity("alternative", parts)
+	}
+	if len(msg.Attachments) == 0 {
+		return content, nil
+	}
+
+	parts = []entity{content}
+	for _, a := range msg.Attachments {
+		att, err := attachmentEntity(a)
+		if err != nil {
+			return entity{}, err
+		}
+		parts = append(parts, att)
+	}
+	return multipartEntity("mixed", parts), nil
+}
+
+func textEntity(contentType, text string) entity {
+	var b bytes.Buffer
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(text))
+	w.Close()
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		body: b.Bytes(),
+	}
+}
+
+func multipartEntity(subtype string, parts []entity) entity {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, p := range parts {
+		w, _ := mw.CreatePart(p.header)
+		w.Write(p.body)
+	}
+	mw.Close()
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": mw.Boundary()})},
+		},
+		body: b.Bytes(),
+	}
+}
+
+func attachmentEntity(a Attachment) (entity, error) {
+	name := strings.NewReplacer("\r", "", "\n", "").Replace(filepath.Base(a.Filename))
+	if name == "." || name == string(filepath.Separator) {
+		name = "attachment"
+	}
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return entity{}, fmt.Errorf("%w: invalid content type %q for %s", ErrInvalidMessage, a.ContentType, name)
+	}
+	params["name"] = name
+
+	var b bytes.Buffer
+	enc := base64.StdEncoding.EncodeToString(a.Content)
+	for len(enc) > 76 {
+		b.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc + "\r\n")
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(mediaType, params)},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+			"Content-Transfer-Encoding": {"base64"},
+		},
+		body: b.Bytes(),
+	}, nil
+}
+
+// writeEntity writes the content fields of e, the blank line ending the
+// header section and its body.
+func writeEntity(b *bytes.Buffer, e entity) {
+	for _, name := range []string{"Content-Type", "Content-Disposition", "Content-Transfer-Encoding"} {
+		if v := e.header.Get(name); v != "" {
+			fmt.Fprintf(b, "%s: %s\r\n", name, v)
+		}
+	}
+	b.WriteString("\r\n")
+	b.Write(e.body)
+}
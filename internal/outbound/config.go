@@ -0,0 +1,133 @@
+package outbound
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/parsel-email/mailroom/internal/mailauth"
+)
+
+// TLS modes of the relay connection.
+const (
+	TLSStartTLS = "starttls" // upgrade a plain connection, e.g. on port 587
+	TLSImplicit = "tls"      // connect over TLS, e.g. on port 465
+	TLSNone     = "none"     // only for relays on a trusted network
+)
+
+// DefaultSelector is the DKIM selector used when DKIM_SELECTOR is not set.
+const DefaultSelector = "mailroom"
+
+// ErrRelayNotConfigured is returned by NewMailerFromEnv when SMTP_RELAY_ADDR
+// is not set.
+var ErrRelayNotConfigured = errors.New("SMTP relay is not configured")
+
+// Config describes the submission relay mail is sent through.
+type Config struct {
+	Addr     string // host:port
+	TLS      string // one of the TLS modes
+	Username string // empty skips AUTH
+	Password string
+	Hostname string // the EHLO name, and the domain of Message-IDs
+
+	// TLSConfig verifies the relay; nil verifies it against the system
+	// roots.
+	TLSConfig *tls.Config
+}
+
+// ConfigFromEnv reads the relay configuration from the environment. It
+// returns false when SMTP_RELAY_ADDR is unset and sending is disabled.
+func ConfigFromEnv() (Config, bool, error) {
+	addr := os.Getenv("SMTP_RELAY_ADDR")
+	if addr == "" {
+		return Config{}, false, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return Config{}, false, fmt.Errorf("invalid SMTP_RELAY_ADDR: %w", err)
+	}
+
+	mode := strings.ToLower(os.Getenv("SMTP_RELAY_TLS"))
+	switch mode {
+	case "":
+		mode = TLSStartTLS
+	case TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return Config{}, false, fmt.Errorf("invalid SMTP_RELAY_TLS %q", mode)
+	}
+
+	hostname := os.Getenv("SMTP_DOMAIN")
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	return Config{
+		Addr:     addr,
+		TLS:      mode,
+		Username: os.Getenv("SMTP_RELAY_USERNAME"),
+		Password: os.Getenv("SMTP_RELAY_PASSWORD"),
+		Hostname: hostname,
+	}, true, nil
+}
+
+// LoadSigners reads the DKIM keys in dir, one PEM file per domain named
+// after it, e.g. example.com.pem. All keys are published under selector.
+func LoadSigners(dir, selector string) ([]*mailauth.Signer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var signers []*mailauth.Signer
+	for _, path := range paths {
+		domain := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := readKey(path)
+		if err != nil {
+			return nil, err
+		}
+		s, err := mailauth.NewSigner(domain, selector, key)
+		if err != nil {
+			return nil, fmt.Errorf("DKIM key %s: %w", path, err)
+		}
+		signers = append(signers, s)
+	}
+	return signers, nil
+}
+
+// sealerFromEnv reads the ARC sealing key from the environment. It returns
+// nil if ARC_SEAL_DOMAIN is unset and forwarded mail isn't sealed.
+func sealerFromEnv(resolver mailauth.Resolver) (*mailauth.Sealer, error) {
+	domain := os.Getenv("ARC_SEAL_DOMAIN")
+	if domain == "" {
+		return nil, nil
+	}
+	selector := os.Getenv("ARC_SEAL_SELECTOR")
+	if selector == "" {
+		selector = DefaultSelector
+	}
+	key, err := readKey(os.Getenv("ARC_SEAL_KEY_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := mailauth.NewSealer(resolver, domain, selector, key)
+	if err != nil {
+		return nil, fmt.Errorf("ARC sealing key: %w", err)
+	}
+	return sealer, nil
+}
+
+// readKey reads a PEM-encoded private key file.
+func readKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	key, err := mailauth.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,376 @@
+// Package outbound sends mail on users' behalf through a submission relay.
+// Messages composed from the API are DKIM-signed with the key of the
+// sender's domain, relayed and stored in the user's Sent folder; messages
+// forwarded by rules and Sieve scripts are relayed as they are, with an ARC
+// set added when a sealing key is configured.
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/bounce"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// SentLabel is the label of the copies of the mail users send.
+const SentLabel = labels.Sent
+
+// relayTimeout bounds relaying a single message.
+const relayTimeout = 2 * time.Minute
+
+var (
+	// ErrInvalidMessage is returned for messages that can't be composed.
+	ErrInvalidMessage = errors.New("invalid message")
+	// ErrReplyNotFound is returned when the message being answered doesn't
+	// exist.
+	ErrReplyNotFound = errors.New("message being answered not found")
+	// ErrSuppressed is returned for mail to recipients on the user's
+	// suppression list.
+	ErrSuppressed = errors.New("recipient is suppressed after a bounce")
+	// ErrRelayFailed is returned when the relay doesn't accept a message.
+	// It wraps the relay's *smtp.SMTPError, if it gave one.
+	ErrRelayFailed = errors.New("relay failed")
+)
+
+// Mailer sends mail through the relay. It implements rules.Forwarder and
+// sieve.Sender.
+type Mailer struct {
+	cfg      Config
+	store    *mailstore.Store
+	signers  map[string]*mailauth.Signer // by domain
+	sealer   *mailauth.Sealer            // nil leaves forwarded mail unsealed
+	verifier *mailauth.Verifier          // authenticates forwarded mail for the ARC set
+	now      func() time.Time
+}
+
+// NewMailer creates a Mailer relaying through cfg.Addr and storing sent
+// messages in store. Messages are not signed until signers are added.
+func NewMailer(cfg Config, store *mailstore.Store) *Mailer {
+	return &Mailer{
+		cfg:     cfg,
+		store:   store,
+		signers: map[string]*mailauth.Signer{},
+		now:     time.Now,
+	}
+}
+
+// NewMailerFromEnv creates a Mailer configured from the environment, with
+// the DKIM keys in DKIM_KEY_DIR and the ARC sealing key in
+// ARC_SEAL_KEY_FILE. It returns ErrRelayNotConfigured if SMTP_RELAY_ADDR
+// is not set.
+func NewMailerFromEnv(store *mailstore.Store) (*Mailer, error) {
+	cfg, ok, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrRelayNotConfigured
+	}
+	m := NewMailer(cfg, store)
+
+	if dir := os.Getenv("DKIM_KEY_DIR"); dir != "" {
+		selector := os.Getenv("DKIM_SELECTOR")
+		if selector == "" {
+			selector = DefaultSelector
+		}
+		signers, err := LoadSigners(dir, selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range signers {
+			m.AddSigner(s)
+		}
+	}
+
+	sealer, err := sealerFromEnv(net.DefaultResolver)
+	if err != nil {
+		return nil, err
+	}
+	if sealer != nil {
+		m.SetSealer(sealer, mailauth.NewVerifier(net.DefaultResolver, cfg.Hostname))
+	}
+	return m, nil
+}
+
+// AddSigner makes the Mailer DKIM-sign mail from s's domain with s.
+func (m *Mailer) AddSigner(s *mailauth.Signer) {
+	m.signers[s.Domain()] = s
+}
+
+// SetSealer makes the Mailer add an ARC set to the messages it forwards,
+// recording how v authenticates them.
+func (m *Mailer) SetSealer(s *mailauth.Sealer, v *mailauth.Verifier) {
+	m.sealer, m.verifier = s, v
+}
+
+// Sent is a message that was sent. ID is the stored copy's ID, or empty if
+// the message was relayed but the copy couldn't be stored.
+type Sent struct {
+	ID        string `json:"id,omitempty"`
+	MessageID string `json:"message_id"`
+	ThreadID  string `json:"thread_id,omitempty"`
+}
+
+// Submit composes msg, sends it from userID's address and stores a copy in
+// their Sent folder, in the thread of the message it answers. Nothing is
+// sent if any recipient is suppressed.
+func (m *Mailer) Submit(ctx context.Context, userID string, msg Message) (Sent, error) {
+	q := m.store.DB().Queries()
+	user, err := q.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Sent{}, mailstore.ErrUnknownUser
+		}
+		return Sent{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	var p *parent
+	if msg.InReplyTo != "" {
+		orig, err := q.GetMessage(ctx, schema.GetMessageParams{ID: msg.InReplyTo, UserID: userID})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return Sent{}, ErrReplyNotFound
+			}
+			return Sent{}, fmt.Errorf("failed to get message being answered: %w", err)
+		}
+		p = &parent{
+			messageID:  orig.InternetMessageID,
+			references: strings.Fields(orig.MessageReferences),
+			subject:    orig.Subject,
+		}
+	}
+
+	env, err := compose(user.Email, msg, p, m.cfg.Hostname, m.now())
+	if err != nil {
+		return Sent{}, err
+	}
+	if int64(len(env.raw)) > m.store.MaxMessageSize() {
+		return Sent{}, fmt.Errorf("%w: message is larger than %d bytes", ErrInvalidMessage, m.store.MaxMessageSize())
+	}
+	if err := m.checkSuppressed(ctx, userID, env.recipients); err != nil {
+		return Sent{}, err
+	}
+	raw, err := m.sign(env.raw)
+	if err != nil {
+		return Sent{}, err
+	}
+	if err := m.relay(ctx, user.Email, env.recipients, raw); err != nil {
+		return Sent{}, err
+	}
+
+	sent := Sent{MessageID: env.messageID}
+	sent.ID, err = m.store.Deliver(ctx, mailstore.Delivery{
+		UserID:   userID,
+		Raw:      raw,
+		Outgoing: true,
+		Tx: func(ctx context.Context, q *schema.Queries, id string) error {
+			if err := q.AddMessageLabel(ctx, schema.AddMessageLabelParams{MessageID: id, UserID: userID, Label: SentLabel}); err != nil {
+				return err
+			}
+			if err := q.SetMessageRead(ctx, schema.SetMessageReadParams{IsRead: true, ID: id, UserID: userID}); err != nil {
+				return err
+			}
+			return q.SetMessageArchived(ctx, schema.SetMessageArchivedParams{Archived: true, ID: id, UserID: userID})
+		},
+	})
+	if err != nil {
+		// Sent all the same, so not an error for the caller
+		metrics.Errors.WithLabelValues("outbound_store_sent").Inc()
+		logger.Error(ctx, "Failed to store sent message", "internet_message_id", env.messageID, "error", err)
+		return sent, nil
+	}
+	if stored, err := q.GetMessage(ctx, schema.GetMessageParams{ID: sent.ID, UserID: userID}); err == nil {
+		sent.ThreadID = stored.ThreadID
+	}
+	return sent, nil
+}
+
+// Forward relays a stored message to another address on userID's behalf,
+// sealing it if a sealer is set.
+func (m *Mailer) Forward(ctx context.Context, userID, to string, raw []byte) error {
+	from, err := m.userAddress(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := m.checkSuppressed(ctx, userID, []string{to}); err != nil {
+		return err
+	}
+	if m.sealer != nil {
+		res := m.verifier.Verify(ctx, mailauth.Input{Raw: raw})
+		sealed, err := m.sealer.Seal(ctx, raw, res.String())
+		switch {
+		case err == nil:
+			raw = sealed
+		case errors.Is(err, mailauth.ErrChainFailed) || errors.Is(err, mailauth.ErrTooManyInstances):
+			logger.Warn(ctx, "Forwarding message without an ARC seal", "reason", err)
+		default:
+			return err
+		}
+	}
+	return m.relay(ctx, from, []string{to}, raw)
+}
+
+// Send relays a message composed on userID's behalf, such as a vacation
+// response, signing it if its From domain has a key. Automatic responses
+// are sent with the null reverse path (RFC 3834).
+func (m *Mailer) Send(ctx context.Context, userID, to string, raw []byte) error {
+	from, err := m.userAddress(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := m.checkSuppressed(ctx, userID, []string{to}); err != nil {
+		return err
+	}
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if v := strings.ToLower(strings.TrimSpace(msg.Header.Get("Auto-Submitted"))); v != "" && v != "no" {
+			from = ""
+		}
+	}
+	if raw, err = m.sign(raw); err != nil {
+		return err
+	}
+	return m.relay(ctx, from, []string{to}, raw)
+}
+
+// Relay sends a message the user composed in full, such as one submitted
+// over JMAP, from their address to the given recipients. Bcc fields are
+// removed and the message is signed if its From domain has a key. No copy
+// is stored, as the message already is.
+func (m *Mailer) Relay(ctx context.Context, userID string, to []string, raw []byte) error {
+	from, err := m.userAddress(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if len(to) == 0 {
+		return fmt.Errorf("%w: no recipients", ErrInvalidMessage)
+	}
+	if err := m.checkSuppressed(ctx, userID, to); err != nil {
+		return err
+	}
+	if raw, err = m.sign(removeHeader(raw, "Bcc")); err != nil {
+		return err
+	}
+	return m.relay(ctx, from, to, raw)
+}
+
+func (m *Mailer) userAddress(ctx context.Context, userID string) (string, error) {
+	user, err := m.store.DB().Queries().GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", mailstore.ErrUnknownUser
+		}
+		return "", fmt.Errorf("failed to get user: %w", err)
+	}
+	return user.Email, nil
+}
+
+// checkSuppressed returns an error naming the recipients on userID's
+// suppression list, if there are any.
+func (m *Mailer) checkSuppressed(ctx context.Context, userID string, recipients []string) error {
+	suppressed, err := bounce.Suppressed(ctx, m.store.DB().Queries(), userID, recipients)
+	if err != nil {
+		return err
+	}
+	if len(suppressed) > 0 {
+		return fmt.Errorf("%w: %s", ErrSuppressed, strings.Join(suppressed, ", "))
+	}
+	return nil
+}
+
+// sign adds a DKIM signature to raw if there is a key for its From domain.
+func (m *Mailer) sign(raw []byte) ([]byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return raw, nil
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return raw, nil
+	}
+	_, domain, _ := strings.Cut(from.Address, "@")
+	s := m.signers[strings.ToLower(domain)]
+	if s == nil {
+		return raw, nil
+	}
+	return s.Sign(raw)
+}
+
+// relay sends raw to the recipients through the relay.
+func (m *Mailer) relay(ctx context.Context, from string, to []string, raw []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, relayTimeout)
+	defer cancel()
+
+	err := m.send(ctx, from, to, raw)
+	if err != nil {
+		metrics.Errors.WithLabelValues("outbound_relay").Inc()
+		return fmt.Errorf("%w: %w", ErrRelayFailed, err)
+	}
+	return nil
+}
+
+func (m *Mailer) send(ctx context.Context, from string, to []string, raw []byte) error {
+	host, _, _ := net.SplitHostPort(m.cfg.Addr)
+	tlsConfig := m.cfg.TLSConfig.Clone()
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var c *smtp.Client
+	switch m.cfg.TLS {
+	case TLSImplicit:
+		c = smtp.NewClient(tls.Client(conn, tlsConfig))
+	case TLSNone:
+		c = smtp.NewClient(conn)
+	default:
+		// The client greets the relay as localhost before STARTTLS
+		if c, err = smtp.NewClientStartTLS(conn, tlsConfig); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	defer c.Close()
+	if m.cfg.TLS == TLSImplicit || m.cfg.TLS == TLSNone {
+		if err := c.Hello(m.cfg.Hostname); err != nil {
+			return err
+		}
+	}
+
+	if m.cfg.Username != "" {
+		if err := c.Auth(sasl.NewPlainClient("", m.cfg.Username, m.cfg.Password)); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(from, to, bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,408 @@
+package outbound
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// relayed is a message the fake relay accepted.
+type relayed struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+}
+
+// fakeRelay is an in-process submission server that requires STARTTLS and
+// AUTH PLAIN as alice/secret, and rejects mail to reject@example.net.
+type fakeRelay struct {
+	addr   string
+	certs  *x509.CertPool
+	mu     sync.Mutex
+	mail   []relayed
+	server *smtp.Server
+}
+
+func newFakeRelay(t *testing.T) *fakeRelay {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRelay{certs: x509.NewCertPool()}
+	r.certs.AddCert(cert)
+	r.server = smtp.NewServer(r)
+	r.server.Domain = "relay.example.net"
+	r.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.addr = ln.Addr().String()
+	go r.server.Serve(ln)
+	t.Cleanup(func() { r.server.Close() })
+	return r
+}
+
+func (r *fakeRelay) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	_, tls := c.TLSConnectionState()
+	return &relaySession{relay: r, msg: relayed{tls: tls}}, nil
+}
+
+func (r *fakeRelay) received() []relayed {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]relayed(nil), r.mail...)
+}
+
+type relaySession struct {
+	relay  *fakeRelay
+	authed bool
+	msg    relayed
+}
+
+func (s *relaySession) AuthMechanisms() []string { return []string{sasl.Plain} }
+
+func (s *relaySession) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if username != "alice" || password != "secret" {
+			return smtp.ErrAuthFailed
+		}
+		s.authed = true
+		return nil
+	}), nil
+}
+
+func (s *relaySession) Mail(from string, _ *smtp.MailOptions) error {
+	if !s.authed {
+		return smtp.ErrAuthRequired
+	}
+	s.msg.from = from
+	return nil
+}
+
+func (s *relaySession) Rcpt(to string, _ *smtp.RcptOptions) error {
+	if to == "reject@example.net" {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	s.msg.to = append(s.msg.to, to)
+	return nil
+}
+
+func (s *relaySession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.data = string(data)
+	s.relay.mu.Lock()
+	s.relay.mail = append(s.relay.mail, s.msg)
+	s.relay.mu.Unlock()
+	return nil
+}
+
+func (s *relaySession) Reset()        { s.msg = relayed{tls: s.msg.tls} }
+func (s *relaySession) Logout() error { return nil }
+
+// newTestMailer returns a Mailer sending through a fake relay for u1
+// (user@example.com), signing mail from example.com.
+func newTestMailer(t *testing.T) (*Mailer, *fakeRelay, database.Service, mailauth.Zone) {
+	t.Helper()
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+
+	relay := newFakeRelay(t)
+	m := NewMailer(Config{
+		Addr:      relay.addr,
+		TLS:       TLSStartTLS,
+		Username:  "alice",
+		Password:  "secret",
+		Hostname:  "mail.example.com",
+		TLSConfig: &tls.Config{RootCAs: relay.certs},
+	}, store)
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := mailauth.NewSigner("example.com", "mailroom", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AddSigner(signer)
+	zone := mailauth.Zone{TXT: map[string][]string{
+		"mailroom._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}}
+	return m, relay, db, zone
+}
+
+func TestSubmit(t *testing.T) {
+	m, relay, db, zone := newTestMailer(t)
+	ctx := context.Background()
+
+	sent, err := m.Submit(ctx, "u1", Message{
+		To:      []string{"Bob <bob@example.net>"},
+		Cc:      []string{"carol@example.net"},
+		Bcc:     []string{"dave@example.net"},
+		Subject: "Quarterly numbers ✓",
+		Text:    "See attached.\n",
+		HTML:    "<p>See attached.</p>",
+		Attachments: []Attachment{
+			{Filename: "numbers.csv", Content: []byte("a,b\n1,2\n")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.ID == "" || sent.ThreadID == "" || !strings.HasSuffix(sent.MessageID, "@example.com") {
+		t.Errorf("got %+v", sent)
+	}
+
+	got := relay.received()
+	if len(got) != 1 {
+		t.Fatalf("relay got %d messages", len(got))
+	}
+	msg := got[0]
+	if !msg.tls || msg.from != "user@example.com" || strings.Join(msg.to, ",") != "bob@example.net,carol@example.net,dave@example.net" {
+		t.Errorf("got envelope %+v", msg)
+	}
+	for _, want := range []string{
+		"From: <user@example.com>\r\n",
+		"To: \"Bob\" <bob@example.net>\r\n",
+		"Cc: <carol@example.net>\r\n",
+		"Subject: =?utf-8?q?Quarterly_numbers_=E2=9C=93?=\r\n",
+		"Content-Type: multipart/mixed;",
+		"Content-Type: multipart/alternative;",
+		"Content-Type: text/html; charset=utf-8",
+		"Content-Disposition: attachment; filename=numbers.csv",
+		base64.StdEncoding.EncodeToString([]byte("a,b\n1,2\n")),
+	} {
+		if !strings.Contains(msg.data, want) {
+			t.Errorf("message does not contain %q:\n%s", want, msg.data)
+		}
+	}
+	if strings.Contains(msg.data, "dave@") {
+		t.Errorf("message names the Bcc recipient:\n%s", msg.data)
+	}
+	if res := mailauth.NewVerifier(zone, "mx.example.net").Verify(ctx, mailauth.Input{Raw: []byte(msg.data)}); res.DKIMVerdict() != mailauth.ResultPass {
+		t.Errorf("got DKIM %+v", res.DKIM)
+	}
+
+	// The copy is in the Sent folder, read and out of the inbox
+	stored, err := db.Queries().GetMessage(ctx, schema.GetMessageParams{ID: sent.ID, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := db.Queries().ListMessageLabels(ctx, sent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.IsRead || !stored.Archived || len(labels) != 1 || labels[0] != SentLabel || stored.InternetMessageID != sent.MessageID {
+		t.Errorf("stored %+v with labels %v", stored, labels)
+	}
+}
+
+func TestSubmitReply(t *testing.T) {
+	m, relay, db, _ := newTestMailer(t)
+	ctx := context.Background()
+
+	origID, err := m.store.Deliver(ctx, mailstore.Delivery{
+		UserID: "u1",
+		Raw: []byte("From: bob@example.net\r\nTo: user@example.com\r\nSubject: Lunch?\r\n" +
+			"Message-ID: <lunch-2@example.net>\r\nReferences: <lunch-1@example.net>\r\n\r\nNoon?\r\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := db.Queries().GetMessage(ctx, schema.GetMessageParams{ID: origID, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err := m.Submit(ctx, "u1", Message{To: []string{"bob@example.net"}, Text: "Sure.", InReplyTo: origID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.ThreadID != orig.ThreadID {
+		t.Errorf("reply is in thread %s, want %s", sent.ThreadID, orig.ThreadID)
+	}
+	data := relay.received()[0].data
+	for _, want := range []string{
+		"Subject: Re: Lunch?\r\n",
+		"In-Reply-To: <lunch-2@example.net>\r\n",
+		"References: <lunch-1@example.net>\r\n <lunch-2@example.net>\r\n",
+	} {
+		if !strings.Contains(data, want) {
+			t.Errorf("reply does not contain %q:\n%s", want, data)
+		}
+	}
+
+	if _, err := m.Submit(ctx, "u1", Message{To: []string{"bob@example.net"}, Text: "Hi", InReplyTo: "missing"}); !errors.Is(err, ErrReplyNotFound) {
+		t.Errorf("reply to a missing message: got %v", err)
+	}
+}
+
+func TestSubmitErrors(t *testing.T) {
+	m, relay, db, _ := newTestMailer(t)
+	ctx := context.Background()
+
+	for name, msg := range map[string]Message{
+		"no recipients": {Text: "Hi"},
+		"bad address":   {To: []string{"not an address"}, Text: "Hi"},
+		"no content":    {To: []string{"bob@example.net"}},
+		"bad type":      {To: []string{"bob@example.net"}, Attachments: []Attachment{{Filename: "a", ContentType: "text/"}}},
+	} {
+		if _, err := m.Submit(ctx, "u1", msg); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrInvalidMessage)
+		}
+	}
+
+	// A rejected recipient fails the whole message, which isn't stored
+	_, err := m.Submit(ctx, "u1", Message{To: []string{"bob@example.net", "reject@example.net"}, Text: "Hi"})
+	var smtpErr *smtp.SMTPError
+	if !errors.Is(err, ErrRelayFailed) || !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("rejected recipient: got %v", err)
+	}
+	// Suppressed recipients aren't sent to, by any path
+	err = db.Queries().UpsertSuppression(ctx, schema.UpsertSuppressionParams{UserID: "u1", Address: "gone@example.net", Status: "5.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Submit(ctx, "u1", Message{To: []string{"bob@example.net"}, Bcc: []string{"Gone@example.net"}, Text: "Hi"}); !errors.Is(err, ErrSuppressed) {
+		t.Errorf("suppressed recipient: got %v, want %v", err, ErrSuppressed)
+	}
+	if err := m.Forward(ctx, "u1", "gone@example.net", []byte("Subject: Hi\r\n\r\nHi\r\n")); !errors.Is(err, ErrSuppressed) {
+		t.Errorf("forward to a suppressed recipient: got %v, want %v", err, ErrSuppressed)
+	}
+
+	m.cfg.Password = "wrong"
+	if _, err := m.Submit(ctx, "u1", Message{To: []string{"bob@example.net"}, Text: "Hi"}); !errors.Is(err, ErrRelayFailed) {
+		t.Errorf("bad credentials: got %v", err)
+	}
+	var n int
+	if err := db.DB().QueryRow(`SELECT COUNT(*) FROM message`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || len(relay.received()) != 0 {
+		t.Errorf("stored %d and relayed %d failed messages", n, len(relay.received()))
+	}
+}
+
+func TestForwardAndSend(t *testing.T) {
+	m, relay, _, zone := newTestMailer(t)
+	ctx := context.Background()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone.TXT["arc._domainkey.example.com"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}
+	sealer, err := mailauth.NewSealer(zone, "example.com", "arc", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetSealer(sealer, mailauth.NewVerifier(zone, "mail.example.com"))
+
+	raw := []byte("From: bob@example.net\r\nTo: user@example.com\r\nSubject: Hi\r\n\r\nHello\r\n")
+	if err := m.Forward(ctx, "u1", "user@example.org", raw); err != nil {
+		t.Fatal(err)
+	}
+	vacation := []byte("From: <user@example.com>\r\nTo: <bob@example.net>\r\nSubject: Away\r\nAuto-Submitted: auto-replied\r\n\r\nBack Monday\r\n")
+	if err := m.Send(ctx, "u1", "bob@example.net", vacation); err != nil {
+		t.Fatal(err)
+	}
+
+	got := relay.received()
+	if len(got) != 2 {
+		t.Fatalf("relay got %d messages", len(got))
+	}
+	fwd := got[0]
+	if fwd.from != "user@example.com" || fwd.to[0] != "user@example.org" {
+		t.Errorf("forward envelope: got %+v", fwd)
+	}
+	res := mailauth.NewVerifier(zone, "mx.example.org").Verify(ctx, mailauth.Input{Raw: []byte(fwd.data)})
+	if res.ARC.Result != mailauth.ResultPass || res.ARC.Sealers[0] != "example.com" {
+		t.Errorf("forward ARC: got %+v\n%s", res.ARC, fwd.data)
+	}
+	if !strings.Contains(fwd.data, "ARC-Authentication-Results: i=1; mail.example.com;") {
+		t.Errorf("forward lacks our results:\n%s", fwd.data)
+	}
+
+	auto := got[1]
+	if auto.from != "" || !strings.HasPrefix(auto.data, "DKIM-Signature: ") {
+		t.Errorf("vacation response: got %+v", auto)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	m, relay, _, _ := newTestMailer(t)
+	ctx := context.Background()
+
+	raw := []byte("From: user@example.com\r\nTo: bob@example.net\r\nBcc: carol@example.net,\r\n dave@example.net\r\n" +
+		"Subject: Hi\r\n\r\nBcc: in the body\r\n")
+	if err := m.Relay(ctx, "u1", []string{"bob@example.net", "carol@example.net"}, raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Relay(ctx, "u1", nil, raw); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("without recipients: got %v", err)
+	}
+
+	got := relay.received()
+	if len(got) != 1 {
+		t.Fatalf("relay got %d messages", len(got))
+	}
+	if got[0].from != "user@example.com" || len(got[0].to) != 2 {
+		t.Errorf("envelope: got %+v", got[0])
+	}
+	if strings.Contains(got[0].data, "dave@") || !strings.Contains(got[0].data, "\r\n\r\nBcc: in the body") {
+		t.Errorf("Bcc not removed from the header alone:\n%s", got[0].data)
+	}
+	if !strings.HasPrefix(got[0].data, "DKIM-Signature: ") {
+		t.Errorf("message not signed:\n%s", got[0].data)
+	}
+}
@@ -0,0 +1,29 @@
+package push
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mailroom_push_connections",
+		Help: "Open WebSocket push connections.",
+	})
+
+	messages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailroom_push_messages_total",
+		Help: "WebSocket push messages by direction (received or sent) and type.",
+	}, []string{"direction", "type"})
+)
+
+// countReceived counts a message from a client. Types clients made up are
+// counted together, so that they can't add series.
+func countReceived(typ string) {
+	switch typ {
+	case typeAuth, typeSubscribe, typeUnsubscribe:
+	default:
+		typ = "unknown"
+	}
+	messages.WithLabelValues("received", typ).Inc()
+}
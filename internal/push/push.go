@@ -0,0 +1,331 @@
+// Package push notifies WebSocket clients of changes to users' messages as
+// they happen. A client signs in with its JWT and subscribes to labels,
+// threads or search queries. For each change to a message one of its
+// subscriptions covers, it is sent the change and a summary of the
+// message, then the subscription's new counts. Changes are read from the
+// change log, which is polled, as they can be made by other instances.
+//
+// Messages both ways are JSON objects with a type. A client sends:
+//
+//	{"type": "auth", "token": "<JWT>"}
+//	{"type": "subscribe", "id": "s1", "label": "Inbox"}
+//	{"type": "subscribe", "id": "s2", "thread": "<thread ID>"}
+//	{"type": "subscribe", "id": "s3", "query": "from:alice invoice"}
+//	{"type": "unsubscribe", "id": "s1"}
+//
+// auth comes first, unless the upgrade request had an Authorization header.
+// Subscription IDs are the client's own; subscribing again under an ID
+// replaces the subscription. The server sends "ready" once the client is
+// signed in, "subscribed" and "unsubscribed" in answer, "change" and
+// "summary" as messages change, "ping" while nothing does and "error" for
+// requests that failed.
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/changelog"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/search"
+	"golang.org/x/net/websocket"
+)
+
+// Message types.
+const (
+	typeAuth         = "auth"
+	typeSubscribe    = "subscribe"
+	typeUnsubscribe  = "unsubscribe"
+	typeReady        = "ready"
+	typeSubscribed   = "subscribed"
+	typeUnsubscribed = "unsubscribed"
+	typeChange       = "change"
+	typeSummary      = "summary"
+	typePing         = "ping"
+	typeError        = "error"
+)
+
+const (
+	// authTimeout is how long a client has to authenticate once connected.
+	authTimeout = 10 * time.Second
+	// writeTimeout bounds sending one message to a client.
+	writeTimeout = 10 * time.Second
+	// pingInterval is how often an idle connection gets a ping, so that
+	// proxies keep it open and a gone client is noticed.
+	pingInterval = 30 * time.Second
+	// maxMessageSize bounds the messages clients send.
+	maxMessageSize = 64 << 10
+	// pageSize bounds the changes read from the change log at once.
+	pageSize = 500
+)
+
+// clientMessage is a message from a client.
+type clientMessage struct {
+	Type   string `json:"type"`
+	Token  string `json:"token,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Label  string `json:"label,omitempty"`
+	Thread string `json:"thread,omitempty"`
+	Query  string `json:"query,omitempty"`
+}
+
+// serverMessage is a message to a client. Matches, on a change, tells
+// whether the message is covered by the subscription after the change; a
+// message that stops being covered is sent one last change.
+type serverMessage struct {
+	Type         string           `json:"type"`
+	Subscription string           `json:"subscription,omitempty"`
+	Event        *changelog.Event `json:"event,omitempty"`
+	Matches      *bool            `json:"matches,omitempty"`
+	Message      *Message         `json:"message,omitempty"`
+	Summary      *Summary         `json:"summary,omitempty"`
+	Error        *Error           `json:"error,omitempty"`
+}
+
+// Error is a failed request, with a machine-readable code.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Server serves WebSocket push connections.
+type Server struct {
+	db      database.Service
+	changes *changelog.Service
+	labels  *labels.Service
+	search  *search.Searcher
+
+	// pollInterval is how often connections look for changes.
+	pollInterval time.Duration
+}
+
+// New creates a Server.
+func New(db database.Service) *Server {
+	return &Server{
+		db:           db,
+		changes:      changelog.New(db),
+		labels:       labels.New(db),
+		search:       search.New(db),
+		pollInterval: changelog.DefaultPollInterval,
+	}
+}
+
+// SetPollInterval changes how often connections look for changes.
+func (s *Server) SetPollInterval(d time.Duration) {
+	s.pollInterval = d
+}
+
+// Handler returns the WebSocket endpoint. Connections are accepted from any
+// origin, as clients authenticate with tokens rather than cookies.
+func (s *Server) Handler() http.Handler {
+	return websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   s.serve,
+	}
+}
+
+// conn is one client connection.
+type conn struct {
+	s      *Server
+	ws     *websocket.Conn
+	ctx    context.Context
+	userID string
+	subs   []*subscription
+}
+
+func (s *Server) serve(ws *websocket.Conn) {
+	connections.Inc()
+	defer connections.Dec()
+	ws.MaxPayloadBytes = maxMessageSize
+
+	// The connection was taken over with the deadlines the HTTP server set
+	// for ordinary requests
+	if err := ws.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+	// The connection closes when the request's context is cancelled, as
+	// when the server shuts down
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+	c := &conn{s: s, ws: ws, ctx: ctx}
+
+	expires, ok := c.authenticate()
+	if !ok {
+		return
+	}
+	after, err := s.changes.Last(ctx, c.userID)
+	if err != nil {
+		c.logError("push_changes", "Failed to get last change", err)
+		return
+	}
+	if !c.send(serverMessage{Type: typeReady}) {
+		return
+	}
+
+	// Messages are read on their own goroutine, and the connection closes
+	// when reading fails
+	incoming := make(chan []byte)
+	go func() {
+		defer cancel()
+		for {
+			var data []byte
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				return
+			}
+			select {
+			case incoming <- data:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	poll := time.NewTicker(s.pollInterval)
+	defer poll.Stop()
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	var expired <-chan time.Time
+	if !expires.IsZero() {
+		t := time.NewTimer(time.Until(expires))
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case data := <-incoming:
+			if !c.handle(data) {
+				return
+			}
+		case <-poll.C:
+			if after, ok = c.poll(after); !ok {
+				return
+			}
+		case <-ping.C:
+			if !c.send(serverMessage{Type: typePing}) {
+				return
+			}
+		case <-expired:
+			// The client reconnects with a fresh token
+			c.sendError("", "token_expired", "Token has expired")
+			return
+		}
+	}
+}
+
+// authenticate signs the client in with the token of the upgrade request or
+// of its first message, and returns when the token expires.
+func (c *conn) authenticate() (time.Time, bool) {
+	token := c.ws.Request().Header.Get("Authorization")
+	if token == "" {
+		if err := c.ws.SetReadDeadline(time.Now().Add(authTimeout)); err != nil {
+			return time.Time{}, false
+		}
+		var data []byte
+		if err := websocket.Message.Receive(c.ws, &data); err != nil {
+			return time.Time{}, false
+		}
+		if err := c.ws.SetReadDeadline(time.Time{}); err != nil {
+			return time.Time{}, false
+		}
+		var m clientMessage
+		if err := json.Unmarshal(data, &m); err != nil || m.Type != typeAuth {
+			c.sendError("", "unauthorized", "The first message must be auth")
+			return time.Time{}, false
+		}
+		countReceived(m.Type)
+		token = m.Token
+	}
+
+	userID, err := auth.GetIDFromJWT(token)
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		c.sendError("", "invalid_token", "Failed to get user ID from token")
+		return time.Time{}, false
+	}
+	c.userID = userID
+
+	// Tokens without an expiry are good for as long as the connection lasts
+	var expires time.Time
+	if t, err := auth.ParseToken(token); err == nil {
+		if claims, ok := t.Claims.(jwt.MapClaims); ok {
+			if exp, ok := claims["exp"].(float64); ok {
+				expires = time.Unix(int64(exp), 0)
+			}
+		}
+	}
+	return expires, true
+}
+
+// handle answers a message from the client. It returns false if the
+// connection should close.
+func (c *conn) handle(data []byte) bool {
+	var m clientMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		countReceived("")
+		return c.sendError("", "invalid_message", "Messages must be JSON objects with a type")
+	}
+	countReceived(m.Type)
+
+	switch m.Type {
+	case typeSubscribe:
+		return c.subscribe(m)
+	case typeUnsubscribe:
+		for i, sub := range c.subs {
+			if sub.id == m.ID {
+				c.subs = append(c.subs[:i], c.subs[i+1:]...)
+				return c.send(serverMessage{Type: typeUnsubscribed, Subscription: m.ID})
+			}
+		}
+		return c.sendError(m.ID, "not_found", "No such subscription")
+	case typeAuth:
+		return c.sendError("", "invalid_message", "Already authenticated")
+	}
+	return c.sendError("", "invalid_message", "Unknown message type")
+}
+
+// send sends m to the client, reporting whether it could.
+func (c *conn) send(m serverMessage) bool {
+	if err := c.ws.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return false
+	}
+	if err := websocket.JSON.Send(c.ws, m); err != nil {
+		return false
+	}
+	messages.WithLabelValues("sent", m.Type).Inc()
+	return true
+}
+
+func (c *conn) sendError(subscription, code, message string) bool {
+	return c.send(serverMessage{Type: typeError, Subscription: subscription, Error: &Error{Code: code, Message: message}})
+}
+
+// poll sends the changes made after the one with ID after, and returns the
+// ID of the last one sent. It returns false if the connection should
+// close.
+func (c *conn) poll(after int64) (int64, bool) {
+	for {
+		events, err := c.s.changes.List(c.ctx, c.userID, after, pageSize)
+		if err != nil {
+			c.logError("push_changes", "Failed to list changes", err)
+			return after, false
+		}
+		if len(events) == 0 {
+			return after, true
+		}
+		if !c.notify(events) {
+			return after, false
+		}
+		after = events[len(events)-1].ID
+		if len(events) < pageSize {
+			return after, true
+		}
+	}
+}
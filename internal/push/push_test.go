@@ -0,0 +1,225 @@
+package push
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"golang.org/x/net/websocket"
+)
+
+const testSecret = "test-secret"
+
+type testServer struct {
+	url   string
+	db    database.Service
+	store *mailstore.Store
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	t.Setenv("AUTH_SECRET", testSecret)
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(db)
+	s.SetPollInterval(10 * time.Millisecond)
+	hs := httptest.NewServer(s.Handler())
+	t.Cleanup(hs.Close)
+	return &testServer{url: "ws" + strings.TrimPrefix(hs.URL, "http"), db: db, store: mailstore.New(db, blobstore.New(db, fsb))}
+}
+
+func token(t *testing.T, userID string, ttl time.Duration) string {
+	t.Helper()
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"ID":  userID,
+		"exp": time.Now().Add(ttl).Unix(),
+	}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+// dial connects, with the token in the upgrade request if header is set.
+func (ts *testServer) dial(t *testing.T, header string) *websocket.Conn {
+	t.Helper()
+	config, err := websocket.NewConfig(ts.url, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != "" {
+		config.Header.Set("Authorization", header)
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func send(t *testing.T, ws *websocket.Conn, m clientMessage) {
+	t.Helper()
+	if err := websocket.JSON.Send(ws, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next returns the next message other than a ping.
+func next(t *testing.T, ws *websocket.Conn) serverMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var m serverMessage
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Fatalf("no message: %v", err)
+		}
+		if m.Type != typePing {
+			return m
+		}
+	}
+}
+
+func (ts *testServer) deliver(t *testing.T, subject string) string {
+	t.Helper()
+	raw := "From: alice@example.org\r\nTo: user@example.com\r\nSubject: " + subject + "\r\n\r\nHi.\r\n"
+	id, err := ts.store.Deliver(context.Background(), mailstore.Delivery{UserID: "u1", Raw: []byte(raw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestAuthenticate(t *testing.T) {
+	ts := newTestServer(t)
+
+	ws := ts.dial(t, "")
+	send(t, ws, clientMessage{Type: typeAuth, Token: "nope"})
+	if m := next(t, ws); m.Type != typeError || m.Error.Code != "invalid_token" {
+		t.Errorf("got %+v, want invalid_token", m)
+	}
+
+	ws = ts.dial(t, "")
+	send(t, ws, clientMessage{Type: typeSubscribe, ID: "s", Label: "Inbox"})
+	if m := next(t, ws); m.Type != typeError || m.Error.Code != "unauthorized" {
+		t.Errorf("got %+v before auth, want unauthorized", m)
+	}
+
+	ws = ts.dial(t, "Bearer "+token(t, "u1", time.Hour))
+	if m := next(t, ws); m.Type != typeReady {
+		t.Errorf("got %+v, want ready", m)
+	}
+
+	// The connection closes when the token expires
+	ws = ts.dial(t, "")
+	send(t, ws, clientMessage{Type: typeAuth, Token: token(t, "u1", 2*time.Second)})
+	if m := next(t, ws); m.Type != typeReady {
+		t.Fatalf("got %+v, want ready", m)
+	}
+	if m := next(t, ws); m.Type != typeError || m.Error.Code != "token_expired" {
+		t.Errorf("got %+v, want token_expired", m)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	first := ts.deliver(t, "Invoice 1")
+	msg, err := ts.db.Queries().GetMessage(ctx, schema.GetMessageParams{ID: first, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws := ts.dial(t, "")
+	send(t, ws, clientMessage{Type: typeAuth, Token: token(t, "u1", time.Hour)})
+	if m := next(t, ws); m.Type != typeReady {
+		t.Fatalf("got %+v, want ready", m)
+	}
+	for _, c := range []struct {
+		m    clientMessage
+		want string
+	}{
+		{clientMessage{Type: typeSubscribe, ID: "inbox", Label: "inbox"}, typeSubscribed},
+		{clientMessage{Type: typeSubscribe, ID: "thread", Thread: msg.ThreadID}, typeSubscribed},
+		{clientMessage{Type: typeSubscribe, ID: "search", Query: "invoice"}, typeSubscribed},
+		{clientMessage{Type: typeSubscribe, ID: "trash", Label: "Trash"}, typeSubscribed},
+		{clientMessage{Type: typeSubscribe, ID: "x", Label: "Missing"}, "not_found"},
+		{clientMessage{Type: typeSubscribe, ID: "x", Query: "-"}, "invalid_query"},
+		{clientMessage{Type: typeSubscribe, ID: "x", Label: "Inbox", Query: "a"}, "invalid_subscription"},
+		{clientMessage{Type: typeSubscribe, ID: "x", Thread: "missing"}, "not_found"},
+		{clientMessage{Type: "hello"}, "invalid_message"},
+	} {
+		send(t, ws, c.m)
+		m := next(t, ws)
+		got := m.Type
+		if m.Error != nil {
+			got = m.Error.Code
+		}
+		if got != c.want {
+			t.Errorf("%+v got %+v, want %s", c.m, m, c.want)
+		}
+		if m.Type == typeSubscribed && (m.Summary.Total == 1) != (m.Subscription != "trash") {
+			t.Errorf("%s starts with %+v", m.Subscription, m.Summary)
+		}
+	}
+	send(t, ws, clientMessage{Type: typeUnsubscribe, ID: "trash"})
+	if m := next(t, ws); m.Type != typeUnsubscribed || m.Subscription != "trash" {
+		t.Errorf("got %+v, want unsubscribed", m)
+	}
+
+	// A new message is in the Inbox and matches the search, and then each
+	// subscription it changed gets its counts
+	second := ts.deliver(t, "Invoice 2")
+	changed := map[string]bool{}
+	for len(changed) < 2 {
+		m := next(t, ws)
+		if m.Type != typeChange {
+			t.Fatalf("got %+v, want a change", m)
+		}
+		if m.Message == nil || m.Message.ID != second || !*m.Matches || m.Message.Subject != "Invoice 2" {
+			t.Errorf("got %+v, want the new message", m)
+		}
+		changed[m.Subscription] = true
+	}
+	if !changed["inbox"] || !changed["search"] {
+		t.Errorf("got changes for %v, want inbox and search", changed)
+	}
+	for range 2 {
+		m := next(t, ws)
+		if m.Type != typeSummary || m.Summary.Total != 2 || (m.Subscription == "inbox") != (m.Summary.Unread != nil) {
+			t.Errorf("got %+v, want a summary of 2 messages", m)
+		}
+	}
+
+	// Moving the first message to Trash takes it out of the Inbox
+	if err := labels.New(ts.db).Modify(ctx, "u1", []string{first}, []string{"trash"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m := next(t, ws)
+		if m.Type == typeSummary {
+			break
+		}
+		if m.Type != typeChange || m.Message.ID != first {
+			t.Fatalf("got %+v, want a change to %s", m, first)
+		}
+		if m.Subscription == "inbox" && *m.Matches {
+			t.Errorf("message moved to Trash still in the Inbox: %+v", m)
+		}
+		if m.Subscription != "inbox" && !*m.Matches {
+			t.Errorf("got %+v, want the message still in %s", m, m.Subscription)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package push
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/changelog"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/search"
+)
+
+const (
+	// maxSubscriptions bounds the subscriptions of one connection.
+	maxSubscriptions = 100
+	// maxQueryTotal bounds the messages counted for a search subscription's
+	// summary.
+	maxQueryTotal = 1000
+)
+
+// subscription is what a client watches: a label, a thread or the results
+// of a search.
+type subscription struct {
+	id string
+
+	label   string // path
+	labelID string
+	thread  string
+	query   *search.Query
+
+	// members are the messages the client was last told are covered, so
+	// that it hears when they stop being.
+	members map[string]bool
+}
+
+// Message summarizes a message for a client. Labels include Inbox or
+// Archive where the message is in them.
+type Message struct {
+	ID             string    `json:"id"`
+	ThreadID       string    `json:"thread_id"`
+	Subject        string    `json:"subject"`
+	FromName       string    `json:"from_name"`
+	FromAddress    string    `json:"from_address"`
+	ReceivedAt     time.Time `json:"received_at"`
+	HasAttachments bool      `json:"has_attachments"`
+	Read           bool      `json:"read"`
+	Starred        bool      `json:"starred"`
+	Labels         []string  `json:"labels"`
+}
+
+// Summary is the number of messages a subscription covers, and of those the
+// number unread. Search subscriptions count up to 1000 messages and leave
+// out the unread count.
+type Summary struct {
+	Total  int64  `json:"total"`
+	Unread *int64 `json:"unread,omitempty"`
+}
+
+// subscribe answers a subscribe message.
+func (c *conn) subscribe(m clientMessage) bool {
+	if m.ID == "" {
+		return c.sendError("", "invalid_subscription", "Subscriptions need an id")
+	}
+	set := 0
+	for _, v := range []string{m.Label, m.Thread, m.Query} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return c.sendError(m.ID, "invalid_subscription", "Subscribe to one of a label, a thread or a query")
+	}
+
+	sub := &subscription{id: m.ID, members: map[string]bool{}}
+	switch {
+	case m.Label != "":
+		path, err := labels.Canonical(m.Label)
+		if err != nil {
+			return c.sendError(m.ID, "invalid_subscription", err.Error())
+		}
+		list, err := c.s.labels.List(c.ctx, c.userID)
+		if err != nil {
+			return c.internalError("push_subscribe", "Failed to list labels", err)
+		}
+		for _, l := range list {
+			if l.Path == path {
+				sub.label, sub.labelID = path, l.ID
+			}
+		}
+		if sub.labelID == "" {
+			return c.sendError(m.ID, "not_found", "Label not found")
+		}
+	case m.Thread != "":
+		_, err := c.s.db.Queries().GetThread(c.ctx, schema.GetThreadParams{ID: m.Thread, UserID: c.userID})
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.sendError(m.ID, "not_found", "Thread not found")
+		}
+		if err != nil {
+			return c.internalError("push_subscribe", "Failed to get thread", err)
+		}
+		sub.thread = m.Thread
+	default:
+		q, err := search.ParseQuery(m.Query)
+		if err != nil {
+			return c.sendError(m.ID, "invalid_query", err.Error())
+		}
+		sub.query = &q
+	}
+
+	i := slices.IndexFunc(c.subs, func(s *subscription) bool { return s.id == m.ID })
+	if i < 0 && len(c.subs) >= maxSubscriptions {
+		return c.sendError(m.ID, "too_many_subscriptions", "A connection can have at most 100 subscriptions")
+	}
+	summary, err := c.summarize(sub)
+	if err != nil {
+		return c.internalError("push_subscribe", "Failed to summarize subscription", err)
+	}
+	if i < 0 {
+		c.subs = append(c.subs, sub)
+	} else {
+		c.subs[i] = sub
+	}
+	return c.send(serverMessage{Type: typeSubscribed, Subscription: sub.id, Summary: &summary})
+}
+
+// summarize counts the messages sub covers.
+func (c *conn) summarize(sub *subscription) (Summary, error) {
+	switch {
+	case sub.labelID != "":
+		l, err := c.s.labels.Get(c.ctx, c.userID, sub.labelID)
+		if errors.Is(err, labels.ErrLabelNotFound) {
+			// The label was deleted since
+			return Summary{Unread: new(int64)}, nil
+		}
+		if err != nil {
+			return Summary{}, err
+		}
+		return Summary{Total: l.Total, Unread: &l.Unread}, nil
+	case sub.thread != "":
+		msgs, err := c.s.db.Queries().ListThreadMessages(c.ctx, schema.ListThreadMessagesParams{UserID: c.userID, ThreadID: sub.thread})
+		if err != nil {
+			return Summary{}, err
+		}
+		var unread int64
+		for _, m := range msgs {
+			if !m.IsRead {
+				unread++
+			}
+		}
+		return Summary{Total: int64(len(msgs)), Unread: &unread}, nil
+	}
+	ids, err := c.s.search.IDs(c.ctx, c.userID, *sub.query, maxQueryTotal)
+	if err != nil {
+		return Summary{}, err
+	}
+	return Summary{Total: int64(len(ids))}, nil
+}
+
+// notify tells the client of events to the messages its subscriptions
+// cover, then of the new counts of the subscriptions they touched. Messages
+// are described as they are now, which may be after later events.
+func (c *conn) notify(events []changelog.Event) bool {
+	q := c.s.db.Queries()
+	current := map[string]*Message{}
+	var ids []string
+	for _, e := range events {
+		if _, ok := current[e.MessageID]; ok || e.MessageID == "" {
+			continue
+		}
+		msg, err := q.GetMessage(c.ctx, schema.GetMessageParams{ID: e.MessageID, UserID: c.userID})
+		if errors.Is(err, sql.ErrNoRows) {
+			// Deleted since
+			current[e.MessageID] = nil
+			continue
+		}
+		if err != nil {
+			c.logError("push_notify", "Failed to get message", err)
+			return false
+		}
+		summary, err := c.summarizeMessage(q, msg)
+		if err != nil {
+			c.logError("push_notify", "Failed to get message", err)
+			return false
+		}
+		current[e.MessageID] = summary
+		ids = append(ids, e.MessageID)
+	}
+
+	// Which messages match the searches is looked up once for all of them
+	matched := map[*subscription]map[string]bool{}
+	for _, sub := range c.subs {
+		if sub.query == nil || len(ids) == 0 {
+			continue
+		}
+		m, err := c.s.search.Match(c.ctx, c.userID, *sub.query, ids)
+		if err != nil {
+			c.logError("push_notify", "Failed to match search subscription", err)
+			return false
+		}
+		matched[sub] = m
+	}
+
+	touched := map[*subscription]bool{}
+	for i := range events {
+		e := &events[i]
+		if e.MessageID == "" {
+			// Changes to labels themselves don't change what is covered
+			continue
+		}
+		msg := current[e.MessageID]
+		for _, sub := range c.subs {
+			var matches bool
+			switch {
+			case msg == nil:
+			case sub.query != nil:
+				matches = matched[sub][msg.ID]
+			default:
+				matches = sub.covers(msg)
+			}
+			if !matches && !sub.members[e.MessageID] && !sub.concerns(e) {
+				continue
+			}
+			if matches {
+				sub.members[e.MessageID] = true
+			} else {
+				delete(sub.members, e.MessageID)
+			}
+			touched[sub] = true
+			if !c.send(serverMessage{Type: typeChange, Subscription: sub.id, Event: e, Matches: &matches, Message: msg}) {
+				return false
+			}
+		}
+	}
+
+	for _, sub := range c.subs {
+		if !touched[sub] {
+			continue
+		}
+		summary, err := c.summarize(sub)
+		if err != nil {
+			c.logError("push_notify", "Failed to summarize subscription", err)
+			return false
+		}
+		if !c.send(serverMessage{Type: typeSummary, Subscription: sub.id, Summary: &summary}) {
+			return false
+		}
+	}
+	return true
+}
+
+// covers reports whether msg is on sub's label or in its thread.
+func (sub *subscription) covers(msg *Message) bool {
+	if sub.thread != "" {
+		return msg.ThreadID == sub.thread
+	}
+	return slices.Contains(msg.Labels, sub.label)
+}
+
+// concerns reports whether e changes what sub covers even for a message the
+// client wasn't told of: every deletion, and labels coming off the message
+// that take it off sub's label.
+func (sub *subscription) concerns(e *changelog.Event) bool {
+	switch e.Type {
+	case changelog.EventMessageDeleted:
+		return true
+	case changelog.EventMessageLabelsChanged:
+		switch sub.label {
+		case "":
+			return false
+		case labels.Inbox, labels.Archive:
+			return e.Label == labels.Inbox || e.Label == labels.Sent || e.Label == labels.Trash || e.Label == labels.Spam
+		}
+		return e.Label == sub.label
+	}
+	return false
+}
+
+func (c *conn) summarizeMessage(q *schema.Queries, msg schema.Message) (*Message, error) {
+	stored, err := q.ListMessageLabels(c.ctx, msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	keywords, err := q.ListMessageKeywords(c.ctx, msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		ID:             msg.ID,
+		ThreadID:       msg.ThreadID,
+		Subject:        msg.Subject,
+		FromName:       msg.FromName,
+		FromAddress:    msg.FromAddress,
+		ReceivedAt:     msg.ReceivedAt,
+		HasAttachments: msg.HasAttachments,
+		Read:           msg.IsRead,
+		Starred:        slices.Contains(keywords, flags.KeywordStarred),
+		Labels:         withMailbox(stored, msg.Archived),
+	}, nil
+}
+
+// withMailbox adds Inbox or Archive to the stored labels of a message, when
+// it is in them.
+func withMailbox(stored []string, archived bool) []string {
+	if mailbox := labels.Mailbox(stored, archived); mailbox != "" {
+		return append(stored, mailbox)
+	}
+	return stored
+}
+
+func (c *conn) logError(kind, msg string, err error) {
+	metrics.Errors.WithLabelValues(kind).Inc()
+	logger.Error(c.ctx, msg, "user_id", c.userID, "error", err)
+}
+
+// internalError reports a failure to answer the client, which can try
+// again.
+func (c *conn) internalError(kind, msg string, err error) bool {
+	c.logError(kind, msg, err)
+	return c.sendError("", "internal_error", msg)
+}
@@ -0,0 +1,390 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+// webhookTimeout bounds a single webhook request.
+const webhookTimeout = 10 * time.Second
+
+// Forwarder sends a copy of a stored message to another address.
+type Forwarder interface {
+	Forward(ctx context.Context, userID, to string, raw []byte) error
+}
+
+// Engine stores users' rules and runs them against new messages.
+type Engine struct {
+	db        database.Service
+	forwarder Forwarder // nil when outbound mail is not configured
+	client    *http.Client
+}
+
+// New creates an Engine. Forward actions are skipped until a Forwarder is
+// set.
+func New(db database.Service) *Engine {
+	return &Engine{
+		db:     db,
+		client: webhook.NewClient(webhookTimeout),
+	}
+}
+
+// SetForwarder sets how forward actions send mail.
+func (e *Engine) SetForwarder(f Forwarder) {
+	e.forwarder = f
+}
+
+// List returns userID's rules in the order they run.
+func (e *Engine) List(ctx context.Context, userID string) ([]Rule, error) {
+	rows, err := e.db.Queries().ListRulesByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules: %w", err)
+	}
+	list := make([]Rule, 0, len(rows))
+	for _, row := range rows {
+		r, err := newRule(row)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// Get returns one of userID's rules.
+func (e *Engine) Get(ctx context.Context, userID, id string) (Rule, error) {
+	row, err := e.db.Queries().GetRule(ctx, schema.GetRuleParams{ID: id, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Rule{}, ErrRuleNotFound
+		}
+		return Rule{}, fmt.Errorf("failed to get rule: %w", err)
+	}
+	return newRule(row)
+}
+
+// Create adds a rule for userID. Errors wrap ErrInvalidRule if p is not a
+// valid rule.
+func (e *Engine) Create(ctx context.Context, userID string, p Params) (Rule, error) {
+	if err := p.validate(); err != nil {
+		return Rule{}, err
+	}
+	conditions, actions, err := encode(p)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	id := uuid.New().String()
+	err = e.db.WithTx(ctx, func(q *schema.Queries) error {
+		var position int64
+		if p.Position != nil {
+			position = *p.Position
+		} else {
+			next, err := q.NextRulePosition(ctx, userID)
+			if err != nil {
+				return fmt.Errorf("failed to get rule position: %w", err)
+			}
+			position = next
+		}
+		err := q.InsertRule(ctx, schema.InsertRuleParams{
+			ID:             id,
+			UserID:         userID,
+			Name:           p.Name,
+			Position:       position,
+			Enabled:        p.Enabled == nil || *p.Enabled,
+			Match:          p.Match,
+			Conditions:     conditions,
+			Actions:        actions,
+			StopProcessing: p.StopProcessing,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert rule: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Rule{}, err
+	}
+	return e.Get(ctx, userID, id)
+}
+
+// Update replaces one of userID's rules with p.
+func (e *Engine) Update(ctx context.Context, userID, id string, p Params) (Rule, error) {
+	if err := p.validate(); err != nil {
+		return Rule{}, err
+	}
+	conditions, actions, err := encode(p)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	err = e.db.WithTx(ctx, func(q *schema.Queries) error {
+		current, err := q.GetRule(ctx, schema.GetRuleParams{ID: id, UserID: userID})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrRuleNotFound
+			}
+			return fmt.Errorf("failed to get rule: %w", err)
+		}
+		position := current.Position
+		if p.Position != nil {
+			position = *p.Position
+		}
+		_, err = q.UpdateRule(ctx, schema.UpdateRuleParams{
+			Name:           p.Name,
+			Position:       position,
+			Enabled:        p.Enabled == nil || *p.Enabled,
+			Match:          p.Match,
+			Conditions:     conditions,
+			Actions:        actions,
+			StopProcessing: p.StopProcessing,
+			ID:             id,
+			UserID:         userID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update rule: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Rule{}, err
+	}
+	return e.Get(ctx, userID, id)
+}
+
+// Delete removes one of userID's rules.
+func (e *Engine) Delete(ctx context.Context, userID, id string) error {
+	n, err := e.db.Queries().DeleteRule(ctx, schema.DeleteRuleParams{ID: id, UserID: userID})
+	if err != nil {
+		return fmt.Errorf("failed to delete rule: %w", err)
+	}
+	if n == 0 {
+		return ErrRuleNotFound
+	}
+	return nil
+}
+
+func encode(p Params) (conditions, actions string, err error) {
+	c, err := json.Marshal(p.Conditions)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode conditions: %w", err)
+	}
+	a, err := json.Marshal(p.Actions)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode actions: %w", err)
+	}
+	return string(c), string(a), nil
+}
+
+// plan collects the rules that matched a message and their actions.
+type plan struct {
+	matched  []Rule
+	labels   []string
+	archive  bool
+	read     bool
+	delete   bool
+	forwards []string
+	webhooks []webhookAction
+}
+
+type webhookAction struct {
+	url  string
+	rule Rule
+}
+
+func (p *plan) add(r Rule) {
+	p.matched = append(p.matched, r)
+	for _, a := range r.Actions {
+		switch a.Type {
+		case ActionLabel:
+			p.labels = append(p.labels, a.Label)
+		case ActionArchive:
+			p.archive = true
+		case ActionMarkRead:
+			p.read = true
+		case ActionForward:
+			p.forwards = append(p.forwards, a.To)
+		case ActionWebhook:
+			p.webhooks = append(p.webhooks, webhookAction{url: a.URL, rule: r})
+		case ActionDelete:
+			p.delete = true
+		}
+	}
+}
+
+// Process runs the enabled rules of the message's owner against a stored
+// message, in position order. A matching rule with stop_processing set, or
+// one that deletes the message, ends the run. Changes to the message are
+// made in one transaction; forwards and webhooks are sent afterwards, and
+// their failures are returned together once all have been tried.
+func (e *Engine) Process(ctx context.Context, rec database.MessageRecord, _ mailstore.Envelope) error {
+	userID := rec.Message.UserID
+	rows, err := e.db.Queries().ListEnabledRulesByUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	m := newMessage(rec)
+	var p plan
+	for _, row := range rows {
+		r, ok, err := match(row, m)
+		if err != nil {
+			// A stored rule that can't run is skipped rather than holding
+			// up the rules after it
+			metrics.Errors.WithLabelValues("rule_invalid").Inc()
+			logger.Error(ctx, "Skipping invalid rule", "rule_id", row.ID, "error", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		logger.Info(ctx, "Rule matched", "rule_id", r.ID, "message_id", rec.Message.ID)
+		p.add(r)
+		if r.StopProcessing || p.delete {
+			break
+		}
+	}
+
+	if err := e.apply(ctx, rec, p); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, to := range p.forwards {
+		if e.forwarder == nil {
+			logger.Warn(ctx, "Skipping forward; outbound mail is not configured", "message_id", rec.Message.ID)
+			continue
+		}
+		if err := e.forwarder.Forward(ctx, userID, to, rec.Blobs[rec.Body.RawHash]); err != nil {
+			metrics.Errors.WithLabelValues("rule_forward").Inc()
+			errs = append(errs, fmt.Errorf("failed to forward message to %s: %w", to, err))
+		}
+	}
+	for _, w := range p.webhooks {
+		if err := e.postWebhook(ctx, w, rec); err != nil {
+			metrics.Errors.WithLabelValues("rule_webhook").Inc()
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// match decodes a stored rule and reports whether it matches m.
+func match(row schema.Rule, m *message) (Rule, bool, error) {
+	r, err := newRule(row)
+	if err != nil {
+		return Rule{}, false, err
+	}
+	c, err := compile(r)
+	if err != nil {
+		return Rule{}, false, err
+	}
+	return r, c.matches(m), nil
+}
+
+// apply makes the planned changes to the stored message and publishes the
+// events they cause.
+func (e *Engine) apply(ctx context.Context, rec database.MessageRecord, p plan) error {
+	if len(p.matched) == 0 {
+		return nil
+	}
+	id, userID := rec.Message.ID, rec.Message.UserID
+	return e.db.WithTx(ctx, func(q *schema.Queries) error {
+		for _, r := range p.matched {
+			err := webhook.PublishTx(ctx, q, userID, webhook.EventRuleMatched, webhook.RuleMatched{
+				RuleID:   r.ID,
+				RuleName: r.Name,
+				Message:  webhook.NewMessage(rec),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if p.delete {
+			if _, err := database.DeleteMessageTx(ctx, q, userID, id); err != nil {
+				return err
+			}
+			return webhook.PublishTx(ctx, q, userID, webhook.EventMessageDeleted, webhook.MessageDeleted{MessageID: id})
+		}
+		for _, label := range p.labels {
+			if err := labels.Add(ctx, q, userID, id, label); err != nil {
+				return err
+			}
+		}
+		if len(p.labels) > 0 {
+			err := webhook.PublishTx(ctx, q, userID, webhook.EventMessageLabeled, webhook.MessageLabeled{MessageID: id, Labels: p.labels})
+			if err != nil {
+				return err
+			}
+		}
+		if p.read {
+			if err := q.SetMessageRead(ctx, schema.SetMessageReadParams{IsRead: true, ID: id, UserID: userID}); err != nil {
+				return fmt.Errorf("failed to mark message read: %w", err)
+			}
+		}
+		if p.archive {
+			if err := q.SetMessageArchived(ctx, schema.SetMessageArchivedParams{Archived: true, ID: id, UserID: userID}); err != nil {
+				return fmt.Errorf("failed to archive message: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// webhookPayload is the JSON body posted by a webhook action.
+type webhookPayload struct {
+	Event   string          `json:"event"`
+	RuleID  string          `json:"rule_id"`
+	Rule    string          `json:"rule_name"`
+	Message webhook.Message `json:"message"`
+}
+
+// postWebhook tells a webhook that a rule matched the message. Any 2xx
+// response counts as delivered. Unlike the endpoints of package webhook, a
+// webhook action is tried once and unsigned, but it is posted the same way:
+// only to public addresses, without following redirects. Errors leave out
+// the URL and the network errors, as they are the user's to see.
+func (e *Engine) postWebhook(ctx context.Context, w webhookAction, rec database.MessageRecord) error {
+	body, err := json.Marshal(webhookPayload{
+		Event:   webhook.EventRuleMatched,
+		RuleID:  w.rule.ID,
+		Rule:    w.rule.Name,
+		Message: webhook.NewMessage(rec),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook of rule %s: %s", w.rule.ID, webhook.Failure(err))
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook of rule %s answered %s", w.rule.ID, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package rules
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+// message is the view of a stored message that conditions test.
+type message struct {
+	headers        mime.Headers
+	from           string
+	subject        string
+	body           string
+	size           int64
+	hasAttachments bool
+	dkim           string
+	spf            string
+	dmarc          string
+	arc            string
+	spoofed        bool
+}
+
+func newMessage(rec database.MessageRecord) *message {
+	m := &message{
+		from:           rec.Message.FromAddress,
+		subject:        rec.Message.Subject,
+		body:           rec.Body.TextBody,
+		size:           rec.Message.Size,
+		hasAttachments: rec.Message.HasAttachments,
+		dkim:           mailauth.ResultNone,
+		spf:            mailauth.ResultNone,
+		dmarc:          mailauth.ResultNone,
+		arc:            mailauth.ResultNone,
+	}
+	if rec.Auth != nil {
+		m.dkim, m.spf, m.dmarc, m.arc = rec.Auth.Dkim, rec.Auth.Spf, rec.Auth.Dmarc, rec.Auth.Arc
+		m.spoofed = rec.Auth.Dmarc == mailauth.ResultFail && rec.Auth.DmarcOverride == ""
+	}
+	if strings.TrimSpace(m.body) == "" && rec.Body.HtmlBody != "" {
+		m.body = mime.HTMLText(rec.Body.HtmlBody)
+	}
+	for _, h := range rec.Headers {
+		m.headers = append(m.headers, mime.Header{Name: h.Name, Value: h.Value})
+	}
+	return m
+}
+
+// compiled is a rule ready to run, with its regular expressions compiled.
+type compiled struct {
+	Rule
+	patterns []*regexp.Regexp // by condition; nil unless the op is matches
+}
+
+func compile(r Rule) (*compiled, error) {
+	c := &compiled{Rule: r, patterns: make([]*regexp.Regexp, len(r.Conditions))}
+	for i, cond := range r.Conditions {
+		if cond.Op != OpMatches {
+			continue
+		}
+		re, err := regexp.Compile(cond.Value)
+		if err != nil {
+			return nil, err
+		}
+		c.patterns[i] = re
+	}
+	return c, nil
+}
+
+// matches reports whether m satisfies the rule's conditions. A rule without
+// conditions matches every message.
+func (c *compiled) matches(m *message) bool {
+	if len(c.Conditions) == 0 {
+		return true
+	}
+	for i, cond := range c.Conditions {
+		ok := c.test(i, cond, m) != cond.Not
+		if c.Match == MatchAny && ok {
+			return true
+		}
+		if c.Match == MatchAll && !ok {
+			return false
+		}
+	}
+	return c.Match == MatchAll
+}
+
+// test evaluates the i'th condition, ignoring Not.
+func (c *compiled) test(i int, cond Condition, m *message) bool {
+	switch cond.Field {
+	case FieldHeader:
+		values := m.headers.Values(cond.Header)
+		if cond.Op == OpExists {
+			return len(values) > 0
+		}
+		for _, v := range values {
+			if c.compare(i, cond, mime.DecodeHeader(v)) {
+				return true
+			}
+		}
+		return false
+	case FieldFrom:
+		return c.compare(i, cond, m.from)
+	case FieldFromDomain:
+		_, domain, _ := strings.Cut(m.from, "@")
+		return c.compare(i, cond, domain)
+	case FieldSubject:
+		return c.compare(i, cond, m.subject)
+	case FieldBody:
+		return c.compare(i, cond, m.body)
+	case FieldListID:
+		return c.compare(i, cond, listID(m.headers.Get("List-Id")))
+	case FieldSize:
+		n, _ := strconv.ParseInt(cond.Value, 10, 64)
+		if cond.Op == OpGreaterThan {
+			return m.size > n
+		}
+		return m.size < n
+	case FieldHasAttachment:
+		return m.hasAttachments
+	case FieldDKIM:
+		return c.compare(i, cond, m.dkim)
+	case FieldSPF:
+		return c.compare(i, cond, m.spf)
+	case FieldDMARC:
+		return c.compare(i, cond, m.dmarc)
+	case FieldARC:
+		return c.compare(i, cond, m.arc)
+	case FieldSpoofed:
+		return m.spoofed
+	}
+	return false
+}
+
+// compare applies a text operator to s.
+func (c *compiled) compare(i int, cond Condition, s string) bool {
+	if cond.Op == OpMatches {
+		return c.patterns[i].MatchString(s)
+	}
+	s, v := strings.ToLower(s), strings.ToLower(cond.Value)
+	switch cond.Op {
+	case OpEquals:
+		return s == v
+	case OpContains:
+		return strings.Contains(s, v)
+	case OpStartsWith:
+		return strings.HasPrefix(s, v)
+	case OpEndsWith:
+		return strings.HasSuffix(s, v)
+	}
+	return false
+}
+
+// listID returns the identifier of a List-Id field (RFC 2919), which follows
+// an optional description in angle brackets.
+func listID(value string) string {
+	value = mime.DecodeHeader(value)
+	if i := strings.LastIndexByte(value, '<'); i >= 0 {
+		if j := strings.IndexByte(value[i:], '>'); j > 0 {
+			return strings.TrimSpace(value[i+1 : i+j])
+		}
+	}
+	return strings.TrimSpace(value)
+}
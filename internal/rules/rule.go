@@ -0,0 +1,258 @@
+// Package rules runs each user's declarative rules against the messages
+// stored for them. A rule's conditions test the message's headers, sender,
+// subject, body, size, attachments and authentication results; when they
+// match, its actions label, archive, mark read, forward, post to a webhook
+// or delete the message. Rules run in position order and a matching rule
+// can stop the rules after it from running.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/labels"
+)
+
+var (
+	ErrInvalidRule  = errors.New("invalid rule")
+	ErrRuleNotFound = errors.New("rule not found")
+)
+
+// How a rule's conditions combine.
+const (
+	MatchAll = "all"
+	MatchAny = "any"
+)
+
+// Condition fields.
+const (
+	FieldHeader        = "header"         // the header named by Header
+	FieldFrom          = "from"           // the sender's address
+	FieldFromDomain    = "from_domain"    // the domain of the sender's address
+	FieldSubject       = "subject"        // the decoded subject
+	FieldBody          = "body"           // the text body, or the HTML body's text
+	FieldListID        = "list_id"        // the List-Id, without its description
+	FieldSize          = "size"           // the raw message size in bytes
+	FieldHasAttachment = "has_attachment" // whether the message has attachments
+	FieldDKIM          = "dkim"           // the DKIM result, e.g. pass or fail
+	FieldSPF           = "spf"            // the SPF result
+	FieldDMARC         = "dmarc"          // the DMARC result
+	FieldARC           = "arc"            // the ARC chain validation result
+	FieldSpoofed       = "spoofed"        // whether DMARC failed without a trusted ARC override
+)
+
+// Condition operators. Text comparisons ignore case, except for matches,
+// whose regular expression can ask for it with (?i).
+const (
+	OpEquals      = "equals"
+	OpContains    = "contains"
+	OpStartsWith  = "starts_with"
+	OpEndsWith    = "ends_with"
+	OpMatches     = "matches"
+	OpExists      = "exists" // header only
+	OpGreaterThan = "greater_than"
+	OpLessThan    = "less_than"
+)
+
+// Action types.
+const (
+	ActionLabel    = "label"
+	ActionArchive  = "archive"
+	ActionMarkRead = "mark_read"
+	ActionForward  = "forward"
+	ActionWebhook  = "webhook"
+	ActionDelete   = "delete"
+)
+
+// Limits on a single rule.
+const (
+	maxNameLength = 200
+	maxConditions = 50
+	maxActions    = 20
+)
+
+// Condition is a test on a message. Size conditions compare against Value
+// as a number of bytes; has_attachment and spoofed take no operator or value.
+// The dkim, spf, dmarc and arc results of messages that weren't
+// authenticated are none.
+// Not inverts the result.
+type Condition struct {
+	Field  string `json:"field"`
+	Header string `json:"header,omitempty"`
+	Op     string `json:"op,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Not    bool   `json:"not,omitempty"`
+}
+
+// Action is something done to a matching message. Label names the label to
+// add, To the address to forward to and URL the webhook to post to.
+type Action struct {
+	Type  string `json:"type"`
+	Label string `json:"label,omitempty"`
+	To    string `json:"to,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+// Rule is a user's rule as returned by the API.
+type Rule struct {
+	ID             string      `json:"id"`
+	Name           string      `json:"name"`
+	Position       int64       `json:"position"`
+	Enabled        bool        `json:"enabled"`
+	Match          string      `json:"match"`
+	Conditions     []Condition `json:"conditions"`
+	Actions        []Action    `json:"actions"`
+	StopProcessing bool        `json:"stop_processing"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+}
+
+// Params describes a rule to create or replace. A nil Position appends a new
+// rule after the user's others and keeps a replaced rule where it was; a nil
+// Enabled means enabled.
+type Params struct {
+	Name           string      `json:"name"`
+	Position       *int64      `json:"position"`
+	Enabled        *bool       `json:"enabled"`
+	Match          string      `json:"match"`
+	Conditions     []Condition `json:"conditions"`
+	Actions        []Action    `json:"actions"`
+	StopProcessing bool        `json:"stop_processing"`
+}
+
+// validate normalizes p and checks it describes a rule that can run.
+func (p *Params) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Match == "" {
+		p.Match = MatchAll
+	}
+	if p.Conditions == nil {
+		p.Conditions = []Condition{}
+	}
+
+	switch {
+	case len(p.Name) > maxNameLength:
+		return fmt.Errorf("%w: name is longer than %d characters", ErrInvalidRule, maxNameLength)
+	case p.Match != MatchAll && p.Match != MatchAny:
+		return fmt.Errorf("%w: match must be all or any", ErrInvalidRule)
+	case p.Position != nil && *p.Position < 0:
+		return fmt.Errorf("%w: position must not be negative", ErrInvalidRule)
+	case len(p.Conditions) > maxConditions:
+		return fmt.Errorf("%w: a rule can have at most %d conditions", ErrInvalidRule, maxConditions)
+	case len(p.Actions) == 0:
+		return fmt.Errorf("%w: a rule needs at least one action", ErrInvalidRule)
+	case len(p.Actions) > maxActions:
+		return fmt.Errorf("%w: a rule can have at most %d actions", ErrInvalidRule, maxActions)
+	}
+
+	for i := range p.Conditions {
+		if err := p.Conditions[i].validate(); err != nil {
+			return fmt.Errorf("%w: condition %d: %v", ErrInvalidRule, i+1, err)
+		}
+	}
+	for i := range p.Actions {
+		if err := p.Actions[i].validate(); err != nil {
+			return fmt.Errorf("%w: action %d: %v", ErrInvalidRule, i+1, err)
+		}
+	}
+	return nil
+}
+
+func (c *Condition) validate() error {
+	c.Op = strings.ToLower(c.Op)
+	switch c.Field {
+	case FieldHeader:
+		c.Header = strings.TrimSpace(c.Header)
+		if c.Header == "" {
+			return errors.New("header conditions need a header name")
+		}
+		if c.Op == OpExists {
+			return nil
+		}
+		return c.validateText()
+	case FieldFrom, FieldFromDomain, FieldSubject, FieldBody, FieldListID, FieldDKIM, FieldSPF, FieldDMARC, FieldARC:
+		return c.validateText()
+	case FieldSize:
+		if c.Op != OpGreaterThan && c.Op != OpLessThan {
+			return errors.New("size conditions use greater_than or less_than")
+		}
+		if n, err := strconv.ParseInt(c.Value, 10, 64); err != nil || n < 0 {
+			return errors.New("size conditions need a number of bytes")
+		}
+		return nil
+	case FieldHasAttachment, FieldSpoofed:
+		c.Op, c.Value = "", ""
+		return nil
+	default:
+		return fmt.Errorf("unknown field %q", c.Field)
+	}
+}
+
+func (c *Condition) validateText() error {
+	switch c.Op {
+	case OpEquals, OpContains, OpStartsWith, OpEndsWith:
+		return nil
+	case OpMatches:
+		if _, err := regexp.Compile(c.Value); err != nil {
+			return fmt.Errorf("invalid regular expression: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown operator %q for %s", c.Op, c.Field)
+	}
+}
+
+func (a *Action) validate() error {
+	switch a.Type {
+	case ActionLabel:
+		label, err := labels.Canonical(a.Label)
+		if err != nil {
+			return fmt.Errorf("label actions need a valid label: %v", err)
+		}
+		a.Label = label
+	case ActionArchive, ActionMarkRead, ActionDelete:
+	case ActionForward:
+		addr, err := mail.ParseAddress(a.To)
+		if err != nil {
+			return errors.New("forward actions need an email address")
+		}
+		a.To = addr.Address
+	case ActionWebhook:
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("webhook actions need an http or https URL")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", a.Type)
+	}
+	return nil
+}
+
+// newRule converts a stored rule into its API view.
+func newRule(r schema.Rule) (Rule, error) {
+	rule := Rule{
+		ID:             r.ID,
+		Name:           r.Name,
+		Position:       r.Position,
+		Enabled:        r.Enabled,
+		Match:          r.Match,
+		StopProcessing: r.StopProcessing,
+		CreatedAt:      r.CreatedAt,
+		UpdatedAt:      r.UpdatedAt,
+	}
+	if err := json.Unmarshal([]byte(r.Conditions), &rule.Conditions); err != nil {
+		return Rule{}, fmt.Errorf("failed to decode conditions of rule %s: %w", r.ID, err)
+	}
+	if err := json.Unmarshal([]byte(r.Actions), &rule.Actions); err != nil {
+		return Rule{}, fmt.Errorf("failed to decode actions of rule %s: %w", r.ID, err)
+	}
+	return rule, nil
+}
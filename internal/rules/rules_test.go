@@ -0,0 +1,314 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+const testRaw = "From: Alice <alice@lists.example.org>\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: =?utf-8?q?Weekly_r=C3=A9port?=\r\n" +
+	"List-Id: Team updates <updates.example.org>\r\n" +
+	"X-Priority: 1 (Highest)\r\n" +
+	"Message-ID: <weekly@example.org>\r\n" +
+	"\r\n" +
+	"Numbers are up this week.\r\n"
+
+func TestMatch(t *testing.T) {
+	parsed, err := mailstore.Parse([]byte(testRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &mailauth.Results{
+		SPF:   mailauth.SPFResult{Result: mailauth.ResultSoftFail},
+		DMARC: mailauth.DMARCResult{Result: mailauth.ResultFail},
+		ARC:   mailauth.ARCResult{Result: mailauth.ResultNone},
+	}
+	m := newMessage(mailstore.NewRecord(mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw), Auth: auth}, parsed))
+
+	for _, c := range []struct {
+		name  string
+		match string
+		conds []Condition
+		want  bool
+	}{
+		{"no conditions", MatchAll, nil, true},
+		{"header contains", MatchAll, []Condition{{Field: FieldHeader, Header: "x-priority", Op: OpContains, Value: "highest"}}, true},
+		{"header exists", MatchAll, []Condition{{Field: FieldHeader, Header: "X-Spam", Op: OpExists}}, false},
+		{"header not exists", MatchAll, []Condition{{Field: FieldHeader, Header: "X-Spam", Op: OpExists, Not: true}}, true},
+		{"from domain", MatchAll, []Condition{{Field: FieldFromDomain, Op: OpEquals, Value: "Lists.Example.org"}}, true},
+		{"from domain suffix", MatchAll, []Condition{{Field: FieldFromDomain, Op: OpEndsWith, Value: ".example.org"}}, true},
+		{"decoded subject", MatchAll, []Condition{{Field: FieldSubject, Op: OpStartsWith, Value: "weekly rÉport"}}, true},
+		{"subject regex is case sensitive", MatchAll, []Condition{{Field: FieldSubject, Op: OpMatches, Value: `^weekly`}}, false},
+		{"body regex", MatchAll, []Condition{{Field: FieldBody, Op: OpMatches, Value: `(?i)numbers\s+are`}}, true},
+		{"list id", MatchAll, []Condition{{Field: FieldListID, Op: OpEquals, Value: "updates.example.org"}}, true},
+		{"size", MatchAll, []Condition{{Field: FieldSize, Op: OpLessThan, Value: "1000"}}, true},
+		{"attachment", MatchAll, []Condition{{Field: FieldHasAttachment}}, false},
+		{"spoofed", MatchAll, []Condition{{Field: FieldDMARC, Op: OpEquals, Value: "fail"}}, true},
+		{"spoofed flag", MatchAll, []Condition{{Field: FieldSpoofed}}, true},
+		{"no ARC chain", MatchAll, []Condition{{Field: FieldARC, Op: OpEquals, Value: "none"}}, true},
+		{"spf", MatchAll, []Condition{{Field: FieldSPF, Op: OpEquals, Value: "pass"}}, false},
+		{"unsigned", MatchAll, []Condition{{Field: FieldDKIM, Op: OpEquals, Value: "none"}}, true},
+		{"all fails on one", MatchAll, []Condition{
+			{Field: FieldListID, Op: OpEquals, Value: "updates.example.org"},
+			{Field: FieldSize, Op: OpGreaterThan, Value: "1000"},
+		}, false},
+		{"any passes on one", MatchAny, []Condition{
+			{Field: FieldSize, Op: OpGreaterThan, Value: "1000"},
+			{Field: FieldFrom, Op: OpEquals, Value: "alice@lists.example.org"},
+		}, true},
+	} {
+		p := Params{Match: c.match, Conditions: c.conds, Actions: []Action{{Type: ActionArchive}}}
+		if err := p.validate(); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		compiled, err := compile(Rule{Match: p.Match, Conditions: p.Conditions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := compiled.matches(m); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, p := range []Params{
+		{},
+		{Match: "some", Actions: []Action{{Type: ActionArchive}}},
+		{Actions: []Action{{Type: "explode"}}},
+		{Actions: []Action{{Type: ActionLabel}}},
+		{Actions: []Action{{Type: ActionForward, To: "not an address"}}},
+		{Actions: []Action{{Type: ActionWebhook, URL: "ftp://example.com/hook"}}},
+		{Conditions: []Condition{{Field: "color", Op: OpEquals}}, Actions: []Action{{Type: ActionArchive}}},
+		{Conditions: []Condition{{Field: FieldHeader, Op: OpEquals}}, Actions: []Action{{Type: ActionArchive}}},
+		{Conditions: []Condition{{Field: FieldSubject, Op: OpMatches, Value: "("}}, Actions: []Action{{Type: ActionArchive}}},
+		{Conditions: []Condition{{Field: FieldSize, Op: OpGreaterThan, Value: "big"}}, Actions: []Action{{Type: ActionArchive}}},
+	} {
+		if err := p.validate(); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("validate(%+v) = %v, want ErrInvalidRule", p, err)
+		}
+	}
+}
+
+func newTestStore(t *testing.T) (*mailstore.Store, *Engine) {
+	t.Helper()
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	engine := New(db)
+	store.Use(engine)
+	return store, engine
+}
+
+func TestProcess(t *testing.T) {
+	ctx := context.Background()
+	store, engine := newTestStore(t)
+	// The receiver listens on loopback, which webhooks may not reach
+	engine.client = &http.Client{Timeout: webhookTimeout}
+
+	hooks := make(chan map[string]interface{}, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("webhook body %s: %v", body, err)
+		}
+		hooks <- payload
+	}))
+	defer receiver.Close()
+
+	list := Condition{Field: FieldListID, Op: OpEquals, Value: "updates.example.org"}
+	for _, p := range []Params{
+		{Name: "updates", Conditions: []Condition{list}, Actions: []Action{
+			{Type: ActionLabel, Label: "Updates"},
+			{Type: ActionMarkRead},
+			{Type: ActionWebhook, URL: receiver.URL},
+		}, StopProcessing: true},
+		// Never runs for list mail because the rule above stops processing
+		{Name: "archive everything", Actions: []Action{{Type: ActionArchive}}},
+	} {
+		if _, err := engine.Create(ctx, "u1", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := store.DB().Queries()
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.IsRead || msg.Archived {
+		t.Errorf("got read %v, archived %v; want read and not archived", msg.IsRead, msg.Archived)
+	}
+	if labels, err := q.ListMessageLabels(ctx, id); err != nil || strings.Join(labels, ",") != "Updates" {
+		t.Errorf("got labels %v, %v", labels, err)
+	}
+	payload := <-hooks
+	if payload["event"] != "rule.matched" || payload["rule_name"] != "updates" {
+		t.Errorf("got webhook payload %v", payload)
+	}
+
+	// Other mail falls through to the second rule
+	other := strings.Replace(testRaw, "List-Id: Team updates <updates.example.org>\r\n", "", 1)
+	other = strings.Replace(other, "weekly@", "other@", 1)
+	id, err = store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(other)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.IsRead || !msg.Archived {
+		t.Errorf("got read %v, archived %v; want archived and not read", msg.IsRead, msg.Archived)
+	}
+}
+
+func TestUnsafeWebhook(t *testing.T) {
+	ctx := context.Background()
+	store, engine := newTestStore(t)
+
+	var requests atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer receiver.Close()
+	_, err := engine.Create(ctx, "u1", Params{Name: "hook", Actions: []Action{{Type: ActionWebhook, URL: receiver.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Loopback isn't public, and the error doesn't tell where it was posted
+	rec, err := database.LoadMessageRecord(ctx, store.DB().Queries(), "u1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.Process(ctx, rec, mailstore.Envelope{})
+	if err == nil || !strings.Contains(err.Error(), webhook.ErrAddressNotAllowed.Error()) || strings.Contains(err.Error(), receiver.URL) {
+		t.Errorf("Process = %v, want the address refused", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("a loopback webhook got %d requests", n)
+	}
+}
+
+func TestProcessDelete(t *testing.T) {
+	ctx := context.Background()
+	store, engine := newTestStore(t)
+
+	_, err := engine.Create(ctx, "u1", Params{
+		Conditions: []Condition{{Field: FieldFromDomain, Op: OpEquals, Value: "lists.example.org"}},
+		Actions:    []Action{{Type: ActionDelete}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Runs after the delete, so it never applies
+	_, err = engine.Create(ctx, "u1", Params{Actions: []Action{{Type: ActionLabel, Label: "Late"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks := webhook.New(store.DB())
+	endpoint, err := hooks.Create(ctx, "u1", webhook.Params{URL: "https://example.org/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.DB().Queries().GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: "u1"})
+	if err == nil {
+		t.Error("message wasn't deleted")
+	}
+
+	deliveries, err := hooks.ListDeliveries(ctx, "u1", endpoint.ID, webhook.StatusPending, webhook.DefaultDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := map[string]bool{}
+	for _, d := range deliveries {
+		events[d.Event] = true
+	}
+	if len(events) != 2 || !events[webhook.EventRuleMatched] || !events[webhook.EventMessageDeleted] {
+		t.Errorf("published %v, want rule.matched and message.deleted", events)
+	}
+}
+
+func TestCRUD(t *testing.T) {
+	ctx := context.Background()
+	_, engine := newTestStore(t)
+
+	first, err := engine.Create(ctx, "u1", Params{Name: " first ", Actions: []Action{{Type: ActionArchive}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := engine.Create(ctx, "u1", Params{Name: "second", Actions: []Action{{Type: ActionMarkRead}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Name != "first" || first.Position != 0 || second.Position != 1 || !second.Enabled || second.Match != MatchAll {
+		t.Errorf("created %+v and %+v", first, second)
+	}
+
+	// Moving the second rule to the front changes the order they run in
+	zero, disabled := int64(0), false
+	if _, err := engine.Update(ctx, "u1", second.ID, Params{
+		Name: "second", Position: &zero, Enabled: &disabled, Actions: []Action{{Type: ActionMarkRead}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Both rules are at position 0 now, where the older runs first
+	one := int64(1)
+	if _, err := engine.Update(ctx, "u1", first.ID, Params{
+		Name: "first", Position: &one, Actions: []Action{{Type: ActionArchive}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := engine.List(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != second.ID || list[0].Enabled {
+		t.Errorf("got %+v", list)
+	}
+
+	if _, err := engine.Get(ctx, "u2", first.ID); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("got another user's rule: %v", err)
+	}
+	if err := engine.Delete(ctx, "u1", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Delete(ctx, "u1", first.ID); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("second delete = %v, want ErrRuleNotFound", err)
+	}
+}
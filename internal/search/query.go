@@ -0,0 +1,225 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	// ErrEmptyQuery is returned by ParseQuery for a query with no terms.
+	ErrEmptyQuery = errors.New("search query is empty")
+	// ErrInvalidQuery wraps problems with the query syntax.
+	ErrInvalidQuery = errors.New("invalid search query")
+)
+
+// fieldColumns maps query qualifiers onto message_search columns.
+var fieldColumns = map[string]string{
+	"subject":    "subject",
+	"from":       "from_text",
+	"to":         "to_text",
+	"body":       "body",
+	"filename":   "attachments",
+	"attachment": "attachments",
+}
+
+// dateLayouts are accepted by before: and after:.
+var dateLayouts = []string{"2006-01-02", "2006/01/02", time.RFC3339}
+
+// Query is a parsed search string.
+//
+// Terms are ANDed together. A term is a word, a "quoted phrase" or a word
+// ending in * for a prefix match, optionally qualified by a field (from:,
+// to:, subject:, body:, filename:) and negated with a leading -. The
+// filters has:attachment, before:DATE and after:DATE restrict by message
+// metadata; dates are YYYY-MM-DD in UTC and compared with the message's
+// Date header.
+type Query struct {
+	// Match is the FTS5 MATCH expression, "" when only filters were given.
+	Match string
+
+	HasAttachment bool
+	Before        time.Time // sent before this time, zero if unbounded
+	After         time.Time // sent at or after this time, zero if unbounded
+
+	// ids, if set, restricts the query to these messages
+	ids []string
+}
+
+// ParseQuery parses the q parameter of a search request. Errors wrap
+// ErrInvalidQuery or are ErrEmptyQuery.
+func ParseQuery(s string) (Query, error) {
+	var q Query
+	var include, exclude []string
+	filters := 0
+
+	for _, tok := range tokenize(s) {
+		negate := tok.negate
+		field, value, column := "", tok.text, ""
+		if !tok.quoted {
+			if k, v, ok := strings.Cut(tok.text, ":"); ok {
+				k = strings.ToLower(k)
+				switch {
+				case k == "has" || k == "before" || k == "after":
+					field, value = k, v
+				case fieldColumns[k] != "":
+					field, value, column = k, v, fieldColumns[k]
+				}
+			}
+		}
+		if field != "" && value == "" {
+			return Query{}, fmt.Errorf("%w: %s: needs a value", ErrInvalidQuery, field)
+		}
+		if tok.valueQuoted {
+			value = strings.ReplaceAll(value, `"`, "")
+		}
+
+		switch field {
+		case "has":
+			if v := strings.ToLower(value); v != "attachment" && v != "attachments" {
+				return Query{}, fmt.Errorf("%w: unknown has:%s", ErrInvalidQuery, value)
+			}
+			if negate {
+				return Query{}, fmt.Errorf("%w: has:attachment can't be negated", ErrInvalidQuery)
+			}
+			q.HasAttachment = true
+			filters++
+			continue
+		case "before", "after":
+			t, err := parseDate(value)
+			if err != nil {
+				return Query{}, fmt.Errorf("%w: %s:%s is not a date", ErrInvalidQuery, field, value)
+			}
+			if negate {
+				return Query{}, fmt.Errorf("%w: %s: can't be negated", ErrInvalidQuery, field)
+			}
+			if field == "before" {
+				q.Before = t
+			} else {
+				q.After = t
+			}
+			filters++
+			continue
+		}
+
+		term := matchTerm(value, tok.quoted || tok.valueQuoted)
+		if term == "" {
+			continue
+		}
+		if column != "" {
+			term = column + " : " + term
+		}
+		if negate {
+			exclude = append(exclude, term)
+		} else {
+			include = append(include, term)
+		}
+	}
+
+	if len(include) == 0 && len(exclude) > 0 {
+		return Query{}, fmt.Errorf("%w: excluded terms need at least one other term", ErrInvalidQuery)
+	}
+	if len(include) == 0 && filters == 0 {
+		return Query{}, ErrEmptyQuery
+	}
+	if len(include) > 0 {
+		q.Match = "(" + strings.Join(include, " AND ") + ")"
+		for _, term := range exclude {
+			q.Match += " NOT " + term
+		}
+	}
+	return q, nil
+}
+
+// matchTerm quotes a term as an FTS5 string so that user input is never
+// read as query syntax. An unquoted word ending in * is a prefix query.
+func matchTerm(value string, phrase bool) string {
+	prefix := false
+	if !phrase && strings.HasSuffix(value, "*") {
+		prefix = true
+		value = strings.TrimRight(value, "*")
+	}
+	if !strings.ContainsFunc(value, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) {
+		return ""
+	}
+	term := `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+	if prefix {
+		term += " *"
+	}
+	return term
+}
+
+func parseDate(s string) (time.Time, error) {
+	var err error
+	for _, layout := range dateLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// token is one whitespace-separated element of a query. quoted is set for a
+// "whole phrase", valueQuoted for field:"a phrase".
+type token struct {
+	text        string
+	negate      bool
+	quoted      bool
+	valueQuoted bool
+}
+
+func tokenize(s string) []token {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		if isSpace(s[i]) {
+			i++
+			continue
+		}
+
+		var tok token
+		if s[i] == '-' && i+1 < len(s) && !isSpace(s[i+1]) {
+			tok.negate = true
+			i++
+		}
+
+		if s[i] == '"' {
+			// An unterminated phrase runs to the end of the query
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				tok.text, i = s[i+1:], len(s)
+			} else {
+				tok.text, i = s[i+1:i+1+end], i+end+2
+			}
+			tok.quoted = true
+			toks = append(toks, tok)
+			continue
+		}
+
+		start := i
+		for i < len(s) && !isSpace(s[i]) {
+			if s[i] == '"' {
+				// field:"a phrase" runs to the closing quote
+				end := strings.IndexByte(s[i+1:], '"')
+				if end < 0 {
+					i = len(s)
+					break
+				}
+				i += end + 2
+				continue
+			}
+			i++
+		}
+		tok.text = s[start:i]
+		tok.valueQuoted = strings.Contains(tok.text, `"`)
+		toks = append(toks, tok)
+	}
+	return toks
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,271 @@
+// Package search answers full-text queries over a user's stored messages
+// using the SQLite FTS5 index maintained by the database package.
+package search
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+const (
+	// DefaultLimit is the page size used when a request doesn't set one.
+	DefaultLimit = 25
+	// MaxLimit bounds the page size.
+	MaxLimit = 100
+)
+
+// ErrInvalidCursor is returned for a cursor that wasn't produced by Search
+// for the same query.
+var ErrInvalidCursor = errors.New("invalid search cursor")
+
+// bm25Weights ranks subject matches above sender, recipient, attachment name
+// and body matches, in that order.
+const bm25Weights = "10.0, 5.0, 3.0, 1.0, 2.0"
+
+// Snippet markers; SQLite can't HTML-escape, so matches are marked with
+// control characters and the text is escaped afterwards.
+const (
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+// Searcher runs search queries against the database.
+type Searcher struct {
+	db database.Service
+}
+
+// New creates a Searcher.
+func New(db database.Service) *Searcher {
+	return &Searcher{db: db}
+}
+
+// Result is one matching message. Snippet and Subject are HTML with matches
+// wrapped in <mark>.
+type Result struct {
+	ID             string    `json:"id"`
+	Subject        string    `json:"subject"`
+	FromName       string    `json:"from_name"`
+	FromAddress    string    `json:"from_address"`
+	SentAt         time.Time `json:"sent_at"`
+	ReceivedAt     time.Time `json:"received_at"`
+	HasAttachments bool      `json:"has_attachments"`
+	Snippet        string    `json:"snippet"`
+	Score          float64   `json:"score"`
+}
+
+// Page is one page of results. NextCursor is empty on the last page.
+type Page struct {
+	Results    []Result `json:"results"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// cursor is the position after the last result of a page. Text queries are
+// ordered by bm25 score; filter-only queries by receipt time, newest first.
+// Query is the fingerprint of the query the page answered.
+type cursor struct {
+	Query      string    `json:"q"`
+	Score      float64   `json:"s,omitempty"`
+	ReceivedAt time.Time `json:"t"`
+	ID         string    `json:"id"`
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor decodes a cursor, which must have been produced for q.
+func decodeCursor(s string, q Query) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == "" || c.Query != q.fingerprint() {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// fingerprint identifies a parsed query. Queries that differ only in
+// spelling, such as the order of filters or the case of qualifiers, parse
+// to the same Query and share a fingerprint.
+func (q Query) fingerprint() string {
+	b, _ := json.Marshal(q)
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// Search returns the page of userID's messages matching q that follows
+// after, which is "" for the first page. Scores change as messages are
+// added, so a cursor only gives a stable order while the index is unchanged.
+func (s *Searcher) Search(ctx context.Context, userID string, q Query, after string, limit int) (Page, error) {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+
+	var pos *cursor
+	if after != "" {
+		var err error
+		if pos, err = decodeCursor(after, q); err != nil {
+			return Page{}, err
+		}
+	}
+
+	query, args := buildQuery(userID, q, pos, limit+1)
+	rows, err := s.db.DB().QueryContext(ctx, query, args...)
+	if err != nil {
+		return Page{}, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	page := Page{Results: []Result{}}
+	for rows.Next() {
+		var r Result
+		var subject, snippet string
+		err := rows.Scan(&r.ID, &r.FromName, &r.FromAddress, &r.SentAt, &r.ReceivedAt,
+			&r.HasAttachments, &r.Score, &subject, &snippet)
+		if err != nil {
+			return Page{}, fmt.Errorf("failed to read search result: %w", err)
+		}
+		r.Subject = markHTML(subject)
+		r.Snippet = markHTML(snippet)
+		page.Results = append(page.Results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return Page{}, fmt.Errorf("failed to search messages: %w", err)
+	}
+
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+		last := page.Results[limit-1]
+		next := cursor{Query: q.fingerprint(), ID: last.ID}
+		if q.Match != "" {
+			next.Score = last.Score
+		} else {
+			next.ReceivedAt = last.ReceivedAt
+		}
+		page.NextCursor = next.encode()
+	}
+	return page, nil
+}
+
+// IDs returns the IDs of up to limit of userID's messages matching q, in
+// the order Search returns them.
+func (s *Searcher) IDs(ctx context.Context, userID string, q Query, limit int) ([]string, error) {
+	query, args := buildQuery(userID, q, nil, limit)
+	rows, err := s.db.DB().QueryContext(ctx, "SELECT id FROM ("+query+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to read search result: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	return ids, nil
+}
+
+// Match returns those of ids, userID's messages, that match q.
+func (s *Searcher) Match(ctx context.Context, userID string, q Query, ids []string) (map[string]bool, error) {
+	matched := make(map[string]bool, len(ids))
+	if len(ids) == 0 {
+		return matched, nil
+	}
+	q.ids = ids
+	found, err := s.IDs(ctx, userID, q, len(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range found {
+		matched[id] = true
+	}
+	return matched, nil
+}
+
+// buildQuery assembles the search SQL. The FTS5 functions only exist in a
+// query that scans message_search, so filter-only searches select from the
+// message table directly with a zero score and a plain-text snippet.
+func buildQuery(userID string, q Query, pos *cursor, limit int) (string, []interface{}) {
+	var b strings.Builder
+	var args []interface{}
+
+	if q.Match != "" {
+		score := "bm25(message_search, " + bm25Weights + ")"
+		b.WriteString(`SELECT m.id, m.from_name, m.from_address, m.sent_at, m.received_at, m.has_attachments, ` +
+			score + ` AS score, highlight(message_search, 0, char(2), char(3)), snippet(message_search, 3, char(2), char(3), '…', 24)
+FROM message_search
+JOIN message_search_content c ON c.doc_id = message_search.rowid
+JOIN message m ON m.id = c.message_id
+WHERE message_search MATCH ? AND c.user_id = ?`)
+		args = append(args, q.Match, userID)
+		if pos != nil {
+			b.WriteString(" AND (" + score + " > ? OR (" + score + " = ? AND m.id > ?))")
+			args = append(args, pos.Score, pos.Score, pos.ID)
+		}
+	} else {
+		b.WriteString(`SELECT m.id, m.from_name, m.from_address, m.sent_at, m.received_at, m.has_attachments,
+0.0 AS score, m.subject, substr(coalesce(c.body, ''), 1, 200)
+FROM message m
+LEFT JOIN message_search_content c ON c.message_id = m.id
+WHERE m.user_id = ?`)
+		args = append(args, userID)
+		if pos != nil {
+			b.WriteString(" AND (m.received_at < ? OR (m.received_at = ? AND m.id < ?))")
+			args = append(args, pos.ReceivedAt.UTC(), pos.ReceivedAt.UTC(), pos.ID)
+		}
+	}
+
+	if len(q.ids) > 0 {
+		b.WriteString(" AND m.id IN (?" + strings.Repeat(", ?", len(q.ids)-1) + ")")
+		for _, id := range q.ids {
+			args = append(args, id)
+		}
+	}
+	if q.HasAttachment {
+		b.WriteString(" AND m.has_attachments = 1")
+	}
+	if !q.Before.IsZero() {
+		b.WriteString(" AND m.sent_at < ?")
+		args = append(args, q.Before)
+	}
+	if !q.After.IsZero() {
+		b.WriteString(" AND m.sent_at >= ?")
+		args = append(args, q.After)
+	}
+
+	if q.Match != "" {
+		b.WriteString("\nORDER BY score, m.id")
+	} else {
+		b.WriteString("\nORDER BY m.received_at DESC, m.id DESC")
+	}
+	b.WriteString("\nLIMIT ?")
+	args = append(args, limit)
+	return b.String(), args
+}
+
+// markHTML escapes text from the index and turns the match markers into
+// <mark> elements.
+func markHTML(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, markStart, "<mark>")
+	return strings.ReplaceAll(s, markEnd, "</mark>")
+}
@@ -0,0 +1,248 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+)
+
+func TestParseQuery(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	for _, c := range []struct {
+		in   string
+		want Query
+	}{
+		{"hello world", Query{Match: `("hello" AND "world")`}},
+		{`"exact phrase"`, Query{Match: `("exact phrase")`}},
+		{`from:alice Subject:"weekly report"`, Query{Match: `(from_text : "alice" AND subject : "weekly report")`}},
+		{"filename:invoice.pdf to:bob body:lunch", Query{Match: `(attachments : "invoice.pdf" AND to_text : "bob" AND body : "lunch")`}},
+		{"invoice -draft -from:bob", Query{Match: `("invoice") NOT "draft" NOT from_text : "bob"`}},
+		{"rep* rep**", Query{Match: `("rep" * AND "rep" *)`}},
+		{`"rep*"`, Query{Match: `("rep*")`}},
+		// FTS5 syntax in the input is only ever text
+		{"foo OR bar", Query{Match: `("foo" AND "OR" AND "bar")`}},
+		{"NEAR(a b) ^start", Query{Match: `("NEAR(a" AND "b)" AND "^start")`}},
+		{`say"hi`, Query{Match: `("sayhi")`}},
+		{"col:value", Query{Match: `("col:value")`}},
+		{"invoice * -", Query{Match: `("invoice")`}},
+		{"has:attachment", Query{HasAttachment: true}},
+		{"after:2024-01-02 before:2024/02/01 report", Query{
+			Match:  `("report")`,
+			After:  day("2024-01-02"),
+			Before: day("2024-02-01"),
+		}},
+	} {
+		got, err := ParseQuery(c.in)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", c.in, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", c.in, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		in   string
+		want error
+	}{
+		{"", ErrEmptyQuery},
+		{"  * - ", ErrEmptyQuery},
+		{"-draft", ErrInvalidQuery},
+		{"from:", ErrInvalidQuery},
+		{"has:nothing", ErrInvalidQuery},
+		{"-has:attachment", ErrInvalidQuery},
+		{"before:yesterday", ErrInvalidQuery},
+		{"-after:2024-01-01 x", ErrInvalidQuery},
+	} {
+		if _, err := ParseQuery(c.in); !errors.Is(err, c.want) {
+			t.Errorf("ParseQuery(%q) = %v, want %v", c.in, err, c.want)
+		}
+	}
+}
+
+// testMessage is a message to index for u1.
+type testMessage struct {
+	id, subject, from, body string
+	received                time.Time
+	attachment              bool
+}
+
+func newTestSearcher(t *testing.T, msgs ...testMessage) *Searcher {
+	t.Helper()
+	db := dbtest.New(t)
+	for _, m := range msgs {
+		rec := database.MessageRecord{
+			Message: schema.InsertMessageParams{
+				ID:             m.id,
+				UserID:         "u1",
+				Subject:        m.subject,
+				FromAddress:    m.from,
+				SentAt:         m.received,
+				ReceivedAt:     m.received,
+				HasAttachments: m.attachment,
+			},
+			Body: schema.InsertMessageBodyParams{TextBody: m.body},
+		}
+		if err := db.InsertMessage(context.Background(), rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return New(db)
+}
+
+func mustParseQuery(t *testing.T, s string) Query {
+	t.Helper()
+	q, err := ParseQuery(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func resultIDs(p Page) string {
+	ids := make([]string, len(p.Results))
+	for i, r := range p.Results {
+		ids[i] = r.ID
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestSearchRanksByField(t *testing.T) {
+	now := time.Now().UTC()
+	s := newTestSearcher(t,
+		testMessage{id: "body", subject: "Hello", from: "carol@example.org", body: "the budget is attached", received: now},
+		testMessage{id: "subject", subject: "Budget for 2025", from: "alice@example.org", body: "see inside", received: now},
+		testMessage{id: "from", subject: "Hi", from: "budget@example.org", body: "numbers", received: now},
+		testMessage{id: "other", subject: "Lunch", from: "bob@example.org", body: "noon?", received: now},
+	)
+
+	page, err := s.Search(context.Background(), "u1", mustParseQuery(t, "budget"), "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resultIDs(page); got != "subject from body" {
+		t.Errorf("got results %q, want subject, from then body matches", got)
+	}
+	if page.NextCursor != "" {
+		t.Errorf("got a cursor %q on the only page", page.NextCursor)
+	}
+	if r := page.Results[0]; r.Subject != "<mark>Budget</mark> for 2025" {
+		t.Errorf("got subject %q", r.Subject)
+	}
+	if r := page.Results[2]; !strings.Contains(r.Snippet, "the <mark>budget</mark> is") {
+		t.Errorf("got snippet %q", r.Snippet)
+	}
+
+	matched, err := s.Match(context.Background(), "u1", mustParseQuery(t, "budget"), []string{"body", "other", "missing"})
+	if err != nil || len(matched) != 1 || !matched["body"] {
+		t.Errorf("Match got %v, %v; want only body", matched, err)
+	}
+
+	// Operators in the input are searched for as text rather than failing
+	for _, in := range []string{"budget OR lunch", `NEAR(budget lunch)`, `"budget" AND`} {
+		if _, err := s.Search(context.Background(), "u1", mustParseQuery(t, in), "", 10); err != nil {
+			t.Errorf("Search(%q): %v", in, err)
+		}
+	}
+}
+
+// collect pages through every result of q, limit at a time.
+func collect(t *testing.T, s *Searcher, q Query, limit int) ([]string, int) {
+	t.Helper()
+	var ids []string
+	pages := 0
+	after := ""
+	for {
+		page, err := s.Search(context.Background(), "u1", q, after, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, r := range page.Results {
+			ids = append(ids, r.ID)
+		}
+		if page.NextCursor == "" {
+			return ids, pages
+		}
+		after = page.NextCursor
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	var msgs []testMessage
+	for i := 0; i < 7; i++ {
+		msgs = append(msgs, testMessage{
+			id:         fmt.Sprintf("m%d", i),
+			subject:    "weekly report",
+			body:       strings.Repeat("filler ", i),
+			received:   base.Add(time.Duration(i%3) * time.Hour),
+			attachment: i%2 == 0,
+		})
+	}
+	s := newTestSearcher(t, msgs...)
+
+	// Pages of a text query follow the bm25 order without gaps or repeats
+	q := mustParseQuery(t, "report")
+	all, err := s.Search(context.Background(), "u1", q, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, pages := collect(t, s, q, 2)
+	if strings.Join(ids, " ") != resultIDs(all) || pages != 4 {
+		t.Errorf("got %v in %d pages, want %q in 4", ids, pages, resultIDs(all))
+	}
+	ids, err = s.IDs(context.Background(), "u1", q, 100)
+	if err != nil || strings.Join(ids, " ") != resultIDs(all) {
+		t.Errorf("got IDs %v, %v; want %q", ids, err, resultIDs(all))
+	}
+
+	// Filter-only queries page newest first, ties broken by ID
+	ids, _ = collect(t, s, mustParseQuery(t, "has:attachment"), 3)
+	if got := strings.Join(ids, " "); got != "m2 m4 m6 m0" {
+		t.Errorf("got %q, want m2 m4 m6 m0", got)
+	}
+}
+
+func TestSearchCursorBelongsToItsQuery(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	s := newTestSearcher(t,
+		testMessage{id: "a", subject: "report one", received: now},
+		testMessage{id: "b", subject: "report two", received: now},
+		testMessage{id: "c", subject: "budget", received: now},
+	)
+
+	q := mustParseQuery(t, "subject:report has:attachment")
+	page, err := s.Search(ctx, "u1", mustParseQuery(t, "subject:report"), "", 1)
+	if err != nil || page.NextCursor == "" {
+		t.Fatalf("Search = %+v, %v", page, err)
+	}
+	for _, other := range []Query{q, mustParseQuery(t, "report"), mustParseQuery(t, "budget")} {
+		if _, err := s.Search(ctx, "u1", other, page.NextCursor, 1); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("cursor of subject:report used for %q: got %v, want ErrInvalidCursor", other.Match, err)
+		}
+	}
+	for _, bad := range []string{"!!", "e30", "bm90IGpzb24"} {
+		if _, err := s.Search(ctx, "u1", q, bad, 1); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("cursor %q: got %v, want ErrInvalidCursor", bad, err)
+		}
+	}
+
+	// The same query spelled differently takes the cursor
+	page, err = s.Search(ctx, "u1", mustParseQuery(t, "SUBJECT:report"), page.NextCursor, 1)
+	if err != nil || len(page.Results) != 1 {
+		t.Errorf("second page = %+v, %v", page, err)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+)
+
+// handleGetAttachment streams the content of one attachment of a message,
+// identified by its part path (e.g. "2" or "1.2"). Range requests are
+// supported.
+func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	q := s.db.Queries()
+	msg, err := q.GetMessage(r.Context(), schema.GetMessageParams{ID: r.PathValue("id"), UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, "not_found", "Message not found")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_get_message").Inc()
+		logger.Error(r.Context(), "Failed to get message", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get attachment")
+		return
+	}
+
+	att, err := q.GetAttachment(r.Context(), schema.GetAttachmentParams{MessageID: msg.ID, Part: r.PathValue("part")})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, "not_found", "Attachment not found")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_get_attachment").Inc()
+		logger.Error(r.Context(), "Failed to get attachment", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get attachment")
+		return
+	}
+	if att.BlobHash == "" {
+		writeError(w, r, http.StatusNotFound, "not_found", "Attachment content is not available")
+		return
+	}
+
+	content, err := s.store.Blobs().Open(r.Context(), att.BlobHash, att.Size)
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			metrics.Errors.WithLabelValues("blob_missing").Inc()
+			logger.Error(r.Context(), "Attachment content is missing from the blob store", "hash", att.BlobHash)
+			writeError(w, r, http.StatusNotFound, "not_found", "Attachment content is not available")
+			return
+		}
+		metrics.Errors.WithLabelValues("blob_open").Inc()
+		logger.Error(r.Context(), "Failed to open attachment content", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get attachment")
+		return
+	}
+	defer content.Close()
+
+	contentType := att.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	filename := att.Filename
+	if filename == "" {
+		filename = "attachment"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+att.BlobHash+`"`)
+	http.ServeContent(w, r, "", msg.ReceivedAt, content)
+}
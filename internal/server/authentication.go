@@ -0,0 +1,82 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/mailauth"
+)
+
+// authenticationResponse is the API view of the DKIM, SPF, DMARC and ARC
+// verdict on a message delivered over SMTP or LMTP. dmarc_override names
+// the trusted ARC sealer that vouched for a message failing DMARC; spoofed
+// is set when the From domain failed DMARC without one. results is the
+// Authentication-Results field value.
+type authenticationResponse struct {
+	DKIM          string `json:"dkim"`
+	SPF           string `json:"spf"`
+	DMARC         string `json:"dmarc"`
+	DMARCPolicy   string `json:"dmarc_policy,omitempty"`
+	DMARCOverride string `json:"dmarc_override,omitempty"`
+	ARC           string `json:"arc"`
+	HeaderFrom    string `json:"header_from,omitempty"`
+	Spoofed       bool   `json:"spoofed"`
+	Results       string `json:"results"`
+}
+
+func newAuthenticationResponse(a schema.MessageAuth) *authenticationResponse {
+	return &authenticationResponse{
+		DKIM:          a.Dkim,
+		SPF:           a.Spf,
+		DMARC:         a.Dmarc,
+		DMARCPolicy:   a.DmarcPolicy,
+		DMARCOverride: a.DmarcOverride,
+		ARC:           a.Arc,
+		HeaderFrom:    a.HeaderFrom,
+		Spoofed:       a.Dmarc == mailauth.ResultFail && a.DmarcOverride == "",
+		Results:       a.Results,
+	}
+}
+
+// handleGetMessageAuthentication returns the authentication verdict on one
+// of the authenticated user's messages. Messages that didn't arrive over
+// SMTP or LMTP have none.
+func (s *Server) handleGetMessageAuthentication(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	q := s.db.Queries()
+	msg, err := q.GetMessage(r.Context(), schema.GetMessageParams{ID: r.PathValue("id"), UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, "not_found", "Message not found")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_get_message").Inc()
+		logger.Error(r.Context(), "Failed to get message", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get message authentication")
+		return
+	}
+
+	a, err := q.GetMessageAuth(r.Context(), msg.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, "not_authenticated", "Message was not authenticated")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_get_message_auth").Inc()
+		logger.Error(r.Context(), "Failed to get message authentication", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get message authentication")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newAuthenticationResponse(a))
+}
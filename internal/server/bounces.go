@@ -0,0 +1,108 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/bounce"
+)
+
+// handleListMessageBounces lists the bounces recorded for one of the
+// authenticated user's sent messages.
+func (s *Server) handleListMessageBounces(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	msg, err := s.db.Queries().GetMessage(r.Context(), schema.GetMessageParams{ID: r.PathValue("id"), UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, "not_found", "Message not found")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_get_message").Inc()
+		logger.Error(r.Context(), "Failed to get message", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to list bounces")
+		return
+	}
+
+	list, err := s.bounces.Bounces(r.Context(), userID, msg.ID)
+	if err != nil {
+		s.writeBounceError(w, r, err, "Failed to list bounces")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"bounces": list})
+}
+
+// handleListSuppressions lists the authenticated user's suppressed
+// recipients.
+func (s *Server) handleListSuppressions(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	list, err := s.bounces.List(r.Context(), userID)
+	if err != nil {
+		s.writeBounceError(w, r, err, "Failed to list suppressions")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"suppressions": list})
+}
+
+// handleGetSuppression returns why one recipient is suppressed.
+func (s *Server) handleGetSuppression(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	sup, err := s.bounces.Get(r.Context(), userID, r.PathValue("address"))
+	if err != nil {
+		s.writeBounceError(w, r, err, "Failed to get suppression")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, sup)
+}
+
+// handleDeleteSuppression clears a recipient from the authenticated user's
+// suppression list.
+func (s *Server) handleDeleteSuppression(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	if err := s.bounces.Delete(r.Context(), userID, r.PathValue("address")); err != nil {
+		s.writeBounceError(w, r, err, "Failed to delete suppression")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeBounceError maps bounce errors onto API responses; message describes
+// a failure that isn't the client's.
+func (s *Server) writeBounceError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, bounce.ErrSuppressionNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Address is not suppressed")
+	default:
+		metrics.Errors.WithLabelValues("database_bounce").Inc()
+		logger.Error(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", message)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+)
+
+func TestSuppressionsAPI(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t)
+
+	err := ts.db.Queries().UpsertSuppression(ctx, schema.UpsertSuppressionParams{
+		UserID:     "u1",
+		Address:    "gone@example.net",
+		Status:     "5.1.1",
+		Diagnostic: "550 5.1.1 User unknown",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := ts.do(t, http.MethodGet, "u1", "/api/v1/suppressions", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"address":"gone@example.net"`) {
+		t.Errorf("list got status %d: %s", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u2", "/api/v1/suppressions", nil)
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, "gone@") {
+		t.Errorf("other user's list got status %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(ingestRaw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ingest got status %d: %s", resp.StatusCode, body)
+	}
+	messageID := resp.Header.Get("Location")
+
+	path := "/api/v1/suppressions/Gone@example.net"
+	for _, c := range []struct {
+		method, userID, path string
+		wantStatus           int
+	}{
+		{http.MethodGet, "u1", path, http.StatusOK},
+		{http.MethodGet, "u2", path, http.StatusNotFound},
+		{http.MethodDelete, "u2", path, http.StatusNotFound},
+		{http.MethodDelete, "u1", path, http.StatusNoContent},
+		{http.MethodGet, "u1", path, http.StatusNotFound},
+		{http.MethodGet, "u1", messageID + "/bounces", http.StatusOK},
+		{http.MethodGet, "u2", messageID + "/bounces", http.StatusNotFound},
+	} {
+		resp, body := ts.do(t, c.method, c.userID, c.path, nil)
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s %s as %s: got status %d, want %d: %s", c.method, c.path, c.userID, resp.StatusCode, c.wantStatus, body)
+		}
+	}
+}
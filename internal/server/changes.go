@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/changelog"
+)
+
+const (
+	defaultMaxChanges = 500
+	maxMaxChanges     = 5000
+)
+
+// changesResponse lists the messages and labels that changed between two
+// states. States are opaque to clients.
+type changesResponse struct {
+	OldState       string                  `json:"old_state,omitempty"`
+	NewState       string                  `json:"new_state"`
+	HasMoreChanges bool                    `json:"has_more_changes"`
+	Messages       changelog.EntityChanges `json:"messages"`
+	Labels         changelog.EntityChanges `json:"labels"`
+}
+
+// handleChanges returns what changed for the authenticated user since the
+// state since, for clients to sync with. Without since it returns the
+// current state, which a client reads before listing everything; with
+// has_more_changes set the client asks again from new_state. Parameters:
+// since and max_changes, which bounds the changes read at once. A state
+// from before the change log was compacted gets cannotCalculateChanges, and
+// the client lists everything again.
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	params := r.URL.Query()
+	limit := defaultMaxChanges
+	if v := params.Get("max_changes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxMaxChanges {
+			writeError(w, r, http.StatusBadRequest, "invalid_max_changes",
+				"max_changes must be between 1 and "+strconv.Itoa(maxMaxChanges))
+			return
+		}
+		limit = n
+	}
+
+	v := params.Get("since")
+	if v == "" {
+		state, err := s.changes.State(r.Context(), userID)
+		if err != nil {
+			metrics.Errors.WithLabelValues("database_get_changes").Inc()
+			logger.Error(r.Context(), "Failed to get state", "error", err)
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get changes")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, changesResponse{
+			NewState: strconv.FormatInt(state, 10),
+			Messages: changelog.EntityChanges{Created: []string{}, Updated: []string{}, Destroyed: []string{}},
+			Labels:   changelog.EntityChanges{Created: []string{}, Updated: []string{}, Destroyed: []string{}},
+		})
+		return
+	}
+	since, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || since < 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_state", "since must be a state returned by this endpoint")
+		return
+	}
+
+	c, err := s.changes.Changes(r.Context(), userID, since, limit)
+	if errors.Is(err, changelog.ErrCannotCalculateChanges) {
+		writeError(w, r, http.StatusGone, "cannotCalculateChanges",
+			"Changes since this state are no longer known; list everything again")
+		return
+	}
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_get_changes").Inc()
+		logger.Error(r.Context(), "Failed to get changes", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get changes")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, changesResponse{
+		OldState:       strconv.FormatInt(c.OldState, 10),
+		NewState:       strconv.FormatInt(c.NewState, 10),
+		HasMoreChanges: c.HasMore,
+		Messages:       c.Messages,
+		Labels:         c.Labels,
+	})
+}
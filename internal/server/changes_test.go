@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	ts := newTestServer(t)
+
+	getChanges := func(userID, query string) changesResponse {
+		t.Helper()
+		resp, body := ts.do(t, http.MethodGet, userID, "/api/v1/changes"+query, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s got status %d: %s", query, resp.StatusCode, body)
+		}
+		var c changesResponse
+		if err := json.Unmarshal([]byte(body), &c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	start := getChanges("u1", "")
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(ingestRaw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ingest got status %d: %s", resp.StatusCode, body)
+	}
+	messageID := strings.TrimPrefix(resp.Header.Get("Location"), "/api/v1/messages/")
+	resp, body = ts.do(t, http.MethodPost, "u1", "/api/v1/labels", strings.NewReader(`{"path": "Work"}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create label got status %d: %s", resp.StatusCode, body)
+	}
+	var label struct{ ID string }
+	if err := json.Unmarshal([]byte(body), &label); err != nil {
+		t.Fatal(err)
+	}
+
+	c := getChanges("u1", "?since="+start.NewState)
+	if c.OldState != start.NewState || c.NewState == start.NewState || c.HasMoreChanges {
+		t.Errorf("got %+v from %s", c, start.NewState)
+	}
+	if len(c.Messages.Created) != 1 || c.Messages.Created[0] != messageID || len(c.Labels.Created) != 1 || c.Labels.Created[0] != label.ID {
+		t.Errorf("got %+v, want message %s and label %s created", c, messageID, label.ID)
+	}
+	if c := getChanges("u1", "?since="+start.NewState+"&max_changes=1"); !c.HasMoreChanges {
+		t.Errorf("got %+v with max_changes=1, want more changes", c)
+	}
+	if c := getChanges("u2", "?since=0"); len(c.Messages.Created) != 0 {
+		t.Errorf("another user got %+v", c)
+	}
+
+	for query, want := range map[string]int{
+		"?since=x":                   http.StatusBadRequest,
+		"?since=0&max_changes=0":     http.StatusBadRequest,
+		"?since=" + c.NewState + "0": http.StatusGone,
+	} {
+		if resp, body := ts.do(t, http.MethodGet, "u1", "/api/v1/changes"+query, nil); resp.StatusCode != want {
+			t.Errorf("GET %s got status %d, want %d: %s", query, resp.StatusCode, want, body)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/credentials"
+)
+
+// maxCredentialSize bounds the JSON body of a new credential.
+const maxCredentialSize = 4 << 10
+
+// createdCredential is a new credential with its secret.
+type createdCredential struct {
+	credentials.Credential
+	Secret string `json:"secret"`
+}
+
+// handleListCredentials lists the authenticated user's API keys and app
+// passwords, without their secrets.
+func (s *Server) handleListCredentials(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	list, err := s.creds.List(r.Context(), userID)
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_list_credentials").Inc()
+		logger.Error(r.Context(), "Failed to list credentials", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to list credentials")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"credentials": list})
+}
+
+// handleCreateCredential makes an API key or app password for the
+// authenticated user. The response is the only one that includes the
+// secret.
+func (s *Server) handleCreateCredential(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCredentialSize)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON credential")
+		return
+	}
+
+	c, secret, err := s.creds.Create(r.Context(), userID, params.Kind, params.Name)
+	if err != nil {
+		s.writeCredentialError(w, r, err, "Failed to create credential")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/credentials/"+c.ID)
+	writeJSON(w, r, http.StatusCreated, createdCredential{Credential: c, Secret: secret})
+}
+
+// handleDeleteCredential revokes one of the authenticated user's
+// credentials.
+func (s *Server) handleDeleteCredential(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	if err := s.creds.Delete(r.Context(), userID, r.PathValue("id")); err != nil {
+		s.writeCredentialError(w, r, err, "Failed to delete credential")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeCredentialError maps credential errors onto API responses; message
+// describes a failure that isn't the client's.
+func (s *Server) writeCredentialError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, credentials.ErrInvalidCredential):
+		writeError(w, r, http.StatusBadRequest, "invalid_credential", err.Error())
+	case errors.Is(err, credentials.ErrCredentialNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Credential not found")
+	default:
+		metrics.Errors.WithLabelValues("database_credential").Inc()
+		logger.Error(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", message)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/credentials",
+		strings.NewReader(`{"kind": "app_password", "name": "Thunderbird"}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var created struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Secret == "" || resp.Header.Get("Location") != "/api/v1/credentials/"+created.ID {
+		t.Errorf("created %s with location %q", body, resp.Header.Get("Location"))
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/credentials", nil)
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, created.Secret) || !strings.Contains(body, `"name":"Thunderbird"`) {
+		t.Errorf("list got status %d: %s", resp.StatusCode, body)
+	}
+
+	path := "/api/v1/credentials/" + created.ID
+	for _, c := range []struct {
+		method, userID, path, body string
+		wantStatus                 int
+	}{
+		{http.MethodPost, "u1", "/api/v1/credentials", `{"kind": "password"}`, http.StatusBadRequest},
+		{http.MethodPost, "u1", "/api/v1/credentials", `[]`, http.StatusBadRequest},
+		{http.MethodDelete, "u2", path, "", http.StatusNotFound},
+		{http.MethodDelete, "u1", path, "", http.StatusNoContent},
+		{http.MethodDelete, "u1", path, "", http.StatusNotFound},
+	} {
+		resp, body := ts.do(t, c.method, c.userID, c.path, strings.NewReader(c.body))
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s %s as %s: got status %d, want %d: %s", c.method, c.path, c.userID, resp.StatusCode, c.wantStatus, body)
+		}
+	}
+}
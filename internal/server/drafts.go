@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/drafts"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+// handleListDrafts lists the authenticated user's drafts.
+func (s *Server) handleListDrafts(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	list, err := s.drafts.List(r.Context(), userID)
+	if err != nil {
+		s.writeDraftError(w, r, err, "Failed to list drafts")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"drafts": list})
+}
+
+// handleCreateDraft saves a draft for the authenticated user. The body is a
+// message as the send endpoint takes it, possibly incomplete.
+func (s *Server) handleCreateDraft(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	msg, ok := s.decodeDraft(w, r)
+	if !ok {
+		return
+	}
+	d, err := s.drafts.Create(r.Context(), userID, msg)
+	if err != nil {
+		s.writeDraftError(w, r, err, "Failed to create draft")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/drafts/"+d.ID)
+	writeJSON(w, r, http.StatusCreated, d)
+}
+
+// handleGetDraft returns one of the authenticated user's drafts.
+func (s *Server) handleGetDraft(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	d, err := s.drafts.Get(r.Context(), userID, r.PathValue("id"))
+	if err != nil {
+		s.writeDraftError(w, r, err, "Failed to get draft")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, d)
+}
+
+// handleUpdateDraft replaces the message of one of the authenticated user's
+// drafts. A scheduled draft stays scheduled.
+func (s *Server) handleUpdateDraft(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	msg, ok := s.decodeDraft(w, r)
+	if !ok {
+		return
+	}
+	d, err := s.drafts.Update(r.Context(), userID, r.PathValue("id"), msg)
+	if err != nil {
+		s.writeDraftError(w, r, err, "Failed to update draft")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, d)
+}
+
+// handleDeleteDraft removes one of the authenticated user's drafts.
+func (s *Server) handleDeleteDraft(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	if err := s.drafts.Delete(r.Context(), userID, r.PathValue("id")); err != nil {
+		s.writeDraftError(w, r, err, "Failed to delete draft")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scheduleRequest is the body of handleScheduleDraft.
+type scheduleRequest struct {
+	SendAt time.Time `json:"send_at"`
+}
+
+// handleScheduleDraft schedules, or reschedules, one of the authenticated
+// user's drafts to be sent at send_at (RFC 3339).
+func (s *Server) handleScheduleDraft(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+	if s.mailer == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "sending_disabled", "Outbound mail is not configured")
+		return
+	}
+
+	var req scheduleRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be JSON with an RFC 3339 send_at")
+		return
+	}
+	d, err := s.drafts.Schedule(r.Context(), userID, r.PathValue("id"), req.SendAt)
+	if err != nil {
+		s.writeDraftError(w, r, err, "Failed to schedule draft")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, d)
+}
+
+// handleUnscheduleDraft cancels sending one of the authenticated user's
+// drafts, keeping the draft.
+func (s *Server) handleUnscheduleDraft(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	d, err := s.drafts.Unschedule(r.Context(), userID, r.PathValue("id"))
+	if err != nil {
+		s.writeDraftError(w, r, err, "Failed to unschedule draft")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, d)
+}
+
+// decodeDraft reads the message of a draft from the request body, writing
+// the error response if it can't.
+func (s *Server) decodeDraft(w http.ResponseWriter, r *http.Request) (outbound.Message, bool) {
+	// Attachments are base64 in the body, a third larger than in the message
+	var msg outbound.Message
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.store.MaxMessageSize()*2)).Decode(&msg); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "message_too_large", "Message exceeds the maximum size")
+			return msg, false
+		}
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON message")
+		return msg, false
+	}
+	return msg, true
+}
+
+// writeDraftError maps draft errors onto API responses; message describes a
+// failure that isn't the client's.
+func (s *Server) writeDraftError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, drafts.ErrDraftNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Draft not found")
+	case errors.Is(err, drafts.ErrDraftSending):
+		writeError(w, r, http.StatusConflict, "draft_sending", "Draft is being sent")
+	case errors.Is(err, drafts.ErrInvalidSchedule):
+		writeError(w, r, http.StatusBadRequest, "invalid_schedule", err.Error())
+	case errors.Is(err, outbound.ErrInvalidMessage):
+		writeError(w, r, http.StatusBadRequest, "invalid_message", err.Error())
+	default:
+		metrics.Errors.WithLabelValues("database_draft").Inc()
+		logger.Error(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", message)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/parsel-email/mailroom/internal/drafts"
+)
+
+func TestDraftsAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/drafts", strings.NewReader(`{"subject": "Weekly status"}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var created drafts.Draft
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Status != drafts.StatusDraft || resp.Header.Get("Location") != "/api/v1/drafts/"+created.ID {
+		t.Errorf("created %s with location %q", body, resp.Header.Get("Location"))
+	}
+
+	path := "/api/v1/drafts/" + created.ID
+	resp, body = ts.do(t, http.MethodPut, "u1", path,
+		strings.NewReader(`{"to": ["team@example.com"], "subject": "Weekly status", "text": "All good."}`))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"text":"All good."`) {
+		t.Errorf("update got status %d: %s", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/drafts", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, created.ID) {
+		t.Errorf("list got status %d: %s", resp.StatusCode, body)
+	}
+
+	for _, c := range []struct {
+		method, userID, path, body string
+		wantStatus                 int
+	}{
+		{http.MethodGet, "u2", path, "", http.StatusNotFound},
+		{http.MethodPut, "u2", path, `{"subject": "Mine now"}`, http.StatusNotFound},
+		{http.MethodPost, "u1", "/api/v1/drafts", `{"to": "not a list"}`, http.StatusBadRequest},
+		// Sending isn't configured in tests
+		{http.MethodPut, "u1", path + "/schedule", `{"send_at": "2030-01-02T09:00:00Z"}`, http.StatusServiceUnavailable},
+		{http.MethodDelete, "u1", path + "/schedule", "", http.StatusOK},
+		{http.MethodDelete, "u1", path, "", http.StatusNoContent},
+		{http.MethodDelete, "u1", path, "", http.StatusNotFound},
+	} {
+		resp, body := ts.do(t, c.method, c.userID, c.path, strings.NewReader(c.body))
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s %s as %s: got status %d, want %d: %s", c.method, c.path, c.userID, resp.StatusCode, c.wantStatus, body)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/changelog"
+)
+
+const (
+	// eventsPageSize bounds the events read from the change log at once.
+	eventsPageSize = 500
+	// eventsPingInterval is how often an idle stream gets a comment, so
+	// that proxies keep it open and a gone client is noticed.
+	eventsPingInterval = 15 * time.Second
+)
+
+// handleEvents streams changes to the authenticated user's messages and
+// labels as server-sent events, named after their type and with their
+// change log ID. A client that reconnects with Last-Event-ID gets the
+// changes it missed; any other starts from the present. If some of those
+// changes have since been compacted away, the stream starts from the
+// present with a reset event instead, after which the client lists
+// everything again.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	last := r.Header.Get("Last-Event-ID")
+	var after int64
+	if last != "" {
+		after, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || after < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_event_id", "Last-Event-ID must be an event ID")
+			return
+		}
+		err = s.changes.Resume(r.Context(), userID, after)
+	}
+	reset := errors.Is(err, changelog.ErrCannotCalculateChanges)
+	if last == "" || reset {
+		after, err = s.changes.Last(r.Context(), userID)
+	}
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_get_changes").Inc()
+		logger.Error(r.Context(), "Failed to get last change", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to stream events")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if reset {
+		// With the ID to resume from once the client has caught up
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", after); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	poll := time.NewTicker(s.eventsPollInterval)
+	defer poll.Stop()
+	ping := time.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+	for {
+		events, err := s.changes.List(r.Context(), userID, after, eventsPageSize)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			metrics.Errors.WithLabelValues("database_list_changes").Inc()
+			logger.Error(r.Context(), "Failed to list changes", "error", err)
+			return
+		}
+		for _, e := range events {
+			data, err := json.Marshal(e)
+			if err != nil {
+				metrics.Errors.WithLabelValues("response_encode").Inc()
+				logger.Error(r.Context(), "Failed to encode event", "error", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return
+			}
+			after = e.ID
+		}
+		if len(events) > 0 {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+		// A full page means more are waiting
+		if len(events) == eventsPageSize {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-poll.C:
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
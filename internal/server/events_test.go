@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/changelog"
+	"golang.org/x/net/websocket"
+)
+
+// sseEvent is a server-sent event as a client reads it.
+type sseEvent struct {
+	id, name string
+	data     changelog.Event
+}
+
+// openEvents opens userID's event stream, resuming after lastID if it is
+// set, and returns the events read from it.
+func (ts *testServer) openEvents(t *testing.T, userID, lastID string) <-chan sseEvent {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", token(t, userID))
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d, %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer close(events)
+		var e sseEvent
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case line == "":
+				if e.id != "" {
+					events <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("stream closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return sseEvent{}
+}
+
+func TestEventsStream(t *testing.T) {
+	ts := newTestServer(t)
+
+	if resp, body := ts.do(t, http.MethodGet, "u1", "/api/v1/events", nil, "Last-Event-ID", "x"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid Last-Event-ID got status %d: %s", resp.StatusCode, body)
+	}
+
+	// A new stream starts from the present
+	events := ts.openEvents(t, "u1", "")
+	other := ts.openEvents(t, "u2", "")
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(ingestRaw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ingest got status %d: %s", resp.StatusCode, body)
+	}
+	messageID := strings.TrimPrefix(resp.Header.Get("Location"), "/api/v1/messages/")
+
+	created := nextEvent(t, events)
+	if created.name != changelog.EventMessageCreated || created.data.MessageID != messageID || created.id != strconv.FormatInt(created.data.ID, 10) {
+		t.Fatalf("got %+v, want the creation of %s", created, messageID)
+	}
+
+	resp, body = ts.do(t, http.MethodPatch, "u1", "/api/v1/messages",
+		strings.NewReader(`{"ids": ["`+messageID+`"], "starred": true}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH got status %d: %s", resp.StatusCode, body)
+	}
+	var flagged sseEvent
+	for flagged.name != changelog.EventMessageFlagsChanged {
+		flagged = nextEvent(t, events)
+	}
+	if flagged.data.Flag != "starred" || flagged.data.Added == nil || !*flagged.data.Added {
+		t.Errorf("got %+v, want starred set", flagged.data)
+	}
+
+	select {
+	case e := <-other:
+		t.Errorf("another user got %+v", e)
+	default:
+	}
+
+	// Resuming replays what came after the last event seen
+	resumed := ts.openEvents(t, "u1", created.id)
+	for {
+		e := nextEvent(t, resumed)
+		if e.data.ID <= created.data.ID {
+			t.Fatalf("resumed stream replayed %+v", e)
+		}
+		if e.id == flagged.id {
+			break
+		}
+	}
+}
+
+// A stream resumed from before the log was compacted is told to reset.
+func TestEventsReset(t *testing.T) {
+	ts := newTestServer(t)
+	events := ts.openEvents(t, "u1", "")
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(ingestRaw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ingest got status %d: %s", resp.StatusCode, body)
+	}
+	created := nextEvent(t, events)
+
+	// Compact the log through the event
+	ctx := context.Background()
+	q := ts.db.Queries()
+	state, err := q.GetModseq(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.DeleteChangesThrough(ctx, schema.DeleteChangesThroughParams{UserID: "u1", Modseq: state.Modseq}); err != nil {
+		t.Fatal(err)
+	}
+	err = q.SetCompactedModseq(ctx, schema.SetCompactedModseqParams{
+		Compacted:   state.Modseq,
+		CompactedID: created.data.ID,
+		UserID:      "u1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resuming from the event misses nothing, but resuming from before it
+	// does
+	if e, ok := nextOrNone(ts.openEvents(t, "u1", created.id)); ok {
+		t.Errorf("resuming from the last event got %+v", e)
+	}
+	reset := nextEvent(t, ts.openEvents(t, "u1", "0"))
+	if reset.name != "reset" || reset.id != created.id {
+		t.Errorf("got %+v, want a reset to %s", reset, created.id)
+	}
+}
+
+// nextOrNone returns the next event of events if one comes soon.
+func nextOrNone(events <-chan sseEvent) (sseEvent, bool) {
+	select {
+	case e, ok := <-events:
+		return e, ok
+	case <-time.After(200 * time.Millisecond):
+		return sseEvent{}, false
+	}
+}
+
+// Shutting down ends open streams.
+func TestEventsShutdown(t *testing.T) {
+	ts := newTestServer(t)
+	events := ts.openEvents(t, "u1", "")
+
+	// The open stream doesn't hold up shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := ts.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("got an event, want the stream closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("stream still open")
+	}
+}
+
+// The WebSocket endpoint upgrades through the middleware.
+func TestPushUpgrade(t *testing.T) {
+	ts := newTestServer(t)
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/v1/push", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header.Set("Authorization", token(t, "u1"))
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m struct{ Type string }
+	if err := websocket.JSON.Receive(ws, &m); err != nil || m.Type != "ready" {
+		t.Fatalf("got %+v, %v; want ready", m, err)
+	}
+	if err := websocket.JSON.Send(ws, map[string]string{"type": "subscribe", "id": "s", "label": "Inbox"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.JSON.Receive(ws, &m); err != nil || m.Type != "subscribed" {
+		t.Errorf("got %+v, %v; want subscribed", m, err)
+	}
+}
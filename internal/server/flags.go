@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/search"
+)
+
+// maxFlagsSize bounds the JSON body of a flag change; it fits the IDs of
+// flags.MaxMessages messages.
+const maxFlagsSize = 1 << 20
+
+// handleGetMessageFlags returns the flags of one of the authenticated user's
+// messages.
+func (s *Server) handleGetMessageFlags(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	f, err := s.flags.Get(r.Context(), userID, r.PathValue("id"))
+	if err != nil {
+		s.writeFlagsError(w, r, err, "Failed to get message flags")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, f)
+}
+
+// handleUpdateMessages changes the flags of a batch of the authenticated
+// user's messages in one transaction: those with the given ids, or those
+// matching a search query. The response has the outcome for each message,
+// including IDs that weren't found.
+func (s *Server) handleUpdateMessages(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params struct {
+		IDs   []string `json:"ids"`
+		Query string   `json:"query"`
+		flags.Change
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFlagsSize)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON flag change")
+		return
+	}
+	if (len(params.IDs) == 0) == (params.Query == "") {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Exactly one of ids and query is required")
+		return
+	}
+
+	ids := params.IDs
+	if params.Query != "" {
+		q, err := search.ParseQuery(params.Query)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error())
+			return
+		}
+		if ids, err = s.search.IDs(r.Context(), userID, q, flags.MaxMessages+1); err != nil {
+			metrics.Errors.WithLabelValues("database_search_messages").Inc()
+			logger.Error(r.Context(), "Failed to search messages", "error", err)
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to update messages")
+			return
+		}
+		if len(ids) > flags.MaxMessages {
+			writeError(w, r, http.StatusBadRequest, "too_many_messages",
+				"Query matches more than "+strconv.Itoa(flags.MaxMessages)+" messages")
+			return
+		}
+	}
+
+	outcomes, err := s.flags.Apply(r.Context(), userID, ids, params.Change)
+	if err != nil {
+		s.writeFlagsError(w, r, err, "Failed to update messages")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"results": outcomes})
+}
+
+// writeFlagsError maps flag errors onto API responses; message describes a
+// failure that isn't the client's.
+func (s *Server) writeFlagsError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, flags.ErrMessageNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Message not found")
+	case errors.Is(err, flags.ErrInvalidChange):
+		writeError(w, r, http.StatusBadRequest, "invalid_change", err.Error())
+	default:
+		metrics.Errors.WithLabelValues("database_flags").Inc()
+		logger.Error(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", message)
+	}
+}
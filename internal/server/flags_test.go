@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/parsel-email/mailroom/internal/flags"
+)
+
+func TestUpdateMessages(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(ingestRaw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ingest got status %d: %s", resp.StatusCode, body)
+	}
+	messagePath := resp.Header.Get("Location")
+	messageID := strings.TrimPrefix(messagePath, "/api/v1/messages/")
+
+	for _, c := range []struct {
+		userID, body string
+		wantStatus   int
+	}{
+		{"u1", `{"read": true}`, http.StatusBadRequest},
+		{"u1", `{"ids": ["x"], "query": "hello", "read": true}`, http.StatusBadRequest},
+		{"u1", `{"ids": ["x"]}`, http.StatusBadRequest},
+		{"u1", `{"ids": ["x"], "add_keywords": ["\\Seen"]}`, http.StatusBadRequest},
+		{"u1", `{"query": "before:yesterday", "read": true}`, http.StatusBadRequest},
+		{"u1", `not json`, http.StatusBadRequest},
+	} {
+		resp, got := ts.do(t, http.MethodPatch, c.userID, "/api/v1/messages", strings.NewReader(c.body))
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("PATCH %s as %s: got status %d, want %d: %s", c.body, c.userID, resp.StatusCode, c.wantStatus, got)
+		}
+	}
+
+	patch := func(userID, body string) []flags.Outcome {
+		t.Helper()
+		resp, got := ts.do(t, http.MethodPatch, userID, "/api/v1/messages", strings.NewReader(body))
+		var out struct{ Results []flags.Outcome }
+		if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(got), &out) != nil {
+			t.Fatalf("PATCH %s got status %d: %s", body, resp.StatusCode, got)
+		}
+		return out.Results
+	}
+
+	results := patch("u1", `{"ids": ["`+messageID+`", "missing"], "read": true, "starred": true}`)
+	if len(results) != 2 || results[0].Status != flags.StatusUpdated || !results[0].Flags.Starred || results[1].Status != flags.StatusNotFound {
+		t.Errorf("got %+v", results)
+	}
+	results = patch("u2", `{"query": "hello", "read": false}`)
+	if len(results) != 0 {
+		t.Errorf("other user's query changed %+v", results)
+	}
+	results = patch("u1", `{"query": "subject:hello", "read": false, "add_keywords": ["todo"]}`)
+	if len(results) != 1 || results[0].ID != messageID || results[0].Flags.Read {
+		t.Errorf("got %+v", results)
+	}
+
+	resp, body = ts.do(t, http.MethodGet, "u1", messagePath+"/flags", nil)
+	if resp.StatusCode != http.StatusOK || body != `{"read":false,"starred":true,"important":false,"answered":false,"keywords":["todo"]}`+"\n" {
+		t.Errorf("get flags got status %d: %q", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u2", messagePath+"/flags", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("other user's flags got status %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJMAPRoutes(t *testing.T) {
+	ts := newTestServer(t)
+
+	api := `{"using": ["urn:ietf:params:jmap:core"], "methodCalls": [["Core/echo", {"ok": true}, "0"]]}`
+	for _, c := range []struct {
+		method, userID, path, body string
+		wantStatus                 int
+		wantBody                   string
+	}{
+		{http.MethodGet, "", "/.well-known/jmap", "", http.StatusUnauthorized, ""},
+		{http.MethodPost, "", "/jmap/api", api, http.StatusUnauthorized, ""},
+		{http.MethodGet, "u1", "/.well-known/jmap", "", http.StatusOK, `"username":"user@example.com"`},
+		{http.MethodPost, "u1", "/jmap/api", api, http.StatusOK, `["Core/echo",{"ok":true},"0"]`},
+		{http.MethodGet, "u1", "/jmap/download/u2/Mnope/x", "", http.StatusNotFound, ""},
+	} {
+		var resp *http.Response
+		var got string
+		if c.body != "" {
+			resp, got = ts.do(t, c.method, c.userID, c.path, strings.NewReader(c.body))
+		} else {
+			resp, got = ts.do(t, c.method, c.userID, c.path, nil)
+		}
+		if resp.StatusCode != c.wantStatus || !strings.Contains(got, c.wantBody) {
+			t.Errorf("%s %s as %q: got status %d: %s", c.method, c.path, c.userID, resp.StatusCode, got)
+		}
+	}
+}
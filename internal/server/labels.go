@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/labels"
+)
+
+const (
+	// maxLabelSize bounds the JSON body of a label.
+	maxLabelSize = 4 << 10
+	// maxLabelMessages bounds the messages one request labels.
+	maxLabelMessages = 1000
+)
+
+// labelParams is the body of a request creating or changing a label.
+type labelParams struct {
+	Path  string `json:"path"`
+	Color string `json:"color"`
+}
+
+// handleListLabels lists the authenticated user's labels with the number of
+// messages on each.
+func (s *Server) handleListLabels(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	list, err := s.labels.List(r.Context(), userID)
+	if err != nil {
+		s.writeLabelError(w, r, err, "Failed to list labels")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"labels": list})
+}
+
+// handleCreateLabel creates a label for the authenticated user, nested under
+// the labels its path names.
+func (s *Server) handleCreateLabel(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params labelParams
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLabelSize)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON label")
+		return
+	}
+
+	l, err := s.labels.Create(r.Context(), userID, params.Path, params.Color)
+	if err != nil {
+		s.writeLabelError(w, r, err, "Failed to create label")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/labels/"+l.ID)
+	writeJSON(w, r, http.StatusCreated, l)
+}
+
+// handleGetLabel returns one of the authenticated user's labels.
+func (s *Server) handleGetLabel(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	l, err := s.labels.Get(r.Context(), userID, r.PathValue("id"))
+	if err != nil {
+		s.writeLabelError(w, r, err, "Failed to get label")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, l)
+}
+
+// handleUpdateLabel renames or recolors one of the authenticated user's
+// labels.
+func (s *Server) handleUpdateLabel(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params labelParams
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLabelSize)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON label")
+		return
+	}
+
+	l, err := s.labels.Update(r.Context(), userID, r.PathValue("id"), params.Path, params.Color)
+	if err != nil {
+		s.writeLabelError(w, r, err, "Failed to update label")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, l)
+}
+
+// handleDeleteLabel deletes one of the authenticated user's labels and the
+// labels nested under it. Its messages are kept.
+func (s *Server) handleDeleteLabel(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	if err := s.labels.Delete(r.Context(), userID, r.PathValue("id")); err != nil {
+		s.writeLabelError(w, r, err, "Failed to delete label")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLabelMessages adds and removes labels, given by ID, on a batch of the
+// authenticated user's messages. Either every message is changed or none is.
+func (s *Server) handleLabelMessages(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params struct {
+		MessageIDs []string `json:"message_ids"`
+		Add        []string `json:"add"`
+		Remove     []string `json:"remove"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLabelMessages*64)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON object of message_ids, add and remove")
+		return
+	}
+	if len(params.MessageIDs) == 0 || len(params.MessageIDs) > maxLabelMessages {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Between 1 and 1000 message_ids are required")
+		return
+	}
+
+	if err := s.labels.Modify(r.Context(), userID, params.MessageIDs, params.Add, params.Remove); err != nil {
+		s.writeLabelError(w, r, err, "Failed to label messages")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeLabelError maps label errors onto API responses; message describes a
+// failure that isn't the client's.
+func (s *Server) writeLabelError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, labels.ErrLabelNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, labels.ErrMessageNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, labels.ErrLabelExists):
+		writeError(w, r, http.StatusConflict, "label_exists", err.Error())
+	case errors.Is(err, labels.ErrSystemLabel):
+		writeError(w, r, http.StatusForbidden, "system_label", "System labels can't be changed")
+	case errors.Is(err, labels.ErrInvalidLabel):
+		writeError(w, r, http.StatusBadRequest, "invalid_label", err.Error())
+	default:
+		metrics.Errors.WithLabelValues("database_label").Inc()
+		logger.Error(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", message)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLabelsAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(ingestRaw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ingest got status %d: %s", resp.StatusCode, body)
+	}
+	messageID := strings.TrimPrefix(resp.Header.Get("Location"), "/api/v1/messages/")
+
+	resp, body = ts.do(t, http.MethodPost, "u1", "/api/v1/labels", strings.NewReader(`{"path": "Work/Acme", "color": "#336699"}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create got status %d: %s", resp.StatusCode, body)
+	}
+	path := resp.Header.Get("Location")
+	labelID := strings.TrimPrefix(path, "/api/v1/labels/")
+
+	label := func(userID, labelPath string) (total, unread int64) {
+		t.Helper()
+		resp, body := ts.do(t, http.MethodGet, userID, labelPath, nil)
+		var l struct{ Total, Unread int64 }
+		if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(body), &l) != nil {
+			t.Fatalf("get %s got status %d: %s", labelPath, resp.StatusCode, body)
+		}
+		return l.Total, l.Unread
+	}
+
+	labelBody := `{"message_ids": ["` + messageID + `"], "add": ["` + labelID + `", "archive"]}`
+	for _, c := range []struct {
+		method, userID, path, body string
+		wantStatus                 int
+	}{
+		{http.MethodPost, "u1", "/api/v1/labels", `{"path": "Work/Acme"}`, http.StatusConflict},
+		{http.MethodPost, "u1", "/api/v1/labels", `{"path": "Inbox"}`, http.StatusBadRequest},
+		{http.MethodPost, "u1", "/api/v1/labels", `{"path": "News", "color": "blue"}`, http.StatusBadRequest},
+		{http.MethodPost, "u1", "/api/v1/labels", `not json`, http.StatusBadRequest},
+		{http.MethodGet, "u2", path, "", http.StatusNotFound},
+		{http.MethodPut, "u1", "/api/v1/labels/inbox", `{"path": "Box"}`, http.StatusForbidden},
+		{http.MethodDelete, "u1", "/api/v1/labels/sent", "", http.StatusForbidden},
+		{http.MethodPost, "u2", "/api/v1/messages/labels", labelBody, http.StatusNotFound},
+		{http.MethodPost, "u1", "/api/v1/messages/labels", `{"message_ids": [], "add": ["spam"]}`, http.StatusBadRequest},
+		{http.MethodPost, "u1", "/api/v1/messages/labels", `{"message_ids": ["` + messageID + `"], "add": ["nope"]}`, http.StatusNotFound},
+		{http.MethodPost, "u1", "/api/v1/messages/labels", labelBody, http.StatusNoContent},
+		{http.MethodPut, "u1", path, `{"path": "Clients/Acme", "color": "#000000"}`, http.StatusOK},
+	} {
+		var body io.Reader
+		if c.body != "" {
+			body = strings.NewReader(c.body)
+		}
+		resp, got := ts.do(t, c.method, c.userID, c.path, body)
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s %s as %s: got status %d, want %d: %s", c.method, c.path, c.userID, resp.StatusCode, c.wantStatus, got)
+		}
+	}
+
+	if total, unread := label("u1", path); total != 1 || unread != 1 {
+		t.Errorf("got %d/%d in label, want 1/1", total, unread)
+	}
+	if total, _ := label("u1", "/api/v1/labels/inbox"); total != 0 {
+		t.Errorf("got %d in Inbox, want 0", total)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/labels", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"path":"Clients/Acme"`) || !strings.Contains(body, `"path":"Work"`) {
+		t.Errorf("list got status %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = ts.do(t, http.MethodDelete, "u1", path, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete got status %d: %s", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", path, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get after delete got status %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// messageResponse is the API view of a message. thread_id is "" until the
+// message has been threaded; labels include Inbox or Archive where the
+// message is in them. Attachments are downloaded by their part.
+// authentication, the DKIM, SPF, DMARC and ARC verdict, is omitted for
+// messages that weren't authenticated.
+type messageResponse struct {
+	ID                string              `json:"id"`
+	ThreadID          string              `json:"thread_id"`
+	InternetMessageID string              `json:"internet_message_id"`
+	Subject           string              `json:"subject"`
+	FromName          string              `json:"from_name"`
+	FromAddress       string              `json:"from_address"`
+	To                []addressResponse   `json:"to"`
+	Cc                []addressResponse   `json:"cc"`
+	ReplyTo           []addressResponse   `json:"reply_to"`
+	SentAt            time.Time           `json:"sent_at"`
+	ReceivedAt        time.Time           `json:"received_at"`
+	Size              int64               `json:"size"`
+	HasAttachments    bool                `json:"has_attachments"`
+	TextBody          string              `json:"text_body"`
+	HTMLBody          string              `json:"html_body"`
+	Attachments       []attachmentSummary `json:"attachments"`
+	Labels            []string            `json:"labels"`
+	Flags             flags.Flags         `json:"flags"`
+
+	Authentication *authenticationResponse `json:"authentication,omitempty"`
+}
+
+type addressResponse struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type attachmentSummary struct {
+	Part        string `json:"part"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// handleGetMessage returns one of the authenticated user's messages.
+func (s *Server) handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	q := s.db.Queries()
+	msg, err := q.GetMessage(r.Context(), schema.GetMessageParams{ID: r.PathValue("id"), UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, "not_found", "Message not found")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_get_message").Inc()
+		logger.Error(r.Context(), "Failed to get message", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get message")
+		return
+	}
+	resp, err := s.newMessageResponse(r, q, msg)
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_get_message").Inc()
+		logger.Error(r.Context(), "Failed to get message", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get message")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (s *Server) newMessageResponse(r *http.Request, q *schema.Queries, msg schema.Message) (messageResponse, error) {
+	resp := messageResponse{
+		ID:                msg.ID,
+		ThreadID:          msg.ThreadID,
+		InternetMessageID: msg.InternetMessageID,
+		Subject:           msg.Subject,
+		FromName:          msg.FromName,
+		FromAddress:       msg.FromAddress,
+		To:                []addressResponse{},
+		Cc:                []addressResponse{},
+		ReplyTo:           []addressResponse{},
+		SentAt:            msg.SentAt,
+		ReceivedAt:        msg.ReceivedAt,
+		Size:              msg.Size,
+		HasAttachments:    msg.HasAttachments,
+		Attachments:       []attachmentSummary{},
+	}
+
+	addrs, err := q.ListMessageAddresses(r.Context(), msg.ID)
+	if err != nil {
+		return messageResponse{}, fmt.Errorf("failed to list message addresses: %w", err)
+	}
+	for _, a := range addrs {
+		addr := addressResponse{Name: a.Name, Address: a.Address}
+		switch a.Kind {
+		case "to":
+			resp.To = append(resp.To, addr)
+		case "cc":
+			resp.Cc = append(resp.Cc, addr)
+		case "reply-to":
+			resp.ReplyTo = append(resp.ReplyTo, addr)
+		}
+	}
+
+	body, err := q.GetMessageBody(r.Context(), msg.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return messageResponse{}, fmt.Errorf("failed to get message body: %w", err)
+	}
+	resp.TextBody, resp.HTMLBody = body.TextBody, body.HtmlBody
+
+	atts, err := q.ListAttachments(r.Context(), msg.ID)
+	if err != nil {
+		return messageResponse{}, fmt.Errorf("failed to list attachments: %w", err)
+	}
+	for _, a := range atts {
+		resp.Attachments = append(resp.Attachments, attachmentSummary{
+			Part:        a.Part,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+		})
+	}
+
+	stored, err := q.ListMessageLabels(r.Context(), msg.ID)
+	if err != nil {
+		return messageResponse{}, fmt.Errorf("failed to list message labels: %w", err)
+	}
+	resp.Labels = append([]string{}, stored...)
+	if mailbox := labels.Mailbox(stored, msg.Archived); mailbox != "" {
+		resp.Labels = append(resp.Labels, mailbox)
+	}
+
+	if resp.Flags, err = s.flags.Get(r.Context(), msg.UserID, msg.ID); err != nil {
+		return messageResponse{}, err
+	}
+
+	a, err := q.GetMessageAuth(r.Context(), msg.ID)
+	switch {
+	case err == nil:
+		resp.Authentication = newAuthenticationResponse(a)
+	case !errors.Is(err, sql.ErrNoRows):
+		return messageResponse{}, fmt.Errorf("failed to get message authentication: %w", err)
+	}
+	return resp, nil
+}
+
+// handleIngestMessage stores a raw message/rfc822 request body for the
+// authenticated user.
+func (s *Server) handleIngestMessage(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != "message/rfc822" {
+			writeError(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", "Request body must be message/rfc822")
+			return
+		}
+	}
+
+	maxSize := s.store.MaxMessageSize()
+	if r.ContentLength > maxSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "message_too_large",
+			fmt.Sprintf("Message exceeds the maximum size of %d bytes", maxSize))
+		return
+	}
+
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "message_too_large",
+				fmt.Sprintf("Message exceeds the maximum size of %d bytes", maxSize))
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "read_failed", "Failed to read request body")
+		return
+	}
+
+	id, err := s.store.Deliver(r.Context(), mailstore.Delivery{UserID: userID, Raw: raw})
+	if err != nil {
+		s.writeDeliverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/messages/"+id)
+	writeJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"id":   id,
+		"size": len(raw),
+	})
+}
+
+// writeDeliverError maps mailstore delivery errors onto API responses.
+func (s *Server) writeDeliverError(w http.ResponseWriter, r *http.Request, err error) {
+	var parseErr *mailstore.ParseError
+	switch {
+	case errors.As(err, &parseErr):
+		metrics.Errors.WithLabelValues("message_malformed").Inc()
+		writeError(w, r, http.StatusBadRequest, "malformed_message", parseErr.Reason)
+	case errors.Is(err, mailstore.ErrEmptyMessage):
+		writeError(w, r, http.StatusBadRequest, "empty_message", "Request body is empty")
+	case errors.Is(err, mailstore.ErrMessageTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, "message_too_large", "Message exceeds the maximum size")
+	case errors.Is(err, mailstore.ErrUnknownUser):
+		writeError(w, r, http.StatusForbidden, "unknown_user", "User does not exist")
+	default:
+		metrics.Errors.WithLabelValues("database_insert_message").Inc()
+		logger.Error(r.Context(), "Failed to store message", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to store message")
+	}
+}
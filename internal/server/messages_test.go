@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+)
+
+const ingestRaw = "From: Alice <alice@example.org>\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"Message-ID: <hello@example.org>\r\n" +
+	"\r\n" +
+	"Hi there.\r\n"
+
+func TestIngestMessage(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(ingestRaw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var created struct {
+		ID   string `json:"id"`
+		Size int    `json:"size"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Size != len(ingestRaw) {
+		t.Errorf("got %s, want the new ID and a size of %d", body, len(ingestRaw))
+	}
+	if got, want := resp.Header.Get("Location"), "/api/v1/messages/"+created.ID; got != want {
+		t.Errorf("got Location %q, want %q", got, want)
+	}
+
+	resp, body = ts.do(t, http.MethodGet, "u1", resp.Header.Get("Location"), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET got status %d: %s", resp.StatusCode, body)
+	}
+	var got messageResponse
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != created.ID || got.Subject != "Hello" || got.FromAddress != "alice@example.org" ||
+		len(got.To) != 1 || got.To[0].Address != "user@example.com" ||
+		strings.TrimSpace(got.TextBody) != "Hi there." || !slices.Equal(got.Labels, []string{"Inbox"}) || got.Flags.Read {
+		t.Errorf("GET got %s", body)
+	}
+	if resp, body := ts.do(t, http.MethodGet, "u2", "/api/v1/messages/"+created.ID, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("another user's message got status %d: %s", resp.StatusCode, body)
+	}
+
+	msg, err := ts.db.Queries().GetMessage(context.Background(), schema.GetMessageParams{ID: created.ID, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Hello" || msg.FromAddress != "alice@example.org" || msg.InternetMessageID != "hello@example.org" {
+		t.Errorf("stored %+v", msg)
+	}
+}
+
+func TestIngestMessageWithAttachment(t *testing.T) {
+	ts := newTestServer(t)
+	raw := "From: alice@example.org\r\n" +
+		"To: user@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf; name=report.pdf\r\n" +
+		"Content-Disposition: attachment; filename=report.pdf\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0xLjQgcmVwb3J0\r\n" +
+		"--b--\r\n"
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(raw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	q := ts.db.Queries()
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: created.ID, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.HasAttachments {
+		t.Error("message isn't marked as having attachments")
+	}
+	text, err := q.GetMessageBody(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(text.TextBody) != "See attached." {
+		t.Errorf("got text %q", text.TextBody)
+	}
+	atts, err := q.ListAttachments(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 1 {
+		t.Fatalf("got attachments %+v, want one", atts)
+	}
+	if a := atts[0]; a.Part != "2" || a.Filename != "report.pdf" || a.ContentType != "application/pdf" || a.Size != int64(len("%PDF-1.4 report")) {
+		t.Errorf("got attachment %+v", a)
+	}
+}
+
+func TestIngestMessageErrors(t *testing.T) {
+	t.Setenv("MAX_MESSAGE_SIZE", "1024")
+	ts := newTestServer(t)
+
+	tests := []struct {
+		name        string
+		userID      string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+	}{
+		// The authentication middleware answers in plain text
+		{"no token", "", "message/rfc822", ingestRaw, http.StatusUnauthorized, ""},
+		{"wrong content type", "u1", "application/json", `{"raw":"x"}`, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"bad content type", "u1", "message/", ingestRaw, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"empty", "u1", "message/rfc822", "", http.StatusBadRequest, "empty_message"},
+		{"no header", "u1", "message/rfc822", "\r\nJust a body.\r\n", http.StatusBadRequest, "malformed_message"},
+		{"too large", "u1", "message/rfc822", ingestRaw + strings.Repeat("x", 1024), http.StatusRequestEntityTooLarge, "message_too_large"},
+		{"unknown user", "ghost", "message/rfc822", ingestRaw, http.StatusForbidden, "unknown_user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := ts.do(t, http.MethodPost, tt.userID, "/api/v1/messages", strings.NewReader(tt.body),
+				"Content-Type", tt.contentType)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var e apiError
+			if err := json.Unmarshal([]byte(body), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Error.Code != tt.wantCode {
+				t.Errorf("got code %q, want %q", e.Error.Code, tt.wantCode)
+			}
+		})
+	}
+
+	var n int
+	if err := ts.db.DB().QueryRow(`SELECT COUNT(*) FROM message`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("stored %d messages from failed requests", n)
+	}
+}
+
+func TestMessageAuthentication(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages", strings.NewReader(ingestRaw),
+		"Content-Type", "message/rfc822")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/v1/messages/" + created.ID + "/authentication"
+
+	// Messages ingested over HTTP aren't authenticated
+	resp, body = ts.do(t, http.MethodGet, "u1", path, nil)
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(body, "not_authenticated") {
+		t.Errorf("got status %d: %s", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/messages/"+created.ID, nil)
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, `"authentication"`) {
+		t.Errorf("message got status %d: %s", resp.StatusCode, body)
+	}
+
+	q := ts.db.Queries()
+	err := q.InsertMessageAuth(ctx, schema.InsertMessageAuthParams{
+		MessageID:   created.ID,
+		Dkim:        "none",
+		Spf:         "fail",
+		Dmarc:       "fail",
+		DmarcPolicy: "reject",
+		HeaderFrom:  "example.org",
+		Results:     "mx.example.com; dkim=none; spf=fail; dmarc=fail",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", path, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"spoofed":true`) || !strings.Contains(body, `"dmarc_policy":"reject"`) {
+		t.Errorf("got status %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := ts.do(t, http.MethodGet, "u2", path, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("another user got status %d", resp.StatusCode)
+	}
+
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: created.ID, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/threads/"+msg.ThreadID, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"authentication":{"dkim":"none"`) {
+		t.Errorf("thread got status %d: %s", resp.StatusCode, body)
+	}
+
+	// A trusted ARC sealer vouched for the message
+	if err := q.DeleteMessageAuth(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	err = q.InsertMessageAuth(ctx, schema.InsertMessageAuthParams{
+		MessageID:     created.ID,
+		Dkim:          "fail",
+		Spf:           "pass",
+		Dmarc:         "fail",
+		DmarcPolicy:   "reject",
+		DmarcOverride: "google.com",
+		Arc:           "pass",
+		HeaderFrom:    "example.org",
+		Results:       "mx.example.com; dkim=fail; spf=pass; dmarc=fail; arc=pass",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", path, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"spoofed":false`) ||
+		!strings.Contains(body, `"dmarc_override":"google.com"`) || !strings.Contains(body, `"arc":"pass"`) {
+		t.Errorf("got status %d: %s", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/messages/"+created.ID, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"arc":"pass"`) || !strings.Contains(body, `"spoofed":false`) {
+		t.Errorf("message got status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestSendMessageDisabled(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/messages/send",
+		strings.NewReader(`{"to":["bob@example.net"],"text":"Hi"}`), "Content-Type", "application/json")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var e apiError
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Error.Code != "sending_disabled" {
+		t.Errorf("got code %q, want sending_disabled", e.Error.Code)
+	}
+}
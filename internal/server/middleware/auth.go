@@ -12,12 +12,22 @@ var UnprotectedAPIRoutes = map[string]bool{
 	"/api/v1/renew":  true,
 	"/api/v1/health": true,
 	"/api/v1/logout": true, // Allow logout without a valid token
+	"/api/v1/push":   true, // Browsers can't send headers with WebSockets, so clients may authenticate after connecting
+}
+
+// isProtected reports whether path needs a JWT: the API routes not listed
+// in UnprotectedAPIRoutes, and JMAP.
+func isProtected(path string) bool {
+	if strings.Contains(path, "/api/") && !UnprotectedAPIRoutes[path] {
+		return true
+	}
+	return path == "/.well-known/jmap" || strings.HasPrefix(path, "/jmap/")
 }
 
 func AuthenticatedMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// if the route is an API route and is not in the unprotected list, check for JWT
-		if (strings.Contains(r.URL.Path, "/api/") && !UnprotectedAPIRoutes[r.URL.Path]) && !auth.ValidateJWT(r.Header.Get("Authorization")) {
+		// if the route is protected, check for JWT
+		if isProtected(r.URL.Path) && !auth.ValidateJWT(r.Header.Get("Authorization")) {
 			logger.Warn(r.Context(), "Unauthorized access attempt",
 				"path", r.URL.Path,
 				"method", r.Method,
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+// CancelOnShutdown cancels the context of the requests next serves once
+// shutdown is done, for streams that would otherwise stay open and keep the
+// server from shutting down. Ordinary requests are left to finish.
+func CancelOnShutdown(shutdown context.Context, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stop := context.AfterFunc(shutdown, cancel)
+		defer stop()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+)
+
+// WriteTimeout gives the route next serves its own write timeout in place
+// of the server's, which is sized for ordinary requests. A zero timeout
+// removes the deadline, for streams that stay open as long as the client
+// wants.
+func WriteTimeout(d time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if d > 0 {
+			deadline = time.Now().Add(d)
+		}
+		if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+			logger.Warn(r.Context(), "Failed to set write deadline", "path", r.URL.Path, "error", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -22,6 +22,98 @@ func (s *Server) RegisterRoutes() http.Handler {
 	mux.HandleFunc("/api/v1/health", s.healthHandler)
 	mux.HandleFunc("/api/v1/auth/health", s.authHealthHandler) // Dedicated auth health check
 
+	// Message ingestion
+	mux.HandleFunc("POST /api/v1/messages", s.handleIngestMessage)
+	mux.HandleFunc("PATCH /api/v1/messages", s.handleUpdateMessages)
+	mux.HandleFunc("POST /api/v1/messages/send", s.handleSendMessage)
+	mux.HandleFunc("POST /api/v1/messages/labels", s.handleLabelMessages)
+	mux.HandleFunc("GET /api/v1/messages/{id}", s.handleGetMessage)
+	mux.HandleFunc("GET /api/v1/messages/{id}/attachments/{part}", s.handleGetAttachment)
+	mux.HandleFunc("GET /api/v1/messages/{id}/flags", s.handleGetMessageFlags)
+	mux.HandleFunc("GET /api/v1/messages/{id}/authentication", s.handleGetMessageAuthentication)
+	mux.HandleFunc("GET /api/v1/messages/{id}/bounces", s.handleListMessageBounces)
+
+	// Labels, system and the user's own
+	mux.HandleFunc("GET /api/v1/labels", s.handleListLabels)
+	mux.HandleFunc("POST /api/v1/labels", s.handleCreateLabel)
+	mux.HandleFunc("GET /api/v1/labels/{id}", s.handleGetLabel)
+	mux.HandleFunc("PUT /api/v1/labels/{id}", s.handleUpdateLabel)
+	mux.HandleFunc("DELETE /api/v1/labels/{id}", s.handleDeleteLabel)
+
+	// Drafts, and scheduling them to be sent
+	mux.HandleFunc("GET /api/v1/drafts", s.handleListDrafts)
+	mux.HandleFunc("POST /api/v1/drafts", s.handleCreateDraft)
+	mux.HandleFunc("GET /api/v1/drafts/{id}", s.handleGetDraft)
+	mux.HandleFunc("PUT /api/v1/drafts/{id}", s.handleUpdateDraft)
+	mux.HandleFunc("DELETE /api/v1/drafts/{id}", s.handleDeleteDraft)
+	mux.HandleFunc("PUT /api/v1/drafts/{id}/schedule", s.handleScheduleDraft)
+	mux.HandleFunc("DELETE /api/v1/drafts/{id}/schedule", s.handleUnscheduleDraft)
+
+	// Recipients not sent to after their mail bounced
+	mux.HandleFunc("GET /api/v1/suppressions", s.handleListSuppressions)
+	mux.HandleFunc("GET /api/v1/suppressions/{address}", s.handleGetSuppression)
+	mux.HandleFunc("DELETE /api/v1/suppressions/{address}", s.handleDeleteSuppression)
+
+	// Conversations
+	mux.HandleFunc("GET /api/v1/threads", s.handleListThreads)
+	mux.HandleFunc("GET /api/v1/threads/{id}", s.handleGetThread)
+
+	// Full-text search
+	mux.HandleFunc("GET /api/v1/search", s.handleSearch)
+
+	// Rules run on incoming mail
+	mux.HandleFunc("GET /api/v1/rules", s.handleListRules)
+	mux.HandleFunc("POST /api/v1/rules", s.handleCreateRule)
+	mux.HandleFunc("GET /api/v1/rules/{id}", s.handleGetRule)
+	mux.HandleFunc("PUT /api/v1/rules/{id}", s.handleUpdateRule)
+	mux.HandleFunc("DELETE /api/v1/rules/{id}", s.handleDeleteRule)
+
+	// Sieve scripts run on incoming mail after the rules
+	mux.HandleFunc("GET /api/v1/sieve/scripts", s.handleListSieveScripts)
+	mux.HandleFunc("GET /api/v1/sieve/scripts/{name}", s.handleGetSieveScript)
+	mux.HandleFunc("PUT /api/v1/sieve/scripts/{name}", s.handlePutSieveScript)
+	mux.HandleFunc("DELETE /api/v1/sieve/scripts/{name}", s.handleDeleteSieveScript)
+	mux.HandleFunc("PUT /api/v1/sieve/active", s.handleActivateSieveScript)
+
+	// Webhook endpoints and their deliveries
+	mux.HandleFunc("GET /api/v1/webhooks", s.handleListWebhooks)
+	mux.HandleFunc("POST /api/v1/webhooks", s.handleCreateWebhook)
+	mux.HandleFunc("GET /api/v1/webhooks/{id}", s.handleGetWebhook)
+	mux.HandleFunc("PUT /api/v1/webhooks/{id}", s.handleUpdateWebhook)
+	mux.HandleFunc("DELETE /api/v1/webhooks/{id}", s.handleDeleteWebhook)
+	mux.HandleFunc("GET /api/v1/webhooks/{id}/deliveries", s.handleListWebhookDeliveries)
+	mux.HandleFunc("POST /api/v1/webhooks/{id}/deliveries/{delivery}/retry", s.handleRetryWebhookDelivery)
+
+	// API keys and app passwords, for programs and mail clients
+	mux.HandleFunc("GET /api/v1/credentials", s.handleListCredentials)
+	mux.HandleFunc("POST /api/v1/credentials", s.handleCreateCredential)
+	mux.HandleFunc("DELETE /api/v1/credentials/{id}", s.handleDeleteCredential)
+
+	// Changes to messages as they happen, as server-sent events. The stream
+	// stays open, so the server's write timeout doesn't apply, until the
+	// client leaves or the server shuts down
+	mux.Handle("GET /api/v1/events", s.stream(middleware.WriteTimeout(0, http.HandlerFunc(s.handleEvents))))
+	// The same, for labels, threads and searches a WebSocket client
+	// subscribes to
+	mux.Handle("GET /api/v1/push", s.stream(s.push.Handler()))
+	// What changed since a client last synced
+	mux.HandleFunc("GET /api/v1/changes", s.handleChanges)
+
+	// IMAP sync accounts
+	mux.HandleFunc("GET /api/v1/sync/accounts", s.handleListSyncAccounts)
+	mux.HandleFunc("POST /api/v1/sync/accounts", s.handleCreateSyncAccount)
+	mux.HandleFunc("DELETE /api/v1/sync/accounts/{id}", s.handleDeleteSyncAccount)
+	mux.HandleFunc("POST /api/v1/sync/accounts/{id}/sync", s.handleTriggerSync)
+
+	// JMAP, for mail clients
+	mux.HandleFunc("GET /.well-known/jmap", s.jmap.HandleSession)
+	mux.HandleFunc("POST /jmap/api", s.jmap.HandleAPI)
+	mux.HandleFunc("GET /jmap/download/{account}/{blob}/{name}", s.jmap.HandleDownload)
+	mux.HandleFunc("POST /jmap/upload/{account}/{$}", s.jmap.HandleUpload)
+	// Pushes state changes for as long as the client listens, like the
+	// event stream above
+	mux.Handle("GET /jmap/eventsource", s.stream(middleware.WriteTimeout(0, http.HandlerFunc(s.jmap.HandleEventSource))))
+
 	// Wrap with middleware in the following order
 	handler := middleware.TracingMiddleware(mux)          // Add tracing (first to capture all other middleware)
 	handler = middleware.LoggingMiddleware(handler)       // Add logging
@@ -34,6 +126,11 @@ func (s *Server) RegisterRoutes() http.Handler {
 	return handler
 }
 
+// stream ends the requests next serves when the server shuts down.
+func (s *Server) stream(next http.Handler) http.Handler {
+	return middleware.CancelOnShutdown(s.shutdown, next)
+}
+
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	resp, err := json.Marshal(s.db.Health())
 	if err != nil {
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+)
+
+// apiError is the JSON body returned for failed API requests.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSON encodes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		metrics.Errors.WithLabelValues("response_encode").Inc()
+		logger.Error(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// writeError writes a structured JSON error with a machine-readable code.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeJSON(w, r, status, apiError{Error: apiErrorDetail{Code: code, Message: message}})
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/rules"
+)
+
+// maxRuleSize bounds the JSON body of a rule.
+const maxRuleSize = 64 << 10
+
+// handleListRules lists the authenticated user's rules in the order they run.
+func (s *Server) handleListRules(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	list, err := s.rules.List(r.Context(), userID)
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_list_rules").Inc()
+		logger.Error(r.Context(), "Failed to list rules", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to list rules")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"rules": list})
+}
+
+// handleCreateRule adds a rule for the authenticated user.
+func (s *Server) handleCreateRule(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params rules.Params
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuleSize)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON rule")
+		return
+	}
+
+	rule, err := s.rules.Create(r.Context(), userID, params)
+	if err != nil {
+		s.writeRuleError(w, r, err, "Failed to create rule")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/rules/"+rule.ID)
+	writeJSON(w, r, http.StatusCreated, rule)
+}
+
+// handleGetRule returns one of the authenticated user's rules.
+func (s *Server) handleGetRule(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	rule, err := s.rules.Get(r.Context(), userID, r.PathValue("id"))
+	if err != nil {
+		s.writeRuleError(w, r, err, "Failed to get rule")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, rule)
+}
+
+// handleUpdateRule replaces one of the authenticated user's rules.
+func (s *Server) handleUpdateRule(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params rules.Params
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuleSize)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON rule")
+		return
+	}
+
+	rule, err := s.rules.Update(r.Context(), userID, r.PathValue("id"), params)
+	if err != nil {
+		s.writeRuleError(w, r, err, "Failed to update rule")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, rule)
+}
+
+// handleDeleteRule removes one of the authenticated user's rules.
+func (s *Server) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	if err := s.rules.Delete(r.Context(), userID, r.PathValue("id")); err != nil {
+		s.writeRuleError(w, r, err, "Failed to delete rule")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeRuleError maps rules errors onto API responses; message describes a
+// failure that isn't the client's.
+func (s *Server) writeRuleError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, rules.ErrInvalidRule):
+		writeError(w, r, http.StatusBadRequest, "invalid_rule", err.Error())
+	case errors.Is(err, rules.ErrRuleNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Rule not found")
+	default:
+		metrics.Errors.WithLabelValues("database_rule").Inc()
+		logger.Error(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", message)
+	}
+}
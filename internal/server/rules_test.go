@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRulesAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/rules", strings.NewReader(`{
+		"name": "newsletters",
+		"conditions": [{"field": "list_id", "op": "ends_with", "value": ".example.org"}],
+		"actions": [{"type": "label", "label": "Newsletters"}, {"type": "archive"}]
+	}`), "Content-Type", "application/json")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var created struct {
+		ID      string `json:"id"`
+		Enabled bool   `json:"enabled"`
+		Match   string `json:"match"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !created.Enabled || created.Match != "all" {
+		t.Errorf("created %s", body)
+	}
+	if got, want := resp.Header.Get("Location"), "/api/v1/rules/"+created.ID; got != want {
+		t.Errorf("got Location %q, want %q", got, want)
+	}
+
+	resp, body = ts.do(t, http.MethodPut, "u1", "/api/v1/rules/"+created.ID, strings.NewReader(`{
+		"name": "newsletters", "enabled": false, "actions": [{"type": "mark_read"}]
+	}`))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"enabled":false`) {
+		t.Errorf("update got status %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/rules", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, created.ID) {
+		t.Errorf("list got status %d: %s", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u2", "/api/v1/rules", nil)
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, created.ID) {
+		t.Errorf("another user's list got status %d: %s", resp.StatusCode, body)
+	}
+
+	for _, c := range []struct {
+		method, userID, path, body string
+		wantStatus                 int
+	}{
+		{http.MethodPost, "u1", "/api/v1/rules", `{"actions": [{"type": "shred"}]}`, http.StatusBadRequest},
+		{http.MethodPost, "u1", "/api/v1/rules", `not json`, http.StatusBadRequest},
+		{http.MethodGet, "u2", "/api/v1/rules/" + created.ID, "", http.StatusNotFound},
+		{http.MethodDelete, "u2", "/api/v1/rules/" + created.ID, "", http.StatusNotFound},
+		{http.MethodDelete, "u1", "/api/v1/rules/" + created.ID, "", http.StatusNoContent},
+		{http.MethodGet, "u1", "/api/v1/rules/" + created.ID, "", http.StatusNotFound},
+	} {
+		resp, body := ts.do(t, c.method, c.userID, c.path, strings.NewReader(c.body))
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s %s as %s: got status %d, want %d: %s", c.method, c.path, c.userID, resp.StatusCode, c.wantStatus, body)
+		}
+	}
+}
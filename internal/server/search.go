@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/search"
+)
+
+// handleSearch runs a full-text query over the authenticated user's
+// messages. Parameters: q (required), limit and cursor (the next_cursor of
+// the previous page).
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	params := r.URL.Query()
+	q, err := search.ParseQuery(params.Get("q"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error())
+		return
+	}
+
+	limit := search.DefaultLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > search.MaxLimit {
+			writeError(w, r, http.StatusBadRequest, "invalid_limit",
+				"limit must be between 1 and "+strconv.Itoa(search.MaxLimit))
+			return
+		}
+		limit = n
+	}
+
+	page, err := s.search.Search(r.Context(), userID, q, params.Get("cursor"), limit)
+	if err != nil {
+		if errors.Is(err, search.ErrInvalidCursor) {
+			writeError(w, r, http.StatusBadRequest, "invalid_cursor", "Cursor is not valid")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_search_messages").Inc()
+		logger.Error(r.Context(), "Failed to search messages", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to search messages")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, page)
+}
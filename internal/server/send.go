@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/outbound"
+)
+
+// handleSendMessage composes a message from a JSON body and sends it from
+// the authenticated user's address, storing a copy in their Sent folder.
+func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+	if s.mailer == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "sending_disabled", "Outbound mail is not configured")
+		return
+	}
+
+	// Attachments are base64 in the body, a third larger than in the message
+	var msg outbound.Message
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.store.MaxMessageSize()*2)).Decode(&msg); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "message_too_large", "Message exceeds the maximum size")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON message")
+		return
+	}
+
+	sent, err := s.mailer.Submit(r.Context(), userID, msg)
+	switch {
+	case err == nil:
+	case errors.Is(err, outbound.ErrInvalidMessage):
+		writeError(w, r, http.StatusBadRequest, "invalid_message", err.Error())
+		return
+	case errors.Is(err, outbound.ErrReplyNotFound):
+		writeError(w, r, http.StatusBadRequest, "invalid_message", "Message being answered not found")
+		return
+	case errors.Is(err, outbound.ErrSuppressed):
+		writeError(w, r, http.StatusUnprocessableEntity, "recipient_suppressed", err.Error())
+		return
+	case errors.Is(err, mailstore.ErrUnknownUser):
+		writeError(w, r, http.StatusForbidden, "unknown_user", "User does not exist")
+		return
+	case errors.Is(err, outbound.ErrRelayFailed):
+		logger.Error(r.Context(), "Failed to relay message", "error", err)
+		writeError(w, r, http.StatusBadGateway, "relay_failed", err.Error())
+		return
+	default:
+		metrics.Errors.WithLabelValues("outbound_send").Inc()
+		logger.Error(r.Context(), "Failed to send message", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to send message")
+		return
+	}
+
+	if sent.ID == "" {
+		writeJSON(w, r, http.StatusAccepted, sent)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/messages/"+sent.ID)
+	writeJSON(w, r, http.StatusCreated, sent)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
@@ -8,21 +9,77 @@ import (
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/parsel-email/mailroom/internal/bounce"
+	"github.com/parsel-email/mailroom/internal/changelog"
+	"github.com/parsel-email/mailroom/internal/credentials"
 	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/drafts"
+	"github.com/parsel-email/mailroom/internal/flags"
+	"github.com/parsel-email/mailroom/internal/imapsync"
+	"github.com/parsel-email/mailroom/internal/jmap"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/outbound"
+	"github.com/parsel-email/mailroom/internal/push"
+	"github.com/parsel-email/mailroom/internal/rules"
+	"github.com/parsel-email/mailroom/internal/search"
+	"github.com/parsel-email/mailroom/internal/sieve"
+	"github.com/parsel-email/mailroom/internal/webhook"
 )
 
 type Server struct {
-	port int
-	db   database.Service
+	port     int
+	db       database.Service
+	store    *mailstore.Store
+	sync     *imapsync.Worker // nil when IMAP sync is not configured
+	mailer   *outbound.Mailer // nil when outbound mail is not configured
+	drafts   *drafts.Service
+	bounces  *bounce.Service
+	labels   *labels.Service
+	flags    *flags.Service
+	search   *search.Searcher
+	rules    *rules.Engine
+	sieve    *sieve.Filter
+	webhooks *webhook.Service
+	jmap     *jmap.Server
+	creds    *credentials.Service
+	changes  *changelog.Service
+	push     *push.Server
+
+	// eventsPollInterval is how often event streams look for changes.
+	eventsPollInterval time.Duration
+	// shutdown is done once the HTTP server starts shutting down, which
+	// ends the streams that would keep it from finishing.
+	shutdown context.Context
 }
 
-func NewServer(dbService database.Service) *http.Server { // Added dbService parameter
+func NewServer(dbService database.Service, store *mailstore.Store, syncWorker *imapsync.Worker, mailer *outbound.Mailer) *http.Server { // Added dbService parameter
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
 
+	shutdown, cancelStreams := context.WithCancel(context.Background())
+
 	// Use the provided dbService instead of initializing a new one
 	NewServer := &Server{
-		port: port,
-		db:   dbService,
+		port:     port,
+		db:       dbService,
+		store:    store,
+		sync:     syncWorker,
+		mailer:   mailer,
+		drafts:   drafts.New(dbService),
+		bounces:  bounce.New(dbService),
+		labels:   labels.New(dbService),
+		flags:    flags.New(dbService),
+		search:   search.New(dbService),
+		rules:    rules.New(dbService),
+		sieve:    sieve.New(dbService),
+		webhooks: webhook.New(dbService),
+		jmap:     jmap.New(store, mailer),
+		creds:    credentials.New(dbService),
+		changes:  changelog.New(dbService),
+		push:     push.New(dbService),
+
+		eventsPollInterval: changelog.DefaultPollInterval,
+		shutdown:           shutdown,
 	}
 
 	// Declare Server config
@@ -33,6 +90,7 @@ func NewServer(dbService database.Service) *http.Server { // Added dbService par
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	server.RegisterOnShutdown(cancelStreams)
 
 	return server
 }
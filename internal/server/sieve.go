@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/sieve"
+)
+
+// handleListSieveScripts lists the authenticated user's Sieve scripts.
+func (s *Server) handleListSieveScripts(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	list, err := s.sieve.List(r.Context(), userID)
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_list_sieve_scripts").Inc()
+		logger.Error(r.Context(), "Failed to list sieve scripts", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to list sieve scripts")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"scripts": list})
+}
+
+// handleGetSieveScript returns one of the authenticated user's scripts.
+func (s *Server) handleGetSieveScript(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	script, err := s.sieve.Get(r.Context(), userID, r.PathValue("name"))
+	if err != nil {
+		s.writeSieveError(w, r, err, "Failed to get sieve script")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, script)
+}
+
+// handlePutSieveScript creates or replaces a script. The body is the script
+// itself, as uploaded from a Sieve client or another mail host.
+func (s *Server) handlePutSieveScript(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, sieve.MaxScriptSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "script_too_large", "Sieve script exceeds maximum size")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Failed to read request body")
+		return
+	}
+
+	name := r.PathValue("name")
+	script, created, err := s.sieve.Put(r.Context(), userID, name, string(content))
+	if err != nil {
+		s.writeSieveError(w, r, err, "Failed to save sieve script")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		w.Header().Set("Location", "/api/v1/sieve/scripts/"+name)
+	}
+	writeJSON(w, r, status, script)
+}
+
+// handleDeleteSieveScript removes one of the authenticated user's scripts.
+func (s *Server) handleDeleteSieveScript(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	if err := s.sieve.Delete(r.Context(), userID, r.PathValue("name")); err != nil {
+		s.writeSieveError(w, r, err, "Failed to delete sieve script")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type activateSieveRequest struct {
+	Name string `json:"name"` // empty turns filtering off
+}
+
+// handleActivateSieveScript chooses the script that runs on the user's mail.
+func (s *Server) handleActivateSieveScript(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var req activateSieveRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", `Request body must be {"name": "<script>"}`)
+		return
+	}
+	if err := s.sieve.Activate(r.Context(), userID, req.Name); err != nil {
+		s.writeSieveError(w, r, err, "Failed to activate sieve script")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeSieveError maps sieve errors onto API responses; message describes a
+// failure that isn't the client's.
+func (s *Server) writeSieveError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, sieve.ErrInvalidScript):
+		writeError(w, r, http.StatusBadRequest, "invalid_script", err.Error())
+	case errors.Is(err, sieve.ErrInvalidName):
+		writeError(w, r, http.StatusBadRequest, "invalid_name", err.Error())
+	case errors.Is(err, sieve.ErrScriptNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Sieve script not found")
+	default:
+		metrics.Errors.WithLabelValues("database_sieve_script").Inc()
+		logger.Error(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", message)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSieveAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	script := "require \"fileinto\";\nif header :contains \"subject\" \"report\" { fileinto \"Reports\"; }\n"
+	resp, body := ts.do(t, http.MethodPut, "u1", "/api/v1/sieve/scripts/main", strings.NewReader(script), "Content-Type", "application/sieve")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/api/v1/sieve/scripts/main" {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodPut, "u1", "/api/v1/sieve/scripts/main", strings.NewReader("keep;"))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"content":"keep;"`) {
+		t.Errorf("replace got status %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = ts.do(t, http.MethodPut, "u1", "/api/v1/sieve/scripts/broken", strings.NewReader("keep;\nfileinto \"x\";"))
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "line 2") {
+		t.Errorf("invalid script got status %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = ts.do(t, http.MethodPut, "u1", "/api/v1/sieve/active", strings.NewReader(`{"name": "main"}`))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("activate got status %d: %s", resp.StatusCode, body)
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/sieve/scripts", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"active":true`) {
+		t.Errorf("list got status %d: %s", resp.StatusCode, body)
+	}
+
+	for _, c := range []struct {
+		method, userID, path, body string
+		wantStatus                 int
+	}{
+		{http.MethodGet, "u2", "/api/v1/sieve/scripts/main", "", http.StatusNotFound},
+		{http.MethodPut, "u2", "/api/v1/sieve/active", `{"name": "main"}`, http.StatusNotFound},
+		{http.MethodPut, "u1", "/api/v1/sieve/active", `main`, http.StatusBadRequest},
+		{http.MethodDelete, "u1", "/api/v1/sieve/scripts/main", "", http.StatusNoContent},
+		{http.MethodGet, "u1", "/api/v1/sieve/scripts/main", "", http.StatusNotFound},
+		{http.MethodPut, "u1", "/api/v1/sieve/active", `{"name": ""}`, http.StatusNoContent},
+	} {
+		resp, body := ts.do(t, c.method, c.userID, c.path, strings.NewReader(c.body))
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s %s as %s: got status %d, want %d: %s", c.method, c.path, c.userID, resp.StatusCode, c.wantStatus, body)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/imapsync"
+)
+
+// syncAccountResponse is the API view of an IMAP account; the sealed password
+// is never returned.
+type syncAccountResponse struct {
+	ID           string     `json:"id"`
+	Host         string     `json:"host"`
+	Port         int64      `json:"port"`
+	Security     string     `json:"security"`
+	Username     string     `json:"username"`
+	Enabled      bool       `json:"enabled"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastSyncedAt *time.Time `json:"last_synced_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+func newSyncAccountResponse(a schema.ImapAccount) syncAccountResponse {
+	resp := syncAccountResponse{
+		ID:        a.ID,
+		Host:      a.Host,
+		Port:      a.Port,
+		Security:  a.Security,
+		Username:  a.Username,
+		Enabled:   a.Enabled,
+		LastError: a.LastError,
+		CreatedAt: a.CreatedAt,
+	}
+	if a.LastSyncedAt.Valid {
+		resp.LastSyncedAt = &a.LastSyncedAt.Time
+	}
+	return resp
+}
+
+// syncUser returns the authenticated user ID, writing an error response and
+// returning false if the request can't use the sync API.
+func (s *Server) syncUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return "", false
+	}
+	if s.sync == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "sync_disabled", "IMAP sync is not configured")
+		return "", false
+	}
+	return userID, true
+}
+
+// handleListSyncAccounts lists the authenticated user's IMAP accounts.
+func (s *Server) handleListSyncAccounts(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.syncUser(w, r)
+	if !ok {
+		return
+	}
+
+	accounts, err := s.db.Queries().ListIMAPAccountsByUser(r.Context(), userID)
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_list_imap_accounts").Inc()
+		logger.Error(r.Context(), "Failed to list IMAP accounts", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to list accounts")
+		return
+	}
+
+	resp := make([]syncAccountResponse, 0, len(accounts))
+	for _, a := range accounts {
+		resp = append(resp, newSyncAccountResponse(a))
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"accounts": resp})
+}
+
+// handleCreateSyncAccount adds an IMAP account and starts its first sync.
+func (s *Server) handleCreateSyncAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.syncUser(w, r)
+	if !ok {
+		return
+	}
+
+	var params imapsync.AccountParams
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON account")
+		return
+	}
+
+	account, err := s.sync.CreateAccount(r.Context(), userID, params)
+	if err != nil {
+		if errors.Is(err, imapsync.ErrInvalidAccount) {
+			writeError(w, r, http.StatusBadRequest, "invalid_account", err.Error())
+			return
+		}
+		metrics.Errors.WithLabelValues("database_insert_imap_account").Inc()
+		logger.Error(r.Context(), "Failed to create IMAP account", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to create account")
+		return
+	}
+
+	if err := s.sync.TriggerSync(r.Context(), userID, account.ID); err != nil {
+		logger.Error(r.Context(), "Failed to start IMAP sync", "account_id", account.ID, "error", err)
+	}
+
+	w.Header().Set("Location", "/api/v1/sync/accounts/"+account.ID)
+	writeJSON(w, r, http.StatusCreated, newSyncAccountResponse(account))
+}
+
+// handleDeleteSyncAccount removes an IMAP account. Messages already imported
+// from it are kept.
+func (s *Server) handleDeleteSyncAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.syncUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.sync.DeleteAccount(r.Context(), userID, r.PathValue("id")); err != nil {
+		if errors.Is(err, imapsync.ErrAccountNotFound) {
+			writeError(w, r, http.StatusNotFound, "not_found", "Account not found")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_delete_imap_account").Inc()
+		logger.Error(r.Context(), "Failed to delete IMAP account", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to delete account")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTriggerSync starts an immediate sync of one account.
+func (s *Server) handleTriggerSync(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.syncUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.sync.TriggerSync(r.Context(), userID, r.PathValue("id")); err != nil {
+		if errors.Is(err, imapsync.ErrAccountNotFound) {
+			writeError(w, r, http.StatusNotFound, "not_found", "Account not found")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_get_imap_account").Inc()
+		logger.Error(r.Context(), "Failed to start IMAP sync", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to start sync")
+		return
+	}
+	writeJSON(w, r, http.StatusAccepted, map[string]string{"status": "started"})
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/threading"
+)
+
+const (
+	defaultThreadLimit = 25
+	maxThreadLimit     = 100
+)
+
+// threadResponse is the API view of a thread.
+type threadResponse struct {
+	ID            string    `json:"id"`
+	Subject       string    `json:"subject"`
+	MessageCount  int64     `json:"message_count"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func newThreadResponse(t schema.Thread) threadResponse {
+	return threadResponse{
+		ID:            t.ID,
+		Subject:       t.Subject,
+		MessageCount:  t.MessageCount,
+		LastMessageAt: t.LastMessageAt,
+		CreatedAt:     t.CreatedAt,
+	}
+}
+
+// threadMessageResponse is a message within a thread. parent_id is the
+// message it replies to, "" for the start of the thread; authentication is
+// omitted for messages that weren't authenticated.
+type threadMessageResponse struct {
+	ID                string    `json:"id"`
+	ParentID          string    `json:"parent_id"`
+	Depth             int       `json:"depth"`
+	InternetMessageID string    `json:"internet_message_id"`
+	Subject           string    `json:"subject"`
+	FromName          string    `json:"from_name"`
+	FromAddress       string    `json:"from_address"`
+	SentAt            time.Time `json:"sent_at"`
+	ReceivedAt        time.Time `json:"received_at"`
+	Size              int64     `json:"size"`
+	HasAttachments    bool      `json:"has_attachments"`
+
+	Authentication *authenticationResponse `json:"authentication,omitempty"`
+}
+
+// threadCursor is the position after the last thread of a page.
+type threadCursor struct {
+	LastMessageAt time.Time `json:"t"`
+	ID            string    `json:"id"`
+}
+
+func (c threadCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeThreadCursor(s string) (threadCursor, bool) {
+	var c threadCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.ID == "" {
+		return threadCursor{}, false
+	}
+	return c, true
+}
+
+// handleListThreads lists the authenticated user's threads, most recently
+// active first. Parameters: limit and cursor (the next_cursor of the
+// previous page).
+func (s *Server) handleListThreads(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	params := r.URL.Query()
+	limit := defaultThreadLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxThreadLimit {
+			writeError(w, r, http.StatusBadRequest, "invalid_limit",
+				"limit must be between 1 and "+strconv.Itoa(maxThreadLimit))
+			return
+		}
+		limit = n
+	}
+
+	// The first page starts after every possible thread
+	pos := threadCursor{LastMessageAt: time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)}
+	if v := params.Get("cursor"); v != "" {
+		var ok bool
+		if pos, ok = decodeThreadCursor(v); !ok {
+			writeError(w, r, http.StatusBadRequest, "invalid_cursor", "Cursor is not valid")
+			return
+		}
+	}
+
+	threads, err := s.db.Queries().ListThreadsByUser(r.Context(), schema.ListThreadsByUserParams{
+		UserID:              userID,
+		BeforeLastMessageAt: pos.LastMessageAt.UTC(),
+		BeforeID:            pos.ID,
+		Limit:               int64(limit + 1),
+	})
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_list_threads").Inc()
+		logger.Error(r.Context(), "Failed to list threads", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to list threads")
+		return
+	}
+
+	resp := map[string]interface{}{}
+	if len(threads) > limit {
+		threads = threads[:limit]
+		last := threads[limit-1]
+		resp["next_cursor"] = threadCursor{LastMessageAt: last.LastMessageAt, ID: last.ID}.encode()
+	}
+	list := make([]threadResponse, 0, len(threads))
+	for _, t := range threads {
+		list = append(list, newThreadResponse(t))
+	}
+	resp["threads"] = list
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// handleGetThread returns a thread with its messages in conversation order:
+// depth-first, replies after the message they answer, siblings by date.
+func (s *Server) handleGetThread(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	q := s.db.Queries()
+	thread, err := q.GetThread(r.Context(), schema.GetThreadParams{ID: r.PathValue("id"), UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, "not_found", "Thread not found")
+			return
+		}
+		metrics.Errors.WithLabelValues("database_get_thread").Inc()
+		logger.Error(r.Context(), "Failed to get thread", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get thread")
+		return
+	}
+
+	msgs, err := q.ListThreadMessages(r.Context(), schema.ListThreadMessagesParams{UserID: userID, ThreadID: thread.ID})
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_list_thread_messages").Inc()
+		logger.Error(r.Context(), "Failed to list thread messages", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get thread")
+		return
+	}
+
+	auths, err := q.ListThreadMessageAuth(r.Context(), schema.ListThreadMessageAuthParams{UserID: userID, ThreadID: thread.ID})
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_list_thread_messages").Inc()
+		logger.Error(r.Context(), "Failed to list thread message authentication", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to get thread")
+		return
+	}
+	authByID := make(map[string]*authenticationResponse, len(auths))
+	for _, a := range auths {
+		authByID[a.MessageID] = newAuthenticationResponse(a)
+	}
+
+	byID := make(map[string]schema.Message, len(msgs))
+	input := make([]threading.Message, 0, len(msgs))
+	for _, m := range msgs {
+		byID[m.ID] = m
+		input = append(input, threading.Message{
+			ID:         m.ID,
+			MessageID:  m.InternetMessageID,
+			InReplyTo:  m.InReplyTo,
+			References: strings.Fields(m.MessageReferences),
+			Subject:    m.Subject,
+			Date:       m.SentAt,
+		})
+	}
+
+	list := make([]threadMessageResponse, 0, len(msgs))
+	threading.Flatten(threading.Thread(input), func(tm *threading.Message, parent string, depth int) {
+		m := byID[tm.ID]
+		list = append(list, threadMessageResponse{
+			ID:                m.ID,
+			ParentID:          parent,
+			Depth:             depth,
+			InternetMessageID: m.InternetMessageID,
+			Subject:           m.Subject,
+			FromName:          m.FromName,
+			FromAddress:       m.FromAddress,
+			SentAt:            m.SentAt,
+			ReceivedAt:        m.ReceivedAt,
+			Size:              m.Size,
+			HasAttachments:    m.HasAttachments,
+			Authentication:    authByID[m.ID],
+		})
+	})
+
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"thread":   newThreadResponse(thread),
+		"messages": list,
+	})
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/internal/auth"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+// maxWebhookSize bounds the JSON body of a webhook endpoint.
+const maxWebhookSize = 16 << 10
+
+// handleListWebhooks lists the authenticated user's webhook endpoints.
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	list, err := s.webhooks.List(r.Context(), userID)
+	if err != nil {
+		metrics.Errors.WithLabelValues("database_list_webhooks").Inc()
+		logger.Error(r.Context(), "Failed to list webhooks", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to list webhooks")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"webhooks": list})
+}
+
+// handleCreateWebhook registers an endpoint for the authenticated user. The
+// response is the only one that includes the signing secret.
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params webhook.Params
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookSize)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON webhook endpoint")
+		return
+	}
+
+	endpoint, err := s.webhooks.Create(r.Context(), userID, params)
+	if err != nil {
+		s.writeWebhookError(w, r, err, "Failed to create webhook")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/webhooks/"+endpoint.ID)
+	writeJSON(w, r, http.StatusCreated, endpoint)
+}
+
+// handleGetWebhook returns one of the authenticated user's endpoints.
+func (s *Server) handleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	endpoint, err := s.webhooks.Get(r.Context(), userID, r.PathValue("id"))
+	if err != nil {
+		s.writeWebhookError(w, r, err, "Failed to get webhook")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, endpoint)
+}
+
+// handleUpdateWebhook replaces the settings of one of the authenticated
+// user's endpoints.
+func (s *Server) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	var params webhook.Params
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookSize)).Decode(&params); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Request body must be a JSON webhook endpoint")
+		return
+	}
+
+	endpoint, err := s.webhooks.Update(r.Context(), userID, r.PathValue("id"), params)
+	if err != nil {
+		s.writeWebhookError(w, r, err, "Failed to update webhook")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, endpoint)
+}
+
+// handleDeleteWebhook removes one of the authenticated user's endpoints.
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	if err := s.webhooks.Delete(r.Context(), userID, r.PathValue("id")); err != nil {
+		s.writeWebhookError(w, r, err, "Failed to delete webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListWebhookDeliveries lists the deliveries to one of the
+// authenticated user's endpoints, newest first. Parameters: status (pending,
+// delivered or dead; dead lists the dead letters) and limit.
+func (s *Server) handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	params := r.URL.Query()
+	limit := webhook.DefaultDeliveryLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > webhook.MaxDeliveryLimit {
+			writeError(w, r, http.StatusBadRequest, "invalid_limit",
+				"limit must be between 1 and "+strconv.Itoa(webhook.MaxDeliveryLimit))
+			return
+		}
+		limit = n
+	}
+
+	list, err := s.webhooks.ListDeliveries(r.Context(), userID, r.PathValue("id"), params.Get("status"), limit)
+	if err != nil {
+		s.writeWebhookError(w, r, err, "Failed to list webhook deliveries")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"deliveries": list})
+}
+
+// handleRetryWebhookDelivery queues a dead delivery for another attempt.
+func (s *Server) handleRetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetIDFromJWT(r.Header.Get("Authorization"))
+	if err != nil {
+		metrics.Errors.WithLabelValues("jwt_decode").Inc()
+		writeError(w, r, http.StatusUnauthorized, "invalid_token", "Failed to get user ID from token")
+		return
+	}
+
+	delivery, err := s.webhooks.Retry(r.Context(), userID, r.PathValue("id"), r.PathValue("delivery"))
+	if err != nil {
+		s.writeWebhookError(w, r, err, "Failed to retry webhook delivery")
+		return
+	}
+	writeJSON(w, r, http.StatusAccepted, delivery)
+}
+
+// writeWebhookError maps webhook errors onto API responses; message
+// describes a failure that isn't the client's.
+func (s *Server) writeWebhookError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, webhook.ErrInvalidEndpoint):
+		writeError(w, r, http.StatusBadRequest, "invalid_webhook", err.Error())
+	case errors.Is(err, webhook.ErrInvalidStatus):
+		writeError(w, r, http.StatusBadRequest, "invalid_status", "status must be pending, delivered or dead")
+	case errors.Is(err, webhook.ErrEndpointNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Webhook not found")
+	case errors.Is(err, webhook.ErrDeliveryNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Webhook delivery not found")
+	case errors.Is(err, webhook.ErrDeliveryNotDead):
+		writeError(w, r, http.StatusConflict, "delivery_not_dead", "Only dead deliveries can be retried")
+	default:
+		metrics.Errors.WithLabelValues("database_webhook").Inc()
+		logger.Error(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", message)
+	}
+}
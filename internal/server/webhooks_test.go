@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+func TestWebhooksAPI(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t)
+
+	resp, body := ts.do(t, http.MethodPost, "u1", "/api/v1/webhooks",
+		strings.NewReader(`{"url": "https://example.org/hook", "events": ["message.deleted"]}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+	var created webhook.Endpoint
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Secret == "" || resp.Header.Get("Location") != "/api/v1/webhooks/"+created.ID {
+		t.Errorf("created %s with location %q", body, resp.Header.Get("Location"))
+	}
+	resp, body = ts.do(t, http.MethodGet, "u1", "/api/v1/webhooks", nil)
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, created.Secret) {
+		t.Errorf("list got status %d: %s", resp.StatusCode, body)
+	}
+
+	// A delivery that gave up
+	q := ts.db.Queries()
+	err := ts.db.WithTx(ctx, func(q *schema.Queries) error {
+		return webhook.PublishTx(ctx, q, "u1", webhook.EventMessageDeleted, webhook.MessageDeleted{MessageID: "m1"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := q.ListWebhookDeliveries(ctx, schema.ListWebhookDeliveriesParams{EndpointID: created.ID, UserID: "u1", Limit: 1})
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("got deliveries %v, %v", pending, err)
+	}
+	err = q.MarkWebhookFailed(ctx, schema.MarkWebhookFailedParams{Status: webhook.StatusDead, NextAttemptAt: time.Now(), LastError: "timeout", ID: pending[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/api/v1/webhooks/" + created.ID
+	resp, body = ts.do(t, http.MethodGet, "u1", path+"/deliveries?status=dead", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"last_error":"timeout"`) || !strings.Contains(body, `"message_id":"m1"`) {
+		t.Errorf("dead letters got status %d: %s", resp.StatusCode, body)
+	}
+	retry := path + "/deliveries/" + pending[0].ID + "/retry"
+	resp, body = ts.do(t, http.MethodPost, "u1", retry, nil)
+	if resp.StatusCode != http.StatusAccepted || !strings.Contains(body, `"status":"pending"`) {
+		t.Errorf("retry got status %d: %s", resp.StatusCode, body)
+	}
+
+	for _, c := range []struct {
+		method, userID, path, body string
+		wantStatus                 int
+	}{
+		{http.MethodPost, "u1", retry, "", http.StatusConflict},
+		{http.MethodPost, "u2", retry, "", http.StatusNotFound},
+		{http.MethodGet, "u2", path, "", http.StatusNotFound},
+		{http.MethodGet, "u1", path + "/deliveries?status=lost", "", http.StatusBadRequest},
+		{http.MethodGet, "u1", path + "/deliveries?limit=0", "", http.StatusBadRequest},
+		{http.MethodPost, "u1", "/api/v1/webhooks", `{"url": "mailto:user@example.com"}`, http.StatusBadRequest},
+		{http.MethodPut, "u1", path, `{"url": "https://example.org/v2", "enabled": false}`, http.StatusOK},
+		{http.MethodDelete, "u1", path, "", http.StatusNoContent},
+		{http.MethodGet, "u1", path + "/deliveries", "", http.StatusNotFound},
+	} {
+		resp, body := ts.do(t, c.method, c.userID, c.path, strings.NewReader(c.body))
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s %s as %s: got status %d, want %d: %s", c.method, c.path, c.userID, resp.StatusCode, c.wantStatus, body)
+		}
+	}
+}
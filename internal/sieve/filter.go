@@ -0,0 +1,353 @@
+package sieve
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/labels"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+// maxNameLength bounds the length of a script name in bytes.
+const maxNameLength = 128
+
+// Sender sends mail on a user's behalf: redirected messages, vacation
+// responses and rejection notices.
+type Sender interface {
+	Send(ctx context.Context, userID, to string, raw []byte) error
+}
+
+// StoredScript is a user's script as the API shows it.
+type StoredScript struct {
+	Name      string    `json:"name"`
+	Active    bool      `json:"active"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newStoredScript(row schema.SieveScript) StoredScript {
+	return StoredScript{
+		Name:      row.Name,
+		Active:    row.Active,
+		Content:   row.Content,
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
+	}
+}
+
+// Filter stores users' scripts and runs each user's active script against
+// the messages stored for them.
+type Filter struct {
+	db     database.Service
+	sender Sender // nil when outbound mail is not configured
+}
+
+// New creates a Filter. Redirects, vacation responses and rejection notices
+// are skipped until a Sender is set.
+func New(db database.Service) *Filter {
+	return &Filter{db: db}
+}
+
+// SetSender sets how the filter sends mail.
+func (f *Filter) SetSender(s Sender) {
+	f.sender = s
+}
+
+// List returns userID's scripts by name.
+func (f *Filter) List(ctx context.Context, userID string) ([]StoredScript, error) {
+	rows, err := f.db.Queries().ListSieveScriptsByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sieve scripts: %w", err)
+	}
+	list := make([]StoredScript, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, newStoredScript(row))
+	}
+	return list, nil
+}
+
+// Get returns one of userID's scripts.
+func (f *Filter) Get(ctx context.Context, userID, name string) (StoredScript, error) {
+	row, err := f.db.Queries().GetSieveScript(ctx, schema.GetSieveScriptParams{UserID: userID, Name: name})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return StoredScript{}, ErrScriptNotFound
+		}
+		return StoredScript{}, fmt.Errorf("failed to get sieve script: %w", err)
+	}
+	return newStoredScript(row), nil
+}
+
+// Put creates or replaces one of userID's scripts, reporting whether it was
+// created. Scripts that don't compile are refused with an *Error.
+func (f *Filter) Put(ctx context.Context, userID, name, content string) (StoredScript, bool, error) {
+	if err := validateName(name); err != nil {
+		return StoredScript{}, false, err
+	}
+	if _, err := Compile(content); err != nil {
+		return StoredScript{}, false, err
+	}
+
+	created := false
+	err := f.db.WithTx(ctx, func(q *schema.Queries) error {
+		n, err := q.UpdateSieveScript(ctx, schema.UpdateSieveScriptParams{Content: content, UserID: userID, Name: name})
+		if err != nil {
+			return fmt.Errorf("failed to update sieve script: %w", err)
+		}
+		if n > 0 {
+			return nil
+		}
+		created = true
+		err = q.InsertSieveScript(ctx, schema.InsertSieveScriptParams{
+			ID:      uuid.New().String(),
+			UserID:  userID,
+			Name:    name,
+			Content: content,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert sieve script: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return StoredScript{}, false, err
+	}
+	s, err := f.Get(ctx, userID, name)
+	return s, created, err
+}
+
+// Delete removes one of userID's scripts. Deleting the active script turns
+// filtering off.
+func (f *Filter) Delete(ctx context.Context, userID, name string) error {
+	n, err := f.db.Queries().DeleteSieveScript(ctx, schema.DeleteSieveScriptParams{UserID: userID, Name: name})
+	if err != nil {
+		return fmt.Errorf("failed to delete sieve script: %w", err)
+	}
+	if n == 0 {
+		return ErrScriptNotFound
+	}
+	return nil
+}
+
+// Activate makes the named script the one that runs on userID's mail. An
+// empty name turns filtering off.
+func (f *Filter) Activate(ctx context.Context, userID, name string) error {
+	return f.db.WithTx(ctx, func(q *schema.Queries) error {
+		if err := q.DeactivateSieveScripts(ctx, userID); err != nil {
+			return fmt.Errorf("failed to deactivate sieve scripts: %w", err)
+		}
+		if name == "" {
+			return nil
+		}
+		n, err := q.ActivateSieveScript(ctx, schema.ActivateSieveScriptParams{UserID: userID, Name: name})
+		if err != nil {
+			return fmt.Errorf("failed to activate sieve script: %w", err)
+		}
+		if n == 0 {
+			return ErrScriptNotFound
+		}
+		return nil
+	})
+}
+
+func validateName(name string) error {
+	if name == "" || len(name) > maxNameLength || !utf8.ValidString(name) {
+		return ErrInvalidName
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == '/' {
+			return ErrInvalidName
+		}
+	}
+	return nil
+}
+
+// Process runs the active script of the message's owner against a stored
+// message. Changes to the message are made in one transaction; redirects,
+// vacation responses and rejection notices are sent afterwards. A script
+// that fails at runtime keeps the message, as RFC 5228 requires.
+func (f *Filter) Process(ctx context.Context, rec database.MessageRecord, env mailstore.Envelope) error {
+	userID := rec.Message.UserID
+	q := f.db.Queries()
+	row, err := q.GetActiveSieveScript(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("failed to get active sieve script: %w", err)
+	}
+	script, err := Compile(row.Content)
+	if err != nil {
+		return fmt.Errorf("active sieve script %q: %w", row.Name, err)
+	}
+	user, err := q.GetUserByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	m, err := NewMessage(rec.Blobs[rec.Body.RawHash])
+	if err != nil {
+		return fmt.Errorf("failed to parse message: %w", err)
+	}
+	m.EnvelopeFrom, m.EnvelopeTo = env.From, env.To
+	m.Addresses = []string{user.Email}
+	if env.To != "" {
+		m.Addresses = append(m.Addresses, env.To)
+	}
+
+	var errs []error
+	res, err := script.Run(m)
+	if err != nil {
+		metrics.Errors.WithLabelValues("sieve_runtime").Inc()
+		errs = append(errs, fmt.Errorf("sieve script %q failed: %w", row.Name, err))
+	}
+	if err := f.apply(ctx, rec, res); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	recipient := env.To
+	if recipient == "" {
+		recipient = user.Email
+	}
+	for _, rd := range res.Redirects {
+		if err := f.send(ctx, userID, rd.Address, m.Raw()); err != nil {
+			errs = append(errs, fmt.Errorf("failed to redirect message to %s: %w", rd.Address, err))
+		}
+	}
+	if res.Reject != nil && env.From != "" {
+		if err := f.send(ctx, userID, env.From, RejectNotice(res.Reject, m, user.Email, recipient)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send rejection to %s: %w", env.From, err))
+		}
+	}
+	if res.Vacation != nil {
+		if err := f.vacation(ctx, userID, res.Vacation, m, user.Email); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// apply files, flags or deletes the stored message as the result says. The
+// message is deleted when it is neither kept nor filed anywhere; otherwise
+// mailboxes become labels, and a message that isn't kept leaves the inbox.
+// Labels added and deletions are published as webhook events.
+func (f *Filter) apply(ctx context.Context, rec database.MessageRecord, res *Result) error {
+	flags := res.KeepFlags
+	for _, fi := range res.FileInto {
+		flags = mergeFlags(flags, fi.Flags)
+	}
+	if res.Keep && len(res.FileInto) == 0 && len(flags) == 0 {
+		return nil
+	}
+
+	id, userID := rec.Message.ID, rec.Message.UserID
+	return f.db.WithTx(ctx, func(q *schema.Queries) error {
+		if _, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: userID}); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				// An earlier processor deleted it
+				return nil
+			}
+			return fmt.Errorf("failed to get message: %w", err)
+		}
+		if !res.Keep && len(res.FileInto) == 0 {
+			if _, err := database.DeleteMessageTx(ctx, q, userID, id); err != nil {
+				return err
+			}
+			return webhook.PublishTx(ctx, q, userID, webhook.EventMessageDeleted, webhook.MessageDeleted{MessageID: id})
+		}
+
+		var added []string
+		for _, fi := range res.FileInto {
+			label, err := labels.Canonical(fi.Mailbox)
+			if err != nil {
+				// Skipped rather than failing the script's other actions
+				logger.Warn(ctx, "Sieve script filed into an invalid mailbox", "mailbox", fi.Mailbox, "error", err)
+				continue
+			}
+			if err := labels.Add(ctx, q, userID, id, label); err != nil {
+				return err
+			}
+			added = append(added, label)
+		}
+		if len(added) > 0 {
+			err := webhook.PublishTx(ctx, q, userID, webhook.EventMessageLabeled, webhook.MessageLabeled{MessageID: id, Labels: added})
+			if err != nil {
+				return err
+			}
+		}
+		if !res.Keep {
+			if err := q.SetMessageArchived(ctx, schema.SetMessageArchivedParams{Archived: true, ID: id, UserID: userID}); err != nil {
+				return fmt.Errorf("failed to archive message: %w", err)
+			}
+		}
+		for _, flag := range flags {
+			if strings.EqualFold(flag, `\Seen`) {
+				if err := q.SetMessageRead(ctx, schema.SetMessageReadParams{IsRead: true, ID: id, UserID: userID}); err != nil {
+					return fmt.Errorf("failed to mark message read: %w", err)
+				}
+				continue
+			}
+			err := q.AddMessageKeyword(ctx, schema.AddMessageKeywordParams{MessageID: id, UserID: userID, Keyword: flag})
+			if err != nil {
+				return fmt.Errorf("failed to flag message: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// vacation sends a vacation response unless the sender already had one with
+// the same handle within its :days.
+func (f *Filter) vacation(ctx context.Context, userID string, v *Vacation, m *Message, from string) error {
+	q := f.db.Queries()
+	sender := strings.ToLower(v.Sender)
+	key := schema.GetSieveVacationParams{UserID: userID, Handle: v.Handle, Sender: sender}
+	sentAt, err := q.GetSieveVacation(ctx, key)
+	switch {
+	case err == nil:
+		if time.Since(sentAt) < time.Duration(v.Days)*24*time.Hour {
+			return nil
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("failed to get vacation response: %w", err)
+	}
+
+	if err := f.send(ctx, userID, v.Sender, VacationResponse(v, m, from)); err != nil {
+		return fmt.Errorf("failed to send vacation response to %s: %w", v.Sender, err)
+	}
+	err = q.PutSieveVacation(ctx, schema.PutSieveVacationParams{
+		UserID: userID,
+		Handle: v.Handle,
+		Sender: sender,
+		SentAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record vacation response: %w", err)
+	}
+	return nil
+}
+
+func (f *Filter) send(ctx context.Context, userID, to string, raw []byte) error {
+	if f.sender == nil {
+		logger.Warn(ctx, "Skipping sieve action; outbound mail is not configured", "to", to)
+		return nil
+	}
+	if err := f.sender.Send(ctx, userID, to, raw); err != nil {
+		metrics.Errors.WithLabelValues("sieve_send").Inc()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,602 @@
+package sieve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+// maxRedirects bounds the redirects one run may make.
+const maxRedirects = 4
+
+// Result lists what a script decided to do with a message.
+type Result struct {
+	// Keep is set when the message stays in the inbox, by an explicit keep
+	// or because no action cancelled the implicit keep. KeepFlags are the
+	// IMAP flags it is kept with.
+	Keep      bool
+	KeepFlags []string
+
+	FileInto  []FileInto
+	Redirects []Redirect
+	Reject    *Reject
+	Vacation  *Vacation
+}
+
+// FileInto files the message into a mailbox.
+type FileInto struct {
+	Mailbox string
+	Flags   []string
+}
+
+// Redirect sends the message on to another address.
+type Redirect struct {
+	Address string
+}
+
+// Reject refuses the message, telling the sender why.
+type Reject struct {
+	Reason string
+}
+
+// Vacation is an automatic response to the sender. The caller sends it
+// unless it already responded to Sender with Handle within Days.
+type Vacation struct {
+	Sender  string // address the response goes to
+	Handle  string
+	Days    int64
+	Subject string
+	From    string // empty means the recipient's address
+	Reason  string
+	MIME    bool // Reason is a MIME entity rather than plain text
+}
+
+// Run executes the script against m. A runtime error leaves the result
+// holding only an implicit keep, as RFC 5228 section 2.10.6 requires.
+func (s *Script) Run(m *Message) (*Result, error) {
+	r := &run{
+		script: s,
+		msg:    m,
+		vars:   map[string]string{},
+		res:    &Result{},
+		keep:   true,
+	}
+	err := r.block(s.cmds)
+	if errors.Is(err, errStop) {
+		err = nil
+	}
+	if err != nil {
+		return &Result{Keep: true}, err
+	}
+	if r.keep {
+		r.res.Keep = true
+		r.res.KeepFlags = mergeFlags(r.res.KeepFlags, r.flags(""))
+	}
+	return r.res, nil
+}
+
+// errStop ends a run early without being an error.
+var errStop = errors.New("stop")
+
+// run is the state of one script execution.
+type run struct {
+	script *Script
+	msg    *Message
+	res    *Result
+
+	vars      map[string]string
+	matchVars []string
+
+	// keep is the implicit keep, cancelled by discard, redirect, fileinto
+	// and reject
+	keep         bool
+	explicitKeep bool
+}
+
+type cmd interface {
+	exec(r *run) error
+}
+
+type cond interface {
+	eval(r *run) (bool, error)
+}
+
+func (r *run) block(cmds []cmd) error {
+	for _, c := range cmds {
+		if err := c.exec(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expand substitutes variables in s when the script uses the variables
+// extension.
+func (r *run) expand(s string) string {
+	if !r.script.extensions["variables"] {
+		return s
+	}
+	return expandVariables(s, r.vars, r.matchVars)
+}
+
+func (r *run) expandAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = r.expand(s)
+	}
+	return out
+}
+
+type cmdIf struct {
+	tests     []cond
+	blocks    [][]cmd
+	otherwise []cmd
+}
+
+func (c *cmdIf) exec(r *run) error {
+	for i, t := range c.tests {
+		ok, err := t.eval(r)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return r.block(c.blocks[i])
+		}
+	}
+	return r.block(c.otherwise)
+}
+
+type cmdStop struct{}
+
+func (*cmdStop) exec(*run) error {
+	return errStop
+}
+
+type cmdDiscard struct{}
+
+func (*cmdDiscard) exec(r *run) error {
+	r.keep = false
+	return nil
+}
+
+type cmdKeep struct {
+	flags    []string
+	hasFlags bool
+}
+
+func (c *cmdKeep) exec(r *run) error {
+	if r.res.Reject != nil {
+		return errors.New("keep can't be used with reject")
+	}
+	flags := r.flags("")
+	if c.hasFlags {
+		flags = normalizeFlags(r.expandAll(c.flags))
+	}
+	r.res.Keep = true
+	r.res.KeepFlags = mergeFlags(r.res.KeepFlags, flags)
+	r.explicitKeep = true
+	r.keep = false
+	return nil
+}
+
+type cmdFileInto struct {
+	mailbox  string
+	copy     bool
+	flags    []string
+	hasFlags bool
+}
+
+func (c *cmdFileInto) exec(r *run) error {
+	if r.res.Reject != nil {
+		return errors.New("fileinto can't be used with reject")
+	}
+	mailbox := r.expand(c.mailbox)
+	if mailbox == "" {
+		return errors.New("fileinto needs a mailbox name")
+	}
+	flags := r.flags("")
+	if c.hasFlags {
+		flags = normalizeFlags(r.expandAll(c.flags))
+	}
+	if !c.copy {
+		r.keep = false
+	}
+	// Filing into INBOX is the same as keeping the message
+	if strings.EqualFold(mailbox, "INBOX") {
+		r.res.Keep = true
+		r.res.KeepFlags = mergeFlags(r.res.KeepFlags, flags)
+		r.explicitKeep = true
+		return nil
+	}
+	for i, f := range r.res.FileInto {
+		if f.Mailbox == mailbox {
+			r.res.FileInto[i].Flags = mergeFlags(f.Flags, flags)
+			return nil
+		}
+	}
+	r.res.FileInto = append(r.res.FileInto, FileInto{Mailbox: mailbox, Flags: flags})
+	return nil
+}
+
+type cmdRedirect struct {
+	address string
+	copy    bool
+}
+
+func (c *cmdRedirect) exec(r *run) error {
+	address := r.expand(c.address)
+	if !validAddress(address) {
+		return fmt.Errorf("redirect to invalid address %q", address)
+	}
+	if !c.copy {
+		r.keep = false
+	}
+	for _, rd := range r.res.Redirects {
+		if strings.EqualFold(rd.Address, address) {
+			return nil
+		}
+	}
+	if len(r.res.Redirects) >= maxRedirects {
+		return fmt.Errorf("more than %d redirects", maxRedirects)
+	}
+	r.res.Redirects = append(r.res.Redirects, Redirect{Address: address})
+	return nil
+}
+
+type cmdReject struct {
+	reason string
+}
+
+func (c *cmdReject) exec(r *run) error {
+	if r.res.Reject != nil {
+		return errors.New("reject used more than once")
+	}
+	if r.explicitKeep || len(r.res.FileInto) > 0 || r.res.Vacation != nil {
+		return errors.New("reject can't be used with keep, fileinto or vacation")
+	}
+	r.keep = false
+	r.res.Reject = &Reject{Reason: r.expand(c.reason)}
+	return nil
+}
+
+type cmdVacation struct {
+	days      int64
+	subject   string
+	from      string
+	addresses []string
+	mime      bool
+	handle    string
+	reason    string
+}
+
+func (c *cmdVacation) exec(r *run) error {
+	if r.res.Reject != nil {
+		return errors.New("vacation can't be used with reject")
+	}
+	if r.res.Vacation != nil {
+		return errors.New("vacation used more than once")
+	}
+	sender, ok := r.vacationSender(r.expandAll(c.addresses))
+	if !ok {
+		return nil
+	}
+
+	v := &Vacation{
+		Sender:  sender,
+		Days:    c.days,
+		Subject: r.expand(c.subject),
+		From:    r.expand(c.from),
+		Reason:  r.expand(c.reason),
+		MIME:    c.mime,
+		Handle:  r.expand(c.handle),
+	}
+	if v.Handle == "" {
+		// Without a handle, responses with different content count as
+		// different vacations (RFC 5230 section 4.2)
+		sum := sha256.Sum256([]byte(v.Subject + "\x00" + v.From + "\x00" + v.Reason + "\x00" + fmt.Sprint(v.MIME)))
+		v.Handle = hex.EncodeToString(sum[:16])
+	}
+	r.res.Vacation = v
+	return nil
+}
+
+// vacationSender returns who a vacation response would go to, and whether
+// one should be sent at all (RFC 5230 sections 4.5 and 4.6). Responses only
+// go to a personal message sent directly to one of the recipient's
+// addresses, never to lists, automated mail or the recipient themselves.
+func (r *run) vacationSender(extra []string) (string, bool) {
+	sender := r.msg.EnvelopeFrom
+	if sender == "" {
+		for _, v := range r.msg.parsed.Header().Values("Return-Path") {
+			if list := mime.ParseAddressList(v); len(list) > 0 {
+				sender = list[0].Address
+			}
+		}
+	}
+	if sender == "" {
+		return "", false
+	}
+	local := asciiLower(addressPart(sender, "localpart"))
+	if local == "mailer-daemon" || local == "listserv" || local == "majordomo" ||
+		strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return "", false
+	}
+
+	if auto := r.msg.header("Auto-Submitted"); len(auto) > 0 && !strings.EqualFold(auto[0], "no") {
+		return "", false
+	}
+	for _, p := range r.msg.header("Precedence") {
+		if p := asciiLower(p); p == "bulk" || p == "list" || p == "junk" {
+			return "", false
+		}
+	}
+	for _, h := range []string{"List-Id", "List-Unsubscribe", "List-Post"} {
+		if len(r.msg.header(h)) > 0 {
+			return "", false
+		}
+	}
+
+	own := append(append([]string{}, r.msg.Addresses...), extra...)
+	isOwn := func(addr string) bool {
+		for _, a := range own {
+			if strings.EqualFold(a, addr) {
+				return true
+			}
+		}
+		return false
+	}
+	if isOwn(sender) {
+		return "", false
+	}
+	for _, h := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		for _, v := range r.msg.parsed.Header().Values(h) {
+			for _, addr := range mime.ParseAddressList(v) {
+				if isOwn(addr.Address) {
+					return sender, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+type cmdFlags struct {
+	op       string // setflag, addflag or removeflag
+	variable string // "" for the internal flags variable
+	flags    []string
+}
+
+func (c *cmdFlags) exec(r *run) error {
+	flags := normalizeFlags(r.expandAll(c.flags))
+	current := r.flags(c.variable)
+	switch c.op {
+	case "setflag":
+		current = flags
+	case "addflag":
+		current = mergeFlags(current, flags)
+	case "removeflag":
+		var kept []string
+		for _, f := range current {
+			if !containsFold(flags, f) {
+				kept = append(kept, f)
+			}
+		}
+		current = kept
+	}
+	r.vars[flagVariable(c.variable)] = strings.Join(current, " ")
+	return nil
+}
+
+// flagVariable returns the key of a flag variable in run.vars. The internal
+// variable of imap4flags can't clash with script variables, whose names
+// can't contain spaces.
+func flagVariable(name string) string {
+	if name == "" {
+		return " flags"
+	}
+	return name
+}
+
+// flags returns the flags held by a flag variable.
+func (r *run) flags(variable string) []string {
+	return normalizeFlags([]string{r.vars[flagVariable(variable)]})
+}
+
+// normalizeFlags splits space-separated flag lists and drops duplicates,
+// which differ only in case.
+func normalizeFlags(lists []string) []string {
+	var flags []string
+	for _, list := range lists {
+		for _, f := range strings.Fields(list) {
+			if !containsFold(flags, f) {
+				flags = append(flags, f)
+			}
+		}
+	}
+	return flags
+}
+
+func mergeFlags(a, b []string) []string {
+	return normalizeFlags([]string{strings.Join(a, " "), strings.Join(b, " ")})
+}
+
+func containsFold(list []string, s string) bool {
+	for _, x := range list {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type cmdSet struct {
+	name          string
+	value         string
+	caseMod       string // "lower", "upper" or ""
+	firstMod      string // "lowerfirst", "upperfirst" or ""
+	quoteWildcard bool
+	length        bool
+}
+
+func (c *cmdSet) exec(r *run) error {
+	r.vars[c.name] = applyModifiers(r.expand(c.value), c)
+	return nil
+}
+
+type testConst bool
+
+func (t testConst) eval(*run) (bool, error) {
+	return bool(t), nil
+}
+
+type testNot struct {
+	test cond
+}
+
+func (t *testNot) eval(r *run) (bool, error) {
+	ok, err := t.test.eval(r)
+	return !ok, err
+}
+
+// testAll is allof, or anyof when any is set. Both short-circuit.
+type testAll struct {
+	any   bool
+	tests []cond
+}
+
+func (t *testAll) eval(r *run) (bool, error) {
+	for _, sub := range t.tests {
+		ok, err := sub.eval(r)
+		if err != nil {
+			return false, err
+		}
+		if ok == t.any {
+			return ok, nil
+		}
+	}
+	return !t.any, nil
+}
+
+type testExists struct {
+	headers []string
+}
+
+func (t *testExists) eval(r *run) (bool, error) {
+	for _, h := range r.expandAll(t.headers) {
+		if len(r.msg.parsed.Header().Values(h)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+type testSize struct {
+	over  bool
+	limit int64
+}
+
+func (t *testSize) eval(r *run) (bool, error) {
+	size := int64(len(r.msg.raw))
+	if t.over {
+		return size > t.limit, nil
+	}
+	return size < t.limit, nil
+}
+
+type testHeader struct {
+	headers []string
+	*matcher
+}
+
+func (t *testHeader) eval(r *run) (bool, error) {
+	var values []string
+	for _, h := range r.expandAll(t.headers) {
+		values = append(values, r.msg.header(h)...)
+	}
+	return t.test(r, values)
+}
+
+type testAddress struct {
+	envelope bool
+	fields   []string
+	part     string
+	*matcher
+}
+
+func (t *testAddress) eval(r *run) (bool, error) {
+	var values []string
+	for _, f := range r.expandAll(t.fields) {
+		if t.envelope {
+			addr := r.msg.EnvelopeFrom
+			if f == "to" {
+				addr = r.msg.EnvelopeTo
+			}
+			// The null reverse path matches as the empty string for all
+			// address parts
+			if addr == "" {
+				values = append(values, "")
+			} else {
+				values = append(values, addressPart(addr, t.part))
+			}
+			continue
+		}
+		for _, v := range r.msg.parsed.Header().Values(f) {
+			for _, addr := range mime.ParseAddressList(v) {
+				values = append(values, addressPart(addr.Address, t.part))
+			}
+		}
+	}
+	return t.test(r, values)
+}
+
+type testBody struct {
+	transform string // "text", "raw" or "content"
+	types     []string
+	*matcher
+}
+
+func (t *testBody) eval(r *run) (bool, error) {
+	var values []string
+	switch t.transform {
+	case "raw":
+		values = []string{r.msg.rawBody()}
+	case "content":
+		values = r.msg.bodyParts(r.expandAll(t.types))
+	default:
+		values = []string{r.msg.text()}
+	}
+	// The body test doesn't set match variables (RFC 5173 section 6)
+	saved := r.matchVars
+	ok, err := t.test(r, values)
+	r.matchVars = saved
+	return ok, err
+}
+
+type testHasFlag struct {
+	variables []string
+	*matcher
+}
+
+func (t *testHasFlag) eval(r *run) (bool, error) {
+	var flags []string
+	if len(t.variables) == 0 {
+		flags = r.flags("")
+	}
+	for _, v := range t.variables {
+		flags = append(flags, r.flags(v)...)
+	}
+	return t.test(r, flags)
+}
+
+type testString struct {
+	sources []string
+	*matcher
+}
+
+func (t *testString) eval(r *run) (bool, error) {
+	return t.test(r, r.expandAll(t.sources))
+}
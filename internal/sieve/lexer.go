@@ -0,0 +1,268 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdentifier
+	tokTag
+	tokNumber
+	tokString
+	tokLeftBracket
+	tokRightBracket
+	tokLeftParen
+	tokRightParen
+	tokLeftBrace
+	tokRightBrace
+	tokComma
+	tokSemicolon
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of script"
+	case tokIdentifier:
+		return "identifier"
+	case tokTag:
+		return "tag"
+	case tokNumber:
+		return "number"
+	case tokString:
+		return "string"
+	case tokLeftBracket:
+		return `"["`
+	case tokRightBracket:
+		return `"]"`
+	case tokLeftParen:
+		return `"("`
+	case tokRightParen:
+		return `")"`
+	case tokLeftBrace:
+		return `"{"`
+	case tokRightBrace:
+		return `"}"`
+	case tokComma:
+		return `","`
+	default:
+		return `";"`
+	}
+}
+
+type token struct {
+	kind tokenKind
+	text string // identifier and tag names are lower-cased
+	num  int64
+	line int
+}
+
+// lex splits a script into tokens (RFC 5228 section 8.1).
+func lex(src string) ([]token, error) {
+	l := &lexer{src: src, line: 1}
+	var toks []token
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, tok)
+		if tok.kind == tokEOF {
+			return toks, nil
+		}
+	}
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &Error{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	line := l.line
+	c := l.src[l.pos]
+	single := map[byte]tokenKind{
+		'[': tokLeftBracket, ']': tokRightBracket,
+		'(': tokLeftParen, ')': tokRightParen,
+		'{': tokLeftBrace, '}': tokRightBrace,
+		',': tokComma, ';': tokSemicolon,
+	}
+	if kind, ok := single[c]; ok {
+		l.pos++
+		return token{kind: kind, line: line}, nil
+	}
+
+	switch {
+	case c == '"':
+		s, err := l.quoted()
+		return token{kind: tokString, text: s, line: line}, err
+	case c == ':':
+		l.pos++
+		name := l.identifier()
+		if name == "" {
+			return token{}, l.errorf("expected a tag name after \":\"")
+		}
+		return token{kind: tokTag, text: strings.ToLower(name), line: line}, nil
+	case c >= '0' && c <= '9':
+		return l.number()
+	case isIdentStart(c):
+		name := l.identifier()
+		if strings.EqualFold(name, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			s, err := l.multiline()
+			return token{kind: tokString, text: s, line: line}, err
+		}
+		return token{kind: tokIdentifier, text: strings.ToLower(name), line: line}, nil
+	}
+	return token{}, l.errorf("unexpected character %q", c)
+}
+
+// skipSpace skips white space and comments.
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if !isIdentStart(c) && !(c >= '0' && c <= '9') {
+			break
+		}
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+// number reads a number with an optional K, M or G quantifier.
+func (l *lexer) number() (token, error) {
+	line := l.line
+	start := l.pos
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		l.pos++
+	}
+	n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+	if err != nil {
+		return token{}, l.errorf("number out of range")
+	}
+	if l.pos < len(l.src) {
+		shift := map[byte]uint{'k': 10, 'K': 10, 'm': 20, 'M': 20, 'g': 30, 'G': 30}[l.src[l.pos]]
+		if shift > 0 {
+			l.pos++
+			if n > (1<<62)>>shift {
+				return token{}, l.errorf("number out of range")
+			}
+			n <<= shift
+		}
+	}
+	return token{kind: tokNumber, num: n, line: line}, nil
+}
+
+// quoted reads a quoted string, in which only \" and \\ are escapes.
+func (l *lexer) quoted() (string, error) {
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return b.String(), nil
+		case '\\':
+			if l.pos+1 < len(l.src) {
+				l.pos++
+				c = l.src[l.pos]
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return "", l.errorf("unterminated string")
+}
+
+// multiline reads the rest of a text: string, which ends with a line
+// holding a single dot. A leading dot on other lines is doubled.
+func (l *lexer) multiline() (string, error) {
+	// The rest of the text: line is white space or a comment
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return "", l.errorf("expected a line break after text:")
+	}
+	l.pos++
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			break
+		}
+		line := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end + 1
+		l.line++
+		if line == "." {
+			return b.String(), nil
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	return "", l.errorf("unterminated text: string")
+}
@@ -0,0 +1,141 @@
+package sieve
+
+import (
+	"regexp"
+	"strings"
+)
+
+// matcher compares values against a test's key list with its comparator
+// and match type.
+type matcher struct {
+	comparator string // "i;ascii-casemap" or "i;octet"
+	match      string // "is", "contains", "matches" or "regex"
+	keys       []string
+	patterns   []*regexp.Regexp // compiled :regex keys; nil where a key holds variables
+}
+
+func (m *matcher) fold() bool {
+	return m.comparator == "i;ascii-casemap"
+}
+
+// compile compiles a :regex key. Sieve regexes are POSIX extended; RE2
+// syntax covers what scripts use in practice.
+func (m *matcher) compile(key string) (*regexp.Regexp, error) {
+	if m.fold() {
+		key = "(?i)" + key
+	}
+	return regexp.Compile(key)
+}
+
+// test reports whether any value matches any key. Keys are expanded first
+// when the script uses variables. On a match with :matches or :regex, the
+// match variables are set from the first matching value and key.
+func (m *matcher) test(r *run, values []string) (bool, error) {
+	for i, key := range m.keys {
+		key := r.expand(key)
+		var re *regexp.Regexp
+		switch m.match {
+		case "regex":
+			re = m.patterns[i]
+			if re == nil {
+				var err error
+				if re, err = m.compile(key); err != nil {
+					return false, err
+				}
+			}
+		case "matches":
+			re = globRegexp(key, m.fold())
+		}
+
+		for _, v := range values {
+			switch m.match {
+			case "is":
+				if m.equal(v, key) {
+					return true, nil
+				}
+			case "contains":
+				if m.contains(v, key) {
+					return true, nil
+				}
+			default:
+				if groups := re.FindStringSubmatch(v); groups != nil {
+					r.matchVars = groups
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *matcher) equal(a, b string) bool {
+	if m.fold() {
+		return asciiLower(a) == asciiLower(b)
+	}
+	return a == b
+}
+
+func (m *matcher) contains(s, sub string) bool {
+	if m.fold() {
+		return strings.Contains(asciiLower(s), asciiLower(sub))
+	}
+	return strings.Contains(s, sub)
+}
+
+// asciiLower folds only ASCII letters, as i;ascii-casemap requires.
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// globRegexp converts a :matches pattern to an anchored regular expression
+// with a group per wildcard. "*" matches as little as it can and "?" one
+// character; a backslash quotes the next character.
+func globRegexp(pattern string, fold bool) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)")
+	if fold {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString("(.*?)")
+		case '?':
+			b.WriteString("(.)")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// addressPart returns the part of an address selected by :all, :localpart or
+// :domain.
+func addressPart(address, part string) string {
+	at := strings.LastIndex(address, "@")
+	switch part {
+	case "localpart":
+		if at < 0 {
+			return address
+		}
+		return address[:at]
+	case "domain":
+		if at < 0 {
+			return ""
+		}
+		return address[at+1:]
+	}
+	return address
+}
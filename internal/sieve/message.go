@@ -0,0 +1,101 @@
+package sieve
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/parsel-email/mailroom/internal/mime"
+)
+
+// Message is a message that a script runs against.
+type Message struct {
+	raw    []byte
+	parsed *mime.Message
+
+	// EnvelopeFrom and EnvelopeTo are the SMTP MAIL FROM and RCPT TO
+	// addresses. Both are empty for mail that didn't arrive over SMTP.
+	EnvelopeFrom string
+	EnvelopeTo   string
+
+	// Addresses are the recipient's own addresses. Vacation only responds
+	// to mail sent to one of them.
+	Addresses []string
+}
+
+// NewMessage parses raw for a script to run against.
+func NewMessage(raw []byte) (*Message, error) {
+	parsed, err := mime.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{raw: raw, parsed: parsed}, nil
+}
+
+// Raw returns the message as it was delivered.
+func (m *Message) Raw() []byte {
+	return m.raw
+}
+
+// header returns the decoded values of the top-level fields named name.
+func (m *Message) header(name string) []string {
+	var values []string
+	for _, v := range m.parsed.Header().Values(name) {
+		values = append(values, strings.TrimSpace(mime.DecodeHeader(v)))
+	}
+	return values
+}
+
+// rawBody returns the body of the message without transfer decoding.
+func (m *Message) rawBody() string {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(m.raw, []byte(sep)); i >= 0 {
+			return string(m.raw[i+len(sep):])
+		}
+	}
+	return ""
+}
+
+// bodyParts returns the decoded text of the leaf parts whose content type
+// matches one of types, as the body test's :content does. An empty type
+// matches every part; a type without a subtype matches all its subtypes.
+func (m *Message) bodyParts(types []string) []string {
+	var texts []string
+	m.parsed.Root.Walk(func(p *mime.Part) {
+		if p.IsMultipart() {
+			return
+		}
+		mediaType := p.MediaType
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+		for _, t := range types {
+			t = strings.ToLower(t)
+			if t == "" || t == mediaType || (!strings.Contains(t, "/") && strings.HasPrefix(mediaType, t+"/")) {
+				if p.Text != "" {
+					texts = append(texts, p.Text)
+				} else {
+					texts = append(texts, string(p.Body))
+				}
+				return
+			}
+		}
+	})
+	return texts
+}
+
+// text returns the message's text for the body test's :text transform, with
+// HTML parts reduced to their text.
+func (m *Message) text() string {
+	var parts []string
+	m.parsed.Root.Walk(func(p *mime.Part) {
+		switch {
+		case p.MediaType == "text/html":
+			parts = append(parts, mime.HTMLText(p.Text))
+		case p.MediaType == "" || strings.HasPrefix(p.MediaType, "text/"):
+			if p.Disposition != "attachment" {
+				parts = append(parts, p.Text)
+			}
+		}
+	})
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,232 @@
+package sieve
+
+import "fmt"
+
+type argKind int
+
+const (
+	argTag argKind = iota
+	argNumber
+	argStrings
+)
+
+// arg is a positional argument or tag of a command or test.
+type arg struct {
+	kind    argKind
+	tag     string
+	num     int64
+	strings []string
+	line    int
+}
+
+// test is a test with its arguments and nested tests (for allof, anyof and
+// not).
+type test struct {
+	name  string
+	args  []arg
+	tests []*test
+	line  int
+}
+
+// command is a command with its arguments, the test of if and elsif, and
+// the block of a control command.
+type command struct {
+	name  string
+	args  []arg
+	test  *test
+	block []*command
+	line  int
+}
+
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+// maxDepth bounds the nesting of blocks and tests.
+const maxDepth = 32
+
+// parse builds the syntax tree of a script (RFC 5228 section 8.2).
+func parse(src string) ([]*command, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok.kind)
+	}
+	return cmds, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) advance() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return &Error{Line: tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	tok := p.advance()
+	if tok.kind != kind {
+		return tok, p.errorf(tok, "expected %s, found %s", kind, tok.kind)
+	}
+	return tok, nil
+}
+
+func (p *parser) commands() ([]*command, error) {
+	var cmds []*command
+	for p.peek().kind == tokIdentifier {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (p *parser) command() (*command, error) {
+	name := p.advance()
+	cmd := &command{name: name.text, line: name.line}
+
+	args, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	cmd.args = args
+
+	switch p.peek().kind {
+	case tokIdentifier:
+		if cmd.test, err = p.test(); err != nil {
+			return nil, err
+		}
+	case tokLeftParen:
+		tok := p.peek()
+		return nil, p.errorf(tok, "%s takes a single test, not a test list", cmd.name)
+	}
+
+	switch tok := p.advance(); tok.kind {
+	case tokSemicolon:
+		return cmd, nil
+	case tokLeftBrace:
+		if p.depth++; p.depth > maxDepth {
+			return nil, p.errorf(tok, "blocks are nested too deeply")
+		}
+		if cmd.block, err = p.commands(); err != nil {
+			return nil, err
+		}
+		p.depth--
+		if cmd.block == nil {
+			cmd.block = []*command{}
+		}
+		if _, err := p.expect(tokRightBrace); err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	default:
+		return nil, p.errorf(tok, "expected \";\" or a block after %s, found %s", cmd.name, tok.kind)
+	}
+}
+
+func (p *parser) arguments() ([]arg, error) {
+	var args []arg
+	for {
+		tok := p.peek()
+		switch tok.kind {
+		case tokTag:
+			p.advance()
+			args = append(args, arg{kind: argTag, tag: tok.text, line: tok.line})
+		case tokNumber:
+			p.advance()
+			args = append(args, arg{kind: argNumber, num: tok.num, line: tok.line})
+		case tokString:
+			p.advance()
+			args = append(args, arg{kind: argStrings, strings: []string{tok.text}, line: tok.line})
+		case tokLeftBracket:
+			list, err := p.stringList()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg{kind: argStrings, strings: list, line: tok.line})
+		default:
+			return args, nil
+		}
+	}
+}
+
+func (p *parser) stringList() ([]string, error) {
+	p.advance()
+	var list []string
+	for {
+		tok, err := p.expect(tokString)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, tok.text)
+		tok = p.advance()
+		switch tok.kind {
+		case tokComma:
+		case tokRightBracket:
+			return list, nil
+		default:
+			return nil, p.errorf(tok, "expected \",\" or \"]\" in string list, found %s", tok.kind)
+		}
+	}
+}
+
+func (p *parser) test() (*test, error) {
+	name, err := p.expect(tokIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	if p.depth++; p.depth > maxDepth {
+		return nil, p.errorf(name, "tests are nested too deeply")
+	}
+	defer func() { p.depth-- }()
+
+	t := &test{name: name.text, line: name.line}
+	if t.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+
+	switch p.peek().kind {
+	case tokIdentifier:
+		sub, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		t.tests = []*test{sub}
+	case tokLeftParen:
+		p.advance()
+		for {
+			sub, err := p.test()
+			if err != nil {
+				return nil, err
+			}
+			t.tests = append(t.tests, sub)
+			tok := p.advance()
+			if tok.kind == tokRightParen {
+				break
+			}
+			if tok.kind != tokComma {
+				return nil, p.errorf(tok, "expected \",\" or \")\" in test list, found %s", tok.kind)
+			}
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,113 @@
+package sieve
+
+import (
+	"bytes"
+	"fmt"
+	stdmime "mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VacationResponse composes the response v describes to m, sent from the
+// address from.
+func VacationResponse(v *Vacation, m *Message, from string) []byte {
+	if v.From != "" {
+		from = v.From
+	}
+	subject := v.Subject
+	if subject == "" {
+		subject = "Auto: " + m.parsed.Subject
+	}
+
+	var b bytes.Buffer
+	writeReplyHeader(&b, m, from, v.Sender, subject)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	if v.MIME {
+		// The reason is a complete MIME entity, header section included
+		b.WriteString("MIME-Version: 1.0\r\n")
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(v.Reason, "\r\n", "\n"), "\n", "\r\n"))
+		return b.Bytes()
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	writeQuotedPrintable(&b, v.Reason)
+	return b.Bytes()
+}
+
+// RejectNotice composes the message disposition notification that tells the
+// sender of m that recipient rejected it (RFC 5429 section 2.1).
+func RejectNotice(rej *Reject, m *Message, from, recipient string) []byte {
+	var b bytes.Buffer
+	writeReplyHeader(&b, m, from, m.EnvelopeFrom, "Rejected: "+m.parsed.Subject)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=disposition-notification; boundary=%q\r\n\r\n", mw.Boundary())
+
+	text, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	var reason bytes.Buffer
+	writeQuotedPrintable(&reason, fmt.Sprintf("Your message to %s was automatically rejected:\r\n\r\n%s\r\n", recipient, rej.Reason))
+	text.Write(reason.Bytes())
+
+	mdn, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/disposition-notification"}})
+	fmt.Fprintf(mdn, "Reporting-UA: mailroom; sieve\r\n")
+	fmt.Fprintf(mdn, "Final-Recipient: rfc822; %s\r\n", recipient)
+	if m.parsed.MessageID != "" {
+		fmt.Fprintf(mdn, "Original-Message-ID: <%s>\r\n", m.parsed.MessageID)
+	}
+	fmt.Fprintf(mdn, "Disposition: automatic-action/MDN-sent-automatically; deleted\r\n")
+
+	headers, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+	headers.Write(headerSection(m.raw))
+	mw.Close()
+
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// writeReplyHeader writes the header fields shared by responses to m.
+func writeReplyHeader(b *bytes.Buffer, m *Message, from, to, subject string) {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+	fmt.Fprintf(b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(b, "From: <%s>\r\n", from)
+	fmt.Fprintf(b, "To: <%s>\r\n", to)
+	fmt.Fprintf(b, "Subject: %s\r\n", stdmime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(b, "Message-ID: <%s@%s>\r\n", uuid.New().String(), domain)
+	if id := m.parsed.MessageID; id != "" {
+		fmt.Fprintf(b, "In-Reply-To: <%s>\r\n", id)
+		refs := m.parsed.References
+		refs = append(refs[:len(refs):len(refs)], id)
+		fmt.Fprintf(b, "References: <%s>\r\n", strings.Join(refs, "> <"))
+	}
+}
+
+func writeQuotedPrintable(b *bytes.Buffer, s string) {
+	w := quotedprintable.NewWriter(b)
+	w.Write([]byte(s))
+	w.Close()
+}
+
+// headerSection returns the header section of raw, without the blank line
+// that ends it.
+func headerSection(raw []byte) []byte {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i >= 0 {
+			return raw[:i+len(sep)/2]
+		}
+	}
+	return raw
+}
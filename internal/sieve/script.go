@@ -0,0 +1,789 @@
+// Package sieve runs users' Sieve mail filtering scripts (RFC 5228) against
+// stored messages. Besides the base language it supports the fileinto,
+// reject, vacation, imap4flags, variables, regex, envelope, body and copy
+// extensions.
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrInvalidScript is wrapped by every error about a script that doesn't
+	// compile; see Error for the line it was found on.
+	ErrInvalidScript = errors.New("invalid sieve script")
+	// ErrScriptNotFound means the user has no script with the given name.
+	ErrScriptNotFound = errors.New("sieve script not found")
+	// ErrInvalidName means a script name is empty, too long or contains
+	// control characters.
+	ErrInvalidName = errors.New("invalid sieve script name")
+)
+
+// Error is a syntax or semantic error in a script.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Unwrap makes errors.Is(err, ErrInvalidScript) hold for every Error.
+func (e *Error) Unwrap() error {
+	return ErrInvalidScript
+}
+
+// Extensions lists the capabilities scripts can require.
+var Extensions = []string{
+	"body",
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"copy",
+	"envelope",
+	"fileinto",
+	"imap4flags",
+	"regex",
+	"reject",
+	"vacation",
+	"variables",
+}
+
+// MaxScriptSize bounds the size of a script in bytes.
+const MaxScriptSize = 64 << 10
+
+// Script is a compiled script, ready to run.
+type Script struct {
+	cmds       []cmd
+	extensions map[string]bool
+}
+
+// Compile parses and checks a script. Errors are *Error values.
+func Compile(src string) (*Script, error) {
+	if len(src) > MaxScriptSize {
+		return nil, &Error{Line: 1, Msg: fmt.Sprintf("script is larger than %d bytes", MaxScriptSize)}
+	}
+	tree, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{extensions: map[string]bool{}}
+	cmds, err := c.block(tree, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds, extensions: c.extensions}, nil
+}
+
+type compiler struct {
+	extensions map[string]bool
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *compiler) need(ext string, line int, what string) error {
+	if !c.extensions[ext] {
+		return errorf(line, "%s requires the %q extension", what, ext)
+	}
+	return nil
+}
+
+// block compiles a list of commands. require is only allowed at the start of
+// the script.
+func (c *compiler) block(tree []*command, top bool) ([]cmd, error) {
+	var cmds []cmd
+	requires := top
+	for i := 0; i < len(tree); i++ {
+		n := tree[i]
+		if n.name == "require" {
+			if !requires {
+				return nil, errorf(n.line, "require must come before any other command")
+			}
+			if err := c.require(n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		requires = false
+
+		if n.name == "if" {
+			stmt, next, err := c.ifChain(tree, i)
+			if err != nil {
+				return nil, err
+			}
+			cmds = append(cmds, stmt)
+			i = next - 1
+			continue
+		}
+		if n.name == "elsif" || n.name == "else" {
+			return nil, errorf(n.line, "%s without a preceding if", n.name)
+		}
+
+		stmt, err := c.command(n)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, stmt)
+	}
+	return cmds, nil
+}
+
+func (c *compiler) require(n *command) error {
+	if len(n.args) != 1 || n.args[0].kind != argStrings || n.test != nil || n.block != nil {
+		return errorf(n.line, "require takes a string list of extensions")
+	}
+	for _, ext := range n.args[0].strings {
+		if !supported(ext) {
+			return errorf(n.line, "unsupported extension %q", ext)
+		}
+		c.extensions[ext] = true
+	}
+	return nil
+}
+
+func supported(ext string) bool {
+	for _, e := range Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// ifChain compiles the if command at tree[i] with the elsif and else
+// commands that follow it, returning the index after the chain.
+func (c *compiler) ifChain(tree []*command, i int) (cmd, int, error) {
+	stmt := &cmdIf{}
+	for ; i < len(tree); i++ {
+		n := tree[i]
+		if n.name != "if" && n.name != "elsif" && n.name != "else" {
+			break
+		}
+		if n.name == "if" && len(stmt.tests) > 0 {
+			break
+		}
+		if len(n.args) > 0 {
+			return nil, 0, errorf(n.line, "%s takes no arguments", n.name)
+		}
+		if n.block == nil {
+			return nil, 0, errorf(n.line, "%s needs a block", n.name)
+		}
+		body, err := c.block(n.block, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n.name == "else" {
+			if n.test != nil {
+				return nil, 0, errorf(n.line, "else takes no test")
+			}
+			stmt.otherwise = body
+			return stmt, i + 1, nil
+		}
+		if n.test == nil {
+			return nil, 0, errorf(n.line, "%s needs a test", n.name)
+		}
+		t, err := c.test(n.test)
+		if err != nil {
+			return nil, 0, err
+		}
+		stmt.tests = append(stmt.tests, t)
+		stmt.blocks = append(stmt.blocks, body)
+	}
+	return stmt, i, nil
+}
+
+// tagKind is the value that follows a tag, if any.
+type tagKind int
+
+const (
+	tagFlag tagKind = iota
+	tagNumber
+	tagString
+	tagStringList
+)
+
+// args separates the tagged and positional arguments of a command or test
+// according to the tags it accepts.
+type args struct {
+	name       string
+	line       int
+	tags       map[string]arg // tag name -> its value (or the tag itself)
+	positional []arg
+}
+
+func splitArgs(name string, line int, list []arg, accepted map[string]tagKind) (*args, error) {
+	a := &args{name: name, line: line, tags: map[string]arg{}}
+	for i := 0; i < len(list); i++ {
+		x := list[i]
+		if x.kind != argTag {
+			a.positional = append(a.positional, x)
+			continue
+		}
+		if len(a.positional) > 0 {
+			return nil, errorf(x.line, "tag :%s must come before the positional arguments of %s", x.tag, name)
+		}
+		kind, ok := accepted[x.tag]
+		if !ok {
+			return nil, errorf(x.line, "%s does not accept :%s", name, x.tag)
+		}
+		if _, dup := a.tags[x.tag]; dup {
+			return nil, errorf(x.line, "duplicate :%s", x.tag)
+		}
+		if kind == tagFlag {
+			a.tags[x.tag] = x
+			continue
+		}
+		if i+1 >= len(list) {
+			return nil, errorf(x.line, ":%s needs a value", x.tag)
+		}
+		i++
+		v := list[i]
+		switch {
+		case kind == tagNumber && v.kind != argNumber:
+			return nil, errorf(v.line, ":%s needs a number", x.tag)
+		case kind == tagString && (v.kind != argStrings || len(v.strings) != 1):
+			return nil, errorf(v.line, ":%s needs a string", x.tag)
+		case kind == tagStringList && v.kind != argStrings:
+			return nil, errorf(v.line, ":%s needs a string list", x.tag)
+		}
+		a.tags[x.tag] = v
+	}
+	return a, nil
+}
+
+func (a *args) has(tag string) bool {
+	_, ok := a.tags[tag]
+	return ok
+}
+
+// exactly checks that a has n positional arguments.
+func (a *args) exactly(n int) error {
+	if len(a.positional) != n {
+		return errorf(a.line, "%s takes %d positional arguments, found %d", a.name, n, len(a.positional))
+	}
+	return nil
+}
+
+// strings returns positional argument i as a string list.
+func (a *args) strings(i int) ([]string, error) {
+	x := a.positional[i]
+	if x.kind != argStrings {
+		return nil, errorf(x.line, "%s expects a string list", a.name)
+	}
+	return x.strings, nil
+}
+
+// string returns positional argument i as a single string.
+func (a *args) string(i int) (string, error) {
+	x := a.positional[i]
+	if x.kind != argStrings || len(x.strings) != 1 {
+		return "", errorf(x.line, "%s expects a string", a.name)
+	}
+	return x.strings[0], nil
+}
+
+// oneOf returns the single tag of group that was given, or def.
+func (a *args) oneOf(def string, group ...string) (string, error) {
+	found := ""
+	for _, tag := range group {
+		if a.has(tag) {
+			if found != "" {
+				return "", errorf(a.line, ":%s and :%s can't be used together", found, tag)
+			}
+			found = tag
+		}
+	}
+	if found == "" {
+		return def, nil
+	}
+	return found, nil
+}
+
+var (
+	flagTags  = map[string]tagKind{"flags": tagStringList}
+	matchTags = map[string]tagKind{
+		"comparator": tagString,
+		"is":         tagFlag,
+		"contains":   tagFlag,
+		"matches":    tagFlag,
+		"regex":      tagFlag,
+	}
+)
+
+func withTags(sets ...map[string]tagKind) map[string]tagKind {
+	m := map[string]tagKind{}
+	for _, set := range sets {
+		for k, v := range set {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func (c *compiler) command(n *command) (cmd, error) {
+	if n.test != nil {
+		return nil, errorf(n.line, "%s takes no test", n.name)
+	}
+	if n.block != nil {
+		return nil, errorf(n.line, "%s takes no block", n.name)
+	}
+
+	var accepted map[string]tagKind
+	switch n.name {
+	case "keep":
+		accepted = flagTags
+	case "fileinto":
+		accepted = withTags(flagTags, map[string]tagKind{"copy": tagFlag})
+	case "redirect":
+		accepted = map[string]tagKind{"copy": tagFlag}
+	case "vacation":
+		accepted = map[string]tagKind{
+			"days":      tagNumber,
+			"subject":   tagString,
+			"from":      tagString,
+			"addresses": tagStringList,
+			"mime":      tagFlag,
+			"handle":    tagString,
+		}
+	case "set":
+		accepted = map[string]tagKind{}
+		for _, m := range modifiers {
+			accepted[m] = tagFlag
+		}
+	}
+	a, err := splitArgs(n.name, n.line, n.args, accepted)
+	if err != nil {
+		return nil, err
+	}
+	if a.has("copy") {
+		if err := c.need("copy", n.line, ":copy"); err != nil {
+			return nil, err
+		}
+	}
+	if a.has("flags") {
+		if err := c.need("imap4flags", n.line, ":flags"); err != nil {
+			return nil, err
+		}
+	}
+
+	switch n.name {
+	case "stop":
+		return &cmdStop{}, a.exactly(0)
+	case "discard":
+		return &cmdDiscard{}, a.exactly(0)
+	case "keep":
+		if err := a.exactly(0); err != nil {
+			return nil, err
+		}
+		stmt := &cmdKeep{}
+		if v, ok := a.tags["flags"]; ok {
+			stmt.flags = v.strings
+			stmt.hasFlags = true
+		}
+		return stmt, nil
+
+	case "fileinto":
+		if err := c.need("fileinto", n.line, "fileinto"); err != nil {
+			return nil, err
+		}
+		if err := a.exactly(1); err != nil {
+			return nil, err
+		}
+		mailbox, err := a.string(0)
+		if err != nil {
+			return nil, err
+		}
+		stmt := &cmdFileInto{mailbox: mailbox, copy: a.has("copy")}
+		if v, ok := a.tags["flags"]; ok {
+			stmt.flags = v.strings
+			stmt.hasFlags = true
+		}
+		return stmt, nil
+
+	case "redirect":
+		if err := a.exactly(1); err != nil {
+			return nil, err
+		}
+		address, err := a.string(0)
+		if err != nil {
+			return nil, err
+		}
+		if !c.extensions["variables"] && !validAddress(address) {
+			return nil, errorf(n.line, "redirect to invalid address %q", address)
+		}
+		return &cmdRedirect{address: address, copy: a.has("copy")}, nil
+
+	case "reject":
+		if err := c.need("reject", n.line, "reject"); err != nil {
+			return nil, err
+		}
+		if err := a.exactly(1); err != nil {
+			return nil, err
+		}
+		reason, err := a.string(0)
+		if err != nil {
+			return nil, err
+		}
+		return &cmdReject{reason: reason}, nil
+
+	case "vacation":
+		return c.vacation(a)
+
+	case "setflag", "addflag", "removeflag":
+		if err := c.need("imap4flags", n.line, n.name); err != nil {
+			return nil, err
+		}
+		stmt := &cmdFlags{op: n.name}
+		switch len(a.positional) {
+		case 2:
+			name, err := a.string(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.need("variables", n.line, "a flag variable"); err != nil {
+				return nil, err
+			}
+			if !validVariable(name) {
+				return nil, errorf(n.line, "invalid variable name %q", name)
+			}
+			stmt.variable = strings.ToLower(name)
+			if stmt.flags, err = a.strings(1); err != nil {
+				return nil, err
+			}
+		case 1:
+			if stmt.flags, err = a.strings(0); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errorf(n.line, "%s takes an optional variable name and a list of flags", n.name)
+		}
+		return stmt, nil
+
+	case "set":
+		if err := c.need("variables", n.line, "set"); err != nil {
+			return nil, err
+		}
+		if err := a.exactly(2); err != nil {
+			return nil, err
+		}
+		name, err := a.string(0)
+		if err != nil {
+			return nil, err
+		}
+		if !validVariable(name) {
+			return nil, errorf(n.line, "invalid variable name %q", name)
+		}
+		value, err := a.string(1)
+		if err != nil {
+			return nil, err
+		}
+		stmt := &cmdSet{name: strings.ToLower(name), value: value}
+		if stmt.caseMod, err = a.oneOf("", "lower", "upper"); err != nil {
+			return nil, err
+		}
+		if stmt.firstMod, err = a.oneOf("", "lowerfirst", "upperfirst"); err != nil {
+			return nil, err
+		}
+		stmt.quoteWildcard = a.has("quotewildcard")
+		stmt.length = a.has("length")
+		return stmt, nil
+	}
+	return nil, errorf(n.line, "unknown command %q", n.name)
+}
+
+// maxVacationDays bounds the :days of a vacation command.
+const maxVacationDays = 90
+
+func (c *compiler) vacation(a *args) (cmd, error) {
+	if err := c.need("vacation", a.line, "vacation"); err != nil {
+		return nil, err
+	}
+	if err := a.exactly(1); err != nil {
+		return nil, err
+	}
+	reason, err := a.string(0)
+	if err != nil {
+		return nil, err
+	}
+	stmt := &cmdVacation{
+		reason: reason,
+		days:   7,
+		mime:   a.has("mime"),
+	}
+	if v, ok := a.tags["days"]; ok {
+		stmt.days = v.num
+		// RFC 5230 section 4.1 lets sites clamp :days to their own range
+		if stmt.days < 1 {
+			stmt.days = 1
+		}
+		if stmt.days > maxVacationDays {
+			stmt.days = maxVacationDays
+		}
+	}
+	if v, ok := a.tags["subject"]; ok {
+		stmt.subject = v.strings[0]
+	}
+	if v, ok := a.tags["from"]; ok {
+		stmt.from = v.strings[0]
+	}
+	if v, ok := a.tags["addresses"]; ok {
+		stmt.addresses = v.strings
+	}
+	if v, ok := a.tags["handle"]; ok {
+		stmt.handle = v.strings[0]
+	}
+	return stmt, nil
+}
+
+func (c *compiler) test(n *test) (cond, error) {
+	switch n.name {
+	case "true", "false":
+		if len(n.args) > 0 || n.tests != nil {
+			return nil, errorf(n.line, "%s takes no arguments", n.name)
+		}
+		return testConst(n.name == "true"), nil
+	case "not":
+		if len(n.args) > 0 || len(n.tests) != 1 {
+			return nil, errorf(n.line, "not takes a single test")
+		}
+		t, err := c.test(n.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return &testNot{test: t}, nil
+	case "allof", "anyof":
+		if len(n.args) > 0 || len(n.tests) == 0 {
+			return nil, errorf(n.line, "%s takes a list of tests", n.name)
+		}
+		t := &testAll{any: n.name == "anyof"}
+		for _, sub := range n.tests {
+			compiled, err := c.test(sub)
+			if err != nil {
+				return nil, err
+			}
+			t.tests = append(t.tests, compiled)
+		}
+		return t, nil
+	}
+	if n.tests != nil {
+		return nil, errorf(n.line, "%s takes no nested tests", n.name)
+	}
+
+	var accepted map[string]tagKind
+	switch n.name {
+	case "address", "envelope":
+		accepted = withTags(matchTags, map[string]tagKind{"all": tagFlag, "localpart": tagFlag, "domain": tagFlag})
+	case "header", "hasflag", "string":
+		accepted = matchTags
+	case "body":
+		accepted = withTags(matchTags, map[string]tagKind{"raw": tagFlag, "content": tagStringList, "text": tagFlag})
+	case "size":
+		accepted = map[string]tagKind{"over": tagFlag, "under": tagFlag}
+	}
+	a, err := splitArgs(n.name, n.line, n.args, accepted)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.name {
+	case "exists":
+		if err := a.exactly(1); err != nil {
+			return nil, err
+		}
+		headers, err := a.strings(0)
+		if err != nil {
+			return nil, err
+		}
+		return &testExists{headers: headers}, nil
+
+	case "size":
+		if err := a.exactly(1); err != nil {
+			return nil, err
+		}
+		over, err := a.oneOf("", "over", "under")
+		if err != nil {
+			return nil, err
+		}
+		if over == "" {
+			return nil, errorf(n.line, "size needs :over or :under")
+		}
+		if a.positional[0].kind != argNumber {
+			return nil, errorf(n.line, "size expects a number")
+		}
+		return &testSize{over: over == "over", limit: a.positional[0].num}, nil
+
+	case "header":
+		if err := a.exactly(2); err != nil {
+			return nil, err
+		}
+		headers, err := a.strings(0)
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.matcher(a, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &testHeader{headers: headers, matcher: m}, nil
+
+	case "address", "envelope":
+		if n.name == "envelope" {
+			if err := c.need("envelope", n.line, "envelope"); err != nil {
+				return nil, err
+			}
+		}
+		if err := a.exactly(2); err != nil {
+			return nil, err
+		}
+		fields, err := a.strings(0)
+		if err != nil {
+			return nil, err
+		}
+		if n.name == "envelope" {
+			for i, f := range fields {
+				f = strings.ToLower(f)
+				if f != "from" && f != "to" {
+					return nil, errorf(n.line, "unsupported envelope part %q", fields[i])
+				}
+				fields[i] = f
+			}
+		}
+		part, err := a.oneOf("all", "all", "localpart", "domain")
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.matcher(a, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &testAddress{envelope: n.name == "envelope", fields: fields, part: part, matcher: m}, nil
+
+	case "body":
+		if err := c.need("body", n.line, "body"); err != nil {
+			return nil, err
+		}
+		if err := a.exactly(1); err != nil {
+			return nil, err
+		}
+		t := &testBody{}
+		if t.transform, err = a.oneOf("text", "raw", "content", "text"); err != nil {
+			return nil, err
+		}
+		if t.transform == "content" {
+			t.types = a.tags["content"].strings
+		}
+		if t.matcher, err = c.matcher(a, 0); err != nil {
+			return nil, err
+		}
+		return t, nil
+
+	case "hasflag":
+		if err := c.need("imap4flags", n.line, "hasflag"); err != nil {
+			return nil, err
+		}
+		t := &testHasFlag{}
+		switch len(a.positional) {
+		case 2:
+			if err := c.need("variables", n.line, "a flag variable"); err != nil {
+				return nil, err
+			}
+			names, err := a.strings(0)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if !validVariable(name) {
+					return nil, errorf(n.line, "invalid variable name %q", name)
+				}
+				t.variables = append(t.variables, strings.ToLower(name))
+			}
+			t.matcher, err = c.matcher(a, 1)
+			if err != nil {
+				return nil, err
+			}
+		case 1:
+			if t.matcher, err = c.matcher(a, 0); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errorf(n.line, "hasflag takes an optional variable list and a list of flags")
+		}
+		return t, nil
+
+	case "string":
+		if err := c.need("variables", n.line, "string"); err != nil {
+			return nil, err
+		}
+		if err := a.exactly(2); err != nil {
+			return nil, err
+		}
+		sources, err := a.strings(0)
+		if err != nil {
+			return nil, err
+		}
+		m, err := c.matcher(a, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &testString{sources: sources, matcher: m}, nil
+	}
+	return nil, errorf(n.line, "unknown test %q", n.name)
+}
+
+// matcher reads the comparator and match type of a test whose key list is
+// positional argument i.
+func (c *compiler) matcher(a *args, i int) (*matcher, error) {
+	keys, err := a.strings(i)
+	if err != nil {
+		return nil, err
+	}
+	m := &matcher{comparator: "i;ascii-casemap", keys: keys}
+	if v, ok := a.tags["comparator"]; ok {
+		m.comparator = v.strings[0]
+		if m.comparator != "i;ascii-casemap" && m.comparator != "i;octet" {
+			return nil, errorf(a.line, "unsupported comparator %q", m.comparator)
+		}
+	}
+	if m.match, err = a.oneOf("is", "is", "contains", "matches", "regex"); err != nil {
+		return nil, err
+	}
+	if m.match == "regex" {
+		if err := c.need("regex", a.line, ":regex"); err != nil {
+			return nil, err
+		}
+		// Keys holding variables are compiled once expanded
+		m.patterns = make([]*regexp.Regexp, len(keys))
+		for j, key := range keys {
+			if c.extensions["variables"] && strings.Contains(key, "${") {
+				continue
+			}
+			if m.patterns[j], err = m.compile(key); err != nil {
+				return nil, errorf(a.line, "invalid regular expression %q: %v", key, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+func validAddress(s string) bool {
+	local, domain, ok := strings.Cut(s, "@")
+	return ok && local != "" && domain != "" && !strings.ContainsAny(s, " \t\r\n<>")
+}
+
+func validVariable(name string) bool {
+	if name == "" || !isIdentStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !isIdentStart(c) && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,395 @@
+package sieve
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+	"github.com/parsel-email/mailroom/internal/mime"
+	"github.com/parsel-email/mailroom/internal/webhook"
+)
+
+const testRaw = "Return-Path: <alice@lists.example.org>\r\n" +
+	"From: Alice <alice@lists.example.org>\r\n" +
+	"To: User <user@example.com>, bob@example.net\r\n" +
+	"Subject: =?utf-8?q?[team]_Weekly_r=C3=A9port?=\r\n" +
+	"X-Spam-Score: 7.5\r\n" +
+	"Message-ID: <weekly@example.org>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Numbers are up this week.\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Numbers are <b>up</b> this week.</p>\r\n" +
+	"--b--\r\n"
+
+func TestCompileErrors(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		line int
+	}{
+		{`keep`, 1},
+		{"keep;\n\"unterminated", 2},
+		{`fileinto "Lists";`, 1},
+		{`require "fileinto"; require "enotify";`, 1},
+		{"keep;\nrequire \"fileinto\";", 2},
+		{`if true { keep; } else { discard; } else { stop; }`, 1},
+		{`elsif true { keep; }`, 1},
+		{`if header :is :contains "subject" "x" { keep; }`, 1},
+		{`if header :comparator "i;unicode-casemap" "subject" "x" { keep; }`, 1},
+		{"require \"regex\";\nif header :regex \"subject\" \"(\" { keep; }", 2},
+		{`if size 100 { keep; }`, 1},
+		{`redirect "not an address";`, 1},
+		{`require "envelope"; if envelope "auth" "x" { keep; }`, 1},
+		{`keep :flags "\\Seen";`, 1},
+		{`discard "now";`, 1},
+		{`frobnicate;`, 1},
+		{"if true {\n  keep;\n", 3},
+		{`require "variables"; set "1x" "value";`, 1},
+		{`/* never closed`, 1},
+	} {
+		_, err := Compile(c.src)
+		var serr *Error
+		if !errors.As(err, &serr) || !errors.Is(err, ErrInvalidScript) {
+			t.Errorf("Compile(%q) = %v, want an *Error", c.src, err)
+			continue
+		}
+		if serr.Line != c.line {
+			t.Errorf("Compile(%q) reported line %d, want %d: %v", c.src, serr.Line, c.line, err)
+		}
+	}
+}
+
+func runScript(t *testing.T, src string, m *Message) *Result {
+	t.Helper()
+	script, err := Compile(src)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	res, err := script.Run(m)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return res
+}
+
+func testMessage(t *testing.T) *Message {
+	t.Helper()
+	m, err := NewMessage([]byte(testRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.EnvelopeFrom = "bounce+123@lists.example.org"
+	m.EnvelopeTo = "user+team@example.com"
+	m.Addresses = []string{"user@example.com"}
+	return m
+}
+
+func TestRun(t *testing.T) {
+	m := testMessage(t)
+	for _, c := range []struct {
+		name string
+		src  string
+		want Result
+	}{
+		{"implicit keep", `# nothing to do`, Result{Keep: true}},
+		{"discard", `discard;`, Result{}},
+		{"header contains decoded", `require "fileinto";
+			if header :contains "subject" "WEEKLY réport" { fileinto "Reports"; }`,
+			Result{FileInto: []FileInto{{Mailbox: "Reports"}}}},
+		{"octet comparator is case sensitive", `require "fileinto";
+			if header :comparator "i;octet" :contains "subject" "WEEKLY" { fileinto "Reports"; }`,
+			Result{Keep: true}},
+		{"address domain", `if address :domain :is "from" "LISTS.example.org" { discard; }`, Result{}},
+		{"address localpart of any to", `if address :localpart :is "to" "bob" { discard; }`, Result{}},
+		{"envelope", `require ["envelope", "fileinto"];
+			if envelope :matches "to" "*+team@*" { fileinto "Team"; }`,
+			Result{FileInto: []FileInto{{Mailbox: "Team"}}}},
+		{"exists and size", `if allof (exists ["x-spam-score", "from"], size :under 10K) { discard; }`, Result{}},
+		{"anyof not", `if anyof (not exists "to", size :over 1M) { discard; }`, Result{Keep: true}},
+		{"elsif", `require "fileinto";
+			if header :is "subject" "nope" { discard; }
+			elsif header :matches "subject" "[team]*" { fileinto "Team"; }
+			else { fileinto "Other"; }`,
+			Result{FileInto: []FileInto{{Mailbox: "Team"}}}},
+		{"stop", `stop; discard;`, Result{Keep: true}},
+		{"fileinto copy keeps", `require ["fileinto", "copy"]; fileinto :copy "Archive";`,
+			Result{Keep: true, FileInto: []FileInto{{Mailbox: "Archive"}}}},
+		{"redirect", `redirect "boss@example.com"; redirect "boss@example.com";`,
+			Result{Redirects: []Redirect{{Address: "boss@example.com"}}}},
+		{"reject", `require "reject"; reject "No thanks";`, Result{Reject: &Reject{Reason: "No thanks"}}},
+		{"flags", `require ["imap4flags", "fileinto"];
+			addflag ["\\Seen", "$Work"]; addflag "\\seen"; removeflag "$Work";
+			if hasflag :contains "seen" { addflag "\\Flagged"; }
+			fileinto :flags "\\Answered" "Done";
+			keep;`,
+			Result{Keep: true, KeepFlags: []string{`\Seen`, `\Flagged`}, FileInto: []FileInto{{Mailbox: "Done", Flags: []string{`\Answered`}}}}},
+		{"explicit keep with flags", `require "imap4flags"; keep :flags "\\Seen"; discard;`,
+			Result{Keep: true, KeepFlags: []string{`\Seen`}}},
+		{"variables and match variables", `require ["variables", "fileinto"];
+			if header :matches "subject" "[*] *" { set :upperfirst "list" "${1}"; }
+			set "box" "Lists/${list}";
+			fileinto "${box}";`,
+			Result{FileInto: []FileInto{{Mailbox: "Lists/Team"}}}},
+		{"set modifiers", `require ["variables", "fileinto"];
+			set :lower :upperfirst "a" "HELLO";
+			set :length "n" "${a}";
+			set :quotewildcard "q" "a*b";
+			if string :is "${a}-${n}-${q}" "Hello-5-a\\*b" { fileinto "ok"; }`,
+			Result{FileInto: []FileInto{{Mailbox: "ok"}}}},
+		{"body text", `require ["body", "fileinto"];
+			if body :contains "numbers are up" { fileinto "Stats"; }`,
+			Result{FileInto: []FileInto{{Mailbox: "Stats"}}}},
+		{"body content html", `require ["body", "fileinto"];
+			if body :content "text/html" :contains "<b>up</b>" { fileinto "Html"; }`,
+			Result{FileInto: []FileInto{{Mailbox: "Html"}}}},
+		{"body raw", `require ["body", "fileinto"];
+			if body :raw :contains "boundary" { fileinto "Raw"; }`,
+			Result{Keep: true}},
+	} {
+		got := runScript(t, c.src, m)
+		if !reflect.DeepEqual(*got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, *got, c.want)
+		}
+	}
+}
+
+func TestRegexMatchVariables(t *testing.T) {
+	res := runScript(t, `require ["regex", "variables", "fileinto"];
+		if header :regex "x-spam-score" "^([0-9]+)\\.([0-9]+)$" { fileinto "Spam/${1}/${2}"; }`, testMessage(t))
+	if len(res.FileInto) != 1 || res.FileInto[0].Mailbox != "Spam/7/5" {
+		t.Errorf("got %+v", res)
+	}
+}
+
+func TestRuntimeErrorKeeps(t *testing.T) {
+	script, err := Compile(`require ["reject", "fileinto"]; fileinto "A"; reject "no";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := script.Run(testMessage(t))
+	if err == nil || !reflect.DeepEqual(*res, Result{Keep: true}) {
+		t.Errorf("got %+v, %v; want an implicit keep and an error", res, err)
+	}
+}
+
+func TestVacation(t *testing.T) {
+	src := `require "vacation"; vacation :days 3 :subject "Away" "Back next week.";`
+
+	res := runScript(t, src, testMessage(t))
+	v := res.Vacation
+	if v == nil || v.Sender != "bounce+123@lists.example.org" || v.Days != 3 || v.Handle == "" || !res.Keep {
+		t.Fatalf("got %+v", res)
+	}
+	reply := string(VacationResponse(v, testMessage(t), "user@example.com"))
+	for _, want := range []string{
+		"To: <bounce+123@lists.example.org>\r\n",
+		"Subject: Away\r\n",
+		"In-Reply-To: <weekly@example.org>\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"\r\n\r\nBack next week.",
+	} {
+		if !strings.Contains(reply, want) {
+			t.Errorf("response lacks %q:\n%s", want, reply)
+		}
+	}
+
+	for name, change := range map[string]func(m *Message){
+		"not addressed to us": func(m *Message) { m.Addresses = []string{"someone@example.com"} },
+		"from a daemon":       func(m *Message) { m.EnvelopeFrom = "MAILER-DAEMON@example.org" },
+		"null sender": func(m *Message) {
+			// Nor a Return-Path to fall back to
+			m.EnvelopeFrom = ""
+			m.parsed.Root.Header = m.parsed.Root.Header[1:]
+		},
+		"list mail": func(m *Message) {
+			m.parsed.Root.Header = append(m.parsed.Root.Header, mime.Header{Name: "List-Id", Value: "<team.example.org>"})
+		},
+		"auto-submitted": func(m *Message) {
+			m.parsed.Root.Header = append(m.parsed.Root.Header, mime.Header{Name: "Auto-Submitted", Value: "auto-generated"})
+		},
+	} {
+		m := testMessage(t)
+		change(m)
+		if res := runScript(t, src, m); res.Vacation != nil {
+			t.Errorf("%s: got a vacation response to %s", name, res.Vacation.Sender)
+		}
+	}
+}
+
+type fakeSender struct {
+	mu   sync.Mutex
+	sent map[string][]string // recipient -> raw messages
+}
+
+func (s *fakeSender) Send(ctx context.Context, userID, to string, raw []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sent == nil {
+		s.sent = map[string][]string{}
+	}
+	s.sent[to] = append(s.sent[to], string(raw))
+	return nil
+}
+
+func newTestStore(t *testing.T) (*mailstore.Store, *Filter, *fakeSender) {
+	t.Helper()
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	filter := New(db)
+	sender := &fakeSender{}
+	filter.SetSender(sender)
+	store.Use(filter)
+	return store, filter, sender
+}
+
+func TestProcess(t *testing.T) {
+	ctx := context.Background()
+	store, filter, sender := newTestStore(t)
+
+	script := `require ["fileinto", "imap4flags", "vacation", "copy"];
+		if address :domain :is "from" "lists.example.org" {
+			fileinto :flags ["\\Seen", "$List"] "Lists";
+			redirect :copy "archive@example.net";
+		}
+		vacation :days 1 "Away";`
+	if _, created, err := filter.Put(ctx, "u1", "main", script); err != nil || !created {
+		t.Fatalf("Put = %v, %v", created, err)
+	}
+	// Scripts only run once active
+	if err := filter.Activate(ctx, "u1", "main"); err != nil {
+		t.Fatal(err)
+	}
+	hooks := webhook.New(store.DB())
+	endpoint, err := hooks.Create(ctx, "u1", webhook.Params{URL: "https://example.org/hook", Events: []string{webhook.EventMessageLabeled}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := mailstore.Envelope{From: "alice@lists.example.org", To: "user@example.com"}
+	id, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw), Envelope: env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := store.DB().Queries()
+	msg, err := q.GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.IsRead || !msg.Archived {
+		t.Errorf("got read %v, archived %v; want read and archived", msg.IsRead, msg.Archived)
+	}
+	if labels, err := q.ListMessageLabels(ctx, id); err != nil || strings.Join(labels, ",") != "Lists" {
+		t.Errorf("got labels %v, %v", labels, err)
+	}
+	if keywords, err := q.ListMessageKeywords(ctx, id); err != nil || strings.Join(keywords, ",") != "$List" {
+		t.Errorf("got keywords %v, %v", keywords, err)
+	}
+	deliveries, err := hooks.ListDeliveries(ctx, "u1", endpoint.ID, "", webhook.DefaultDeliveryLimit)
+	if err != nil || len(deliveries) != 1 || !strings.Contains(string(deliveries[0].Payload), `"labels":["Lists"]`) {
+		t.Errorf("got webhook deliveries %+v, %v", deliveries, err)
+	}
+	if len(sender.sent["archive@example.net"]) != 1 || sender.sent["archive@example.net"][0] != testRaw {
+		t.Errorf("redirect sent %v", sender.sent["archive@example.net"])
+	}
+	if len(sender.sent["alice@lists.example.org"]) != 1 {
+		t.Errorf("got %d vacation responses, want 1", len(sender.sent["alice@lists.example.org"]))
+	}
+
+	// The sender already had a response within :days
+	other := strings.Replace(testRaw, "weekly@", "other@", 1)
+	if _, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(other), Envelope: env}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sender.sent["alice@lists.example.org"]); n != 1 {
+		t.Errorf("got %d vacation responses, want 1", n)
+	}
+}
+
+func TestProcessReject(t *testing.T) {
+	ctx := context.Background()
+	store, filter, sender := newTestStore(t)
+
+	if _, _, err := filter.Put(ctx, "u1", "reject", `require "reject";
+		if header :contains "subject" "weekly" { reject "Not interested"; }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Activate(ctx, "u1", "reject"); err != nil {
+		t.Fatal(err)
+	}
+
+	env := mailstore.Envelope{From: "alice@lists.example.org", To: "user@example.com"}
+	id, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw), Envelope: env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DB().Queries().GetMessage(ctx, schema.GetMessageParams{ID: id, UserID: "u1"}); err == nil {
+		t.Error("rejected message wasn't deleted")
+	}
+	notices := sender.sent["alice@lists.example.org"]
+	if len(notices) != 1 || !strings.Contains(notices[0], "report-type=disposition-notification") ||
+		!strings.Contains(notices[0], "Not interested") {
+		t.Errorf("got rejection notices %v", notices)
+	}
+}
+
+func TestScripts(t *testing.T) {
+	ctx := context.Background()
+	_, filter, _ := newTestStore(t)
+
+	if _, _, err := filter.Put(ctx, "u1", "bad", `fileinto "x";`); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("Put of an invalid script = %v, want ErrInvalidScript", err)
+	}
+	if _, _, err := filter.Put(ctx, "u1", "a\nb", `keep;`); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Put with an invalid name = %v, want ErrInvalidName", err)
+	}
+	for _, name := range []string{"one", "two"} {
+		if _, _, err := filter.Put(ctx, "u1", name, `keep;`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, created, err := filter.Put(ctx, "u1", "one", `discard;`); err != nil || created {
+		t.Errorf("replacing got created %v, %v", created, err)
+	}
+	if err := filter.Activate(ctx, "u1", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Activate(ctx, "u1", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Activate(ctx, "u1", "three"); !errors.Is(err, ErrScriptNotFound) {
+		t.Errorf("activating a missing script = %v", err)
+	}
+	list, err := filter.List(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "one" || list[0].Active || !list[1].Active || list[0].Content != "discard;" {
+		t.Errorf("got %+v", list)
+	}
+	if _, err := filter.Get(ctx, "u2", "one"); !errors.Is(err, ErrScriptNotFound) {
+		t.Errorf("got another user's script: %v", err)
+	}
+	if err := filter.Delete(ctx, "u1", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Delete(ctx, "u1", "two"); !errors.Is(err, ErrScriptNotFound) {
+		t.Errorf("second delete = %v, want ErrScriptNotFound", err)
+	}
+}
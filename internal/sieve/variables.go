@@ -0,0 +1,88 @@
+package sieve
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// modifiers are the tags of the set command (RFC 5229 section 4.1).
+var modifiers = []string{"lower", "upper", "lowerfirst", "upperfirst", "quotewildcard", "length"}
+
+// expandVariables replaces ${name} with the variable's value and ${N} with
+// the Nth match variable. Unknown variables expand to the empty string;
+// anything that isn't a valid reference is kept as written.
+func expandVariables(s string, vars map[string]string, matchVars []string) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		name := s[start+2 : start+end]
+		b.WriteString(s[:start])
+		switch {
+		case isDigits(name):
+			if n, err := strconv.Atoi(name); err == nil && n < len(matchVars) {
+				b.WriteString(matchVars[n])
+			}
+		case validVariable(name):
+			b.WriteString(vars[strings.ToLower(name)])
+		default:
+			// Not a reference; keep "${" and look again after it
+			b.WriteString("${")
+			s = s[start+2:]
+			continue
+		}
+		s = s[start+end+1:]
+	}
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// applyModifiers applies the set command's modifiers in the order RFC 5229
+// section 4.1 gives them precedence.
+func applyModifiers(value string, c *cmdSet) string {
+	switch c.caseMod {
+	case "lower":
+		value = strings.ToLower(value)
+	case "upper":
+		value = strings.ToUpper(value)
+	}
+	if value != "" {
+		r, size := utf8.DecodeRuneInString(value)
+		switch c.firstMod {
+		case "lowerfirst":
+			value = string(unicode.ToLower(r)) + value[size:]
+		case "upperfirst":
+			value = string(unicode.ToUpper(r)) + value[size:]
+		}
+	}
+	if c.quoteWildcard {
+		value = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(value)
+	}
+	if c.length {
+		value = strconv.Itoa(utf8.RuneCountInString(value))
+	}
+	return value
+}
@@ -0,0 +1,282 @@
+// Package threading reconstructs conversations from message headers using
+// Jamie Zawinski's threading algorithm (https://www.jwz.org/doc/threading.html):
+// messages are linked through Message-ID, In-Reply-To and References, and
+// replies whose references were dropped by broken clients are grouped by
+// subject.
+package threading
+
+import (
+	"sort"
+	"time"
+)
+
+// Message is the header data threading needs.
+type Message struct {
+	ID         string // the stored message ID
+	MessageID  string // Message-ID header, without angle brackets
+	InReplyTo  string
+	References []string
+	Subject    string
+	Date       time.Time
+}
+
+// Node is a position in a thread tree. Message is nil for a placeholder
+// standing in for a referenced message that isn't present.
+type Node struct {
+	Message  *Message
+	Parent   *Node
+	Children []*Node
+}
+
+// date is the node's message date, or that of its earliest descendant for
+// a placeholder.
+func (n *Node) date() time.Time {
+	if n.Message != nil {
+		return n.Message.Date
+	}
+	var d time.Time
+	for _, c := range n.Children {
+		if cd := c.date(); d.IsZero() || (!cd.IsZero() && cd.Before(d)) {
+			d = cd
+		}
+	}
+	return d
+}
+
+func (n *Node) subject() string {
+	if n.Message != nil {
+		return n.Message.Subject
+	}
+	for _, c := range n.Children {
+		if s := c.subject(); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// isAncestorOf reports whether n is c or one of c's ancestors.
+func (n *Node) isAncestorOf(c *Node) bool {
+	for ; c != nil; c = c.Parent {
+		if c == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) addChild(c *Node) {
+	if c.Parent != nil {
+		c.Parent.removeChild(c)
+	}
+	c.Parent = n
+	n.Children = append(n.Children, c)
+}
+
+func (n *Node) removeChild(c *Node) {
+	for i, x := range n.Children {
+		if x == c {
+			n.Children = append(n.Children[:i], n.Children[i+1:]...)
+			break
+		}
+	}
+	c.Parent = nil
+}
+
+// Thread arranges msgs into trees and returns their roots, oldest first.
+// Siblings are ordered by date.
+func Thread(msgs []Message) []*Node {
+	byID := map[string]*Node{}
+	var all []*Node
+
+	container := func(id string) *Node {
+		n, ok := byID[id]
+		if !ok {
+			n = &Node{}
+			byID[id] = n
+			all = append(all, n)
+		}
+		return n
+	}
+
+	for i := range msgs {
+		m := &msgs[i]
+
+		// A missing or duplicate Message-ID gets a container of its own
+		var node *Node
+		if m.MessageID != "" {
+			if n := container(m.MessageID); n.Message == nil {
+				node = n
+			}
+		}
+		if node == nil {
+			node = &Node{}
+			all = append(all, node)
+		}
+		node.Message = m
+
+		// Link the reference chain parent to child, without overriding
+		// links made earlier or creating loops
+		refs := parentRefs(m)
+		var prev *Node
+		for _, ref := range refs {
+			n := container(ref)
+			if prev != nil && n.Parent == nil && !n.isAncestorOf(prev) {
+				prev.addChild(n)
+			}
+			prev = n
+		}
+
+		// The last reference is this message's parent, replacing any
+		// parent guessed from other messages' references
+		if node.Parent != nil {
+			node.Parent.removeChild(node)
+		}
+		if prev != nil && !node.isAncestorOf(prev) {
+			prev.addChild(node)
+		}
+	}
+
+	var roots []*Node
+	for _, n := range all {
+		if n.Parent == nil {
+			roots = append(roots, n)
+		}
+	}
+	roots = prune(roots, true)
+	roots = groupBySubject(roots)
+	sortNodes(roots)
+	return roots
+}
+
+// parentRefs returns the Message-IDs of a message's ancestors, oldest first:
+// its References, followed by In-Reply-To if References doesn't end with it.
+func parentRefs(m *Message) []string {
+	refs := make([]string, 0, len(m.References)+1)
+	seen := map[string]bool{m.MessageID: true}
+	for _, r := range m.References {
+		if r != "" && !seen[r] {
+			seen[r] = true
+			refs = append(refs, r)
+		}
+	}
+	if m.InReplyTo != "" && !seen[m.InReplyTo] {
+		refs = append(refs, m.InReplyTo)
+	}
+	return refs
+}
+
+// prune removes placeholders without children and replaces placeholders by
+// their children, except a placeholder at the root that holds several
+// children together.
+func prune(nodes []*Node, root bool) []*Node {
+	var out []*Node
+	for _, n := range nodes {
+		n.Children = prune(n.Children, false)
+		for _, c := range n.Children {
+			c.Parent = n
+		}
+		if n.Message != nil {
+			out = append(out, n)
+			continue
+		}
+		switch {
+		case len(n.Children) == 0:
+		case root && len(n.Children) > 1:
+			out = append(out, n)
+		default:
+			for _, c := range n.Children {
+				c.Parent = n.Parent
+			}
+			out = append(out, n.Children...)
+		}
+	}
+	if root {
+		for _, n := range out {
+			n.Parent = nil
+		}
+	}
+	return out
+}
+
+// groupBySubject merges root trees with the same base subject, for replies
+// whose references were lost. A reply goes below the original message; two
+// originals, or two replies, become siblings under a placeholder.
+func groupBySubject(roots []*Node) []*Node {
+	bySubject := map[string]*Node{}
+	var out []*Node
+	for _, n := range roots {
+		subj := BaseSubject(n.subject())
+		if subj == "" {
+			out = append(out, n)
+			continue
+		}
+		prev, ok := bySubject[subj]
+		if !ok {
+			bySubject[subj] = n
+			out = append(out, n)
+			continue
+		}
+
+		nReply := n.Message != nil && IsReply(n.Message.Subject)
+		prevReply := prev.Message != nil && IsReply(prev.Message.Subject)
+		switch {
+		case prev.Message == nil && n.Message == nil:
+			for _, c := range append([]*Node(nil), n.Children...) {
+				prev.addChild(c)
+			}
+		case prev.Message == nil:
+			prev.addChild(n)
+		case nReply && !prevReply:
+			prev.addChild(n)
+		case n.Message == nil || (prevReply && !nReply):
+			// n takes prev's place as the root
+			n.addChild(prev)
+			replace(out, prev, n)
+			bySubject[subj] = n
+		default:
+			p := &Node{}
+			p.addChild(prev)
+			p.addChild(n)
+			replace(out, prev, p)
+			bySubject[subj] = p
+		}
+	}
+	return out
+}
+
+func replace(nodes []*Node, old, n *Node) {
+	for i, x := range nodes {
+		if x == old {
+			nodes[i] = n
+		}
+	}
+}
+
+func sortNodes(nodes []*Node) {
+	for _, n := range nodes {
+		sortNodes(n.Children)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].date().Before(nodes[j].date())
+	})
+}
+
+// Flatten lists the messages of a tree depth-first. parent is the ID of the
+// nearest ancestor with a message, "" at the top; depth counts ancestors
+// with messages.
+func Flatten(roots []*Node, fn func(m *Message, parent string, depth int)) {
+	var walk func(n *Node, parent string, depth int)
+	walk = func(n *Node, parent string, depth int) {
+		if n.Message != nil {
+			fn(n.Message, parent, depth)
+			parent, depth = n.Message.ID, depth+1
+		}
+		for _, c := range n.Children {
+			walk(c, parent, depth)
+		}
+	}
+	for _, r := range roots {
+		walk(r, "", 0)
+	}
+}
@@ -0,0 +1,163 @@
+package threading
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// msg is a message sent day days after a fixed date, replying to refs, the
+// last of which is its In-Reply-To.
+func msg(id, subject string, day int, refs ...string) Message {
+	m := Message{
+		ID:         id,
+		MessageID:  id + "@example.com",
+		Subject:    subject,
+		Date:       time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, day),
+		References: make([]string, len(refs)),
+	}
+	for i, r := range refs {
+		m.References[i] = r + "@example.com"
+	}
+	if len(refs) > 0 {
+		m.InReplyTo = m.References[len(refs)-1]
+	}
+	return m
+}
+
+// layout describes the threads of msgs as "id<parent" entries, a thread
+// per line.
+func layout(msgs []Message) string {
+	var threads []string
+	for _, root := range Thread(msgs) {
+		var entries []string
+		Flatten([]*Node{root}, func(m *Message, parent string, depth int) {
+			entries = append(entries, fmt.Sprintf("%s<%s", m.ID, parent))
+		})
+		threads = append(threads, strings.Join(entries, " "))
+	}
+	return strings.Join(threads, "\n")
+}
+
+func TestThread(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msgs []Message
+		want string
+	}{
+		{
+			name: "chain",
+			msgs: []Message{msg("a", "Plans", 0), msg("b", "Re: Plans", 1, "a"), msg("c", "Re: Plans", 2, "a", "b")},
+			want: "a< b<a c<b",
+		},
+		{
+			name: "replies before their parent",
+			msgs: []Message{msg("c", "Re: Plans", 2, "a", "b"), msg("b", "Re: Plans", 1, "a"), msg("a", "Plans", 0)},
+			want: "a< b<a c<b",
+		},
+		{
+			name: "siblings by date",
+			msgs: []Message{msg("a", "Plans", 0), msg("late", "Re: Plans", 5, "a"), msg("early", "Re: Plans", 1, "a")},
+			want: "a< early<a late<a",
+		},
+		{
+			name: "missing middle message",
+			msgs: []Message{msg("a", "Plans", 0), msg("c", "Re: Plans", 2, "a", "b")},
+			want: "a< c<a",
+		},
+		{
+			name: "replies to a missing message",
+			msgs: []Message{msg("b", "Re: Gone", 1, "gone"), msg("c", "Re: Gone", 2, "gone")},
+			want: "b< c<",
+		},
+		{
+			name: "In-Reply-To only",
+			msgs: []Message{msg("a", "Plans", 0), {ID: "b", MessageID: "b@example.com", Subject: "Re: Plans", InReplyTo: "a@example.com"}},
+			want: "a< b<a",
+		},
+		{
+			name: "reference loop",
+			msgs: []Message{msg("a", "Loop", 0, "b"), msg("b", "Loop", 1, "a")},
+			want: "b< a<b",
+		},
+		{
+			name: "duplicate Message-ID",
+			msgs: []Message{msg("a", "Plans", 0), {ID: "copy", MessageID: "a@example.com", Subject: "Plans", Date: msg("a", "", 0).Date}},
+			want: "a< copy<",
+		},
+		{
+			name: "unrelated",
+			msgs: []Message{msg("a", "Plans", 0), msg("b", "Lunch", 1)},
+			want: "a<\nb<",
+		},
+	} {
+		if got := layout(c.msgs); got != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestThreadGroupsBySubject(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msgs []Message
+		want string
+	}{
+		{
+			name: "reply without references",
+			msgs: []Message{msg("a", "Plans", 0), msg("b", "RE: [team] Plans", 1)},
+			want: "a< b<a",
+		},
+		{
+			name: "reply first",
+			msgs: []Message{msg("b", "Re: Plans", 1), msg("a", "Plans", 0)},
+			want: "a< b<a",
+		},
+		{
+			name: "two replies",
+			msgs: []Message{msg("b", "Re: Plans", 1), msg("c", "Aw: Plans", 2)},
+			want: "b< c<",
+		},
+		{
+			name: "forward",
+			msgs: []Message{msg("a", "Plans", 0), msg("b", "Fwd: Plans", 1)},
+			want: "a< b<",
+		},
+		{
+			name: "different subjects",
+			msgs: []Message{msg("a", "Plans", 0), msg("b", "Re: Lunch", 1)},
+			want: "a<\nb<",
+		},
+	} {
+		if got := layout(c.msgs); got != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	for _, c := range []struct {
+		in    string
+		want  string
+		reply bool
+	}{
+		{"Plans", "plans", false},
+		{"Re: Plans", "plans", true},
+		{"RE: re:  Plans", "plans", true},
+		{"Re[2]: Plans", "plans", true},
+		{"AW: Plans", "plans", true},
+		{"[golang-dev] Re: Plans", "plans", true},
+		{"Re: [golang-dev] Plans (fwd)", "plans", true},
+		{"Fwd: Plans", "plans", false},
+		{"Re:", "", true},
+		{"Regarding plans", "regarding plans", false},
+	} {
+		if got := BaseSubject(c.in); got != c.want {
+			t.Errorf("BaseSubject(%q) = %q, want %q", c.in, got, c.want)
+		}
+		if got := IsReply(c.in); got != c.reply {
+			t.Errorf("IsReply(%q) = %v, want %v", c.in, got, c.reply)
+		}
+	}
+}
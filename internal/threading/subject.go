@@ -0,0 +1,44 @@
+package threading
+
+import (
+	"regexp"
+	"strings"
+)
+
+// replyPrefix matches one reply or forward marker at the start of a subject,
+// including localized ones and counters such as "Re[2]:" or "Re^3:".
+var replyPrefix = regexp.MustCompile(`(?i)^(re|aw|sv|antw|odp|ynt|vs|fwd?|wg|tr|rv|enc)(\[\d+\]|\^\d+)?\s*:\s*`)
+
+// forwardPrefix is the subset of replyPrefix that marks a forward.
+var forwardPrefix = regexp.MustCompile(`(?i)^(fwd?|wg|tr|rv|enc)(\[\d+\]|\^\d+)?\s*:`)
+
+// listTag matches a mailing list tag such as "[golang-dev]".
+var listTag = regexp.MustCompile(`^\[[^\]]*\]\s*`)
+
+// BaseSubject normalizes a subject for comparison: reply and forward
+// prefixes, mailing list tags and a trailing "(fwd)" are removed, whitespace
+// is collapsed and the result is lowercased.
+func BaseSubject(subject string) string {
+	s := strings.Join(strings.Fields(subject), " ")
+	for {
+		trimmed := s
+		trimmed = listTag.ReplaceAllString(trimmed, "")
+		trimmed = replyPrefix.ReplaceAllString(trimmed, "")
+		trimmed = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(trimmed), "(fwd)"))
+		if trimmed == s {
+			break
+		}
+		s = trimmed
+	}
+	return strings.ToLower(s)
+}
+
+// IsReply reports whether subject starts with a reply marker, after any
+// mailing list tags. Forwards don't count as replies.
+func IsReply(subject string) bool {
+	s := strings.TrimSpace(subject)
+	for listTag.MatchString(s) {
+		s = listTag.ReplaceAllString(s, "")
+	}
+	return replyPrefix.MatchString(s) && !forwardPrefix.MatchString(s)
+}
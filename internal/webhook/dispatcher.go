@@ -0,0 +1,348 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/parsel-email/lib-go/logger"
+	"github.com/parsel-email/lib-go/metrics"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+const (
+	// DefaultInterval is how often the Dispatcher looks for due deliveries.
+	DefaultInterval = 2 * time.Second
+	// MaxAttempts is how many times a delivery is tried before it is dead.
+	MaxAttempts = 10
+	// Retention is how long delivered deliveries are kept.
+	Retention = 7 * 24 * time.Hour
+
+	requestTimeout = 10 * time.Second
+	batchSize      = 20
+	baseBackoff    = 30 * time.Second
+	maxBackoff     = 6 * time.Hour
+	pruneInterval  = time.Hour
+)
+
+// Dispatcher posts recorded events to their endpoints. Each delivery is
+// leased while it is being sent, so a delivery interrupted by a crash is
+// retried once its lease runs out: endpoints see every event at least once
+// and should use the delivery or event ID to ignore duplicates.
+type Dispatcher struct {
+	queries  *schema.Queries
+	client   *http.Client
+	interval time.Duration
+	now      func() time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher creates a Dispatcher for the deliveries recorded in db.
+func NewDispatcher(db database.Service) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		queries:  db.Queries(),
+		client:   NewClient(requestTimeout),
+		interval: DefaultInterval,
+		now:      time.Now,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start delivers due events in the background until Shutdown.
+func (d *Dispatcher) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.Run(d.ctx)
+	}()
+}
+
+// Run delivers due events every interval and prunes old deliveries every
+// hour until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	var pruned time.Time
+	for {
+		if _, err := d.DeliverDue(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			metrics.Errors.WithLabelValues("webhook_claim").Inc()
+			logger.Error(ctx, "Failed to claim webhook deliveries", "error", err)
+		}
+		if time.Since(pruned) >= pruneInterval {
+			pruned = time.Now()
+			if n, err := d.Prune(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				logger.Error(ctx, "Failed to prune webhook deliveries", "error", err)
+			} else if n > 0 {
+				logger.Info(ctx, "Pruned webhook deliveries", "count", n)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops the Dispatcher and waits until ctx is done for in-flight
+// requests to finish. Deliveries cut short are retried after a restart.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeliverDue sends the deliveries that are due, concurrently, and returns
+// how many it attempted.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	now := d.now().UTC()
+	due, err := d.queries.ClaimWebhookDeliveries(ctx, schema.ClaimWebhookDeliveriesParams{
+		LeaseUntil: now.Add(2 * requestTimeout),
+		Now:        now,
+		Limit:      batchSize,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, del := range due {
+		wg.Add(1)
+		go func(del schema.WebhookDelivery) {
+			defer wg.Done()
+			if err := d.deliver(ctx, del); err != nil {
+				metrics.Errors.WithLabelValues("webhook_record").Inc()
+				logger.Error(ctx, "Failed to record webhook delivery", "delivery_id", del.ID, "error", err)
+			}
+		}(del)
+	}
+	wg.Wait()
+	return len(due), nil
+}
+
+// Prune deletes deliveries delivered longer than Retention ago.
+func (d *Dispatcher) Prune(ctx context.Context) (int64, error) {
+	cutoff := d.now().UTC().Add(-Retention)
+	return d.queries.DeleteDeliveredWebhookDeliveries(ctx, sql.NullTime{Time: cutoff, Valid: true})
+}
+
+// deliver makes one attempt at a claimed delivery and records the outcome.
+// Only failures to record it are returned.
+func (d *Dispatcher) deliver(ctx context.Context, del schema.WebhookDelivery) error {
+	endpoint, err := d.queries.GetWebhookEndpointByID(ctx, del.EndpointID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Deleted along with its deliveries
+			return nil
+		}
+		return fmt.Errorf("failed to get webhook endpoint: %w", err)
+	}
+	if !endpoint.Enabled {
+		return d.fail(ctx, del, StatusDead, 0, "endpoint is disabled")
+	}
+
+	code, err := d.post(ctx, endpoint, del)
+	if err != nil && ctx.Err() != nil {
+		// Shutting down; the lease runs out and the delivery is retried
+		return nil
+	}
+	// Outcomes are recorded even if a shutdown starts meanwhile
+	ctx = context.WithoutCancel(ctx)
+	switch {
+	case err != nil:
+		metrics.Errors.WithLabelValues("webhook_delivery").Inc()
+		logger.Warn(ctx, "Webhook request failed", "delivery_id", del.ID, "endpoint_id", del.EndpointID, "error", err)
+		return d.retry(ctx, del, 0, Failure(err))
+	case code >= 200 && code <= 299:
+		return d.queries.MarkWebhookDelivered(ctx, schema.MarkWebhookDeliveredParams{
+			AttemptedAt: sql.NullTime{Time: d.now().UTC(), Valid: true},
+			StatusCode:  int64(code),
+			ID:          del.ID,
+		})
+	case code == http.StatusGone:
+		// The receiver asked not to be sent this again
+		return d.fail(ctx, del, StatusDead, code, answered(code))
+	default:
+		metrics.Errors.WithLabelValues("webhook_delivery").Inc()
+		return d.retry(ctx, del, code, answered(code))
+	}
+}
+
+// ErrAddressNotAllowed is returned when an endpoint's host resolves to an
+// address that isn't on the public internet.
+var ErrAddressNotAllowed = errors.New("endpoint address is not allowed")
+
+// NewClient returns a client for posting to addresses users chose, such as
+// endpoints and the webhooks of rules, with requests bounded by timeout. It
+// refuses addresses that aren't on the public internet and doesn't follow
+// redirects.
+func NewClient(timeout time.Duration) *http.Client {
+	return newClient(timeout, publicOnly)
+}
+
+// newClient returns a client that connects directly, not through a proxy,
+// so that control sees the endpoint's own address, and doesn't follow
+// redirects: a 3xx is retried like any other answer.
+func newClient(timeout time.Duration, control func(network, address string, c syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: control}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicOnly refuses connections to loopback, private, link-local and other
+// addresses that aren't on the public internet, so that endpoints can't be
+// used to reach the server's own network. It runs once the host is
+// resolved, for every address tried.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := ap.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return ErrAddressNotAllowed
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which is as private
+// as the others.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Failure returns the reason a request failed to record for the user, who
+// is told what went wrong without being shown the server's network errors.
+func Failure(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrAddressNotAllowed):
+		return ErrAddressNotAllowed.Error()
+	case errors.As(err, &dnsErr):
+		return "endpoint host could not be resolved"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "request timed out"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "endpoint refused the connection"
+	case errors.As(err, &certErr):
+		return "endpoint certificate is not valid"
+	case errors.As(err, &recordErr):
+		return "TLS handshake with endpoint failed"
+	}
+	return "request to endpoint failed"
+}
+
+func answered(code int) string {
+	return "endpoint answered " + strconv.Itoa(code) + " " + http.StatusText(code)
+}
+
+// post sends del to endpoint and returns the response status.
+func (d *Dispatcher) post(ctx context.Context, endpoint schema.WebhookEndpoint, del schema.WebhookDelivery) (int, error) {
+	body := []byte(del.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	now := d.now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mailroom-webhooks/1")
+	req.Header.Set(HeaderEvent, del.Event)
+	req.Header.Set(HeaderEventID, del.EventID)
+	req.Header.Set(HeaderDelivery, del.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, now, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	return resp.StatusCode, nil
+}
+
+// retry schedules the next attempt at del, or gives up on it once it has had
+// MaxAttempts.
+func (d *Dispatcher) retry(ctx context.Context, del schema.WebhookDelivery, code int, reason string) error {
+	if del.Attempts+1 >= MaxAttempts {
+		return d.fail(ctx, del, StatusDead, code, reason)
+	}
+	return d.fail(ctx, del, StatusPending, code, reason)
+}
+
+func (d *Dispatcher) fail(ctx context.Context, del schema.WebhookDelivery, status string, code int, reason string) error {
+	now := d.now().UTC()
+	next := now
+	if status == StatusPending {
+		next = now.Add(Backoff(int(del.Attempts) + 1))
+	} else {
+		logger.Warn(ctx, "Webhook delivery is dead", "delivery_id", del.ID, "endpoint_id", del.EndpointID, "reason", reason)
+	}
+	return d.queries.MarkWebhookFailed(ctx, schema.MarkWebhookFailedParams{
+		Status:         status,
+		NextAttemptAt:  next,
+		LastAttemptAt:  sql.NullTime{Time: now, Valid: true},
+		LastStatusCode: int64(code),
+		LastError:      reason,
+		ID:             del.ID,
+	})
+}
+
+// Backoff returns how long to wait after the given number of failed
+// attempts: 30s doubling each time up to 6h, plus up to 10% jitter so that
+// deliveries failing together don't retry together.
+func Backoff(attempts int) time.Duration {
+	wait := maxBackoff
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts < 20 {
+		if b := baseBackoff << (attempts - 1); b < maxBackoff {
+			wait = b
+		}
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait)/10+1))
+}
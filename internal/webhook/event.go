@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+)
+
+// payload is the JSON body posted for an event.
+type payload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Message summarizes a stored message in event data.
+type Message struct {
+	ID                string    `json:"id"`
+	InternetMessageID string    `json:"internet_message_id"`
+	Subject           string    `json:"subject"`
+	FromName          string    `json:"from_name"`
+	FromAddress       string    `json:"from_address"`
+	SentAt            time.Time `json:"sent_at"`
+	ReceivedAt        time.Time `json:"received_at"`
+	Size              int64     `json:"size"`
+	HasAttachments    bool      `json:"has_attachments"`
+}
+
+// NewMessage summarizes rec.
+func NewMessage(rec database.MessageRecord) Message {
+	return Message{
+		ID:                rec.Message.ID,
+		InternetMessageID: rec.Message.InternetMessageID,
+		Subject:           rec.Message.Subject,
+		FromName:          rec.Message.FromName,
+		FromAddress:       rec.Message.FromAddress,
+		SentAt:            rec.Message.SentAt,
+		ReceivedAt:        rec.Message.ReceivedAt,
+		Size:              rec.Message.Size,
+		HasAttachments:    rec.Message.HasAttachments,
+	}
+}
+
+// MessageLabeled is the data of a message.labeled event.
+type MessageLabeled struct {
+	MessageID string   `json:"message_id"`
+	Labels    []string `json:"labels"` // the labels added
+}
+
+// MessageDeleted is the data of a message.deleted event.
+type MessageDeleted struct {
+	MessageID string `json:"message_id"`
+}
+
+// RuleMatched is the data of a rule.matched event.
+type RuleMatched struct {
+	RuleID   string  `json:"rule_id"`
+	RuleName string  `json:"rule_name"`
+	Message  Message `json:"message"`
+}
+
+// PublishTx records an event for every enabled endpoint of userID that
+// subscribes to it. q should be bound to the transaction that makes the
+// change the event reports, so that the event is recorded if and only if the
+// change is.
+func PublishTx(ctx context.Context, q *schema.Queries, userID, event string, data interface{}) error {
+	endpoints, err := q.ListEnabledWebhookEndpointsByUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to list webhook endpoints: %w", err)
+	}
+	var body []byte
+	eventID := uuid.New().String()
+	now := time.Now().UTC()
+	for _, e := range endpoints {
+		if !subscribed(e.Events, event) {
+			continue
+		}
+		if body == nil {
+			body, err = json.Marshal(payload{ID: eventID, Type: event, CreatedAt: now, Data: data})
+			if err != nil {
+				return fmt.Errorf("failed to encode webhook payload: %w", err)
+			}
+		}
+		err := q.InsertWebhookDelivery(ctx, schema.InsertWebhookDeliveryParams{
+			ID:            uuid.New().String(),
+			EndpointID:    e.ID,
+			UserID:        userID,
+			EventID:       eventID,
+			Event:         event,
+			Payload:       string(body),
+			NextAttemptAt: now,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record webhook delivery: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+// Limits of ListDeliveries.
+const (
+	DefaultDeliveryLimit = 50
+	MaxDeliveryLimit     = 200
+)
+
+// Service stores users' webhook endpoints and their deliveries.
+type Service struct {
+	db database.Service
+}
+
+// New creates a Service.
+func New(db database.Service) *Service {
+	return &Service{db: db}
+}
+
+// List returns userID's endpoints, oldest first.
+func (s *Service) List(ctx context.Context, userID string) ([]Endpoint, error) {
+	rows, err := s.db.Queries().ListWebhookEndpointsByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook endpoints: %w", err)
+	}
+	list := make([]Endpoint, 0, len(rows))
+	for _, row := range rows {
+		e, err := newEndpoint(row)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// Get returns one of userID's endpoints.
+func (s *Service) Get(ctx context.Context, userID, id string) (Endpoint, error) {
+	row, err := s.db.Queries().GetWebhookEndpoint(ctx, schema.GetWebhookEndpointParams{ID: id, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Endpoint{}, ErrEndpointNotFound
+		}
+		return Endpoint{}, fmt.Errorf("failed to get webhook endpoint: %w", err)
+	}
+	return newEndpoint(row)
+}
+
+// Create registers an endpoint for userID with a new signing secret, which
+// the returned Endpoint carries. Errors wrap ErrInvalidEndpoint if p is not
+// valid.
+func (s *Service) Create(ctx context.Context, userID string, p Params) (Endpoint, error) {
+	if err := p.validate(); err != nil {
+		return Endpoint{}, err
+	}
+	events, err := encodeEvents(p.Events)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	id := uuid.New().String()
+	err = s.db.Queries().InsertWebhookEndpoint(ctx, schema.InsertWebhookEndpointParams{
+		ID:          id,
+		UserID:      userID,
+		Url:         p.URL,
+		Secret:      secret,
+		Events:      events,
+		Description: p.Description,
+		Enabled:     p.Enabled == nil || *p.Enabled,
+	})
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("failed to insert webhook endpoint: %w", err)
+	}
+	e, err := s.Get(ctx, userID, id)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	e.Secret = secret
+	return e, nil
+}
+
+// Update replaces the settings of one of userID's endpoints with p. The
+// secret is kept.
+func (s *Service) Update(ctx context.Context, userID, id string, p Params) (Endpoint, error) {
+	if err := p.validate(); err != nil {
+		return Endpoint{}, err
+	}
+	events, err := encodeEvents(p.Events)
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	n, err := s.db.Queries().UpdateWebhookEndpoint(ctx, schema.UpdateWebhookEndpointParams{
+		Url:         p.URL,
+		Events:      events,
+		Description: p.Description,
+		Enabled:     p.Enabled == nil || *p.Enabled,
+		ID:          id,
+		UserID:      userID,
+	})
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("failed to update webhook endpoint: %w", err)
+	}
+	if n == 0 {
+		return Endpoint{}, ErrEndpointNotFound
+	}
+	return s.Get(ctx, userID, id)
+}
+
+// Delete removes one of userID's endpoints along with its deliveries.
+func (s *Service) Delete(ctx context.Context, userID, id string) error {
+	n, err := s.db.Queries().DeleteWebhookEndpoint(ctx, schema.DeleteWebhookEndpointParams{ID: id, UserID: userID})
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook endpoint: %w", err)
+	}
+	if n == 0 {
+		return ErrEndpointNotFound
+	}
+	return nil
+}
+
+func encodeEvents(events []string) (string, error) {
+	if events == nil {
+		events = []string{}
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode webhook events: %w", err)
+	}
+	return string(b), nil
+}
+
+// ListDeliveries returns up to limit of the deliveries to one of userID's
+// endpoints, newest first. A non-empty status restricts them to that status;
+// StatusDead lists the dead letters.
+func (s *Service) ListDeliveries(ctx context.Context, userID, endpointID, status string, limit int) ([]Delivery, error) {
+	if _, err := s.Get(ctx, userID, endpointID); err != nil {
+		return nil, err
+	}
+
+	q := s.db.Queries()
+	var rows []schema.WebhookDelivery
+	var err error
+	switch status {
+	case "":
+		rows, err = q.ListWebhookDeliveries(ctx, schema.ListWebhookDeliveriesParams{
+			EndpointID: endpointID,
+			UserID:     userID,
+			Limit:      int64(limit),
+		})
+	case StatusPending, StatusDelivered, StatusDead:
+		rows, err = q.ListWebhookDeliveriesByStatus(ctx, schema.ListWebhookDeliveriesByStatusParams{
+			EndpointID: endpointID,
+			UserID:     userID,
+			Status:     status,
+			Limit:      int64(limit),
+		})
+	default:
+		return nil, fmt.Errorf("%w %q", ErrInvalidStatus, status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	list := make([]Delivery, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, newDelivery(row))
+	}
+	return list, nil
+}
+
+// Retry queues a dead delivery for one more attempt. If that attempt fails
+// the delivery is dead again.
+func (s *Service) Retry(ctx context.Context, userID, endpointID, id string) (Delivery, error) {
+	q := s.db.Queries()
+	n, err := q.RetryWebhookDelivery(ctx, schema.RetryWebhookDeliveryParams{
+		NextAttemptAt: time.Now().UTC(),
+		ID:            id,
+		EndpointID:    endpointID,
+		UserID:        userID,
+	})
+	if err != nil {
+		return Delivery{}, fmt.Errorf("failed to retry webhook delivery: %w", err)
+	}
+	row, err := q.GetWebhookDelivery(ctx, schema.GetWebhookDeliveryParams{ID: id, EndpointID: endpointID, UserID: userID})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Delivery{}, ErrDeliveryNotFound
+		}
+		return Delivery{}, fmt.Errorf("failed to get webhook delivery: %w", err)
+	}
+	if n == 0 {
+		return Delivery{}, ErrDeliveryNotDead
+	}
+	return newDelivery(row), nil
+}
+
+// Process publishes message.received for a stored message. It runs before
+// the rules and Sieve scripts, so their events follow it.
+func (s *Service) Process(ctx context.Context, rec database.MessageRecord, _ mailstore.Envelope) error {
+	return s.db.WithTx(ctx, func(q *schema.Queries) error {
+		return PublishTx(ctx, q, rec.Message.UserID, EventMessageReceived, NewMessage(rec))
+	})
+}
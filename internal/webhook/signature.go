@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers set on every delivery.
+const (
+	HeaderSignature = "Mailroom-Signature" // t=<unix time>,v1=<hex HMAC-SHA256>
+	HeaderTimestamp = "Mailroom-Timestamp" // unix time the request was signed
+	HeaderEvent     = "Mailroom-Event"     // event type
+	HeaderEventID   = "Mailroom-Event-Id"  // same for every endpoint and attempt
+	HeaderDelivery  = "Mailroom-Delivery"  // same for every attempt
+)
+
+// DefaultTolerance is how old a signature Verify accepts by default.
+const DefaultTolerance = 5 * time.Minute
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Sign returns the signature header value for body sent at t. The signed
+// content is the timestamp, a dot and the body, so a captured request can't
+// be replayed with a different timestamp.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + mac(secret, ts, body)
+}
+
+func mac(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks the signature of a delivery received at now, rejecting ones
+// signed more than tolerance before or after it. Receivers written in Go can
+// use it as is; the scheme is documented on Sign.
+func Verify(secret string, header http.Header, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header.Get(HeaderSignature), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return ErrInvalidSignature
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return ErrInvalidSignature
+	}
+	want := mac(secret, ts, body)
+	for _, sig := range sigs {
+		if hmac.Equal([]byte(sig), []byte(want)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
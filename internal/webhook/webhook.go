@@ -0,0 +1,175 @@
+// Package webhook delivers events about users' mail to the HTTP endpoints
+// they register. Events are recorded in the database in the same transaction
+// as the change they report, then posted by a Dispatcher with an HMAC-SHA256
+// signature, retrying with exponential backoff. Deliveries that run out of
+// attempts are kept as dead letters that can be retried by hand.
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+)
+
+var (
+	ErrInvalidEndpoint  = errors.New("invalid webhook endpoint")
+	ErrEndpointNotFound = errors.New("webhook endpoint not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrDeliveryNotDead  = errors.New("webhook delivery is not dead")
+	ErrInvalidStatus    = errors.New("invalid webhook delivery status")
+)
+
+// Event types.
+const (
+	EventMessageReceived = "message.received"
+	EventMessageLabeled  = "message.labeled"
+	EventMessageDeleted  = "message.deleted"
+	EventRuleMatched     = "rule.matched"
+)
+
+// Events lists every event type an endpoint can subscribe to.
+var Events = []string{EventMessageReceived, EventMessageLabeled, EventMessageDeleted, EventRuleMatched}
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Endpoint is a registered webhook endpoint as the API shows it. The secret
+// is only shown when the endpoint is created.
+type Endpoint struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Description string    `json:"description"`
+	Enabled     bool      `json:"enabled"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Params are the user-supplied fields of an endpoint. An empty Events
+// subscribes to every event.
+type Params struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Description string   `json:"description"`
+	Enabled     *bool    `json:"enabled"` // nil means true
+}
+
+// validate normalizes p and checks that it describes a usable endpoint.
+func (p *Params) validate() error {
+	p.URL = strings.TrimSpace(p.URL)
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an http or https URL", ErrInvalidEndpoint)
+	}
+	for _, e := range p.Events {
+		if !known(e) {
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidEndpoint, e)
+		}
+	}
+	p.Description = strings.TrimSpace(p.Description)
+	return nil
+}
+
+func known(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func newEndpoint(row schema.WebhookEndpoint) (Endpoint, error) {
+	e := Endpoint{
+		ID:          row.ID,
+		URL:         row.Url,
+		Description: row.Description,
+		Enabled:     row.Enabled,
+		CreatedAt:   row.CreatedAt,
+		UpdatedAt:   row.UpdatedAt,
+	}
+	if err := json.Unmarshal([]byte(row.Events), &e.Events); err != nil {
+		return Endpoint{}, fmt.Errorf("failed to decode webhook events: %w", err)
+	}
+	return e, nil
+}
+
+// subscribed reports whether an endpoint with the given JSON events column
+// wants event.
+func subscribed(events, event string) bool {
+	var list []string
+	if err := json.Unmarshal([]byte(events), &list); err != nil {
+		return false
+	}
+	if len(list) == 0 {
+		return true
+	}
+	for _, e := range list {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// newSecret returns a random signing secret.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Delivery is one attempt record of an event for an endpoint, as the API
+// shows it.
+type Delivery struct {
+	ID             string          `json:"id"`
+	EventID        string          `json:"event_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int64           `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at,omitempty"`
+	LastStatusCode int64           `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+func newDelivery(row schema.WebhookDelivery) Delivery {
+	d := Delivery{
+		ID:             row.ID,
+		EventID:        row.EventID,
+		Event:          row.Event,
+		Payload:        json.RawMessage(row.Payload),
+		Status:         row.Status,
+		Attempts:       row.Attempts,
+		LastStatusCode: row.LastStatusCode,
+		LastError:      row.LastError,
+		CreatedAt:      row.CreatedAt,
+	}
+	if row.Status == StatusPending {
+		d.NextAttemptAt = &row.NextAttemptAt
+	}
+	if row.LastAttemptAt.Valid {
+		d.LastAttemptAt = &row.LastAttemptAt.Time
+	}
+	if row.DeliveredAt.Valid {
+		d.DeliveredAt = &row.DeliveredAt.Time
+	}
+	return d
+}
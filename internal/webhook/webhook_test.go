@@ -0,0 +1,432 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parsel-email/mailroom/db/lib/schema"
+	"github.com/parsel-email/mailroom/internal/blobstore"
+	"github.com/parsel-email/mailroom/internal/database"
+	"github.com/parsel-email/mailroom/internal/database/dbtest"
+	"github.com/parsel-email/mailroom/internal/jobs"
+	"github.com/parsel-email/mailroom/internal/mailstore"
+)
+
+const testRaw = "From: Alice <alice@example.org>\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Lunch\r\n" +
+	"Message-ID: <lunch@example.org>\r\n" +
+	"\r\n" +
+	"Noon?\r\n"
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"e1"}`)
+	signedAt := time.Unix(1700000000, 0)
+	h := http.Header{}
+	h.Set(HeaderSignature, Sign("secret", signedAt, body))
+
+	if err := Verify("secret", h, body, signedAt.Add(time.Minute), DefaultTolerance); err != nil {
+		t.Errorf("valid signature: %v", err)
+	}
+	for name, check := range map[string]func() error{
+		"wrong secret": func() error { return Verify("other", h, body, signedAt, DefaultTolerance) },
+		"changed body": func() error { return Verify("secret", h, []byte(`{"id":"e2"}`), signedAt, DefaultTolerance) },
+		"too old":      func() error { return Verify("secret", h, body, signedAt.Add(time.Hour), DefaultTolerance) },
+		"missing":      func() error { return Verify("secret", http.Header{}, body, signedAt, DefaultTolerance) },
+	} {
+		if err := check(); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: got %v, want ErrInvalidSignature", name, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, c := range []struct {
+		attempts int
+		min      time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{5, 8 * time.Minute},
+		{12, maxBackoff},
+		{64, maxBackoff},
+	} {
+		got := Backoff(c.attempts)
+		if got < c.min || got > c.min+c.min/10 {
+			t.Errorf("Backoff(%d) = %v, want %v plus up to 10%%", c.attempts, got, c.min)
+		}
+	}
+}
+
+func TestCRUD(t *testing.T) {
+	ctx := context.Background()
+	s := New(dbtest.New(t))
+
+	for _, p := range []Params{
+		{URL: "ftp://example.org/hook"},
+		{URL: "/hook"},
+		{URL: "https://example.org/hook", Events: []string{"message.read"}},
+	} {
+		if _, err := s.Create(ctx, "u1", p); !errors.Is(err, ErrInvalidEndpoint) {
+			t.Errorf("Create(%+v) = %v, want ErrInvalidEndpoint", p, err)
+		}
+	}
+
+	e, err := s.Create(ctx, "u1", Params{URL: " https://example.org/hook ", Description: "CRM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Secret == "" || e.URL != "https://example.org/hook" || !e.Enabled || len(e.Events) != 0 {
+		t.Errorf("created %+v", e)
+	}
+	got, err := s.Get(ctx, "u1", e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Secret != "" {
+		t.Error("Get shows the secret")
+	}
+	if _, err := s.Get(ctx, "u2", e.ID); !errors.Is(err, ErrEndpointNotFound) {
+		t.Errorf("other user's Get = %v, want ErrEndpointNotFound", err)
+	}
+
+	disabled := false
+	got, err = s.Update(ctx, "u1", e.ID, Params{URL: "https://example.org/v2", Events: []string{EventMessageDeleted}, Enabled: &disabled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL != "https://example.org/v2" || got.Enabled || len(got.Events) != 1 {
+		t.Errorf("updated %+v", got)
+	}
+
+	if err := s.Delete(ctx, "u1", e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "u1", e.ID); !errors.Is(err, ErrEndpointNotFound) {
+		t.Errorf("second Delete = %v, want ErrEndpointNotFound", err)
+	}
+}
+
+// receiver is an endpoint that checks signatures and answers with status.
+type receiver struct {
+	*httptest.Server
+	secret string
+	now    func() time.Time // when requests are received
+
+	mu     sync.Mutex
+	status int
+	got    []payload
+}
+
+func newReceiver(t *testing.T) *receiver {
+	rc := &receiver{status: http.StatusOK, now: time.Now}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		if err := Verify(rc.secret, r.Header, body, rc.now(), DefaultTolerance); err != nil {
+			t.Errorf("delivery %s: %v", r.Header.Get(HeaderDelivery), err)
+		}
+		var p payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Errorf("delivery body %s: %v", body, err)
+		}
+		if p.Type != r.Header.Get(HeaderEvent) || p.ID != r.Header.Get(HeaderEventID) {
+			t.Errorf("headers %v don't match payload %s", r.Header, body)
+		}
+		rc.got = append(rc.got, p)
+		w.WriteHeader(rc.status)
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+func (rc *receiver) setStatus(code int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.status = code
+}
+
+func (rc *receiver) received() []payload {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]payload(nil), rc.got...)
+}
+
+func newTestStore(t *testing.T) (database.Service, *mailstore.Store) {
+	t.Helper()
+	db := dbtest.New(t)
+	fsb, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mailstore.New(db, blobstore.New(db, fsb))
+	store.Use(New(db))
+	return db, store
+}
+
+func TestDeliver(t *testing.T) {
+	ctx := context.Background()
+	db, store := newTestStore(t)
+	s := New(db)
+
+	rc := newReceiver(t)
+	all, err := s.Create(ctx, "u1", Params{URL: rc.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.secret = all.Secret
+	// Subscribed to another event, so it is sent nothing
+	if _, err := s.Create(ctx, "u1", Params{URL: rc.URL + "/deleted", Events: []string{EventMessageDeleted}}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WithTx(ctx, func(q *schema.Queries) error {
+		return PublishTx(ctx, q, "u1", EventMessageLabeled, MessageLabeled{MessageID: id, Labels: []string{"Food"}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDispatcher(db)
+	if n, err := d.DeliverDue(ctx); err != nil || n != 2 {
+		t.Fatalf("DeliverDue = %d, %v; want 2 deliveries", n, err)
+	}
+	if n, err := d.DeliverDue(ctx); err != nil || n != 0 {
+		t.Errorf("second DeliverDue = %d, %v; want nothing left", n, err)
+	}
+
+	types := map[string]bool{}
+	for _, p := range rc.received() {
+		types[p.Type] = true
+	}
+	if len(types) != 2 || !types[EventMessageReceived] || !types[EventMessageLabeled] {
+		t.Errorf("received %v", types)
+	}
+
+	list, err := s.ListDeliveries(ctx, "u1", all.ID, StatusDelivered, DefaultDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Attempts != 1 || list[0].LastStatusCode != 200 || list[0].DeliveredAt == nil {
+		t.Errorf("delivered %+v", list)
+	}
+	if _, err := s.ListDeliveries(ctx, "u1", all.ID, "lost", DefaultDeliveryLimit); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("unknown status: got %v, want ErrInvalidStatus", err)
+	}
+
+	// Delivered deliveries are pruned after a week
+	d.now = func() time.Time { return time.Now().Add(Retention + time.Hour) }
+	if n, err := d.Prune(ctx); err != nil || n != 2 {
+		t.Errorf("Prune = %d, %v; want 2", n, err)
+	}
+}
+
+func TestDeliverQueued(t *testing.T) {
+	ctx := context.Background()
+	db, store := newTestStore(t)
+	queue := jobs.New(db)
+	store.SetQueue(queue)
+	s := New(db)
+
+	e, err := s.Create(ctx, "u1", Params{URL: "https://example.org/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.ListDeliveries(ctx, "u1", e.ID, "", DefaultDeliveryLimit)
+	if err != nil || len(list) != 0 {
+		t.Fatalf("published before the job ran: %+v, %v", list, err)
+	}
+
+	if ok, err := queue.RunNext(ctx); err != nil || !ok {
+		t.Fatalf("RunNext = %t, %v", ok, err)
+	}
+	list, err = s.ListDeliveries(ctx, "u1", e.ID, "", DefaultDeliveryLimit)
+	if err != nil || len(list) != 1 || list[0].Event != EventMessageReceived {
+		t.Errorf("after the job ran: %+v, %v", list, err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	db, store := newTestStore(t)
+	s := New(db)
+
+	rc := newReceiver(t)
+	rc.setStatus(http.StatusServiceUnavailable)
+	e, err := s.Create(ctx, "u1", Params{URL: rc.URL, Events: []string{EventMessageReceived}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.secret = e.Secret
+	if _, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Now()
+	d := newTestDispatcher(db)
+	d.now = func() time.Time { return clock }
+	rc.now = d.now
+	for i := 1; i <= MaxAttempts; i++ {
+		if n, err := d.DeliverDue(ctx); err != nil || n != 1 {
+			t.Fatalf("attempt %d: DeliverDue = %d, %v", i, n, err)
+		}
+		// Not due again until the backoff has passed
+		if n, _ := d.DeliverDue(ctx); n != 0 {
+			t.Fatalf("attempt %d retried without backoff", i)
+		}
+		clock = clock.Add(Backoff(i) * 2)
+	}
+	if n, _ := d.DeliverDue(ctx); n != 0 {
+		t.Fatal("dead delivery was retried")
+	}
+
+	dead, err := s.ListDeliveries(ctx, "u1", e.ID, StatusDead, DefaultDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != MaxAttempts || dead[0].LastStatusCode != 503 || dead[0].LastError == "" {
+		t.Fatalf("dead letters %+v", dead)
+	}
+	if len(rc.received()) != MaxAttempts {
+		t.Errorf("endpoint got %d requests, want %d", len(rc.received()), MaxAttempts)
+	}
+
+	// A retried dead letter gets one more attempt
+	rc.setStatus(http.StatusNoContent)
+	if _, err := s.Retry(ctx, "u1", e.ID, dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Retry(ctx, "u1", e.ID, dead[0].ID); !errors.Is(err, ErrDeliveryNotDead) {
+		t.Errorf("retrying a pending delivery = %v, want ErrDeliveryNotDead", err)
+	}
+	if _, err := s.Retry(ctx, "u1", e.ID, "missing"); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Errorf("retrying a missing delivery = %v, want ErrDeliveryNotFound", err)
+	}
+	if n, err := d.DeliverDue(ctx); err != nil || n != 1 {
+		t.Fatalf("DeliverDue after retry = %d, %v", n, err)
+	}
+	list, err := s.ListDeliveries(ctx, "u1", e.ID, "", DefaultDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Status != StatusDelivered {
+		t.Errorf("deliveries %+v", list)
+	}
+}
+
+func TestGone(t *testing.T) {
+	ctx := context.Background()
+	db, store := newTestStore(t)
+	s := New(db)
+
+	rc := newReceiver(t)
+	rc.setStatus(http.StatusGone)
+	e, err := s.Create(ctx, "u1", Params{URL: rc.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.secret = e.Secret
+	if _, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTestDispatcher(db).DeliverDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := s.ListDeliveries(ctx, "u1", e.ID, StatusDead, DefaultDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 1 {
+		t.Errorf("a 410 should kill the delivery at once; got %+v", dead)
+	}
+}
+
+// newTestDispatcher returns a Dispatcher that may post to the test
+// receivers, which listen on loopback.
+func newTestDispatcher(db database.Service) *Dispatcher {
+	d := NewDispatcher(db)
+	d.client = newClient(requestTimeout, nil)
+	return d
+}
+
+func TestUnsafeEndpoints(t *testing.T) {
+	ctx := context.Background()
+	db, store := newTestStore(t)
+	s := New(db)
+
+	rc := newReceiver(t)
+	e, err := s.Create(ctx, "u1", Params{URL: rc.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.secret = e.Secret
+	if _, err := store.Deliver(ctx, mailstore.Delivery{UserID: "u1", Raw: []byte(testRaw)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loopback isn't public
+	if n, err := NewDispatcher(db).DeliverDue(ctx); err != nil || n != 1 {
+		t.Fatalf("DeliverDue = %d, %v", n, err)
+	}
+	if got := rc.received(); len(got) != 0 {
+		t.Fatalf("a loopback endpoint got %d requests", len(got))
+	}
+	list, err := s.ListDeliveries(ctx, "u1", e.ID, "", DefaultDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Status != StatusPending || list[0].LastError != ErrAddressNotAllowed.Error() {
+		t.Fatalf("deliveries %+v", list)
+	}
+
+	// Redirects aren't followed
+	rc.setStatus(http.StatusFound)
+	d := newTestDispatcher(db)
+	d.now = func() time.Time { return time.Now().Add(time.Hour) }
+	rc.now = d.now
+	if n, err := d.DeliverDue(ctx); err != nil || n != 1 {
+		t.Fatalf("DeliverDue = %d, %v", n, err)
+	}
+	list, err = s.ListDeliveries(ctx, "u1", e.ID, "", DefaultDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Status != StatusPending || list[0].LastStatusCode != http.StatusFound {
+		t.Errorf("deliveries %+v", list)
+	}
+
+	for addr, allowed := range map[string]bool{
+		"93.184.216.34:443":    true,
+		"[2606:4700::1]:443":   true,
+		"127.0.0.1:80":         false,
+		"10.1.2.3:80":          false,
+		"192.168.0.1:80":       false,
+		"169.254.169.254:80":   false,
+		"100.64.0.1:80":        false,
+		"0.0.0.0:80":           false,
+		"[::1]:80":             false,
+		"[fe80::1]:80":         false,
+		"[fd00::1]:80":         false,
+		"[::ffff:10.0.0.1]:80": false,
+	} {
+		if err := publicOnly("tcp", addr, nil); (err == nil) != allowed {
+			t.Errorf("publicOnly(%s) = %v", addr, err)
+		}
+	}
+}